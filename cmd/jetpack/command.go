@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha512"
 	stderrors "errors"
 	"flag"
 	"fmt"
@@ -189,31 +188,20 @@ func cmdWrapPodPrepare0(cmd func(*jetpack.Pod) error) func([]string) error {
 	}
 }
 
-const hashSize = sha512.Size*2 + len("sha512-")
-
 func getImage(name string, localOnly bool) (*jetpack.Image, error) {
-	if h, err := types.NewHash(name); err == nil {
-		if len(name) < hashSize {
-			// Short hash. Iterate over images, return first prefix match.
-			// FIXME: what about multiple matches?
-			name = strings.ToLower(name)
-			if imgs, err := Host.Images(); err != nil {
-				return nil, errors.Trace(err)
-			} else {
-				for _, img := range imgs {
-					if strings.HasPrefix(img.Hash.String(), name) {
-						return img, nil
-					}
-				}
-				return nil, jetpack.ErrNotFound
-			}
+	if _, err := types.NewHash(name); err == nil {
+		return Host.GetImageByHash(name)
+	}
+	// Bare hex is an ID prefix, unless no image ID has it
+	if name != "" && strings.Trim(name, "0123456789abcdefABCDEF") == "" {
+		if img, err := Host.GetImageByHash(name); errors.Cause(err) != jetpack.ErrNotFound {
+			return img, errors.Trace(err)
 		}
-		return Host.GetImage(*h, "", nil)
 	}
 	if name, labels, err := acutil.ParseImageName(name); err != nil {
 		return nil, errors.Trace(err)
 	} else if localOnly {
-		return Host.GetLocalImage(types.Hash{}, name, labels)
+		return Host.GetImageByName(name, labels)
 	} else {
 		return Host.GetImage(types.Hash{}, name, labels)
 	}
@@ -236,6 +224,9 @@ func getPodManifest(args []string) (*schema.PodManifest, error) {
 	} else if pm, err := Host.ReifyPodManifest(thePodManifest); err != nil {
 		return nil, errors.Trace(err)
 	} else {
+		if flEphemeral {
+			jetpack.SetEphemeral(pm)
+		}
 		return pm, nil
 	}
 }
@@ -253,7 +244,7 @@ func getOrPreparePod(args []string) (*jetpack.Pod, error) {
 	default:
 		if pm, err := getPodManifest(args); err != nil {
 			return nil, err
-		} else if pod, err := Host.CreatePod(pm); err != nil {
+		} else if pod, err := Host.CreatePod(pm, &jetpack.CreateOptions{IgnoreLimits: flIgnoreLimits}); err != nil {
 			return nil, err
 		} else {
 			if SaveID != "" {
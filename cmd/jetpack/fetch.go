@@ -1,24 +1,47 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
+	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
 
 	"github.com/3ofcoins/jetpack/lib/acutil"
 	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/jetpack"
 )
 
 func init() {
-	AddCommand("fetch NAME", "Discover and fetch an image", cmdFetch, flFetch)
-	AddCommand("import LOCATION", "Import an image directly from location", cmdImport, flImport)
+	AddCommand("fetch [-insecure] [-discover-keys] NAME|docker://REFERENCE", "Discover and fetch an image", cmdFetch, flFetch)
+	AddCommand("import [-sig LOCATION] [-insecure] [-discover-keys] [-docker [-docker-ref REFERENCE]] [-oci] [-dir [-manifest FILE]] LOCATION", "Import an image directly from location, or stdin if it is -", cmdImport, flImport)
+}
+
+var flInsecure bool
+
+func flInsecureFlag(fl *flag.FlagSet) {
+	fl.BoolVar(&flInsecure, "insecure", false, "Import images without signature (needs allow.no-signature)")
+}
+
+// Returns options of fetching and importing images from command line
+// flags, showing progress on stderr.
+func imageOptions() *jetpack.ImageOptions {
+	return &jetpack.ImageOptions{
+		AllowUnsigned: flInsecure,
+		ConfirmKey:    discoverKeys(),
+		Progress:      fetch.ProgressBar(os.Stderr),
+	}
 }
 
 func flFetch(fl *flag.FlagSet) {
 	SaveIDFlag(fl)
+	flInsecureFlag(fl)
+	flDiscoverKeysFlag(fl)
 }
 
 func cmdFetch(args []string) error {
@@ -32,18 +55,25 @@ func cmdFetch(args []string) error {
 		}
 	}
 
+	imgOpts := imageOptions()
 	for _, name := range args {
-		if name, labels, err := acutil.ParseImageName(name); err != nil {
+		var img *jetpack.Image
+		var err error
+		if strings.HasPrefix(name, "docker://") {
+			img, err = Host.FetchDockerImage(strings.TrimPrefix(name, "docker://"), imgOpts)
+		} else if name, labels, perr := acutil.ParseImageName(name); perr != nil {
+			err = perr
+		} else {
+			img, err = Host.FetchImage(types.Hash{}, name, labels, imgOpts)
+		}
+		if err != nil {
 			return errors.Trace(err)
-		} else if img, err := Host.FetchImage(types.Hash{}, name, labels); err != nil {
+		}
+		if idf != nil {
+			fmt.Fprintln(idf, img.Hash)
+		}
+		if err := cmdShowImage(img); err != nil {
 			return errors.Trace(err)
-		} else {
-			if idf != nil {
-				fmt.Fprintln(idf, img.Hash)
-			}
-			if err := cmdShowImage(img); err != nil {
-				return errors.Trace(err)
-			}
 		}
 	}
 
@@ -52,11 +82,25 @@ func cmdFetch(args []string) error {
 
 var flImportName types.ACIdentifier
 var flImportSignature string
+var flImportDocker bool
+var flImportDockerRef string
+var flImportOCI bool
+var flImportDir bool
+var flImportManifest string
+var flImportLabels sliceFlag
 
 func flImport(fl *flag.FlagSet) {
 	SaveIDFlag(fl)
-	fl.Var(&flImportName, "name", "Name of imported image (for signature check)")
+	fl.Var(&flImportName, "name", "Name of imported image (for signature check; of an OCI layout)")
 	fl.StringVar(&flImportSignature, "sig", "", "Location of signature")
+	fl.BoolVar(&flImportDocker, "docker", false, "LOCATION is a docker-save archive")
+	fl.StringVar(&flImportDockerRef, "docker-ref", "", "Reference of the Docker image (default: archive's first tag)")
+	fl.BoolVar(&flImportOCI, "oci", false, "LOCATION is an OCI image layout directory, optionally followed by :TAG")
+	fl.BoolVar(&flImportDir, "dir", false, "LOCATION is a directory tree to use as rootfs")
+	fl.StringVar(&flImportManifest, "manifest", "", "Image manifest for -dir (default: generated from -name and -label)")
+	fl.Var(&flImportLabels, "label", "Label NAME=VALUE of image generated with -dir (can be repeated)")
+	flInsecureFlag(fl)
+	flDiscoverKeysFlag(fl)
 }
 
 func cmdImport(args []string) error {
@@ -74,26 +118,95 @@ func cmdImport(args []string) error {
 		}
 	}
 
-	aci, err := fetch.OpenLocation(args[0])
+	imgOpts := imageOptions()
+	if flImportDir {
+		img, err := importDir(args[0], imgOpts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if idf != nil {
+			fmt.Fprintln(idf, img.Hash)
+		}
+		return cmdShowImage(img)
+	}
+	if flImportDocker || flImportOCI {
+		var img *jetpack.Image
+		var err error
+		if flImportOCI {
+			dir, tag := args[0], ""
+			if i := strings.LastIndex(dir, ":"); i > strings.LastIndex(dir, "/") {
+				dir, tag = dir[:i], dir[i+1:]
+			}
+			img, err = Host.ImportOCILayout(dir, tag, flImportName, imgOpts)
+		} else {
+			img, err = Host.ImportDockerArchive(args[0], flImportDockerRef, imgOpts)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if idf != nil {
+			fmt.Fprintln(idf, img.Hash)
+		}
+		return cmdShowImage(img)
+	}
+
+	opts, err := Host.FetchOptions()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	var asc *os.File
+	opts.Progress = imgOpts.Progress
+	importOpts := &jetpack.ImportOptions{ImageOptions: *imgOpts, Name: flImportName}
 	if flImportSignature != "" {
-		if asc_, err := fetch.OpenLocation(flImportSignature); err != nil {
+		if asc, err := opts.OpenLocation(flImportSignature); err != nil {
 			return errors.Trace(err)
 		} else {
-			asc = asc_
+			defer asc.Close()
+			importOpts.Signature = asc
 		}
 	}
 
-	if img, err := Host.ImportImage(flImportName, aci, asc); err != nil {
+	var img *jetpack.Image
+	if strings.Contains(args[0], "://") {
+		var aci *os.File
+		if aci, err = opts.OpenLocation(args[0]); err != nil {
+			return errors.Trace(err)
+		}
+		defer aci.Close()
+		importOpts.Source = args[0]
+		img, err = Host.ImportImage(aci, importOpts)
+	} else {
+		// Local path, or - for stdin
+		img, err = Host.ImportImageFile(args[0], importOpts)
+	}
+	if err != nil {
 		return errors.Trace(err)
+	}
+	if idf != nil {
+		fmt.Fprintln(idf, img.Hash)
+	}
+	return cmdShowImage(img)
+}
+
+// Imports directory tree with manifest from -manifest, or generated
+// from -name and -label.
+func importDir(dir string, imgOpts *jetpack.ImageOptions) (*jetpack.Image, error) {
+	var manifest schema.ImageManifest
+	opts := &jetpack.FSImportOptions{ImageOptions: *imgOpts}
+	if flImportManifest != "" {
+		if bb, err := ioutil.ReadFile(flImportManifest); err != nil {
+			return nil, errors.Trace(err)
+		} else if err := json.Unmarshal(bb, &manifest); err != nil {
+			return nil, errors.Annotatef(err, "Parsing %v", flImportManifest)
+		}
 	} else {
-		if idf != nil {
-			fmt.Fprintln(idf, img.Hash)
+		opts.GenerateManifest = true
+		manifest.Name = flImportName
+		labels, err := parseLabels(flImportLabels)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
-		return cmdShowImage(img)
+		manifest.Labels = labels
 	}
+	return Host.ImportImageFromFS(dir, manifest, opts)
 }
@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
 
 	"github.com/3ofcoins/jetpack/lib/acutil"
 )
@@ -22,6 +25,23 @@ func (sf *sliceFlag) Set(v string) error {
 	return nil
 }
 
+// Parses NAME=VALUE labels given with a repeated flag.
+func parseLabels(labels sliceFlag) (types.Labels, error) {
+	var rv types.Labels
+	for _, label := range labels {
+		pieces := strings.SplitN(label, "=", 2)
+		if len(pieces) != 2 {
+			return nil, errors.Errorf("Invalid label %#v (NAME=VALUE)", label)
+		}
+		name, err := types.NewACIdentifier(pieces[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "Invalid label %#v", label)
+		}
+		rv = append(rv, types.Label{Name: *name, Value: pieces[1]})
+	}
+	return rv, nil
+}
+
 // Command line flags used by different commands
 
 var SaveID string
@@ -38,6 +58,10 @@ func QuietFlag(fl *flag.FlagSet, desc string) {
 
 var thePodManifest = schema.BlankPodManifest()
 
+var flIgnoreLimits, flEphemeral bool
+
 func flPodManifest(fl *flag.FlagSet) {
 	acutil.PodManifestFlags(fl, thePodManifest)
+	fl.BoolVar(&flIgnoreLimits, "ignore-limits", false, "Create pod even if host limits are exceeded")
+	fl.BoolVar(&flEphemeral, "ephemeral", false, "Mount images read-only instead of cloning them; nothing written outlives the pod's run")
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/juju/errors"
 
@@ -11,11 +19,57 @@ import (
 )
 
 func init() {
-	AddCommand("init", "Initialize host", cmdWrapErr(cmdInit), nil)
-	AddCommand("config [VAR...]", "Show configuration", cmdConfig, nil)
+	AddCommand("init [DATASET]", "Initialize host, or check an initialized one", cmdInit, flInit)
+	AddCommand("config [-schema|-effective] [VAR...]", "Show configuration", cmdConfig, flConfig)
+	AddCommand("metrics", "Serve Prometheus metrics on metrics.listen address", cmdWrapErr(cmdMetrics), nil)
+	AddCommand("api", "Serve HTTP API on api.socket (and metadata with mds.embed)", cmdWrapErr(cmdAPI), nil)
+	AddCommand("prune [-n] [-grace DURATION]", "Destroy stopped pods, unused images, and orphaned datasets", cmdPrune, flPrune)
+	AddCommand("gc-images [-n] [-min-age DURATION]", "Destroy images that no pod needs", cmdGCImages, flGCImages)
+	AddCommand("export-state FILE", "Export pods and host state for disaster recovery (- for stdout)", cmdExportState, nil)
+	AddCommand("restore-state [-fetch] FILE", "Recreate pods from exported state (- for stdin)", cmdRestoreState, flRestoreState)
+	AddCommand("record-stats", "Record pods' resource usage every stats.interval", cmdWrapErr(cmdRecordStats), nil)
+	AddCommand("rctl-event RULE [PID]", "Record pod's rctl rule match reported by devd", cmdRctlEvent, nil)
+	AddCommand("reconcile-limits", "Bring running pods' rctl rules in line with their limits", cmdWrapErr(cmdReconcileLimits), nil)
+}
+
+var flConfigSchema, flConfigEffective bool
+
+func flConfig(fl *flag.FlagSet) {
+	fl.BoolVar(&flConfigSchema, "schema", false, "List known properties with their types and defaults")
+	fl.BoolVar(&flConfigEffective, "effective", false, "List properties with their values and where they're set")
 }
 
 func cmdConfig(args []string) error {
+	if flConfigSchema {
+		if len(args) > 0 {
+			return ErrUsage
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tDEFAULT")
+		for _, ps := range Host.PropertySchema() {
+			name := ps.Name
+			if strings.HasSuffix(name, ".") {
+				name += "*"
+			}
+			def := ps.Default
+			if ps.Required && def == "" {
+				def = "(required)"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", name, ps.Type, def)
+		}
+		return tw.Flush()
+	}
+	if flConfigEffective {
+		if len(args) > 0 {
+			return ErrUsage
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVALUE\tSOURCE")
+		for _, cv := range Host.EffectiveConfig() {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", cv.Name, cv.Value, cv.Source)
+		}
+		return tw.Flush()
+	}
 	if len(args) == 0 {
 		lines := strings.Split(jetpack.Config().String(), "\n")
 		sort.Strings(lines)
@@ -32,6 +86,267 @@ func cmdConfig(args []string) error {
 	return nil
 }
 
-func cmdInit() error {
-	return Host.Initialize()
+var flInitOptions jetpack.InitOptions
+
+func flInit(fl *flag.FlagSet) {
+	fl.StringVar(&flInitOptions.Mountpoint, "mountpoint", "", "Mountpoint of the root dataset (default: root.zfs.mountpoint)")
+	fl.BoolVar(&flInitOptions.Fix, "fix", false, "Fix differences found on an initialized host")
+}
+
+func cmdInit(args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		flInitOptions.Dataset = args[0]
+	default:
+		return ErrUsage
+	}
+	_, err := Host.Initialize(&flInitOptions)
+	return errors.Trace(err)
+}
+
+var flPruneDryRun bool
+var flPruneGrace string
+
+func flPrune(fl *flag.FlagSet) {
+	fl.BoolVar(&flPruneDryRun, "n", false, "Dry run: show what would be pruned")
+	fl.StringVar(&flPruneGrace, "grace", "", "Prune only pods stopped for longer than DURATION (default: gc.grace-period)")
+}
+
+func cmdPrune(args []string) error {
+	if len(args) > 0 {
+		return ErrUsage
+	}
+	opts := &jetpack.PruneOptions{DryRun: flPruneDryRun, GracePeriod: -1}
+	if flPruneGrace != "" {
+		if d, err := time.ParseDuration(flPruneGrace); err != nil || d < 0 {
+			return errors.Errorf("Invalid grace period %#v", flPruneGrace)
+		} else {
+			opts.GracePeriod = d
+		}
+	}
+	rep, err := Host.Prune(opts)
+	if rep != nil {
+		verb := "Pruned"
+		if rep.DryRun {
+			verb = "Would prune"
+		}
+		for _, kept := range rep.Kept {
+			fmt.Println("Keeping", kept)
+		}
+		for _, cat := range []struct {
+			name string
+			pc   jetpack.PruneCategory
+		}{{"pod", rep.Pods}, {"image", rep.Images}, {"orphaned dataset", rep.Datasets}, {"partial download", rep.Spool}, {"core file", rep.Cores}} {
+			for _, item := range cat.pc.Items {
+				fmt.Println(verb, cat.name, item)
+			}
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tCOUNT\tBYTES")
+		fmt.Fprintf(tw, "Pods\t%d\t%d\n", len(rep.Pods.Items), rep.Pods.Bytes)
+		fmt.Fprintf(tw, "Images\t%d\t%d\n", len(rep.Images.Items), rep.Images.Bytes)
+		fmt.Fprintf(tw, "Orphaned datasets\t%d\t%d\n", len(rep.Datasets.Items), rep.Datasets.Bytes)
+		fmt.Fprintf(tw, "Partial downloads\t%d\t%d\n", len(rep.Spool.Items), rep.Spool.Bytes)
+		fmt.Fprintf(tw, "Core files\t%d\t%d\n", len(rep.Cores.Items), rep.Cores.Bytes)
+		tw.Flush()
+	}
+	return errors.Trace(err)
+}
+
+var flGCImagesDryRun bool
+var flGCImagesMinAge string
+
+func flGCImages(fl *flag.FlagSet) {
+	fl.BoolVar(&flGCImagesDryRun, "n", false, "Dry run: show what would be destroyed")
+	fl.StringVar(&flGCImagesMinAge, "min-age", "", "Keep images imported or used within DURATION (default: gc.image-min-age)")
+}
+
+func cmdGCImages(args []string) error {
+	if len(args) > 0 {
+		return ErrUsage
+	}
+	opts := &jetpack.ImageGCOptions{DryRun: flGCImagesDryRun, MinAge: -1}
+	if flGCImagesMinAge == "off" {
+		opts.MinAge = 0
+	} else if flGCImagesMinAge != "" {
+		if d, err := time.ParseDuration(flGCImagesMinAge); err != nil || d < 0 {
+			return errors.Errorf("Invalid minimum age %#v", flGCImagesMinAge)
+		} else {
+			opts.MinAge = d
+		}
+	}
+	rep, err := Host.GCImages(opts)
+	if rep != nil {
+		for _, kept := range rep.Kept {
+			fmt.Println("Keeping", kept)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tBYTES")
+		for _, item := range rep.Images {
+			fmt.Fprintf(tw, "%v\t%v\t%d\n", item.Hash, item.Name, item.Bytes)
+		}
+		verb := "Destroyed"
+		if rep.DryRun {
+			verb = "Would destroy"
+		}
+		fmt.Fprintf(tw, "%v %d images\t\t%d\n", verb, len(rep.Images), rep.Bytes)
+		tw.Flush()
+	}
+	return errors.Trace(err)
+}
+
+func cmdExportState(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if args[0] == "-" {
+		return errors.Trace(Host.ExportState(os.Stdout))
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := Host.ExportState(f); err != nil {
+		f.Close()
+		os.Remove(args[0])
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+var flRestoreOptions jetpack.RestoreOptions
+
+func flRestoreState(fl *flag.FlagSet) {
+	fl.BoolVar(&flRestoreOptions.Fetch, "fetch", false, "Fetch images that are not imported")
+}
+
+func cmdRestoreState(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	r := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	rep, err := Host.RestoreState(r, &flRestoreOptions)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range rep.Config {
+		fmt.Println("Configuration differs:", key)
+	}
+	for _, id := range rep.Restored {
+		if readdressed, ok := rep.Readdressed[id]; ok {
+			fmt.Printf("Restored %v (address %v)\n", id, readdressed)
+		} else {
+			fmt.Println("Restored", id)
+		}
+	}
+	skipped := make([]string, 0, len(rep.Skipped))
+	for id := range rep.Skipped {
+		skipped = append(skipped, id)
+	}
+	sort.Strings(skipped)
+	for _, id := range skipped {
+		fmt.Printf("Skipped %v: %v\n", id, rep.Skipped[id])
+	}
+	if len(skipped) > 0 {
+		return errors.Errorf("%d of %d pods not restored", len(skipped), len(skipped)+len(rep.Restored))
+	}
+	return nil
+}
+
+func cmdMetrics() error {
+	if sr, err := Host.StartStatsRecorder(); err != nil {
+		return errors.Trace(err)
+	} else if sr != nil {
+		defer sr.Stop()
+	}
+	go reloadOnHangup()
+	return Host.ServeMetrics()
+}
+
+// Reloads configuration on SIGHUP.
+func reloadOnHangup() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGHUP)
+	for range sigch {
+		if err := Host.ReloadConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, "Configuration not reloaded:", err)
+		}
+	}
+}
+
+func cmdAPI() error {
+	srv, err := Host.ListenAPI()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	errch := make(chan error, 2)
+	if jetpack.Config().GetBool("mds.embed", false) {
+		ms, err := Host.ListenMetadata(true)
+		if err != nil {
+			srv.Shutdown(context.Background())
+			return errors.Trace(err)
+		}
+		go func() { errch <- ms.Serve() }()
+		defer ms.Shutdown(context.Background())
+	}
+	go func() { errch <- srv.Serve() }()
+	go reloadOnHangup()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errch:
+		return errors.Trace(err)
+	case <-sigch:
+	}
+	// Requests in progress have 10 seconds, or until another signal, to
+	// finish; then the commands they run are cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		<-sigch
+		cancel()
+	}()
+	return errors.Trace(srv.Shutdown(ctx))
+}
+
+func cmdRctlEvent(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrUsage
+	}
+	pid := 0
+	if len(args) == 2 {
+		if n, err := strconv.Atoi(args[1]); err != nil {
+			return ErrUsage
+		} else {
+			pid = n
+		}
+	}
+	return errors.Trace(Host.RecordRctlEvent(args[0], pid))
+}
+
+func cmdReconcileLimits() error {
+	return errors.Trace(Host.ReconcileRctl())
+}
+
+func cmdRecordStats() error {
+	sr, err := Host.StartStatsRecorder()
+	if err != nil {
+		return errors.Trace(err)
+	} else if sr == nil {
+		return errors.New("Stats recording is disabled (stats.interval is not set)")
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	<-sigch
+	sr.Stop()
+	return nil
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
 
+	"github.com/3ofcoins/jetpack/lib/acutil"
 	"github.com/3ofcoins/jetpack/lib/jetpack"
 	"github.com/3ofcoins/jetpack/lib/run"
 )
@@ -21,15 +22,24 @@ import (
 func init() {
 	AddCommand("show-image IMAGE", "Show image info", cmdWrapImage0(cmdShowImage, true), nil)
 	AddCommand("image-manifest IMAGE", "Show image manifest", cmdWrapImage0(cmdImageManifest, true), nil)
-	AddCommand("destroy-image IMAGE", "Destroy an image", cmdWrapImage0(cmdDestroyImage, true), nil)
+	AddCommand("destroy-image [-f] IMAGE", "Destroy an image", cmdWrapImage0(cmdDestroyImage, true), flDestroyImage)
 	AddCommand("export IMAGE [FILE]", "Export image to an ACI file", cmdWrapImage(cmdExportImage, true), flExport)
+	AddCommand("send-image [-base IMAGE] IMAGE [FILE]", "Write image as a stream for receive-image on another host", cmdWrapImage(cmdSendImage, true), flSendImage)
+	AddCommand("receive-image [-insecure] [FILE]", "Receive an image written by send-image, from stdin if FILE is - or not given", cmdReceiveImage, flInsecureFlag)
+	AddCommand("verify-images [IMAGE...]", "Verify that images haven't changed since import", cmdVerifyImages, nil)
 	AddCommand("build IMAGE COMMAND ARGS...", "Build a niew image", cmdWrapImage(cmdBuild, false), flBuild)
+	AddCommand("build-spec SPEC", "Build a new image from a JSON build spec", cmdBuildSpec, flBuildSpec)
+	AddCommand("tag IMAGE NAME[:VERSION][,LABEL=VALUE...]", "Tag an image with another name or labels", cmdWrapImage(cmdTagImage, true), nil)
+	AddCommand("untag NAME[:VERSION][,LABEL=VALUE...]", "Remove an image tag", cmdUntagImage, nil)
+	AddCommand("prune-build-cache", "Destroy cached build steps that haven't been used recently", cmdPruneBuildCache, flPruneBuildCache)
 }
 
-var flExportFlat bool
+var flExportFlat, flExportGzip, flExportStored bool
 
 func flExport(fl *flag.FlagSet) {
-	fl.BoolVar(&flExportFlat, "flat", false, "Export flattened image without dependencies")
+	fl.BoolVar(&flExportFlat, "flat", false, "Export flattened image without dependencies, using system tar")
+	fl.BoolVar(&flExportGzip, "gzip", false, "Compress exported image")
+	fl.BoolVar(&flExportStored, "stored", false, "Export the ACI file image was imported from")
 }
 
 func cmdImageManifest(img *jetpack.Image) error {
@@ -42,12 +52,37 @@ func cmdImageManifest(img *jetpack.Image) error {
 }
 
 func cmdShowImage(img *jetpack.Image) error {
-	output := fmt.Sprintf("ID\t%v\nName\t%v\nTimestamp\t%v\n",
+	output := fmt.Sprintf("ID\t%v\nName\t%v\nOS/Arch\t%v\nTimestamp\t%v\n",
 		img.Hash,
 		img,
+		img.OSArch(),
 		img.Timestamp.Format(time.RFC3339),
 	)
 
+	if tags, err := img.Tags(); err != nil {
+		return errors.Trace(err)
+	} else if len(tags) == 0 {
+		output += "Tags\t-\n"
+	} else {
+		for i, tag := range tags {
+			if i == 0 {
+				output += "Tags"
+			}
+			output += fmt.Sprintf("\t%v\n", tag)
+		}
+	}
+
+	if img.Signature != nil {
+		output += fmt.Sprintf("Signed by\t%v\nKey\t%v\nVerified\t%v\n",
+			img.Signature.Signer, img.Signature.Fingerprint, img.Signature.Verified.Format(time.RFC3339))
+	} else {
+		output += "Signed by\tunsigned\n"
+	}
+
+	if img.Import != nil {
+		output += fmt.Sprintf("Imported\t%v\n", img.Import)
+	}
+
 	if len(img.Manifest.Dependencies) > 0 {
 		output += "Dependencies"
 		for _, dep := range img.Manifest.Dependencies {
@@ -60,17 +95,149 @@ func cmdShowImage(img *jetpack.Image) error {
 		}
 	}
 
+	if du, err := img.DiskUsage(); err != nil {
+		return errors.Trace(err)
+	} else {
+		output += fmt.Sprintf("Disk\t%v\n", du)
+	}
+
 	if app := img.Manifest.App; app != nil {
 		output += "App\t\n" + appDetails(app)
 	}
 
+	if history, err := img.History(); err != nil {
+		return errors.Trace(err)
+	} else {
+		output += "History\t\n"
+		for _, entry := range history {
+			when := "-"
+			if !entry.Time.IsZero() {
+				when = entry.Time.Format(time.RFC3339)
+			}
+			output += fmt.Sprintf("  %v\t%v %v\n", entry.Type, when, entry.Details)
+		}
+	}
+
 	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
 	fmt.Fprint(tw, output)
 	return tw.Flush()
 }
 
+var flDestroyImageForce bool
+
+func flDestroyImage(fl *flag.FlagSet) {
+	fl.BoolVar(&flDestroyImageForce, "f", false, "Destroy even if used; stopped pods that run it are marked broken")
+}
+
 func cmdDestroyImage(img *jetpack.Image) error {
-	return errors.Trace(img.Destroy())
+	return errors.Trace(Host.RemoveImage(*img.Hash, flDestroyImageForce))
+}
+
+func cmdTagImage(img *jetpack.Image, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	name, labels, err := acutil.ParseImageName(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(Host.TagImage(*img.Hash, name, labels))
+}
+
+func cmdUntagImage(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	name, labels, err := acutil.ParseImageName(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(Host.UntagImage(name, labels))
+}
+
+func cmdVerifyImages(args []string) error {
+	var results []jetpack.ImageVerification
+	if len(args) == 0 {
+		if rr, err := Host.VerifyImages(); err != nil {
+			return errors.Trace(err)
+		} else {
+			results = rr
+		}
+	} else {
+		for _, name := range args {
+			if img, err := getImage(name, true); err != nil {
+				return errors.Annotate(err, name)
+			} else {
+				results = append(results, jetpack.ImageVerification{Image: img, Err: img.Verify()})
+			}
+		}
+	}
+
+	failed := 0
+	for _, res := range results {
+		if res.Skipped() {
+			fmt.Printf("SKIPPED\t%v\tunsealed\n", types.ShortHash(res.Image.ID()))
+		} else if res.Err != nil {
+			failed++
+			fmt.Printf("FAILED\t%v\t%v\n", types.ShortHash(res.Image.ID()), res.Err)
+		} else {
+			fmt.Printf("OK\t%v\t%v\n", types.ShortHash(res.Image.ID()), res.Image)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d images failed verification", failed, len(results))
+	}
+	return nil
+}
+
+var flSendBase string
+
+func flSendImage(fl *flag.FlagSet) {
+	fl.StringVar(&flSendBase, "base", "", "Send increments from this image, which the receiving host has received")
+}
+
+func cmdSendImage(img *jetpack.Image, args []string) error {
+	opts := &jetpack.SendOptions{}
+	if flSendBase != "" {
+		if base, err := getImage(flSendBase, true); err != nil {
+			return errors.Annotate(err, flSendBase)
+		} else {
+			opts.Base = base.Hash
+		}
+	}
+	if len(args) == 0 || args[0] == "-" {
+		return errors.Trace(img.Send(os.Stdout, opts))
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := img.Send(f, opts); err != nil {
+		f.Close()
+		os.Remove(args[0])
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+func cmdReceiveImage(args []string) error {
+	if len(args) > 1 {
+		return ErrUsage
+	}
+	r := os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	img, err := Host.ReceiveImage(r, &jetpack.ImageOptions{AllowUnsigned: flInsecure})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmdShowImage(img)
 }
 
 func cmdExportImage(img *jetpack.Image, args []string) error {
@@ -87,20 +254,34 @@ func cmdExportImage(img *jetpack.Image, args []string) error {
 		}
 	}
 
-	if flExportFlat {
+	// Hash goes to stderr when the image goes to stdout
+	hashOutput := os.Stdout
+	if output == os.Stdout {
+		hashOutput = os.Stderr
+	}
+
+	switch {
+	case flExportStored:
+		aci, err := os.Open(img.Path("aci"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer aci.Close()
+		_, err = io.Copy(output, aci)
+		return errors.Trace(err)
+	case flExportFlat:
 		if hash, err := img.WriteFlatACI(output); err != nil {
 			return errors.Trace(err)
 		} else {
-			fmt.Println(hash)
+			fmt.Fprintln(hashOutput, hash)
 			return nil
 		}
-	} else {
-		if aci, err := os.Open(img.Path("aci")); err != nil {
+	default:
+		if hash, err := img.Export(output, &jetpack.ExportOptions{Gzip: flExportGzip}); err != nil {
 			return errors.Trace(err)
 		} else {
-			defer aci.Close()
-			_, err = io.Copy(output, aci)
-			return errors.Trace(err)
+			fmt.Fprintln(hashOutput, hash)
+			return nil
 		}
 	}
 }
@@ -182,3 +363,59 @@ func cmdBuild(img *jetpack.Image, args []string) error {
 		return nil
 	}
 }
+
+var flBuildNoCache bool
+
+func flBuildSpec(fl *flag.FlagSet) {
+	SaveIDFlag(fl)
+	fl.BoolVar(&flBuildNoCache, "no-cache", false, "Run all steps, even if they are cached")
+}
+
+func cmdBuildSpec(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	var spec jetpack.BuildSpec
+	var bb []byte
+	var err error
+	if args[0] == "-" {
+		bb, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bb, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := json.Unmarshal(bb, &spec); err != nil {
+		return errors.Annotate(err, "Parsing build spec")
+	}
+	nimg, err := Host.BuildImage(&spec, &jetpack.BuildOptions{NoCache: flBuildNoCache})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := cmdShowImage(nimg); err != nil {
+		return errors.Trace(err)
+	}
+	if SaveID != "" {
+		return errors.Trace(ioutil.WriteFile(SaveID, []byte(nimg.Hash.String()+"\n"), 0644))
+	}
+	return nil
+}
+
+var flPruneAge time.Duration
+
+func flPruneBuildCache(fl *flag.FlagSet) {
+	fl.DurationVar(&flPruneAge, "age", 7*24*time.Hour, "Destroy steps not used for this long")
+}
+
+func cmdPruneBuildCache(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	if n, err := Host.PruneBuildCache(flPruneAge); err != nil {
+		return errors.Trace(err)
+	} else {
+		fmt.Printf("Destroyed %d cached build steps\n", n)
+		return nil
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/jetpack"
 )
 
 func init() {
@@ -25,37 +28,106 @@ func flList(fl *flag.FlagSet) {
 	fl.BoolVar(&MachineFriendly, "H", false, "machine-friendly output")
 }
 
+var (
+	flImagesName, flImagesSort   string
+	flImagesLabels               sliceFlag
+	flImagesReverse              bool
+	flImagesUsed, flImagesUnused bool
+	flImagesMinSize              int64
+)
+
 func flListImages(fl *flag.FlagSet) {
 	flList(fl)
 	fl.BoolVar(&LongHash, "l", false, "Show full sha-512 hashes")
+	fl.StringVar(&flImagesName, "name", "", "Only images with name or a tag matching pattern")
+	fl.Var(&flImagesLabels, "label", "Only images with label NAME=VALUE (can be repeated)")
+	fl.StringVar(&flImagesSort, "sort", "name", "Order by name, imported, or size")
+	fl.BoolVar(&flImagesReverse, "reverse", false, "Reverse the order")
+	fl.BoolVar(&flImagesUsed, "used", false, "Only images used by pods or other images")
+	fl.BoolVar(&flImagesUnused, "unused", false, "Only images not used by pods or other images")
+	fl.Int64Var(&flImagesMinSize, "min-size", 0, "Only images using at least this many bytes")
 }
 
 func cmdListImages([]string) error {
-	if images, err := Host.Images(); err != nil {
+	filter := &jetpack.ImageFilter{
+		Name:    flImagesName,
+		MinSize: flImagesMinSize,
+		Reverse: flImagesReverse,
+	}
+	if labels, err := parseLabels(flImagesLabels); err != nil {
+		return errors.Trace(err)
+	} else {
+		filter.Labels = labels
+	}
+	switch {
+	case flImagesUsed && flImagesUnused:
+		return errors.Annotate(jetpack.ErrUsage, "-used and -unused exclude each other")
+	case flImagesUsed:
+		filter.Referenced = jetpack.ReferencedImages
+	case flImagesUnused:
+		filter.Referenced = jetpack.UnreferencedImages
+	}
+	if by, err := jetpack.ParseImageSort(flImagesSort); err != nil {
 		return errors.Trace(err)
 	} else {
-		items := make([][]string, len(images))
-		for i, img := range images {
-			items[i] = []string{img.ID(), img.String()}
+		filter.Sort = by
+	}
+
+	images, err := Host.ListImages(filter)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	items := make([][]string, len(images))
+	for i, is := range images {
+		id, lastUsed := "", "-"
+		if is.Hash != nil {
+			id = is.Hash.String()
+		}
+		if !is.LastUsed.IsZero() {
+			lastUsed = humanDuration(time.Since(is.LastUsed)) + " ago"
+		}
+		unique := "-"
+		if is.Unique >= 0 {
+			unique = fmt.Sprintf("%d", is.Unique)
+		}
+		items[i] = []string{
+			id,
+			is.OSArch(),
+			is.TagsString(),
+			fmt.Sprintf("%d", is.Size),
+			unique,
+			is.Imported.Format(time.RFC3339),
+			lastUsed,
+			is.SignedBy(),
 		}
-		return doList("ID\tNAME", items)
 	}
+	// Listing is already in the requested order
+	return doListOrdered(os.Stdout, "ID\tOS/ARCH\tTAGS\tSIZE\tUNIQUE\tIMPORTED\tLAST USED\tSIGNED BY", items)
 }
 
 func cmdListPods([]string) error {
-	pods := Host.Pods()
+	pods, err := Host.PodHeaders()
+	if err != nil {
+		return errors.Trace(err)
+	}
 	items := make([][]string, len(pods))
 	for i, pod := range pods {
-		apps := make([]string, len(pod.Manifest.Apps))
-		for j, app := range pod.Manifest.Apps {
-			apps[j] = app.Name.String()
+		status := pod.Status.String()
+		if pod.Status == jetpack.PodStatusStopped {
+			if pb, err := pod.Broken(); err == nil && pb != nil {
+				status = "broken"
+			} else if es, err := pod.LastExitStatus(); err == nil && es != nil {
+				status = fmt.Sprintf("%v %v ago", es, humanDuration(time.Since(es.Finished)))
+			}
+		}
+		if pod.Ephemeral {
+			status += ", ephemeral"
 		}
-		ipAddress, _ := pod.Manifest.Annotations.Get("ip-address")
 		items[i] = []string{
-			pod.ID(),
-			pod.Status().String(),
-			ipAddress,
-			strings.Join(apps, ", "),
+			pod.UUID.String(),
+			status,
+			pod.IP,
+			strings.Join(pod.Apps, ", "),
 		}
 	}
 	return doList("ID\tSTATUS\tIP\tAPPS\t", items)
@@ -66,6 +138,14 @@ func doList(header string, items [][]string) error {
 }
 
 func doListF(w io.Writer, header string, items [][]string) error {
+	sort.Slice(items, func(i, j int) bool {
+		return strings.Join(items[i], "\t") < strings.Join(items[j], "\t")
+	})
+	return doListOrdered(w, header, items)
+}
+
+// Like doListF, but keeps order of items.
+func doListOrdered(w io.Writer, header string, items [][]string) error {
 	if !LongHash {
 		for i := range items {
 			items[i][0] = types.ShortHash(items[i][0])
@@ -80,7 +160,6 @@ func doListF(w io.Writer, header string, items [][]string) error {
 			lines[i] = strings.Join(item, "\t")
 		}
 	}
-	sort.Strings(lines)
 
 	if !(Quiet || MachineFriendly || header == "") {
 		lines = append([]string{header}, lines...)
@@ -96,3 +175,17 @@ func doListF(w io.Writer, header string, items [][]string) error {
 		return tw.Flush()
 	}
 }
+
+// Returns duration rounded to its largest unit, e.g. "5m" or "3d".
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+}
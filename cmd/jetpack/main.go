@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/3ofcoins/jetpack/lib/jetpack"
 )
@@ -14,18 +17,69 @@ const AppName = "jetpack"
 
 // Die on error
 func Die(err error) {
+	if aerr, ok := errors.Cause(err).(*jetpack.AppExitError); ok {
+		// Exit with app's exit code
+		fmt.Fprintln(os.Stderr, aerr)
+		if aerr.Code > 0 {
+			os.Exit(aerr.Code)
+		}
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.ErrorStack(err))
 		os.Exit(1)
 	}
 }
 
+// Asks a question until user answers yes or no.
+func askYesNo(question string) bool {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("%v (yes/no)? ", question)
+		input, err := in.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		switch strings.TrimSpace(input) {
+		case "yes":
+			return true
+		case "no":
+			return false
+		default:
+			fmt.Println("Please enter 'yes' or 'no'")
+		}
+	}
+}
+
+// Returns new host. If a dataset it needs is not mounted, offers to
+// mount it when run on a terminal. For init, which fixes datasets
+// itself, mounts aren't checked.
+func newHost(command string) (*jetpack.Host, error) {
+	if command == "init" {
+		return jetpack.NewHostWithOptions(&jetpack.HostOptions{SkipMountCheck: true})
+	}
+	for {
+		h, err := jetpack.NewHost()
+		merr, ok := errors.Cause(err).(*jetpack.MountError)
+		if !ok || !merr.CanMount() || !terminal.IsTerminal(0) {
+			return h, err
+		}
+		fmt.Fprintln(os.Stderr, merr)
+		if !askYesNo(fmt.Sprintf("Mount %v at %v now", merr.Dataset.Name, merr.Path)) {
+			return nil, err
+		}
+		if err := merr.Mount(); err != nil {
+			return nil, err
+		}
+	}
+}
+
 var Host *jetpack.Host
 
 func main() {
 	flag.Parse()
 
-	if h, err := jetpack.NewHost(); err != nil {
+	if h, err := newHost(flag.Arg(0)); err != nil {
 		Die(err)
 	} else {
 		Host = h
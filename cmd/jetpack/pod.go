@@ -4,11 +4,16 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
@@ -21,29 +26,52 @@ import (
 func init() {
 	AddCommand("prepare ...", "Prepare a pod", cmdPrepare, flPrepare)
 	AddCommand("run ...", "Run a pod", cmdWrapPodPrepare0(cmdRun), flRun)
+	AddCommand("show POD", "Show pod info", cmdWrapPod0(cmdShowPod), nil)
 	AddCommand("manifest POD", "Show pod manifest", cmdWrapPod0(cmdPodManifest), nil)
 	AddCommand("destroy POD", "Destroy a pod", cmdWrapPod0(cmdDestroyPod), nil)
+	AddCommand("start POD", "Start pod's jail without running apps", cmdWrapPod0(cmdStartPod), nil)
 	AddCommand("kill POD", "Kill a running pod", cmdWrapPod0(cmdKillPod), nil)
+	AddCommand("stats [-history DURATION] POD", "Show pod's resource usage", cmdWrapPod0(cmdPodStats), flStats)
+	AddCommand("processes POD", "List pod's processes", cmdWrapPod0(cmdPodProcesses), nil)
 	AddCommand("ps POD [ARGS...]", "Show pod's process list (ps)", cmdWrapPod(cmdPodCmd("/bin/ps", "-J")), nil)
 	AddCommand("top POD [ARGS...]", "Show pod's process list (top)", cmdWrapPod(cmdPodCmd("/usr/bin/top", "-J")), nil)
 	AddCommand("killall POD [ARGS...]", "Kill pod's processes", cmdWrapPod(cmdPodCmd("/usr/bin/killall", "-j")), nil)
-	AddCommand("console POD[:APP]", "Open a console in app", cmdWrapApp0(cmdConsole), flConsole)
-	AddCommand("exec POD[:APP] COMMAND...", "Run a command in app", cmdWrapApp(cmdExec), nil)
-	AddCommand("cp [FLAGS] ARGS...", "Copy files to/from pod (use POD:[APP|@VOL]:PATH for pod paths)", cmdCp, nil)
+	AddCommand("console [-e NAME=VALUE...] POD[:APP]", "Open a console in app", cmdWrapApp0(cmdConsole), flConsole)
+	AddCommand("supervise POD:APP OPTIONS", "Supervise a detached app (used by run -d)", cmdWrapApp(cmdSupervise), nil)
+	AddCommand("syslog-forward POD", "Forward pod's syslog to the host (started with the pod)", cmdWrapPod0(cmdSyslogForward), nil)
+	AddCommand("wait POD[:APP]", "Wait for a detached app to finish", cmdWrapApp0(cmdWait), nil)
+	AddCommand("logs [-f] [-n LINES] [-err] POD[:APP]", "Show app's captured output", cmdWrapApp0(cmdLogs), flLogs)
+	AddCommand("exec [-t] [-e NAME=VALUE...] POD[:APP] COMMAND...", "Run a command in app", cmdWrapApp(cmdExec), flExec)
+	AddCommand("snapshot-volume POD VOLUME SNAPSHOT", "Snapshot pod's volume", cmdWrapPod(cmdVolumeSnapshot), nil)
+	AddCommand("rollback-volume POD VOLUME SNAPSHOT", "Roll pod's volume back to a snapshot", cmdWrapPod(cmdVolumeRollback), nil)
+	AddCommand("set-storage-limit POD SIZE|off", "Change pod's storage limit (quota of its dataset)", cmdWrapPod(cmdSetStorageLimit), nil)
+	AddCommand("move-storage POD CLASS", "Move a stopped pod's datasets to another storage class", cmdWrapPod(cmdMoveStorage), nil)
+	AddCommand("cp [-chown] SOURCE... TARGET", "Copy files to/from pod (use POD:[APP|@VOL]:PATH for pod paths)", cmdCp, flCp)
 }
 
 var flDryRun bool
+var flPodEnvFiles sliceFlag
 
 func flPrepare(fl *flag.FlagSet) {
 	SaveIDFlag(fl)
 	flPodManifest(fl)
 	fl.BoolVar(&flDryRun, "n", false, "Dry run (don't actually create pod, just show reified manifest)")
+	fl.Var(&flPodEnvFiles, "env-file", "Read apps' environment variables from file on each run (repeatable)")
 }
 
 func cmdPrepare(args []string) error {
-	if pm, err := getPodManifest(args); err != nil {
+	pm, err := getPodManifest(args)
+	if err != nil {
 		return errors.Trace(err)
-	} else if flDryRun {
+	}
+	if len(flPodEnvFiles) > 0 {
+		if envFiles, err := absPaths(flPodEnvFiles); err != nil {
+			return errors.Trace(err)
+		} else if err := jetpack.SetEnvFiles(pm, envFiles); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if flDryRun {
 		if jb, err := json.MarshalIndent(pm, "", "  "); err != nil {
 			return errors.Trace(err)
 		} else {
@@ -51,7 +79,7 @@ func cmdPrepare(args []string) error {
 			fmt.Println(string(jb))
 			return nil
 		}
-	} else if pod, err := Host.CreatePod(pm); err != nil {
+	} else if pod, err := Host.CreatePod(pm, &jetpack.CreateOptions{IgnoreLimits: flIgnoreLimits}); err != nil {
 		return errors.Trace(err)
 	} else {
 		if SaveID != "" {
@@ -68,7 +96,49 @@ func cmdPrepare(args []string) error {
 }
 
 var flAppName types.ACName
-var flDestroy, flTerminal bool
+var flDestroy, flTerminal, flDetach bool
+var flEnv, flEnvFiles, flExecReplace, flExecAppend sliceFlag
+var flStdin string
+
+func flEnvVars(fl *flag.FlagSet) {
+	fl.Var(&flEnv, "e", "Set environment variable for this run (NAME=VALUE)")
+	fl.Var(&flEnvFiles, "env-file", "Read environment variables for this run from file (repeatable)")
+}
+
+// Returns paths made absolute, as env files are read by jetpack
+// processes that may run elsewhere.
+func absPaths(paths []string) ([]string, error) {
+	rv := make([]string, len(paths))
+	for i, path := range paths {
+		if abs, err := filepath.Abs(path); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			rv[i] = abs
+		}
+	}
+	return rv, nil
+}
+
+func flStdinMode(fl *flag.FlagSet) {
+	fl.StringVar(&flStdin, "stdin", jetpack.StdinCaller, "Attach app's stdin to jetpack's (caller) or /dev/null (null)")
+}
+
+func runOptions() *jetpack.RunOptions {
+	opts := &jetpack.RunOptions{Env: flEnv, StdinMode: flStdin}
+	// A relative path that can't be resolved fails opts' check
+	if envFiles, err := absPaths(flEnvFiles); err != nil {
+		opts.EnvFiles = flEnvFiles
+	} else {
+		opts.EnvFiles = envFiles
+	}
+	switch {
+	case len(flExecReplace) > 0:
+		opts.ExecMode, opts.Exec = jetpack.ExecReplace, flExecReplace
+	case len(flExecAppend) > 0:
+		opts.ExecMode, opts.Exec = jetpack.ExecAppend, flExecAppend
+	}
+	return opts
+}
 
 func flRun(fl *flag.FlagSet) {
 	flPodManifest(fl)
@@ -76,9 +146,29 @@ func flRun(fl *flag.FlagSet) {
 	fl.Var(&flAppName, "app", "Specify app to run for a multi-app pod")
 	fl.BoolVar(&flDestroy, "destroy", false, "Destroy pod when done")
 	fl.BoolVar(&flTerminal, "t", false, "Attach app to the terminal (single-app containers only)")
+	fl.BoolVar(&flDetach, "d", false, "Run app detached, under a supervisor process")
+	fl.Var(&flExecReplace, "exec", "Run app with this command instead of its exec (repeat for each argument)")
+	fl.Var(&flExecAppend, "arg", "Add argument to app's exec (repeatable)")
+	flEnvVars(fl)
+	flStdinMode(fl)
 }
 
 func cmdRun(pod *jetpack.Pod) (erv error) {
+	if len(flExecReplace) > 0 && len(flExecAppend) > 0 {
+		return errors.New("Can't use both -exec and -arg")
+	}
+	if len(flExecReplace)+len(flExecAppend) > 0 {
+		if flAppName.Empty() && len(pod.Manifest.Apps) != 1 {
+			return errors.New("Multi-app pod! Please use -app=NAME to choose app for -exec or -arg")
+		}
+		flTerminal = true
+	}
+	if flDetach {
+		if flDestroy {
+			return errors.New("Can't destroy a detached pod when done")
+		}
+		flTerminal = true
+	}
 	if flAppName.Empty() && flTerminal {
 		if len(pod.Manifest.Apps) != 1 {
 			return errors.New("Multi-app pod! Please use -app=NAME to choose")
@@ -98,15 +188,25 @@ func cmdRun(pod *jetpack.Pod) (erv error) {
 			}
 		}()
 	}
-	if !flAppName.Empty() {
-		// Run one app on terminal
+	if flDetach {
 		if app := pod.App(flAppName); app == nil {
 			return jetpack.ErrNotFound
+		} else if sv, err := app.RunDetached(runOptions()); err != nil {
+			return errors.Trace(err)
+		} else if !Quiet {
+			fmt.Printf("%v:%v\t%d\n", pod.UUID, sv.App, sv.Pid)
+		}
+		return nil
+	}
+	if !flAppName.Empty() {
+		// Run one app on terminal
+		if es, err := Host.RunApp(pod.UUID, flAppName, runOptions()); err != nil {
+			return errors.Trace(err)
 		} else {
-			return errors.Trace(app.Run(os.Stdin, os.Stdout, os.Stderr))
+			return es.Err()
 		}
 	} else {
-		return errors.Trace(pod.Run())
+		return errors.Trace(pod.Run(runOptions()))
 	}
 }
 
@@ -119,14 +219,324 @@ func cmdPodManifest(pod *jetpack.Pod) error {
 	}
 }
 
+func cmdShowPod(pod *jetpack.Pod) error {
+	ipAddress, _ := pod.IPAddress()
+	if pod.IsDHCP() {
+		ipAddress += " (DHCP)"
+	}
+	output := fmt.Sprintf("ID\t%v\nStatus\t%v\nHostname\t%v\nIP\t%v\n",
+		pod.UUID,
+		pod.Status(),
+		pod.Hostname(),
+		ipAddress,
+	)
+
+	if pb, err := pod.Broken(); err != nil {
+		return errors.Trace(err)
+	} else if pb != nil {
+		output += fmt.Sprintf("Broken\t%v (%v)\n", pb, pb.Time.Format(time.RFC3339))
+	}
+
+	if bridge, ok := pod.VNETBridge(); ok {
+		if mac, err := pod.MACAddress(); err != nil {
+			return errors.Trace(err)
+		} else {
+			output += fmt.Sprintf("VNET\t%v\nMAC\t%v\n", bridge, mac)
+		}
+	} else {
+		output += fmt.Sprintf("Interface\t%v\n", pod.Interface())
+	}
+
+	statuses, err := pod.ExitStatuses()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	apps := make([]string, len(pod.Manifest.Apps))
+	for i, app := range pod.Manifest.Apps {
+		apps[i] = fmt.Sprintf("%v\t%v", app.Name, types.ShortHash(app.Image.ID.String()))
+		if img, err := pod.Host.GetImage(app.Image.ID, "", nil); err == nil {
+			apps[i] += " " + img.OSArch()
+		}
+		if a := pod.App(app.Name); a != nil {
+			if a.LogCaptured() {
+				apps[i] += fmt.Sprintf("\n\t  log: %v, %v", a.LogPath("out"), a.LogPath("err"))
+			}
+			if rls, err := a.Rlimits(); err != nil {
+				return errors.Trace(err)
+			} else if effective, err := a.EffectiveRlimits(); err != nil {
+				return errors.Trace(err)
+			} else if len(effective) > 0 {
+				// Running process's limits, with configured values
+				// that differ
+				limits := make([]string, len(effective))
+				for j, rl := range effective {
+					limits[j] = rl.String()
+					if rl != rls[j] {
+						limits[j] += fmt.Sprintf(" (configured %v:%v)", rls[j].Soft, rls[j].Hard)
+					}
+				}
+				apps[i] += "\n\t  limits: " + strings.Join(limits, " ")
+			} else if len(rls) > 0 {
+				limits := make([]string, len(rls))
+				for j, rl := range rls {
+					limits[j] = rl.String()
+				}
+				apps[i] += "\n\t  configured limits: " + strings.Join(limits, " ")
+			}
+		}
+		if sv, err := pod.Supervisor(app.Name); err != nil {
+			return errors.Trace(err)
+		} else if sv != nil {
+			apps[i] += fmt.Sprintf("\n\t  detached: supervisor pid %d, app pid %d, since %v", sv.Pid, sv.AppPid, sv.Started.Format(time.RFC3339))
+		}
+		if es := statuses[app.Name]; es != nil && len(es.Exec) > 0 {
+			apps[i] += fmt.Sprintf("\n\t  last run: %v (%v)", strings.Join(es.Exec, " "), es)
+		}
+	}
+	output += "Apps\t" + strings.Join(apps, "\n\t") + "\n"
+
+	if pod.IsLinux() {
+		if rel, err := jetpack.LinuxOSRelease(); err != nil {
+			output += "Linux\tunavailable\n"
+		} else {
+			output += fmt.Sprintf("Linux\tosrelease %v\n", rel)
+		}
+	}
+
+	if effective, err := pod.EffectiveRctlRules(); err != nil {
+		return errors.Trace(err)
+	} else if configured, err := pod.RctlRules(); err != nil {
+		return errors.Trace(err)
+	} else {
+		if len(effective) > 0 {
+			output += "Limits\t" + rctlRulesString(effective) + "\n"
+		}
+		if !reflect.DeepEqual(effective, configured) && len(configured) > 0 {
+			output += "Configured limits\t" + rctlRulesString(configured) + "\n"
+		}
+	}
+	if cpus, err := pod.CPUSet(); err != nil {
+		return errors.Trace(err)
+	} else if len(cpus) > 0 {
+		output += fmt.Sprintf("CPU set\t%v\n", strings.Trim(fmt.Sprint(cpus), "[]"))
+	}
+
+	if policy, err := pod.CoredumpPolicy(); err != nil {
+		return errors.Trace(err)
+	} else if cores, err := pod.CoreFiles(); err != nil {
+		return errors.Trace(err)
+	} else {
+		lines := []string{policy}
+		for _, core := range cores {
+			lines = append(lines, fmt.Sprintf("%v\t%d bytes, %v", core.Name, core.Size, core.Time.Format(time.RFC3339)))
+		}
+		output += "Core dumps\t" + strings.Join(lines, "\n\t") + "\n"
+	}
+
+	if size, ok := pod.TmpfsTmp(); ok {
+		output += fmt.Sprintf("/tmp\ttmpfs, size %v\n", size)
+	}
+
+	if ems, err := pod.ExtraMounts(); err != nil {
+		return errors.Trace(err)
+	} else if len(ems) > 0 {
+		mounts := make([]string, len(ems))
+		for i, em := range ems {
+			mounts[i] = fmt.Sprintf("%v\t%v", em.Name, em)
+		}
+		output += "Extra mounts\t" + strings.Join(mounts, "\n\t") + "\n"
+	}
+
+	if pfs, err := pod.PortForwards(); err != nil {
+		return errors.Trace(err)
+	} else if len(pfs) > 0 {
+		ports := make([]string, len(pfs))
+		for i, pf := range pfs {
+			ports[i] = pf.String()
+		}
+		output += "Ports\t" + strings.Join(ports, "\n\t") + "\n"
+		if pod.Status() == jetpack.PodStatusRunning {
+			if rules, err := pod.LivePortForwards(); err != nil {
+				return errors.Trace(err)
+			} else {
+				output += "Forwarding\t" + strings.Join(rules, "\n\t") + "\n"
+			}
+		}
+	}
+
+	if du, err := pod.DiskUsage(); err != nil {
+		return errors.Trace(err)
+	} else if pod.Ephemeral() {
+		output += fmt.Sprintf("Disk\t%v (ephemeral)\n", du)
+	} else {
+		output += fmt.Sprintf("Disk\t%v (storage class %v)\n", du, pod.StorageClass())
+	}
+
+	if props, err := pod.ZFSProperties(); err != nil {
+		return errors.Trace(err)
+	} else if len(props) > 0 {
+		lines := make([]string, len(props))
+		for i, prop := range props {
+			lines[i] = prop.String()
+		}
+		output += "ZFS\t" + strings.Join(lines, "\n\t") + "\n"
+	}
+
+	if Host.Settings.Network.Accounting {
+		if pod.Status() == jetpack.PodStatusRunning {
+			if ns, err := pod.NetStats(); err != nil {
+				return errors.Trace(err)
+			} else {
+				output += fmt.Sprintf("Traffic\t%v\n", ns)
+			}
+		}
+		if ns, err := pod.NetStatsTotal(); err != nil {
+			return errors.Trace(err)
+		} else {
+			output += fmt.Sprintf("Total traffic\t%v\n", ns)
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+	fmt.Fprint(tw, output)
+	return tw.Flush()
+}
+
+func rctlRulesString(rules []jetpack.RctlRule) string {
+	strs := make([]string, len(rules))
+	for i, rule := range rules {
+		strs[i] = rule.String()
+	}
+	return strings.Join(strs, " ")
+}
+
 func cmdDestroyPod(pod *jetpack.Pod) error {
 	return errors.Trace(pod.Destroy())
 }
 
+var flStatsHistory time.Duration
+
+func flStats(fl *flag.FlagSet) {
+	fl.DurationVar(&flStatsHistory, "history", 0, "Show samples recorded in last DURATION")
+}
+
+func cmdPodStats(pod *jetpack.Pod) error {
+	if flStatsHistory > 0 {
+		return cmdPodStatsHistory(pod)
+	}
+	st, err := pod.Stats()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "source\t%v\n", st.Source)
+	fmt.Fprintf(tw, "cpu time\t%v\n", st.CPUTime)
+	fmt.Fprintf(tw, "cpu\t%.1f%%\n", st.CPUPercent)
+	fmt.Fprintf(tw, "memory\t%v\n", st.Memory)
+	fmt.Fprintf(tw, "swap\t%v\n", st.Swap)
+	usage := func(n int, resource string) string {
+		if limit := st.Limit(resource); limit > 0 {
+			return fmt.Sprintf("%v of %v", n, limit)
+		}
+		return strconv.Itoa(n)
+	}
+	fmt.Fprintf(tw, "processes\t%v\n", usage(st.Processes, "maxproc"))
+	fmt.Fprintf(tw, "threads\t%v\n", st.Threads)
+	fmt.Fprintf(tw, "open files\t%v\n", usage(st.OpenFiles, "openfiles"))
+	if st.Source == "rctl" {
+		fmt.Fprintf(tw, "pseudo-terminals\t%v\n", usage(st.PseudoTerminals, "pseudoterminals"))
+	}
+	if du, err := pod.DiskUsage(); err != nil {
+		return errors.Trace(err)
+	} else if du.Quota > 0 {
+		fmt.Fprintf(tw, "disk\t%v of %v\n", du.Used, du.Quota)
+	} else {
+		fmt.Fprintf(tw, "disk\t%v\n", du.Used)
+	}
+	for _, rule := range st.Limits {
+		fmt.Fprintf(tw, "limit\t%v\n", rule)
+	}
+	return errors.Trace(tw.Flush())
+}
+
+func cmdSetStorageLimit(pod *jetpack.Pod, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	limit, err := jetpack.ParseStorageLimit(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(pod.SetStorageLimit(limit))
+}
+
+func cmdMoveStorage(pod *jetpack.Pod, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	return errors.Trace(pod.MoveStorage(args[0]))
+}
+
+func cmdPodStatsHistory(pod *jetpack.Pod) error {
+	samples, err := pod.StatsHistory(time.Now().Add(-flStatsHistory))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCPU TIME\tCPU\tMEMORY\tSWAP\tPROCS\tTHREADS\tFILES")
+	for _, s := range samples {
+		fmt.Fprintf(tw, "%v\t%v\t%.1f%%\t%v\t%v\t%v\t%v\t%v\n",
+			s.Time.Format(time.RFC3339), s.CPUTime, s.CPUPercent, s.Memory, s.Swap,
+			s.Processes, s.Threads, s.OpenFiles)
+	}
+	return errors.Trace(tw.Flush())
+}
+
+func cmdPodProcesses(pod *jetpack.Pod) error {
+	procs, err := pod.Processes()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tPPID\tUSER\tSTARTED\tTIME\tRSS\tAPP\tCOMMAND")
+	for _, proc := range procs {
+		fmt.Fprintf(tw, "%d\t%d\t%v\t%v\t%v\t%d\t%v\t%v\n",
+			proc.Pid, proc.Ppid, proc.User, proc.Started.Format(time.RFC3339),
+			proc.CPUTime, proc.RSS/1024, proc.App, strings.Join(proc.Command, " "))
+	}
+	return errors.Trace(tw.Flush())
+}
+
+func cmdStartPod(pod *jetpack.Pod) error {
+	return errors.Trace(pod.Start())
+}
+
 func cmdKillPod(pod *jetpack.Pod) error {
 	return errors.Trace(pod.Kill())
 }
 
+func cmdVolumeSnapshot(pod *jetpack.Pod, args []string) error {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	if name, err := types.NewACName(args[0]); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(pod.VolumeSnapshot(*name, args[1]))
+	}
+}
+
+func cmdVolumeRollback(pod *jetpack.Pod, args []string) error {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	if name, err := types.NewACName(args[0]); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(pod.VolumeRollback(*name, args[1]))
+	}
+}
+
 func cmdPodCmd(cmd string, baseArgs ...string) func(*jetpack.Pod, []string) error {
 	return func(pod *jetpack.Pod, args []string) error {
 		jid := pod.Jid()
@@ -138,75 +548,188 @@ func cmdPodCmd(cmd string, baseArgs ...string) func(*jetpack.Pod, []string) erro
 	}
 }
 
-var flConsoleUsername string
+var flConsoleUsername, flConsoleShell string
 
 func flConsole(fl *flag.FlagSet) {
 	fl.StringVar(&flConsoleUsername, "u", "root", "Username to run console as")
+	fl.StringVar(&flConsoleShell, "shell", "", "Shell to run (default: login, user's shell, or /bin/sh)")
+	flEnvVars(fl)
 }
 
 func cmdConsole(app *jetpack.App) error {
-	return errors.Trace(app.Console(flConsoleUsername))
+	if es, err := app.Console(flConsoleUsername, flConsoleShell, runOptions()); err != nil {
+		return errors.Trace(err)
+	} else {
+		return es.Err()
+	}
+}
+
+func cmdSupervise(app *jetpack.App, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	var opts jetpack.RunOptions
+	if err := json.Unmarshal([]byte(args[0]), &opts); err != nil {
+		return errors.Trace(err)
+	}
+	if es, err := app.Supervise(&opts); err != nil {
+		return errors.Trace(err)
+	} else {
+		return es.Err()
+	}
+}
+
+func cmdSyslogForward(pod *jetpack.Pod) error {
+	return errors.Trace(pod.ForwardSyslog())
+}
+
+func cmdWait(app *jetpack.App) error {
+	if sv, err := app.Pod.Supervisor(app.Name); err != nil {
+		return errors.Trace(err)
+	} else if sv == nil {
+		return errors.Errorf("App %v doesn't run detached", app.Name)
+	} else if es, err := sv.Wait(); err != nil {
+		return errors.Trace(err)
+	} else {
+		if !Quiet {
+			fmt.Println(es)
+		}
+		return es.Err()
+	}
+}
+
+var flLogsFollow, flLogsErr bool
+var flLogsLines int
+
+func flLogs(fl *flag.FlagSet) {
+	fl.BoolVar(&flLogsFollow, "f", false, "Follow the log")
+	fl.IntVar(&flLogsLines, "n", 0, "Show only last LINES lines")
+	fl.BoolVar(&flLogsErr, "err", false, "Show stderr instead of stdout")
+}
+
+func cmdLogs(app *jetpack.App) error {
+	opts := &jetpack.LogsOptions{Lines: flLogsLines, Follow: flLogsFollow}
+	if flLogsErr {
+		opts.Stream = "err"
+	}
+	rd, err := app.Pod.Logs(app.Name, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rd.Close()
+	_, err = io.Copy(os.Stdout, rd)
+	return errors.Trace(err)
+}
+
+var flExecTTY bool
+
+func flExec(fl *flag.FlagSet) {
+	fl.BoolVar(&flExecTTY, "t", false, "Run command on a pseudo-terminal")
+	flEnvVars(fl)
+	flStdinMode(fl)
 }
 
 func cmdExec(app *jetpack.App, args []string) error {
-	return errors.Trace(app.Stage2(os.Stdin, os.Stdout, os.Stderr, "", "", "", args...))
+	var es *jetpack.ExitStatus
+	var err error
+	if flExecTTY {
+		es, err = app.Stage2TTY(runOptions(), "", "", "", args...)
+	} else {
+		es, err = app.Stage2(runOptions(), os.Stdin, os.Stdout, os.Stderr, "", "", "", args...)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return es.Err()
 }
 
-// Arguments for cp to leave unprocessed (switches and local paths):
-//  - switches (starting with '-')
+// Local paths for cp (left unprocessed):
 //  - absolute paths (starting with '/')
 //  - current and parent dir (literal "." and "..")
 //  - relative paths (starting with "./" or "../")
-var cmdCpSwitchOrLocalFileRegexp = regexp.MustCompile(`^(?:[-/]|\.\.?(?:$|/))`)
+var cmdCpLocalFileRegexp = regexp.MustCompile(`^(?:/|\.\.?(?:$|/))`)
+
+var flCpChown bool
+
+func flCp(fl *flag.FlagSet) {
+	fl.BoolVar(&flCpChown, "chown", false, "Give files copied to an app to the app's user")
+}
+
+// Pod path of cp
+type cpPodPath struct {
+	pod  *jetpack.Pod
+	opts jetpack.CopyOptions
+	path string
+}
+
+// Parses POD:[APP|@VOL]:PATH argument of cp; nil if it's a local path.
+func parseCpPodPath(arg string, pods map[string]*jetpack.Pod) (*cpPodPath, error) {
+	if cmdCpLocalFileRegexp.MatchString(arg) {
+		return nil, nil
+	}
+	pieces := strings.SplitN(arg, ":", 3)
+	if len(pieces) != 3 {
+		return nil, ErrUsage
+	}
+	podUUID := uuid.Parse(pieces[0])
+	if podUUID == nil {
+		return nil, ErrUsage
+	}
+	pod := pods[podUUID.String()]
+	if pod == nil {
+		if pod_, err := Host.GetPod(podUUID); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			pod = pod_
+			pods[podUUID.String()] = pod
+		}
+	}
+	pp := &cpPodPath{pod: pod, path: pieces[2]}
+	if strings.HasPrefix(pieces[1], "@") {
+		pp.opts.Volume = types.ACName(pieces[1][1:])
+	} else {
+		pp.opts.App = types.ACName(pieces[1])
+	}
+	return pp, nil
+}
 
 func cmdCp(args []string) error {
+	if len(args) < 2 {
+		return ErrUsage
+	}
 	// caches
 	pods := map[string]*jetpack.Pod{}
 
+	paths := make([]*cpPodPath, len(args))
 	for i, arg := range args {
-		// Leave switches and local paths alone
-		if cmdCpSwitchOrLocalFileRegexp.MatchString(arg) {
-			continue
-		}
-		pieces := strings.SplitN(arg, ":", 3)
-		if len(pieces) != 3 {
-			return ErrUsage
-		}
-
-		podUUID := uuid.Parse(pieces[0])
-		if podUUID == nil {
-			return ErrUsage
+		if pp, err := parseCpPodPath(arg, pods); err != nil {
+			return err
+		} else {
+			paths[i] = pp
 		}
+	}
 
-		pod := pods[podUUID.String()]
-		if pod == nil {
-			pod_, err := Host.GetPod(podUUID)
-			if err != nil {
-				return err
+	last := len(args) - 1
+	target := paths[last]
+	for i, source := range paths[:last] {
+		switch {
+		case source == nil && target != nil:
+			opts := target.opts
+			opts.Chown = flCpChown
+			if err := target.pod.CopyTo(args[i], target.path, &opts); err != nil {
+				return errors.Trace(err)
 			}
-			pod = pod_
-			pods[podUUID.String()] = pod_
-		}
-
-		isVolume := false
-		if pieces[1] == "" {
-			if len(pod.Manifest.Apps) != 1 {
+		case source != nil && target == nil:
+			if flCpChown {
 				return ErrUsage
 			}
-			pieces[1] = pod.Manifest.Apps[0].Name.String()
-		} else if pieces[1][0] == '@' {
-			isVolume = true
-			pieces[1] = pieces[1][1:]
-		}
-
-		// TODO: sanity check on paths?
-		if isVolume {
-			args[i] = pod.Path("rootfs", "vol", pieces[1], pieces[2])
-		} else {
-			args[i] = pod.Path("rootfs", "app", pieces[1], "rootfs", pieces[2])
+			if err := source.pod.CopyFrom(source.path, args[last], &source.opts); err != nil {
+				return errors.Trace(err)
+			}
+		default:
+			// One side needs to be a pod, the other the host
+			return ErrUsage
 		}
 	}
-
-	// fmt.Printf("cp %#v\n", args)
-	return errors.Trace(run.Command("/bin/cp", args...).Run())
+	return nil
 }
@@ -4,17 +4,18 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"sort"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/jetpack"
 )
 
 func init() {
-	AddCommand("trust [LOCATION]", "Trust or list ACI signing keys", cmdTrust, flTrust)
-	AddCommand("untrust KEY...", "Remove keys from trust database", cmdUntrust, nil)
+	AddCommand("trust [-prefix PREFIX|-root] [-fingerprint FINGERPRINT] [LOCATION...]", "Trust or list ACI signing keys", cmdTrust, flTrust)
+	AddCommand("untrust FINGERPRINT...", "Remove keys from trust database", cmdUntrust, nil)
 }
 
 var trustPrefix types.ACIdentifier
@@ -27,6 +28,35 @@ func flTrust(fl *flag.FlagSet) {
 	fl.StringVar(&trustFingerprint, "fingerprint", "", "Specify key fingerprint to accept")
 }
 
+var flDiscoverKeys bool
+
+// Flag of commands that import images
+func flDiscoverKeysFlag(fl *flag.FlagSet) {
+	fl.BoolVar(&flDiscoverKeys, "discover-keys", false, "Discover keys of unknown image signers, and ask to trust them")
+}
+
+// Returns confirmKey if -discover-keys is given, nil otherwise.
+func discoverKeys() func(*jetpack.TrustedKey) bool {
+	if flDiscoverKeys {
+		return confirmKey
+	}
+	return nil
+}
+
+// Shows key, and asks whether to trust it.
+func confirmKey(tk *jetpack.TrustedKey) bool {
+	if tk.Prefix == "" {
+		fmt.Println("Prefix: ROOT KEY (matches all names)")
+	} else {
+		fmt.Println("Prefix:", tk.Prefix)
+	}
+	fmt.Println("Fingerprint:", tk.Fingerprint)
+	for _, id := range tk.Identities {
+		fmt.Println(" -", id)
+	}
+	return askYesNo("Are you sure you want to trust this key")
+}
+
 func cmdTrust(args []string) error {
 	if len(args) == 0 {
 		return errors.Trace(listKeys())
@@ -42,55 +72,68 @@ func cmdUntrust(args []string) error {
 }
 
 func listKeys() error {
-	ks := Host.Keystore()
-
-	kr, err := ks.GetAllKeys()
+	keys, err := Host.ListTrustedKeys()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	if kr.Len() == 0 {
+	if len(keys) == 0 {
 		fmt.Println("No trusted keys.")
 		return nil
 	}
 
-	el := kr.Entities()
-	sort.Sort(el)
-
-	lines := make([]string, len(el))
-	for i, ety := range el {
-		lines[i] = ety.String()
-	}
-
 	w := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
-	fmt.Fprintf(w, "PREFIX\tFINGERPRINT\tIDENTITY\n%v\n", strings.Join(lines, "\n"))
+	fmt.Fprintln(w, "PREFIX\tFINGERPRINT\tIDENTITY")
+	for _, tk := range keys {
+		prefix := tk.Prefix
+		if prefix == "" {
+			prefix = "@"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", prefix, tk.Fingerprint, strings.Join(tk.Identities, "; "))
+	}
 	return errors.Trace(w.Flush())
 }
 
 func trustKeys(args []string) error {
+	opts := &jetpack.TrustOptions{Fingerprint: trustFingerprint, Confirm: confirmKey}
 	for _, loc := range args {
-		if trustPrefix.Empty() {
-			if acnLoc, err := types.NewACIdentifier(loc); err != nil {
-				return errors.Trace(err)
-			} else if err := Host.TrustKey(*acnLoc, "", trustFingerprint); err != nil {
+		var tk *jetpack.TrustedKey
+		var err error
+		switch {
+		case trustRoot:
+			tk, err = Host.FetchTrustedKey("", loc, opts)
+		case !trustPrefix.Empty():
+			tk, err = Host.FetchTrustedKey(trustPrefix.String(), loc, opts)
+		default:
+			if _, err := types.NewACIdentifier(loc); err != nil {
 				return errors.Trace(err)
 			}
-		} else if err := Host.TrustKey(trustPrefix, loc, trustFingerprint); err != nil {
+			tk, err = Host.FetchTrustedKey(loc, "", opts)
+		}
+		if errors.Cause(err) == jetpack.ErrKeyNotConfirmed {
+			fmt.Println("Key NOT accepted:", err)
+			continue
+		} else if err != nil {
 			return errors.Trace(err)
 		}
+		fmt.Println("Key accepted:", tk.Fingerprint)
 	}
 
 	return nil
 }
 
 func untrustKeys(args []string) error {
-	ks := Host.Keystore()
 	for _, fprint := range args {
 		fmt.Println("Untrusting:", fprint)
-		if removed, err := ks.UntrustKey(fprint); err != nil {
+		if removed, err := Host.UntrustKey(fprint); err != nil {
 			return errors.Trace(err)
 		} else {
-			fmt.Println("Removed from:", removed)
+			for i := range removed {
+				if removed[i] == "" {
+					removed[i] = "@"
+				}
+			}
+			fmt.Println("Removed from:", strings.Join(removed, ", "))
 		}
 	}
 	return nil
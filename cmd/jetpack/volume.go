@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+func init() {
+	AddCommand("volumes", "List managed volumes", cmdListVolumes, flList)
+	AddCommand("create-volume NAME [PROPERTY=VALUE...]", "Create a managed volume", cmdCreateVolume, nil)
+	AddCommand("destroy-volume NAME", "Destroy a managed volume", cmdDestroyVolume, flDestroyVolume)
+}
+
+func cmdListVolumes([]string) error {
+	if mvs, err := Host.Volumes(); err != nil {
+		return errors.Trace(err)
+	} else {
+		// Names are not hashes, don't shorten them
+		LongHash = true
+		items := make([][]string, len(mvs))
+		for i, mv := range mvs {
+			items[i] = []string{mv.Name.String(), mv.Used(), fmt.Sprintf("%d", len(mv.Pods())), mv.Path()}
+		}
+		return doList("NAME\tUSED\tPODS\tPATH", items)
+	}
+}
+
+func cmdCreateVolume(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	name, err := types.NewACName(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	props := make(map[string]string)
+	for _, arg := range args[1:] {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) != 2 {
+			return ErrUsage
+		} else {
+			props[kv[0]] = kv[1]
+		}
+	}
+	if mv, err := Host.CreateVolume(*name, props); err != nil {
+		return errors.Trace(err)
+	} else {
+		fmt.Println(mv.Path())
+		return nil
+	}
+}
+
+var flDestroyVolumeForce bool
+
+func flDestroyVolume(fl *flag.FlagSet) {
+	fl.BoolVar(&flDestroyVolumeForce, "f", false, "Destroy even if used by stopped pods")
+}
+
+func cmdDestroyVolume(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if name, err := types.NewACName(args[0]); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(Host.RemoveVolume(*name, flDestroyVolumeForce))
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -185,17 +184,15 @@ func parseApp(args []string) ([]string, *schema.RuntimeApp, error) {
 	// Parse first argument (image name)
 	if h, err := types.NewHash(args[0]); err == nil {
 		rtapp.Image.ID = *h
-		rtapp.Name.Set(h.String()) // won't err
 	} else if name, labels, err := ParseImageName(args[0]); err == nil {
 		rtapp.Image.Name = &name
-		rtapp.Name.Set(path.Base(name.String())) // won't err here
 		rtapp.Image.Labels = labels
 	} else {
 		return args, nil, err
 	}
 
 	fl := flag.NewFlagSet(args[0], flag.ExitOnError)
-	fl.Var(&rtapp.Name, "name", "App name")
+	fl.Var(&rtapp.Name, "name", "App name (default: derived from image name)")
 	fl.Var((*AnnotationsFlag)(&rtapp.Annotations), "a", "Add annotation (NAME=VALUE)")
 	fl.Var((*MountsFlag)(&rtapp.Mounts), "m", "Mount volume (VOLUME[:MOUNTPOINT])")
 	// TODO: app override
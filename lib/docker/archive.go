@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Entry of manifest.json in a docker-save archive
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Reads image from a docker-save archive. The archive is unpacked to
+// a temporary directory in tmpdir ("" for the system default), which
+// is removed when the image is closed. An archive with several images
+// is rejected.
+func ReadArchive(filename, tmpdir string) (_ *Image, erv error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	dir, err := ioutil.TempDir(tmpdir, "docker-archive.")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		if erv != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "Reading %v", filename)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return nil, errors.Trace(err)
+		}
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "Reading %v", filename)
+		}
+	}
+
+	var manifests []archiveManifest
+	if bb, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json")); os.IsNotExist(err) {
+		return nil, errors.Errorf("%v is not a docker-save archive: no manifest.json", filename)
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &manifests); err != nil {
+		return nil, errors.Annotatef(err, "%v: manifest.json", filename)
+	}
+	if len(manifests) != 1 {
+		return nil, errors.Errorf("%v has %d images, expected one", filename, len(manifests))
+	}
+	am := manifests[0]
+
+	archivePath := func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+name), "/")))
+	}
+	configBytes, err := ioutil.ReadFile(archivePath(am.Config))
+	if err != nil {
+		return nil, errors.Annotatef(err, "%v: image config", filename)
+	}
+	img := &Image{
+		ID:     fmt.Sprintf("sha256:%x", sha256.Sum256(configBytes)),
+		Config: &ImageConfig{},
+		layers: len(am.Layers),
+		openLayer: func(i int) (io.ReadCloser, error) {
+			return os.Open(archivePath(am.Layers[i]))
+		},
+		close: removeAll(dir),
+	}
+	if err := json.Unmarshal(configBytes, img.Config); err != nil {
+		return nil, errors.Annotatef(err, "%v: image config", filename)
+	}
+	if len(am.RepoTags) > 0 {
+		if ref, err := ParseReference(am.RepoTags[0]); err != nil {
+			return nil, errors.Annotatef(err, "%v", filename)
+		} else {
+			img.Reference = ref
+		}
+	}
+	return img, nil
+}
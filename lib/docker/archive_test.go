@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	config := `{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/sh"]}}`
+	layer := testLayer(t, false, testEntry{"bin/sh", tar.TypeReg, "sh"})
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"manifest.json", `[{"Config":"abc.json","RepoTags":["example.com/shell:1"],"Layers":["l1/layer.tar"]}]`},
+		{"abc.json", config},
+		{"l1/layer.tar", string(layer)},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	archive := filepath.Join(tmp, "image.tar")
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ReadArchive(archive, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config))); img.ID != id {
+		t.Errorf("ID is %v, expected %v", img.ID, id)
+	}
+	if img.Reference.String() != "example.com/shell:1" {
+		t.Errorf("reference is %v", img.Reference)
+	}
+	var aci bytes.Buffer
+	if err := WriteACI(&aci, img); err != nil {
+		t.Fatal(err)
+	}
+	if entries, im := readTestACI(t, aci.Bytes()); entries["rootfs/bin/sh"] != "sh" {
+		t.Errorf("rootfs is %v", entries)
+	} else if im.App == nil || im.App.Exec[0] != "/bin/sh" {
+		t.Errorf("app is %v", im.App)
+	}
+
+	if err := img.Close(); err != nil {
+		t.Error(err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tmp, "docker-archive.*")); len(left) != 0 {
+		t.Errorf("temporary files left: %v", left)
+	}
+
+	if _, err := ReadArchive(filepath.Join(tmp, "no-such-file"), tmp); err == nil {
+		t.Error("expected error for a missing archive")
+	}
+}
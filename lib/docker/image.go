@@ -0,0 +1,240 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Docker and OCI images are converted to ACIs: layers are squashed
+// into the rootfs, and the image config becomes the app. Labels record
+// the platform, tag (as version), and image ID (digest of the config,
+// which is the same in a registry, in a docker-save archive, and in an
+// OCI layout), so that an image that has been converted already can be
+// found without downloading its layers. Image's labels (Docker's
+// LABEL) and manifest annotations become annotations, if their names
+// are valid in appc.
+
+// Label with the image ID of a converted image
+const ImageIDLabel = "docker-image-id"
+
+// Annotations of a converted image
+const (
+	RepositoryAnnotation     = "appc.io/docker/repository"
+	ImageIDAnnotation        = "appc.io/docker/imageid"
+	ManifestDigestAnnotation = "appc.io/docker/manifest-digest"
+)
+
+// Image configuration, as in a registry or in a docker-save archive
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	OS           string `json:"os"`
+	Config       struct {
+		User         string              `json:"User"`
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Volumes      map[string]struct{} `json:"Volumes"`
+		Labels       map[string]string   `json:"Labels"`
+	} `json:"config"`
+}
+
+// Docker or OCI image read from a registry, an archive, or a layout.
+// Layers are opened on demand, so that an image can be skipped after
+// reading its config.
+type Image struct {
+	Reference      *Reference         // nil if not known
+	ImageName      types.ACIdentifier // name of the converted image; from Reference if empty
+	ID             string             // digest of the config
+	ManifestDigest string             // digest of the image manifest, if known
+	Annotations    map[string]string  // of the image manifest
+	Config         *ImageConfig
+
+	layers    int
+	openLayer func(i int) (io.ReadCloser, error)
+	close     func() error
+}
+
+// Releases temporary files of the image.
+func (img *Image) Close() error {
+	if img.close != nil {
+		return img.close()
+	}
+	return nil
+}
+
+// Returns name of the converted image.
+func (img *Image) Name() (types.ACIdentifier, error) {
+	if !img.ImageName.Empty() {
+		return img.ImageName, nil
+	}
+	if img.Reference == nil || img.Reference.Repository == "" {
+		return "", errors.New("Image has no repository name")
+	}
+	name, err := types.NewACIdentifier(img.Reference.ImageName())
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return *name, nil
+}
+
+// Docker architectures and their appc names
+var archNames = map[string]string{
+	"386":   "i386",
+	"arm64": "aarch64",
+	"arm":   "armv7l",
+}
+
+// Returns appc arch label of the image.
+func (img *Image) Arch() string {
+	arch := img.Config.Architecture
+	if arch == "arm" && img.Config.Variant == "v6" {
+		return "armv6l"
+	}
+	if name, ok := archNames[arch]; ok {
+		return name
+	}
+	return arch
+}
+
+// Returns labels of the converted image.
+func (img *Image) Labels() types.Labels {
+	var labels types.Labels
+	if img.Reference != nil && img.Reference.Tag != "" {
+		labels = append(labels, types.Label{Name: "version", Value: img.Reference.Tag})
+	}
+	if img.Config.OS != "" {
+		labels = append(labels, types.Label{Name: "os", Value: img.Config.OS})
+	}
+	if arch := img.Arch(); arch != "" {
+		labels = append(labels, types.Label{Name: "arch", Value: arch})
+	}
+	return append(labels, types.Label{Name: ImageIDLabel, Value: img.ID})
+}
+
+// Returns manifest of the converted image; passwd is contents of
+// image's /etc/passwd, for the group of a user without a group, and
+// fs resolves a relative executable in image's PATH.
+func (img *Image) manifest(passwd []byte, fs *rootfsIndex) (*schema.ImageManifest, error) {
+	im := schema.BlankImageManifest()
+	name, err := img.Name()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	im.Name = name
+	im.Labels = img.Labels()
+	for _, src := range []map[string]string{img.Config.Config.Labels, img.Annotations} {
+		names := make([]string, 0, len(src))
+		for name := range src {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if acName, err := types.NewACIdentifier(name); err == nil {
+				im.Annotations.Set(*acName, src[name])
+			}
+		}
+	}
+	im.Annotations.Set(ImageIDAnnotation, img.ID)
+	if img.Reference != nil && img.Reference.Repository != "" {
+		im.Annotations.Set(RepositoryAnnotation, img.Reference.String())
+	}
+	if img.ManifestDigest != "" {
+		im.Annotations.Set(ManifestDigestAnnotation, img.ManifestDigest)
+	}
+
+	cfg := img.Config.Config
+	exec := append(append([]string(nil), cfg.Entrypoint...), cfg.Cmd...)
+	if len(exec) == 0 {
+		// Base image, nothing to run
+		return im, nil
+	}
+
+	app := &types.App{WorkingDirectory: cfg.WorkingDir}
+	for _, env := range cfg.Env {
+		pieces := strings.SplitN(env, "=", 2)
+		if len(pieces) == 2 {
+			app.Environment.Set(pieces[0], pieces[1])
+		}
+	}
+	if !path.IsAbs(exec[0]) {
+		envPath, _ := app.Environment.Get("PATH")
+		if resolved := fs.lookPath(exec[0], envPath); resolved != "" {
+			exec[0] = resolved
+		}
+	}
+	app.Exec = exec
+	app.User, app.Group = userGroup(cfg.User, passwd)
+
+	for _, port := range sortedKeys(cfg.ExposedPorts) {
+		pieces := strings.SplitN(port, "/", 2)
+		proto := "tcp"
+		if len(pieces) == 2 {
+			proto = pieces[1]
+		}
+		n, err := strconv.ParseUint(pieces[0], 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("Invalid exposed port %#v", port)
+		}
+		portName, err := types.SanitizeACName(fmt.Sprintf("%v-%v", proto, n))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		app.Ports = append(app.Ports, types.Port{Name: types.ACName(portName), Protocol: proto, Port: uint(n), Count: 1})
+	}
+
+	for _, vol := range sortedKeys(cfg.Volumes) {
+		mpName, err := types.SanitizeACName("volume" + strings.Replace(path.Clean(vol), "/", "-", -1))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		app.MountPoints = append(app.MountPoints, types.MountPoint{Name: types.ACName(mpName), Path: vol})
+	}
+
+	im.App = app
+	return im, nil
+}
+
+// Translates Docker's USER (name, uid, name:group, uid:gid) to appc
+// user and group. Group of a user without one is their primary group
+// from the image's /etc/passwd, or root.
+func userGroup(user string, passwd []byte) (string, string) {
+	if user == "" {
+		return "0", "0"
+	}
+	if pieces := strings.SplitN(user, ":", 2); len(pieces) == 2 {
+		return pieces[0], pieces[1]
+	}
+	for _, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 4 && (fields[0] == user || fields[2] == user) {
+			return user, fields[3]
+		}
+	}
+	return user, "0"
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Removes dir and everything in it; for close functions.
+func removeAll(dir string) func() error {
+	return func() error { return os.RemoveAll(dir) }
+}
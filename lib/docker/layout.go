@@ -0,0 +1,152 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Annotation of an OCI index entry with its tag or reference
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Deepest nesting of indexes we follow
+const maxIndexDepth = 4
+
+// Reads image from an OCI image layout directory. With a tag, the
+// index entry whose ref.name annotation is the tag (or a reference
+// with the tag) is used; without one, the image is selected from the
+// whole index. Nested indexes are resolved by platform, like manifest
+// lists of a registry. Manifest, config, and layers are verified
+// against their digests.
+func ReadLayout(dir, tag string) (*Image, error) {
+	var layout struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout")); os.IsNotExist(err) {
+		return nil, errors.Errorf("%v is not an OCI image layout: no oci-layout file", dir)
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &layout); err != nil || layout.ImageLayoutVersion == "" {
+		return nil, errors.Errorf("%v: invalid oci-layout file", dir)
+	}
+
+	var index registryManifest
+	if bb, err := ioutil.ReadFile(filepath.Join(dir, "index.json")); err != nil {
+		return nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &index); err != nil {
+		return nil, errors.Annotatef(err, "%v: index.json", dir)
+	}
+
+	candidates := index.Manifests
+	if tag != "" {
+		candidates = nil
+		for _, m := range index.Manifests {
+			if refName := m.Annotations[refNameAnnotation]; refName == tag || strings.HasSuffix(refName, ":"+tag) {
+				candidates = append(candidates, m)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, errors.Errorf("%v: no image tagged %v", dir, tag)
+		}
+	}
+
+	var refName string
+	var manifest *registryManifest
+	var digest string
+	for depth := 0; manifest == nil; depth++ {
+		if depth > maxIndexDepth {
+			return nil, errors.Errorf("%v: indexes nested too deep", dir)
+		}
+		found, err := selectManifest(candidates)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v", dir)
+		}
+		if depth == 0 {
+			refName = found.Annotations[refNameAnnotation]
+		}
+		bb, err := readLayoutBlob(dir, found.Digest)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var m registryManifest
+		if err := json.Unmarshal(bb, &m); err != nil {
+			return nil, errors.Annotatef(err, "%v: manifest %v", dir, found.Digest)
+		}
+		if m.MediaType == "" {
+			m.MediaType = found.MediaType
+		}
+		if isIndex(&m) {
+			candidates = m.Manifests
+		} else {
+			manifest, digest = &m, found.Digest
+		}
+	}
+	if manifest.SchemaVersion != 2 || manifest.Config.Digest == "" {
+		return nil, errors.Errorf("%v: unsupported manifest (schema version %d)", dir, manifest.SchemaVersion)
+	}
+
+	configBytes, err := readLayoutBlob(dir, manifest.Config.Digest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	img := &Image{
+		ID:             manifest.Config.Digest,
+		ManifestDigest: digest,
+		Annotations:    manifest.Annotations,
+		Config:         &ImageConfig{},
+		layers:         len(manifest.Layers),
+		openLayer: func(i int) (io.ReadCloser, error) {
+			return openLayoutBlob(dir, manifest.Layers[i].Digest)
+		},
+	}
+	if err := json.Unmarshal(configBytes, img.Config); err != nil {
+		return nil, errors.Annotatef(err, "%v: image config", dir)
+	}
+
+	// ref.name is a tag, or a full reference
+	if ref, err := ParseReference(refName); err == nil && strings.Contains(refName, "/") {
+		img.Reference = ref
+	} else if tagRegexp.MatchString(refName) {
+		img.Reference = &Reference{Tag: refName}
+	}
+	return img, nil
+}
+
+func layoutBlobPath(dir, digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", errors.Errorf("Unsupported digest %#v", digest)
+	}
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+// Opens a blob of the layout, and verifies its digest.
+func openLayoutBlob(dir, digest string) (*os.File, error) {
+	path, err := layoutBlobPath(dir, digest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := verifyBlob(f, digest); err != nil {
+		f.Close()
+		return nil, errors.Annotatef(err, "%v", path)
+	}
+	return f, nil
+}
+
+func readLayoutBlob(dir, digest string) ([]byte, error) {
+	f, err := openLayoutBlob(dir, digest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	bb, err := ioutil.ReadAll(io.LimitReader(f, maxMetadataSize))
+	return bb, errors.Trace(err)
+}
@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Writes an OCI layout with an index that points, for tag 1.0, to a
+// nested index of a Linux and a Windows image. Returns digest of the
+// Linux image's manifest.
+func writeTestLayout(t *testing.T, dir string) string {
+	blob := func(content []byte) string {
+		digest := sha256Digest(content)
+		path := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	config := blob([]byte(`{"architecture":"` + runtime.GOARCH + `","os":"linux","config":{
+  "Entrypoint":["/bin/app"],"Env":["A=1"],"Labels":{"maintainer":"ops@example.com","Not Valid":"x"}}}`))
+	lower := blob(testLayer(t, true,
+		testEntry{"bin/app", tar.TypeReg, "app"},
+		testEntry{"etc/old", tar.TypeReg, "old"},
+	))
+	upper := blob(testLayer(t, false, testEntry{"etc/.wh.old", tar.TypeReg, ""}))
+	manifest := blob([]byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,
+  "config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q},
+  "layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q},
+            {"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q}],
+  "annotations":{"org.opencontainers.image.source":"https://example.com/app"}}`,
+		mediaTypeOCIManifest, config, lower, upper)))
+	nested := blob([]byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+  {"mediaType":%q,"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","platform":{"os":"windows","architecture":%q}},
+  {"mediaType":%q,"digest":%q,"platform":{"os":"linux","architecture":%q}}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, runtime.GOARCH, mediaTypeOCIManifest, manifest, runtime.GOARCH)))
+	for name, content := range map[string]string{
+		"oci-layout": `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json": fmt.Sprintf(`{"schemaVersion":2,"manifests":[
+  {"mediaType":%q,"digest":%q,"annotations":{%q:"1.0"}}]}`, mediaTypeOCIIndex, nested, refNameAnnotation),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return manifest
+}
+
+func TestReadLayout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	manifestDigest := writeTestLayout(t, tmp)
+
+	if _, err := ReadLayout(tmp, "2.0"); err == nil {
+		t.Error("expected error for a missing tag")
+	}
+	if _, err := ReadLayout(filepath.Join(tmp, "blobs"), ""); err == nil {
+		t.Error("expected error for a directory that is not a layout")
+	}
+
+	img, err := ReadLayout(tmp, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ManifestDigest != manifestDigest {
+		t.Errorf("manifest digest %v, expected %v", img.ManifestDigest, manifestDigest)
+	}
+	if _, err := img.Name(); err == nil {
+		t.Error("expected error for an image without name")
+	}
+	img.ImageName = "example.com/app"
+
+	entries, im := readTestACI(t, mustWriteACI(t, img).Bytes())
+	if entries["rootfs/bin/app"] != "app" {
+		t.Errorf("rootfs is %v", entries)
+	}
+	if _, ok := entries["rootfs/etc/old"]; ok {
+		t.Error("deleted file is in rootfs")
+	}
+	if im.Name != "example.com/app" {
+		t.Errorf("name is %v", im.Name)
+	}
+	for name, value := range map[string]string{
+		"version": "1.0",
+		"os":      "linux",
+	} {
+		if v, _ := im.GetLabel(name); v != value {
+			t.Errorf("label %v is %#v, expected %#v", name, v, value)
+		}
+	}
+	for name, value := range map[string]string{
+		"maintainer":                      "ops@example.com",
+		"org.opencontainers.image.source": "https://example.com/app",
+		ManifestDigestAnnotation:          manifestDigest,
+	} {
+		if v, _ := im.Annotations.Get(name); v != value {
+			t.Errorf("annotation %v is %#v, expected %#v", name, v, value)
+		}
+	}
+	if len(im.Annotations) != 4 {
+		t.Errorf("unexpected annotations %v", im.Annotations)
+	}
+
+	// Corrupt a layer
+	layers, _ := filepath.Glob(filepath.Join(tmp, "blobs", "sha256", "*"))
+	for _, layer := range layers {
+		if bb, _ := ioutil.ReadFile(layer); len(bb) > 0 && bb[0] == 0x1f {
+			ioutil.WriteFile(layer, bb[:len(bb)-1], 0644)
+		}
+	}
+	if _, err := img.openLayer(0); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("expected digest mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package docker
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Registry of Docker Hub, for references without a registry
+const DefaultRegistry = "registry-1.docker.io"
+
+// Reference to an image in a registry:
+// [REGISTRY/]REPOSITORY[:TAG][@DIGEST]
+type Reference struct {
+	Registry   string // host[:port]
+	Repository string // official images of Docker Hub are in library/
+	Tag        string // "latest" if neither tag nor digest is given
+	Digest     string // of image manifest, e.g. sha256:...
+}
+
+var repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+var tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+var digestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+func ParseReference(str string) (*Reference, error) {
+	ref := &Reference{}
+	rest := str
+	if i := strings.Index(rest, "@"); i >= 0 {
+		rest, ref.Digest = rest[:i], rest[i+1:]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return nil, errors.Errorf("Invalid digest in %#v", str)
+		}
+	}
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		rest, ref.Tag = rest[:i], rest[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, errors.Errorf("Invalid tag in %#v", str)
+		}
+	}
+
+	// First component is a registry if it looks like a host name
+	if i := strings.Index(rest, "/"); i >= 0 {
+		if host := rest[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, rest = host, rest[i+1:]
+		}
+	}
+	switch ref.Registry {
+	case "", "docker.io", "index.docker.io":
+		ref.Registry = DefaultRegistry
+		if !strings.Contains(rest, "/") {
+			rest = "library/" + rest
+		}
+	}
+	if !repositoryRegexp.MatchString(rest) {
+		return nil, errors.Errorf("Invalid repository in %#v", str)
+	}
+	ref.Repository = rest
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+func (ref *Reference) String() string {
+	str := ref.Registry + "/" + ref.Repository
+	if ref.Tag != "" {
+		str += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		str += "@" + ref.Digest
+	}
+	return str
+}
+
+// Returns name of the converted image: REGISTRY/REPOSITORY, with
+// docker.io for Docker Hub, and port separated by a dash.
+func (ref *Reference) ImageName() string {
+	registry := ref.Registry
+	if registry == DefaultRegistry {
+		registry = "docker.io"
+	}
+	return strings.Replace(registry, ":", "-", 1) + "/" + ref.Repository
+}
+
+// Returns tag or digest to request the manifest with
+func (ref *Reference) manifestRef() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
@@ -0,0 +1,35 @@
+package docker
+
+import "testing"
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, c := range []struct {
+		str, expected, imageName string
+	}{
+		{"busybox", "registry-1.docker.io/library/busybox:latest", "docker.io/library/busybox"},
+		{"docker.io/library/nginx:1.11", "registry-1.docker.io/library/nginx:1.11", "docker.io/library/nginx"},
+		{"grafana/grafana:4.0.0", "registry-1.docker.io/grafana/grafana:4.0.0", "docker.io/grafana/grafana"},
+		{"quay.io/coreos/etcd@" + digest, "quay.io/coreos/etcd@" + digest, "quay.io/coreos/etcd"},
+		{"localhost:5000/app:v1", "localhost:5000/app:v1", "localhost-5000/app"},
+		{"localhost/app", "localhost/app:latest", "localhost/app"},
+	} {
+		ref, err := ParseReference(c.str)
+		if err != nil {
+			t.Errorf("%v: %v", c.str, err)
+			continue
+		}
+		if ref.String() != c.expected {
+			t.Errorf("%v: parsed as %v, expected %v", c.str, ref, c.expected)
+		}
+		if ref.ImageName() != c.imageName {
+			t.Errorf("%v: image name %v, expected %v", c.str, ref.ImageName(), c.imageName)
+		}
+	}
+
+	for _, str := range []string{"", "Busybox", "busybox:", "busybox@sha256:abc", "registry.example.com/"} {
+		if ref, err := ParseReference(str); err == nil {
+			t.Errorf("%#v: expected error, got %v", str, ref)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// Media types of manifests
+const (
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// Largest manifest or config we read
+const maxMetadataSize = 4 << 20
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+// Image manifest, or manifest list (OCI index)
+type registryManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Manifests     []descriptor      `json:"manifests"` // of a list
+	Annotations   map[string]string `json:"annotations"`
+}
+
+func isIndex(m *registryManifest) bool {
+	return m.MediaType == mediaTypeManifestList || m.MediaType == mediaTypeOCIIndex || len(m.Manifests) > 0
+}
+
+// Operating systems of images we can run, preferred first
+var imageOSes = []string{"freebsd", "linux"}
+
+// Selects manifest of an image we can run from a list: native FreeBSD
+// image, or Linux image, for host's architecture. Entry without a
+// platform is selected only if it is the only one.
+func selectManifest(manifests []descriptor) (*descriptor, error) {
+	if len(manifests) == 1 && manifests[0].Platform == nil {
+		return &manifests[0], nil
+	}
+	for _, imageOS := range imageOSes {
+		for i, m := range manifests {
+			if m.Platform != nil && m.Platform.OS == imageOS && m.Platform.Architecture == runtime.GOARCH {
+				return &manifests[i], nil
+			}
+		}
+	}
+	return nil, errors.Errorf("No image for %v/%v", strings.Join(imageOSes, " or "), runtime.GOARCH)
+}
+
+// Client of a registry's v2 API, for one repository
+type registry struct {
+	ref    *Reference
+	o      *fetch.Options // with bearer token, once we get one
+	scheme string
+}
+
+// Pulls image from a registry: reads its manifest and config, and
+// downloads layers when they are opened. Manifest lists are resolved
+// to the Linux image for the host's architecture. Manifest, config,
+// and each layer are verified against their digests.
+func Pull(ref *Reference, o *fetch.Options) (_ *Image, erv error) {
+	defer func() {
+		switch errors.Cause(erv) {
+		case nil, fetch.ErrDiscoveryFailed, fetch.ErrDownloadFailed, fetch.ErrVerificationFailed:
+		default:
+			erv = &fetch.Error{Stage: fetch.ErrDiscoveryFailed, Location: ref.String(), Err: erv}
+		}
+	}()
+	if o == nil {
+		o = fetch.DefaultOptions
+	}
+	r := &registry{ref: ref, o: o, scheme: "https"}
+	o.Progress.Phase(fetch.PhaseDiscovering, ref.String())
+
+	manifest, digest, err := r.manifest(ref.manifestRef())
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest != "" && digest != ref.Digest {
+		return nil, r.verificationError(ref.String(), errors.Errorf("manifest digest is %v", digest))
+	}
+	if isIndex(manifest) {
+		found, err := selectManifest(manifest.Manifests)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v", ref)
+		}
+		if manifest, digest, err = r.manifest(found.Digest); err != nil {
+			return nil, err
+		} else if digest != found.Digest {
+			return nil, r.verificationError(ref.String(), errors.Errorf("manifest digest is %v, list has %v", digest, found.Digest))
+		}
+	}
+	if manifest.SchemaVersion != 2 || manifest.Config.Digest == "" {
+		return nil, errors.Errorf("%v: unsupported manifest (schema version %d)", ref, manifest.SchemaVersion)
+	}
+
+	res, err := r.get("blobs/"+manifest.Config.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := ioutil.ReadAll(io.LimitReader(res.Body, maxMetadataSize))
+	res.Body.Close()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if d := sha256Digest(configBytes); d != manifest.Config.Digest {
+		return nil, r.verificationError(ref.String(), errors.Errorf("config digest is %v, manifest has %v", d, manifest.Config.Digest))
+	}
+
+	img := &Image{
+		Reference:      ref,
+		ID:             manifest.Config.Digest,
+		ManifestDigest: digest,
+		Annotations:    manifest.Annotations,
+		Config:         &ImageConfig{},
+		layers:         len(manifest.Layers),
+		openLayer: func(i int) (io.ReadCloser, error) {
+			return r.openBlob(manifest.Layers[i].Digest)
+		},
+	}
+	if err := json.Unmarshal(configBytes, img.Config); err != nil {
+		return nil, errors.Annotate(err, "Image config")
+	}
+	return img, nil
+}
+
+func (r *registry) url(path string) string {
+	return fmt.Sprintf("%v://%v/v2/%v/%v", r.scheme, r.ref.Registry, r.ref.Repository, path)
+}
+
+func (r *registry) verificationError(location string, err error) error {
+	return &fetch.Error{Stage: fetch.ErrVerificationFailed, Location: location, Err: err}
+}
+
+// Requests path in the repository. Gets a bearer token when the
+// registry asks for one, and falls back to plain HTTP if HTTPS fails
+// and plain HTTP is allowed for the registry.
+func (r *registry) get(path, accept string) (*http.Response, error) {
+	for authenticated := false; ; {
+		req, err := http.NewRequest("GET", r.url(path), nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := r.o.Client().Do(req)
+		if err != nil {
+			if r.scheme == "https" && r.o.AllowsHTTP(r.ref.Registry) {
+				r.scheme = "http"
+				continue
+			}
+			return nil, errors.Trace(err)
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			return res, nil
+		case http.StatusUnauthorized:
+			challenge := res.Header.Get("WWW-Authenticate")
+			res.Body.Close()
+			if !authenticated && strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+				if err := r.authenticate(challenge); err != nil {
+					return nil, err
+				}
+				authenticated = true
+				continue
+			}
+			return nil, &fetch.UnauthorizedError{Host: r.ref.Registry, Credentials: r.o.CredentialsFor(r.ref.Registry)}
+		default:
+			res.Body.Close()
+			return nil, errors.Errorf("%v: bad HTTP status code: %d", r.url(path), res.StatusCode)
+		}
+	}
+}
+
+// Gets a bearer token as asked by the challenge, and uses it for
+// further requests to the registry.
+func (r *registry) authenticate(challenge string) error {
+	params := parseChallenge(challenge[len("bearer "):])
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return errors.Errorf("%v: invalid authentication realm %#v", r.ref.Registry, params["realm"])
+	}
+	if realm.Scheme != "https" && !r.o.AllowsHTTP(realm.Host) {
+		return errors.Errorf("%v: refusing authentication realm %v (allow.http is off)", r.ref.Registry, realm)
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Credentials of the realm's host are added by the client; the
+	// registry's own are used if the realm has none.
+	if r.o.CredentialsFor(realm.Host) == nil {
+		if c := r.o.CredentialsFor(r.ref.Registry); c != nil && c.Token == "" && (realm.Scheme == "https" || c.AllowHTTP) {
+			req.SetBasicAuth(c.User, c.Password)
+		}
+	}
+	res, err := r.o.Client().Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return &fetch.UnauthorizedError{Host: realm.Host, Credentials: r.o.CredentialsFor(r.ref.Registry)}
+	} else if res.StatusCode != http.StatusOK {
+		return errors.Errorf("%v: bad HTTP status code: %d", realm.Host, res.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxMetadataSize)).Decode(&token); err != nil {
+		return errors.Annotatef(err, "%v: token", realm.Host)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.Errorf("%v: no token in response", realm.Host)
+	}
+	r.o = r.o.WithCredentials(&fetch.Credentials{
+		Host:      r.ref.Registry,
+		Token:     token.Token,
+		AllowHTTP: r.o.AllowsHTTP(r.ref.Registry),
+		Source:    realm.Host,
+	})
+	return nil
+}
+
+// Parses parameters of a WWW-Authenticate challenge:
+// key="value",key="value"
+func parseChallenge(str string) map[string]string {
+	params := make(map[string]string)
+	for str != "" {
+		str = strings.TrimLeft(str, " ,")
+		eq := strings.Index(str, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(str[:eq]))
+		str = str[eq+1:]
+		var value string
+		if strings.HasPrefix(str, `"`) {
+			end := strings.Index(str[1:], `"`)
+			if end < 0 {
+				value, str = str[1:], ""
+			} else {
+				value, str = str[1:end+1], str[end+2:]
+			}
+		} else if comma := strings.Index(str, ","); comma >= 0 {
+			value, str = str[:comma], str[comma:]
+		} else {
+			value, str = str, ""
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// Returns manifest reference (tag or digest), and its digest.
+func (r *registry) manifest(reference string) (*registryManifest, string, error) {
+	res, err := r.get("manifests/"+reference, strings.Join([]string{
+		mediaTypeManifest, mediaTypeManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex,
+	}, ", "))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	bb, err := ioutil.ReadAll(io.LimitReader(res.Body, maxMetadataSize))
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	digest := sha256Digest(bb)
+	if hdr := res.Header.Get("Docker-Content-Digest"); hdr != "" && hdr != digest {
+		return nil, "", r.verificationError(r.ref.String(), errors.Errorf("manifest digest is %v, registry sent %v", digest, hdr))
+	}
+	var m registryManifest
+	if err := json.Unmarshal(bb, &m); err != nil {
+		return nil, "", errors.Annotate(err, "Manifest")
+	}
+	if m.MediaType == "" {
+		m.MediaType = res.Header.Get("Content-Type")
+	}
+	return &m, digest, nil
+}
+
+// Downloads a blob to the spool, and verifies its digest.
+func (r *registry) openBlob(digest string) (io.ReadCloser, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, errors.Errorf("Unsupported digest %#v", digest)
+	}
+	location := r.url("blobs/" + digest)
+	f, err := r.o.OpenURL(location)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := verifyBlob(f, digest); err != nil {
+		f.Close()
+		return nil, r.verificationError(location, err)
+	}
+	return f, nil
+}
+
+// Checks that f's content has digest, and rewinds f.
+func verifyBlob(f *os.File, digest string) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return errors.Trace(err)
+	}
+	if d := fmt.Sprintf("sha256:%x", hash.Sum(nil)); d != digest {
+		return errors.Errorf("digest is %v", d)
+	}
+	_, err := f.Seek(0, os.SEEK_SET)
+	return errors.Trace(err)
+}
+
+func sha256Digest(bb []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(bb))
+}
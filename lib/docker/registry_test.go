@@ -0,0 +1,124 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// Registry that serves one image under a manifest list, and requires a
+// token that it gives to user:secret.
+func testRegistry(t *testing.T, blobs map[string][]byte) *httptest.Server {
+	config := []byte(`{"architecture":"` + runtime.GOARCH + `","os":"linux","config":{"Cmd":["/bin/sh"]}}`)
+	layer := testLayer(t, true, testEntry{"bin/sh", tar.TypeReg, "sh"})
+	blobs[sha256Digest(config)] = config
+	blobs[sha256Digest(layer)] = layer
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"digest":%q},"layers":[{"digest":%q}]}`,
+		mediaTypeManifest, sha256Digest(config), sha256Digest(layer)))
+	list := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+  {"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","platform":{"os":"windows","architecture":%q}},
+  {"digest":%q,"platform":{"os":"linux","architecture":%q}}]}`,
+		mediaTypeManifestList, runtime.GOARCH, sha256Digest(manifest), runtime.GOARCH))
+	manifests := map[string][]byte{"latest": list, sha256Digest(list): list, sha256Digest(manifest): manifest}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:test/app:pull" {
+				t.Errorf("token scope %v", r.URL.Query().Get("scope"))
+			}
+			fmt.Fprint(w, `{"token":"t0k3n"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v/token",service="test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/test/app/manifests/"):
+			if m, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/test/app/manifests/")]; ok {
+				w.Write(m)
+				return
+			}
+		case strings.HasPrefix(r.URL.Path, "/v2/test/app/blobs/"):
+			if b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/test/app/blobs/")]; ok {
+				w.Write(b)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	return srv
+}
+
+func TestPull(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	blobs := make(map[string][]byte)
+	srv := testRegistry(t, blobs)
+	defer srv.Close()
+	host := srv.URL[len("http://"):]
+	ref, err := ParseReference(host + "/test/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &fetch.Options{AllowHTTP: true, Spool: tmp}
+
+	if _, err := Pull(ref, o); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("expected unauthorized error without credentials, got %v", err)
+	}
+
+	o.Credentials = []*fetch.Credentials{{Host: "127.0.0.1", User: "user", Password: "secret", AllowHTTP: true}}
+	img, err := Pull(ref, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Arch() == "" || img.Config.OS != "linux" || img.ManifestDigest == "" {
+		t.Errorf("unexpected image %#v", img)
+	}
+	if entries, _ := readTestACI(t, mustWriteACI(t, img).Bytes()); entries["rootfs/bin/sh"] != "sh" {
+		t.Errorf("rootfs is %v", entries)
+	}
+
+	// Corrupt the layer
+	for digest, blob := range blobs {
+		if blob[0] == 0x1f {
+			blobs[digest] = append([]byte(nil), blob[:len(blob)-1]...)
+		}
+	}
+	img, err = Pull(ref, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.openLayer(0); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("expected digest mismatch, got %v", err)
+	}
+}
+
+func mustWriteACI(t *testing.T, img *Image) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := WriteACI(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
@@ -0,0 +1,260 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Layers are squashed from the top one down: an entry is written if
+// no upper layer had it, deleted it with a whiteout (.wh.NAME), hid
+// its directory's contents with an opaque whiteout (.wh..wh..opq), or
+// replaced one of its parent directories with a file. Hard links are
+// written at the end of their layer, once their targets are.
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// Entries of the squashed rootfs, for resolving executables
+type rootfsIndex struct {
+	entries  map[string]byte   // path to tar type flag
+	symlinks map[string]string // path to target
+}
+
+// Resolves symlinks in p. Returns resolved path, and whether it
+// exists.
+func (fs *rootfsIndex) resolve(p string) (string, bool) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for hops := 0; hops < 32; hops++ {
+		comps := strings.Split(p, "/")
+		cur, restarted := "", false
+		for i, comp := range comps {
+			next := path.Join(cur, comp)
+			if target, ok := fs.symlinks[next]; ok {
+				if !path.IsAbs(target) {
+					target = path.Join(cur, target)
+				}
+				p = strings.TrimPrefix(path.Clean("/"+path.Join(target, strings.Join(comps[i+1:], "/"))), "/")
+				restarted = true
+				break
+			}
+			cur = next
+		}
+		if !restarted {
+			_, ok := fs.entries[p]
+			return p, ok
+		}
+	}
+	return "", false
+}
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Returns absolute path of file in PATH, or "" if not found.
+func (fs *rootfsIndex) lookPath(file, envPath string) string {
+	if fs == nil || strings.Contains(file, "/") {
+		return ""
+	}
+	if envPath == "" {
+		envPath = defaultPath
+	}
+	for _, dir := range strings.Split(envPath, ":") {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		candidate := path.Join(dir, file)
+		if resolved, ok := fs.resolve(candidate); ok {
+			switch fs.entries[resolved] {
+			case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+type squasher struct {
+	tw        *tar.Writer
+	fs        *rootfsIndex
+	whiteouts map[string]bool // deleted by upper layers
+	opaque    map[string]bool // directories hidden by upper layers
+	files     map[string]bool // non-directories of upper layers
+	passwd    []byte          // etc/passwd
+}
+
+func newSquasher(tw *tar.Writer) *squasher {
+	return &squasher{
+		tw:        tw,
+		fs:        &rootfsIndex{entries: make(map[string]byte), symlinks: make(map[string]string)},
+		whiteouts: make(map[string]bool),
+		opaque:    make(map[string]bool),
+		files:     make(map[string]bool),
+	}
+}
+
+// Returns true if an upper layer has name, or has hidden it.
+func (sq *squasher) hidden(name string) bool {
+	if _, ok := sq.fs.entries[name]; ok || sq.whiteouts[name] {
+		return true
+	}
+	for p := name; p != ""; {
+		p = path.Dir(p)
+		if p == "." {
+			p = ""
+		}
+		if sq.whiteouts[p] || sq.opaque[p] || sq.files[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns reader of an uncompressed layer tarball.
+func layerReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzr, err := gzip.NewReader(br)
+		return gzr, errors.Annotate(err, "Corrupt gzip layer")
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, errors.New("zstd-compressed layers are not supported")
+	}
+	return br, nil
+}
+
+// Adds entries of a layer that upper layers haven't hidden.
+func (sq *squasher) addLayer(r io.Reader) error {
+	lr, err := layerReader(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tr := tar.NewReader(lr)
+	whiteouts := make(map[string]bool)
+	opaque := make(map[string]bool)
+	emitted := make(map[string]bool)
+	var links []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		if base == opaqueWhiteout {
+			opaque[dir] = true
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteouts[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+			continue
+		}
+		if sq.hidden(name) {
+			continue
+		}
+
+		out := *hdr
+		out.Name = "rootfs/" + name
+		sq.fs.entries[name] = hdr.Typeflag
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			out.Name += "/"
+		case tar.TypeSymlink:
+			sq.fs.symlinks[name] = hdr.Linkname
+		case tar.TypeLink:
+			out.Linkname = "rootfs/" + strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+			links = append(links, &out)
+			continue
+		}
+		if err := sq.tw.WriteHeader(&out); err != nil {
+			return errors.Trace(err)
+		}
+		var data io.Reader = tr
+		var passwd bytes.Buffer
+		if name == "etc/passwd" {
+			data = io.TeeReader(tr, &passwd)
+		}
+		if _, err := io.Copy(sq.tw, data); err != nil {
+			return errors.Trace(err)
+		}
+		if name == "etc/passwd" {
+			sq.passwd = passwd.Bytes()
+		}
+		emitted[name] = true
+	}
+
+	for _, link := range links {
+		if target := strings.TrimPrefix(link.Linkname, "rootfs/"); !emitted[target] {
+			return errors.Errorf("Hard link %v to %v, which is hidden by an upper layer, is not supported",
+				strings.TrimPrefix(link.Name, "rootfs/"), target)
+		}
+		if err := sq.tw.WriteHeader(link); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for name, typ := range sq.fs.entries {
+		if typ != tar.TypeDir {
+			sq.files[name] = true
+		}
+	}
+	for p := range whiteouts {
+		sq.whiteouts[p] = true
+	}
+	for p := range opaque {
+		sq.opaque[p] = true
+	}
+	return nil
+}
+
+// Writes ACI of img to w: rootfs of squashed layers, and manifest
+// converted from image config.
+func WriteACI(w io.Writer, img *Image) error {
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: "rootfs/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return errors.Trace(err)
+	}
+	sq := newSquasher(tw)
+	for i := img.layers - 1; i >= 0; i-- {
+		rc, err := img.openLayer(i)
+		if err != nil {
+			return errors.Annotatef(err, "Layer %d", i)
+		}
+		err = sq.addLayer(rc)
+		rc.Close()
+		if err != nil {
+			return errors.Annotatef(err, "Layer %d", i)
+		}
+	}
+
+	im, err := img.manifest(sq.passwd, sq.fs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	manifest, err := json.Marshal(im)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(tw.Close())
+}
@@ -0,0 +1,234 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/appc/spec/schema"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string // or link target
+}
+
+func testLayer(t *testing.T, gz bool, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gzw *gzip.Writer
+	if gz {
+		gzw = gzip.NewWriter(&buf)
+		w = gzw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.content
+		default:
+			hdr.Size = int64(len(e.content))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(e.content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzw != nil {
+		gzw.Close()
+	}
+	return buf.Bytes()
+}
+
+func testImage(t *testing.T) *Image {
+	layers := [][]byte{
+		testLayer(t, false,
+			testEntry{"bin/", tar.TypeDir, ""},
+			testEntry{"bin/sh", tar.TypeReg, "sh"},
+			testEntry{"bin/sh2", tar.TypeLink, "bin/sh"},
+			testEntry{"etc/passwd", tar.TypeReg, "root:x:0:0::/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"},
+			testEntry{"usr/bin/app", tar.TypeReg, "v1"},
+			testEntry{"opt/data/a", tar.TypeReg, "a"},
+			testEntry{"opt/data/b", tar.TypeReg, "b"},
+			testEntry{"var/log/old", tar.TypeReg, "old"},
+			testEntry{"lib/x", tar.TypeReg, "x"},
+		),
+		testLayer(t, true,
+			testEntry{"usr/bin/app", tar.TypeReg, "v2"},
+			testEntry{"opt/data/.wh.a", tar.TypeReg, ""},
+			testEntry{"var/log/.wh..wh..opq", tar.TypeReg, ""},
+			testEntry{"var/log/new", tar.TypeReg, "new"},
+			testEntry{"lib", tar.TypeSymlink, "usr/lib"},
+			testEntry{"sbin", tar.TypeSymlink, "usr/bin"},
+		),
+	}
+	ref, _ := ParseReference("example.com/app:1.0")
+	img := &Image{
+		Reference: ref,
+		ID:        "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Config:    &ImageConfig{},
+		layers:    len(layers),
+		openLayer: func(i int) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(layers[i])), nil
+		},
+	}
+	json.Unmarshal([]byte(`{
+  "architecture": "amd64",
+  "os": "linux",
+  "config": {
+    "User": "app",
+    "Env": ["PATH=/sbin", "LANG=C"],
+    "Entrypoint": ["app"],
+    "Cmd": ["serve"],
+    "WorkingDir": "/opt/data",
+    "ExposedPorts": {"80/tcp": {}, "53/udp": {}},
+    "Volumes": {"/var/lib/data": {}}
+  }
+}`), img.Config)
+	return img
+}
+
+// Returns ACI's entries (content, or link target), and its manifest.
+func readTestACI(t *testing.T, aci []byte) (map[string]string, *schema.ImageManifest) {
+	entries := make(map[string]string)
+	var im *schema.ImageManifest
+	tr := tar.NewReader(bytes.NewReader(aci))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if hdr.Linkname != "" {
+			content = []byte("-> " + hdr.Linkname)
+		}
+		if _, ok := entries[hdr.Name]; ok {
+			t.Errorf("Duplicate entry %v", hdr.Name)
+		}
+		entries[hdr.Name] = string(content)
+		if hdr.Name == "manifest" {
+			im = &schema.ImageManifest{}
+			if err := json.Unmarshal(content, im); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if im == nil {
+		t.Fatal("No manifest")
+	}
+	return entries, im
+}
+
+func TestWriteACI(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteACI(&buf, testImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	entries, im := readTestACI(t, buf.Bytes())
+
+	var names []string
+	for name := range entries {
+		if name != "manifest" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	expected := []string{
+		"rootfs/", "rootfs/bin/", "rootfs/bin/sh", "rootfs/bin/sh2", "rootfs/etc/passwd",
+		"rootfs/lib", "rootfs/opt/data/b", "rootfs/sbin", "rootfs/usr/bin/app", "rootfs/var/log/new",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("rootfs has %v, expected %v", names, expected)
+	}
+	for name, content := range map[string]string{
+		"rootfs/usr/bin/app": "v2",
+		"rootfs/bin/sh2":     "-> rootfs/bin/sh",
+		"rootfs/lib":         "-> usr/lib",
+	} {
+		if entries[name] != content {
+			t.Errorf("%v is %#v, expected %#v", name, entries[name], content)
+		}
+	}
+
+	if im.Name != "example.com/app" {
+		t.Errorf("name is %v", im.Name)
+	}
+	for name, value := range map[string]string{"version": "1.0", "os": "linux", "arch": "amd64", ImageIDLabel: testImage(t).ID} {
+		if v, _ := im.GetLabel(name); v != value {
+			t.Errorf("label %v is %#v, expected %#v", name, v, value)
+		}
+	}
+	app := im.App
+	if app == nil {
+		t.Fatal("No app")
+	}
+	if !reflect.DeepEqual([]string(app.Exec), []string{"/sbin/app", "serve"}) {
+		t.Errorf("exec is %v", app.Exec)
+	}
+	if app.User != "app" || app.Group != "1001" {
+		t.Errorf("user/group is %v/%v", app.User, app.Group)
+	}
+	if lang, _ := app.Environment.Get("LANG"); lang != "C" || app.WorkingDirectory != "/opt/data" {
+		t.Errorf("environment is %v, working directory %v", app.Environment, app.WorkingDirectory)
+	}
+	var ports []string
+	for _, p := range app.Ports {
+		ports = append(ports, p.Name.String())
+	}
+	if !reflect.DeepEqual(ports, []string{"udp-53", "tcp-80"}) {
+		t.Errorf("ports are %v", ports)
+	}
+	if len(app.MountPoints) != 1 || app.MountPoints[0].Name != "volume-var-lib-data" || app.MountPoints[0].Path != "/var/lib/data" {
+		t.Errorf("mount points are %v", app.MountPoints)
+	}
+}
+
+func TestWriteACIHiddenHardLink(t *testing.T) {
+	img := testImage(t)
+	layers := [][]byte{
+		testLayer(t, false,
+			testEntry{"a", tar.TypeReg, "a"},
+			testEntry{"b", tar.TypeLink, "a"},
+		),
+		testLayer(t, false, testEntry{".wh.a", tar.TypeReg, ""}),
+	}
+	img.layers = len(layers)
+	img.openLayer = func(i int) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(layers[i])), nil
+	}
+	if err := WriteACI(ioutil.Discard, img); err == nil {
+		t.Error("expected error for a hard link to a deleted file")
+	}
+}
+
+func TestUserGroup(t *testing.T) {
+	passwd := []byte("root:x:0:0::/root:/bin/sh\nwww:x:80:80::/var/www:/bin/false\n")
+	for _, c := range [][3]string{
+		{"", "0", "0"},
+		{"www", "www", "80"},
+		{"80", "80", "80"},
+		{"nobody", "nobody", "0"},
+		{"1000:1000", "1000", "1000"},
+	} {
+		if user, group := userGroup(c[0], passwd); user != c[1] || group != c[2] {
+			t.Errorf("%#v: got %v:%v, expected %v:%v", c[0], user, group, c[1], c[2])
+		}
+	}
+}
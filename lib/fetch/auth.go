@@ -0,0 +1,168 @@
+package fetch
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Credentials for a registry host. They are sent only to hosts that
+// match, and only over HTTPS unless AllowHTTP is set; they never
+// appear in errors or logs, only their source does.
+type Credentials struct {
+	Host      string // host name pattern (path.Match syntax, e.g. *.example.com), with port to match only that port
+	User      string // basic authentication
+	Password  string
+	Token     string // bearer token; used instead of User and Password
+	AllowHTTP bool   // may be sent over plain HTTP
+	Source    string // where the credentials are configured
+}
+
+func (c *Credentials) String() string {
+	return fmt.Sprintf("credentials for %v from %v", c.Host, c.Source)
+}
+
+func (c *Credentials) matches(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil && !strings.Contains(c.Host, ":") {
+		host = h
+	}
+	ok, _ := path.Match(strings.ToLower(c.Host), strings.ToLower(host))
+	return ok
+}
+
+func (c *Credentials) header() http.Header {
+	hdr := make(http.Header)
+	if c.Token != "" {
+		hdr.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		req := &http.Request{Header: hdr}
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return hdr
+}
+
+// Returns credentials for host, or nil. First matching entry wins.
+func (o *Options) CredentialsFor(host string) *Credentials {
+	if o == nil {
+		return nil
+	}
+	for _, c := range o.Credentials {
+		if c.matches(host) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns credentials that may be sent with a request to u's host
+// over u's scheme.
+func (o *Options) usableCredentials(scheme, host string) *Credentials {
+	if c := o.CredentialsFor(host); c != nil && (scheme == "https" || c.AllowHTTP) {
+		return c
+	}
+	return nil
+}
+
+// Returns copy of options with creds taking precedence over
+// configured credentials.
+func (o *Options) WithCredentials(creds ...*Credentials) *Options {
+	o2 := *o
+	o2.Credentials = append(append([]*Credentials(nil), creds...), o.Credentials...)
+	return &o2
+}
+
+// Adds credentials to each request, including redirects.
+type authTransport struct {
+	http.RoundTripper
+	o *Options
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c := at.o.usableCredentials(req.URL.Scheme, req.URL.Host); c != nil {
+		r2 := new(http.Request)
+		*r2 = *req
+		r2.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r2.Header[k] = v
+		}
+		for k, v := range c.header() {
+			r2.Header[k] = v
+		}
+		req = r2
+	}
+	return at.RoundTripper.RoundTrip(req)
+}
+
+// Returned for a 401 response
+type UnauthorizedError struct {
+	Host        string
+	Credentials *Credentials // sent credentials, or nil
+	Unsent      *Credentials // matching credentials that were not sent over plain HTTP
+}
+
+func (e *UnauthorizedError) Error() string {
+	switch {
+	case e.Credentials != nil:
+		return fmt.Sprintf("%v: unauthorized; %v were rejected", e.Host, e.Credentials)
+	case e.Unsent != nil:
+		return fmt.Sprintf("%v: unauthorized; %v were not sent over plain HTTP", e.Host, e.Unsent)
+	}
+	return fmt.Sprintf("%v: unauthorized; no credentials are configured", e.Host)
+}
+
+func (o *Options) unauthorized(scheme, host string) *UnauthorizedError {
+	if c := o.usableCredentials(scheme, host); c != nil {
+		return &UnauthorizedError{Host: host, Credentials: c}
+	}
+	return &UnauthorizedError{Host: host, Unsent: o.CredentialsFor(host)}
+}
+
+// Reads credentials from a netrc(5) file. Default entry is skipped:
+// credentials are sent only to named hosts.
+func ReadNetrc(filename string) ([]*Credentials, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var rv []*Credentials
+	var cur *Credentials
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		switch word := scanner.Text(); word {
+		case "machine":
+			if !scanner.Scan() {
+				return nil, errors.Errorf("%v: machine without name", filename)
+			}
+			cur = &Credentials{Host: scanner.Text(), Source: filename}
+			rv = append(rv, cur)
+		case "default":
+			cur = nil
+		case "login", "password", "account":
+			if !scanner.Scan() {
+				return nil, errors.Errorf("%v: %v without value", filename, word)
+			}
+			if cur == nil {
+				continue
+			}
+			switch word {
+			case "login":
+				cur.User = scanner.Text()
+			case "password":
+				cur.Password = scanner.Text()
+			}
+		case "macdef":
+			// Macro runs until an empty line; we don't need macros
+			cur = nil
+		}
+	}
+	return rv, errors.Trace(scanner.Err())
+}
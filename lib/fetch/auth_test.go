@@ -0,0 +1,128 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestOpenURLCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && user == "deploy" && pass == "s3cret" {
+			w.Write([]byte("image"))
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer t0ken" {
+			w.Write([]byte("image"))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	host, _, _ := net.SplitHostPort(u.Host)
+
+	for _, creds := range []*Credentials{
+		{Host: host, User: "deploy", Password: "s3cret", AllowHTTP: true, Source: "test"},
+		{Host: "127.*", Token: "t0ken", AllowHTTP: true, Source: "test"},
+	} {
+		o := &Options{AllowHTTP: true, Credentials: []*Credentials{creds}}
+		f, err := o.OpenURL(srv.URL + "/image.aci")
+		if err != nil {
+			t.Fatalf("%v: %v", creds, err)
+		}
+		f.Close()
+	}
+
+	for _, tc := range []struct {
+		creds *Credentials
+		want  string
+	}{
+		{nil, "no credentials are configured"},
+		{&Credentials{Host: host, User: "deploy", Password: "wrong", AllowHTTP: true, Source: "test"}, "were rejected"},
+		{&Credentials{Host: host, User: "deploy", Password: "s3cret", Source: "test"}, "not sent over plain HTTP"},
+	} {
+		o := &Options{AllowHTTP: true}
+		if tc.creds != nil {
+			o.Credentials = []*Credentials{tc.creds}
+		}
+		_, err := o.OpenURL(srv.URL + "/image.aci")
+		if errors.Cause(err) != ErrDownloadFailed {
+			t.Fatalf("%v: expected download failure, got %v", tc.creds, err)
+		}
+		msg := err.Error()
+		if !strings.Contains(msg, tc.want) || !strings.Contains(msg, host) {
+			t.Errorf("%v: unexpected error %v", tc.creds, msg)
+		}
+		if strings.Contains(msg, "s3cret") || strings.Contains(msg, "wrong") {
+			t.Errorf("error leaks password: %v", msg)
+		}
+	}
+}
+
+func TestReadNetrc(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "netrc")
+	ioutil.WriteFile(path, []byte(`machine registry.example.com
+  login deploy
+  password s3cret
+default login anonymous password guest
+machine other.example.com login other password pass
+`), 0600)
+
+	creds, err := ReadNetrc(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 {
+		t.Fatalf("expected 2 entries, got %v", creds)
+	}
+	if c := creds[0]; c.Host != "registry.example.com" || c.User != "deploy" || c.Password != "s3cret" {
+		t.Errorf("unexpected entry %#v", c)
+	}
+	if c := creds[1]; c.Host != "other.example.com" || c.User != "other" || c.Password != "pass" {
+		t.Errorf("unexpected entry %#v", c)
+	}
+
+	o := &Options{Credentials: creds}
+	if c := o.usableCredentials("https", "registry.example.com:443"); c != creds[0] {
+		t.Errorf("expected credentials for registry.example.com, got %v", c)
+	}
+	if c := o.usableCredentials("http", "registry.example.com"); c != nil {
+		t.Errorf("credentials usable over plain HTTP: %v", c)
+	}
+	if c := o.usableCredentials("https", "example.com"); c != nil {
+		t.Errorf("unexpected credentials %v", c)
+	}
+}
+
+func TestCredentialsMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, host string
+		matches       bool
+	}{
+		{"registry.example.com", "registry.example.com", true},
+		{"registry.example.com", "Registry.Example.com:443", true},
+		{"*.example.com", "registry.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"localhost:5000", "localhost:5000", true},
+		{"localhost:5000", "localhost:5001", false},
+		{"localhost:5000", "localhost", false},
+	} {
+		if m := (&Credentials{Host: c.pattern}).matches(c.host); m != c.matches {
+			t.Errorf("%v matches %v: %v, expected %v", c.pattern, c.host, m, c.matches)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/discovery"
+	"github.com/juju/errors"
+)
+
+// ACIs fetched by name are kept in a local cache, so that the same
+// image isn't downloaded again, and can be fetched when its server is
+// down. An entry is a directory named after SHA-256 of the app
+// (name and sorted labels), with the `aci`, its signature `aci.asc` if
+// there was one, and `entry.json`. Entries are written to a temporary
+// directory and renamed into place, so a reader sees a whole entry or
+// none. A hit touches the entry; when the cache grows over MaxSize,
+// least recently used entries are removed. The cache doesn't vouch
+// for its contents: a cached ACI is verified by the importer like a
+// downloaded one. An entry of the "latest" version is only a fallback
+// (see Options.FetchACI), as the same key names a different ACI once a
+// new version is published.
+
+const cacheEntryPrefix = "aci."
+
+// Local cache of fetched ACIs
+type Cache struct {
+	Dir     string
+	MaxSize int64 // of all entries; an ACI larger than this is not cached
+}
+
+// Metadata of a cache entry
+type cacheEntry struct {
+	App    string
+	URL    string // where the ACI was downloaded from
+	Stored time.Time
+}
+
+// Returns cache key of app: its name with sorted labels.
+func cacheKey(app discovery.App) string {
+	labels := make([]string, 0, len(app.Labels))
+	for name, value := range app.Labels {
+		labels = append(labels, fmt.Sprintf("%v=%v", name, value))
+	}
+	sort.Strings(labels)
+	return strings.Join(append([]string{app.Name.String()}, labels...), ",")
+}
+
+func (c *Cache) path(app discovery.App) string {
+	sum := sha256.Sum256([]byte(cacheKey(app)))
+	return filepath.Join(c.Dir, cacheEntryPrefix+hex.EncodeToString(sum[:]))
+}
+
+// Opens cached ACI of app, and its signature if cached (nil
+// otherwise). Returns nil ACI if app is not cached.
+func (c *Cache) Get(app discovery.App) (*os.File, *os.File) {
+	if c == nil {
+		return nil, nil
+	}
+	path := c.path(app)
+	aci, err := os.Open(filepath.Join(path, "aci"))
+	if err != nil {
+		return nil, nil
+	}
+	asc, err := os.Open(filepath.Join(path, "aci.asc"))
+	if err != nil {
+		asc = nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return aci, asc
+}
+
+// Stores ACI of app, downloaded from url, and its signature if not
+// nil. Both files are rewound.
+func (c *Cache) Put(app discovery.App, url string, aci, asc *os.File) error {
+	if c == nil {
+		return nil
+	}
+	if fi, err := aci.Stat(); err != nil {
+		return errors.Trace(err)
+	} else if c.MaxSize > 0 && fi.Size() > c.MaxSize {
+		_, err := aci.Seek(0, os.SEEK_SET)
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	tmp, err := ioutil.TempDir(c.Dir, ".new.")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := copyToFile(filepath.Join(tmp, "aci"), aci); err != nil {
+		return errors.Trace(err)
+	}
+	if asc != nil {
+		if err := copyToFile(filepath.Join(tmp, "aci.asc"), asc); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if bb, err := json.Marshal(cacheEntry{App: cacheKey(app), URL: url, Stored: time.Now()}); err != nil {
+		return errors.Trace(err)
+	} else if err := ioutil.WriteFile(filepath.Join(tmp, "entry.json"), bb, 0600); err != nil {
+		return errors.Trace(err)
+	}
+
+	path := c.path(app)
+	if err := os.RemoveAll(path); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.evict(path))
+}
+
+// Removes cached ACI of app, e.g. when it can't be verified.
+func (c *Cache) Remove(app discovery.App) error {
+	if c == nil {
+		return nil
+	}
+	return errors.Trace(os.RemoveAll(c.path(app)))
+}
+
+// Removes least recently used entries, except keep, until the cache
+// fits in MaxSize.
+func (c *Cache) evict(keep string) error {
+	if c.MaxSize <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(c.Dir, cacheEntryPrefix+"*"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	type entry struct {
+		path string
+		used time.Time
+		size int64
+	}
+	var entries []entry
+	var total int64
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		e := entry{path: path, used: fi.ModTime()}
+		for _, name := range []string{"aci", "aci.asc", "entry.json"} {
+			if fi, err := os.Stat(filepath.Join(path, name)); err == nil {
+				e.size += fi.Size()
+			}
+		}
+		total += e.size
+		if path != keep {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.MaxSize {
+			break
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			return errors.Trace(err)
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// Copies f, from its start, to a new file at path; f is rewound.
+func copyToFile(path string, f *os.File) error {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return errors.Trace(err)
+	}
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = io.Copy(w, f)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = f.Seek(0, os.SEEK_SET)
+	return errors.Trace(err)
+}
@@ -0,0 +1,230 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/discovery"
+	"github.com/appc/spec/schema/types"
+)
+
+func testApp(t *testing.T, name string) discovery.App {
+	app, err := discovery.NewAppFromString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for label, value := range map[types.ACIdentifier]string{"version": "1.0", "os": "freebsd", "arch": "amd64"} {
+		if app.Labels[label] == "" {
+			app.Labels[label] = value
+		}
+	}
+	return *app
+}
+
+func readAll(t *testing.T, f *os.File) string {
+	defer f.Close()
+	bb, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bb)
+}
+
+func TestCache(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	c := &Cache{Dir: filepath.Join(tmp, "cache"), MaxSize: 2000}
+
+	put := func(name, body string, signed bool) {
+		aci, err := ioutil.TempFile(tmp, "aci.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aci.Close()
+		aci.WriteString(body)
+		var asc *os.File
+		if signed {
+			if asc, err = ioutil.TempFile(tmp, "asc."); err != nil {
+				t.Fatal(err)
+			}
+			defer asc.Close()
+			asc.WriteString("signature of " + body)
+		}
+		if err := c.Put(testApp(t, name), "https://"+name+".aci", aci, asc); err != nil {
+			t.Fatal(err)
+		}
+		if off, _ := aci.Seek(0, os.SEEK_CUR); off != 0 {
+			t.Errorf("%v: ACI not rewound", name)
+		}
+	}
+
+	if aci, _ := c.Get(testApp(t, "example.com/a")); aci != nil {
+		t.Error("hit in an empty cache")
+	}
+
+	put("example.com/a", strings.Repeat("a", 500), true)
+	aci, asc := c.Get(testApp(t, "example.com/a"))
+	if aci == nil || asc == nil {
+		t.Fatal("expected a hit with signature")
+	}
+	if body := readAll(t, aci); body != strings.Repeat("a", 500) {
+		t.Errorf("unexpected ACI %#v", body)
+	}
+	if sig := readAll(t, asc); sig != "signature of "+strings.Repeat("a", 500) {
+		t.Errorf("unexpected signature %#v", sig)
+	}
+	if aci, _ := c.Get(testApp(t, "example.com/a,version=2.0")); aci != nil {
+		t.Error("hit for other labels")
+	}
+
+	// Too large to cache
+	put("example.com/huge", strings.Repeat("h", 4096), false)
+	if aci, _ := c.Get(testApp(t, "example.com/huge")); aci != nil {
+		t.Error("cached an ACI over the size limit")
+	}
+
+	// b is the least recently used when c is stored
+	put("example.com/b", strings.Repeat("b", 500), false)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(c.path(testApp(t, "example.com/b")), past, past)
+	if aci, _ := c.Get(testApp(t, "example.com/a")); aci == nil {
+		t.Fatal("a evicted")
+	} else {
+		aci.Close()
+	}
+	put("example.com/c", strings.Repeat("c", 500), false)
+	for name, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		aci, asc := c.Get(testApp(t, "example.com/"+name))
+		if (aci != nil) != cached {
+			t.Errorf("%v: expected cached=%v", name, cached)
+		}
+		if aci != nil {
+			aci.Close()
+		}
+		if asc != nil {
+			asc.Close()
+		}
+	}
+
+	if err := c.Remove(testApp(t, "example.com/a")); err != nil {
+		t.Error(err)
+	}
+	if aci, _ := c.Get(testApp(t, "example.com/a")); aci != nil {
+		t.Error("hit after removal")
+	}
+	if ff, _ := filepath.Glob(filepath.Join(c.Dir, ".new.*")); len(ff) != 0 {
+		t.Errorf("temporary entries left: %v", ff)
+	}
+}
+
+func TestFetchACIMirrors(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/good/example.com/app-1.0-freebsd-amd64.aci":
+			w.Write([]byte("image"))
+		case "/good/example.com/app-1.0-freebsd-amd64.aci.asc":
+			w.Write([]byte("signature"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	o := &Options{
+		AllowHTTP: true,
+		Spool:     tmp,
+		Cache:     &Cache{Dir: filepath.Join(tmp, "cache")},
+		Mirrors:   []string{srv.URL + "/empty", srv.URL + "/good/"},
+		Warnf:     func(string, ...interface{}) {},
+	}
+	app := testApp(t, "example.com/app")
+
+	for _, expected := range []Origin{OriginMirror, OriginCache} {
+		aci, asc, origin, err := o.FetchACI(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin != expected {
+			t.Errorf("expected origin %v, got %v", expected, origin)
+		}
+		if body := readAll(t, aci); body != "image" {
+			t.Errorf("unexpected ACI %#v", body)
+		}
+		if asc == nil {
+			t.Error("no signature")
+		} else if sig := readAll(t, asc); sig != "signature" {
+			t.Errorf("unexpected signature %#v", sig)
+		}
+	}
+	if len(requests) != 3 {
+		t.Errorf("expected 3 requests, got %v", requests)
+	}
+
+	if url := mirrorURL("https://mirror/", testApp(t, "example.com/app,channel=beta")); url != "" {
+		t.Errorf("mirrored an app with extra labels: %v", url)
+	}
+}
+
+func TestFetchACILatest(t *testing.T) {
+	published := "1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if published == "" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		} else if r.URL.Path == "/example.com/app-latest-freebsd-amd64.aci" {
+			w.Write([]byte("image " + published))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	o := &Options{
+		AllowHTTP: true,
+		Spool:     tmp,
+		Cache:     &Cache{Dir: filepath.Join(tmp, "cache")},
+		Mirrors:   []string{srv.URL},
+		Warnf:     func(string, ...interface{}) {},
+	}
+	app := testApp(t, "example.com/app,version=latest")
+
+	// A new version is fetched, not served from the cache; once the
+	// server is down, the cached one is used
+	for _, expected := range []struct {
+		published, body string
+		origin          Origin
+	}{
+		{"1", "image 1", OriginMirror},
+		{"2", "image 2", OriginMirror},
+		{"", "image 2", OriginCache},
+	} {
+		published = expected.published
+		aci, _, origin, err := o.FetchACI(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, aci); body != expected.body || origin != expected.origin {
+			t.Errorf("expected %#v from %v, got %#v from %v", expected.body, expected.origin, body, origin)
+		}
+	}
+}
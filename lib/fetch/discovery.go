@@ -1,12 +1,16 @@
 package fetch
 
 import (
+	"fmt"
+	"net/http"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/appc/spec/discovery"
 	"github.com/appc/spec/schema/types"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/juju/errors"
 )
 
 func tryAppFromString(location string) *discovery.App {
@@ -25,17 +29,58 @@ func tryAppFromString(location string) *discovery.App {
 }
 
 func OpenPubKey(location string) (types.ACIdentifier, *os.File, error) {
+	return DefaultOptions.OpenPubKey(location)
+}
+
+func (o *Options) insecure(host string) discovery.InsecureOption {
+	if o.AllowsHTTP(host) {
+		return discovery.InsecureHTTP
+	}
+	return discovery.InsecureNone
+}
+
+// Starts discovery of app with o's TLS settings. Returns its headers
+// and insecure option, and a function that ends it. Plain HTTP
+// fallback is disabled when the credentials may not be sent over it.
+func (o *Options) discovery(app discovery.App) (map[string]http.Header, discovery.InsecureOption, func()) {
+	host := strings.SplitN(app.Name.String(), "/", 2)[0]
+	insecure := o.insecure(host)
+	var header http.Header
+	if c := o.CredentialsFor(host); c != nil {
+		header = c.header()
+		if !c.AllowHTTP {
+			insecure = discovery.InsecureNone
+		}
+	}
+	headers, done := o.startDiscovery(host, header)
+	return headers, insecure, done
+}
+
+// Wraps discovery error, telling apart registries that refused
+// authentication.
+func (o *Options) discoveryError(app discovery.App, attempts []discovery.FailedAttempt, err error) error {
+	for _, fa := range attempts {
+		if fa.Error != nil && strings.HasSuffix(fa.Error.Error(), "got 401") {
+			err = o.unauthorized("https", strings.SplitN(app.Name.String(), "/", 2)[0])
+			break
+		}
+	}
+	return &Error{Stage: ErrDiscoveryFailed, Location: app.String(), Err: err}
+}
+
+func (o *Options) OpenPubKey(location string) (types.ACIdentifier, *os.File, error) {
 	if app := tryAppFromString(location); app != nil {
 		// Proper ACIdentifier given, let's do the discovery
-		// TODO: hostHeaders, insecure
-		if pks, _, err := discovery.DiscoverPublicKeys(*app, nil, 0, 0); err != nil {
-			return app.Name, nil, err
+		headers, insecure, done := o.discovery(*app)
+		defer done()
+		if pks, attempts, err := discovery.DiscoverPublicKeys(*app, headers, insecure, 0); err != nil {
+			return app.Name, nil, o.discoveryError(*app, attempts, err)
 		} else {
 			// We assume multiple returned keys are alternatives, not
 			// multiple different valid keychains.
 			var err error
 			for _, keyurl := range pks {
-				if keyf, er1 := OpenLocation(keyurl); er1 != nil {
+				if keyf, er1 := o.OpenLocation(keyurl); er1 != nil {
 					err = multierror.Append(err, er1)
 				} else {
 					return app.Name, keyf, nil
@@ -46,64 +91,164 @@ func OpenPubKey(location string) (types.ACIdentifier, *os.File, error) {
 		}
 	} else {
 		// Not an ACIdentifier, let's open as raw location
-		f, err := OpenLocation(location)
+		f, err := o.OpenLocation(location)
 		return "", f, err
 	}
 }
 
 func DiscoverACI(app discovery.App) (*os.File, *os.File, error) {
-	return discoverACI(app, nil)
+	return DefaultOptions.DiscoverACI(app)
 }
 
-func discoverACI(app discovery.App, asc *os.File) (*os.File, *os.File, error) {
-	var aci *os.File
-	// TODO: hostHeaders, insecure
-	if eps, _, err := discovery.DiscoverACIEndpoints(app, nil, 0, 0); err != nil {
-		return nil, nil, err
-	} else {
-		var err error
+// Where a fetched ACI comes from
+type Origin string
 
-		if asc == nil {
-			err = nil
-			for _, ep := range eps {
-				if af, er1 := OpenLocation(ep.ASC); er1 != nil {
-					err = multierror.Append(err, er1)
-				} else {
-					asc = af
-					break
+const (
+	OriginCache    Origin = "cache"    // local cache; see Cache
+	OriginMirror   Origin = "mirror"   // one of Options.Mirrors
+	OriginUpstream Origin = "upstream" // URL found by appc discovery
+)
+
+// Discovers app's ACI and signature URLs with appc meta discovery,
+// and downloads them. Missing os and arch labels default to the
+// host's, and version to "latest". Returns nil signature if the ACI
+// has been found, but none of its signatures could be downloaded.
+func (o *Options) DiscoverACI(app discovery.App) (*os.File, *os.File, error) {
+	aci, asc, _, err := o.FetchACI(app)
+	return aci, asc, err
+}
+
+// Fetches app's ACI and signature, as DiscoverACI does, looking first
+// in the cache, then on the mirrors, and returns where they come from.
+// Downloaded ACIs are stored in the cache. The latest version changes
+// when a new one is published, so it is looked up again, and taken
+// from the cache only if it can't be fetched.
+func (o *Options) FetchACI(app discovery.App) (*os.File, *os.File, Origin, error) {
+	app = *app.Copy()
+	for label, value := range map[types.ACIdentifier]string{"os": runtime.GOOS, "arch": runtime.GOARCH, "version": "latest"} {
+		if app.Labels[label] == "" {
+			app.Labels[label] = value
+		}
+	}
+
+	latest := app.Labels["version"] == "latest"
+	if !latest {
+		if aci, asc := o.Cache.Get(app); aci != nil {
+			fmt.Printf("Using cached %v\n", app.String())
+			return aci, asc, OriginCache, nil
+		}
+	}
+
+	origin := OriginMirror
+	aci, asc, url := o.mirrorACI(app)
+	if aci == nil {
+		origin = OriginUpstream
+		var err error
+		if aci, asc, url, err = o.discoverACI(app, nil); err != nil {
+			if latest && o.context().Err() == nil {
+				if aci, asc := o.Cache.Get(app); aci != nil {
+					fmt.Printf("Using cached %v, as it can't be fetched: %v\n", app.String(), err)
+					return aci, asc, OriginCache, nil
 				}
 			}
-			if err != nil {
-				return nil, nil, err
-			}
+			return nil, nil, "", err
+		}
+	}
+	if err := o.Cache.Put(app, url, aci, asc); err != nil {
+		fmt.Printf("Could not cache %v: %v\n", url, err)
+	}
+	return aci, asc, origin, nil
+}
+
+// Returns URL of app's ACI on mirror: BASE/NAME-VERSION-OS-ARCH.aci,
+// the layout of appc simple discovery. Apps with other labels can't
+// be mirrored.
+func mirrorURL(base string, app discovery.App) string {
+	for label := range app.Labels {
+		if label != "os" && label != "arch" && label != "version" {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%v/%v-%v-%v-%v.aci", strings.TrimSuffix(base, "/"), app.Name,
+		app.Labels["version"], app.Labels["os"], app.Labels["arch"])
+}
+
+// Downloads app's ACI, and its signature if there is one, from the
+// first mirror that has it. Returns nil ACI if none has.
+func (o *Options) mirrorACI(app discovery.App) (*os.File, *os.File, string) {
+	for _, base := range o.Mirrors {
+		url := mirrorURL(base, app)
+		if url == "" {
+			return nil, nil, ""
+		}
+		aci, err := o.OpenLocation(url)
+		if err != nil && o.context().Err() != nil {
+			return nil, nil, ""
+		} else if err != nil {
+			fmt.Printf("Mirror %v: %v\n", base, err)
+			continue
+		}
+		asc, err := o.OpenLocation(url + ".asc")
+		if err != nil {
+			asc = nil
+		}
+		return aci, asc, url
+	}
+	return nil, nil, ""
+}
+
+func (o *Options) discoverACI(app discovery.App, asc *os.File) (*os.File, *os.File, string, error) {
+	o.Progress.Phase(PhaseDiscovering, app.String())
+	headers, insecure, done := o.discovery(app)
+	eps, attempts, err := discovery.DiscoverACIEndpoints(app, headers, insecure, 0)
+	done()
+	if err != nil {
+		return nil, nil, "", o.discoveryError(app, attempts, err)
+	}
+	if len(eps) == 0 {
+		return nil, nil, "", &Error{Stage: ErrDiscoveryFailed, Location: app.String(), Err: errors.New("no ACI endpoints")}
+	}
+
+	var aci *os.File
+	var aciURL string
+	var aciErr error
+	for _, ep := range eps {
+		if af, err := o.OpenLocation(ep.ACI); err != nil {
+			aciErr = multierror.Append(aciErr, err)
+		} else {
+			aci, aciURL = af, ep.ACI
+			break
+		}
+	}
+	if aci == nil {
+		if asc != nil {
+			asc.Close()
 		}
+		return nil, nil, "", aciErr
+	}
 
-		err = nil
+	if asc == nil {
 		for _, ep := range eps {
-			if af, er1 := OpenLocation(ep.ACI); er1 != nil {
-				err = multierror.Append(err, er1)
-			} else {
-				aci = af
+			if af, err := o.OpenLocation(ep.ASC); err == nil {
+				asc = af
 				break
 			}
-			if aci == nil {
-				if asc != nil {
-					asc.Close()
-				}
-				return nil, nil, err
-			}
 		}
-
-		return aci, asc, nil
 	}
+
+	return aci, asc, aciURL, nil
 }
 
 func OpenACI(location, sigLocation string) (types.ACIdentifier, *os.File, *os.File, error) {
+	return DefaultOptions.OpenACI(location, sigLocation)
+}
+
+func (o *Options) OpenACI(location, sigLocation string) (types.ACIdentifier, *os.File, *os.File, error) {
 	var asc *os.File
 
 	// Signature override
 	if sigLocation != "" {
-		if sf, err := OpenLocation(sigLocation); err != nil {
+		if sf, err := o.OpenLocation(sigLocation); err != nil {
 			return "", nil, nil, err
 		} else {
 			asc = sf
@@ -112,13 +257,13 @@ func OpenACI(location, sigLocation string) (types.ACIdentifier, *os.File, *os.Fi
 
 	if app := tryAppFromString(location); app != nil {
 		// Proper ACIdentifier given, let's do discovery
-		if aci, asc, err := discoverACI(*app, asc); err != nil {
+		if aci, asc, _, err := o.discoverACI(*app, asc); err != nil {
 			return app.Name, nil, nil, err
 		} else {
 			return app.Name, aci, asc, nil
 		}
 	} else {
-		if aci, err := OpenLocation(location); err != nil {
+		if aci, err := o.OpenLocation(location); err != nil {
 			if asc != nil {
 				asc.Close()
 			}
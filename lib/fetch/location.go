@@ -3,24 +3,17 @@ package fetch
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/coreos/ioprogress"
-	"github.com/juju/errors"
 )
 
-func ProgressBarReader(r io.Reader, size int64) io.Reader {
-	if size > 0 && size < 5120 { // TODO: isatty
-		// Don't bother with progress bar below 50k
-		return r
-	}
-
+// Formats progress of a transfer as a bar
+func progressBarText() ioprogress.DrawTextFormatFunc {
 	bar := ioprogress.DrawTextFormatBar(int64(56))
-	fmtfunc := func(progress, total int64) string {
+	return func(progress, total int64) string {
 		// Content-Length is set to -1 when unknown.
 		if total == -1 {
 			return fmt.Sprintf(
@@ -34,14 +27,52 @@ func ProgressBarReader(r io.Reader, size int64) io.Reader {
 			ioprogress.DrawTextFormatBytes(progress, total),
 		)
 	}
+}
+
+func ProgressBarReader(r io.Reader, size int64) io.Reader {
+	if size > 0 && size < 5120 { // TODO: isatty
+		// Don't bother with progress bar below 50k
+		return r
+	}
+
 	return &ioprogress.Reader{
 		Reader:       r,
 		Size:         size,
-		DrawFunc:     ioprogress.DrawTerminalf(os.Stderr, fmtfunc),
+		DrawFunc:     ioprogress.DrawTerminalf(os.Stderr, progressBarText()),
 		DrawInterval: time.Second,
 	}
 }
 
+// Returns ProgressFunc that prints phases, and draws progress bars of
+// transfers, on w.
+func ProgressBar(w io.Writer) ProgressFunc {
+	var draw ioprogress.DrawFunc
+	var phase, location string
+	return func(p Progress) {
+		if p.Phase != phase || p.Location != location {
+			if draw != nil {
+				// Previous bar didn't finish
+				draw(-1, -1)
+				draw = nil
+			}
+			phase, location = p.Phase, p.Location
+			fmt.Fprintf(w, "%v %v ...\n", strings.Title(phase), location)
+		}
+		if p.Bytes == 0 && p.Total == -1 && !p.Done {
+			// Start of a phase
+			return
+		}
+		if draw == nil {
+			draw = ioprogress.DrawTerminalf(w, progressBarText())
+		}
+		draw(p.Bytes, p.Total)
+		if p.Done {
+			draw(-1, -1)
+			draw = nil
+		}
+	}
+}
+
 func ProgressBarFileReader(f *os.File) io.Reader {
 	if fi, err := f.Stat(); err != nil {
 		panic(err)
@@ -50,68 +81,10 @@ func ProgressBarFileReader(f *os.File) io.Reader {
 	}
 }
 
-func OpenURL(url string) (_ *os.File, erv error) {
-	tf, err := ioutil.TempFile("", "jetpack.fetch.")
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	os.Remove(tf.Name()) // no need to keep the tempfile around
-
-	defer func() {
-		if erv != nil {
-			tf.Close()
-		}
-	}()
-
-	res, err := http.Get(url)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("bad HTTP status code: %d", res.StatusCode)
-	}
-
-	fmt.Println("Downloading", url, "...")
-	if _, err := io.Copy(tf, ProgressBarReader(res.Body, res.ContentLength)); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	tf.Seek(0, os.SEEK_SET)
-
-	return tf, nil
+func OpenURL(url string) (*os.File, error) {
+	return DefaultOptions.OpenURL(url)
 }
 
-const flagAllowHTTP = false // TODO: make the flag
-
-func OpenLocation(location string) (_ *os.File, erv error) {
-	if location == "-" {
-		return os.Stdin, nil
-	}
-
-	u, err := url.Parse(location)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	switch u.Scheme {
-	case "":
-		return os.Open(location)
-
-	case "file":
-		return os.Open(u.Path)
-
-	case "http":
-		if !flagAllowHTTP {
-			return nil, errors.New("-insecure-allow-http required for http URLs")
-		}
-		fallthrough
-
-	case "https":
-		return OpenURL(u.String())
-
-	default:
-		return nil, errors.Errorf("Unsupported scheme: %v\n", u.Scheme)
-	}
+func OpenLocation(location string) (*os.File, error) {
+	return DefaultOptions.OpenLocation(location)
 }
@@ -0,0 +1,251 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Stages of fetching an image; causes of Error
+var (
+	ErrDiscoveryFailed    = errors.New("Discovery failed")
+	ErrDownloadFailed     = errors.New("Download failed")
+	ErrVerificationFailed = errors.New("Verification failed")
+)
+
+// Error of a fetch stage. Its cause is the stage's Err*Failed
+// sentinel, so that callers can tell the stages apart.
+type Error struct {
+	Stage    error  // ErrDiscoveryFailed, ErrDownloadFailed, or ErrVerificationFailed
+	Location string // image name or URL
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Stage, e.Location, e.Err)
+}
+
+func (e *Error) Cause() error {
+	return e.Stage
+}
+
+// Default timeout of network operations
+const DefaultTimeout = 30 * time.Second
+
+// Most redirects followed by downloads
+const maxRedirects = 10
+
+// How images are fetched over network
+type Options struct {
+	AllowHTTP bool            // allow plain HTTP for discovery and downloads
+	Timeout   time.Duration   // for connecting, response headers, and each read
+	Spool     string          // directory for downloads; system's default temporary directory if empty
+	Retries   int             // of failed transfers
+	Progress  ProgressFunc    // receives progress of discovery and downloads
+	Context   context.Context // cancels downloads when done; nil never does
+
+	Credentials []*Credentials // for registries that require authentication
+	TLS         []*TLSConfig   // per-host TLS settings; see TLSConfig
+
+	Cache   *Cache   // of ACIs fetched by name; nil disables
+	Mirrors []string // base URLs tried, in order, before discovery; see mirrorURL
+
+	Warnf func(format string, args ...interface{}) // reports insecure requests; nil prints to stderr
+}
+
+var DefaultOptions = &Options{}
+
+func (o *Options) context() context.Context {
+	if o == nil || o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
+
+// Returns HTTP client with timeouts, redirect policy, credentials, and
+// TLS settings of the options.
+func (o *Options) Client() *http.Client {
+	return &http.Client{
+		Transport: &authTransport{
+			RoundTripper: &tlsTransport{o: o},
+			o:            o,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "https" && !o.AllowsHTTP(req.URL.Host) {
+				return errors.Errorf("refusing redirect to %v (allow.http is off)", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// Downloads url to a file in the spool, resuming a previous partial
+// download; the file is unlinked, and removed when closed. Failed
+// transfers are retried up to Retries times, continuing where they
+// stopped.
+func (o *Options) OpenURL(url string) (_ *os.File, erv error) {
+	defer func() {
+		if erv != nil {
+			erv = &Error{Stage: ErrDownloadFailed, Location: url, Err: erv}
+		}
+	}()
+
+	sf, err := o.openSpoolFile(url)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := o.download(url, sf)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= o.Retries || o.context().Err() != nil {
+			sf.Close()
+			return nil, err
+		}
+		fmt.Printf("Download of %v failed (%v), retrying ...\n", url, err)
+	}
+
+	if err := sf.complete(); err != nil {
+		sf.Close()
+		return nil, errors.Trace(err)
+	}
+	return sf.File, nil
+}
+
+// Downloads url into sf, continuing at its current offset if it can
+// be resumed. Returns true if a failure may be retried.
+func (o *Options) download(url string, sf *spoolFile) (bool, error) {
+	// Cancel the request if the server stalls
+	ctx, cancel := context.WithCancel(o.context())
+	defer cancel()
+	stall := time.AfterFunc(o.timeout(), cancel)
+	defer stall.Stop()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	offset := sf.offset()
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", sf.meta.validator())
+	}
+	res, err := o.Client().Do(req.WithContext(ctx))
+	if cerr := o.context().Err(); cerr != nil {
+		if res != nil {
+			res.Body.Close()
+		}
+		return false, cerr
+	} else if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return false, o.unauthorized(res.Request.URL.Scheme, res.Request.URL.Host)
+	case offset > 0 && res.StatusCode == http.StatusPartialContent && contentRangeStart(res.Header.Get("Content-Range")) == offset:
+		if _, err := sf.Seek(offset, os.SEEK_SET); err != nil {
+			return false, errors.Trace(err)
+		}
+		fmt.Println("Resuming download of", url, "at", offset, "...")
+	case offset > 0 && (res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+		// Range we can't use; start over
+		if err := sf.restart(spoolMeta{}); err != nil {
+			return false, errors.Trace(err)
+		}
+		return true, errors.Errorf("cannot resume at %d: %v", offset, res.Status)
+	case res.StatusCode == http.StatusOK:
+		if err := sf.restart(spoolMeta{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		}); err != nil {
+			return false, errors.Trace(err)
+		}
+		offset = 0
+		fmt.Println("Downloading", url, "...")
+	default:
+		return false, errors.Errorf("bad HTTP status code: %d", res.StatusCode)
+	}
+
+	progress := Progress{Phase: PhaseDownloading, Location: url, Bytes: offset, Total: -1}
+	if res.ContentLength >= 0 {
+		progress.Total = offset + res.ContentLength
+	}
+	body := &stallReader{r: res.Body, timer: stall, timeout: o.timeout()}
+	if _, err := io.Copy(sf, o.Progress.Reader(body, progress)); err != nil {
+		if err := o.context().Err(); err != nil {
+			return false, err
+		} else if ctx.Err() != nil {
+			return true, errors.Errorf("no data for %v", o.timeout())
+		}
+		return true, errors.Trace(err)
+	}
+	return false, nil
+}
+
+// Postpones timer on each read.
+type stallReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.timer.Reset(sr.timeout)
+	}
+	return n, err
+}
+
+// Opens a local path, `-` for stdin, or downloads a URL.
+func (o *Options) OpenLocation(location string) (_ *os.File, erv error) {
+	if location == "-" {
+		return os.Stdin, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch u.Scheme {
+	case "":
+		return os.Open(location)
+
+	case "file":
+		return os.Open(u.Path)
+
+	case "http":
+		if !o.AllowsHTTP(u.Host) {
+			return nil, errors.New("allow.http, or allow-insecure for the host, is required for http URLs")
+		}
+		fallthrough
+
+	case "https":
+		return o.OpenURL(u.String())
+
+	default:
+		return nil, errors.Errorf("Unsupported scheme: %v\n", u.Scheme)
+	}
+}
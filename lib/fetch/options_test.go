@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestOpenURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.aci":
+			w.Write([]byte("image"))
+		case "/redirect":
+			http.Redirect(w, r, "/image.aci", http.StatusFound)
+		case "/stall":
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("sta"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Second)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	spool, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	o := &Options{AllowHTTP: true, Timeout: 200 * time.Millisecond, Spool: spool}
+
+	for _, path := range []string{"/image.aci", "/redirect"} {
+		f, err := o.OpenLocation(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		bb, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(bb) != "image" {
+			t.Errorf("%v: got %#v", path, string(bb))
+		}
+	}
+	if ff, _ := ioutil.ReadDir(spool); len(ff) != 0 {
+		t.Errorf("spool not empty: %v", ff)
+	}
+
+	for _, path := range []string{"/missing", "/stall"} {
+		if _, err := o.OpenURL(srv.URL + path); errors.Cause(err) != ErrDownloadFailed {
+			t.Errorf("%v: expected download failure, got %v", path, err)
+		}
+	}
+
+	if _, err := (&Options{}).OpenLocation(srv.URL + "/image.aci"); err == nil {
+		t.Error("plain HTTP allowed")
+	}
+}
+
+func TestOpenURLCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("slo"))
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	spool, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Options{AllowHTTP: true, Timeout: 5 * time.Second, Spool: spool, Retries: 3, Context: ctx}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	if _, err := o.OpenURL(srv.URL + "/slow.aci"); errors.Cause(err) != ErrDownloadFailed {
+		t.Errorf("expected download failure, got %v", err)
+	}
+	if d := time.Since(started); d > 900*time.Millisecond {
+		t.Errorf("canceled download took %v", d)
+	}
+}
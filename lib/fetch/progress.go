@@ -0,0 +1,75 @@
+package fetch
+
+import (
+	"io"
+	"time"
+)
+
+// Phases of fetching and importing an image
+const (
+	PhaseDiscovering = "discovering"
+	PhaseDownloading = "downloading"
+	PhaseVerifying   = "verifying"
+	PhaseExtracting  = "extracting"
+	PhaseRegistering = "registering"
+)
+
+// Progress of a phase
+type Progress struct {
+	Phase    string
+	Location string // URL, or image name
+	Bytes    int64  // done so far
+	Total    int64  // -1 if unknown
+	Done     bool   // last report of the phase's transfer
+}
+
+// Receives progress reports; a nil ProgressFunc is silent. Reports of
+// a transfer are coalesced to at most one per ProgressInterval.
+type ProgressFunc func(Progress)
+
+// Shortest interval between reports of a transfer
+var ProgressInterval = 250 * time.Millisecond
+
+// Reports start of a phase.
+func (fn ProgressFunc) Phase(phase, location string) {
+	if fn != nil {
+		fn(Progress{Phase: phase, Location: location, Total: -1})
+	}
+}
+
+// Returns reader that reports bytes read from r, counting from
+// p.Bytes; returns r if fn is nil.
+func (fn ProgressFunc) Reader(r io.Reader, p Progress) io.Reader {
+	if fn == nil {
+		return r
+	}
+	if p.Total <= 0 {
+		p.Total = -1
+	}
+	pr := &progressReader{r: r, fn: fn, p: p}
+	fn(pr.p)
+	pr.last = time.Now()
+	return pr
+}
+
+type progressReader struct {
+	r    io.Reader
+	fn   ProgressFunc
+	p    Progress
+	last time.Time
+}
+
+func (pr *progressReader) Read(buf []byte) (int, error) {
+	n, err := pr.r.Read(buf)
+	pr.p.Bytes += int64(n)
+	if err == io.EOF {
+		if !pr.p.Done {
+			pr.p.Done = true
+			pr.fn(pr.p)
+		}
+	} else if now := time.Now(); now.Sub(pr.last) >= ProgressInterval {
+		pr.last = now
+		pr.fn(pr.p)
+	}
+	return n, err
+}
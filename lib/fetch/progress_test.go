@@ -0,0 +1,56 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	defer func(interval time.Duration) { ProgressInterval = interval }(ProgressInterval)
+	ProgressInterval = time.Hour
+
+	var reports []Progress
+	fn := ProgressFunc(func(p Progress) { reports = append(reports, p) })
+	data := strings.Repeat("x", 1000)
+	r := fn.Reader(iotest.OneByteReader(strings.NewReader(data)), Progress{Phase: PhaseDownloading, Location: "loc", Bytes: 24, Total: 1024})
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	// Reads are coalesced: only start and end are reported
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d: %v", len(reports), reports)
+	}
+	if p := reports[0]; p.Bytes != 24 || p.Total != 1024 || p.Done {
+		t.Errorf("unexpected first report %#v", p)
+	}
+	if p := reports[1]; p.Phase != PhaseDownloading || p.Location != "loc" || p.Bytes != 1024 || !p.Done {
+		t.Errorf("unexpected last report %#v", p)
+	}
+
+	// Nil ProgressFunc is silent
+	var nilFn ProgressFunc
+	nilFn.Phase(PhaseVerifying, "loc")
+	rd := strings.NewReader(data)
+	if nilFn.Reader(rd, Progress{}) != io.Reader(rd) {
+		t.Error("nil ProgressFunc wraps reader")
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var buf bytes.Buffer
+	fn := ProgressBar(&buf)
+	fn.Phase(PhaseDiscovering, "example.com/app")
+	r := fn.Reader(strings.NewReader("data"), Progress{Phase: PhaseDownloading, Location: "https://example.com/app.aci", Total: 4})
+	io.Copy(ioutil.Discard, r)
+	out := buf.String()
+	for _, expected := range []string{"Discovering example.com/app ...\n", "Downloading https://example.com/app.aci ...\n", "4 B/4 B"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %#v in output %#v", expected, out)
+		}
+	}
+}
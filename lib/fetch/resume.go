@@ -0,0 +1,187 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Downloads into the spool are resumable: a download of URL is kept
+// in `download.HASH` (HASH is SHA-256 of the URL) with validators of
+// the response in `download.HASH.json`. When a download fails midway,
+// a retry, or a later fetch of the same URL, continues with a ranged
+// request made conditional on the validator (If-Range); a server that
+// doesn't support ranges, or whose file has changed, sends the whole
+// file and the download starts over. Spool files are removed once
+// the download is complete; partial ones are removed by CleanSpool
+// when they're stale. The complete file is verified by the caller
+// like any other download.
+
+const spoolPrefix = "download."
+
+// Validators of a partial download
+type spoolMeta struct {
+	URL          string
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+// Returns value of If-Range header, or "" if download can't be
+// resumed. Weak ETags can't be used for ranges.
+func (sm *spoolMeta) validator() string {
+	if sm.ETag != "" && !strings.HasPrefix(sm.ETag, "W/") {
+		return sm.ETag
+	}
+	return sm.LastModified
+}
+
+func spoolPath(spool, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(spool, spoolPrefix+hex.EncodeToString(sum[:]))
+}
+
+// A download in progress. Path is empty for downloads into an
+// unlinked temporary file, which can be resumed only by retries.
+type spoolFile struct {
+	*os.File
+	path string
+	meta spoolMeta
+}
+
+// Opens, and locks, the spool file for url.
+func (o *Options) openSpoolFile(url string) (*spoolFile, error) {
+	if o.Spool == "" {
+		tf, err := ioutil.TempFile("", "jetpack.fetch.")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		os.Remove(tf.Name())
+		return &spoolFile{File: tf}, nil
+	}
+
+	if err := os.MkdirAll(o.Spool, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	path := spoolPath(o.Spool, url)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errors.Errorf("%v is already being downloaded", url)
+	}
+	sf := &spoolFile{File: f, path: path}
+	if bb, err := ioutil.ReadFile(path + ".json"); err == nil {
+		if json.Unmarshal(bb, &sf.meta) != nil || sf.meta.URL != url {
+			sf.meta = spoolMeta{}
+		}
+	}
+	return sf, nil
+}
+
+// Returns offset to resume the download at, or 0.
+func (sf *spoolFile) offset() int64 {
+	if sf.meta.validator() == "" {
+		return 0
+	}
+	fi, err := sf.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Starts over with new validators.
+func (sf *spoolFile) restart(meta spoolMeta) error {
+	if err := sf.Truncate(0); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := sf.Seek(0, os.SEEK_SET); err != nil {
+		return errors.Trace(err)
+	}
+	sf.meta = meta
+	if sf.path == "" {
+		return nil
+	}
+	if meta.validator() == "" {
+		os.Remove(sf.path + ".json")
+		return nil
+	}
+	bb, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(sf.path+".json", bb, 0600))
+}
+
+// Removes the spool file of a complete download, which stays open.
+func (sf *spoolFile) complete() error {
+	if sf.path != "" {
+		os.Remove(sf.path)
+		os.Remove(sf.path + ".json")
+	}
+	_, err := sf.Seek(0, os.SEEK_SET)
+	return errors.Trace(err)
+}
+
+// Returns the first byte position of a `bytes FIRST-LAST/LENGTH`
+// Content-Range, or -1.
+func contentRangeStart(cr string) int64 {
+	if !strings.HasPrefix(cr, "bytes ") {
+		return -1
+	}
+	first := strings.SplitN(strings.TrimPrefix(cr, "bytes "), "-", 2)[0]
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Removes partial downloads from spool that haven't been modified for
+// maxAge, skipping downloads in progress. Returns removed files and
+// their total size.
+func CleanSpool(spool string, maxAge time.Duration) ([]string, uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(spool, spoolPrefix+"*"))
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	var removed []string
+	var size uint64
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".json") {
+			// Validators of a removed download
+			if _, err := os.Stat(strings.TrimSuffix(path, ".json")); os.IsNotExist(err) {
+				os.Remove(path)
+			}
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			if err := os.Remove(path); err == nil {
+				os.Remove(path + ".json")
+				removed = append(removed, path)
+				size += uint64(fi.Size())
+			}
+		}
+		f.Close()
+	}
+	return removed, size, nil
+}
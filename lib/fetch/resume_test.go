@@ -0,0 +1,124 @@
+package fetch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpenURLResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranged, failed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		if r.URL.Path == "/changed" {
+			w.Header().Set("ETag", `"v`+strconv.Itoa(int(atomic.LoadInt32(&failed)))+`"`)
+		} else {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		if atomic.AddInt32(&failed, 1) == 1 {
+			// First response breaks off midway
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:4000])
+			return
+		}
+		http.ServeContent(w, r, "image.aci", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/image.aci", "/changed"} {
+		atomic.StoreInt32(&ranged, 0)
+		atomic.StoreInt32(&failed, 0)
+		spool, err := ioutil.TempDir("", "jetpack-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(spool)
+		o := &Options{AllowHTTP: true, Spool: spool}
+
+		// Failed download is kept in spool
+		if _, err := o.OpenURL(srv.URL + path); err == nil {
+			t.Fatalf("%v: expected first download to fail", path)
+		}
+		if fi, err := os.Stat(spoolPath(spool, srv.URL+path)); err != nil || fi.Size() != 4000 {
+			t.Fatalf("%v: expected partial download, got %v, %v", path, fi, err)
+		}
+
+		// Next fetch continues, or starts over if the file has changed
+		f, err := o.OpenURL(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		bb, _ := ioutil.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(bb, content) {
+			t.Errorf("%v: got %d bytes, expected %d", path, len(bb), len(content))
+		}
+		if ranged != 1 {
+			t.Errorf("%v: expected one ranged request, got %d", path, ranged)
+		}
+		if ff, _ := ioutil.ReadDir(spool); len(ff) != 0 {
+			t.Errorf("%v: spool not empty: %v", path, ff)
+		}
+	}
+
+	// Retries resume within one call
+	atomic.StoreInt32(&failed, 0)
+	o := &Options{AllowHTTP: true, Retries: 1}
+	f, err := o.OpenURL(srv.URL + "/image.aci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, _ := ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(bb, content) {
+		t.Errorf("retried: got %d bytes, expected %d", len(bb), len(content))
+	}
+}
+
+func TestCleanSpool(t *testing.T) {
+	spool, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for name, mtime := range map[string]time.Time{
+		"download.old":       old,
+		"download.old.json":  old,
+		"download.new":       time.Now(),
+		"download.gone.json": old,
+		"other":              old,
+	} {
+		path := filepath.Join(spool, name)
+		ioutil.WriteFile(path, []byte("data"), 0600)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	removed, size, err := CleanSpool(spool, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !strings.HasSuffix(removed[0], "download.old") || size != 4 {
+		t.Errorf("unexpected removal: %v, %d", removed, size)
+	}
+	ff, _ := ioutil.ReadDir(spool)
+	var left []string
+	for _, fi := range ff {
+		left = append(left, fi.Name())
+	}
+	if strings.Join(left, " ") != "download.new other" {
+		t.Errorf("unexpected files left: %v", left)
+	}
+}
@@ -0,0 +1,296 @@
+package fetch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/appc/spec/discovery"
+	"github.com/juju/errors"
+)
+
+// TLS settings are chosen per host, as credentials are: the first
+// TLSConfig whose pattern matches the request's host applies to
+// discovery, downloads, and registry requests. A host may trust a CA
+// bundle instead of the system's trust store, and present a client
+// certificate. Skipping verification and plain HTTP can be allowed
+// only for hosts named without wildcards, and each insecure request is
+// reported with Options.Warnf. Failed verification is reported as
+// TLSError, naming the trust that was used.
+//
+// appc discovery uses its own package-level HTTP client. Its transport
+// is replaced with one that sends each request with the options of the
+// discovery that made it, named by a private header (see
+// startDiscovery), so that concurrent discoveries with different
+// options don't mix.
+
+// TLS settings of hosts that match a pattern
+type TLSConfig struct {
+	Host       string // host name pattern, as Credentials.Host
+	CAFile     string // PEM bundle of CAs trusted instead of the system's
+	CertFile   string // client certificate for mutual TLS, with KeyFile
+	KeyFile    string
+	SkipVerify bool   // don't verify host's certificate; host can't be a pattern
+	AllowHTTP  bool   // allow plain HTTP; host can't be a pattern
+	Source     string // where the settings are configured
+}
+
+func (tc *TLSConfig) String() string {
+	return fmt.Sprintf("TLS settings for %v from %v", tc.Host, tc.Source)
+}
+
+func (tc *TLSConfig) matches(host string) bool {
+	return (&Credentials{Host: tc.Host}).matches(host)
+}
+
+// Checks that insecure options are given for a named host, and that
+// certificate and key come together.
+func (tc *TLSConfig) Validate() error {
+	if (tc.SkipVerify || tc.AllowHTTP) && (tc.Host == "" || strings.ContainsAny(tc.Host, "*?[")) {
+		return errors.Errorf("%v: insecure options need a host name, not a pattern", tc)
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return errors.Errorf("%v: client certificate needs both cert and key", tc)
+	}
+	return nil
+}
+
+// Returns TLS client configuration.
+func (tc *TLSConfig) config() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: tc.SkipVerify}
+	if tc.CAFile != "" {
+		pem, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v: CA bundle", tc)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("%v: no certificates in CA bundle %v", tc, tc.CAFile)
+		}
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v: client certificate", tc)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Returns TLS settings of host, or nil. First matching entry wins.
+func (o *Options) TLSFor(host string) *TLSConfig {
+	if o == nil {
+		return nil
+	}
+	for _, tc := range o.TLS {
+		if tc.matches(host) {
+			return tc
+		}
+	}
+	return nil
+}
+
+// Returns whether plain HTTP is allowed for host.
+func (o *Options) AllowsHTTP(host string) bool {
+	if o == nil {
+		return false
+	}
+	if o.AllowHTTP {
+		return true
+	}
+	tc := o.TLSFor(host)
+	return tc != nil && tc.AllowHTTP
+}
+
+func (o *Options) warnf(format string, args ...interface{}) {
+	if o != nil && o.Warnf != nil {
+		o.Warnf(format, args...)
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: "+format+"\n", args...)
+	}
+}
+
+// Returned when a host's certificate can't be verified, or the host
+// refuses the client certificate
+type TLSError struct {
+	Host   string
+	Config *TLSConfig // nil if none matched the host
+	Err    error
+}
+
+func (e *TLSError) Error() string {
+	trust := "system's trust store"
+	if e.Config != nil {
+		if e.Config.CAFile != "" {
+			trust = "CA bundle " + e.Config.CAFile
+		}
+		if e.Config.CertFile != "" {
+			trust += " and client certificate " + e.Config.CertFile
+		}
+		trust += fmt.Sprintf(" (%v)", e.Config)
+	}
+	return fmt.Sprintf("%v: TLS verification failed with %v: %v", e.Host, trust, e.Err)
+}
+
+// TLS alerts of a host that refuses the client certificate
+var certificateAlerts = map[tls.AlertError]bool{
+	42:  true, // bad_certificate
+	43:  true, // unsupported_certificate
+	44:  true, // certificate_revoked
+	45:  true, // certificate_expired
+	46:  true, // certificate_unknown
+	48:  true, // unknown_ca
+	116: true, // certificate_required
+}
+
+// Returns whether err is a failure of certificate verification, on
+// either side. Other TLS failures (e.g. no common protocol version)
+// are not.
+func isVerificationError(err error) bool {
+	var (
+		uae x509.UnknownAuthorityError
+		he  x509.HostnameError
+		cie x509.CertificateInvalidError
+		cve *tls.CertificateVerificationError
+		ae  tls.AlertError
+	)
+	if stderrors.As(err, &ae) {
+		return certificateAlerts[ae]
+	}
+	return stderrors.As(err, &uae) || stderrors.As(err, &he) || stderrors.As(err, &cie) ||
+		stderrors.As(err, &cve)
+}
+
+// Sends requests with TLS settings of their hosts.
+type tlsTransport struct {
+	o          *Options
+	mx         sync.Mutex
+	transports map[*TLSConfig]*http.Transport // nil key for hosts without settings
+}
+
+func (tt *tlsTransport) transport(tc *TLSConfig) (*http.Transport, error) {
+	tt.mx.Lock()
+	defer tt.mx.Unlock()
+	if t := tt.transports[tc]; t != nil {
+		return t, nil
+	}
+	timeout := tt.o.timeout()
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	if tc != nil {
+		cfg, err := tc.config()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		t.TLSClientConfig = cfg
+	}
+	if tt.transports == nil {
+		tt.transports = make(map[*TLSConfig]*http.Transport)
+	}
+	tt.transports[tc] = t
+	return t, nil
+}
+
+// Closes idle connections of all transports.
+func (tt *tlsTransport) closeIdleConnections() {
+	tt.mx.Lock()
+	defer tt.mx.Unlock()
+	for _, t := range tt.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+func (tt *tlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tc := tt.o.TLSFor(req.URL.Host)
+	switch {
+	case req.URL.Scheme == "http" && tc != nil && tc.AllowHTTP:
+		tt.o.warnf("INSECURE: requesting %v over plain HTTP, allowed by %v", req.URL, tc)
+	case req.URL.Scheme == "http":
+		tt.o.warnf("INSECURE: requesting %v over plain HTTP, allowed by allow.http", req.URL)
+	case tc != nil && tc.SkipVerify:
+		tt.o.warnf("INSECURE: not verifying certificate of %v, as set by %v", req.URL.Host, tc)
+	}
+	t, err := tt.transport(tc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.RoundTrip(req)
+	if err != nil && isVerificationError(err) {
+		return nil, &TLSError{Host: req.URL.Host, Config: tc, Err: err}
+	}
+	return res, err
+}
+
+// Header naming the discovery that sends a request; it's removed
+// before the request is sent.
+const discoveryHeader = "X-Jetpack-Discovery"
+
+// Transports of running discoveries, by ID
+var discoveries struct {
+	sync.Mutex
+	last    uint64
+	running map[string]*tlsTransport
+}
+
+func init() {
+	discovery.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		id := req.Header.Get(discoveryHeader)
+		discoveries.Lock()
+		tt := discoveries.running[id]
+		discoveries.Unlock()
+		if tt == nil {
+			tt = &tlsTransport{o: DefaultOptions}
+		}
+		if id != "" {
+			req = req.Clone(req.Context())
+			req.Header.Del(discoveryHeader)
+		}
+		return tt.RoundTrip(req)
+	})
+}
+
+// Starts a discovery that uses o's TLS settings. Returns headers
+// (with header's values) that its requests to host need to carry, and
+// a function that ends it.
+func (o *Options) startDiscovery(host string, header http.Header) (map[string]http.Header, func()) {
+	tt := &tlsTransport{o: o}
+	discoveries.Lock()
+	discoveries.last++
+	id := strconv.FormatUint(discoveries.last, 10)
+	if discoveries.running == nil {
+		discoveries.running = make(map[string]*tlsTransport)
+	}
+	discoveries.running[id] = tt
+	discoveries.Unlock()
+
+	h := make(http.Header, len(header)+1)
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set(discoveryHeader, id)
+	return map[string]http.Header{host: h}, func() {
+		discoveries.Lock()
+		delete(discoveries.running, id)
+		discoveries.Unlock()
+		tt.closeIdleConnections()
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
@@ -0,0 +1,179 @@
+package fetch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ca := filepath.Join(tmp, "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	warnf := func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+	get := func(tcs ...*TLSConfig) error {
+		o := &Options{Spool: tmp, TLS: tcs, Warnf: warnf}
+		f, err := o.OpenURL(srv.URL + "/image.aci")
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+
+	if err := get(); err == nil {
+		t.Error("expected verification failure")
+	} else if !strings.Contains(err.Error(), "TLS verification failed with system's trust store") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := get(&TLSConfig{Host: "other.example.com", CAFile: ca}); err == nil {
+		t.Error("expected verification failure for settings of another host")
+	}
+	if err := get(&TLSConfig{Host: "127.0.0.1", CAFile: ca, Source: "test"}); err != nil {
+		t.Error(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	// Wrong CA bundle is named in the error
+	wrongCA := filepath.Join(tmp, "wrong-ca.pem")
+	if err := ioutil.WriteFile(wrongCA, testCA(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(&TLSConfig{Host: host, CAFile: wrongCA, Source: "test"}); err == nil {
+		t.Error("expected verification failure with a wrong CA")
+	} else if !strings.Contains(err.Error(), "CA bundle "+wrongCA) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := get(&TLSConfig{Host: host, SkipVerify: true, Source: "test"}); err != nil {
+		t.Error(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "not verifying certificate of "+host) {
+		t.Errorf("expected a warning, got %v", warnings)
+	}
+}
+
+// Returns PEM of a self-signed CA certificate that signed nothing.
+func testCA(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	for _, tc := range []*TLSConfig{
+		{Host: "*.example.com", SkipVerify: true},
+		{Host: "*", AllowHTTP: true},
+		{Host: "example.com", CertFile: "client.pem"},
+	} {
+		if err := tc.Validate(); err == nil {
+			t.Errorf("%#v: expected error", tc)
+		}
+	}
+	for _, tc := range []*TLSConfig{
+		{Host: "registry.example.com:5000", SkipVerify: true, AllowHTTP: true},
+		{Host: "*.example.com", CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client.key"},
+	} {
+		if err := tc.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	o := &Options{TLS: []*TLSConfig{{Host: "dev.example.com", AllowHTTP: true}}}
+	if !o.AllowsHTTP("dev.example.com:8080") || o.AllowsHTTP("example.com") {
+		t.Error("plain HTTP allowed for wrong hosts")
+	}
+}
+
+func TestIsVerificationError(t *testing.T) {
+	for _, err := range []error{
+		x509.UnknownAuthorityError{},
+		fmt.Errorf("get: %w", x509.HostnameError{}),
+		tls.AlertError(48),  // unknown_ca
+		tls.AlertError(116), // certificate_required
+	} {
+		if !isVerificationError(err) {
+			t.Errorf("%#v: not a verification error", err)
+		}
+	}
+	for _, err := range []error{
+		tls.AlertError(70), // protocol_version
+		tls.AlertError(80), // internal_error
+		os.ErrNotExist,
+	} {
+		if isVerificationError(err) {
+			t.Errorf("%#v: verification error", err)
+		}
+	}
+}
+
+func TestDiscoveryHeaders(t *testing.T) {
+	o := &Options{Credentials: []*Credentials{{Host: "example.com", Token: "t0k3n"}}}
+	shared := http.Header{"Authorization": {"Bearer t0k3n"}}
+	headers, done := o.startDiscovery("example.com", shared)
+	h := headers["example.com"]
+	id := h.Get(discoveryHeader)
+	if id == "" || h.Get("Authorization") != "Bearer t0k3n" {
+		t.Fatalf("Unexpected headers %v", h)
+	}
+	if shared.Get(discoveryHeader) != "" {
+		t.Error("Credentials' header modified")
+	}
+	discoveries.Lock()
+	tt := discoveries.running[id]
+	discoveries.Unlock()
+	if tt == nil || tt.o != o {
+		t.Errorf("Discovery %v doesn't use its options", id)
+	}
+	done()
+	discoveries.Lock()
+	_, ok := discoveries.running[id]
+	discoveries.Unlock()
+	if ok {
+		t.Errorf("Discovery %v not ended", id)
+	}
+}
@@ -0,0 +1,648 @@
+package jetpack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/acutil"
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// HTTP API for controlling the host, served by `jetpack api` on a unix
+// socket (api.socket, with api.socket.mode and api.socket.group
+// permissions). Requests and responses are JSON:
+//
+//   GET    /pods                      list pods
+//   POST   /pods                      create pod from a pod manifest
+//   GET    /pods/UUID                 inspect pod
+//   DELETE /pods/UUID                 destroy pod
+//   POST   /pods/UUID/start           start pod's jail
+//   POST   /pods/UUID/stop            kill pod's jail
+//   POST   /pods/UUID/apps/APP/run    run app detached, with RunOptions
+//   GET    /images                    list images, filtered by query (see parseImageFilter)
+//   POST   /images                    fetch image {"Name": "NAME[:VERSION]"}
+//
+// With `?progress=1`, POST /images streams newline-delimited JSON:
+// {"Progress": fetch.Progress} objects as the fetch goes, and then
+// {"Image": APIImage} or {"Error": APIError}.
+//
+// Errors are returned as APIError with a matching status code.
+// Operations on a pod are serialized: a request for a pod that has an
+// operation in progress fails with ErrPodBusy.
+
+// Error returned by the API
+type APIError struct {
+	Status  int `json:"-"`
+	Kind    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Maps error to an APIError with status and kind.
+func apiError(err error) *APIError {
+	ae := &APIError{Status: http.StatusInternalServerError, Kind: "internal", Message: err.Error()}
+	if IsTimeout(err) {
+		ae.Status, ae.Kind = http.StatusGatewayTimeout, "timeout"
+		return ae
+	}
+	switch errors.Cause(err) {
+	case ErrNotFound:
+		ae.Status, ae.Kind = http.StatusNotFound, "not-found"
+	case ErrManyFound:
+		ae.Status, ae.Kind = http.StatusConflict, "many-found"
+	case ErrPodBusy:
+		ae.Status, ae.Kind = http.StatusConflict, "pod-busy"
+	case ErrHostBusy:
+		ae.Status, ae.Kind = http.StatusConflict, "host-busy"
+	case ErrHostFull:
+		ae.Status, ae.Kind = http.StatusInsufficientStorage, "host-full"
+	case ErrPodStopped:
+		ae.Status, ae.Kind = http.StatusConflict, "pod-stopped"
+	case ErrPodBroken:
+		ae.Status, ae.Kind = http.StatusConflict, "pod-broken"
+	case fetch.ErrDiscoveryFailed:
+		ae.Status, ae.Kind = http.StatusBadGateway, "discovery-failed"
+	case fetch.ErrDownloadFailed:
+		ae.Status, ae.Kind = http.StatusBadGateway, "download-failed"
+	case fetch.ErrVerificationFailed:
+		ae.Status, ae.Kind = http.StatusUnprocessableEntity, "verification-failed"
+	case ErrUsage, ErrNoCommand:
+		ae.Status, ae.Kind = http.StatusBadRequest, "bad-request"
+	}
+	return ae
+}
+
+// Pod as returned by the API; Manifest and ExitStatuses are included
+// only when a single pod is inspected.
+type APIPod struct {
+	UUID             string
+	Status           string
+	Hostname         string
+	IP               string                       `json:",omitempty"`
+	Apps             []types.ACName               `json:",omitempty"`
+	Manifest         *schema.PodManifest          `json:",omitempty"`
+	ExitStatuses     map[types.ACName]*ExitStatus `json:",omitempty"`
+	Broken           *PodBroken                   `json:",omitempty"`
+	Limits           []string                     `json:",omitempty"` // rctl rules in effect; only when running
+	ConfiguredLimits []string                     `json:",omitempty"` // rctl rules the pod is configured with
+	Rlimits          map[types.ACName][]Rlimit    `json:",omitempty"` // of running detached apps' processes
+	CPUSet           []int                        `json:",omitempty"` // only when running
+	Disk             *DiskUsage                   `json:",omitempty"`
+	StorageClass     string                       `json:",omitempty"`
+	Ephemeral        bool                         `json:",omitempty"`
+	ZFS              []*ZFSProperty               `json:",omitempty"` // pod dataset's properties
+	Coredump         string                       `json:",omitempty"` // core dump policy
+	CoreFiles        []CoreFile                   `json:",omitempty"`
+}
+
+// Image as returned by the API
+type APIImage struct {
+	UUID      string
+	Hash      string
+	Name      string
+	OSArch    string
+	Timestamp time.Time
+	Signature *ImageSignature `json:",omitempty"`
+	Import    *ImportSummary  `json:",omitempty"`
+
+	// Only in listings
+	Size       int64      `json:",omitempty"`
+	LastUsed   *time.Time `json:",omitempty"`
+	Referenced bool       `json:",omitempty"`
+	Tags       []string   `json:",omitempty"`
+
+	// Not in listings
+	History []ImageHistoryEntry `json:",omitempty"`
+}
+
+func apiPod(pod *Pod) *APIPod {
+	ap := &APIPod{UUID: pod.UUID.String(), Status: pod.Status().String(), Hostname: pod.Hostname()}
+	ap.IP, _ = pod.IPAddress()
+	ap.Broken, _ = pod.Broken()
+	for _, app := range pod.Manifest.Apps {
+		ap.Apps = append(ap.Apps, app.Name)
+	}
+	return ap
+}
+
+func apiImage(img *Image) *APIImage {
+	ai := &APIImage{UUID: img.UUID.String(), Name: img.String(), OSArch: img.OSArch(), Timestamp: img.Timestamp, Signature: img.Signature, Import: img.Import}
+	if img.Hash != nil {
+		ai.Hash = img.Hash.String()
+	}
+	if history, err := img.History(); err == nil {
+		ai.History = history
+	} else {
+		img.log().Warnf("History: %v", err)
+	}
+	return ai
+}
+
+// Serves the API
+type APIServer struct {
+	h        *Host
+	srv      *http.Server
+	listener net.Listener
+	path     string
+
+	ops    sync.WaitGroup // requests in progress
+	hostMx sync.Mutex     // serializes changes of host state; host lock doesn't within a process
+	busyMx sync.Mutex
+	busy   map[string]bool // pods with an operation in progress
+}
+
+func newAPIServer(h *Host) *APIServer {
+	s := &APIServer{h: h, busy: make(map[string]bool)}
+	s.srv = &http.Server{Handler: s}
+	return s
+}
+
+// Returns HTTP handler of the API, e.g. for serving on another
+// listener.
+func (h *Host) APIHandler() http.Handler {
+	return newAPIServer(h)
+}
+
+// Listens on api.socket, and returns server ready to Serve.
+func (h *Host) ListenAPI() (*APIServer, error) {
+	path := Config().GetString("api.socket", "")
+	if path == "" || path == "off" {
+		return nil, errors.New("API is disabled (api.socket is not set)")
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, errors.Errorf("API socket %v is in use", path)
+	}
+	removeSocket(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	mode := Config().GetString("api.socket.mode", "0600")
+	if m, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		l.Close()
+		return nil, errors.Errorf("Invalid api.socket.mode %#v", mode)
+	} else if err := os.Chmod(path, os.FileMode(m)); err != nil {
+		l.Close()
+		return nil, errors.Trace(err)
+	}
+	if group := Config().GetString("api.socket.group", ""); group != "" {
+		gid := -1
+		if grp, err := user.LookupGroup(group); err == nil {
+			gid, _ = strconv.Atoi(grp.Gid)
+		} else if gid, err = strconv.Atoi(group); err != nil {
+			l.Close()
+			return nil, errors.Errorf("Invalid api.socket.group %#v", group)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	s := newAPIServer(h)
+	s.listener, s.path = l, path
+	return s, nil
+}
+
+// Serves requests until Shutdown.
+func (s *APIServer) Serve() error {
+	s.h.log().Infof("Serving API on %v", s.path)
+	if err := s.srv.Serve(s.listener); err != http.ErrServerClosed {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Stops accepting requests, and waits for requests in progress to
+// finish. Pod operations are never abandoned halfway: when ctx is done
+// first, the commands they run are cancelled (see Host.CancelCommands),
+// and they're waited for to clean up after themselves.
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if ctx.Err() != nil {
+		s.h.CancelCommands()
+	}
+	s.ops.Wait()
+	if s.path != "" {
+		removeSocket(s.path)
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		// Waited for the operations anyway
+		err = nil
+	}
+	return errors.Trace(err)
+}
+
+// Marks pod busy; returns ErrPodBusy if it is busy already.
+func (s *APIServer) lockPod(pod *Pod) (func(), error) {
+	id := pod.UUID.String()
+	s.busyMx.Lock()
+	defer s.busyMx.Unlock()
+	if s.busy[id] {
+		return nil, errors.Annotatef(ErrPodBusy, "Pod %v", id)
+	}
+	s.busy[id] = true
+	return func() {
+		s.busyMx.Lock()
+		delete(s.busy, id)
+		s.busyMx.Unlock()
+	}, nil
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ops.Add(1)
+	defer s.ops.Done()
+	if r.Method == "POST" && strings.Trim(r.URL.Path, "/") == "images" && r.URL.Query().Get("progress") != "" {
+		s.streamFetchImage(w, r)
+		return
+	}
+	status, body, err := s.route(r)
+	if err != nil {
+		ae := s.errorResponse(r, err)
+		status, body = ae.Status, ae
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// Returns APIError for err, logging server errors.
+func (s *APIServer) errorResponse(r *http.Request, err error) *APIError {
+	ae, ok := errors.Cause(err).(*APIError)
+	if !ok {
+		ae = apiError(err)
+	}
+	if ae.Status >= 500 {
+		s.h.log().With("op", "api").Errorf("%v %v: %v", r.Method, r.URL.Path, errors.ErrorStack(err))
+	}
+	return ae
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &APIError{Status: http.StatusBadRequest, Kind: "bad-request", Message: fmt.Sprintf(format, args...)}
+}
+
+var errMethodNotAllowed = &APIError{Status: http.StatusMethodNotAllowed, Kind: "method-not-allowed", Message: "Method not allowed"}
+
+func (s *APIServer) route(r *http.Request) (int, interface{}, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "pods":
+		switch r.Method {
+		case "GET":
+			return s.listPods()
+		case "POST":
+			return s.createPod(r)
+		}
+		return 0, nil, errMethodNotAllowed
+	case len(parts) == 1 && parts[0] == "images":
+		switch r.Method {
+		case "GET":
+			return s.listImages(r)
+		case "POST":
+			return s.fetchImage(r)
+		}
+		return 0, nil, errMethodNotAllowed
+	case len(parts) >= 2 && parts[0] == "pods":
+		id := uuid.Parse(parts[1])
+		if id == nil {
+			return 0, nil, badRequest("Invalid pod UUID %#v", parts[1])
+		}
+		pod, err := s.h.GetPod(id)
+		if err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+		switch {
+		case len(parts) == 2 && r.Method == "GET":
+			return s.inspectPod(pod)
+		case len(parts) == 2 && r.Method == "DELETE":
+			return s.podOp(pod, http.StatusNoContent, pod.Destroy)
+		case len(parts) == 3 && parts[2] == "start" && r.Method == "POST":
+			return s.podOp(pod, http.StatusOK, pod.Start)
+		case len(parts) == 3 && parts[2] == "stop" && r.Method == "POST":
+			return s.podOp(pod, http.StatusOK, pod.Kill)
+		case len(parts) == 5 && parts[2] == "apps" && parts[4] == "run" && r.Method == "POST":
+			return s.runApp(pod, parts[3], r)
+		case len(parts) == 2,
+			len(parts) == 3 && (parts[2] == "start" || parts[2] == "stop"),
+			len(parts) == 5 && parts[2] == "apps" && parts[4] == "run":
+			return 0, nil, errMethodNotAllowed
+		}
+	}
+	return 0, nil, ErrNotFound
+}
+
+func (s *APIServer) listPods() (int, interface{}, error) {
+	pods := s.h.Pods()
+	rv := make([]*APIPod, len(pods))
+	for i, pod := range pods {
+		rv[i] = apiPod(pod)
+	}
+	return http.StatusOK, rv, nil
+}
+
+func (s *APIServer) inspectPod(pod *Pod) (int, interface{}, error) {
+	ap := apiPod(pod)
+	ap.Manifest = &pod.Manifest
+	statuses, err := pod.ExitStatuses()
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	ap.ExitStatuses = statuses
+	rules, err := pod.EffectiveRctlRules()
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	for _, rule := range rules {
+		ap.Limits = append(ap.Limits, rule.String())
+	}
+	if rules, err = pod.RctlRules(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	for _, rule := range rules {
+		ap.ConfiguredLimits = append(ap.ConfiguredLimits, rule.String())
+	}
+	for _, rtApp := range pod.Manifest.Apps {
+		if app := pod.App(rtApp.Name); app == nil {
+			continue
+		} else if rls, err := app.EffectiveRlimits(); err != nil {
+			return 0, nil, errors.Trace(err)
+		} else if len(rls) > 0 {
+			if ap.Rlimits == nil {
+				ap.Rlimits = make(map[types.ACName][]Rlimit)
+			}
+			ap.Rlimits[rtApp.Name] = rls
+		}
+	}
+	if ap.CPUSet, err = pod.CPUSet(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if du, err := pod.DiskUsage(); err != nil {
+		return 0, nil, errors.Trace(err)
+	} else {
+		ap.Disk = &du
+	}
+	ap.StorageClass = pod.StorageClass()
+	ap.Ephemeral = pod.Ephemeral()
+	if ap.ZFS, err = pod.ZFSProperties(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if ap.Coredump, err = pod.CoredumpPolicy(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if ap.CoreFiles, err = pod.CoreFiles(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return http.StatusOK, ap, nil
+}
+
+func (s *APIServer) createPod(r *http.Request) (int, interface{}, error) {
+	pm := &schema.PodManifest{}
+	if err := json.NewDecoder(r.Body).Decode(pm); err != nil {
+		return 0, nil, badRequest("Invalid pod manifest: %v", err)
+	}
+	s.hostMx.Lock()
+	defer s.hostMx.Unlock()
+	pm, err := s.h.ReifyPodManifest(pm)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	pod, err := s.h.CreatePod(pm, nil)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return http.StatusCreated, apiPod(pod), nil
+}
+
+// Runs operation on the pod, and returns the pod's new state.
+func (s *APIServer) podOp(pod *Pod, status int, op func() error) (int, interface{}, error) {
+	unlock, err := s.lockPod(pod)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	defer unlock()
+	if err := op(); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if status == http.StatusNoContent {
+		return status, nil, nil
+	}
+	pod.Host.getJailStatus("", true)
+	return status, apiPod(pod), nil
+}
+
+func (s *APIServer) runApp(pod *Pod, appName string, r *http.Request) (int, interface{}, error) {
+	name, err := types.NewACName(appName)
+	if err != nil {
+		return 0, nil, badRequest("Invalid app name %#v", appName)
+	}
+	app := pod.App(*name)
+	if app == nil {
+		return 0, nil, errors.Annotatef(ErrNotFound, "App %v", name)
+	}
+	opts := &RunOptions{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+			return 0, nil, badRequest("Invalid run options: %v", err)
+		}
+	}
+	unlock, err := s.lockPod(pod)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	defer unlock()
+	sv, err := app.RunDetached(opts)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return http.StatusAccepted, sv, nil
+}
+
+func apiImageSummary(is *ImageSummary) *APIImage {
+	ai := &APIImage{
+		UUID:       is.UUID.String(),
+		Name:       is.String(),
+		OSArch:     is.OSArch(),
+		Timestamp:  is.Imported,
+		Signature:  is.Signature,
+		Import:     is.Import,
+		Size:       is.Size,
+		Referenced: is.Referenced,
+	}
+	if is.Hash != nil {
+		ai.Hash = is.Hash.String()
+	}
+	if !is.LastUsed.IsZero() {
+		ai.LastUsed = &is.LastUsed
+	}
+	for _, tag := range is.Tags {
+		ai.Tags = append(ai.Tags, tag.String())
+	}
+	return ai
+}
+
+// Parses image filter from query parameters: name (pattern), label
+// (NAME=VALUE, repeated), imported-before and imported-after
+// (RFC3339), min-size (bytes), referenced (true or false), sort
+// (name, imported, or size), and reverse.
+func parseImageFilter(q url.Values) (*ImageFilter, error) {
+	filter := &ImageFilter{Name: q.Get("name")}
+	for _, label := range q["label"] {
+		pieces := strings.SplitN(label, "=", 2)
+		if len(pieces) != 2 {
+			return nil, badRequest("Invalid label %#v", label)
+		}
+		name, err := types.NewACIdentifier(pieces[0])
+		if err != nil {
+			return nil, badRequest("Invalid label %#v: %v", label, err)
+		}
+		filter.Labels = append(filter.Labels, types.Label{Name: *name, Value: pieces[1]})
+	}
+	for param, t := range map[string]*time.Time{
+		"imported-before": &filter.ImportedBefore,
+		"imported-after":  &filter.ImportedAfter,
+	} {
+		if v := q.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, badRequest("Invalid %v: %v", param, err)
+			}
+			*t = parsed
+		}
+	}
+	if v := q.Get("min-size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, badRequest("Invalid min-size: %v", err)
+		}
+		filter.MinSize = size
+	}
+	if v := q.Get("referenced"); v != "" {
+		referenced, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, badRequest("Invalid referenced: %v", err)
+		}
+		filter.Referenced = UnreferencedImages
+		if referenced {
+			filter.Referenced = ReferencedImages
+		}
+	}
+	if v := q.Get("sort"); v != "" {
+		by, err := ParseImageSort(v)
+		if err != nil {
+			return nil, badRequest("%v", err)
+		}
+		filter.Sort = by
+	}
+	if v := q.Get("reverse"); v != "" {
+		reverse, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, badRequest("Invalid reverse: %v", err)
+		}
+		filter.Reverse = reverse
+	}
+	return filter, nil
+}
+
+func (s *APIServer) listImages(r *http.Request) (int, interface{}, error) {
+	filter, err := parseImageFilter(r.URL.Query())
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	iss, err := s.h.ListImages(filter)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	rv := make([]*APIImage, len(iss))
+	for i, is := range iss {
+		rv[i] = apiImageSummary(is)
+	}
+	return http.StatusOK, rv, nil
+}
+
+func parseFetchRequest(r *http.Request) (types.ACIdentifier, types.Labels, error) {
+	var req struct{ Name string }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", nil, badRequest("Invalid request: %v", err)
+	}
+	name, labels, err := acutil.ParseImageName(req.Name)
+	if err != nil {
+		return "", nil, badRequest("Invalid image name %#v: %v", req.Name, err)
+	}
+	return name, labels, nil
+}
+
+// Fetches image, reporting progress to progress.
+func (s *APIServer) doFetchImage(name types.ACIdentifier, labels types.Labels, progress fetch.ProgressFunc) (*APIImage, error) {
+	s.hostMx.Lock()
+	defer s.hostMx.Unlock()
+	img, err := s.h.FetchImage(types.Hash{}, name, labels, &ImageOptions{Progress: progress})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiImage(img), nil
+}
+
+func (s *APIServer) fetchImage(r *http.Request) (int, interface{}, error) {
+	name, labels, err := parseFetchRequest(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	ai, err := s.doFetchImage(name, labels, nil)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return http.StatusOK, ai, nil
+}
+
+// Fetches image, streaming progress. Invalid requests are refused
+// before the stream starts; later errors end it.
+func (s *APIServer) streamFetchImage(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	name, labels, err := parseFetchRequest(r)
+	if err != nil {
+		ae := s.errorResponse(r, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(ae.Status)
+		enc.Encode(ae)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(v interface{}) {
+		enc.Encode(v)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	ai, err := s.doFetchImage(name, labels, func(p fetch.Progress) {
+		send(struct{ Progress fetch.Progress }{p})
+	})
+	if err != nil {
+		send(struct{ Error *APIError }{s.errorResponse(r, err)})
+		return
+	}
+	send(struct{ Image *APIImage }{ai})
+}
@@ -0,0 +1,95 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestAPIErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	srv := httptest.NewServer(h.APIHandler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		kind         string
+	}{
+		{"GET", "/pods/" + uuid.NewRandom().String(), http.StatusNotFound, "not-found"},
+		{"GET", "/pods/not-an-uuid", http.StatusBadRequest, "bad-request"},
+		{"GET", "/nothing", http.StatusNotFound, "not-found"},
+		{"PUT", "/pods", http.StatusMethodNotAllowed, "method-not-allowed"},
+		{"POST", "/images", http.StatusBadRequest, "bad-request"},
+		{"POST", "/images?progress=1", http.StatusBadRequest, "bad-request"},
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ae APIError
+		err = json.NewDecoder(resp.Body).Decode(&ae)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%v %v: %v", tc.method, tc.path, err)
+		} else if resp.StatusCode != tc.status || ae.Kind != tc.kind || ae.Message == "" {
+			t.Errorf("%v %v: expected %d %v, got %d %#v", tc.method, tc.path, tc.status, tc.kind, resp.StatusCode, ae)
+		}
+	}
+}
+
+func TestAPIPodBusy(t *testing.T) {
+	s := newAPIServer(&Host{})
+	pod := &Pod{UUID: uuid.NewRandom()}
+	unlock, err := s.lockPod(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.lockPod(pod); errors.Cause(err) != ErrPodBusy {
+		t.Errorf("Expected ErrPodBusy, got %v", err)
+	} else if ae := apiError(err); ae.Status != http.StatusConflict || ae.Kind != "pod-busy" {
+		t.Errorf("Unexpected API error %#v", ae)
+	}
+	unlock()
+	if unlock, err := s.lockPod(pod); err != nil {
+		t.Errorf("Expected pod to be unlocked, got %v", err)
+	} else {
+		unlock()
+	}
+}
+
+func TestAPITimeoutError(t *testing.T) {
+	cmdErr := run.Command("/bin/sleep", "10").WithTimeout(10 * time.Millisecond).Run()
+	for _, err := range []error{
+		errors.Annotate(ErrTimeout, "Pod did not stop"),
+		errors.Trace(cmdErr),
+	} {
+		if !IsTimeout(err) {
+			t.Errorf("Expected %v to be a timeout", err)
+		} else if ae := apiError(err); ae.Status != http.StatusGatewayTimeout || ae.Kind != "timeout" {
+			t.Errorf("Unexpected API error %#v", ae)
+		}
+	}
+	if IsTimeout(errors.Trace(ErrPodBusy)) {
+		t.Error("ErrPodBusy is a timeout")
+	}
+}
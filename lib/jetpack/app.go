@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/3ofcoins/jetpack/lib/passwd"
 	"github.com/3ofcoins/jetpack/lib/run"
@@ -20,8 +24,15 @@ type App struct {
 	Pod    *Pod
 	app    *types.App
 	cmd    *run.Cmd
+	pgrp   bool
 	killed bool
 
+	// Don't start the pod's jail for stage2 commands
+	noStart bool
+
+	// Called with pid of each started stage2 command
+	started func(pid int)
+
 	// cache
 	_env []string
 }
@@ -47,16 +58,12 @@ func (app *App) env() []string {
 			}
 		}
 		if !hasPath {
-			env = append(env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+			env = append(env, "PATH="+Config().MustGetString("app.path"))
 		}
 
 		if !hasTerm {
 			// TODO: TERM= only if we're attached to a terminal
-			term := os.Getenv("TERM")
-			if term == "" {
-				term = "vt100"
-			}
-			env = append(env, "TERM="+term)
+			env = append(env, "TERM="+callerTerm())
 		}
 
 		app._env = env
@@ -64,45 +71,142 @@ func (app *App) env() []string {
 	return app._env
 }
 
-func (app *App) Run(stdin io.Reader, stdout, stderr io.Writer) (re error) {
-	if _, err := app.Pod.Host.CheckMDS(); err != nil {
-		return errors.Trace(err)
+// Returns terminal type of jetpack's caller.
+func callerTerm() string {
+	if term := os.Getenv("TERM"); term != "" {
+		return term
 	}
+	return "vt100"
+}
 
-	for _, eh := range app.app.EventHandlers {
-		switch eh.Name {
-		case "pre-start":
-			// TODO: log
-			if err := app.Stage2(stdin, stdout, stderr, "0", "0", "", eh.Exec...); err != nil {
-				return errors.Trace(err)
-			}
-			if app.killed {
-				return errors.New("CAN'T HAPPEN: app killed, and Stage2 succeeded")
+// Returns env with HOME, USER, LOGNAME, and SHELL of the user
+// appended, unless env already sets them.
+func userEnv(env []string, pwent *passwd.PasswdEntry) []string {
+	defaults := [][2]string{{"HOME", pwent.Home}, {"SHELL", pwent.Shell}}
+	if pwent.Username != "" {
+		defaults = append(defaults, [2]string{"USER", pwent.Username}, [2]string{"LOGNAME", pwent.Username})
+	}
+	rv := append([]string(nil), env...)
+defaults:
+	for _, def := range defaults {
+		for _, ev := range env {
+			if strings.HasPrefix(ev, def[0]+"=") {
+				continue defaults
 			}
-		case "post-stop":
-			defer func(exec []string) {
-				// TODO: log
-				if !app.killed {
-					if err := app.Stage2(stdin, stdout, stderr, "0", "0", "", exec...); err != nil {
-						if re != nil {
-							re = errors.Trace(err)
-						} // else? log?
-					}
-				}
-			}(eh.Exec)
-		default:
-			return errors.Errorf("Unrecognized eventHandler: %v", eh.Name)
 		}
+		rv = append(rv, def[0]+"="+def[1])
+	}
+	return rv
+}
+
+// Returns command to run as the app's exec, with opts' override
+// applied. Error's cause is ErrNoCommand if there's none.
+func (app *App) command(opts *RunOptions) ([]string, error) {
+	if err := opts.Check(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Arguments appended to an empty exec are not a command
+	if exec := opts.exec(app.app.Exec); len(exec) > 0 && (len(app.app.Exec) > 0 || opts.ExecMode == ExecReplace) {
+		return exec, nil
+	}
+	image := "?"
+	if rtApp := app.Pod.Manifest.Apps.Get(app.Name); rtApp != nil {
+		if rtApp.Image.Name != nil {
+			image = rtApp.Image.Name.String()
+		} else {
+			image = rtApp.Image.ID.String()
+		}
+	}
+	return nil, errors.Annotatef(ErrNoCommand, "App %v (image %v)", app.Name, image)
+}
+
+// Runs the app's exec with its event handlers. Returns exit status of
+// the app's exec, which is also recorded in the pod; error means that
+// jetpack failed to run the app (or its pre-start handler failed).
+func (app *App) Run(stdin io.Reader, stdout, stderr io.Writer, opts *RunOptions) (*ExitStatus, error) {
+	if err := app.Pod.Host.ensureMDS(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	exec, err := app.command(opts)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	return errors.Trace(app.Stage2(stdin, stdout, stderr, "", "", "", app.app.Exec...))
+	stdout, stderr, closeLogs, err := app.captureOutput(stdout, stderr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeLogs()
+
+	if err := checkEventHandlers(app.app); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := app.runEventHandlers(EventHandlerPreStart, opts, stdout, stderr); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if app.killed {
+		return nil, errors.New("CAN'T HAPPEN: app killed, and Stage2 succeeded")
+	}
+	defer func() {
+		if !app.killed {
+			app.runPostStop(opts, stdout, stderr)
+		}
+	}()
+
+	es, err := app.Stage2(opts, stdin, stdout, stderr, "", "", "", exec...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	es.Exec = exec
+	if err := app.Pod.recordExitStatus(es); err != nil {
+		app.log().Warnf("cannot record exit status: %v", err)
+	}
+	return es, nil
 }
 
-func (app *App) Console(username string) error {
+// Opens a console in the app as username. Shell is picked by
+// consoleExec, unless given explicitly.
+func (app *App) Console(username, shell string, opts *RunOptions) (*ExitStatus, error) {
 	if username == "" {
 		username = "root"
 	}
-	return errors.Trace(app.Stage2(os.Stdin, os.Stdout, os.Stderr, "0", "0", "", "/usr/bin/login", "-p", "-f", username))
+	if shell == "" {
+		shell, _ = app.Pod.appAnnotation(app.Name, "jetpack/console-shell")
+	}
+
+	var userShell string
+	if pwf, err := app.readPasswd(); err != nil {
+		return nil, errors.Trace(err)
+	} else if pwent := pwf.FindByUsername(username); pwent != nil {
+		userShell = pwent.Shell
+	}
+
+	var manifest *schema.ImageManifest
+	if rtApp := app.Pod.Manifest.Apps.Get(app.Name); rtApp != nil {
+		if img, err := app.Pod.Host.getRuntimeImage(rtApp.Image); err == nil {
+			manifest = &img.Manifest
+		}
+	}
+
+	exec, login, err := consoleExec(manifest, username, userShell, shell, func(path string) bool {
+		_, err := os.Stat(app.Path(path))
+		return err == nil
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "App %v", app.Name)
+	}
+	// login(1) switches to the user by itself
+	user, group := username, ""
+	if login {
+		user, group = "0", "0"
+	}
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		es, err := app.Stage2TTY(opts, user, group, "", exec...)
+		return es, errors.Trace(err)
+	}
+	es, err := app.Stage2(opts, os.Stdin, os.Stdout, os.Stderr, user, group, "", exec...)
+	return es, errors.Trace(err)
 }
 
 // IsRunning returns true if the app currently executes a stage2 command.
@@ -111,26 +215,102 @@ func (app *App) IsRunning() bool {
 }
 
 func (app *App) Kill() error {
-	if app.cmd != nil && app.cmd.Cmd.Process != nil {
-		return app.cmd.Cmd.Process.Kill()
+	return app.Signal(syscall.SIGKILL)
+}
+
+// Sends signal to the app's stage2 command, or to its whole process
+// group if it runs in its own. If the app runs detached, signal is
+// sent through its supervisor.
+func (app *App) Signal(sig syscall.Signal) error {
+	if app.cmd == nil || app.cmd.Cmd.Process == nil {
+		if sv, err := app.Pod.Supervisor(app.Name); err != nil {
+			return errors.Trace(err)
+		} else if sv != nil {
+			return errors.Trace(sv.Signal(sig))
+		}
+		// Signalling an app that's not alive is a nop
+		return nil
 	}
-	// Killing an app that's not alive is a nop
-	return nil
+	if app.pgrp {
+		if err := syscall.Kill(-app.cmd.Cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+	return errors.Trace(app.cmd.Cmd.Process.Signal(sig))
+}
+
+// Forwards signals received by jetpack to the app until the returned
+// function is called.
+func (app *App) forwardSignals() func() {
+	sigch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		for {
+			select {
+			case sig := <-sigch:
+				if err := app.Signal(sig.(syscall.Signal)); err != nil {
+					app.log().Warnf("cannot forward %v: %v", sig, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigch)
+		close(done)
+	}
+}
+
+// Waits for the started stage2 command, forwarding signals, and kills
+// what's left of its process group after it exits.
+func (app *App) wait() error {
+	stop := app.forwardSignals()
+	err := app.cmd.Wait()
+	stop()
+	if app.pgrp {
+		// Orphaned children of the app
+		if kerr := syscall.Kill(-app.cmd.Cmd.Process.Pid, syscall.SIGKILL); kerr != nil && kerr != syscall.ESRCH {
+			app.log().Warnf("cannot kill process group: %v", kerr)
+		}
+	}
+	return err
+}
+
+// Runs a command in the app. Returns exit status if the command has
+// run, or error if it couldn't be run.
+func (app *App) Stage2(opts *RunOptions, stdin io.Reader, stdout, stderr io.Writer, user, group string, cwd string, exec ...string) (*ExitStatus, error) {
+	return app.stage2(opts, false, stdin, stdout, stderr, user, group, cwd, exec...)
 }
 
-func (app *App) Stage2(stdin io.Reader, stdout, stderr io.Writer, user, group string, cwd string, exec ...string) error {
+// Runs a command in the app on a pseudo-terminal, relayed to the
+// caller's terminal.
+func (app *App) Stage2TTY(opts *RunOptions, user, group string, cwd string, exec ...string) (*ExitStatus, error) {
+	return app.stage2(opts, true, nil, nil, nil, user, group, cwd, exec...)
+}
+
+func (app *App) stage2(opts *RunOptions, tty bool, stdin io.Reader, stdout, stderr io.Writer, user, group string, cwd string, exec ...string) (rEs *ExitStatus, rErr error) {
 	if app.IsRunning() {
 		// One Jetpack process won't need to run multiple commands in the
 		// same app at the same time. It's either sequential
 		// hook-exec-hook, or an individual command, but not both in the
 		// same binary. This assumption may change in the future.
 		// FIXME: race condition between this place and setting app.cmd
-		return errors.New("A stage2 command is already running for this app")
+		return nil, errors.New("A stage2 command is already running for this app")
 	}
 	app.killed = false
 
+	if err := opts.Check(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !tty {
+		stdin = opts.stdin(stdin)
+	}
+
 	if strings.HasPrefix(user, "/") || strings.HasPrefix(group, "/") {
-		return errors.New("Path-based user/group not supported yet, sorry")
+		return nil, errors.New("Path-based user/group not supported yet, sorry")
 	}
 
 	if cwd == "" {
@@ -150,65 +330,256 @@ func (app *App) Stage2(stdin io.Reader, stdout, stderr io.Writer, user, group st
 	}
 
 	// Ensure jail is created
-	jid := app.Pod.ensureJid()
+	var jid int
+	if app.noStart {
+		if jid = app.Pod.currentJid(); jid == 0 {
+			return nil, errors.Errorf("Pod %v is not running", app.Pod.UUID)
+		}
+	} else {
+		jid = app.Pod.ensureJid()
+	}
 
-	mds, err := app.Pod.MetadataURL()
-	if err != nil {
-		return errors.Trace(err)
+	var mds string
+	if metadataEnabled() {
+		if url, err := app.Pod.MetadataURL(); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			mds = url
+		}
 	}
 
-	pwf, err := passwd.ReadPasswd(app.Path("etc", "passwd"))
+	pwf, err := app.readPasswd()
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	pwent := pwf.Find(user)
-	if pwent == nil {
-		return errors.Errorf("Cannot find user: %#v", user)
+	grf, err := passwd.ReadGroup(app.Path("etc", "group"))
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	if group != "" {
-		grf, err := passwd.ReadGroup(app.Path("etc", "group"))
-		if err != nil {
-			return errors.Trace(err)
-		}
-		pwent.Gid = grf.FindGid(group)
-		if pwent.Gid < 0 {
-			return errors.Errorf("Cannot find group: %#v", group)
-		}
+	pwent, err := resolveUser(pwf, grf, user, group)
+	if err != nil {
+		return nil, errors.Annotatef(err, "App %v", app.Name)
 	}
 
 	if cwd == "" {
 		cwd = "/"
 	}
 
-	gids := strconv.Itoa(pwent.Gid)
-	if addSupplementaryGIDs && len(app.app.SupplementaryGIDs) > 0 {
-		gidsArr := make([]string, len(app.app.SupplementaryGIDs)+1)
-		gidsArr[0] = gids
-		for i, gid := range app.app.SupplementaryGIDs {
-			gidsArr[i+1] = strconv.Itoa(gid)
-		}
-		gids = strings.Join(gidsArr, ",")
+	var manifestGIDs []int
+	if addSupplementaryGIDs {
+		manifestGIDs = app.app.SupplementaryGIDs
 	}
+	var gidsArr []string
+	for _, gid := range processGroups(pwent.Gid, pwent.Username, manifestGIDs, grf) {
+		gidsArr = append(gidsArr, strconv.Itoa(gid))
+	}
+	gids := strings.Join(gidsArr, ",")
 
 	stage2 := filepath.Join(Config().MustGetString("path.libexec"), "stage2")
 	args := []string{
 		fmt.Sprintf("%d:%d:%s:%s:%s", jid, pwent.Uid, gids, app.Name, cwd),
-		"AC_METADATA_URL=" + mds,
-		"USER=" + pwent.Username,
-		"LOGNAME=" + pwent.Username,
-		"HOME=" + pwent.Home,
-		"SHELL=" + pwent.Shell,
-	}
-	// TODO: move TERM= here if stdin (or stdout?) is a terminal
-	args = append(args, app.env()...)
+	}
+	// Environment (with env files' values and the metadata token) is
+	// passed in stage2's own environment rather than argv, which any
+	// user of the host can see with ps(1).
+	env := app.env()
+	if tty {
+		// Session is displayed on caller's terminal
+		env = mergeEnv(env, []string{"TERM=" + callerTerm()})
+	}
+	envFiles, err := app.Pod.appEnvFiles(app.Name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "App %v", app.Name)
+	}
+	if opts != nil {
+		envFiles = append(envFiles, opts.EnvFiles...)
+	}
+	if fileEnv, err := readEnvFiles(envFiles); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		env = mergeEnv(env, fileEnv)
+	}
+	if opts != nil {
+		env = mergeEnv(env, opts.Env)
+	}
+	if mds != "" {
+		env = mergeEnv(env, []string{"AC_METADATA_URL=" + mds})
+	}
+	env = userEnv(env, pwent)
 	args = append(args, exec...)
-	app.cmd = run.Command(stage2, args...)
-	app.cmd.Cmd.Stdin = stdin
-	app.cmd.Cmd.Stdout = stdout
-	app.cmd.Cmd.Stderr = stderr
-	defer func() { app.cmd = nil }()
+	// Command on a pty gets its own session. Otherwise, it gets its own
+	// process group, unless it reads from a terminal (it would be
+	// stopped by SIGTTIN, as it wouldn't be terminal's foreground
+	// group).
+	if f, ok := stdin.(*os.File); tty || !ok || !terminal.IsTerminal(int(f.Fd())) {
+		app.pgrp = true
+	}
+	stage2opts := []string{"-e"}
+	switch {
+	case tty:
+		stage2opts = append(stage2opts, "-t")
+	case app.pgrp:
+		stage2opts = append(stage2opts, "-g")
+	}
+	if rls, err := app.Rlimits(); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		for _, rl := range rls {
+			stage2opts = append(stage2opts, "-r", rl.String())
+		}
+	}
+	class, err := app.LoginClass(pwent.Username)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if class != "" {
+		stage2opts = append(stage2opts, "-c", class)
+	}
+	// Login class' umask is used, unless it's set explicitly
+	if _, explicit := app.Pod.appAnnotation(app.Name, "jetpack/umask"); explicit || class == "" {
+		if umask, err := app.Umask(); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			stage2opts = append(stage2opts, "-m", umask)
+		}
+	}
+	args = append(stage2opts, args...)
+	app.Pod.logEvent(&Event{Type: EventExec, App: app.Name, Exec: exec, EnvFiles: envFiles, Details: opts.String()})
+	defer func() { app.logExit(exec, rEs, rErr) }()
+	app.cmd = run.Command(stage2, args...).WithSecretEnv(env)
+	defer func() { app.cmd, app.pgrp = nil, false }()
 
-	return app.cmd.Run()
+	if !tty {
+		app.cmd.Cmd.Stdin = stdin
+		app.cmd.Cmd.Stdout = stdout
+		app.cmd.Cmd.Stderr = stderr
+		if err := app.cmd.Start(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if app.started != nil {
+			app.started(app.cmd.Cmd.Process.Pid)
+		}
+		return exitStatus(app.Name, app.wait())
+	}
+
+	var es *ExitStatus
+	err = relayPTY(func(slave *os.File) error {
+		app.cmd.Cmd.Stdin = slave
+		app.cmd.Cmd.Stdout = slave
+		app.cmd.Cmd.Stderr = slave
+		err := app.cmd.Start()
+		slave.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		es, err = exitStatus(app.Name, app.wait())
+		return err
+	})
+	return es, errors.Trace(err)
+}
+
+// Returns value of app's annotation, or of pod's annotation if app
+// doesn't have one.
+func (pod *Pod) appAnnotation(name types.ACName, key types.ACIdentifier) (string, bool) {
+	if rtApp := pod.Manifest.Apps.Get(name); rtApp != nil {
+		if v, ok := rtApp.Annotations.Get(string(key)); ok {
+			return v, true
+		}
+	}
+	return pod.Manifest.Annotations.Get(string(key))
+}
+
+// Returns app's umask: `jetpack/umask` annotation of the app or the
+// pod (octal), 0022 by default.
+func (pod *Pod) appUmask(name types.ACName) (string, error) {
+	str, ok := pod.appAnnotation(name, "jetpack/umask")
+	if !ok {
+		return "0022", nil
+	}
+	if umask, err := strconv.ParseUint(str, 8, 32); err != nil || umask > 0777 {
+		return "", errors.Errorf("Invalid umask %#v", str)
+	} else {
+		return fmt.Sprintf("%04o", umask), nil
+	}
+}
+
+func (app *App) Umask() (string, error) {
+	return app.Pod.appUmask(app.Name)
+}
+
+// Verifies resource limits, umasks, and env files of all the pod's apps.
+func (pod *Pod) checkAppOptions() error {
+	for _, rtApp := range pod.Manifest.Apps {
+		if _, err := pod.appRlimits(rtApp.Name); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+		if _, err := pod.appUmask(rtApp.Name); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+		if _, err := pod.appEnvFiles(rtApp.Name); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+	}
+	if _, err := pod.CoredumpPolicy(); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := pod.coredumpSize(); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := pod.logRotation(); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := pod.syslogMode(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Reads the image's /etc/passwd, or /etc/master.passwd if the image
+// ships only that and the databases.
+func (app *App) readPasswd() (passwd.PasswdFile, error) {
+	pwf, err := passwd.ReadPasswd(app.Path("etc", "passwd"))
+	if err == nil && len(pwf) == 0 {
+		pwf, err = passwd.ReadMasterPasswd(app.Path("etc", "master.passwd"))
+	}
+	return pwf, errors.Trace(err)
+}
+
+// Resolves user and group (names or numeric IDs) against the image's
+// passwd and group files. Numeric IDs don't need an entry. Empty group
+// means user's primary group. User's login shell is not checked: it
+// is not used to run the app, so nologin users can run apps too.
+func resolveUser(pwf passwd.PasswdFile, grf passwd.GroupFile, user, group string) (*passwd.PasswdEntry, error) {
+	pwent := pwf.Find(user)
+	if pwent == nil {
+		return nil, errors.Errorf("Unknown user %#v", user)
+	}
+	if group != "" {
+		if pwent.Gid = grf.FindGid(group); pwent.Gid < 0 {
+			return nil, errors.Errorf("Unknown group %#v", group)
+		}
+	} else if pwent.Gid < 0 {
+		return nil, errors.Errorf("User %#v has no passwd entry, group needs to be specified", user)
+	}
+	return pwent, nil
+}
+
+// Returns groups of the app's process: primary gid, followed by
+// manifest's supplementaryGIDs if there are any. Otherwise, followed
+// by groups that list the user as a member in the image's /etc/group,
+// as initgroups(3) would do.
+func processGroups(gid int, username string, manifestGIDs []int, grf passwd.GroupFile) []int {
+	extra := manifestGIDs
+	if len(extra) == 0 {
+		extra = grf.MemberGids(username)
+	}
+	gids := []int{gid}
+	for _, g := range extra {
+		if g != gid {
+			gids = append(gids, g)
+		}
+	}
+	return gids
 }
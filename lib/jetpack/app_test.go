@@ -0,0 +1,166 @@
+package jetpack
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/passwd"
+)
+
+func TestAppUmask(t *testing.T) {
+	pod := newPod(nil, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name}}
+
+	check := func(expected string) {
+		if umask, err := pod.appUmask(name); err != nil {
+			t.Error(err)
+		} else if umask != expected {
+			t.Errorf("Got %#v, expected %#v", umask, expected)
+		}
+	}
+
+	check("0022")
+	pod.Manifest.Annotations.Set("jetpack/umask", "077")
+	check("0077")
+	pod.Manifest.Apps[0].Annotations.Set("jetpack/umask", "0002")
+	check("0002")
+
+	for _, str := range []string{"", "22a", "0888", "01000", "-1", "u=rwx"} {
+		pod.Manifest.Apps[0].Annotations.Set("jetpack/umask", str)
+		if umask, err := pod.appUmask(name); err == nil {
+			t.Errorf("%#v: expected error, got %#v", str, umask)
+		}
+	}
+	if err := pod.checkAppOptions(); err == nil {
+		t.Error("Invalid umask passed validation")
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	grf := passwd.GroupFile{
+		{Name: "wheel", Gid: 0, Members: []string{"root"}},
+		{Name: "www", Gid: 80, Members: []string{"app", "nginx"}},
+		{Name: "app", Gid: 1001},
+		{Name: "dialer", Gid: 68, Members: []string{"app"}},
+	}
+	for _, tc := range []struct {
+		username     string
+		manifestGIDs []int
+		expected     []int
+	}{
+		// Manifest's supplementaryGIDs win
+		{"app", []int{80, 5}, []int{1001, 80, 5}},
+		// Without them, user's memberships in /etc/group are used
+		{"app", nil, []int{1001, 80, 68}},
+		{"app", []int{}, []int{1001, 80, 68}},
+		// User with no memberships gets only the primary group
+		{"nobody", nil, []int{1001}},
+		// Primary group is not repeated
+		{"app", []int{1001, 80}, []int{1001, 80}},
+	} {
+		if gids := processGroups(1001, tc.username, tc.manifestGIDs, grf); !reflect.DeepEqual(gids, tc.expected) {
+			t.Errorf("%v %v: got %v, expected %v", tc.username, tc.manifestGIDs, gids, tc.expected)
+		}
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	pwf := passwd.PasswdFile{
+		{Username: "root", Uid: 0, Gid: 0, Home: "/root", Shell: "/bin/csh"},
+		{Username: "www", Uid: 80, Gid: 80, Home: "/nonexistent", Shell: "/usr/sbin/nologin"},
+	}
+	grf := passwd.GroupFile{
+		{Name: "wheel", Gid: 0},
+		{Name: "www", Gid: 80},
+		{Name: "staff", Gid: 20},
+	}
+	for _, tc := range []struct {
+		user, group string
+		uid, gid    int
+	}{
+		{"", "", 0, 0},
+		{"root", "", 0, 0},
+		{"www", "", 80, 80},
+		{"80", "", 80, 80},
+		{"www", "staff", 80, 20},
+		{"www", "20", 80, 20},
+		// Numeric IDs don't need an entry
+		{"1234", "4321", 1234, 4321},
+		{"www", "4321", 80, 4321},
+	} {
+		if pwent, err := resolveUser(pwf, grf, tc.user, tc.group); err != nil {
+			t.Errorf("%#v:%#v: %v", tc.user, tc.group, err)
+		} else if pwent.Uid != tc.uid || pwent.Gid != tc.gid {
+			t.Errorf("%#v:%#v: got %d:%d, expected %d:%d", tc.user, tc.group, pwent.Uid, pwent.Gid, tc.uid, tc.gid)
+		}
+	}
+
+	for _, tc := range [][2]string{
+		{"nobody", ""},
+		{"www", "nogroup"},
+		{"-1", "0"},
+		{"www", "-1"},
+		// Unknown numeric user has no primary group
+		{"1234", ""},
+	} {
+		if pwent, err := resolveUser(pwf, grf, tc[0], tc[1]); err == nil {
+			t.Errorf("%#v:%#v: expected error, got %v", tc[0], tc[1], pwent)
+		}
+	}
+}
+
+func TestUserEnv(t *testing.T) {
+	pwent := &passwd.PasswdEntry{Username: "www", Uid: 80, Gid: 80, Home: "/nonexistent", Shell: "/usr/sbin/nologin"}
+	env := userEnv([]string{"FOO=bar", "HOME=/srv/www"}, pwent)
+	expected := []string{"FOO=bar", "HOME=/srv/www", "SHELL=/usr/sbin/nologin", "USER=www", "LOGNAME=www"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Got %v, expected %v", env, expected)
+	}
+
+	// User without passwd entry has no name
+	env = userEnv(nil, &passwd.PasswdEntry{Uid: 1234, Gid: 1234, Home: "/", Shell: "/bin/sh"})
+	expected = []string{"HOME=/", "SHELL=/bin/sh"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Got %v, expected %v", env, expected)
+	}
+}
+
+func TestCallerTerm(t *testing.T) {
+	defer os.Setenv("TERM", os.Getenv("TERM"))
+	os.Setenv("TERM", "xterm-256color")
+	if term := callerTerm(); term != "xterm-256color" {
+		t.Errorf("Got %#v", term)
+	}
+	os.Unsetenv("TERM")
+	if term := callerTerm(); term != "vt100" {
+		t.Errorf("Got %#v, expected vt100 default", term)
+	}
+}
+
+func TestAppCommand(t *testing.T) {
+	pod := newPod(nil, nil)
+	name := *types.MustACName("data")
+	pod.Manifest.Apps = schema.AppList{{Name: name, Image: schema.RuntimeImage{Name: types.MustACIdentifier("example.com/data")}}}
+	app := &App{Name: name, Pod: pod, app: &types.App{User: "0", Group: "0"}}
+
+	if exec, err := app.command(nil); errors.Cause(err) != ErrNoCommand {
+		t.Errorf("Expected ErrNoCommand, got %v, %v", exec, err)
+	} else if !strings.Contains(err.Error(), "example.com/data") {
+		t.Errorf("Error doesn't name the image: %v", err)
+	}
+	opts := &RunOptions{ExecMode: ExecReplace, Exec: []string{"/bin/ls"}}
+	if exec, err := app.command(opts); err != nil || !reflect.DeepEqual(exec, opts.Exec) {
+		t.Errorf("Got %v, %v", exec, err)
+	}
+	opts = &RunOptions{ExecMode: ExecAppend, Exec: []string{"-l"}}
+	if exec, err := app.command(opts); errors.Cause(err) != ErrNoCommand {
+		t.Errorf("Appended arguments without command: got %v, %v", exec, err)
+	}
+}
@@ -0,0 +1,346 @@
+package jetpack
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/mattrobenolt/size"
+)
+
+// Apps' stdout and stderr are copied to `logs/APP.out` and
+// `logs/APP.err` files in the pod's directory, unless the pod has
+// `jetpack/log-capture` annotation set to "false". Lines can be
+// prefixed with a timestamp (`jetpack/log-timestamps` annotation or
+// log.timestamps property).
+//
+// Log files are rotated when they grow over log.max-size, or get
+// older than log.max-age: the file is renamed to a sibling with
+// rotation's timestamp appended, and a new one is opened. Only
+// log.keep rotated files are kept; with log.compress, all but the
+// newest one are gzipped. Pods can override these with
+// `jetpack/log-max-size`, `jetpack/log-max-age`, `jetpack/log-keep`,
+// and `jetpack/log-compress` annotations.
+
+// Suffix of rotated log files; sorts in rotation order
+const logRotatedFormat = "20060102T150405.000000Z"
+
+type logRotation struct {
+	MaxSize  int64         // 0 for no size limit
+	MaxAge   time.Duration // 0 for no age limit
+	Keep     int
+	Compress bool
+}
+
+// Append-only log file of an app's output stream
+type appLog struct {
+	path       string
+	file       *os.File
+	timestamps bool
+	midLine    bool
+	mx         sync.Mutex
+
+	rotation *logRotation
+	size     int64
+	started  time.Time // of the current file
+	log      Logger    // rotation failures are reported here
+}
+
+func openAppLog(path string, timestamps bool) (*appLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	al := &appLog{path: path, file: f, timestamps: timestamps, started: time.Now()}
+	if fi, err := f.Stat(); err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	} else {
+		al.size = fi.Size()
+	}
+	// Current file was started at the last rotation
+	if rotated, err := rotatedLogs(path); err == nil && len(rotated) > 0 {
+		if ts, ok := rotatedLogTime(path, rotated[len(rotated)-1]); ok {
+			al.started = ts
+		}
+	}
+	return al, nil
+}
+
+// Writes p, rotating the log first if it's due. Log is rotated only
+// between lines, so that lines are never split between files.
+func (al *appLog) Write(p []byte) (int, error) {
+	al.mx.Lock()
+	defer al.mx.Unlock()
+
+	buf := make([]byte, 0, len(p)+32)
+	for _, c := range p {
+		if !al.midLine {
+			if al.rotationDue() {
+				if err := al.write(buf); err != nil {
+					return 0, err
+				}
+				buf = buf[:0]
+				if err := al.rotate(); err != nil {
+					// Keep writing to the current file
+					al.rotation = nil
+					if al.log != nil {
+						al.log.Warnf("cannot rotate %v: %v", al.path, err)
+					}
+				}
+			}
+			if al.timestamps {
+				buf = append(buf, time.Now().Format(time.RFC3339)+" "...)
+			}
+			al.midLine = true
+		}
+		buf = append(buf, c)
+		if c == '\n' {
+			al.midLine = false
+		}
+	}
+	if err := al.write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (al *appLog) write(buf []byte) error {
+	n, err := al.file.Write(buf)
+	al.size += int64(n)
+	return err
+}
+
+func (al *appLog) rotationDue() bool {
+	if al.rotation == nil || al.size == 0 {
+		return false
+	}
+	return (al.rotation.MaxSize > 0 && al.size >= al.rotation.MaxSize) ||
+		(al.rotation.MaxAge > 0 && time.Since(al.started) >= al.rotation.MaxAge)
+}
+
+func (al *appLog) rotate() error {
+	now := time.Now()
+	if err := os.Rename(al.path, al.path+"."+now.UTC().Format(logRotatedFormat)); err != nil {
+		return errors.Trace(err)
+	}
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	al.file.Close()
+	al.file, al.size, al.started = f, 0, now
+	return errors.Trace(al.rotation.prune(al.path))
+}
+
+func (al *appLog) Close() error {
+	return al.file.Close()
+}
+
+// Removes rotated files over the limit, and compresses all but the
+// newest one if requested.
+func (rot *logRotation) prune(path string) error {
+	rotated, err := rotatedLogs(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for len(rotated) > rot.Keep {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		rotated = rotated[1:]
+	}
+	if rot.Compress {
+		for i, rpath := range rotated {
+			if i < len(rotated)-1 && !strings.HasSuffix(rpath, ".gz") {
+				if err := gzipFile(rpath); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns rotated files of the log at path, oldest first.
+func rotatedLogs(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var rotated []string
+	for _, match := range matches {
+		if _, ok := rotatedLogTime(path, match); ok {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Returns rotation time of rotated file of the log at path.
+func rotatedLogTime(path, rotated string) (time.Time, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(rotated, path+"."), ".gz")
+	ts, err := time.Parse(logRotatedFormat, suffix)
+	return ts, err == nil
+}
+
+// Compresses file at path to path.gz, keeping its modification time,
+// and removes the original.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Remove(path))
+}
+
+// Parses log size: bytes, or a number with K, M, G suffix; "off" for
+// no limit.
+func parseLogSize(str string) (int64, error) {
+	switch str {
+	case "", "off", "0":
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil && n > 0 {
+		return n, nil
+	}
+	if c, err := size.ParseCapacity(strings.ToUpper(str)); err != nil {
+		return 0, errors.Errorf("Invalid log size %#v", str)
+	} else {
+		return int64(c.Bytes()), nil
+	}
+}
+
+// Returns value of pod's `jetpack/log-NAME` annotation, which
+// overrides host's log.NAME setting.
+func (pod *Pod) logOption(name string) (string, bool) {
+	return pod.Manifest.Annotations.Get("jetpack/log-" + name)
+}
+
+// Returns rotation settings of the pod's logs, or nil if they're
+// never rotated.
+func (pod *Pod) logRotation() (*logRotation, error) {
+	ls := pod.Host.settings().Logging
+	rot := &logRotation{MaxSize: ls.MaxSize, MaxAge: ls.MaxAge, Keep: ls.Keep, Compress: ls.Compress}
+	if v, ok := pod.logOption("compress"); ok {
+		rot.Compress = v == "true"
+	}
+	var err error
+	if v, ok := pod.logOption("max-size"); ok {
+		if rot.MaxSize, err = parseLogSize(v); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if age, ok := pod.logOption("max-age"); ok {
+		rot.MaxAge = 0
+		if age != "off" && age != "" {
+			if rot.MaxAge, err = time.ParseDuration(age); err != nil || rot.MaxAge < 0 {
+				return nil, errors.Errorf("Invalid log max age %#v", age)
+			}
+		}
+	}
+	if keep, ok := pod.logOption("keep"); ok {
+		if rot.Keep, err = strconv.Atoi(keep); err != nil || rot.Keep < 0 {
+			return nil, errors.Errorf("Invalid number of rotated logs to keep %#v", keep)
+		}
+	}
+	if rot.MaxSize == 0 && rot.MaxAge == 0 {
+		return nil, nil
+	}
+	return rot, nil
+}
+
+// Returns path of the app's log file for stream ("out" or "err").
+func (app *App) LogPath(stream string) string {
+	return app.Pod.Path("logs", app.Name.String()+"."+stream)
+}
+
+// Returns true if app's output is captured to log files.
+func (app *App) LogCaptured() bool {
+	capture, _ := app.Pod.Manifest.Annotations.Get("jetpack/log-capture")
+	return capture != "false"
+}
+
+func (app *App) logTimestamps() bool {
+	if ts, ok := app.Pod.Manifest.Annotations.Get("jetpack/log-timestamps"); ok {
+		return ts == "true"
+	}
+	return app.Pod.Host.settings().Logging.Timestamps
+}
+
+// Returns writers copying stdout and stderr to the app's log files,
+// and a function closing the logs.
+func (app *App) captureOutput(stdout, stderr io.Writer) (io.Writer, io.Writer, func(), error) {
+	if !app.LogCaptured() {
+		return stdout, stderr, func() {}, nil
+	}
+	rot, err := app.Pod.logRotation()
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	outLog, err := openAppLog(app.LogPath("out"), app.logTimestamps())
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	errLog, err := openAppLog(app.LogPath("err"), app.logTimestamps())
+	if err != nil {
+		outLog.Close()
+		return nil, nil, nil, errors.Trace(err)
+	}
+	outLog.rotation, outLog.log = rot, app.log()
+	errLog.rotation, errLog.log = rot, app.log()
+	closeLogs := func() {
+		outLog.Close()
+		errLog.Close()
+	}
+	return teeWriter(stdout, outLog), teeWriter(stderr, errLog), closeLogs, nil
+}
+
+func teeWriter(w io.Writer, log io.Writer) io.Writer {
+	if w == nil {
+		return log
+	}
+	return io.MultiWriter(w, log)
+}
@@ -0,0 +1,123 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestAppLogTimestamps(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "logs", "app.out")
+	al, err := openAppLog(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines split between writes get a single timestamp
+	for _, chunk := range []string{"first ", "line\nsecond line\n", "third"} {
+		if n, err := al.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		} else if n != len(chunk) {
+			t.Errorf("Wrote %d bytes of %d", n, len(chunk))
+		}
+	}
+	al.Close()
+
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\S* `
+	if !regexp.MustCompile(`^` + ts + `first line\n` + ts + `second line\n` + ts + `third$`).Match(bb) {
+		t.Errorf("Unexpected log contents: %#v", string(bb))
+	}
+
+	// Reopened log is appended to
+	if al, err = openAppLog(path, false); err != nil {
+		t.Fatal(err)
+	}
+	al.Write([]byte("\nmore\n"))
+	al.Close()
+	if bb2, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(bb2) != string(bb)+"\nmore\n" {
+		t.Errorf("Unexpected log contents: %#v", string(bb2))
+	}
+}
+
+func TestAppLogRotation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name, App: &types.App{User: "0", Group: "0"}}}
+	path := pod.App(name).LogPath("out")
+
+	al, err := openAppLog(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.rotation = &logRotation{MaxSize: 10, Keep: 2, Compress: true}
+	// Partial line isn't split by rotation
+	for _, chunk := range []string{"line one\n", "line", " two\n", "line three\n", "line four\n"} {
+		al.Write([]byte(chunk))
+	}
+	al.Close()
+
+	rotated, err := rotatedLogs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 || !strings.HasSuffix(rotated[0], ".gz") || strings.HasSuffix(rotated[1], ".gz") {
+		t.Errorf("Unexpected rotated logs: %v", rotated)
+	}
+	if bb, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(bb) != "line four\n" {
+		t.Errorf("Unexpected current log: %#v", string(bb))
+	}
+
+	// Rotated logs are read too
+	if rd, err := pod.Logs(name, nil); err != nil {
+		t.Error(err)
+	} else if bb, err := ioutil.ReadAll(rd); err != nil {
+		t.Error(err)
+	} else if string(bb) != "line one\nline two\nline three\nline four\n" {
+		t.Errorf("Unexpected logs: %#v", string(bb))
+	}
+}
+
+func TestParseLogSize(t *testing.T) {
+	for str, expected := range map[string]int64{
+		"off":  0,
+		"1000": 1000,
+		"10m":  10 << 20,
+		"1G":   1 << 30,
+	} {
+		if actual, err := parseLogSize(str); err != nil {
+			t.Errorf("%#v: %v", str, err)
+		} else if actual != expected {
+			t.Errorf("%#v: expected %d, got %d", str, expected, actual)
+		}
+	}
+	if _, err := parseLogSize("lots"); err == nil {
+		t.Error("Expected error for invalid size")
+	}
+}
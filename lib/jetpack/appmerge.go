@@ -0,0 +1,92 @@
+package jetpack
+
+import (
+	"github.com/appc/spec/schema/types"
+)
+
+// Merges runtime app's App with its image's App, as the appc spec
+// says: fields set in the runtime app override the image's ones,
+// unset fields are inherited. Environment variables, event handlers,
+// mount points, ports, and isolators are merged by name. Absent (nil)
+// exec is inherited; present but empty exec overrides the image's
+// one.
+func mergeApps(imgApp, rtApp *types.App) *types.App {
+	if rtApp == nil {
+		return imgApp
+	}
+	if imgApp == nil {
+		return rtApp
+	}
+
+	app := *imgApp
+	if rtApp.Exec != nil {
+		app.Exec = rtApp.Exec
+	}
+	if rtApp.User != "" {
+		app.User = rtApp.User
+	}
+	if rtApp.Group != "" {
+		app.Group = rtApp.Group
+	}
+	if rtApp.SupplementaryGIDs != nil {
+		app.SupplementaryGIDs = rtApp.SupplementaryGIDs
+	}
+	if rtApp.WorkingDirectory != "" {
+		app.WorkingDirectory = rtApp.WorkingDirectory
+	}
+
+	app.Environment = append(types.Environment(nil), imgApp.Environment...)
+	for _, ev := range rtApp.Environment {
+		app.Environment.Set(ev.Name, ev.Value)
+	}
+
+	app.EventHandlers = append([]types.EventHandler(nil), imgApp.EventHandlers...)
+eventHandlers:
+	for _, eh := range rtApp.EventHandlers {
+		for i := range app.EventHandlers {
+			if app.EventHandlers[i].Name == eh.Name {
+				app.EventHandlers[i] = eh
+				continue eventHandlers
+			}
+		}
+		app.EventHandlers = append(app.EventHandlers, eh)
+	}
+
+	app.MountPoints = append([]types.MountPoint(nil), imgApp.MountPoints...)
+mountPoints:
+	for _, mp := range rtApp.MountPoints {
+		for i := range app.MountPoints {
+			if app.MountPoints[i].Name == mp.Name {
+				app.MountPoints[i] = mp
+				continue mountPoints
+			}
+		}
+		app.MountPoints = append(app.MountPoints, mp)
+	}
+
+	app.Ports = append([]types.Port(nil), imgApp.Ports...)
+ports:
+	for _, port := range rtApp.Ports {
+		for i := range app.Ports {
+			if app.Ports[i].Name == port.Name {
+				app.Ports[i] = port
+				continue ports
+			}
+		}
+		app.Ports = append(app.Ports, port)
+	}
+
+	app.Isolators = append(types.Isolators(nil), imgApp.Isolators...)
+isolators:
+	for _, iso := range rtApp.Isolators {
+		for i := range app.Isolators {
+			if app.Isolators[i].Name == iso.Name {
+				app.Isolators[i] = iso
+				continue isolators
+			}
+		}
+		app.Isolators = append(app.Isolators, iso)
+	}
+
+	return &app
+}
@@ -0,0 +1,69 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestMergeApps(t *testing.T) {
+	imgApp := &types.App{
+		Exec:             types.Exec{"/usr/local/bin/server", "-v"},
+		User:             "www",
+		Group:            "www",
+		WorkingDirectory: "/srv",
+		Environment: types.Environment{
+			{Name: "LANG", Value: "C"},
+			{Name: "MODE", Value: "production"},
+		},
+		MountPoints: []types.MountPoint{
+			{Name: *types.MustACName("data"), Path: "/srv/data"},
+		},
+	}
+
+	if app := mergeApps(imgApp, nil); app != imgApp {
+		t.Errorf("No runtime app: got %v", app)
+	}
+	rtApp := &types.App{User: "root"}
+	if app := mergeApps(nil, rtApp); app != rtApp {
+		t.Errorf("No image app: got %v", app)
+	}
+
+	app := mergeApps(imgApp, &types.App{
+		Environment: types.Environment{
+			{Name: "MODE", Value: "staging"},
+			{Name: "DEBUG", Value: "1"},
+		},
+		MountPoints: []types.MountPoint{
+			{Name: *types.MustACName("data"), Path: "/data", ReadOnly: true},
+			{Name: *types.MustACName("logs"), Path: "/var/log/server"},
+		},
+	})
+	if !reflect.DeepEqual(app.Exec, imgApp.Exec) || app.User != "www" || app.Group != "www" || app.WorkingDirectory != "/srv" {
+		t.Errorf("Image fields not inherited: %#v", app)
+	}
+	expectedEnv := types.Environment{
+		{Name: "LANG", Value: "C"},
+		{Name: "MODE", Value: "staging"},
+		{Name: "DEBUG", Value: "1"},
+	}
+	if !reflect.DeepEqual(app.Environment, expectedEnv) {
+		t.Errorf("Got environment %v, expected %v", app.Environment, expectedEnv)
+	}
+	if len(app.MountPoints) != 2 || app.MountPoints[0].Path != "/data" || !app.MountPoints[0].ReadOnly || app.MountPoints[1].Path != "/var/log/server" {
+		t.Errorf("Unexpected mount points: %v", app.MountPoints)
+	}
+	// Image's app is not modified
+	if imgApp.Environment[1].Value != "production" || imgApp.MountPoints[0].Path != "/srv/data" {
+		t.Errorf("Image app modified: %#v", imgApp)
+	}
+
+	// Present but empty exec overrides image's one
+	if app := mergeApps(imgApp, &types.App{Exec: types.Exec{}}); len(app.Exec) != 0 {
+		t.Errorf("Empty exec not overridden: %v", app.Exec)
+	}
+	if app := mergeApps(imgApp, &types.App{Exec: types.Exec{"/bin/sh"}, User: "root", Group: "wheel"}); !reflect.DeepEqual(app.Exec, types.Exec{"/bin/sh"}) || app.User != "root" || app.Group != "wheel" {
+		t.Errorf("Runtime fields not used: %#v", app)
+	}
+}
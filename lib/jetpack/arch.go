@@ -0,0 +1,116 @@
+package jetpack
+
+import (
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// appc arch label values that FreeBSD calls differently
+var archAliases = map[string]string{
+	"aarch64": "arm64",
+	"armv6l":  "armv6",
+	"armv7l":  "armv7",
+	"x86_64":  "amd64",
+}
+
+// Returns image's os/arch labels, "?" for missing ones.
+func (img *Image) OSArch() string {
+	return osArch(img.Manifest.Labels)
+}
+
+func osArch(labels types.Labels) string {
+	lm := labels.ToMap()
+	os_, ok := lm["os"]
+	if !ok {
+		os_ = "?"
+	}
+	arch, ok := lm["arch"]
+	if !ok {
+		arch = "?"
+	}
+	return os_ + "/" + arch
+}
+
+// Returns architectures the host kernel can execute
+// (kern.supported_archs sysctl; amd64 kernel with COMPAT_FREEBSD32
+// supports i386 too).
+func HostArchs() ([]string, error) {
+	if archs, err := systemCommand("sysctl", "-n", "kern.supported_archs").Quiet().OutputString(); err == nil {
+		return strings.Fields(archs), nil
+	}
+	// Older kernels: native architecture only
+	arch, err := systemCommand("sysctl", "-n", "hw.machine_arch").OutputString()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return strings.Fields(arch), nil
+}
+
+// Returns operating systems whose binaries host can execute: FreeBSD,
+// and Linux if Linux ABI module is loaded (or will be autoloaded).
+func HostOSes() []string {
+	oses := []string{"freebsd"}
+	if Config().GetBool("linux.autoload", false) {
+		return append(oses, "linux")
+	}
+	if systemCommand("kldstat", "-q", "-m", linuxModules()[0][1]).Quiet().Run() == nil {
+		oses = append(oses, "linux")
+	}
+	return oses
+}
+
+// Verifies that host can execute image's binaries. Missing os or arch
+// label is not checked.
+func checkImagePlatform(img *Image, hostOSes, hostArchs []string) error {
+	if os_, ok := img.Manifest.GetLabel("os"); ok && !stringIn(os_, hostOSes) {
+		return errors.Errorf("Image %v %v (%v) can't run on this host (supported systems: %v)",
+			img.Manifest.Name, img.Hash, img.OSArch(), strings.Join(hostOSes, ", "))
+	}
+	if arch, ok := img.Manifest.GetLabel("arch"); ok {
+		if alias, ok := archAliases[arch]; ok {
+			arch = alias
+		}
+		if !stringIn(arch, hostArchs) {
+			return errors.Errorf("Image %v %v (%v) can't run on this host (supported architectures: %v)",
+				img.Manifest.Name, img.Hash, img.OSArch(), strings.Join(hostArchs, ", "))
+		}
+	}
+	return nil
+}
+
+func stringIn(str string, strs []string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies that host can execute the image.
+func (img *Image) checkPlatform() error {
+	hostArchs, err := HostArchs()
+	if err != nil {
+		return errors.Annotate(err, "Cannot get host's architectures")
+	}
+	return checkImagePlatform(img, HostOSes(), hostArchs)
+}
+
+// Verifies platforms of all the pod's images.
+func (pod *Pod) checkPlatform() error {
+	hostArchs, err := HostArchs()
+	if err != nil {
+		return errors.Annotate(err, "Cannot get host's architectures")
+	}
+	hostOSes := HostOSes()
+	for _, rtApp := range pod.Manifest.Apps {
+		if img, err := pod.Host.getRuntimeImage(rtApp.Image); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		} else if err := checkImagePlatform(img, hostOSes, hostArchs); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package jetpack
+
+import (
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestCheckImagePlatform(t *testing.T) {
+	img := &Image{}
+	img.Manifest.Name = *types.MustACIdentifier("example.com/app")
+	amd64 := []string{"amd64", "i386"}
+	for arch, ok := range map[string]bool{
+		"":        true,
+		"amd64":   true,
+		"x86_64":  true,
+		"i386":    true,
+		"arm64":   false,
+		"aarch64": false,
+	} {
+		img.Manifest.Labels = nil
+		if arch != "" {
+			img.Manifest.Labels = types.Labels{{Name: "os", Value: "freebsd"}, {Name: "arch", Value: arch}}
+		}
+		if err := checkImagePlatform(img, []string{"freebsd"}, amd64); (err == nil) != ok {
+			t.Errorf("arch %#v: expected ok=%v, got %v", arch, ok, err)
+		}
+	}
+
+	img.Manifest.Labels = types.Labels{{Name: "os", Value: "freebsd"}, {Name: "arch", Value: "i386"}}
+	if err := checkImagePlatform(img, []string{"freebsd"}, []string{"amd64"}); err == nil {
+		t.Error("i386 image allowed on a kernel without 32-bit support")
+	}
+
+	img.Manifest.Labels = types.Labels{{Name: "os", Value: "linux"}, {Name: "arch", Value: "amd64"}}
+	if err := checkImagePlatform(img, []string{"freebsd"}, amd64); err == nil {
+		t.Error("Linux image allowed without Linux ABI")
+	}
+	if err := checkImagePlatform(img, []string{"freebsd", "linux"}, amd64); err != nil {
+		t.Error(err)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
 
 	"github.com/3ofcoins/jetpack/lib/run"
 	"github.com/3ofcoins/jetpack/lib/ui"
@@ -33,10 +34,10 @@ func (img *Image) writeACI(w io.Writer, packlist *os.File) (*types.Hash, error)
 
 	tarArgs := []string{"-C", img.Path(), "-c", "--null", "-f", "-"}
 	if packlist != nil {
-		img.ui.Debug("Writing an incremental ACI")
+		img.log().Debugf("Writing an incremental ACI")
 		tarArgs = append(tarArgs, "-n", "-T", "-")
 	} else {
-		img.ui.Debug("Writing a flat ACI")
+		img.log().Debugf("Writing a flat ACI")
 
 		// no packlist -> flat ACI
 		manifest := img.Manifest
@@ -64,7 +65,7 @@ func (img *Image) writeACI(w io.Writer, packlist *os.File) (*types.Hash, error)
 		tarArgs = append(tarArgs, "-s", "/^"+manifestN+"$/manifest/", manifestN, "rootfs")
 	}
 
-	tar := run.Command("tar", tarArgs...).ReadFrom(packlist)
+	tar := run.Command("tar", tarArgs...).ReadFrom(packlist).Stream()
 	if tarPipe, err := tar.StdoutPipe(); err != nil {
 		return nil, errors.Trace(err)
 	} else {
@@ -75,20 +76,22 @@ func (img *Image) writeACI(w io.Writer, packlist *os.File) (*types.Hash, error)
 	faucet = io.TeeReader(faucet, hash)
 
 	var compressor *run.Cmd = nil
-	if compression := Config().GetString("images.aci.compression", "no"); compression != "none" {
+	if compression := img.Host.settings().Images.Compression; compression != "none" {
 		switch compression {
 		case "xz":
 			compressor = run.Command("xz", "-z", "-c")
 		case "bzip2":
 			compressor = run.Command("bzip2", "-z", "-c")
+		case "zstd":
+			compressor = run.Command("zstd", "-q", "-c")
 		case "gz":
 		case "gzip":
 			compressor = run.Command("gzip", "-c")
 		default:
-			return nil, errors.Errorf("Invalid setting images.aci.compression=%#v (allowed values: xz, bzip2, gzip, none)", compression)
+			return nil, errors.Errorf("Invalid setting images.aci.compression=%#v (allowed values: xz, bzip2, gzip, zstd, none)", compression)
 		}
 
-		compressor.Cmd.Stdout = sink
+		compressor.Stream().WriteTo(sink)
 		if cin, err := compressor.StdinPipe(); err != nil {
 			return nil, errors.Trace(err)
 		} else {
@@ -130,7 +133,7 @@ func (img *Image) writeACI(w io.Writer, packlist *os.File) (*types.Hash, error)
 		// CAN'T HAPPEN, srsly
 		return nil, errors.Trace(err)
 	} else {
-		img.ui.Debug("Saved", hash)
+		img.log().Debugf("Saved %v", hash)
 		return hash, nil
 	}
 }
@@ -169,19 +172,23 @@ func (img *Image) buildPodManifest(exec []string) *schema.PodManifest {
 	bpm.Annotations.Set("jetpack/jail.conf/allow.chflags", "true")
 	bpm.Annotations.Set("jetpack/jail.conf/securelevel", "0")
 
+	// Build pod's rootfs becomes an image
+	bpm.Annotations.Set(storageClassAnnotation, DefaultStorageClass)
+
 	return bpm
 }
 
 func (img *Image) Build(buildDir string, addFiles []string, buildExec []string) (*Image, error) {
 	img.ui.Println("Preparing build pod")
 	abuilddir, _ := filepath.Abs(buildDir)
-	img.ui.Debug("Build dir:", abuilddir)
-	img.ui.Debug("Extra files:", run.ShellEscape(addFiles...))
-	img.ui.Debug("Build command:", run.ShellEscape(buildExec...))
-	buildPod, err := img.Host.CreatePod(img.buildPodManifest(buildExec))
+	img.log().Debugf("Build dir: %v", abuilddir)
+	img.log().Debugf("Extra files: %v", run.ShellEscape(addFiles...))
+	img.log().Debugf("Build command: %v", run.ShellEscape(buildExec...))
+	buildPod, err := img.Host.CreatePod(img.buildPodManifest(buildExec), nil)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	defer img.destroyBuildPod(buildPod)
 
 	ui := ui.NewUI("cyan", "build", buildPod.UUID.String())
 
@@ -198,41 +205,75 @@ func (img *Image) Build(buildDir string, addFiles []string, buildExec []string)
 		return nil, errors.Trace(err)
 	}
 
-	if buildDir[len(buildDir)-1] != '/' {
-		buildDir += "/"
+	// Build dir's contents, and extra files, go into the work dir
+	bd, err := os.Open(buildDir)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-
-	cpArgs := []string{"-R", buildDir}
-	if addFiles != nil {
-		cpArgs = append(cpArgs, addFiles...)
+	names, err := bd.Readdirnames(-1)
+	bd.Close()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(names)
+	sources := make([]string, 0, len(names)+len(addFiles))
+	for _, name := range names {
+		sources = append(sources, filepath.Join(buildDir, name))
+	}
+	for _, source := range append(sources, addFiles...) {
+		if err := copyIntoRootfs(ds.Path(), source, workDir); err != nil {
+			return nil, errors.Annotatef(err, "Copying %v", source)
+		}
 	}
-	cpArgs = append(cpArgs, fullWorkDir)
 
-	if err := run.Command("cp", cpArgs...).Run(); err != nil {
+	ui.Println("Running the build")
+	if es, err := buildPod.Apps()[0].Run(os.Stdin, os.Stdout, os.Stderr, nil); err != nil {
+		return nil, errors.Trace(err)
+	} else if err := es.Err(); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ui.Println("Running the build")
-	if err := buildPod.Apps()[0].Run(os.Stdin, os.Stdout, os.Stderr); err != nil {
+	ui.Debug("Reading new image manifest")
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(fullWorkDir, "manifest.json"))
+	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	var manifest schema.ImageManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Annotate(err, "Parsing new image manifest")
+	}
+
+	return img.pivotBuildPod(buildPod, &manifest, []types.Exec{buildExec})
+}
+
+// Destroys build pod, whether the build has succeeded or not. Pod's
+// rootfs is not destroyed if it has been pivoted into an image.
+func (img *Image) destroyBuildPod(buildPod *Pod) {
+	if err := buildPod.Destroy(); err != nil {
+		img.log().Warnf("Cannot destroy build pod %v: %v", buildPod.UUID, err)
+	}
+}
+
+// Turns rootfs of a finished build pod into a new image with manifest,
+// derived from img. Build steps and img's ID are recorded in the new
+// image's annotations.
+func (img *Image) pivotBuildPod(buildPod *Pod, manifest *schema.ImageManifest, steps []types.Exec) (_ *Image, rErr error) {
+	ui := ui.NewUI("cyan", "build", buildPod.UUID.String())
 
 	if err := buildPod.Kill(); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ui.Debug("Reading new image manifest")
-	manifestBytes, err := ioutil.ReadFile(filepath.Join(fullWorkDir, "manifest.json"))
+	ds, err := img.Host.Dataset.GetDataset(path.Join("pods", buildPod.UUID.String(), "rootfs.0"))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ui.Debug("Removing work dir")
-	if err := os.RemoveAll(fullWorkDir); err != nil {
+	ui.Debug("Removing work dir and runtime files")
+	if err := os.RemoveAll(ds.Path(buildPod.Manifest.Apps[0].App.WorkingDirectory)); err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	if err := os.Remove(ds.Path("etc/resolv.conf")); err != nil && !os.IsNotExist(err) {
+	if err := img.stripBuildResidue(ds.Mountpoint); err != nil {
 		return nil, errors.Trace(err)
 	}
 
@@ -248,26 +289,34 @@ func (img *Image) Build(buildDir string, addFiles []string, buildExec []string)
 	if err := ds.Rename(img.Host.Dataset.ChildName(path.Join("images", childImage.UUID.String()))); err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	// We don't need build pod anymore
-	if err := buildPod.Destroy(); err != nil {
-		return nil, errors.Trace(err)
-	}
-	buildPod = nil
+	childImage.rootfs = ds
+	defer func() {
+		if rErr != nil {
+			childImage.abortImport()
+		}
+	}()
 
 	// Construct the child image's manifest
 
 	ui.Debug("Constructing new image manifest")
 
-	if err := json.Unmarshal(manifestBytes, &childImage.Manifest); err != nil {
-		savePath := childImage.Path("manifest.err")
-		ioutil.WriteFile(savePath, manifestBytes, 0400)
-		return nil, errors.Annotatef(err, "Parsing new image manifest; tried to save at %v", savePath)
+	childImage.Manifest = *manifest
+	childImage.Provenance = &ImageProvenance{
+		Method: ProvenanceBuild,
+		User:   currentUser(),
+		Base:   img.Hash,
+		Steps:  steps,
 	}
 
 	if _, ok := childImage.Manifest.Annotations.Get("timestamp"); !ok {
 		childImage.Manifest.Annotations.Set("timestamp", time.Now().Format(time.RFC3339))
 	}
+	childImage.Manifest.Annotations.Set("jetpack/build-base", img.Hash.String())
+	if stepsJSON, err := json.Marshal(steps); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		childImage.Manifest.Annotations.Set("jetpack/build-steps", string(stepsJSON))
+	}
 
 	for _, label := range []types.ACIdentifier{"os", "arch"} {
 		if childValue, ok := childImage.Manifest.GetLabel(string(label)); !ok {
@@ -309,39 +358,22 @@ func (img *Image) Build(buildDir string, addFiles []string, buildExec []string)
 	defer packlist.Close()
 	io.WriteString(packlist, "manifest")
 
-	// To figure out whether a deleted file has been re-added (and
-	// should be kept in PathWhitelist after all), we keep changes in a
-	// map: a false value means there was an addition; true value means
-	// a deletion. False overwrites true, true never overwrites false.
-	deletionMap := make(map[string]bool)
-
-	if snap, err := ds.GetSnapshot("parent"); err != nil {
-		return nil, errors.Trace(err)
-	} else if diffs, err := snap.ZfsFields("diff"); err != nil {
+	// Changes since the base image: a false value means an addition or
+	// modification, true value means a deletion.
+	deletionMap, err := img.buildChanges(ds)
+	if err != nil {
 		return nil, errors.Trace(err)
-	} else {
-		for _, diff := range diffs {
-			path1 := diff[1][len(ds.Mountpoint):]
-			switch diff[0] {
-			case "+", "M":
-				io.WriteString(packlist, filepath.Join("\000rootfs", path1))
-				deletionMap[path1] = false
-			case "R":
-				path2 := diff[2][len(ds.Mountpoint):]
-				deletionMap[path2] = false
-				io.WriteString(packlist, filepath.Join("\000rootfs", path2))
-				fallthrough
-			case "-":
-				if _, ok := deletionMap[path1]; !ok {
-					// if found in map, either already true (no need to set
-					// again), or false (which should stay)
-					deletionMap[path1] = true
-				}
-			default:
-				return nil, errors.Errorf("Unknown `zfs diff` line: %v", diff)
-			}
+	}
+	added := make([]string, 0, len(deletionMap))
+	for path1, isDeletion := range deletionMap {
+		if !isDeletion {
+			added = append(added, path1)
 		}
 	}
+	sort.Strings(added)
+	for _, path1 := range added {
+		io.WriteString(packlist, filepath.Join("\000rootfs", path1))
+	}
 	packlist.Seek(0, os.SEEK_SET)
 
 	// Check if there were any deletions. If there weren't any, we don't
@@ -396,3 +428,65 @@ func (img *Image) Build(buildDir string, addFiles []string, buildExec []string)
 
 	return childImage, nil
 }
+
+// Replaces etc/resolv.conf in rootfs with contents, or removes it if
+// contents is nil, without following symlinks.
+func replaceResolvConf(rootfs string, contents []byte) error {
+	etc, name, err := openParentNoFollow(&podFSPath{path: "/etc/resolv.conf", hostPath: filepath.Join(rootfs, "etc", "resolv.conf"), base: rootfs})
+	if os.IsNotExist(errors.Cause(err)) && contents == nil {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	defer etc.Close()
+	if err := unix.Unlinkat(int(etc.Fd()), name, 0); err != nil && err != unix.ENOENT {
+		return errors.Trace(&os.PathError{Op: "unlink", Path: filepath.Join(etc.Name(), name), Err: err})
+	}
+	if contents == nil {
+		return nil
+	}
+	f, err := openAt(etc, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+// Removes files that a pod's runtime leaves in rootfs: resolv.conf
+// (unless img has its own, which is restored), and contents of /tmp.
+// Build steps can leave symlinks anywhere, so rootfs's files are
+// opened without following them.
+func (img *Image) stripBuildResidue(rootfs string) error {
+	var contents []byte
+	if f, err := openNoFollow(img.getRootfs().Path(), "/etc/resolv.conf", unix.O_RDONLY, 0); err == nil {
+		contents, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Trace(err)
+	}
+	if err := replaceResolvConf(rootfs, contents); err != nil {
+		return errors.Trace(err)
+	}
+
+	tmp := filepath.Join(rootfs, "tmp")
+	if fi, err := os.Lstat(tmp); err != nil || !fi.IsDir() {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, fi := range entries {
+		if err := os.RemoveAll(filepath.Join(tmp, fi.Name())); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package jetpack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Build cache: after each successful step of a build spec, the build
+// pod's rootfs is snapshotted as `@build-KEY`. The first key is a
+// digest of the base image's ID and of the files copied in; each
+// step's key is a digest of the previous key and the step's command
+// (or the script's text). The snapshots stay with the rootfs: in the
+// built image, or, if the build fails, in a dataset under build-cache.
+// Next build clones its rootfs from the snapshot of the last step that
+// has a match, and runs only the following steps. Changes since the
+// base image, which the image's incremental ACI needs, are then traced
+// through the snapshot's dataset and its origins.
+
+const (
+	buildSnapshotPrefix = "build-"
+	buildUsedProperty   = "jetpack:build-used" // UNIX time of last hit
+)
+
+// Returns cache key of what comes after parent.
+func buildCacheKey(parent string, elems ...string) string {
+	digest := sha256.New()
+	io.WriteString(digest, parent)
+	json.NewEncoder(digest).Encode(elems)
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// Returns digest of files' destination paths, and of names, modes,
+// link targets, and contents of everything under their sources.
+func digestBuildFiles(files []BuildFile) (string, error) {
+	digest := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(digest, "%v\x00", file.Path)
+		if fi, err := os.Stat(file.Source); err != nil {
+			return "", errors.Trace(err)
+		} else if !fi.IsDir() {
+			if err := digestFile(digest, file.Source, "", fi); err != nil {
+				return "", errors.Trace(err)
+			}
+			continue
+		}
+		err := filepath.Walk(file.Source, func(fpath string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(file.Source, fpath)
+			if err != nil {
+				return err
+			}
+			return digestFile(digest, fpath, rel, fi)
+		})
+		if err != nil {
+			return "", errors.Annotatef(err, "Build file %v", file.Source)
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func digestFile(w io.Writer, fpath, name string, fi os.FileInfo) error {
+	fmt.Fprintf(w, "%v\x00%o\x00", name, fi.Mode())
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(fpath)
+		if err != nil {
+			return err
+		}
+		io.WriteString(w, target)
+	case fi.Mode().IsRegular():
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(w, "%d\x00", fi.Size())
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// Returns number of leading keys that have a cached snapshot, and the
+// snapshot of the last of them. Snapshots of running builds' pods are
+// not used.
+func (h *Host) findBuildSnapshot(keys []string) (int, *zfs.Dataset, error) {
+	names, err := zfs.ZfsLines("list", "-t", "snapshot", "-r", "-o", "name", h.Dataset.Name)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	pods := h.Dataset.ChildName("pods") + "/"
+	snapshots := make(map[string]string)
+	for _, name := range names {
+		if pieces := strings.SplitN(name, "@"+buildSnapshotPrefix, 2); len(pieces) == 2 && !strings.HasPrefix(name, pods) {
+			snapshots[pieces[1]] = name
+		}
+	}
+	for i := len(keys); i > 0; i-- {
+		if name, ok := snapshots[keys[i-1]]; ok {
+			snap, err := zfs.GetDataset(name)
+			if err != nil {
+				return 0, nil, errors.Trace(err)
+			}
+			return i, snap, nil
+		}
+	}
+	return 0, nil, nil
+}
+
+// Snapshots build pod's rootfs as a cached step.
+func takeBuildSnapshot(rootfs *zfs.Dataset, key string) error {
+	snap, err := rootfs.Snapshot(buildSnapshotPrefix+key, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(markBuildSnapshotUsed(snap))
+}
+
+func markBuildSnapshotUsed(snap *zfs.Dataset) error {
+	return errors.Trace(snap.Set(buildUsedProperty, strconv.FormatInt(time.Now().Unix(), 10)))
+}
+
+// Keeps the failed build pod's rootfs, with its cached steps, in the
+// build-cache dataset.
+func (h *Host) keepFailedBuild(buildPod *Pod) error {
+	if err := buildPod.Kill(); err != nil {
+		return errors.Trace(err)
+	}
+	ds, err := h.Dataset.GetDataset(path.Join("pods", buildPod.UUID.String(), "rootfs.0"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := h.Dataset.GetDataset("build-cache"); err == zfs.ErrNotFound {
+		if _, err := h.Dataset.CreateDataset("build-cache"); err != nil {
+			return errors.Trace(err)
+		}
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ds.Set("mountpoint", h.Path("build-cache", buildPod.UUID.String())); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ds.Rename(h.Dataset.ChildName(path.Join("build-cache", buildPod.UUID.String()))))
+}
+
+// Returns changes in a build's rootfs since its base image, as paths
+// mapped to whether they were deleted. If the rootfs has been cloned
+// from a cached step, changes in the snapshot's dataset (and in its
+// origins, up to the base image) come first.
+func (img *Image) buildChanges(rootfs *zfs.Dataset) (map[string]bool, error) {
+	seal := img.getRootfs().SnapshotName(imageSnapshotName)
+	var phases []map[string]bool
+	ds, snap := rootfs, ""
+	for {
+		changes, err := datasetChanges(ds, snap)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		phases = append(phases, changes)
+		if ds.Origin == seal {
+			break
+		}
+		pieces := strings.SplitN(ds.Origin, "@", 2)
+		if len(pieces) != 2 || !strings.HasPrefix(pieces[1], buildSnapshotPrefix) {
+			return nil, errors.Errorf("Cannot trace %v back to %v", ds.Name, seal)
+		}
+		if ds, err = zfs.GetDataset(pieces[0]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		snap = pieces[1]
+	}
+
+	// Later changes override earlier ones
+	rv := make(map[string]bool)
+	for i := len(phases) - 1; i >= 0; i-- {
+		for p, isDeletion := range phases[i] {
+			rv[p] = isDeletion
+		}
+	}
+	return rv, nil
+}
+
+// Returns changes between dataset's first snapshot (taken when it was
+// cloned) and snapshot snap, or current contents if snap is empty.
+func datasetChanges(ds *zfs.Dataset, snap string) (map[string]bool, error) {
+	snaps, err := zfs.ZfsLines("list", "-t", "snapshot", "-d", "1", "-s", "createtxg", "-o", "name", ds.Name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(snaps) == 0 {
+		return nil, errors.Errorf("%v has no snapshots", ds.Name)
+	}
+	args := []string{snaps[0]}
+	if snap != "" {
+		args = append(args, ds.SnapshotName(snap))
+	}
+	diffs, err := zfs.ZfsFields("diff", args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// To figure out whether a deleted file has been re-added (and
+	// should be kept in PathWhitelist after all), we keep changes in a
+	// map: a false value means there was an addition; true value means
+	// a deletion. False overwrites true, true never overwrites false.
+	deletionMap := make(map[string]bool)
+	for _, diff := range diffs {
+		path1 := diff[1][len(ds.Mountpoint):]
+		switch diff[0] {
+		case "+", "M":
+			deletionMap[path1] = false
+		case "R":
+			path2 := diff[2][len(ds.Mountpoint):]
+			deletionMap[path2] = false
+			fallthrough
+		case "-":
+			if _, ok := deletionMap[path1]; !ok {
+				// if found in map, either already true (no need to set
+				// again), or false (which should stay)
+				deletionMap[path1] = true
+			}
+		default:
+			return nil, errors.Errorf("Unknown `zfs diff` line: %v", diff)
+		}
+	}
+	return deletionMap, nil
+}
+
+// Destroys cached build steps that haven't been used for maxAge, and
+// build-cache datasets that have no cached steps left. Steps that
+// other datasets have been cloned from are kept. Returns number of
+// destroyed steps.
+func (h *Host) PruneBuildCache(maxAge time.Duration) (int, error) {
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer unlock()
+
+	snaps, err := zfs.ZfsFields("list", "-p", "-t", "snapshot", "-r",
+		"-o", "name,clones,creation,"+buildUsedProperty, h.Dataset.Name)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	pruned := 0
+	cutoff := time.Now().Add(-maxAge)
+	inUse := make(map[string]bool) // datasets with snapshots that stay
+	for _, snap := range snaps {
+		name, clones := snap[0], snap[1]
+		pieces := strings.SplitN(name, "@", 2)
+		isBuild := strings.HasPrefix(pieces[1], buildSnapshotPrefix)
+		if isBuild && (clones == "" || clones == "-") {
+			used, err := strconv.ParseInt(snap[3], 10, 64)
+			if err != nil {
+				used, _ = strconv.ParseInt(snap[2], 10, 64)
+			}
+			if time.Unix(used, 0).Before(cutoff) {
+				h.log().Debugf("Pruning build step %v", name)
+				if err := zfs.Zfs("destroy", name); err != nil {
+					return pruned, errors.Trace(err)
+				}
+				pruned++
+				continue
+			}
+		}
+		if isBuild || (clones != "" && clones != "-") {
+			inUse[pieces[0]] = true
+		}
+	}
+
+	if cache, err := h.Dataset.GetDataset("build-cache"); err == nil {
+		children, err := cache.Children(1)
+		if err != nil {
+			return pruned, errors.Trace(err)
+		}
+		for _, ds := range children {
+			if !inUse[ds.Name] {
+				h.log().Debugf("Destroying failed build %v", ds.Name)
+				if err := ds.Destroy("-r"); err != nil {
+					return pruned, errors.Trace(err)
+				}
+			}
+		}
+	} else if err != zfs.ErrNotFound {
+		return pruned, errors.Trace(err)
+	}
+	h.log().Infof("pruned %d cached build steps", pruned)
+	return pruned, nil
+}
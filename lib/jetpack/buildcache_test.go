@@ -0,0 +1,67 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCacheKey(t *testing.T) {
+	base := buildCacheKey("sha512-0123", "files", "")
+	if base == buildCacheKey("sha512-0124", "files", "") {
+		t.Error("base image doesn't change the key")
+	}
+	step := buildCacheKey(base, "pkg", "install", "-y", "nginx")
+	if step != buildCacheKey(base, "pkg", "install", "-y", "nginx") {
+		t.Error("key is not stable")
+	}
+	for _, other := range []string{
+		buildCacheKey(base, "pkg", "install", "-y nginx"),
+		buildCacheKey(base, "pkg", "install", "-y", "nginx", ""),
+		buildCacheKey(buildCacheKey("sha512-0124", "files", ""), "pkg", "install", "-y", "nginx"),
+	} {
+		if other == step {
+			t.Errorf("keys collide: %v", step)
+		}
+	}
+}
+
+func TestDigestBuildFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTestFiles(t, tmp, map[string]string{
+		"src/main.c":   "int main() {}",
+		"src/Makefile": "all: main",
+		"nginx.conf":   "worker_processes 1;",
+	})
+	files := []BuildFile{
+		{Source: filepath.Join(tmp, "src"), Path: "src"},
+		{Source: filepath.Join(tmp, "nginx.conf"), Path: "/usr/local/etc/nginx/nginx.conf"},
+	}
+	digest, err := digestBuildFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := digestBuildFiles(files); err != nil || again != digest {
+		t.Errorf("digest is not stable: %v (%v)", again, err)
+	}
+
+	files[1].Path = "/etc/nginx.conf"
+	if moved, _ := digestBuildFiles(files); moved == digest {
+		t.Error("destination doesn't change the digest")
+	}
+	files[1].Path = "/usr/local/etc/nginx/nginx.conf"
+	writeTestFiles(t, tmp, map[string]string{"src/main.c": "int main() { return 1; }"})
+	if changed, _ := digestBuildFiles(files); changed == digest {
+		t.Error("content doesn't change the digest")
+	}
+
+	files = append(files, BuildFile{Source: filepath.Join(tmp, "missing"), Path: "x"})
+	if _, err := digestBuildFiles(files); err == nil {
+		t.Error("missing file accepted")
+	}
+}
@@ -0,0 +1,227 @@
+package jetpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+	"github.com/3ofcoins/jetpack/lib/ui"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// A build spec describes an image built without a build directory:
+// files are copied from the host into a pod created from the base
+// image, steps are run in it in order, then the script, and the pod's
+// rootfs becomes the new image, with manifest made of the spec's name,
+// labels, app, and annotations. Files are copied like `cp -Rp`, but
+// without following symlinks that the base image has in the rootfs.
+
+// Output of a failed step included in BuildStepError's message
+const maxBuildStepOutput = 4096
+
+type BuildSpec struct {
+	Base        schema.RuntimeImage `json:"base"`
+	Name        types.ACIdentifier  `json:"name"`
+	Labels      types.Labels        `json:"labels,omitempty"`
+	App         *types.App          `json:"app,omitempty"`
+	Annotations types.Annotations   `json:"annotations,omitempty"`
+	Files       []BuildFile         `json:"files,omitempty"`
+	Steps       []types.Exec        `json:"steps,omitempty"`
+	Script      string              `json:"script,omitempty"` // run with `/bin/sh -e` after steps
+}
+
+// File or directory copied from the host into the build pod
+type BuildFile struct {
+	Source string `json:"source"` // path on the host
+	Path   string `json:"path"`   // absolute, or relative to the build's work dir
+}
+
+// Options of Host.BuildImage
+type BuildOptions struct {
+	NoCache bool // run all steps, even if they are cached
+}
+
+// Returned when a build step fails; its cause is AppExitError.
+type BuildStepError struct {
+	Step   int // from 1
+	Exec   types.Exec
+	Status *ExitStatus
+	Output []byte // step's stdout and stderr
+}
+
+func (e *BuildStepError) Error() string {
+	output := e.Output
+	if len(output) > maxBuildStepOutput {
+		output = output[len(output)-maxBuildStepOutput:]
+	}
+	return fmt.Sprintf("Build step %d (%v): %v\n%s", e.Step, run.ShellEscape(e.Exec...), e.Status, output)
+}
+
+func (e *BuildStepError) Cause() error {
+	return &AppExitError{e.Status}
+}
+
+func (spec *BuildSpec) validate() error {
+	if spec.Name.Empty() {
+		return errors.Annotate(ErrUsage, "Build spec needs a name")
+	}
+	if spec.Base.Name == nil && spec.Base.ID.Empty() {
+		return errors.Annotate(ErrUsage, "Build spec needs a base image")
+	}
+	if len(spec.Steps) == 0 && spec.Script == "" {
+		return errors.Annotate(ErrUsage, "Build spec needs steps or a script")
+	}
+	for i, step := range spec.Steps {
+		if len(step) == 0 {
+			return errors.Annotatef(ErrUsage, "Build step %d is empty", i+1)
+		}
+	}
+	for _, file := range spec.Files {
+		if file.Source == "" || file.Path == "" {
+			return errors.Annotatef(ErrUsage, "Invalid build file %#v", file)
+		}
+	}
+	return nil
+}
+
+// Builds a new image from spec, in a pod created from the spec's base
+// image, or from the last cached step that matches. The pod is
+// destroyed whether the build succeeds or not. Returns BuildStepError
+// if a step fails.
+func (h *Host) BuildImage(spec *BuildSpec, opts *BuildOptions) (*Image, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	if err := spec.validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	img, err := h.getRuntimeImage(spec.Base)
+	if err != nil {
+		return nil, errors.Annotate(err, "Base image")
+	}
+
+	steps := spec.Steps
+	if spec.Script != "" {
+		steps = append(steps[:len(steps):len(steps)], types.Exec{"/bin/sh", "-e", "script"})
+	}
+	filesDigest, err := digestBuildFiles(spec.Files)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	keys := make([]string, len(steps))
+	key := buildCacheKey(img.Hash.String(), "files", filesDigest)
+	for i, step := range steps {
+		if i == len(spec.Steps) {
+			// The script
+			key = buildCacheKey(key, strings.TrimSpace(spec.Script))
+		} else {
+			key = buildCacheKey(key, step...)
+		}
+		keys[i] = key
+	}
+	cached, snap := 0, (*zfs.Dataset)(nil)
+	if !opts.NoCache {
+		if cached, snap, err = h.findBuildSnapshot(keys); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	img.ui.Println("Preparing build pod")
+	buildPod, err := createPod(h, img.buildPodManifest([]string{"/bin/sh"}), &podCreateOptions{rootfsSnapshot: snap})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer img.destroyBuildPod(buildPod)
+
+	ui := ui.NewUI("cyan", "build", buildPod.UUID.String())
+	ds, err := h.Dataset.GetDataset(path.Join("pods", buildPod.UUID.String(), "rootfs.0"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	workDir := buildPod.Manifest.Apps[0].App.WorkingDirectory
+	if cached > 0 {
+		// Work dir and files are in the snapshot
+		if err := markBuildSnapshotUsed(snap); err != nil {
+			img.log().Warnf("Cannot mark %v as used: %v", snap.Name, err)
+		}
+	} else if err := h.prepareBuildFiles(ui, ds, workDir, spec.Files); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	app := buildPod.Apps()[0]
+	for i, step := range steps {
+		if i < cached {
+			ui.Printf("Step %d/%d: %v (cached)", i+1, len(steps), run.ShellEscape(step...))
+			continue
+		}
+		ui.Printf("Step %d/%d: %v", i+1, len(steps), run.ShellEscape(step...))
+		if i == len(spec.Steps) {
+			if err := ioutil.WriteFile(ds.Path(workDir, "script"), []byte(spec.Script), 0600); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		var output bytes.Buffer
+		es, err := app.Stage2(nil, nil, &output, &output, "0", "0", workDir, step...)
+		if err == nil && !es.Success() {
+			err = &BuildStepError{Step: i + 1, Exec: step, Status: es, Output: output.Bytes()}
+		}
+		if err != nil {
+			if i > cached {
+				// Keep the steps that have succeeded
+				if kerr := h.keepFailedBuild(buildPod); kerr != nil {
+					img.log().Warnf("Cannot keep cached steps: %v", kerr)
+				}
+			}
+			if _, ok := err.(*BuildStepError); ok {
+				return nil, err
+			}
+			return nil, errors.Annotatef(err, "Build step %d", i+1)
+		}
+		if output.Len() > 0 {
+			ui.Debugf("Step %d output:\n%s", i+1, strings.TrimRight(output.String(), "\n"))
+		}
+		if err := takeBuildSnapshot(ds, keys[i]); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	manifest := schema.BlankImageManifest()
+	manifest.Name = spec.Name
+	manifest.Labels = spec.Labels
+	manifest.App = spec.App
+	manifest.Annotations = append(manifest.Annotations, spec.Annotations...)
+	if spec.Script != "" {
+		manifest.Annotations.Set("jetpack/build-script", spec.Script)
+	}
+	return img.pivotBuildPod(buildPod, manifest, steps)
+}
+
+// Creates build's work dir, and copies files into the build pod's
+// rootfs.
+func (h *Host) prepareBuildFiles(ui *ui.UI, rootfs *zfs.Dataset, workDir string, files []BuildFile) error {
+	ui.Debugf("Preparing build environment in %v", workDir)
+	if err := os.Mkdir(rootfs.Path(workDir), 0700); err != nil {
+		return errors.Trace(err)
+	}
+	for _, file := range files {
+		dest := file.Path
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(workDir, dest)
+		}
+		dest = filepath.Join("/", dest) // within the rootfs
+		ui.Debugf("Copying %v to %v", file.Source, dest)
+		if err := copyIntoRootfs(rootfs.Path(), file.Source, dest); err != nil {
+			return errors.Annotatef(err, "Copying %v", file.Source)
+		}
+	}
+	return nil
+}
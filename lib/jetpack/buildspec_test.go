@@ -0,0 +1,127 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestBuildSpecValidate(t *testing.T) {
+	base := types.MustACIdentifier("example.com/base")
+	valid := BuildSpec{
+		Base:  schema.RuntimeImage{Name: base},
+		Name:  "example.com/app",
+		Steps: []types.Exec{{"/bin/true"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid spec: %v", err)
+	}
+	for _, modify := range []func(*BuildSpec){
+		func(spec *BuildSpec) { spec.Name = "" },
+		func(spec *BuildSpec) { spec.Base = schema.RuntimeImage{} },
+		func(spec *BuildSpec) { spec.Steps = nil },
+		func(spec *BuildSpec) { spec.Steps = append(spec.Steps, nil) },
+		func(spec *BuildSpec) { spec.Files = []BuildFile{{Source: "/etc/hosts"}} },
+	} {
+		spec := valid
+		modify(&spec)
+		if err := spec.validate(); errors.Cause(err) != ErrUsage {
+			t.Errorf("%+v: %v", spec, err)
+		}
+	}
+
+	scriptOnly := valid
+	scriptOnly.Steps = nil
+	scriptOnly.Script = "make install"
+	if err := scriptOnly.validate(); err != nil {
+		t.Errorf("script-only spec: %v", err)
+	}
+}
+
+func TestBuildStepError(t *testing.T) {
+	err := error(&BuildStepError{
+		Step:   2,
+		Exec:   types.Exec{"/bin/sh", "-c", "make"},
+		Status: &ExitStatus{App: "jetpack/build", Code: 2},
+		Output: []byte(strings.Repeat("x", maxBuildStepOutput) + "make: *** No rule"),
+	})
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "Build step 2 (/bin/sh -c make): Exited (2)\n") || !strings.HasSuffix(msg, "make: *** No rule") {
+		t.Errorf("message: %q", msg)
+	}
+	if len(msg) > maxBuildStepOutput+100 {
+		t.Errorf("output not truncated: %d bytes", len(msg))
+	}
+	if aerr, ok := errors.Cause(err).(*AppExitError); !ok || aerr.Code != 2 {
+		t.Errorf("cause: %#v", errors.Cause(err))
+	}
+}
+
+func TestStripBuildResidue(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	img := NewImage(h, nil)
+	img.rootfs = &zfs.Dataset{Mountpoint: filepath.Join(tmp, "base")}
+	os.MkdirAll(img.rootfs.Mountpoint, 0755)
+
+	rootfs := filepath.Join(tmp, "build")
+	writeTestFiles(t, rootfs, map[string]string{
+		"etc/resolv.conf": "nameserver 10.0.0.1\n",
+		"tmp/build.log":   "log",
+		"tmp/cache/x":     "x",
+		"usr/bin/app":     "app",
+	})
+
+	// Base has no resolv.conf: the injected one is removed
+	if err := img.stripBuildResidue(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"etc/resolv.conf", "tmp/build.log", "tmp/cache"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, p)); !os.IsNotExist(err) {
+			t.Errorf("%v survived: %v", p, err)
+		}
+	}
+	for _, p := range []string{"tmp", "usr/bin/app"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, p)); err != nil {
+			t.Errorf("%v removed: %v", p, err)
+		}
+	}
+
+	// Base's own resolv.conf is restored
+	writeTestFiles(t, img.rootfs.Mountpoint, map[string]string{"etc/resolv.conf": "nameserver 127.0.0.1\n"})
+	writeTestFiles(t, rootfs, map[string]string{"etc/resolv.conf": "nameserver 10.0.0.1\n"})
+	if err := img.stripBuildResidue(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(rootfs, "etc/resolv.conf")); err != nil || string(bb) != "nameserver 127.0.0.1\n" {
+		t.Errorf("resolv.conf: %q (%v)", bb, err)
+	}
+
+	// A symlink left by the build is not written through
+	outside := filepath.Join(tmp, "outside")
+	writeTestFiles(t, outside, map[string]string{"resolv.conf": "host\n"})
+	if err := os.RemoveAll(filepath.Join(rootfs, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(rootfs, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.stripBuildResidue(rootfs); err == nil {
+		t.Error("Wrote through a symlink")
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(outside, "resolv.conf")); err != nil || string(bb) != "host\n" {
+		t.Errorf("File outside rootfs changed: %q (%v)", bb, err)
+	}
+}
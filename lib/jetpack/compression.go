@@ -0,0 +1,201 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// ACIs may be plain tar archives, or compressed with gzip, bzip2, xz,
+// or zstd; compression is detected from magic bytes at the start of
+// the file. gzip and bzip2 are decompressed in process, xz and zstd
+// with xz(1) and zstd(1) from the base system, which need to be in
+// PATH. As the appc spec defines, image ID is the SHA-512 hash of
+// the uncompressed tar, so an image has the same ID however it's
+// compressed.
+
+type Compression string
+
+const (
+	CompressionNone  Compression = "none"
+	CompressionGzip  Compression = "gzip"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionXz    Compression = "xz"
+	CompressionZstd  Compression = "zstd"
+)
+
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Offset of "ustar" magic in a tar header
+const tarMagicOffset = 257
+
+// Detects compression of a file that starts with header.
+func DetectCompression(header []byte) (Compression, error) {
+	for _, cm := range compressionMagic {
+		if bytes.HasPrefix(header, cm.magic) {
+			return cm.compression, nil
+		}
+	}
+	if len(header) >= tarMagicOffset+5 && string(header[tarMagicOffset:tarMagicOffset+5]) == "ustar" {
+		return CompressionNone, nil
+	}
+	return "", errors.New("Not an ACI: neither a tar archive, nor compressed with gzip, bzip2, xz, or zstd")
+}
+
+// Decompressed stream. Errors of a corrupt or truncated stream name
+// the compression.
+type decompressingReader struct {
+	r           io.Reader
+	compression Compression
+	cmd         *decompressorCmd
+	err         error // of decompression
+}
+
+func (dr *decompressingReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = errors.Annotatef(err, "Corrupt or truncated %v stream", dr.compression)
+		dr.err = err
+	}
+	return n, err
+}
+
+// Stops the decompressor, if it's an external command.
+func (dr *decompressingReader) Close() error {
+	return dr.cmd.close()
+}
+
+// Returns reader of decompressed rd, and the detected compression. The
+// reader needs to be closed to stop an external decompressor.
+func DecompressingReader(rd io.Reader) (io.ReadCloser, Compression, error) {
+	dr, err := newDecompressingReader(rd)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return dr, dr.compression, nil
+}
+
+func newDecompressingReader(rd io.Reader) (*decompressingReader, error) {
+	brd := bufio.NewReaderSize(rd, 1024)
+	header, err := brd.Peek(tarMagicOffset + 5)
+	if err != nil && err != io.EOF {
+		return nil, errors.Trace(err)
+	}
+	compression, err := DetectCompression(header)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	dr := &decompressingReader{compression: compression}
+	switch compression {
+	case CompressionNone:
+		dr.r = brd
+	case CompressionGzip:
+		gzr, err := gzip.NewReader(brd)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Corrupt %v stream", compression)
+		}
+		dr.r = gzr
+	case CompressionBzip2:
+		dr.r = bzip2.NewReader(brd)
+	case CompressionXz, CompressionZstd:
+		cmd, err := startDecompressor(brd, string(compression), "-d", "-c")
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot decompress %v ACI", compression)
+		}
+		dr.r, dr.cmd = cmd, cmd
+	}
+	return dr, nil
+}
+
+// External decompressor, whose failure is reported at end of its
+// output.
+type decompressorCmd struct {
+	cmd  *run.Cmd
+	out  io.ReadCloser
+	done bool
+}
+
+func startDecompressor(rd io.Reader, command string, args ...string) (*decompressorCmd, error) {
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, errors.Trace(err)
+	}
+	dc := &decompressorCmd{cmd: run.Command(command, args...).ReadFrom(rd).Quiet()}
+	out, err := dc.cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dc.out = out
+	if err := dc.cmd.Start(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return dc, nil
+}
+
+func (dc *decompressorCmd) Read(p []byte) (int, error) {
+	n, err := dc.out.Read(p)
+	if err == io.EOF && !dc.done {
+		dc.done = true
+		if werr := dc.cmd.Wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (dc *decompressorCmd) close() error {
+	if dc == nil || dc.done {
+		return nil
+	}
+	dc.done = true
+	dc.out.Close()
+	dc.cmd.Kill()
+	dc.cmd.Wait()
+	return nil
+}
+
+// Reads image manifest from a (compressed) ACI.
+func readACIManifest(rd io.Reader) ([]byte, error) {
+	dr, err := newDecompressingReader(rd)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("No manifest in ACI")
+		} else if err != nil {
+			if dr.err != nil {
+				return nil, dr.err
+			}
+			if dr.compression != CompressionNone {
+				return nil, errors.Annotatef(err, "Invalid tar archive in %v ACI", dr.compression)
+			}
+			return nil, errors.Annotate(err, "Invalid tar archive")
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == "manifest" {
+			manifest, err := ioutil.ReadAll(tr)
+			return manifest, errors.Trace(err)
+		}
+	}
+}
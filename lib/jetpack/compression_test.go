@@ -0,0 +1,100 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testACITar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"manifest", `{"acKind":"ImageManifest"}`},
+		{"rootfs/hello", strings.Repeat("hello\n", 1000)},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testCompress(t *testing.T, compression Compression, data []byte) []byte {
+	switch compression {
+	case CompressionNone:
+		return data
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		gzw.Write(data)
+		gzw.Close()
+		return buf.Bytes()
+	}
+	if _, err := exec.LookPath(string(compression)); err != nil {
+		t.Skipf("%v is not installed", compression)
+	}
+	cmd := exec.Command(string(compression), "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDecompressingReader(t *testing.T) {
+	plain := testACITar(t)
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionBzip2, CompressionXz, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			compressed := testCompress(t, compression, plain)
+
+			dr, detected, err := DecompressingReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected != compression {
+				t.Errorf("detected %v", detected)
+			}
+			out, err := ioutil.ReadAll(dr)
+			dr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, plain) {
+				t.Errorf("decompressed %d bytes, expected %d", len(out), len(plain))
+			}
+
+			if manifest, err := readACIManifest(bytes.NewReader(compressed)); err != nil {
+				t.Error(err)
+			} else if string(manifest) != `{"acKind":"ImageManifest"}` {
+				t.Errorf("unexpected manifest %#v", string(manifest))
+			}
+
+			if compression == CompressionNone {
+				return
+			}
+			truncated := compressed[:len(compressed)/2]
+			dr, _, err = DecompressingReader(bytes.NewReader(truncated))
+			if err == nil {
+				_, err = ioutil.ReadAll(dr)
+				dr.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), string(compression)) {
+				t.Errorf("expected error naming %v, got %v", compression, err)
+			}
+		})
+	}
+
+	if _, _, err := DecompressingReader(strings.NewReader("not an image")); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/juju/errors"
 	"github.com/magiconair/properties"
 )
 
@@ -21,21 +23,84 @@ var defaultConfig = []byte(fmt.Sprintf(`
 ace.jailConf.osrelease=10.3-RELEASE
 ace.jailConf.securelevel=2
 allow.autodiscovery = on
+allow.extra-mounts = on
+allow.foreign-platform = off
 allow.http = off
 allow.no-signature = off
+api.socket = /var/run/jetpack.sock
+api.socket.mode = 0600
+app.path = /usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+coredump.max-age = off
+coredump.max-size = off
+coredump.policy = host
+coredump.size = off
 debug = off
+ephemeral.scratch-size = 256m
+events.reconcile-interval = 5s
+fetch.cache.size = off
+fetch.concurrency = 4
+fetch.credentials = credentials.toml
+fetch.netrc = on
+fetch.retries = 2
+fetch.timeout = 30s
+fetch.tls = tls.toml
+gc.creation-timeout = 1h
+gc.grace-period = 24h
+gc.image-min-age = 168h
+gc.spool-max-age = 168h
+hooks.timeout = 30s
+hosts.inject = off
 images.aci.compression=xz
+images.verify = off
 images.zfs.atime=off
 images.zfs.compress=lz4
 jail.interface = lo1
 jail.namePrefix = jetpack/
+limits.min-free = off
+limits.pods = 0
+limits.quota = off
+linux.autoload = off
+linux.shm-size = 64m
+lock.timeout = 5m
+log.compress = off
+log.keep = 5
+log.max-age = off
+log.max-size = 10m
+log.timestamps = off
+mds.embed = off
+mds.enable = on
 mds.port = 1104
+mds.socket = /var/run/jetpack-mds.sock
 mds.user = _jetpack
+metrics.listen = off
+mount.fdescfs = off
+mount.procfs = off
+nat.enable = off
+net.accounting = off
+net.isolate = off
 path.libexec = ${path.prefix}/libexec/jetpack
 path.share = ${path.prefix}/share/jetpack
 path.prefix = %v
+rctl.maxproc = 0
+rctl.maxproc.alert = off
+rctl.memory.action = deny
+rctl.openfiles = 0
+rctl.openfiles.alert = off
+rctl.pseudoterminals = 0
+rctl.pseudoterminals.alert = off
+rctl.required = on
+readonly.writable-paths = /tmp /var
 root.zfs = zroot/jetpack
 root.zfs.mountpoint = /var/jetpack
+stats.history = 1440
+stats.interval = off
+storage.default-class = default
+storage.limit = off
+storage.reservation = off
+timeout.jail = 5m
+timeout.system = 1m
+timeout.zfs = 10m
+tmpfs.tmp = off
 `,
 	prefix))
 
@@ -78,38 +143,136 @@ func ConfigFlags() []string {
 	return rv
 }
 
+// Loaded configuration; ReloadConfig replaces it while other
+// goroutines read it, so it is guarded by configMx.
+var configMx sync.RWMutex
 var configProperties *properties.Properties
 var configPath string
 
+// Where each property has been set: "default", FILE:LINE of a
+// structured configuration file, path of jetpack.conf, or "command
+// line"
+var configSources map[string]string
+
+// Properties of structured configuration overridden by jetpack.conf
+// (name to structured source)
+var configShadowed map[string]string
+
+// Configuration read from files and command line
+type loadedConfig struct {
+	props    *properties.Properties
+	path     string
+	sources  map[string]string
+	shadowed map[string]string
+}
+
+// Returns loaded configuration, loading it first if needed. Panics if
+// it can't be loaded; LoadConfig returns the error instead, and
+// NewHost calls it before anything else reads the configuration.
 func Config() *properties.Properties {
-	if configProperties == nil {
-		cfg := defaultConfig
+	configMx.RLock()
+	props := configProperties
+	configMx.RUnlock()
+	if props != nil {
+		return props
+	}
+	if err := LoadConfig(); err != nil {
+		panic(err)
+	}
+	configMx.RLock()
+	defer configMx.RUnlock()
+	return configProperties
+}
 
-		cfgPath, err := filepath.Abs(ConfigPath)
-		if err != nil {
-			panic(err)
-		}
+// Loads configuration, unless it's already loaded. Returns an error
+// if a configuration file is malformed.
+func LoadConfig() error {
+	configMx.Lock()
+	defer configMx.Unlock()
+	if configProperties != nil {
+		return nil
+	}
+	lc, err := loadConfig()
+	if err != nil {
+		return errors.Annotate(err, "Cannot read configuration")
+	}
+	lc.use()
+	return nil
+}
+
+// Makes lc the current configuration; configMx must be held.
+func (lc *loadedConfig) use() {
+	configPath = lc.path
+	configSources = lc.sources
+	configShadowed = lc.shadowed
+	configProperties = lc.props
+}
+
+// Returns where property k has been set, or "" if it hasn't been read
+// from configuration.
+func configSource(k string) string {
+	configMx.RLock()
+	defer configMx.RUnlock()
+	return configSources[k]
+}
+
+// Reads defaults, structured configuration, jetpack.conf, and command
+// line overrides.
+func loadConfig() (*loadedConfig, error) {
+	cfgPath, err := filepath.Abs(ConfigPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	props, err := properties.Load(defaultConfig, properties.UTF8)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sources := make(map[string]string)
+	shadowed := make(map[string]string)
+	for _, k := range props.Keys() {
+		sources[k] = "default"
+	}
 
-		if cfgFile, err := ioutil.ReadFile(cfgPath); os.IsNotExist(err) {
-			// pass
-		} else if err != nil {
-			panic(err)
-		} else {
-			cfg = append(cfg, cfgFile...)
+	entries, err := loadStructuredConfig(filepath.Dir(cfgPath))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, entry := range entries {
+		if _, _, err := props.Set(entry.Name, entry.Value); err != nil {
+			return nil, errors.Annotate(err, entry.Source)
 		}
-		if props, err := properties.Load(cfg, properties.UTF8); err != nil {
-			panic(err)
-		} else {
-			for k, v := range ConfigOverrides {
-				if _, _, err := props.Set(k, v); err != nil {
-					panic(err)
-				}
+		sources[entry.Name] = entry.Source
+	}
+
+	if cfgFile, err := ioutil.ReadFile(cfgPath); os.IsNotExist(err) {
+		// pass
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else if legacy, err := properties.Load(cfgFile, properties.UTF8); err != nil {
+		return nil, errors.Annotate(err, cfgPath)
+	} else {
+		// Raw values; references are expanded against all properties
+		legacy.DisableExpansion = true
+		for _, k := range legacy.Keys() {
+			v, _ := legacy.Get(k)
+			if _, _, err := props.Set(k, v); err != nil {
+				return nil, errors.Annotatef(err, "%v: %v", cfgPath, k)
 			}
-			configPath = cfgPath
-			configProperties = props
+			if src := sources[k]; src != "default" && src != "" {
+				shadowed[k] = src
+			}
+			sources[k] = cfgPath
 		}
 	}
-	return configProperties
+
+	for k, v := range ConfigOverrides {
+		if _, _, err := props.Set(k, v); err != nil {
+			return nil, errors.Annotatef(err, "-o %v", k)
+		}
+		sources[k] = "command line"
+	}
+	return &loadedConfig{props: props, path: cfgPath, sources: sources, shadowed: shadowed}, nil
 }
 
 func ConfigPrefix(prefix string) map[string]string {
@@ -0,0 +1,284 @@
+package jetpack
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Structured configuration: `jetpack.toml` next to jetpack.conf, and
+// fragments in `jetpack.d/*.toml`, in a subset of TOML. Tables and
+// dotted keys map to property names ([gc] grace-period = "24h" sets
+// gc.grace-period); quoted keys may contain any characters, e.g.
+// annotation names. Values are strings, integers, booleans, or
+// one-line arrays, which become space-separated lists. A top-level
+// `include` key (a string or an array) names more files to load,
+// as glob patterns relative to the including file. Properties set in
+// jetpack.conf take precedence over the structured files.
+
+const (
+	structuredConfigFile = "jetpack.toml"
+	structuredConfigDir  = "jetpack.d"
+)
+
+// Included files nested deeper than this are a loop
+const configIncludeDepth = 8
+
+// A property set by a configuration file
+type configEntry struct {
+	Name, Value string
+	Source      string // FILE:LINE
+}
+
+// Loads structured configuration files from dir.
+func loadStructuredConfig(dir string) ([]configEntry, error) {
+	var rv []configEntry
+	main := filepath.Join(dir, structuredConfigFile)
+	if _, err := os.Stat(main); err == nil {
+		if rv, err = parseConfigFile(main, 0); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+	fragments, _ := filepath.Glob(filepath.Join(dir, structuredConfigDir, "*.toml"))
+	sort.Strings(fragments)
+	for _, fragment := range fragments {
+		entries, err := parseConfigFile(fragment, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rv = append(rv, entries...)
+	}
+	return rv, nil
+}
+
+func parseConfigFile(path string, depth int) ([]configEntry, error) {
+	if depth > configIncludeDepth {
+		return nil, errors.Errorf("%v: includes nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var rv []configEntry
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		source := path + ":" + strconv.Itoa(lineno)
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.Errorf("%v: invalid table header", source)
+			}
+			name, err := parseConfigKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, errors.Annotate(err, source)
+			}
+			table = name + "."
+			continue
+		}
+		eq := configKeyEnd(line)
+		if eq < 0 {
+			return nil, errors.Errorf("%v: expected KEY = VALUE", source)
+		}
+		key, err := parseConfigKey(line[:eq])
+		if err != nil {
+			return nil, errors.Annotate(err, source)
+		}
+		values, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v: %v", source, key)
+		}
+		if key == "include" && table == "" {
+			for _, pattern := range values {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				included, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, errors.Annotate(err, source)
+				}
+				sort.Strings(included)
+				for _, inc := range included {
+					entries, err := parseConfigFile(inc, depth+1)
+					if err != nil {
+						return nil, errors.Trace(err)
+					}
+					rv = append(rv, entries...)
+				}
+			}
+			continue
+		}
+		rv = append(rv, configEntry{table + key, strings.Join(values, " "), source})
+	}
+	return rv, errors.Trace(scanner.Err())
+}
+
+// Strips a comment that's not inside a string.
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Returns index of the `=` separating key from value, or -1.
+func configKeyEnd(line string) int {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '=':
+			return i
+		}
+	}
+	return -1
+}
+
+// Parses a (possibly dotted and quoted) key into a property name.
+func parseConfigKey(str string) (string, error) {
+	var parts []string
+	for str = strings.TrimSpace(str); str != ""; {
+		var part string
+		switch str[0] {
+		case '"', '\'':
+			end := strings.IndexByte(str[1:], str[0])
+			if end < 0 {
+				return "", errors.Errorf("unterminated key %v", str)
+			}
+			part, str = str[1:end+1], str[end+2:]
+		default:
+			end := strings.IndexAny(str, ". \t")
+			if end < 0 {
+				end = len(str)
+			}
+			part, str = str[:end], str[end:]
+			for _, r := range part {
+				if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+					return "", errors.Errorf("invalid key %#v", part)
+				}
+			}
+		}
+		if part == "" {
+			return "", errors.New("empty key")
+		}
+		parts = append(parts, part)
+		str = strings.TrimSpace(str)
+		if str != "" {
+			if str[0] != '.' {
+				return "", errors.Errorf("invalid key near %#v", str)
+			}
+			str = strings.TrimSpace(str[1:])
+		}
+	}
+	if len(parts) == 0 {
+		return "", errors.New("empty key")
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// Parses a value; arrays return their items.
+func parseConfigValue(str string) ([]string, error) {
+	if strings.HasPrefix(str, "[") {
+		if !strings.HasSuffix(str, "]") {
+			return nil, errors.New("arrays need to fit in one line")
+		}
+		var rv []string
+		for rest := strings.TrimSpace(str[1 : len(str)-1]); rest != ""; {
+			item, n, err := parseConfigScalar(rest)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			rv = append(rv, item)
+			rest = strings.TrimSpace(rest[n:])
+			if rest != "" {
+				if rest[0] != ',' {
+					return nil, errors.Errorf("expected `,` near %#v", rest)
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+		return rv, nil
+	}
+	item, n, err := parseConfigScalar(str)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if n != len(str) {
+		return nil, errors.Errorf("unexpected %#v after value", str[n:])
+	}
+	return []string{item}, nil
+}
+
+// Parses a scalar at the beginning of str; returns its value and
+// length.
+func parseConfigScalar(str string) (string, int, error) {
+	switch str[0] {
+	case '"':
+		escaped := false
+		for i, r := range str[1:] {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				value, err := strconv.Unquote(str[:i+2])
+				if err != nil {
+					return "", 0, errors.Errorf("invalid string %v", str[:i+2])
+				}
+				return value, i + 2, nil
+			}
+		}
+		return "", 0, errors.New("unterminated string")
+	case '\'':
+		end := strings.IndexByte(str[1:], '\'')
+		if end < 0 {
+			return "", 0, errors.New("unterminated string")
+		}
+		return str[1 : end+1], end + 2, nil
+	}
+	end := strings.IndexAny(str, ", \t")
+	if end < 0 {
+		end = len(str)
+	}
+	word := str[:end]
+	if word == "true" || word == "false" {
+		return word, end, nil
+	}
+	if _, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 0, 64); err == nil {
+		return strings.Replace(word, "_", "", -1), end, nil
+	}
+	return "", 0, errors.Errorf("invalid value %#v (strings need quotes)", word)
+}
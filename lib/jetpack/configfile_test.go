@@ -0,0 +1,238 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadStructuredConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTestFiles(t, tmp, map[string]string{
+		"jetpack.toml": `# Main file
+include = "site/*.toml"
+debug = true
+
+[gc]
+grace-period = "12h" # comment
+creation-timeout = '30m'
+
+[presets.pg]
+images = ["example.com/pg*", "example.com/postgres"]
+annotations."jetpack/log-capture" = "file # not a comment"
+`,
+		"site/net.toml":         "[ips.pool]\nlo1 = \"10.1.0.0/16\"\n",
+		"jetpack.d/10-log.toml": "log.keep = 1_0\n",
+		"jetpack.d/ignored":     "garbage",
+	})
+
+	entries, err := loadStructuredConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name+"="+entry.Value)
+	}
+	expected := []string{
+		"ips.pool.lo1=10.1.0.0/16",
+		"debug=true",
+		"gc.grace-period=12h",
+		"gc.creation-timeout=30m",
+		"presets.pg.images=example.com/pg* example.com/postgres",
+		"presets.pg.annotations.jetpack/log-capture=file # not a comment",
+		"log.keep=10",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if src := entries[2].Source; src != filepath.Join(tmp, "jetpack.toml")+":6" {
+		t.Errorf("Unexpected source %v", src)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for content, expected := range map[string]string{
+		"a = unquoted":           "bad.toml:1: a: invalid value",
+		"\n[gc":                  "bad.toml:2: invalid table header",
+		"just a key":             "expected KEY = VALUE",
+		"a = \"unterminated":     "unterminated string",
+		"a = [\"x\",":            "arrays need to fit in one line",
+		"a b = 1":                "invalid key",
+		"include = \"bad.toml\"": "nested too deeply",
+	} {
+		writeTestFiles(t, tmp, map[string]string{"bad.toml": content})
+		if _, err := parseConfigFile(filepath.Join(tmp, "bad.toml"), 0); err == nil {
+			t.Errorf("%q: expected error", content)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error %q, got %q", content, expected, err)
+		}
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTestFiles(t, tmp, map[string]string{
+		"jetpack.toml": "[gc]\ngrace-period = \"12h\"\ncreation-timeout = \"2h\"\n",
+		"jetpack.conf": "gc.grace-period = 6h\nlog.keep = 3\n",
+	})
+
+	savedProps, savedPath, savedSources, savedShadowed := configProperties, ConfigPath, configSources, configShadowed
+	defer func() {
+		configProperties, ConfigPath, configSources, configShadowed = savedProps, savedPath, savedSources, savedShadowed
+	}()
+	configProperties = nil
+	ConfigPath = filepath.Join(tmp, "jetpack.conf")
+
+	sources := make(map[string]ConfigValue)
+	for _, cv := range (&Host{}).EffectiveConfig() {
+		sources[cv.Name] = cv
+	}
+	for name, expected := range map[string]ConfigValue{
+		"gc.grace-period":     {"gc.grace-period", "6h", ConfigPath},
+		"gc.creation-timeout": {"gc.creation-timeout", "2h", filepath.Join(tmp, "jetpack.toml") + ":3"},
+		"log.keep":            {"log.keep", "3", ConfigPath},
+		"debug":               {"debug", "off", "default"},
+	} {
+		if sources[name] != expected {
+			t.Errorf("Expected %v, got %v", expected, sources[name])
+		}
+	}
+	if !reflect.DeepEqual(configShadowed, map[string]string{"gc.grace-period": filepath.Join(tmp, "jetpack.toml") + ":2"}) {
+		t.Errorf("Unexpected shadowed properties %v", configShadowed)
+	}
+}
+
+func TestLoadHostSettings(t *testing.T) {
+	props := properties.MustLoadString(string(defaultConfig))
+	props.Set("timeout.jail", "off")
+	props.Set("ips.pool.lo1", "10.1.0.0/16")
+	props.Set("gc.grace-period", "off")
+	props.Set("gc.pinned-tags", "*:stable")
+	hs, err := loadHostSettings(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Timeouts != (TimeoutSettings{ZFS: 10 * time.Minute, System: time.Minute}) {
+		t.Errorf("Unexpected timeouts %#v", hs.Timeouts)
+	}
+	if hs.Network.Interface != "lo1" || hs.Network.Pools["lo1"] != "10.1.0.0/16" || hs.Network.NAT {
+		t.Errorf("Unexpected network settings %#v", hs.Network)
+	}
+	if hs.GC.GracePeriod != 0 || hs.GC.CreationTimeout != time.Hour || len(hs.GC.PinnedTags) != 1 {
+		t.Errorf("Unexpected GC settings %#v", hs.GC)
+	}
+	if hs.Logging != (LoggingSettings{MaxSize: 10 << 20, Keep: 5}) {
+		t.Errorf("Unexpected logging settings %#v", hs.Logging)
+	}
+	if hs.Images.Compression != "xz" || !reflect.DeepEqual(hs.Images.ZFS, map[string]string{"atime": "off", "compression": "lz4"}) {
+		t.Errorf("Unexpected images settings %#v", hs.Images)
+	}
+
+	props.Set("timeout.zfs", "soon")
+	props.Set("limits.quota", "lots")
+	props.Set("gc.grace-period", "later")
+	props.Set("net.isolate", "maybe")
+	if _, err := loadHostSettings(props); err == nil {
+		t.Error("Invalid settings accepted")
+	} else if msg := err.Error(); !strings.Contains(msg, "timeouts: timeout.zfs: invalid duration") || !strings.Contains(msg, "limits: limits.quota: invalid size") ||
+		!strings.Contains(msg, "gc: gc.grace-period: invalid duration") || !strings.Contains(msg, "network: net.isolate: invalid boolean") {
+		t.Errorf("Unexpected error %v", msg)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ifname, _ := testInterface(t)
+	toml := func(pods string) map[string]string {
+		return map[string]string{"jetpack.toml": "[jail]\ninterface = \"" + ifname + "\"\n[limits]\npods = " + pods + "\n"}
+	}
+	writeTestFiles(t, tmp, toml("3"))
+
+	savedProps, savedPath, savedSources, savedShadowed := configProperties, ConfigPath, configSources, configShadowed
+	defer func() {
+		configProperties, ConfigPath, configSources, configShadowed = savedProps, savedPath, savedSources, savedShadowed
+	}()
+	configProperties = nil
+	ConfigPath = filepath.Join(tmp, "jetpack.conf")
+
+	h := &Host{}
+	if err := h.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers see either configuration, never a half-loaded one
+	writeTestFiles(t, tmp, toml("5"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if pods := Config().GetInt("limits.pods", 0); pods != 3 && pods != 5 {
+				t.Errorf("Unexpected limits.pods %v", pods)
+			}
+			if pods := h.settings().Limits.Pods; pods != 3 && pods != 5 {
+				t.Errorf("Unexpected settings' limits.pods %v", pods)
+			}
+		}
+	}()
+	if err := h.ReloadConfig(); err != nil {
+		t.Error(err)
+	}
+	<-done
+	if pods := h.settings().Limits.Pods; pods != 5 {
+		t.Errorf("Expected reloaded limits.pods 5, got %v", pods)
+	}
+
+	// Invalid configuration is not loaded
+	writeTestFiles(t, tmp, toml("\"x\""))
+	if err := h.ReloadConfig(); err == nil {
+		t.Error("Invalid configuration loaded")
+	}
+	if pods := Config().GetInt("limits.pods", 0); pods != 5 {
+		t.Errorf("Expected kept limits.pods 5, got %v", pods)
+	}
+
+	// Malformed configuration is an error, not a panic
+	configMx.Lock()
+	configProperties = nil
+	configMx.Unlock()
+	writeTestFiles(t, tmp, map[string]string{"jetpack.toml": "[jail\n"})
+	if err := LoadConfig(); err == nil {
+		t.Error("Malformed configuration loaded")
+	}
+}
@@ -0,0 +1,308 @@
+package jetpack
+
+import (
+	"encoding/hex"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+)
+
+// Type of a configuration property's value
+type PropertyType string
+
+const (
+	PropertyString   PropertyType = "string"
+	PropertyBool     PropertyType = "bool"
+	PropertyInt      PropertyType = "int"
+	PropertyDuration PropertyType = "duration" // or "off"
+	PropertySize     PropertyType = "size"     // bytes, with optional unit, or "off"
+)
+
+// A known configuration property. Name ending with a dot is a family
+// of properties (e.g. "ips.pool." for ips.pool.INTERFACE).
+type PropertySpec struct {
+	Name     string
+	Type     PropertyType
+	Default  string `json:",omitempty"`
+	Required bool   `json:",omitempty"` // must be set to a non-empty value
+
+	// Additional check of a non-empty value, after its type is checked
+	validate func(name, value string) error
+}
+
+func (ps *PropertySpec) matches(name string) bool {
+	if strings.HasSuffix(ps.Name, ".") {
+		return strings.HasPrefix(name, ps.Name) && len(name) > len(ps.Name)
+	}
+	return name == ps.Name
+}
+
+func (ps *PropertySpec) check(name, value string) error {
+	if value == "" {
+		if ps.Required {
+			return errors.Errorf("%v is required", name)
+		}
+		return nil
+	}
+	switch ps.Type {
+	case PropertyBool:
+		switch strings.ToLower(value) {
+		case "on", "off", "true", "false", "yes", "no", "1", "0":
+		default:
+			return errors.Errorf("%v: invalid boolean %#v", name, value)
+		}
+	case PropertyInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.Errorf("%v: invalid integer %#v", name, value)
+		}
+	case PropertyDuration:
+		if value != "off" {
+			if d, err := time.ParseDuration(value); err != nil || d < 0 {
+				return errors.Errorf("%v: invalid duration %#v", name, value)
+			}
+		}
+	case PropertySize:
+		if _, err := parseLogSize(value); err != nil {
+			return errors.Errorf("%v: invalid size %#v", name, value)
+		}
+	}
+	if ps.validate != nil {
+		return errors.Trace(ps.validate(name, value))
+	}
+	return nil
+}
+
+func validateCIDR(name, value string) error {
+	if _, _, err := net.ParseCIDR(value); err != nil {
+		return errors.Errorf("%v: invalid network %#v", name, value)
+	}
+	return nil
+}
+
+func validateHex(name, value string) error {
+	if _, err := hex.DecodeString(value); err != nil {
+		return errors.Errorf("%v: invalid hexadecimal string", name)
+	}
+	return nil
+}
+
+func validateFileMode(name, value string) error {
+	if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+		return errors.Errorf("%v: invalid octal mode %#v", name, value)
+	}
+	return nil
+}
+
+func validatePositive(name, value string) error {
+	if n, _ := strconv.Atoi(value); n <= 0 {
+		return errors.Errorf("%v: must be positive", name)
+	}
+	return nil
+}
+
+func validateNonNegative(name, value string) error {
+	if n, _ := strconv.Atoi(value); n < 0 {
+		return errors.Errorf("%v: must not be negative", name)
+	}
+	return nil
+}
+
+func validateOneOf(values ...string) func(string, string) error {
+	return func(name, value string) error {
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return errors.Errorf("%v: invalid value %#v (allowed values: %v)", name, value, strings.Join(values, ", "))
+	}
+}
+
+func validateNotOff(name, value string) error {
+	if value == "off" {
+		return errors.Errorf("%v can't be off", name)
+	}
+	return nil
+}
+
+func validateURLs(name, value string) error {
+	for _, field := range strings.Fields(value) {
+		if u, err := url.Parse(field); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("%v: invalid URL %#v", name, field)
+		}
+	}
+	return nil
+}
+
+// Known configuration properties; defaults come from defaultConfig.
+var propertySchema = []*PropertySpec{
+	{Name: "ace.dns-servers", Type: PropertyString},
+	{Name: "ace.jailConf.", Type: PropertyString},
+	{Name: "allow.autodiscovery", Type: PropertyBool},
+	{Name: "allow.extra-mounts", Type: PropertyBool},
+	{Name: "allow.foreign-platform", Type: PropertyBool},
+	{Name: "allow.http", Type: PropertyBool},
+	{Name: "allow.no-signature", Type: PropertyBool},
+	{Name: "api.socket", Type: PropertyString},
+	{Name: "api.socket.group", Type: PropertyString},
+	{Name: "api.socket.mode", Type: PropertyString, validate: validateFileMode},
+	{Name: "app.path", Type: PropertyString, Required: true},
+	{Name: "coredump.max-age", Type: PropertyDuration},
+	{Name: "coredump.max-size", Type: PropertySize},
+	{Name: "coredump.policy", Type: PropertyString, validate: validateOneOf(CoredumpHost, CoredumpOff, CoredumpPod)},
+	{Name: "coredump.size", Type: PropertySize},
+	{Name: "debug", Type: PropertyBool},
+	{Name: "ephemeral.scratch-size", Type: PropertySize, validate: validateNotOff},
+	{Name: "events.reconcile-interval", Type: PropertyDuration, validate: validateNotOff},
+	{Name: "fetch.cache.size", Type: PropertySize},
+	{Name: "fetch.concurrency", Type: PropertyInt, validate: validatePositive},
+	{Name: "fetch.credentials", Type: PropertyString},
+	{Name: "fetch.mirrors", Type: PropertyString, validate: validateURLs},
+	{Name: "fetch.netrc", Type: PropertyBool},
+	{Name: "fetch.retries", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "fetch.timeout", Type: PropertyDuration, validate: validateNotOff},
+	{Name: "fetch.tls", Type: PropertyString},
+	{Name: "gc.creation-timeout", Type: PropertyDuration, validate: validateNotOff},
+	{Name: "gc.grace-period", Type: PropertyDuration},
+	{Name: "gc.image-min-age", Type: PropertyDuration},
+	{Name: "gc.pinned-tags", Type: PropertyString, validate: validatePinnedTags},
+	{Name: "gc.spool-max-age", Type: PropertyDuration},
+	{Name: "hooks.pod-started", Type: PropertyString},
+	{Name: "hooks.pod-stopped", Type: PropertyString},
+	{Name: "hooks.timeout", Type: PropertyDuration, validate: validateNotOff},
+	{Name: "hosts.inject", Type: PropertyBool},
+	{Name: "images.aci.compression", Type: PropertyString, validate: validateOneOf("xz", "bzip2", "gzip", "zstd", "none")},
+	{Name: "images.verify", Type: PropertyBool},
+	{Name: "images.zfs.", Type: PropertyString, validate: validateZFSPropertyName},
+	{Name: "ips.pool.", Type: PropertyString, validate: validateCIDR},
+	// Checked only when a pod bound to it starts (Pod.checkInterface),
+	// so that commands that don't need networking work without it
+	{Name: "jail.interface", Type: PropertyString, Required: true},
+	{Name: "jail.namePrefix", Type: PropertyString, Required: true},
+	{Name: "limits.min-free", Type: PropertySize},
+	{Name: "limits.pods", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "limits.quota", Type: PropertySize},
+	{Name: "linux.autoload", Type: PropertyBool},
+	{Name: "linux.devfs-ruleset", Type: PropertyInt},
+	{Name: "linux.shm-size", Type: PropertySize},
+	{Name: "lock.timeout", Type: PropertyDuration, validate: validateNotOff},
+	{Name: "log.compress", Type: PropertyBool},
+	{Name: "log.keep", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "log.max-age", Type: PropertyDuration},
+	{Name: "log.max-size", Type: PropertySize},
+	{Name: "log.timestamps", Type: PropertyBool},
+	{Name: "mds.embed", Type: PropertyBool},
+	{Name: "mds.enable", Type: PropertyBool},
+	{Name: "mds.keep-uid", Type: PropertyBool},
+	{Name: "mds.logfile", Type: PropertyString},
+	{Name: "mds.pidfile", Type: PropertyString},
+	{Name: "mds.port", Type: PropertyInt, Required: true, validate: validatePositive},
+	{Name: "mds.socket", Type: PropertyString, Required: true},
+	{Name: "mds.token-key", Type: PropertyString, validate: validateHex},
+	{Name: "mds.user", Type: PropertyString, Required: true},
+	{Name: "metrics.listen", Type: PropertyString},
+	{Name: "mount.", Type: PropertyBool},
+	{Name: "nat.enable", Type: PropertyBool},
+	{Name: "nat.external-interface", Type: PropertyString},
+	{Name: "net.accounting", Type: PropertyBool},
+	{Name: "net.isolate", Type: PropertyBool},
+	{Name: "path.libexec", Type: PropertyString, Required: true},
+	{Name: "path.prefix", Type: PropertyString},
+	{Name: "path.share", Type: PropertyString},
+	{Name: "pods.zfs.", Type: PropertyString, validate: validateZFSPropertyName},
+	{Name: "presets.", Type: PropertyString, validate: validatePreset},
+	{Name: "rctl.enforce.", Type: PropertyString, validate: validateRctlEnforcement},
+	{Name: "rctl.maxproc", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "rctl.maxproc.alert", Type: PropertyBool},
+	{Name: "rctl.memory.action", Type: PropertyString, validate: validateOneOf("deny", "devctl", "log", "sigterm", "sigkill")},
+	{Name: "rctl.openfiles", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "rctl.openfiles.alert", Type: PropertyBool},
+	{Name: "rctl.pseudoterminals", Type: PropertyInt, validate: validateNonNegative},
+	{Name: "rctl.pseudoterminals.alert", Type: PropertyBool},
+	{Name: "rctl.required", Type: PropertyBool},
+	{Name: "readonly.writable-paths", Type: PropertyString},
+	{Name: "root.zfs", Type: PropertyString, Required: true},
+	{Name: "root.zfs.", Type: PropertyString},
+	{Name: "stats.history", Type: PropertyInt, validate: validatePositive},
+	{Name: "stats.interval", Type: PropertyDuration},
+	{Name: "storage.class.", Type: PropertyString, validate: validateStorageClass},
+	{Name: "storage.default-class", Type: PropertyString, validate: validateDefaultStorageClass},
+	{Name: "storage.limit", Type: PropertySize},
+	{Name: "storage.reservation", Type: PropertySize},
+	{Name: "timeout.jail", Type: PropertyDuration},
+	{Name: "timeout.system", Type: PropertyDuration},
+	{Name: "timeout.zfs", Type: PropertyDuration},
+	{Name: "tmpfs.tmp", Type: PropertySize},
+	{Name: "version.git", Type: PropertyString},
+	{Name: "volumes.zfs.", Type: PropertyString, validate: validateZFSPropertyName},
+}
+
+// Returns the known configuration properties with their defaults,
+// sorted by name.
+func (h *Host) PropertySchema() []PropertySpec {
+	defaults := properties.MustLoadString(string(defaultConfig))
+	rv := make([]PropertySpec, len(propertySchema))
+	for i, ps := range propertySchema {
+		rv[i] = *ps
+		rv[i].validate = nil
+		rv[i].Default, _ = defaults.Get(ps.Name)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+func lookupPropertySpec(name string) *PropertySpec {
+	var rv *PropertySpec
+	for _, ps := range propertySchema {
+		// Exact names win over families (root.zfs vs root.zfs.)
+		if ps.matches(name) && (rv == nil || ps.Name == name) {
+			rv = ps
+		}
+	}
+	return rv
+}
+
+// Checks configuration against the schema. Returns a list of
+// problems with known properties, and names of unknown ones.
+func checkConfig(props *properties.Properties) (problems []string, unknown []string) {
+	keys := props.Keys()
+	sort.Strings(keys)
+	seen := make(map[*PropertySpec]bool)
+	for _, key := range keys {
+		ps := lookupPropertySpec(key)
+		if ps == nil {
+			unknown = append(unknown, key)
+			continue
+		}
+		seen[ps] = true
+		value, _ := props.Get(key)
+		if err := ps.check(key, value); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, ps := range propertySchema {
+		if ps.Required && !seen[ps] {
+			problems = append(problems, ps.Name+" is required")
+		}
+	}
+	return problems, unknown
+}
+
+// Validates loaded configuration; warns about unknown properties,
+// which are most likely typos.
+func (h *Host) validateConfig(props *properties.Properties) error {
+	problems, unknown := checkConfig(props)
+	for _, key := range unknown {
+		h.log().Warnf("Unknown configuration property %v", key)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("Invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package jetpack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties"
+)
+
+func TestCheckConfig(t *testing.T) {
+	props := properties.MustLoadString(string(defaultConfig))
+	if problems, unknown := checkConfig(props); len(problems) != 0 || len(unknown) != 0 {
+		t.Fatalf("Unexpected problems %v, unknown %v in default config", problems, unknown)
+	}
+
+	props.Set("jail.interface", "no-such-if0")
+	props.Set("ips.pool.lo1", "10.1.0.0/33")
+	props.Set("mount.procfs", "sometimes")
+	props.Set("stats.history", "0")
+	props.Set("root.zfs", "")
+	props.Set("root.zfs.recordsize", "16k")
+	props.Set("jail.intreface", "lo1")
+	props.Set("mds.user", "")
+	problems, unknown := checkConfig(props)
+	expected := []string{
+		"ips.pool.lo1: invalid network \"10.1.0.0/33\"",
+		"mds.user is required",
+		"mount.procfs: invalid boolean \"sometimes\"",
+		"root.zfs is required",
+		"stats.history: must be positive",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected problems:\n%v\ngot:\n%v", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+	if !reflect.DeepEqual(unknown, []string{"jail.intreface"}) {
+		t.Errorf("Unexpected unknown properties %v", unknown)
+	}
+}
+
+func TestPropertySchema(t *testing.T) {
+	schema := (&Host{}).PropertySchema()
+	found := false
+	for i, ps := range schema {
+		if i > 0 && schema[i-1].Name > ps.Name {
+			t.Errorf("Schema not sorted at %v", ps.Name)
+		}
+		if ps.Name == "lock.timeout" {
+			found = true
+			if ps.Default != "5m" || ps.Type != PropertyDuration {
+				t.Errorf("Unexpected spec %#v", ps)
+			}
+		}
+	}
+	if !found {
+		t.Error("lock.timeout not in schema")
+	}
+	if ps := lookupPropertySpec("root.zfs"); ps == nil || ps.Name != "root.zfs" {
+		t.Errorf("Expected exact spec for root.zfs, got %#v", ps)
+	}
+	if ps := lookupPropertySpec("root.zfs.atime"); ps == nil || ps.Name != "root.zfs." {
+		t.Errorf("Expected family spec for root.zfs.atime, got %#v", ps)
+	}
+}
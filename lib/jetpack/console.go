@@ -0,0 +1,45 @@
+package jetpack
+
+import (
+	"path/filepath"
+
+	"github.com/appc/spec/schema"
+	"github.com/juju/errors"
+)
+
+// Shells tried in order when there's no login(1) nor user's shell
+var consoleShells = []string{"/bin/sh", "/bin/bash"}
+
+// Returns command to open console as username in an image, and
+// whether it's login(1), which needs to be run as root. The override
+// command is used if set. FreeBSD images use login(1) if they have
+// it; otherwise, user's shell from the image's passwd is used (unless
+// it's a nologin one), and then first of the consoleShells found.
+// exists tells whether a path exists in the app's rootfs.
+func consoleExec(manifest *schema.ImageManifest, username, userShell, override string, exists func(string) bool) ([]string, bool, error) {
+	if override != "" {
+		if !filepath.IsAbs(override) {
+			return nil, false, errors.Errorf("Console shell %#v needs an absolute path", override)
+		}
+		return []string{override}, false, nil
+	}
+
+	isLinux := false
+	if manifest != nil {
+		os_, _ := manifest.GetLabel("os")
+		isLinux = os_ == "linux"
+	}
+	if !isLinux && exists("/usr/bin/login") {
+		return []string{"/usr/bin/login", "-p", "-f", username}, true, nil
+	}
+
+	if userShell != "" && filepath.IsAbs(userShell) && filepath.Base(userShell) != "nologin" && userShell != "/usr/bin/false" && exists(userShell) {
+		return []string{userShell}, false, nil
+	}
+	for _, shell := range consoleShells {
+		if exists(shell) {
+			return []string{shell}, false, nil
+		}
+	}
+	return nil, false, errors.Errorf("No shell found for console (tried /usr/bin/login, user's shell, %v)", consoleShells)
+}
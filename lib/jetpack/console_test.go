@@ -0,0 +1,54 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestConsoleExec(t *testing.T) {
+	freebsd := schema.BlankImageManifest()
+	freebsd.Labels = types.Labels{{Name: "os", Value: "freebsd"}}
+	linux := schema.BlankImageManifest()
+	linux.Labels = types.Labels{{Name: "os", Value: "linux"}}
+
+	rootfs := func(paths ...string) func(string) bool {
+		return func(path string) bool { return stringIn(path, paths) }
+	}
+
+	for i, tc := range []struct {
+		manifest  *schema.ImageManifest
+		userShell string
+		override  string
+		exists    func(string) bool
+		exec      []string
+		login     bool
+	}{
+		{freebsd, "/bin/csh", "", rootfs("/usr/bin/login", "/bin/csh", "/bin/sh"), []string{"/usr/bin/login", "-p", "-f", "user"}, true},
+		{nil, "", "", rootfs("/usr/bin/login"), []string{"/usr/bin/login", "-p", "-f", "user"}, true},
+		// Minimal image without login
+		{freebsd, "/bin/csh", "", rootfs("/bin/csh", "/bin/sh"), []string{"/bin/csh"}, false},
+		{freebsd, "/usr/sbin/nologin", "", rootfs("/usr/sbin/nologin", "/bin/sh"), []string{"/bin/sh"}, false},
+		// Linux never uses login
+		{linux, "/bin/bash", "", rootfs("/usr/bin/login", "/bin/bash", "/bin/sh"), []string{"/bin/bash"}, false},
+		{linux, "/bin/zsh", "", rootfs("/usr/bin/login", "/bin/sh"), []string{"/bin/sh"}, false},
+		{linux, "", "", rootfs("/bin/bash"), []string{"/bin/bash"}, false},
+		// Override wins
+		{freebsd, "/bin/csh", "/usr/local/bin/fish", rootfs("/usr/bin/login"), []string{"/usr/local/bin/fish"}, false},
+	} {
+		if exec, login, err := consoleExec(tc.manifest, "user", tc.userShell, tc.override, tc.exists); err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if !reflect.DeepEqual(exec, tc.exec) || login != tc.login {
+			t.Errorf("%d: got %v %v, expected %v %v", i, exec, login, tc.exec, tc.login)
+		}
+	}
+
+	if exec, _, err := consoleExec(linux, "user", "", "", rootfs()); err == nil {
+		t.Errorf("Expected error for empty rootfs, got %v", exec)
+	}
+	if exec, _, err := consoleExec(linux, "user", "", "sh", rootfs("/bin/sh")); err == nil {
+		t.Errorf("Expected error for relative override, got %v", exec)
+	}
+}
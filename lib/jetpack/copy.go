@@ -0,0 +1,577 @@
+package jetpack
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/3ofcoins/jetpack/lib/passwd"
+)
+
+// Pod.CopyTo and Pod.CopyFrom copy files and directory trees between
+// the host and an app's filesystem (or a volume), as the app sees it.
+// Pod paths are resolved like the app would resolve them: symlinks,
+// absolute ones included, are followed within the app's root, so that
+// they can't point outside of it. Mounts from pod's fstab are looked
+// up when resolving, so volumes can be copied to and from whether the
+// jail is running or not; mounts other than nullfs exist only while
+// it's running. Copies keep mode, ownership, and modification times
+// (like `cp -Rp`); symlinks in copied trees are copied as they are,
+// and the copy refuses to write through symlinks in the pod. As the
+// pod's processes can swap a directory for a symlink after a path is
+// resolved, pod files are opened relative to their directories, from
+// the app's root or a mount's source down, without following
+// symlinks.
+
+// Where pod's files are copied to or from
+type CopyOptions struct {
+	App    types.ACName // app whose filesystem pod paths are in; the only app if empty
+	Volume types.ACName // volume that pod paths are in, instead of an app
+	Chown  bool         // CopyTo: give copied files to the app's user
+}
+
+// Filesystem of an app or a volume, as seen from the host
+type podFS struct {
+	root    string // host path of "/"
+	desc    string // e.g. "app web"
+	mounts  []fstabEntry
+	running bool
+}
+
+// A pod path's host path, and the mount it's on
+type podFSPath struct {
+	path     string // in the app
+	hostPath string
+	base     string      // host directory that hostPath is under: app's root, or a mount's source
+	mount    *fstabEntry // nil if on the app's rootfs
+}
+
+func (pod *Pod) copyFS(opts *CopyOptions) (*podFS, error) {
+	fs := &podFS{running: pod.Status() == PodStatusRunning}
+	if fstab, err := ioutil.ReadFile(pod.Path("fstab")); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	} else if fs.mounts, err = parseFstab(string(fstab)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if opts.Volume != "" {
+		if opts.App != "" {
+			return nil, errors.New("Copy can be from an app or from a volume, not both")
+		}
+		found := false
+		for _, vol := range pod.Manifest.Volumes {
+			found = found || vol.Name == opts.Volume
+		}
+		if !found {
+			return nil, errors.Errorf("Pod %v has no volume %v", pod.UUID, opts.Volume)
+		}
+		fs.root = pod.Path("rootfs", "vol", opts.Volume.String())
+		fs.desc = "volume " + opts.Volume.String()
+		return fs, nil
+	}
+	name := opts.App
+	if name == "" {
+		if len(pod.Manifest.Apps) != 1 {
+			return nil, errors.Errorf("Pod %v has %d apps, app needs to be given", pod.UUID, len(pod.Manifest.Apps))
+		}
+		name = pod.Manifest.Apps[0].Name
+	}
+	for i, rtApp := range pod.Manifest.Apps {
+		if rtApp.Name == name {
+			fs.root = pod.Path("rootfs", strconv.Itoa(i))
+			fs.desc = "app " + name.String()
+			return fs, nil
+		}
+	}
+	return nil, errors.Errorf("Pod %v has no app %v", pod.UUID, name)
+}
+
+// Returns host path of path in fs, following nullfs mounts (a volume's
+// mount in the app, and a host volume's mount on the volume), the host
+// directory it's under (fs's root, or the last nullfs mount's source),
+// and the mount it's on: the first read-only one on the way, or the
+// last one.
+func (fs *podFS) hostPath(p string) (string, string, *fstabEntry, error) {
+	hostPath, base := filepath.Join(fs.root, p), fs.root
+	var mount, readOnly *fstabEntry
+	for range fs.mounts {
+		var found *fstabEntry
+		for i, e := range fs.mounts {
+			target := filepath.Clean(e.Target)
+			if pathUnder(hostPath, target) && (found == nil || len(target) > len(filepath.Clean(found.Target))) {
+				found = &fs.mounts[i]
+			}
+		}
+		if found == nil || found == mount {
+			break
+		}
+		mount = found
+		if readOnly == nil && mountReadOnly(found) {
+			readOnly = found
+		}
+		if found.FSType != "nullfs" {
+			if !fs.running {
+				return "", "", nil, errors.Errorf("%v is on a %v mount, which exists only while the pod is running", p, found.FSType)
+			}
+			break
+		}
+		rel, _ := filepath.Rel(filepath.Clean(found.Target), hostPath)
+		hostPath, base = filepath.Join(found.Source, rel), filepath.Clean(found.Source)
+	}
+	if readOnly != nil {
+		return hostPath, base, readOnly, nil
+	}
+	return hostPath, base, mount, nil
+}
+
+func mountReadOnly(e *fstabEntry) bool {
+	for _, opt := range strings.Split(e.Options, ",") {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// Maximum number of symlinks followed when resolving a path
+const maxCopySymlinks = 40
+
+// Resolves p (absolute, or relative to "/") in fs, following symlinks
+// within fs.
+func (fs *podFS) resolve(p string) (*podFSPath, error) {
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, elem)
+		hostPath, _, _, err := fs.hostPath(next)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		fi, err := os.Lstat(hostPath)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if links++; links > maxCopySymlinks {
+				return nil, errors.Errorf("Too many symlinks in %v", p)
+			}
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if path.IsAbs(target) {
+				resolved = "/"
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Trace(err)
+		}
+		resolved = next
+	}
+	hostPath, base, mount, err := fs.hostPath(resolved)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &podFSPath{path: resolved, hostPath: hostPath, base: base, mount: mount}, nil
+}
+
+// Returns an error if files can't be written at fp because it's on a
+// read-only mount.
+func (fs *podFS) checkWritable(fp *podFSPath) error {
+	if fp.mount == nil || !mountReadOnly(fp.mount) {
+		return nil
+	}
+	return errors.Errorf("Cannot copy to %v in %v: %v is a read-only %v mount of %v",
+		fp.path, fs.desc, fs.podPath(fp.mount.Target), fp.mount.FSType, fp.mount.Source)
+}
+
+// Returns an error for a copy to fp that failed because its file
+// system is read-only (e.g. a read-only rootfs dataset), naming the
+// mount it's on.
+func (fs *podFS) readOnlyError(fp *podFSPath) error {
+	target := ""
+	if mounts, err := mountPoints(); err == nil {
+		for _, m := range mounts {
+			if pathUnder(fp.hostPath, filepath.Clean(m)) && len(m) > len(target) {
+				target = filepath.Clean(m)
+			}
+		}
+	}
+	if target == "" {
+		return errors.Errorf("Cannot copy to %v in %v: file system is read-only", fp.path, fs.desc)
+	}
+	return errors.Errorf("Cannot copy to %v in %v: %v is a read-only mount (%v)",
+		fp.path, fs.desc, fs.podPath(target), target)
+}
+
+// Returns host path as a path in fs, if it's under fs's root.
+func (fs *podFS) podPath(hostPath string) string {
+	if rel, err := filepath.Rel(fs.root, hostPath); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.Join("/", rel)
+	}
+	return filepath.Clean(hostPath)
+}
+
+// Copies hostPath on the host to podPath in the pod. If podPath is an
+// existing directory, hostPath is copied into it.
+func (pod *Pod) CopyTo(hostPath, podPath string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	fs, err := pod.copyFS(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Host's symlinks are followed
+	hostPath, err = filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var owner *[2]int
+	if opts.Chown {
+		if opts.Volume != "" {
+			return errors.New("Copied files can be given to an app's user only when copying to an app")
+		}
+		name := opts.App
+		if name == "" {
+			name = pod.Manifest.Apps[0].Name
+		}
+		app := pod.App(name)
+		if app == nil {
+			return errors.Errorf("Pod %v has no app %v", pod.UUID, name)
+		}
+		if owner, err = app.owner(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	dst, err := fs.resolve(podPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if dfi, err := os.Stat(dst.hostPath); err == nil && dfi.IsDir() {
+		if dst, err = fs.resolve(path.Join(dst.path, filepath.Base(hostPath))); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := fs.checkWritable(dst); err != nil {
+		return errors.Trace(err)
+	}
+	pod.log().Debugf("Copying %v to %v in %v (%v)", hostPath, dst.path, fs.desc, dst.hostPath)
+	srcDir, err := os.Open(filepath.Dir(hostPath))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer srcDir.Close()
+	dstDir, dstName, err := openParentNoFollow(dst)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dstDir.Close()
+	if err := copyTreeAt(srcDir, filepath.Base(hostPath), dstDir, dstName, owner); err != nil {
+		if isReadOnlyFS(err) {
+			return errors.Trace(fs.readOnlyError(dst))
+		}
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Copies podPath in the pod to hostPath on the host. If hostPath is an
+// existing directory, podPath is copied into it.
+func (pod *Pod) CopyFrom(podPath, hostPath string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	fs, err := pod.copyFS(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	src, err := fs.resolve(podPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := os.Stat(src.hostPath); err != nil {
+		return errors.Errorf("Cannot copy %v from %v: %v", podPath, fs.desc, err)
+	}
+	if dfi, err := os.Stat(hostPath); err == nil && dfi.IsDir() {
+		hostPath = filepath.Join(hostPath, path.Base(src.path))
+	}
+	pod.log().Debugf("Copying %v in %v (%v) to %v", src.path, fs.desc, src.hostPath, hostPath)
+	srcDir, srcName, err := openParentNoFollow(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer srcDir.Close()
+	dstDir, err := os.Open(filepath.Dir(hostPath))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dstDir.Close()
+	return errors.Trace(copyTreeAt(srcDir, srcName, dstDir, filepath.Base(hostPath), nil))
+}
+
+// Returns uid and gid of app's user, as resolved in its image.
+func (app *App) owner() (*[2]int, error) {
+	pwf, err := app.readPasswd()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	grf, err := passwd.ReadGroup(app.Path("etc", "group"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pwent, err := resolveUser(pwf, grf, app.app.User, app.app.Group)
+	if err != nil {
+		return nil, errors.Annotatef(err, "App %v", app.Name)
+	}
+	return &[2]int{pwent.Uid, pwent.Gid}, nil
+}
+
+func isReadOnlyFS(err error) bool {
+	perr, ok := errors.Cause(err).(*os.PathError)
+	return ok && perr.Err == syscall.EROFS
+}
+
+// Opens the directory that fp is in, walking down from its base
+// without following symlinks, and returns it with fp's name in it.
+func openParentNoFollow(fp *podFSPath) (*os.File, string, error) {
+	return walkParentNoFollow(fp, false, 0)
+}
+
+// Opens the directory that fp is in, as openParentNoFollow, creating
+// missing directories on the way with mode.
+func mkdirParentNoFollow(fp *podFSPath, mode uint32) (*os.File, string, error) {
+	return walkParentNoFollow(fp, true, mode)
+}
+
+func walkParentNoFollow(fp *podFSPath, mkdir bool, mode uint32) (*os.File, string, error) {
+	rel, err := filepath.Rel(fp.base, fp.hostPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, "", errors.Errorf("%v is not under %v", fp.hostPath, fp.base)
+	}
+	if rel == "." {
+		// The base itself, in a trusted directory
+		dir, err := os.Open(filepath.Dir(fp.hostPath))
+		return dir, filepath.Base(fp.hostPath), errors.Trace(err)
+	}
+	dir, err := os.Open(fp.base)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	elems := strings.Split(rel, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		if mkdir {
+			if err := unix.Mkdirat(int(dir.Fd()), elem, mode); err != nil && err != unix.EEXIST {
+				dir.Close()
+				return nil, "", errors.Trace(&os.PathError{Op: "mkdir", Path: filepath.Join(dir.Name(), elem), Err: err})
+			}
+		}
+		next, err := openAt(dir, elem, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		dir.Close()
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		dir = next
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+// Opens p, a path in root, without following symlinks.
+func openNoFollow(root, p string, flags int, mode uint32) (*os.File, error) {
+	dir, name, err := openParentNoFollow(&podFSPath{path: p, hostPath: filepath.Join(root, p), base: root})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer dir.Close()
+	f, err := openAt(dir, name, flags, mode)
+	return f, errors.Trace(err)
+}
+
+// Opens name in dir, failing if it's a symlink.
+func openAt(dir *os.File, name string, flags int, mode uint32) (*os.File, error) {
+	p := filepath.Join(dir.Name(), name)
+	fd, err := unix.Openat(int(dir.Fd()), name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if err == nil {
+		return os.NewFile(uintptr(fd), p), nil
+	}
+	// FreeBSD's open(2) fails with EMLINK on a symlink, and Linux's
+	// with ENOTDIR if a directory is expected
+	var st unix.Stat_t
+	if err == unix.ELOOP || err == unix.EMLINK ||
+		(err == unix.ENOTDIR && unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK) {
+		return nil, errors.Errorf("Refusing to follow symlink %v", p)
+	}
+	return nil, &os.PathError{Op: "open", Path: p, Err: err}
+}
+
+// Copies srcName in srcDir to dstName in dstDir, like `cp -Rp`, opening
+// files relative to their directories without following symlinks.
+// Owner is uid and gid to give the copies; nil to keep the source's.
+// Refuses to write through a symlink at the destination.
+func copyTreeAt(srcDir *os.File, srcName string, dstDir *os.File, dstName string, owner *[2]int) error {
+	src, dst := filepath.Join(srcDir.Name(), srcName), filepath.Join(dstDir.Name(), dstName)
+	var st, dstSt unix.Stat_t
+	if err := unix.Fstatat(int(srcDir.Fd()), srcName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Trace(&os.PathError{Op: "lstat", Path: src, Err: err})
+	}
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if err := unix.Fstatat(int(dstDir.Fd()), dstName, &dstSt, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		if dstSt.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return errors.Errorf("Refusing to write through symlink %v", dst)
+		} else if isDir != (dstSt.Mode&unix.S_IFMT == unix.S_IFDIR) {
+			return errors.Errorf("Cannot copy %v to %v: one is a directory, and the other is not", src, dst)
+		}
+	} else if err != unix.ENOENT {
+		return errors.Trace(&os.PathError{Op: "lstat", Path: dst, Err: err})
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		in, err := openAt(srcDir, srcName, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer in.Close()
+		if err := unix.Mkdirat(int(dstDir.Fd()), dstName, 0700); err != nil && err != unix.EEXIST {
+			return errors.Trace(&os.PathError{Op: "mkdir", Path: dst, Err: err})
+		}
+		out, err := openAt(dstDir, dstName, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer out.Close()
+		names, err := in.Readdirnames(-1)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := copyTreeAt(in, name, out, name, owner); err != nil {
+				return err
+			}
+		}
+		return errors.Trace(copyMetadata(out, &st, owner))
+	case unix.S_IFREG:
+		in, err := openAt(srcDir, srcName, unix.O_RDONLY, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer in.Close()
+		out, err := openAt(dstDir, dstName, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// Contents are streamed, as copied files may be large
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return errors.Trace(err)
+		}
+		if err := copyMetadata(out, &st, owner); err != nil {
+			out.Close()
+			return errors.Trace(err)
+		}
+		return errors.Trace(out.Close())
+	case unix.S_IFLNK:
+		target, err := readlinkAt(srcDir, srcName)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := unix.Symlinkat(target, int(dstDir.Fd()), dstName); err != nil {
+			return errors.Trace(&os.PathError{Op: "symlink", Path: dst, Err: err})
+		}
+		uid, gid := copyOwner(&st, owner)
+		if err := unix.Fchownat(int(dstDir.Fd()), dstName, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return errors.Trace(&os.PathError{Op: "lchown", Path: dst, Err: err})
+		}
+		return nil
+	default:
+		return errors.Errorf("Cannot copy %v: not a regular file, directory, or symlink", src)
+	}
+}
+
+// Copies host's source to dest, a path in rootfs, like `cp -Rp`,
+// without following symlinks in rootfs: missing directories of dest
+// are created, and if dest is a directory, source is copied into it.
+// Symlinks in source are copied as they are, source included.
+func copyIntoRootfs(rootfs, source, dest string) error {
+	srcDir, err := os.Open(filepath.Dir(source))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer srcDir.Close()
+	srcName := filepath.Base(source)
+	dir, name, err := mkdirParentNoFollow(&podFSPath{path: dest, hostPath: filepath.Join(rootfs, dest), base: rootfs}, 0755)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() { dir.Close() }()
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		into, err := openAt(dir, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		dir.Close()
+		dir, name = into, srcName
+	}
+	return errors.Trace(copyTreeAt(srcDir, srcName, dir, name, nil))
+}
+
+// Returns target of symlink name in dir.
+func readlinkAt(dir *os.File, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(int(dir.Fd()), name, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: filepath.Join(dir.Name(), name), Err: err}
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// Returns uid and gid to give a copy of a file with st: owner's if
+// it's not nil, or the file's.
+func copyOwner(st *unix.Stat_t, owner *[2]int) (int, int) {
+	if owner != nil {
+		return owner[0], owner[1]
+	}
+	return int(st.Uid), int(st.Gid)
+}
+
+// Sets ownership, mode, and modification time of open file f to st's,
+// or ownership to owner if it's not nil.
+func copyMetadata(f *os.File, st *unix.Stat_t, owner *[2]int) error {
+	fd := int(f.Fd())
+	uid, gid := copyOwner(st, owner)
+	// Chown clears setuid and setgid bits, so it goes first
+	if err := unix.Fchown(fd, uid, gid); err != nil {
+		return &os.PathError{Op: "chown", Path: f.Name(), Err: err}
+	}
+	if err := unix.Fchmod(fd, uint32(st.Mode)&07777); err != nil {
+		return &os.PathError{Op: "chmod", Path: f.Name(), Err: err}
+	}
+	mtime := unix.NsecToTimeval(unix.TimespecToNsec(st.Mtim))
+	if err := unix.Futimes(fd, []unix.Timeval{mtime, mtime}); err != nil {
+		return &os.PathError{Op: "utimes", Path: f.Name(), Err: err}
+	}
+	return nil
+}
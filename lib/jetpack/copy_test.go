@@ -0,0 +1,246 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestPodFSResolve(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "rootfs")
+	for _, dir := range []string{"rootfs/etc", "rootfs/data", "rootfs/tmp", "vol/data", "host/data"} {
+		if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"rootfs/etc/abs":    "/etc/passwd",
+		"rootfs/etc/escape": "../../../../../etc",
+		"rootfs/etc/loop":   "loop",
+		"rootfs/srv":        "/data",
+	} {
+		if err := os.Symlink(target, filepath.Join(tmp, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := &podFS{root: root, desc: "app test", mounts: []fstabEntry{
+		{filepath.Join(tmp, "host/data"), filepath.Join(tmp, "vol/data"), "nullfs", "ro", 0},
+		{filepath.Join(tmp, "vol/data"), filepath.Join(root, "data"), "nullfs", "rw", 1},
+		{"tmpfs", filepath.Join(root, "tmp"), "tmpfs", "rw,mode=1777", 0},
+	}}
+
+	for p, expected := range map[string]string{
+		"/etc/passwd":       filepath.Join(root, "etc/passwd"),
+		"etc/abs":           filepath.Join(root, "etc/passwd"),
+		"/etc/escape/hosts": filepath.Join(root, "etc/hosts"),
+		"/../../etc":        filepath.Join(root, "etc"),
+		"/srv/file":         filepath.Join(tmp, "host/data/file"),
+		"/data":             filepath.Join(tmp, "host/data"),
+	} {
+		if fp, err := fs.resolve(p); err != nil {
+			t.Errorf("%v: %v", p, err)
+		} else if fp.hostPath != expected {
+			t.Errorf("%v: expected %v, got %v", p, expected, fp.hostPath)
+		}
+	}
+
+	if _, err := fs.resolve("/etc/loop"); err == nil || !strings.Contains(err.Error(), "Too many symlinks") {
+		t.Errorf("Expected symlink loop error, got %v", err)
+	}
+	if _, err := fs.resolve("/tmp/file"); err == nil || !strings.Contains(err.Error(), "tmpfs mount") {
+		t.Errorf("Expected tmpfs error for stopped pod, got %v", err)
+	}
+	fs.running = true
+	if fp, err := fs.resolve("/tmp/file"); err != nil || fp.hostPath != filepath.Join(root, "tmp/file") {
+		t.Errorf("Expected tmpfs path for running pod, got %v, %v", fp, err)
+	}
+
+	// Read-only host volume below a read-write mount
+	fp, err := fs.resolve("/srv/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.checkWritable(fp); err == nil || !strings.Contains(err.Error(), "read-only nullfs mount of "+filepath.Join(tmp, "host/data")) {
+		t.Errorf("Expected read-only mount error, got %v", err)
+	}
+	if fp, err := fs.resolve("/etc/file"); err != nil {
+		t.Error(err)
+	} else if err := fs.checkWritable(fp); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPodCopy(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	pod := fakeZFSPod(t, h, f)
+	pod.Manifest.Apps = schema.AppList{{Name: *types.MustACName("app")}}
+	if err := os.MkdirAll(pod.Path("rootfs", "0", "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", pod.Path("rootfs", "0", "conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(h.Path(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(src, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Into an existing directory, through a symlink
+	if err := pod.CopyTo(src, "/conf", nil); err != nil {
+		t.Fatal(err)
+	}
+	copied := pod.Path("rootfs", "0", "etc", "src", "sub")
+	if bb, err := ioutil.ReadFile(filepath.Join(copied, "file")); err != nil || string(bb) != "hello" {
+		t.Errorf("Unexpected copy %q, %v", bb, err)
+	}
+	if fi, err := os.Stat(filepath.Join(copied, "file")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Unexpected mode %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(copied); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("Unexpected mode %v, %v", fi, err)
+	}
+	if target, err := os.Readlink(filepath.Join(copied, "link")); err != nil || target != "file" {
+		t.Errorf("Unexpected link %v, %v", target, err)
+	}
+
+	// And back, to a new name
+	dst := filepath.Join(h.Path(), "dst")
+	if err := pod.CopyFrom("/etc/src/sub/file", dst, &CopyOptions{App: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if bb, err := ioutil.ReadFile(dst); err != nil || string(bb) != "hello" {
+		t.Errorf("Unexpected copy %q, %v", bb, err)
+	}
+
+	// Writing through a symlink is refused
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "other"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(copied, "other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pod.CopyTo(src, "/etc", nil); err == nil || !strings.Contains(err.Error(), "Refusing to write through symlink") {
+		t.Errorf("Expected symlink error, got %v", err)
+	}
+
+	for _, opts := range []*CopyOptions{{App: "other"}, {Volume: "nope"}} {
+		if err := pod.CopyFrom("/etc", dst, opts); err == nil {
+			t.Errorf("%v: expected error", opts)
+		}
+	}
+}
+
+func TestOpenParentNoFollow(t *testing.T) {
+	root, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside := filepath.Join(root, "outside")
+	base := filepath.Join(root, "rootfs")
+	for _, dir := range []string{outside, filepath.Join(base, "etc")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fp := &podFSPath{path: "/etc/file", hostPath: filepath.Join(base, "etc", "file"), base: base}
+	if dir, name, err := openParentNoFollow(fp); err != nil {
+		t.Error(err)
+	} else {
+		if dir.Name() != filepath.Join(base, "etc") || name != "file" {
+			t.Errorf("Unexpected %v, %v", dir.Name(), name)
+		}
+		dir.Close()
+	}
+
+	// A directory swapped for a symlink after the path was resolved
+	if err := os.RemoveAll(filepath.Join(base, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if dir, _, err := openParentNoFollow(fp); err == nil {
+		dir.Close()
+		t.Error("Followed a symlink")
+	} else if !strings.Contains(err.Error(), "Refusing to follow symlink") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	fs := &podFS{root: base, desc: "app test"}
+	if p := fs.podPath(base); p != "/" {
+		t.Errorf("Expected /, got %v", p)
+	}
+	if p := fs.podPath(filepath.Join(base, "var", "db")); p != "/var/db" {
+		t.Errorf("Expected /var/db, got %v", p)
+	}
+}
+
+func TestCopyIntoRootfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, rootfs, outside := filepath.Join(root, "src"), filepath.Join(root, "rootfs"), filepath.Join(root, "outside")
+	writeTestFiles(t, src, map[string]string{"tree/a": "a", "file": "file"})
+	if err := os.Symlink("a", filepath.Join(src, "tree", "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{filepath.Join(rootfs, "work"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Into an existing directory, creating missing ones
+	for _, tc := range [][2]string{{"tree", "/work"}, {"file", "/opt/app/file.conf"}} {
+		if err := copyIntoRootfs(rootfs, filepath.Join(src, tc[0]), tc[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(rootfs, "work", "tree", "a")); err != nil || string(bb) != "a" {
+		t.Errorf("Unexpected copy %q, %v", bb, err)
+	}
+	if target, err := os.Readlink(filepath.Join(rootfs, "work", "tree", "link")); err != nil || target != "a" {
+		t.Errorf("Symlink not copied: %v, %v", target, err)
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "app", "file.conf")); err != nil || string(bb) != "file" {
+		t.Errorf("Unexpected copy %q, %v", bb, err)
+	}
+
+	// Symlinks in rootfs are not followed
+	if err := os.Symlink(outside, filepath.Join(rootfs, "usr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyIntoRootfs(rootfs, filepath.Join(src, "file"), "/usr/local/file"); err == nil {
+		t.Error("Followed a symlink")
+	}
+	if err := copyIntoRootfs(rootfs, filepath.Join(src, "file"), "/usr"); err == nil {
+		t.Error("Wrote through a symlink")
+	}
+	if names, _ := ioutil.ReadDir(outside); len(names) != 0 {
+		t.Errorf("Files written outside rootfs: %v", names)
+	}
+}
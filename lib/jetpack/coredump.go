@@ -0,0 +1,202 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// What happens to core dumps of pod's apps is decided by its core dump
+// policy: the jetpack/coredump annotation, or the coredump.policy host
+// property, recorded in the annotation when the pod is created.
+//
+//  - "host" leaves it to the host: cores are written as kern.corefile
+//    says, and nothing cleans them up
+//  - "off" sets apps' core rlimit to 0, so that no cores are written
+//  - "pod" collects cores in the pod's cores/ directory, which is
+//    mounted at /cores in every app
+//
+// kern.corefile is global, so the kernel doesn't know about pods'
+// directories: a relative pattern (the default "%N.core") puts cores
+// in the crashing process' working directory, and an absolute one is
+// resolved in the app's root. Cores land in the pod's directory only
+// with a pattern under /cores (e.g. "/cores/%N.%P.core"); a warning is
+// logged when the pod starts otherwise. With such a pattern, processes
+// without a /cores directory (on the host, or in other pods) can't
+// dump core.
+//
+// Core size is limited by the jetpack/coredump/size annotation or the
+// coredump.size host property, as the core rlimit, unless an explicit
+// jetpack/rlimit/core annotation sets it. Collected cores older than
+// coredump.max-age, or above coredump.max-size per pod (oldest first),
+// are removed by Host.Prune.
+
+const coredumpAnnotation = "jetpack/coredump"
+
+const (
+	CoredumpHost = "host"
+	CoredumpOff  = "off"
+	CoredumpPod  = "pod"
+)
+
+// Path at which apps see pod's cores directory
+const coresMountPoint = "/cores"
+
+// A core file collected in the pod's cores directory
+type CoreFile struct {
+	Name string
+	Size int64
+	Time time.Time
+}
+
+// Returns pod's core dump policy (CoredumpHost, CoredumpOff, or
+// CoredumpPod).
+func (pod *Pod) CoredumpPolicy() (string, error) {
+	policy, ok := pod.Manifest.Annotations.Get(coredumpAnnotation)
+	if !ok {
+		policy = Config().GetString("coredump.policy", CoredumpHost)
+	}
+	switch policy {
+	case CoredumpHost, CoredumpOff, CoredumpPod:
+		return policy, nil
+	}
+	return "", errors.Errorf("Invalid core dump policy %#v of pod %v", policy, pod.UUID)
+}
+
+// Returns core size limit of the pod in bytes; 0 if none.
+func (pod *Pod) coredumpSize() (int64, error) {
+	if v, ok := pod.Manifest.Annotations.Get(coredumpAnnotation + "/size"); ok {
+		n, err := parseLogSize(v)
+		return n, errors.Annotatef(err, "%v/size annotation of pod %v", coredumpAnnotation, pod.UUID)
+	}
+	n, err := parseLogSize(Config().GetString("coredump.size", "off"))
+	return n, errors.Annotate(err, "coredump.size")
+}
+
+// Returns core rlimit spec that pod's core dump policy sets, as in
+// jetpack/rlimit/core annotation; "" if it doesn't set any.
+func (pod *Pod) coredumpRlimit() (string, error) {
+	policy, err := pod.CoredumpPolicy()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if policy == CoredumpOff {
+		return "0", nil
+	}
+	size, err := pod.coredumpSize()
+	if err != nil || size == 0 {
+		return "", errors.Trace(err)
+	}
+	return strconv.FormatInt(size, 10), nil
+}
+
+// Warns if cores of a pod with CoredumpPod policy won't be collected
+// with host's kern.corefile; called before the jail is created.
+func (pod *Pod) checkCoredump() {
+	if policy, _ := pod.CoredumpPolicy(); policy != CoredumpPod {
+		return
+	}
+	out, err := systemCommand("/sbin/sysctl", "-n", "kern.corefile").OutputString()
+	if err != nil {
+		pod.log().Warnf("cannot read kern.corefile: %v", err)
+		return
+	}
+	if warning := corefileWarning(strings.TrimSpace(out)); warning != "" {
+		pod.log().Warnf("%v", warning)
+	}
+}
+
+// Returns a warning if core files named after kern.corefile pattern
+// won't land in apps' /cores; "" if they will.
+func corefileWarning(pattern string) string {
+	if path := filepath.Clean(pattern); path == coresMountPoint || !pathUnder(path, coresMountPoint) {
+		return fmt.Sprintf("kern.corefile is %#v, core dumps won't be collected in %v; set it to e.g. %#v",
+			pattern, coresMountPoint, coresMountPoint+"/%N.%P.core")
+	}
+	return ""
+}
+
+// Returns core files in pod's cores directory, oldest first.
+func (pod *Pod) CoreFiles() ([]CoreFile, error) {
+	fis, err := ioutil.ReadDir(pod.Path("cores"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var cores []CoreFile
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			cores = append(cores, CoreFile{Name: fi.Name(), Size: fi.Size(), Time: fi.ModTime()})
+		}
+	}
+	sort.SliceStable(cores, func(i, j int) bool { return cores[i].Time.Before(cores[j].Time) })
+	return cores, nil
+}
+
+// Returns coredump.max-age (0 if off) and coredump.max-size (0 if
+// off).
+func coredumpRetention() (time.Duration, int64, error) {
+	var maxAge time.Duration
+	if str := Config().GetString("coredump.max-age", "off"); str != "off" && str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			return 0, 0, errors.Errorf("Invalid coredump.max-age %#v", str)
+		}
+		maxAge = d
+	}
+	maxSize, err := parseLogSize(Config().GetString("coredump.max-size", "off"))
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "coredump.max-size")
+	}
+	return maxAge, maxSize, nil
+}
+
+// Returns cores (oldest first) to remove: ones older than maxAge, and
+// the oldest of the rest while they take more than maxSize. Zero
+// maxAge or maxSize is no limit.
+func planCoreCleanup(cores []CoreFile, maxAge time.Duration, maxSize int64, now time.Time) []CoreFile {
+	var remove []CoreFile
+	var total int64
+	for _, core := range cores {
+		total += core.Size
+	}
+	for _, core := range cores {
+		if (maxAge > 0 && now.Sub(core.Time) > maxAge) || (maxSize > 0 && total > maxSize) {
+			remove = append(remove, core)
+			total -= core.Size
+		}
+	}
+	return remove
+}
+
+// Removes pod's cores past coredump.max-age and coredump.max-size;
+// in dry run, only returns them.
+func (pod *Pod) pruneCores(dryRun bool) ([]CoreFile, error) {
+	maxAge, maxSize, err := coredumpRetention()
+	if err != nil || (maxAge == 0 && maxSize == 0) {
+		return nil, errors.Trace(err)
+	}
+	cores, err := pod.CoreFiles()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var removed []CoreFile
+	for _, core := range planCoreCleanup(cores, maxAge, maxSize, time.Now()) {
+		if !dryRun {
+			pod.log().Debugf("Removing core file %v", core.Name)
+			if err := os.Remove(pod.Path("cores", core.Name)); err != nil && !os.IsNotExist(err) {
+				return removed, errors.Trace(err)
+			}
+		}
+		removed = append(removed, core)
+	}
+	return removed, nil
+}
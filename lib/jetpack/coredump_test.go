@@ -0,0 +1,145 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestCoredumpRlimit(t *testing.T) {
+	pod := newPod(nil, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name}}
+
+	if policy, err := pod.CoredumpPolicy(); err != nil || policy != CoredumpHost {
+		t.Errorf("Expected host policy by default, got %v, %v", policy, err)
+	}
+	if rls, err := pod.appRlimits(name); err != nil || len(rls) != 0 {
+		t.Errorf("Expected no rlimits, got %v, %v", rls, err)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/coredump/size", "1k")
+	if rls, err := pod.appRlimits(name); err != nil || !reflect.DeepEqual(rls, []Rlimit{{"core", "1024", "1024"}}) {
+		t.Errorf("Expected core size limit, got %v, %v", rls, err)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/coredump", "off")
+	if rls, err := pod.appRlimits(name); err != nil || !reflect.DeepEqual(rls, []Rlimit{{"core", "0", "0"}}) {
+		t.Errorf("Expected no cores, got %v, %v", rls, err)
+	}
+
+	// Explicit rlimit wins
+	pod.Manifest.Annotations.Set("jetpack/rlimit/core", "unlimited")
+	if rls, err := pod.appRlimits(name); err != nil || !reflect.DeepEqual(rls, []Rlimit{{"core", rlimInfinity, rlimInfinity}}) {
+		t.Errorf("Expected explicit core rlimit, got %v, %v", rls, err)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/coredump", "everywhere")
+	if err := pod.checkAppOptions(); err == nil {
+		t.Error("Invalid policy passed validation")
+	}
+	pod.Manifest.Annotations.Set("jetpack/coredump", "pod")
+	pod.Manifest.Annotations.Set("jetpack/coredump/size", "large")
+	if err := pod.checkAppOptions(); err == nil {
+		t.Error("Invalid size passed validation")
+	}
+}
+
+func TestCorefileWarning(t *testing.T) {
+	for pattern, ok := range map[string]bool{
+		"/cores/%N.%P.core": true,
+		"/cores/app/%N":     true,
+		"%N.core":           false,
+		"/var/crash/%N":     false,
+		"/cores":            false,
+		"/coresfoo/%N":      false,
+	} {
+		if warning := corefileWarning(pattern); (warning == "") != ok {
+			t.Errorf("%v: unexpected warning %#v", pattern, warning)
+		} else if !ok && !strings.Contains(warning, "/cores/%N.%P.core") {
+			t.Errorf("%v: warning doesn't suggest a pattern: %v", pattern, warning)
+		}
+	}
+}
+
+func TestPlanCoreCleanup(t *testing.T) {
+	now := time.Now()
+	cores := []CoreFile{
+		{"a.core", 100, now.Add(-72 * time.Hour)},
+		{"b.core", 300, now.Add(-48 * time.Hour)},
+		{"c.core", 200, now.Add(-24 * time.Hour)},
+		{"d.core", 100, now.Add(-time.Hour)},
+	}
+	for _, tc := range []struct {
+		maxAge   time.Duration
+		maxSize  int64
+		expected []CoreFile
+	}{
+		{0, 0, nil},
+		{60 * time.Hour, 0, cores[:1]},
+		{0, 400, cores[:2]},
+		{0, 300, cores[:2]},
+		{0, 250, cores[:3]},
+		{60 * time.Hour, 1000, cores[:1]},
+		{30 * time.Hour, 250, cores[:3]},
+	} {
+		if rv := planCoreCleanup(cores, tc.maxAge, tc.maxSize, now); !reflect.DeepEqual(rv, tc.expected) {
+			t.Errorf("%v, %v: expected %v, got %v", tc.maxAge, tc.maxSize, tc.expected, rv)
+		}
+	}
+}
+
+func TestPruneCores(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	pod := fakeZFSPod(t, h, f)
+
+	if cores, err := pod.CoreFiles(); err != nil || cores != nil {
+		t.Fatalf("Expected no cores, got %v, %v", cores, err)
+	}
+
+	if err := os.Mkdir(pod.Path("cores"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"new.core", "old.core"} {
+		if err := ioutil.WriteFile(pod.Path("cores", name), make([]byte, 10), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-time.Duration(i) * 48 * time.Hour)
+		if err := os.Chtimes(pod.Path("cores", name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cores, err := pod.CoreFiles()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cores) != 2 || cores[0].Name != "old.core" || cores[1].Name != "new.core" || cores[0].Size != 10 {
+		t.Fatalf("Unexpected cores %v", cores)
+	}
+
+	// Nothing to do without limits
+	if removed, err := pod.pruneCores(false); err != nil || removed != nil {
+		t.Errorf("Expected nothing removed, got %v, %v", removed, err)
+	}
+
+	Config().Set("coredump.max-age", "24h")
+	defer Config().Set("coredump.max-age", "off")
+	if removed, err := pod.pruneCores(true); err != nil || len(removed) != 1 || removed[0].Name != "old.core" {
+		t.Errorf("Expected old core, got %v, %v", removed, err)
+	}
+	if _, err := os.Stat(pod.Path("cores", "old.core")); err != nil {
+		t.Errorf("Dry run removed the core: %v", err)
+	}
+	if removed, err := pod.pruneCores(false); err != nil || len(removed) != 1 {
+		t.Errorf("Expected old core removed, got %v, %v", removed, err)
+	}
+	if cores, err := pod.CoreFiles(); err != nil || len(cores) != 1 || cores[0].Name != "new.core" {
+		t.Errorf("Expected new core left, got %v, %v", cores, err)
+	}
+}
@@ -0,0 +1,121 @@
+package jetpack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// Registry credentials are read from fetch.credentials (relative to
+// jetpack.conf's directory), in the same TOML subset as jetpack.toml,
+// with a table for each host pattern:
+//
+//     ["registry.example.com"]
+//     user = "deploy"
+//     password = "secret"
+//
+//     ["*.internal.example.com"]
+//     token = "..."
+//     allow-http = true
+//
+// Entries of ~/.netrc follow when fetch.netrc is on. The first
+// matching host pattern wins.
+
+// Returns path of the credentials file, or "" if disabled.
+func credentialsPath() string {
+	return configFilePath("fetch.credentials")
+}
+
+// Returns path of a file named by property, relative to jetpack.conf's
+// directory, or "" if it's off.
+func configFilePath(property string) string {
+	path := Config().GetString(property, "")
+	if path == "off" {
+		return ""
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if cfgPath, err := filepath.Abs(ConfigPath); err == nil {
+		return filepath.Join(filepath.Dir(cfgPath), path)
+	}
+	return path
+}
+
+// Reads credentials from a structured file. Missing file is not an
+// error.
+func (h *Host) readCredentials(path string) ([]*fetch.Credentials, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if fi.Mode().Perm()&0044 != 0 {
+		h.log().Warnf("%v is readable by other users", path)
+	}
+
+	entries, err := parseConfigFile(path, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var rv []*fetch.Credentials
+	byHost := make(map[string]*fetch.Credentials)
+	for _, entry := range entries {
+		dot := strings.LastIndex(entry.Name, ".")
+		if dot < 0 {
+			return nil, errors.Errorf("%v: %v: expected a [HOST] table", entry.Source, entry.Name)
+		}
+		host, key := entry.Name[:dot], entry.Name[dot+1:]
+		c := byHost[host]
+		if c == nil {
+			c = &fetch.Credentials{Host: host, Source: path}
+			byHost[host] = c
+			rv = append(rv, c)
+		}
+		switch key {
+		case "user":
+			c.User = entry.Value
+		case "password":
+			c.Password = entry.Value
+		case "token":
+			c.Token = entry.Value
+		case "allow-http":
+			c.AllowHTTP = entry.Value == "true" || entry.Value == "on"
+		default:
+			// Don't echo the value, it may be a secret
+			return nil, errors.Errorf("%v: unknown key %v", entry.Source, key)
+		}
+	}
+	return rv, nil
+}
+
+// Returns registry credentials from configuration.
+func (h *Host) loadCredentials() ([]*fetch.Credentials, error) {
+	var rv []*fetch.Credentials
+	if path := credentialsPath(); path != "" {
+		creds, err := h.readCredentials(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rv = creds
+	}
+	if Config().GetBool("fetch.netrc", true) {
+		netrc := os.Getenv("NETRC")
+		if netrc == "" {
+			netrc = filepath.Join(os.Getenv("HOME"), ".netrc")
+		}
+		if _, err := os.Stat(netrc); err == nil {
+			creds, err := fetch.ReadNetrc(netrc)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			rv = append(rv, creds...)
+		}
+	}
+	return rv, nil
+}
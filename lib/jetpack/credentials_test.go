@@ -0,0 +1,55 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCredentials(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{}
+
+	path := filepath.Join(tmp, "credentials.toml")
+	writeTestFiles(t, tmp, map[string]string{"credentials.toml": `
+["registry.example.com"]
+user = "deploy"
+password = "s3cret"
+
+["*.internal.example.com"]
+token = "t0ken"
+allow-http = true
+`})
+	os.Chmod(path, 0600)
+
+	creds, err := h.readCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 {
+		t.Fatalf("expected 2 entries, got %v", creds)
+	}
+	if c := creds[0]; c.Host != "registry.example.com" || c.User != "deploy" || c.Password != "s3cret" || c.AllowHTTP {
+		t.Errorf("unexpected entry %#v", c)
+	}
+	if c := creds[1]; c.Host != "*.internal.example.com" || c.Token != "t0ken" || !c.AllowHTTP {
+		t.Errorf("unexpected entry %#v", c)
+	}
+
+	if creds, err := h.readCredentials(filepath.Join(tmp, "missing.toml")); err != nil || creds != nil {
+		t.Errorf("missing file: %v, %v", creds, err)
+	}
+
+	writeTestFiles(t, tmp, map[string]string{"bad.toml": "[\"example.com\"]\npasword = \"s3cret\"\n"})
+	if _, err := h.readCredentials(filepath.Join(tmp, "bad.toml")); err == nil {
+		t.Error("expected error for unknown key")
+	} else if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks password: %v", err)
+	}
+}
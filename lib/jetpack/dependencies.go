@@ -0,0 +1,303 @@
+package jetpack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/run"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Dependencies of an image are resolved when it is imported: each one
+// is found in the store, or fetched if it has a name, and their
+// hashes are saved in the stored manifest and metadata. The rootfs is
+// rendered by cloning the first dependency, and copying rootfs of
+// each following one on top of it, in order; image's own rootfs is
+// unpacked last. An image with more than one dependency keeps a
+// snapshot of its rendered dependencies, which images with the same
+// resolved chain clone instead of rendering it again.
+
+// Snapshot of image's rootfs with rendered dependencies only
+const dependenciesSnapshotName = "deps"
+
+// Returned when dependencies of an image can't be found or
+// discovered.
+type MissingDependenciesError struct {
+	Image   types.ACIdentifier
+	Missing []types.Dependency
+}
+
+func (e *MissingDependenciesError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, dep := range e.Missing {
+		missing[i] = dependencyString(dep)
+	}
+	return fmt.Sprintf("Missing dependencies of %v: %v", e.Image, strings.Join(missing, "; "))
+}
+
+// Returned when an image depends, directly or not, on itself.
+type CircularDependencyError struct {
+	Chain []types.ACIdentifier // ends with the first image
+}
+
+func (e *CircularDependencyError) Error() string {
+	chain := make([]string, len(e.Chain))
+	for i, name := range e.Chain {
+		chain[i] = name.String()
+	}
+	return "Circular dependency: " + strings.Join(chain, " -> ")
+}
+
+func dependencyString(dep types.Dependency) string {
+	rv := dep.ImageName.String()
+	for _, label := range dep.Labels {
+		rv += fmt.Sprintf(",%v=%v", label.Name, label.Value)
+	}
+	if dep.ImageID != nil {
+		if rv != "" {
+			rv += " "
+		}
+		rv += dep.ImageID.String()
+	}
+	return rv
+}
+
+// Images whose dependencies are being fetched, with the images each
+// of them waits for
+type resolvingImages struct {
+	mx    sync.Mutex
+	waits map[types.ACIdentifier][]types.ACIdentifier
+}
+
+// Marks name as waiting for dep; returns function that unmarks it, or
+// CircularDependencyError if dep waits for name, directly or not.
+func (ri *resolvingImages) wait(name, dep types.ACIdentifier) (func(), error) {
+	ri.mx.Lock()
+	defer ri.mx.Unlock()
+	if chain := ri.chain(dep, name, make(map[types.ACIdentifier]bool)); chain != nil {
+		return nil, &CircularDependencyError{Chain: append([]types.ACIdentifier{name}, chain...)}
+	}
+	if ri.waits == nil {
+		ri.waits = make(map[types.ACIdentifier][]types.ACIdentifier)
+	}
+	ri.waits[name] = append(ri.waits[name], dep)
+	return func() {
+		ri.mx.Lock()
+		defer ri.mx.Unlock()
+		deps := ri.waits[name]
+		for i, d := range deps {
+			if d == dep {
+				ri.waits[name] = append(deps[:i:i], deps[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// Returns names from name to target, each waiting for the next one, or
+// nil if name doesn't wait for target.
+func (ri *resolvingImages) chain(name, target types.ACIdentifier, seen map[types.ACIdentifier]bool) []types.ACIdentifier {
+	if name == target {
+		return []types.ACIdentifier{name}
+	}
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+	for _, dep := range ri.waits[name] {
+		if chain := ri.chain(dep, target, seen); chain != nil {
+			return append([]types.ACIdentifier{name}, chain...)
+		}
+	}
+	return nil
+}
+
+// Finds or fetches dependencies of manifest, in order, and saves
+// their hashes in it. Missing dependencies are fetched concurrently, as
+// a part of fg (a new fetch if nil). All missing dependencies are
+// reported at once.
+func (h *Host) resolveDependencies(manifest *schema.ImageManifest, fg *fetchGroup) ([]*Image, error) {
+	if fg == nil {
+		fg = h.newFetchGroup(nil)
+		defer fg.cancel()
+	}
+
+	dimgs := make([]*Image, len(manifest.Dependencies))
+	errs := make([]error, len(manifest.Dependencies))
+	var wg sync.WaitGroup
+	for i, dep := range manifest.Dependencies {
+		wg.Add(1)
+		go func(i int, dep types.Dependency) {
+			defer wg.Done()
+			dimgs[i], errs[i] = fg.getDependency(manifest.Name, dep)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	var missing []types.Dependency
+	var failed error
+	for i, dep := range manifest.Dependencies {
+		err := errs[i]
+		if cause := errors.Cause(err); cause == ErrNotFound || cause == fetch.ErrDiscoveryFailed {
+			h.log().Debugf("dependency %v of %v: %v", dependencyString(dep), manifest.Name, err)
+			missing = append(missing, dep)
+		} else if err != nil {
+			// Report the failure that has canceled the fetch
+			if failed == nil || errors.Cause(failed) == errFetchCanceled && cause != errFetchCanceled {
+				failed = errors.Annotatef(err, "Dependency %v of %v", dependencyString(dep), manifest.Name)
+			}
+		} else {
+			// We get a copy of the dependency struct when iterating, not
+			// a pointer to it. We need to write to the slice's index to
+			// save the hash to the real manifest.
+			manifest.Dependencies[i].ImageID = dimgs[i].Hash
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	if len(missing) > 0 {
+		return nil, &MissingDependenciesError{Image: manifest.Name, Missing: missing}
+	}
+	return dimgs, nil
+}
+
+// Renders rootfs of img from its resolved dependencies.
+func (img *Image) renderDependencies(dimgs []*Image) error {
+	h := img.Host
+	dsName := path.Join(h.Dataset.Name, "images", img.UUID.String())
+	mountpoint := h.Dataset.Path("images", img.UUID.String(), "rootfs")
+	img.Dependencies = make([]types.Hash, len(dimgs))
+	for i, dimg := range dimgs {
+		img.Dependencies[i] = *dimg.Hash
+	}
+
+	props := h.imageZFSProperties(mountpoint)
+
+	if len(dimgs) > 1 {
+		if snap, err := h.renderedDependencies(img.Dependencies); err != nil {
+			return errors.Trace(err)
+		} else if snap != nil {
+			img.ui.Printf("Cloning rendered dependencies %v\n", snap.Name)
+			ds, err := cloneWithProperties(h.datasets(), snap.Name, dsName, props, "images.zfs.* settings")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			img.rootfs = ds
+			return nil
+		}
+	}
+
+	img.ui.Printf("Cloning parent %v as base rootfs\n", dimgs[0])
+	ds, err := cloneWithProperties(h.datasets(), dimgs[0].getRootfs().SnapshotName(imageSnapshotName), dsName, props, "images.zfs.* settings")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	img.rootfs = ds
+	if len(dimgs) == 1 {
+		return nil
+	}
+	for _, dimg := range dimgs[1:] {
+		img.ui.Printf("Copying dependency %v\n", dimg)
+		if err := overlayRootfs(dimg.Path("rootfs"), mountpoint); err != nil {
+			return errors.Annotatef(err, "Copying dependency %v", dimg)
+		}
+	}
+	_, err = ds.Snapshot(dependenciesSnapshotName, nil)
+	return errors.Trace(err)
+}
+
+// Returns snapshot of an image's rendered dependencies that are
+// chain, or nil if there is none.
+func (h *Host) renderedDependencies(chain []types.Hash) (*zfs.Dataset, error) {
+	imgs, err := h.Images()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+imgs:
+	for _, img := range imgs {
+		if len(img.Dependencies) != len(chain) {
+			continue
+		}
+		for i, hash := range img.Dependencies {
+			if hash != chain[i] {
+				continue imgs
+			}
+		}
+		if snap, err := img.getRootfs().GetSnapshot(dependenciesSnapshotName); err == nil {
+			return snap, nil
+		}
+	}
+	return nil, nil
+}
+
+// Before image's rootfs is destroyed, a dataset cloned from its
+// snapshot (another image cloned from its rendered dependencies, a
+// build from its cached step, or a pod's rootfs) takes over the
+// snapshots. Snapshots whose names the clone already has are renamed
+// first.
+func (img *Image) releaseDependencies() error {
+	return errors.Trace(promoteClones(img.Host.datasets(), img.log(), img.getRootfs().Name, img.UUID.String()))
+}
+
+// Promotes a clone of rootfs's last cloned snapshot, so that rootfs can
+// be destroyed. Snapshots whose names the clone already has get suffix.
+func promoteClones(z zfs.Interface, log Logger, rootfs, suffix string) error {
+	snaps, err := z.Snapshots(rootfs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Promoting clone of the last cloned snapshot moves all the earlier
+	// snapshots, and their clones, too
+	last := -1
+	for i, snap := range snaps {
+		if len(snap.Clones) > 0 {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	clone := snaps[last].Clones[0]
+	cloneSnaps, err := z.Snapshots(clone)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	taken := make(map[string]bool, len(cloneSnaps))
+	for _, snap := range cloneSnaps {
+		taken[snap.Name] = true
+	}
+	for _, snap := range snaps[:last+1] {
+		if taken[snap.Name] {
+			if err := z.Rename(rootfs+"@"+snap.Name, rootfs+"@"+snap.Name+"-"+suffix); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	log.Debugf("Promoting %v, cloned from %v@%v", clone, rootfs, snaps[last].Name)
+	return errors.Trace(z.Promote(clone))
+}
+
+// Copies tree at src over dst, using system's tar.
+func overlayRootfs(src, dst string) error {
+	tarCmd := run.Command("tar", "-C", src, "-cf", "-", ".").Stream()
+	tarOut, err := tarCmd.StdoutPipe()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := tarCmd.Start(); err != nil {
+		return errors.Trace(err)
+	}
+	err = run.Command("tar", "-C", dst, "-xpf", "-").ReadFrom(tarOut).Stream().Run()
+	if err2 := tarCmd.Wait(); err == nil {
+		err = err2
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,99 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	configProperties.Set("allow.autodiscovery", "off")
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	base := saveTestImage(t, h, "example.com/base")
+	layer := saveTestImage(t, h, "example.com/layer")
+
+	manifest := schema.BlankImageManifest()
+	manifest.Name = "example.com/app"
+	manifest.Dependencies = types.Dependencies{
+		{ImageName: "example.com/base"},
+		{ImageName: "example.com/layer"},
+	}
+	if dimgs, err := h.resolveDependencies(manifest, nil); err != nil {
+		t.Fatal(err)
+	} else if len(dimgs) != 2 || dimgs[0].UUID.String() != base.UUID.String() || dimgs[1].UUID.String() != layer.UUID.String() {
+		t.Errorf("resolved %v", dimgs)
+	}
+	for i, img := range []*Image{base, layer} {
+		if id := manifest.Dependencies[i].ImageID; id == nil || *id != *img.Hash {
+			t.Errorf("dependency %d has ID %v, expected %v", i, id, img.Hash)
+		}
+	}
+
+	// All missing dependencies are listed
+	manifest.Dependencies = types.Dependencies{
+		{ImageName: "example.com/missing", Labels: types.Labels{{Name: "version", Value: "1"}}},
+		{ImageName: "example.com/base"},
+		{ImageID: types.NewHashSHA512([]byte("nothing"))},
+	}
+	_, err = h.resolveDependencies(manifest, nil)
+	if merr, ok := errors.Cause(err).(*MissingDependenciesError); !ok {
+		t.Fatalf("expected missing dependencies, got %v", err)
+	} else if len(merr.Missing) != 2 {
+		t.Errorf("missing %v", merr.Missing)
+	} else if msg := merr.Error(); !strings.Contains(msg, "example.com/missing,version=1") || !strings.Contains(msg, "sha512-") || strings.Contains(msg, "example.com/base") {
+		t.Errorf("unexpected message: %v", msg)
+	}
+}
+
+func TestResolvingImages(t *testing.T) {
+	var ri resolvingImages
+	leaveAB, err := ri.wait("example.com/a", "example.com/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveBC, err := ri.wait("example.com/b", "example.com/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another branch may wait for the same image
+	leaveDC, err := ri.wait("example.com/d", "example.com/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveDC()
+	_, err = ri.wait("example.com/c", "example.com/a")
+	if cerr, ok := err.(*CircularDependencyError); !ok {
+		t.Fatalf("expected circular dependency, got %v", err)
+	} else if msg := cerr.Error(); msg != "Circular dependency: example.com/c -> example.com/a -> example.com/b -> example.com/c" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+	if _, err := ri.wait("example.com/a", "example.com/a"); err == nil {
+		t.Error("expected image waiting for itself to fail")
+	}
+	leaveBC()
+	leaveAB()
+	if _, err := ri.wait("example.com/c", "example.com/a"); err != nil {
+		t.Error(err)
+	}
+}
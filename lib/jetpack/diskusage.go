@@ -0,0 +1,366 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Disk space used by a pod or an image
+type DiskUsage struct {
+	Used        uint64 // including children and snapshots
+	Referenced  uint64
+	Logical     uint64 // before compression
+	Quota       uint64 `json:",omitempty"` // pod's storage limit
+	Reservation uint64 `json:",omitempty"`
+	Dataset     string `json:",omitempty"` // empty if computed by walking files
+}
+
+func (du DiskUsage) String() string {
+	s := fmt.Sprintf("used %d bytes, referenced %d bytes, logical %d bytes",
+		du.Used, du.Referenced, du.Logical)
+	if du.Quota > 0 {
+		s += fmt.Sprintf(", quota %d bytes", du.Quota)
+	}
+	if du.Reservation > 0 {
+		s += fmt.Sprintf(", reservation %d bytes", du.Reservation)
+	}
+	return s
+}
+
+var diskUsageProperties = "used,referenced,logicalused,quota,reservation"
+
+// Disk usage of the host's pods and images, from a single zfs command
+type HostDiskUsage struct {
+	Pods, Images DiskUsage            // whole pods/ (of all storage classes) and images/ datasets
+	PodsByClass  map[string]DiskUsage // pods/ datasets by storage class
+	ByPod        map[string]DiskUsage // by pod UUID
+	ByImage      map[string]DiskUsage // by image UUID
+}
+
+// Returns disk space used by the pod's dataset, or by files in the
+// pod's directory if it has no dataset.
+func (pod *Pod) DiskUsage() (DiskUsage, error) {
+	if ds := pod.getDataset(); ds != nil {
+		return datasetDiskUsage(ds)
+	}
+	return walkDiskUsage(pod.Path())
+}
+
+// Returns disk space used by the image's dataset, or by files in the
+// image's directory if it has no dataset.
+func (img *Image) DiskUsage() (DiskUsage, error) {
+	ds, err := img.Host.datasets().GetDataset(img.Host.Dataset.ChildName(path.Join("images", img.UUID.String())))
+	if err == zfs.ErrNotFound {
+		return walkDiskUsage(img.Path())
+	} else if err != nil {
+		return DiskUsage{}, errors.Trace(err)
+	}
+	return datasetDiskUsage(ds)
+}
+
+// Returns disk usage of pods and images; pods and images without
+// their own dataset are not included in ByPod and ByImage.
+func (h *Host) DiskUsage() (*HostDiskUsage, error) {
+	podsNames, err := h.podsDatasets()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	imagesName := h.Dataset.ChildName("images")
+	args := []string{"-p", "-r", "-d", "1", "-o", "name,property,value", diskUsageProperties, imagesName}
+	for _, name := range podsNames {
+		args = append(args, name)
+	}
+	rows, err := zfs.ZfsFields("get", args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseHostDiskUsage(rows, podsNames, imagesName)
+}
+
+func datasetDiskUsage(ds *zfs.Dataset) (DiskUsage, error) {
+	props, err := ds.GetMany(strings.Split(diskUsageProperties, ",")...)
+	if err != nil {
+		return DiskUsage{}, errors.Trace(err)
+	}
+	du := DiskUsage{Dataset: ds.Name}
+	for prop, value := range props {
+		if err := du.set(prop, value); err != nil {
+			return DiskUsage{}, errors.Annotate(err, ds.Name)
+		}
+	}
+	return du, nil
+}
+
+func (du *DiskUsage) set(prop, value string) error {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return errors.Annotatef(err, "Cannot parse %v", prop)
+	}
+	switch prop {
+	case "used":
+		du.Used = n
+	case "referenced":
+		du.Referenced = n
+	case "logicalused":
+		du.Logical = n
+	case "quota":
+		du.Quota = n
+	case "reservation":
+		du.Reservation = n
+	}
+	return nil
+}
+
+// Parses `zfs get -p -o name,property,value` output for pods/
+// datasets (by storage class) and images/ dataset, and their children.
+func parseHostDiskUsage(rows [][]string, podsNames map[string]string, imagesName string) (*HostDiskUsage, error) {
+	hdu := &HostDiskUsage{
+		PodsByClass: make(map[string]DiskUsage),
+		ByPod:       make(map[string]DiskUsage),
+		ByImage:     make(map[string]DiskUsage),
+	}
+	classes := make(map[string]string, len(podsNames))
+	for class, name := range podsNames {
+		classes[name] = class
+	}
+	for _, row := range rows {
+		if len(row) != 3 {
+			return nil, errors.Errorf("Cannot parse zfs get output %#v", row)
+		}
+		name := row[0]
+		if class, ok := classes[name]; ok {
+			du := hdu.PodsByClass[class]
+			du.Dataset = name
+			if err := du.set(row[1], row[2]); err != nil {
+				return nil, errors.Annotate(err, name)
+			}
+			hdu.PodsByClass[class] = du
+			continue
+		}
+		if name == imagesName {
+			hdu.Images.Dataset = name
+			if err := hdu.Images.set(row[1], row[2]); err != nil {
+				return nil, errors.Annotate(err, name)
+			}
+			continue
+		}
+		dir, id := path.Split(name)
+		children := hdu.ByPod
+		if dir == imagesName+"/" {
+			children = hdu.ByImage
+		} else if _, ok := classes[strings.TrimSuffix(dir, "/")]; !ok {
+			continue
+		}
+		child := children[id]
+		child.Dataset = name
+		if err := child.set(row[1], row[2]); err != nil {
+			return nil, errors.Annotate(err, name)
+		}
+		children[id] = child
+	}
+	for class, du := range hdu.PodsByClass {
+		hdu.Pods.Used += du.Used
+		hdu.Pods.Referenced += du.Referenced
+		hdu.Pods.Logical += du.Logical
+		if class == DefaultStorageClass {
+			hdu.Pods.Dataset = du.Dataset
+		}
+	}
+	return hdu, nil
+}
+
+// Disk usage of an image, accounting for blocks it shares with clones
+// of its snapshots
+type ImageDiskUsage struct {
+	Dataset    string
+	Used       uint64 // including snapshots
+	Referenced uint64
+	Logical    uint64 // referenced, before compression
+	// Space freed by destroying the image: snapshots that clones need
+	// are passed to them (see releaseDependencies), so it's the space
+	// of the dataset, its children, and its later snapshots
+	Unique uint64
+	Pods   int // cloned from the image
+	Images int // cloned from the image
+}
+
+func (idu ImageDiskUsage) String() string {
+	return fmt.Sprintf("used %d bytes, %d unique, referenced %d bytes, logical %d bytes, cloned by %d pods and %d images",
+		idu.Used, idu.Unique, idu.Referenced, idu.Logical, idu.Pods, idu.Images)
+}
+
+// Disk usage of the image store
+type ImageStoreUsage struct {
+	Used    uint64                    // by the whole images/ dataset
+	Unique  uint64                    // by all images, freed if all were destroyed
+	ByImage map[string]ImageDiskUsage // by image UUID
+}
+
+var imageUsageProperties = "name,used,referenced,logicalreferenced,usedbydataset,usedbychildren,usedbyrefreservation,origin"
+
+// Returns disk usage of images, from a single zfs command that lists
+// all datasets and snapshots of the host, and of its storage classes
+// on the same pool, so that clones of images are found wherever they
+// are.
+func (h *Host) ImageDiskUsage() (*ImageStoreUsage, error) {
+	podsNames, err := h.podsDatasets()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	args := []string{"-p", "-r", "-t", "filesystem,snapshot", "-s", "createtxg", "-o", imageUsageProperties, h.Dataset.Name}
+	var names []string
+	for class, name := range podsNames {
+		if class != DefaultStorageClass && zfs.PoolOf(name) == zfs.PoolOf(h.Dataset.Name) {
+			// Other pools have no clones
+			if !pathUnder(name, h.Dataset.Name) {
+				args = append(args, name)
+			}
+		}
+		names = append(names, name)
+	}
+	rows, err := zfs.ZfsFields("list", args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseImageStoreUsage(rows, names, h.Dataset.ChildName("images"))
+}
+
+// Parses `zfs list -p -s createtxg -o imageUsageProperties` output;
+// podsNames are datasets that hold pods.
+func parseImageStoreUsage(rows [][]string, podsNames []string, imagesName string) (*ImageStoreUsage, error) {
+	const nProps = 8
+	isu := &ImageStoreUsage{ByImage: make(map[string]ImageDiskUsage)}
+	parse := func(row []string, i int) (uint64, error) {
+		if row[i] == "-" {
+			return 0, nil
+		}
+		n, err := strconv.ParseUint(row[i], 10, 64)
+		return n, errors.Annotatef(err, "Cannot parse %v of %v", strings.Split(imageUsageProperties, ",")[i], row[0])
+	}
+
+	// Snapshots of each dataset, in creation order, their used space,
+	// and clones of each snapshot
+	snapshots := make(map[string][]string)
+	snapUsed := make(map[string]uint64)
+	clones := make(map[string][]string)
+	for _, row := range rows {
+		if len(row) != nProps {
+			return nil, errors.Errorf("Cannot parse zfs list output %#v", row)
+		}
+		if i := strings.IndexByte(row[0], '@'); i >= 0 {
+			n, err := parse(row, 1)
+			if err != nil {
+				return nil, err
+			}
+			snapshots[row[0][:i]] = append(snapshots[row[0][:i]], row[0])
+			snapUsed[row[0]] = n
+		} else if origin := row[7]; origin != "-" && origin != "" {
+			clones[origin] = append(clones[origin], row[0])
+		}
+	}
+
+	for _, row := range rows {
+		if strings.IndexByte(row[0], '@') >= 0 {
+			continue
+		}
+		if row[0] == imagesName {
+			n, err := parse(row, 1)
+			if err != nil {
+				return nil, err
+			}
+			isu.Used = n
+			continue
+		}
+		parent, id := path.Split(row[0])
+		if parent != imagesName+"/" {
+			continue
+		}
+		idu := ImageDiskUsage{Dataset: row[0]}
+		var own [3]uint64 // by dataset, children, refreservation
+		for i, dst := range []*uint64{&idu.Used, &idu.Referenced, &idu.Logical, &own[0], &own[1], &own[2]} {
+			n, err := parse(row, i+1)
+			if err != nil {
+				return nil, err
+			}
+			*dst = n
+		}
+		idu.Unique = own[0] + own[1] + own[2]
+		pods := make(map[string]bool)
+		snaps := snapshots[row[0]]
+		lastCloned := -1
+		for i, snap := range snaps {
+			for _, clone := range clones[snap] {
+				lastCloned = i
+				if cparent, _ := path.Split(clone); cparent == imagesName+"/" {
+					idu.Images++
+					continue
+				}
+				for _, podsName := range podsNames {
+					if strings.HasPrefix(clone, podsName+"/") {
+						// Pod's apps have datasets under the pod's
+						pods[strings.SplitN(strings.TrimPrefix(clone, podsName+"/"), "/", 2)[0]] = true
+					}
+				}
+			}
+		}
+		idu.Pods = len(pods)
+		for _, snap := range snaps[lastCloned+1:] {
+			idu.Unique += snapUsed[snap]
+		}
+		isu.ByImage[id] = idu
+		isu.Unique += idu.Unique
+	}
+	return isu, nil
+}
+
+// Sums sizes of files under root, counting hard links once, and not
+// crossing into filesystems mounted under root (e.g. images' rootfs in
+// ephemeral pods). Used (and Referenced) is allocated space, Logical
+// is apparent size.
+func walkDiskUsage(root string) (DiskUsage, error) {
+	var du DiskUsage
+	seen := make(map[uint64]bool)
+	var rootDev uint64
+	if fi, err := os.Lstat(root); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			rootDev = uint64(st.Dev)
+		}
+	}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed meanwhile
+				return nil
+			}
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if fi.IsDir() && uint64(st.Dev) != rootDev {
+				return filepath.SkipDir
+			}
+			if st.Nlink > 1 {
+				if seen[uint64(st.Ino)] {
+					return nil
+				}
+				seen[uint64(st.Ino)] = true
+			}
+			du.Used += uint64(st.Blocks) * 512
+		}
+		du.Logical += uint64(fi.Size())
+		return nil
+	})
+	if err != nil {
+		return DiskUsage{}, errors.Trace(err)
+	}
+	du.Referenced = du.Used
+	return du, nil
+}
@@ -0,0 +1,125 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHostDiskUsage(t *testing.T) {
+	rows := [][]string{
+		{"zroot/jetpack/pods", "used", "3000"},
+		{"zroot/jetpack/pods", "referenced", "100"},
+		{"zroot/jetpack/pods/6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5", "used", "2900"},
+		{"zroot/jetpack/pods/6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5", "logicalused", "5800"},
+		{"zroot/jetpack/images", "used", "700"},
+		{"zroot/jetpack/images/0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0", "referenced", "600"},
+		{"fast/jetpack/pods", "used", "500"},
+		{"fast/jetpack/pods/3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21", "used", "450"},
+	}
+	podsNames := map[string]string{DefaultStorageClass: "zroot/jetpack/pods", "fast": "fast/jetpack/pods"}
+	hdu, err := parseHostDiskUsage(rows, podsNames, "zroot/jetpack/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdu.Pods.Used != 3500 || hdu.Pods.Referenced != 100 || hdu.Images.Used != 700 || hdu.Pods.Dataset != "zroot/jetpack/pods" {
+		t.Errorf("Unexpected totals %v / %v", hdu.Pods, hdu.Images)
+	}
+	if du := hdu.PodsByClass["fast"]; du.Used != 500 || du.Dataset != "fast/jetpack/pods" {
+		t.Errorf("Unexpected fast class usage %#v", du)
+	}
+	if du := hdu.ByPod["3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21"]; du.Used != 450 {
+		t.Errorf("Unexpected fast pod usage %v", du)
+	}
+	if du := hdu.ByPod["6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5"]; du.Used != 2900 || du.Logical != 5800 {
+		t.Errorf("Unexpected pod usage %v", du)
+	}
+	if du := hdu.ByImage["0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0"]; du.Referenced != 600 || du.Dataset != "zroot/jetpack/images/0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0" {
+		t.Errorf("Unexpected image usage %#v", du)
+	}
+	if len(hdu.ByPod) != 2 || len(hdu.ByImage) != 1 {
+		t.Errorf("Unexpected children %v %v", hdu.ByPod, hdu.ByImage)
+	}
+
+	if _, err := parseHostDiskUsage([][]string{{"zroot/jetpack/pods", "used", "lots"}}, map[string]string{DefaultStorageClass: "zroot/jetpack/pods"}, "zroot/jetpack/images"); err == nil {
+		t.Error("Expected error for invalid value")
+	}
+}
+
+func TestParseImageStoreUsage(t *testing.T) {
+	const (
+		base  = "zroot/jetpack/images/0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0"
+		child = "zroot/jetpack/images/3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21"
+		pod   = "zroot/jetpack/pods/6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5"
+	)
+	rows := [][]string{
+		{"zroot/jetpack", "9000", "100", "100", "100", "8900", "0", "-"},
+		{"zroot/jetpack/images", "1500", "100", "100", "100", "1400", "0", "-"},
+		{base, "1000", "600", "1200", "50", "0", "0", "-"},
+		{base + "@parent", "250", "600", "600", "-", "-", "-", "-"},
+		{child, "400", "900", "1800", "400", "0", "0", base + "@parent"},
+		{child + "@parent", "0", "900", "900", "-", "-", "-", "-"},
+		{"zroot/jetpack/pods", "2000", "100", "100", "100", "1900", "0", "-"},
+		{pod, "1900", "100", "100", "100", "1800", "0", "-"},
+		{pod + "/0", "900", "900", "1800", "900", "0", "0", child + "@parent"},
+		{pod + "/1", "900", "900", "1800", "900", "0", "0", child + "@parent"},
+		{base + "@later", "300", "600", "600", "-", "-", "-", "-"},
+	}
+	isu, err := parseImageStoreUsage(rows, []string{"zroot/jetpack/pods"}, "zroot/jetpack/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(isu.ByImage) != 2 {
+		t.Fatalf("Unexpected images %v", isu.ByImage)
+	}
+	// The base is cloned by the child; its later snapshot is its own
+	if idu := isu.ByImage["0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0"]; idu.Used != 1000 || idu.Referenced != 600 || idu.Logical != 1200 ||
+		idu.Unique != 350 || idu.Images != 1 || idu.Pods != 0 || idu.Dataset != base {
+		t.Errorf("Unexpected base usage %#v", idu)
+	}
+	// Both apps of one pod are cloned from the child
+	if idu := isu.ByImage["3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21"]; idu.Unique != 400 || idu.Images != 0 || idu.Pods != 1 {
+		t.Errorf("Unexpected child usage %#v", idu)
+	}
+	if isu.Used != 1500 || isu.Unique != 750 {
+		t.Errorf("Unexpected totals %v / %v", isu.Used, isu.Unique)
+	}
+
+	if _, err := parseImageStoreUsage([][]string{{base, "lots", "0", "0", "0", "0", "0", "-"}}, []string{"zroot/jetpack/pods"}, "zroot/jetpack/images"); err == nil {
+		t.Error("Expected error for invalid value")
+	}
+	if _, err := parseImageStoreUsage([][]string{{base, "0"}}, []string{"zroot/jetpack/pods"}, "zroot/jetpack/images"); err == nil {
+		t.Error("Expected error for short row")
+	}
+}
+
+func TestWalkDiskUsage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "a"), make([]byte, 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(tmp, "a"), filepath.Join(tmp, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	du, err := walkDiskUsage(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hard link is counted once
+	if du.Logical != 10000+uint64(fi.Size()) {
+		t.Errorf("Unexpected logical size %v", du.Logical)
+	}
+	if du.Used == 0 || du.Referenced != du.Used || du.Dataset != "" {
+		t.Errorf("Unexpected usage %#v", du)
+	}
+}
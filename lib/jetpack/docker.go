@@ -0,0 +1,160 @@
+package jetpack
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/docker"
+)
+
+// Docker and OCI images are imported converted to ACIs (see
+// lib/docker). They have no signature, so importing them needs the
+// same permission as any other unsigned image. Converted images are
+// labeled with the image ID; importing an image ID that is already in
+// the store returns the existing image.
+
+// Fetches Docker image by reference ([REGISTRY/]REPOSITORY[:TAG][@DIGEST])
+// from a registry, and imports it with opts (defaults if nil).
+func (h *Host) FetchDockerImage(reference string, opts *ImageOptions) (_ *Image, erv error) {
+	defer func() { h.countOperation("image-fetch", erv) }()
+	started := time.Now()
+	ref, err := docker.ParseReference(reference)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	fopts, err := h.FetchOptions()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if opts != nil {
+		fopts.Progress = opts.Progress
+	}
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	dimg, err := docker.Pull(ref, fopts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer dimg.Close()
+	return h.importDockerImage(dimg, started, newProvenance(ProvenanceDocker, ref.String()), opts)
+}
+
+// Imports Docker image from a docker-save archive. Name of the image
+// is reference, or the archive's first tag if reference is empty.
+func (h *Host) ImportDockerArchive(filename, reference string, opts *ImageOptions) (*Image, error) {
+	started := time.Now()
+	spool, err := h.spoolDir()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	dimg, err := docker.ReadArchive(filename, spool)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer dimg.Close()
+	if reference != "" {
+		if ref, err := docker.ParseReference(reference); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			dimg.Reference = ref
+		}
+	}
+	source, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.importDockerImage(dimg, started, newProvenance(ProvenanceDocker, source), opts)
+}
+
+// Imports image from an OCI image layout directory; tag selects the
+// image if the layout has several. Name of the image is name, or the
+// layout's reference if empty.
+func (h *Host) ImportOCILayout(dir, tag string, name types.ACIdentifier, opts *ImageOptions) (*Image, error) {
+	started := time.Now()
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	dimg, err := docker.ReadLayout(dir, tag)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dimg.ImageName = name
+	source, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tag != "" {
+		source += ":" + tag
+	}
+	return h.importDockerImage(dimg, started, newProvenance(ProvenanceOCI, source), opts)
+}
+
+// Returns image of dimg that is already imported, or ErrNotFound.
+func (h *Host) getDockerImage(dimg *docker.Image) (*Image, error) {
+	name, err := dimg.Name()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.getLocalImage(types.Hash{}, name, types.Labels{{Name: docker.ImageIDLabel, Value: dimg.ID}})
+}
+
+// Converts dimg to an ACI in the spool, and imports it with provenance
+// prov and dimg's manifest digest.
+func (h *Host) importDockerImage(dimg *docker.Image, started time.Time, prov *ImageProvenance, opts *ImageOptions) (*Image, error) {
+	if img, err := h.getDockerImage(dimg); err == nil {
+		h.log().Infof("Docker image %v is already imported as %v", dimg.ID, img)
+		return img, nil
+	} else if errors.Cause(err) != ErrNotFound {
+		return nil, errors.Trace(err)
+	}
+	name, err := dimg.Name()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := h.checkUnsigned(name, opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	spool, err := h.spoolDir()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aci, err := ioutil.TempFile(spool, "docker-aci.")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	os.Remove(aci.Name())
+	defer aci.Close()
+
+	gzw := gzip.NewWriter(aci)
+	if err := docker.WriteACI(gzw, dimg); err != nil {
+		return nil, errors.Annotatef(err, "Converting %v", name)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := aci.Seek(0, os.SEEK_SET); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	prov.Digest = dimg.ManifestDigest
+	fg := h.newFetchGroup(opts)
+	defer fg.cancel()
+	return h.importImage(fg, name, aci, nil, started, "", prov)
+}
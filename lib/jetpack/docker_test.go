@@ -0,0 +1,81 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/docker"
+	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Writes docker-save archive with config and an empty layer; returns
+// its path and the image ID.
+func writeTestDockerArchive(t *testing.T, dir, config string) (string, string) {
+	var layer bytes.Buffer
+	tar.NewWriter(&layer).Close()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"manifest.json", `[{"Config":"config.json","RepoTags":["example.com/app:1"],"Layers":["layer.tar"]}]`},
+		{"config.json", config},
+		{"layer.tar", layer.String()},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	path := filepath.Join(dir, "docker.tar")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config)))
+}
+
+func TestImportDockerArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+
+	archive, id := writeTestDockerArchive(t, tmp, `{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/sh"]}}`)
+
+	// Not imported yet: unsigned images are not allowed
+	if _, err := h.ImportDockerArchive(archive, "", nil); errors.Cause(err) != fetch.ErrVerificationFailed {
+		t.Errorf("expected verification failure, got %v", err)
+	}
+
+	// Already imported: existing image is returned
+	img := saveTestImage(t, h, "example.com/app")
+	img.Manifest.Labels = types.Labels{{Name: docker.ImageIDLabel, Value: id}}
+	if bb, err := json.Marshal(&img.Manifest); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(img.Path("manifest"), bb, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if img2, err := h.ImportDockerArchive(archive, "", nil); err != nil {
+		t.Error(err)
+	} else if img2.UUID.String() != img.UUID.String() {
+		t.Errorf("imported %v, expected existing %v", img2, img)
+	}
+
+	// Name from reference overrides archive's tag
+	if _, err := h.ImportDockerArchive(archive, "example.com/other", nil); errors.Cause(err) != fetch.ErrVerificationFailed {
+		t.Errorf("expected verification failure, got %v", err)
+	}
+	if left, _ := filepath.Glob(h.Path("spool", "docker-*")); len(left) != 0 {
+		t.Errorf("temporary files left: %v", left)
+	}
+}
@@ -0,0 +1,130 @@
+package jetpack
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Env files are host files of NAME=VALUE lines, which keep secrets
+// and per-environment settings out of manifests and command lines.
+// Blank lines and lines starting with `#` are skipped, an `export `
+// prefix is allowed, and values may be double-quoted (with Go-style
+// escapes) or single-quoted (verbatim). Later lines, and later files,
+// override earlier ones.
+//
+// Pod's env files are named by its `jetpack/env-files` annotation (or
+// app's, which replaces pod's), a colon-separated list of absolute
+// paths, set with PodOptions.EnvFiles; a single run's ones are given
+// in RunOptions.EnvFiles. The files are read each time a command is
+// run, and never copied into the manifest: app's environment is the
+// image's and runtime app's environment, then pod's env files, then
+// run's env files, then RunOptions.Env. The exec event in the pod's
+// event log lists paths of the applied files.
+
+const envFilesAnnotation = "jetpack/env-files"
+
+// Verifies that paths can name env files.
+func checkEnvFiles(paths []string) error {
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("Env file %#v needs an absolute path", path)
+		}
+		if strings.Contains(path, ":") {
+			return errors.Errorf("Env file %#v has a colon in its path", path)
+		}
+	}
+	return nil
+}
+
+// Sets pm's env files, replacing ones that were set.
+func SetEnvFiles(pm *schema.PodManifest, paths []string) error {
+	if err := checkEnvFiles(paths); err != nil {
+		return errors.Trace(err)
+	}
+	pm.Annotations.Set(envFilesAnnotation, strings.Join(paths, ":"))
+	return nil
+}
+
+// Returns paths of app's env files, from the annotation.
+func (pod *Pod) appEnvFiles(name types.ACName) ([]string, error) {
+	str, _ := pod.appAnnotation(name, envFilesAnnotation)
+	var paths []string
+	for _, path := range strings.Split(str, ":") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, errors.Annotatef(checkEnvFiles(paths), "%v annotation", envFilesAnnotation)
+}
+
+// Returns environment of env files at paths, in turn.
+func readEnvFiles(paths []string) ([]string, error) {
+	var env []string
+	for _, path := range paths {
+		vars, err := readEnvFile(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		env = mergeEnv(env, vars)
+	}
+	return env, nil
+}
+
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		if ev, err := parseEnvLine(scanner.Text()); err != nil {
+			return nil, errors.Errorf("%v:%d: %v", path, lineno, err)
+		} else if ev != "" {
+			env = mergeEnv(env, []string{ev})
+		}
+	}
+	return env, errors.Annotate(scanner.Err(), path)
+}
+
+// Returns NAME=VALUE of an env file's line; empty for blank lines and
+// comments.
+func parseEnvLine(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+	eq := strings.Index(line, "=")
+	if eq < 0 {
+		return "", errors.New("expected NAME=VALUE")
+	}
+	name, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+	if !envNameRegexp.MatchString(name) {
+		return "", errors.Errorf("invalid variable name %#v", name)
+	}
+	if value != "" {
+		switch value[0] {
+		case '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return "", errors.Errorf("invalid double-quoted value of %v", name)
+			}
+			value = unquoted
+		case '\'':
+			if len(value) < 2 || value[len(value)-1] != '\'' || strings.Contains(value[1:len(value)-1], "'") {
+				return "", errors.Errorf("invalid single-quoted value of %v", name)
+			}
+			value = value[1 : len(value)-1]
+		}
+	}
+	return name + "=" + value, nil
+}
@@ -0,0 +1,103 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestParseEnvLine(t *testing.T) {
+	for line, expected := range map[string]string{
+		"":                         "",
+		"   ":                      "",
+		"# FOO=bar":                "",
+		"FOO=bar":                  "FOO=bar",
+		"  FOO = bar baz  ":        "FOO=bar baz",
+		"export FOO=bar":           "FOO=bar",
+		"FOO=":                     "FOO=",
+		"FOO=a=b":                  "FOO=a=b",
+		`FOO="a \"quoted\"\nline"`: "FOO=a \"quoted\"\nline",
+		`FOO='$not \n escaped'`:    `FOO=$not \n escaped`,
+		`FOO=it's`:                 `FOO=it's`,
+	} {
+		if ev, err := parseEnvLine(line); err != nil {
+			t.Errorf("%#v: %v", line, err)
+		} else if ev != expected {
+			t.Errorf("%#v: expected %#v, got %#v", line, expected, ev)
+		}
+	}
+	for _, line := range []string{"FOO", "1FOO=bar", "FOO BAR=baz", `FOO="unterminated`, `FOO="a" b`, `FOO='a'b'`, `FOO='`} {
+		if ev, err := parseEnvLine(line); err == nil {
+			t.Errorf("%#v: expected error, got %#v", line, ev)
+		}
+	}
+}
+
+func TestReadEnvFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for name, contents := range map[string]string{
+		"base.env":  "# Defaults\nFOO=base\nBAR=base\n\nFOO=again\n",
+		"local.env": "BAR=\"local\"\nBAZ=local\n",
+		"bad.env":   "FOO=bar\n\nnot a variable\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env, err := readEnvFiles([]string{filepath.Join(tmp, "base.env"), filepath.Join(tmp, "local.env")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"FOO=again", "BAR=local", "BAZ=local"}; !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+
+	bad := filepath.Join(tmp, "bad.env")
+	if _, err := readEnvFiles([]string{bad}); err == nil || !strings.Contains(err.Error(), bad+":3: expected NAME=VALUE") {
+		t.Errorf("Expected error at %v:3, got %v", bad, err)
+	}
+	if _, err := readEnvFiles([]string{filepath.Join(tmp, "missing.env")}); err == nil {
+		t.Error("Missing file read")
+	}
+}
+
+func TestAppEnvFiles(t *testing.T) {
+	pod := newPod(nil, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name}}
+
+	if paths, err := pod.appEnvFiles(name); err != nil || paths != nil {
+		t.Errorf("Expected no env files, got %v, %v", paths, err)
+	}
+	if err := SetEnvFiles(&pod.Manifest, []string{"/etc/app.env", "/etc/secret.env"}); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := pod.appEnvFiles(name); err != nil || !reflect.DeepEqual(paths, []string{"/etc/app.env", "/etc/secret.env"}) {
+		t.Errorf("Unexpected env files %v, %v", paths, err)
+	}
+	pod.Manifest.Apps[0].Annotations.Set(envFilesAnnotation, "/etc/other.env")
+	if paths, err := pod.appEnvFiles(name); err != nil || !reflect.DeepEqual(paths, []string{"/etc/other.env"}) {
+		t.Errorf("Expected app's env files, got %v, %v", paths, err)
+	}
+
+	for _, paths := range [][]string{{"app.env"}, {"/etc/a:b.env"}} {
+		if err := SetEnvFiles(&pod.Manifest, paths); err == nil {
+			t.Errorf("%v: expected error", paths)
+		}
+	}
+	pod.Manifest.Apps[0].Annotations.Set(envFilesAnnotation, "/etc/app.env:relative.env")
+	if err := pod.checkAppOptions(); err == nil {
+		t.Error("Relative env file passed validation")
+	}
+}
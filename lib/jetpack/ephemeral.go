@@ -0,0 +1,226 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/juju/errors"
+)
+
+// Ephemeral pods (PodOptions.Ephemeral, or `jetpack/ephemeral`
+// annotation set to "true") have no dataset: instead of cloning its
+// image, each app's rootfs is the image's rootfs nullfs-mounted
+// read-only, and the pod's directory is a plain directory in the
+// host's pods/. Writes go to tmpfs scratch: /tmp, empty volumes (as if
+// they were tmpfs volumes), and, for /etc, /var, and the pod's
+// writable paths (see rootfs.go), a tmpfs in the pod's scratch/ with
+// unionfs over the image's directory, so that it starts with the
+// image's contents. Each scratch tmpfs can take the
+// `jetpack/ephemeral-scratch` annotation's size, or the
+// ephemeral.scratch-size property's. Nothing that apps write outlives
+// the jail.
+//
+// The mounts are in the pod's fstab, like other pods' ones, but they
+// are mounted before prepJail writes to the rootfs, rather than by
+// jail(8), and unmounted when the jail is gone. Unmounting looks for
+// everything mounted under the pod's directory, so that mounts left by
+// a crash are found too; the directory is never removed while
+// something is mounted there, as it would remove the images' files.
+// Mount points need to exist in the images, as they can't be created
+// in a read-only rootfs; createPod checks them before anything is
+// written, and names the missing ones. Copied file volumes are copied
+// by prepJail once the scratch is mounted, so they need to be under a
+// writable path, in a directory that exists in the image.
+
+const ephemeralAnnotation = "jetpack/ephemeral"
+
+// Paths that ephemeral pods' apps can always write to
+var ephemeralWritablePaths = []string{"/etc", "/var"}
+
+// Makes pods created from pm ephemeral.
+func SetEphemeral(pm *schema.PodManifest) {
+	pm.Annotations.Set(ephemeralAnnotation, "true")
+}
+
+// Returns true if pod is ephemeral.
+func (pod *Pod) Ephemeral() bool {
+	v, _ := pod.Manifest.Annotations.Get(ephemeralAnnotation)
+	return v == "true"
+}
+
+// Returns size of ephemeral pod's scratch tmpfs mounts.
+func (pod *Pod) ephemeralScratchSize() string {
+	if size, ok := pod.Manifest.Annotations.Get("jetpack/ephemeral-scratch"); ok {
+		return size
+	}
+	return Config().GetString("ephemeral.scratch-size", "256m")
+}
+
+// Returns fstab entries of app i's rootfs at appRootfs, made of image's
+// rootfs at imgRootfs with scratch over its writable paths.
+func (pod *Pod) ephemeralRootfsFstab(i int, imgRootfs, appRootfs string) ([]fstabEntry, error) {
+	fstab := []fstabEntry{{imgRootfs, appRootfs, "nullfs", "ro", 0}}
+	seen := make(map[string]bool)
+	for _, path := range append(ephemeralWritablePaths, pod.writablePaths()...) {
+		if !filepath.IsAbs(path) {
+			return nil, errors.Errorf("Writable path %#v is not absolute", path)
+		}
+		if path = filepath.Clean(path); seen[path] {
+			continue
+		}
+		seen[path] = true
+		fi, err := os.Stat(filepath.Join(imgRootfs, path))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		} else if !fi.IsDir() {
+			return nil, errors.Errorf("Writable path %v is not a directory", path)
+		}
+		opts, err := tmpfsMountOptions("size="+pod.ephemeralScratchSize(), fileInfoPerms(fi))
+		if err != nil {
+			return nil, errors.Annotate(err, "jetpack/ephemeral-scratch")
+		}
+		scratch := pod.Path("scratch", fmt.Sprintf("%d.%d", i, len(seen)-1))
+		if err := os.MkdirAll(scratch, 0700); err != nil {
+			return nil, errors.Trace(err)
+		}
+		fstab = append(fstab,
+			fstabEntry{"tmpfs", scratch, "tmpfs", opts, 0},
+			fstabEntry{scratch, filepath.Join(appRootfs, path), "unionfs", "rw", 0})
+	}
+	return fstab, nil
+}
+
+// Checks that mount point path (a directory, or a regular file if file
+// is true) exists in an ephemeral pod's app rootfs, where it can't be
+// created.
+func checkEphemeralMountPoint(rootfs, path string, file bool) error {
+	fi, err := os.Stat(filepath.Join(rootfs, path))
+	switch {
+	case os.IsNotExist(err):
+		return errors.Errorf("Mount point %v does not exist in the image, and ephemeral pod's read-only rootfs can't have it created", path)
+	case err != nil:
+		return errors.Trace(err)
+	case file && !fi.Mode().IsRegular():
+		return errors.Errorf("Mount point %v is not a regular file", path)
+	case !file && !fi.IsDir():
+		return errors.Errorf("Mount point %v is not a directory", path)
+	}
+	return nil
+}
+
+// Creates mount point directory path in app's rootfs, as
+// mkdirMountPoint; in ephemeral pods, checks that it exists.
+func (pod *Pod) mkdirMountPoint(rootfs, path string, modelFi os.FileInfo) error {
+	if pod.Ephemeral() {
+		return checkEphemeralMountPoint(rootfs, path, false)
+	}
+	return mkdirMountPoint(rootfs, path, modelFi)
+}
+
+// Creates mount point file path in app's rootfs, as mkFileMountPoint;
+// in ephemeral pods, checks that it exists.
+func (pod *Pod) mkFileMountPoint(rootfs, path string) error {
+	if pod.Ephemeral() {
+		return checkEphemeralMountPoint(rootfs, path, true)
+	}
+	return mkFileMountPoint(rootfs, path)
+}
+
+// Creates directory name in app's rootfs with mode, to mount a
+// filesystem like devfs on, if it doesn't exist; in ephemeral pods,
+// checks that it exists.
+func (pod *Pod) mkdirFSMountPoint(rootfs, name string, mode os.FileMode) error {
+	if pod.Ephemeral() {
+		return checkEphemeralMountPoint(rootfs, "/"+name, false)
+	}
+	if err := os.Mkdir(filepath.Join(rootfs, name), mode); err != nil && !os.IsExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Checks that copied file volume's mount point path can be written by
+// prepJail in an ephemeral pod's app rootfs: it's under one of
+// writable paths (scratch mounted over the image), and its directory
+// exists in the image.
+func checkEphemeralFileCopy(rootfs, path string, writable []string) error {
+	for _, w := range writable {
+		if pathUnder(path, w) && path != w {
+			return checkEphemeralMountPoint(rootfs, filepath.Dir(path), false)
+		}
+	}
+	return errors.Errorf("Mount point %v of a copied file volume is not under a writable path of ephemeral pod (%v)", path, strings.Join(writable, ", "))
+}
+
+// Mounts ephemeral pod's fstab, after unmounting what's left of earlier
+// runs.
+func (pod *Pod) mountEphemeral() error {
+	if err := pod.unmountAll(); err != nil {
+		return errors.Trace(err)
+	}
+	bb, err := ioutil.ReadFile(pod.Path("fstab"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fstab, err := parseFstab(string(bb))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pod.log().Debugf("Mounting %d filesystems", len(fstab))
+	for _, e := range fstab {
+		if err := mount(e); err != nil {
+			if err := pod.unmountAll(); err != nil {
+				pod.log().Errorf("%v", err)
+			}
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func mount(e fstabEntry) error {
+	return errors.Annotatef(systemCommand("mount", "-t", e.FSType, "-o", e.Options, e.Source, e.Target).Run(), "Mounting %v", e.Target)
+}
+
+// Unmounts everything mounted under pod's directory. Fails if anything
+// is still mounted there.
+func (pod *Pod) unmountAll() error {
+	mounts, err := mountPoints()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	targets := mountedUnder(mounts, pod.Path())
+	for _, target := range targets {
+		pod.log().Debugf("Unmounting %v", target)
+		if err := systemCommand("umount", "-f", target).Run(); err != nil {
+			pod.log().Warnf("cannot unmount %v: %v", target, err)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	if mounts, err = mountPoints(); err != nil {
+		return errors.Trace(err)
+	} else if left := mountedUnder(mounts, pod.Path()); len(left) > 0 {
+		return errors.Errorf("Pod %v still has mounts: %v", pod.UUID, strings.Join(left, ", "))
+	}
+	return nil
+}
+
+// Returns mount points (listed in mount order) under dir, last mounted
+// first, so that they can be unmounted in turn.
+func mountedUnder(mounts []string, dir string) []string {
+	var rv []string
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if pathUnder(mounts[i], dir) {
+			rv = append(rv, mounts[i])
+		}
+	}
+	return rv
+}
@@ -0,0 +1,209 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+)
+
+func TestSetEphemeral(t *testing.T) {
+	pod := newPod(nil, nil)
+	if pod.Ephemeral() {
+		t.Error("Blank pod is ephemeral")
+	}
+	SetEphemeral(&pod.Manifest)
+	if !pod.Ephemeral() {
+		t.Error("Pod is not ephemeral")
+	}
+
+	pm := schema.BlankPodManifest()
+	SetEphemeral(pm)
+	if v, _ := pm.Annotations.Get(ephemeralAnnotation); v != "true" {
+		t.Errorf("Unexpected annotation %#v", v)
+	}
+}
+
+func TestEphemeralScratch(t *testing.T) {
+	pod := newPod(nil, nil)
+	if size, ok := pod.TmpfsTmp(); ok {
+		t.Errorf("Unexpected /tmp tmpfs %v", size)
+	}
+	SetEphemeral(&pod.Manifest)
+	if size, ok := pod.TmpfsTmp(); !ok || size != "256m" {
+		t.Errorf("Expected scratch /tmp, got %v, %v", size, ok)
+	}
+
+	Config().Set("ephemeral.scratch-size", "1g")
+	defer Config().Set("ephemeral.scratch-size", "256m")
+	if size := pod.ephemeralScratchSize(); size != "1g" {
+		t.Errorf("Expected host's size, got %v", size)
+	}
+	pod.Manifest.Annotations.Set("jetpack/ephemeral-scratch", "64m")
+	if size := pod.ephemeralScratchSize(); size != "64m" {
+		t.Errorf("Expected annotated size, got %v", size)
+	}
+
+	// tmpfs.tmp wins
+	pod.Manifest.Annotations.Set("jetpack/tmpfs-tmp", "32m")
+	if size, ok := pod.TmpfsTmp(); !ok || size != "32m" {
+		t.Errorf("Expected tmpfs.tmp, got %v, %v", size, ok)
+	}
+}
+
+func TestEphemeralRootfsFstab(t *testing.T) {
+	h, _, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	pod := newPod(h, nil)
+	SetEphemeral(&pod.Manifest)
+	pod.Manifest.Annotations.Set("jetpack/ephemeral-scratch", "64m")
+	pod.Manifest.Annotations.Set("jetpack/writable-paths", "/srv,/var/,/missing")
+
+	img := filepath.Join(h.Path("images"), "img", "rootfs")
+	for _, dir := range []string{"etc", "var", "srv"} {
+		if err := os.MkdirAll(filepath.Join(img, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(img, "srv"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if err := os.Chown(filepath.Join(img, "srv"), uid, gid); err != nil {
+		t.Fatal(err)
+	}
+
+	root := pod.Path("rootfs", "1")
+	fstab, err := pod.ephemeralRootfsFstab(1, img, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := func(mode os.FileMode) string {
+		o, err := tmpfsMountOptions("size=64m", volumePerms{Mode: mode, UID: uid, GID: gid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	expected := []fstabEntry{
+		{img, root, "nullfs", "ro", 0},
+		{"tmpfs", pod.Path("scratch", "1.0"), "tmpfs", opts(0755), 0},
+		{pod.Path("scratch", "1.0"), root + "/etc", "unionfs", "rw", 0},
+		{"tmpfs", pod.Path("scratch", "1.1"), "tmpfs", opts(0755), 0},
+		{pod.Path("scratch", "1.1"), root + "/var", "unionfs", "rw", 0},
+		{"tmpfs", pod.Path("scratch", "1.2"), "tmpfs", opts(0750), 0},
+		{pod.Path("scratch", "1.2"), root + "/srv", "unionfs", "rw", 0},
+	}
+	if !reflect.DeepEqual(fstab, expected) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, fstab)
+	}
+	if fi, err := os.Stat(pod.Path("scratch", "1.2")); err != nil || !fi.IsDir() {
+		t.Errorf("Scratch mount point not created: %v", err)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/writable-paths", "srv")
+	if _, err := pod.ephemeralRootfsFstab(1, img, root); err == nil {
+		t.Error("Relative writable path accepted")
+	}
+	if err := ioutil.WriteFile(filepath.Join(img, "srv", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pod.Manifest.Annotations.Set("jetpack/writable-paths", "/srv/file")
+	if _, err := pod.ephemeralRootfsFstab(1, img, root); err == nil {
+		t.Error("Writable file accepted")
+	}
+}
+
+func TestMountedUnder(t *testing.T) {
+	mounts := []string{"/", "/srv/pods/x", "/srv/pods/xy", "/srv/pods/x/rootfs/0", "/tmp", "/srv/pods/x/rootfs/0/etc"}
+	if under, expected := mountedUnder(mounts, "/srv/pods/x"), []string{"/srv/pods/x/rootfs/0/etc", "/srv/pods/x/rootfs/0", "/srv/pods/x"}; !reflect.DeepEqual(under, expected) {
+		t.Errorf("Expected %v, got %v", expected, under)
+	}
+	if under := mountedUnder(mounts, "/srv/pods/z"); under != nil {
+		t.Errorf("Unexpected mounts %v", under)
+	}
+}
+
+func TestEphemeralPodDestroy(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	pod := newPod(h, nil)
+	SetEphemeral(&pod.Manifest)
+	if err := os.MkdirAll(pod.Path("scratch", "0.0"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f.Ops = nil
+	if err := pod.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pod.Path()); !os.IsNotExist(err) {
+		t.Errorf("Pod's directory not removed: %v", err)
+	}
+	if len(f.Ops) != 0 {
+		t.Errorf("Unexpected operations: %q", f.Ops)
+	}
+}
+
+func TestEphemeralMountPoints(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	for _, dir := range []string{"dev", "etc/ssl", "srv"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "app.conf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newPod(nil, nil)
+	SetEphemeral(&pod.Manifest)
+	for _, err := range []error{
+		pod.mkdirMountPoint(rootfs, "/srv", nil),
+		pod.mkFileMountPoint(rootfs, "/etc/app.conf"),
+		pod.mkdirFSMountPoint(rootfs, "dev", 0555),
+		checkEphemeralFileCopy(rootfs, "/etc/ssl/cert.pem", []string{"/etc", "/var"}),
+	} {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		err  error
+	}{
+		{"/data", pod.mkdirMountPoint(rootfs, "/data", nil)},
+		{"/etc/missing.conf", pod.mkFileMountPoint(rootfs, "/etc/missing.conf")},
+		{"/etc/app.conf", pod.mkdirMountPoint(rootfs, "/etc/app.conf", nil)},
+		{"/proc", pod.mkdirFSMountPoint(rootfs, "proc", 0555)},
+		{"/srv/app.conf", checkEphemeralFileCopy(rootfs, "/srv/app.conf", []string{"/etc", "/var"})},
+		{"/etc/missing", checkEphemeralFileCopy(rootfs, "/etc/missing/app.conf", []string{"/etc", "/var"})},
+	} {
+		if tc.err == nil {
+			t.Errorf("%v: expected error", tc.path)
+		} else if !strings.Contains(tc.err.Error(), tc.path) {
+			t.Errorf("%v: error doesn't name the path: %v", tc.path, tc.err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "data")); !os.IsNotExist(err) {
+		t.Errorf("Mount point created: %v", err)
+	}
+
+	// Other pods create mount points
+	pod = newPod(nil, nil)
+	if err := pod.mkdirMountPoint(rootfs, "/data", nil); err != nil {
+		t.Error(err)
+	} else if fi, err := os.Stat(filepath.Join(rootfs, "data")); err != nil || !fi.IsDir() {
+		t.Errorf("Mount point not created: %v", err)
+	}
+}
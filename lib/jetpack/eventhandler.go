@@ -0,0 +1,168 @@
+package jetpack
+
+import (
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// Apps' eventHandlers come from the app merged from the image's
+// manifest and the pod's runtime app (runtime handlers replace image's
+// handlers of the same name). They run inside the pod's jail with
+// stage2, like the app's exec: as the app's user and group, with its
+// environment and working directory, unless the
+// jetpack/event-handler/NAME/user or jetpack/event-handler/NAME/group
+// annotation of the app or the pod says otherwise (e.g. "0" for root).
+//
+// pre-start handlers run before the app's exec; if one fails, the app
+// is not started. post-stop handlers run after the exec exits, if the
+// jail is still running; their failures are only logged. When the pod
+// is killed, its detached apps get SIGTERM (and SIGKILL if they don't
+// exit within run.KillGrace), and Kill waits for their supervisors to
+// run post-stop handlers before the jail is removed. Handlers' output goes where the app's
+// does, including the pod's logs/ directory, their stdin is /dev/null
+// (the app's stdin is left for its exec), and each run is recorded
+// in the pod's event log as a "handler" event, besides stage2's exec
+// and exit events.
+
+const (
+	EventHandlerPreStart = "pre-start"
+	EventHandlerPostStop = "post-stop"
+)
+
+// Verifies that app has only known event handlers.
+func checkEventHandlers(app *types.App) error {
+	for _, eh := range app.EventHandlers {
+		switch eh.Name {
+		case EventHandlerPreStart, EventHandlerPostStop:
+		default:
+			return errors.Errorf("Unrecognized eventHandler: %v", eh.Name)
+		}
+	}
+	return nil
+}
+
+// Returns execs of app's event handlers named name, in manifest order.
+func (app *App) eventHandlers(name string) [][]string {
+	var execs [][]string
+	for _, eh := range app.app.EventHandlers {
+		if eh.Name == name && len(eh.Exec) > 0 {
+			execs = append(execs, eh.Exec)
+		}
+	}
+	return execs
+}
+
+// Returns user and group to run app's event handlers named name as;
+// empty for app's ones.
+func (app *App) eventHandlerUser(name string) (user, group string) {
+	prefix := "jetpack/event-handler/" + name + "/"
+	user, _ = app.Pod.appAnnotation(app.Name, types.ACIdentifier(prefix+"user"))
+	group, _ = app.Pod.appAnnotation(app.Name, types.ACIdentifier(prefix+"group"))
+	return user, group
+}
+
+// Runs app's event handlers named name in turn, with /dev/null as
+// stdin, recording each run in pod's event log. Stops at, and returns,
+// the first failure.
+func (app *App) runEventHandlers(name string, opts *RunOptions, stdout, stderr io.Writer) error {
+	user, group := app.eventHandlerUser(name)
+	opts = opts.nullStdin()
+	for _, exec := range app.eventHandlers(name) {
+		app.log().Debugf("Running %v handler %v", name, quoteAll(exec))
+		es, err := app.Stage2(opts, nil, stdout, stderr, user, group, "", exec...)
+		if err == nil {
+			err = es.Err()
+		}
+		ev := &Event{Type: EventHandler, App: app.Name, Handler: name, Exec: exec}
+		if es != nil {
+			ev.Code = &es.Code
+			ev.Signal = es.Signal
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		app.Pod.logEvent(ev)
+		if err != nil {
+			return errors.Annotatef(err, "%v handler %v of app %v", name, quoteAll(exec), app.Name)
+		}
+	}
+	return nil
+}
+
+// Runs app's post-stop handlers, if the jail still runs (they don't
+// start it); failures are logged.
+func (app *App) runPostStop(opts *RunOptions, stdout, stderr io.Writer) {
+	if len(app.eventHandlers(EventHandlerPostStop)) == 0 {
+		return
+	}
+	if st, err := app.Pod.jailStatus(true); err != nil {
+		app.log().Warnf("cannot run post-stop handlers: %v", err)
+		return
+	} else if podStatusOf(st) != PodStatusRunning {
+		app.log().Warnf("pod is not running, not running post-stop handlers")
+		return
+	}
+	noStart := app.noStart
+	app.noStart = true
+	defer func() { app.noStart = noStart }()
+	if err := app.runEventHandlers(EventHandlerPostStop, opts, stdout, stderr); err != nil {
+		app.log().Warnf("%v", err)
+	}
+}
+
+// Stops pod's detached apps, and waits for their supervisors to run
+// post-stop handlers and finish, up to timeout after the apps are
+// killed (0 waits as long as it takes); called before the jail is
+// removed.
+func (pod *Pod) stopDetachedApps(timeout time.Duration) {
+	var svs []*Supervisor
+	for _, rtapp := range pod.Manifest.Apps {
+		if sv, err := pod.Supervisor(rtapp.Name); err != nil {
+			pod.log().Warnf("cannot read supervisor state of app %v: %v", rtapp.Name, err)
+		} else if sv == nil {
+			continue
+		} else if err := sv.Signal(syscall.SIGTERM); err != nil {
+			pod.log().Warnf("cannot stop detached app %v: %v", rtapp.Name, err)
+		} else {
+			svs = append(svs, sv)
+		}
+	}
+
+	deadline := time.Now().Add(run.KillGrace)
+	killed := false
+	for _, sv := range svs {
+		for sv.Alive() {
+			switch {
+			case !killed && time.Now().After(deadline):
+				pod.killDetachedApps(svs)
+				killed = true
+				deadline = time.Now().Add(timeout)
+			case killed && timeout > 0 && time.Now().After(deadline):
+				pod.log().Warnf("supervisor of app %v did not finish within %v", sv.App, timeout)
+				return
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+}
+
+// Kills detached apps whose supervisors are still running.
+func (pod *Pod) killDetachedApps(svs []*Supervisor) {
+	for _, sv := range svs {
+		// Reload the state for app's current pid
+		if cur, err := pod.Supervisor(sv.App); err != nil {
+			pod.log().Warnf("cannot read supervisor state of app %v: %v", sv.App, err)
+		} else if cur != nil && cur.AppPid != 0 {
+			pod.log().Warnf("app %v did not stop within %v, killing it", sv.App, run.KillGrace)
+			if err := cur.Signal(syscall.SIGKILL); err != nil {
+				pod.log().Warnf("cannot kill app %v: %v", sv.App, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestEventHandlers(t *testing.T) {
+	pod := newPod(nil, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name}}
+	app := &App{Name: name, Pod: pod, app: &types.App{EventHandlers: []types.EventHandler{
+		{Name: EventHandlerPreStart, Exec: []string{"/bin/first"}},
+		{Name: EventHandlerPostStop, Exec: []string{"/bin/cleanup"}},
+		{Name: EventHandlerPreStart, Exec: []string{"/bin/second", "arg"}},
+	}}}
+
+	if err := checkEventHandlers(app.app); err != nil {
+		t.Error(err)
+	}
+	if execs := app.eventHandlers(EventHandlerPreStart); !reflect.DeepEqual(execs, [][]string{{"/bin/first"}, {"/bin/second", "arg"}}) {
+		t.Errorf("Unexpected pre-start handlers %v", execs)
+	}
+	if execs := app.eventHandlers("nope"); execs != nil {
+		t.Errorf("Unexpected handlers %v", execs)
+	}
+
+	if user, group := app.eventHandlerUser(EventHandlerPreStart); user != "" || group != "" {
+		t.Errorf("Expected app's user, got %#v, %#v", user, group)
+	}
+	pod.Manifest.Annotations.Set("jetpack/event-handler/pre-start/user", "0")
+	pod.Manifest.Apps[0].Annotations.Set("jetpack/event-handler/pre-start/user", "www")
+	pod.Manifest.Annotations.Set("jetpack/event-handler/pre-start/group", "wheel")
+	if user, group := app.eventHandlerUser(EventHandlerPreStart); user != "www" || group != "wheel" {
+		t.Errorf("Expected www:wheel, got %#v, %#v", user, group)
+	}
+	if user, group := app.eventHandlerUser(EventHandlerPostStop); user != "" || group != "" {
+		t.Errorf("Expected app's user, got %#v, %#v", user, group)
+	}
+
+	app.app.EventHandlers = append(app.app.EventHandlers, types.EventHandler{Name: "pre-stop", Exec: []string{"/bin/true"}})
+	if err := checkEventHandlers(app.app); err == nil {
+		t.Error("Unknown handler passed validation")
+	}
+}
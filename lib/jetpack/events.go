@@ -0,0 +1,174 @@
+package jetpack
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// Pod's event log (`events.log` in the pod's directory) records the
+// pod's lifecycle: creation, jail starts and stops, runs of the pod's
+// commands, kills. It's append-only, one JSON object per line, so that
+// a crash can damage at most the last record. Destruction of a pod is
+// recorded in the host's event log, as the pod's directory is removed,
+// and so are image imports. In debug mode, jail starts and stops
+// record the jail(8) commands that were run, with their durations and
+// exit statuses.
+
+type EventType string
+
+const (
+	EventCreate          EventType = "create"
+	EventStart           EventType = "start"  // jail created
+	EventStop            EventType = "stop"   // jail removed
+	EventExec            EventType = "exec"   // stage2 command started
+	EventExit            EventType = "exit"   // stage2 command finished
+	EventDetach          EventType = "detach" // app started under a supervisor
+	EventKill            EventType = "kill"
+	EventDestroy         EventType = "destroy"
+	EventSupervisorError EventType = "supervisor-error"
+	EventHook            EventType = "hook"     // operator hook run
+	EventHandler         EventType = "handler"  // app's event handler run
+	EventImport          EventType = "import"   // image imported
+	EventLimit           EventType = "limit"    // rctl devctl rule matched
+	EventOverflow        EventType = "overflow" // watcher's events were dropped
+)
+
+type Event struct {
+	Time     time.Time
+	Type     EventType
+	Pid      int          // pid of the jetpack process that recorded the event
+	Actor    string       // command line of that process
+	Pod      string       `json:",omitempty"` // only in host's event log
+	Image    string       `json:",omitempty"` // image hash, for image events
+	App      types.ACName `json:",omitempty"`
+	Exec     []string     `json:",omitempty"`
+	EnvFiles []string     `json:",omitempty"` // env files applied to exec
+	Code     *int         `json:",omitempty"` // exit code
+	Signal   string       `json:",omitempty"`
+	Hook     string       `json:",omitempty"` // for hook events
+	Handler  string       `json:",omitempty"` // for handler events
+	Error    string       `json:",omitempty"`
+	Details  string       `json:",omitempty"`
+
+	// External commands of the operation, traced in debug mode
+	Commands []*run.Invocation `json:",omitempty"`
+}
+
+func (pod *Pod) EventLogPath() string {
+	return pod.Path("events.log")
+}
+
+func (h *Host) EventLogPath() string {
+	return h.Path("events.log")
+}
+
+// Returns events recorded in the pod's event log, oldest first.
+func (pod *Pod) Events() ([]*Event, error) {
+	return readEvents(pod.EventLogPath())
+}
+
+// Returns events recorded in the host's event log, oldest first.
+func (h *Host) Events() ([]*Event, error) {
+	return readEvents(h.EventLogPath())
+}
+
+// Records trace of cmd's execution, if it was traced.
+func (ev *Event) traceCommand(cmd *run.Cmd) {
+	if inv := cmd.Invocation(); inv != nil {
+		ev.Commands = append(ev.Commands, inv)
+	}
+}
+
+func (pod *Pod) logEvent(ev *Event) {
+	if err := appendEvent(pod.EventLogPath(), ev); err != nil {
+		pod.log().Warnf("cannot write event log: %v", err)
+	}
+	evc := *ev
+	evc.Pod = pod.UUID.String()
+	pod.Host.publishEvent(&evc)
+}
+
+func (h *Host) logEvent(ev *Event) {
+	if err := appendEvent(h.EventLogPath(), ev); err != nil {
+		h.log().Warnf("cannot write event log: %v", err)
+	}
+	h.publishEvent(ev)
+}
+
+// Records end of a stage2 command, successful or not.
+func (app *App) logExit(exec []string, es *ExitStatus, err error) {
+	ev := &Event{Type: EventExit, App: app.Name, Exec: exec}
+	if es != nil {
+		ev.Code = &es.Code
+		ev.Signal = es.Signal
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	app.Pod.logEvent(ev)
+}
+
+func appendEvent(path string, ev *Event) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Pid = os.Getpid()
+	ev.Actor = run.ShellEscape(os.Args...)
+
+	bb, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	bb = append(bb, '\n')
+	// Terminate a torn record, so that it doesn't swallow this one
+	if fi, err := f.Stat(); err != nil {
+		return errors.Trace(err)
+	} else if fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+			return errors.Trace(err)
+		} else if last[0] != '\n' {
+			bb = append([]byte{'\n'}, bb...)
+		}
+	}
+	// Single write, so that concurrent writers don't interleave
+	if _, err := f.Write(bb); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
+
+func readEvents(path string) ([]*Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var events []*Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		ev := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+			// Torn write after a crash
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, errors.Trace(scanner.Err())
+}
@@ -0,0 +1,59 @@
+package jetpack
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestPodEvents(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if evs, err := pod.Events(); err != nil || evs != nil {
+		t.Errorf("No log: got %v, %v", evs, err)
+	}
+
+	app := &App{Name: *types.MustACName("app"), Pod: pod}
+	pod.logEvent(&Event{Type: EventCreate})
+	app.logExit([]string{"/bin/false"}, &ExitStatus{App: app.Name, Code: 1}, nil)
+
+	// A torn record is skipped
+	f, err := os.OpenFile(pod.EventLogPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time":"`)
+	f.Close()
+
+	app.logExit(nil, nil, errors.New("oops"))
+
+	evs, err := pod.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(evs))
+	}
+	if evs[0].Type != EventCreate || evs[0].Pid != os.Getpid() || evs[0].Time.IsZero() {
+		t.Errorf("Unexpected first event: %#v", evs[0])
+	}
+	if ev := evs[1]; ev.Type != EventExit || ev.App != app.Name || ev.Code == nil || *ev.Code != 1 || ev.Error != "" {
+		t.Errorf("Unexpected exit event: %#v", ev)
+	}
+	if ev := evs[2]; ev.Code != nil || ev.Error != "oops" {
+		t.Errorf("Unexpected failure event: %#v", ev)
+	}
+}
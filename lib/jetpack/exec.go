@@ -0,0 +1,64 @@
+package jetpack
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Options of Pod.Exec
+type ExecOptions struct {
+	RunOptions
+
+	// Capture command's stdout and stderr instead of passing them to
+	// jetpack's stdout and stderr. Command's stdin is then empty.
+	Capture bool
+}
+
+// Result of Pod.Exec
+type ExecResult struct {
+	*ExitStatus
+
+	// Output of the command, if it was captured
+	Stdout, Stderr []byte
+}
+
+// Runs a command in a running pod, as app name would run it: with
+// app's user, group, working directory, and environment. Unlike
+// App.Stage2, it doesn't start the pod's jail if it's not running.
+func (pod *Pod) Exec(name types.ACName, cmd []string, opts *ExecOptions) (*ExecResult, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("No command to execute")
+	}
+	if opts == nil {
+		opts = &ExecOptions{}
+	}
+	app := pod.App(name)
+	if app == nil {
+		return nil, ErrNotFound
+	}
+	// Command runs as a separate App, so that it doesn't interfere
+	// with the app's own stage2 command.
+	app = &App{Name: app.Name, Pod: pod, app: mergeApps(app.app, &types.App{Exec: cmd}), noStart: true}
+
+	var stdin io.Reader = os.Stdin
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	var outBuf, errBuf bytes.Buffer
+	if opts.Capture {
+		stdin, stdout, stderr = nil, &outBuf, &errBuf
+	}
+
+	es, err := app.Stage2(&opts.RunOptions, stdin, stdout, stderr, "", "", "", app.app.Exec...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	es.Exec = app.app.Exec
+	res := &ExecResult{ExitStatus: es}
+	if opts.Capture {
+		res.Stdout, res.Stderr = outBuf.Bytes(), errBuf.Bytes()
+	}
+	return res, nil
+}
@@ -0,0 +1,14 @@
+package jetpack
+
+import (
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestPodExecNoCommand(t *testing.T) {
+	pod := newPod(nil, nil)
+	if res, err := pod.Exec(*types.MustACName("app"), nil, nil); err == nil {
+		t.Errorf("Expected error, got %v", res)
+	}
+}
@@ -0,0 +1,132 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// How a stage2 command finished
+type ExitStatus struct {
+	App      types.ACName
+	Exec     []string `json:",omitempty"` // app's exec, as run
+	Code     int      // -1 if killed by a signal
+	Signal   string   `json:",omitempty"`
+	Finished time.Time
+}
+
+func (es *ExitStatus) Success() bool {
+	return es.Code == 0
+}
+
+func (es *ExitStatus) String() string {
+	if es.Signal != "" {
+		return fmt.Sprintf("Killed (%v)", es.Signal)
+	}
+	return fmt.Sprintf("Exited (%d)", es.Code)
+}
+
+// Returns nil for successful status, or AppExitError.
+func (es *ExitStatus) Err() error {
+	if es == nil || es.Success() {
+		return nil
+	}
+	return &AppExitError{es}
+}
+
+// App ran, but didn't finish successfully.
+type AppExitError struct {
+	*ExitStatus
+}
+
+func (err *AppExitError) Error() string {
+	return fmt.Sprintf("App %v: %v", err.App, err.ExitStatus)
+}
+
+// Returns exit status of a finished command. Error is returned when
+// command couldn't be started, or failed other way.
+func exitStatus(app types.ACName, err error) (*ExitStatus, error) {
+	es := &ExitStatus{App: app, Finished: time.Now()}
+	if err == nil {
+		return es, nil
+	}
+	cerr, ok := err.(*run.CmdError)
+	if !ok {
+		return nil, errors.Trace(err)
+	}
+	eerr, ok := cerr.ExecError.(*exec.ExitError)
+	if !ok {
+		return nil, errors.Trace(err)
+	}
+	ws, ok := eerr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil, errors.Trace(err)
+	}
+	if ws.Signaled() {
+		es.Code = -1
+		es.Signal = ws.Signal().String()
+	} else {
+		es.Code = ws.ExitStatus()
+	}
+	return es, nil
+}
+
+// Returns last recorded exit statuses of the pod's apps.
+func (pod *Pod) ExitStatuses() (map[types.ACName]*ExitStatus, error) {
+	statuses := make(map[types.ACName]*ExitStatus)
+	if bb, err := ioutil.ReadFile(pod.Path("exit-status")); os.IsNotExist(err) {
+		return statuses, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &statuses); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return statuses, nil
+}
+
+// Returns the most recent of the pod's exit statuses, preferring
+// unsuccessful ones, or nil if no app has finished yet.
+func (pod *Pod) LastExitStatus() (*ExitStatus, error) {
+	statuses, err := pod.ExitStatuses()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var last *ExitStatus
+	for _, es := range statuses {
+		switch {
+		case last == nil:
+			last = es
+		case last.Success() != es.Success():
+			if !es.Success() {
+				last = es
+			}
+		case es.Finished.After(last.Finished):
+			last = es
+		}
+	}
+	return last, nil
+}
+
+func (pod *Pod) recordExitStatus(es *ExitStatus) error {
+	pod.exitStatusMx.Lock()
+	defer pod.exitStatusMx.Unlock()
+	statuses, err := pod.ExitStatuses()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	statuses[es.App] = es
+	if bb, err := json.Marshal(statuses); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(writeFileAtomic(pod.Path("exit-status"), bb, 0640))
+	}
+}
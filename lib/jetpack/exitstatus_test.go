@@ -0,0 +1,36 @@
+package jetpack
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+func TestExitStatus(t *testing.T) {
+	app := *types.MustACName("test")
+	for script, expected := range map[string]ExitStatus{
+		"exit 0":        {App: app},
+		"exit 3":        {App: app, Code: 3},
+		"kill -TERM $$": {App: app, Code: -1, Signal: "terminated"},
+	} {
+		cmd := run.Command("/bin/sh", "-c", script)
+		if es, err := exitStatus(app, cmd.Run()); err != nil {
+			t.Errorf("%#v: %v", script, err)
+		} else if es.Code != expected.Code || es.Signal != expected.Signal || es.App != app {
+			t.Errorf("%#v: got %#v, expected %#v", script, es, expected)
+		} else if (es.Err() == nil) != (expected.Code == 0) {
+			t.Errorf("%#v: unexpected Err() %v", script, es.Err())
+		}
+	}
+
+	// Command that didn't run is an error
+	if es, err := exitStatus(app, run.Command("/nonexistent").Run()); err == nil {
+		t.Errorf("Expected error, got %#v", es)
+	}
+	if es, err := exitStatus(app, errors.New("failed")); err == nil {
+		t.Errorf("Expected error, got %#v", es)
+	}
+}
@@ -0,0 +1,203 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Exported ACI is canonical: the same manifest and rootfs give the
+// same tarball, so an exported image, imported on another host and
+// exported again, keeps its hash. The manifest comes first, without
+// dependencies (the rootfs is complete), followed by the rootfs in
+// walk order: each directory's entries sorted by name. Headers carry
+// mode, numeric ownership, modification time (in whole seconds), and
+// extended attributes where the system supports them; no user or
+// group names, access or change times. Hard links are written as
+// links to the first path of the file.
+
+// Options of exporting an image
+type ExportOptions struct {
+	Gzip bool // compress the ACI
+}
+
+// Writes image as a flat ACI to w. Returns hash of the uncompressed
+// ACI, which is the ID of an image imported from it.
+func (img *Image) Export(w io.Writer, opts *ExportOptions) (*types.Hash, error) {
+	return img.writeCanonicalACI(w, opts, nil)
+}
+
+// Writes image as a canonical ACI, calling onEntry for each of its
+// entries.
+func (img *Image) writeCanonicalACI(w io.Writer, opts *ExportOptions, onEntry entryFunc) (*types.Hash, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	var gzw *gzip.Writer
+	if opts.Gzip {
+		gzw = gzip.NewWriter(w)
+		w = gzw
+	}
+	hash := sha512.New()
+	tw := tar.NewWriter(io.MultiWriter(w, hash))
+
+	manifest := img.Manifest
+	manifest.Dependencies = nil
+	manifest.PathWhitelist = nil
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "manifest",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(manifestBytes)),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if onEntry != nil {
+		onEntry("manifest", entryDigest(&tar.Header{Name: "manifest", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(manifestBytes))}, manifestBytes))
+	}
+
+	if err := writeRootfsTar(tw, img.Path("rootfs"), onEntry); err != nil {
+		return nil, errors.Annotatef(err, "Exporting %v", img)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return types.NewHash(fmt.Sprintf("sha512-%x", hash.Sum(nil)))
+}
+
+// Receives name and digest of each entry of a written ACI
+type entryFunc func(name string, digest []byte)
+
+// Returns digest of entry's header fields that are exported, and of
+// its content.
+func entryDigest(hdr *tar.Header, content []byte) []byte {
+	hash := sha512.New()
+	writeEntryHeader(hash, hdr)
+	hash.Write(content)
+	return hash.Sum(nil)
+}
+
+func writeEntryHeader(w io.Writer, hdr *tar.Header) {
+	fmt.Fprintf(w, "%q %c %o %d %d %d %d %q\n", hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Size, hdr.ModTime.Unix(), hdr.Linkname)
+	keys := make([]string, 0, len(hdr.PAXRecords))
+	for k := range hdr.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%q=%q\n", k, hdr.PAXRecords[k])
+	}
+}
+
+// Writes tree at dir to tw as rootfs/, in canonical form. If onEntry
+// is not nil, it is called for each entry.
+func writeRootfsTar(tw *tar.Writer, dir string, onEntry entryFunc) error {
+	links := make(map[[2]uint64]string) // device and inode to first path
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			// Not an image's content
+			return nil
+		}
+		name := "rootfs"
+		if rel != "." {
+			name += "/" + filepath.ToSlash(rel)
+		}
+
+		var target string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.ModTime = hdr.ModTime.Truncate(1e9)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatPAX
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[key] = name
+			}
+		}
+
+		if xattrs, err := readXattrs(path); err != nil {
+			return errors.Annotatef(err, "Extended attributes of %v", name)
+		} else if len(xattrs) > 0 {
+			hdr.PAXRecords = make(map[string]string, len(xattrs))
+			names := make([]string, 0, len(xattrs))
+			for k := range xattrs {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			for _, k := range names {
+				hdr.PAXRecords["SCHILY.xattr."+k] = xattrs[k]
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		var out io.Writer = tw
+		if onEntry != nil {
+			digest := sha512.New()
+			writeEntryHeader(digest, hdr)
+			out = io.MultiWriter(tw, digest)
+			defer func() { onEntry(name, digest.Sum(nil)) }()
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(out, f, hdr.Size)
+		return err
+	})
+}
@@ -0,0 +1,162 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Extracts rootfs of an exported ACI to dir, keeping modes and times.
+func extractTestRootfs(t *testing.T, aci []byte, dir string) {
+	tr := tar.NewReader(bytes.NewReader(aci))
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel("rootfs", filepath.Clean(hdr.Name))
+		if err != nil || rel == ".." || filepath.IsAbs(rel) || len(rel) > 2 && rel[:3] == "../" {
+			continue
+		}
+		path := filepath.Join(dir, rel)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0700)
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)); err == nil {
+				_, err = io.Copy(f, tr)
+				f.Close()
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeLink:
+			err = os.Link(filepath.Join(dir, hdr.Linkname[len("rootfs/"):]), path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Lchown(path, hdr.Uid, hdr.Gid)
+			os.Chmod(path, os.FileMode(hdr.Mode))
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		}
+	}
+	// Directories' times are set after their contents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := filepath.Rel("rootfs", filepath.Clean(dirs[i].Name))
+		os.Chtimes(filepath.Join(dir, rel), dirs[i].ModTime, dirs[i].ModTime)
+	}
+}
+
+func TestExportImage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	img := saveTestImage(t, h, "example.com/export")
+	rootfs := img.Path("rootfs")
+	writeTestFiles(t, rootfs, map[string]string{
+		"bin/app":        "#!/bin/sh\n",
+		"etc/motd":       "hello\n",
+		"var/empty/.dot": "",
+	})
+	os.Chmod(filepath.Join(rootfs, "bin/app"), 0755)
+	if err := os.Symlink("../bin/app", filepath.Join(rootfs, "etc/app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(rootfs, "etc/motd"), filepath.Join(rootfs, "etc/motd.link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1400000000, 500)
+	filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+			os.Chtimes(path, mtime, mtime)
+		}
+		return nil
+	})
+
+	var buf, buf2 bytes.Buffer
+	hash, err := img.Export(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("sha512-%x", sha512.Sum512(buf.Bytes())); hash.String() != expected {
+		t.Errorf("hash is %v, expected %v", hash, expected)
+	}
+	if hash2, err := img.Export(&buf2, nil); err != nil {
+		t.Fatal(err)
+	} else if hash2.String() != hash.String() || !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("exports of the same image differ")
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for hdr, err := tr.Next(); err != io.EOF; hdr, err = tr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "rootfs/etc/motd.link" && (hdr.Typeflag != tar.TypeLink || hdr.Linkname != "rootfs/etc/motd") {
+			t.Errorf("hard link is %#v", hdr)
+		}
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"manifest", "rootfs/", "rootfs/bin/", "rootfs/bin/app", "rootfs/etc/",
+		"rootfs/etc/app", "rootfs/etc/motd", "rootfs/etc/motd.link", "rootfs/var/",
+		"rootfs/var/empty/", "rootfs/var/empty/.dot"}; fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("entries are %v, expected %v", names, expected)
+	}
+
+	var gz bytes.Buffer
+	if hashGz, err := img.Export(&gz, &ExportOptions{Gzip: true}); err != nil {
+		t.Fatal(err)
+	} else if hashGz.String() != hash.String() {
+		t.Errorf("gzipped hash is %v, expected %v", hashGz, hash)
+	}
+	if gzr, err := gzip.NewReader(&gz); err != nil {
+		t.Fatal(err)
+	} else if bb, err := ioutil.ReadAll(gzr); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(bb, buf.Bytes()) {
+		t.Error("gzipped export differs")
+	}
+
+	// Same rootfs in another image: same hash
+	img2 := saveTestImage(t, h, "example.com/export-copy")
+	img2.Manifest = img.Manifest
+	extractTestRootfs(t, buf.Bytes(), img2.Path("rootfs"))
+	if hash2, err := img2.Export(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	} else if hash2.String() != hash.String() {
+		t.Errorf("re-exported hash is %v, expected %v", hash2, hash)
+	}
+
+	// Changed rootfs: different hash
+	ioutil.WriteFile(filepath.Join(img2.Path("rootfs"), "etc/motd"), []byte("HELLO\n"), 0644)
+	os.Chtimes(filepath.Join(img2.Path("rootfs"), "etc/motd"), mtime, mtime)
+	if hash2, err := img2.Export(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	} else if hash2.String() == hash.String() {
+		t.Error("changed rootfs has the same hash")
+	}
+}
@@ -0,0 +1,116 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Extra mounts are host paths mounted into all of the pod's apps
+// without a volume or mount point in the manifests. They are declared
+// with `jetpack/mount/N` annotations set to "HOSTPATH:PODPATH[:ro]".
+// The allow.extra-mounts property can forbid them on the host.
+
+const extraMountPrefix = "jetpack/mount/"
+
+type ExtraMount struct {
+	Name     string
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+func (em ExtraMount) String() string {
+	opts := "rw"
+	if em.ReadOnly {
+		opts = "ro"
+	}
+	return fmt.Sprintf("%v:%v:%v", em.Source, em.Target, opts)
+}
+
+func parseExtraMount(name, str string) (ExtraMount, error) {
+	em := ExtraMount{Name: name}
+	pieces := strings.Split(str, ":")
+	switch {
+	case len(pieces) == 3 && pieces[2] == "ro":
+		em.ReadOnly = true
+	case len(pieces) == 3 && pieces[2] == "rw":
+	case len(pieces) == 2:
+	default:
+		return em, errors.Errorf("Invalid extra mount %#v, expected HOSTPATH:PODPATH[:ro]", str)
+	}
+	em.Source, em.Target = pieces[0], pieces[1]
+	if !filepath.IsAbs(em.Source) || !filepath.IsAbs(em.Target) {
+		return em, errors.Errorf("Invalid extra mount %#v, paths need to be absolute", str)
+	}
+	return em, nil
+}
+
+// Returns pod's extra mounts, sorted by name.
+func (pod *Pod) ExtraMounts() ([]ExtraMount, error) {
+	var ems []ExtraMount
+	for _, ann := range pod.Manifest.Annotations {
+		if !strings.HasPrefix(string(ann.Name), extraMountPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(string(ann.Name), extraMountPrefix)
+		if em, err := parseExtraMount(name, ann.Value); err != nil {
+			return nil, errors.Annotatef(err, "Mount %v", name)
+		} else {
+			ems = append(ems, em)
+		}
+	}
+	sort.Slice(ems, func(i, j int) bool { return ems[i].Name < ems[j].Name })
+	return ems, nil
+}
+
+// Verifies that extra mounts are allowed, and that their sources
+// exist.
+func (pod *Pod) checkExtraMounts() ([]ExtraMount, error) {
+	ems, err := pod.ExtraMounts()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(ems) > 0 && !Config().GetBool("allow.extra-mounts", true) {
+		return nil, errors.New("Extra mounts are not allowed on this host")
+	}
+	for _, em := range ems {
+		if _, err := os.Stat(em.Source); err != nil {
+			return nil, errors.Annotatef(err, "Mount %v", em.Name)
+		}
+		if err := pod.checkOutsideRootfs(em.Source); err != nil {
+			return nil, errors.Annotatef(err, "Mount %v", em.Name)
+		}
+	}
+	return ems, nil
+}
+
+// Creates mount points and returns fstab entries of extra mounts in an
+// app's rootfs.
+func (pod *Pod) extraMountsFstab(ems []ExtraMount, appRootfs string) ([]fstabEntry, error) {
+	entries := make([]fstabEntry, 0, len(ems))
+	for _, em := range ems {
+		fi, err := os.Stat(em.Source)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Mount %v", em.Name)
+		}
+		if fi.IsDir() {
+			err = pod.mkdirMountPoint(appRootfs, em.Target, fi)
+		} else {
+			err = pod.mkFileMountPoint(appRootfs, em.Target)
+		}
+		if err != nil {
+			return nil, errors.Annotatef(err, "Mount %v", em.Name)
+		}
+		opts := "rw"
+		if em.ReadOnly {
+			opts = "ro"
+		}
+		entries = append(entries, fstabEntry{em.Source, filepath.Join(appRootfs, em.Target), "nullfs", opts, 1})
+	}
+	return entries, nil
+}
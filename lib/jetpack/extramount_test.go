@@ -0,0 +1,70 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtraMount(t *testing.T) {
+	for str, expected := range map[string]ExtraMount{
+		"/srv/tools:/opt/tools":          {Name: "0", Source: "/srv/tools", Target: "/opt/tools"},
+		"/srv/tools:/opt/tools:ro":       {Name: "0", Source: "/srv/tools", Target: "/opt/tools", ReadOnly: true},
+		"/var/run/sock:/var/run/sock:rw": {Name: "0", Source: "/var/run/sock", Target: "/var/run/sock"},
+	} {
+		if em, err := parseExtraMount("0", str); err != nil {
+			t.Errorf("%#v: %v", str, err)
+		} else if !reflect.DeepEqual(em, expected) {
+			t.Errorf("%#v: got %#v, expected %#v", str, em, expected)
+		}
+	}
+
+	for _, str := range []string{"", "/srv/tools", "srv/tools:/opt/tools", "/srv/tools:opt/tools", "/srv/tools:/opt/tools:rx", "/a:/b:ro:x"} {
+		if em, err := parseExtraMount("0", str); err == nil {
+			t.Errorf("%#v: expected error, got %#v", str, em)
+		}
+	}
+}
+
+func TestExtraMountsFstab(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	toolbox := filepath.Join(tmp, "tool box")
+	config := filepath.Join(tmp, "app.conf")
+	for _, dir := range []string{rootfs, toolbox} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(config, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ems := []ExtraMount{
+		{Name: "0", Source: toolbox, Target: "/opt/tool box", ReadOnly: true},
+		{Name: "1", Source: config, Target: "/usr/local/etc/app.conf"},
+	}
+	expected := []fstabEntry{
+		{toolbox, filepath.Join(rootfs, "opt", "tool box"), "nullfs", "ro", 1},
+		{config, filepath.Join(rootfs, "usr", "local", "etc", "app.conf"), "nullfs", "rw", 1},
+	}
+	if entries, err := newPod(nil, nil).extraMountsFstab(ems, rootfs); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got %#v, expected %#v", entries, expected)
+	}
+
+	if fi, err := os.Stat(filepath.Join(rootfs, "opt", "tool box")); err != nil || !fi.IsDir() {
+		t.Errorf("Directory mount point not created: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, "usr", "local", "etc", "app.conf")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("File mount point not created: %v", err)
+	}
+}
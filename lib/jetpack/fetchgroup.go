@@ -0,0 +1,161 @@
+package jetpack
+
+import (
+	"context"
+	stderrors "errors"
+	"sort"
+	"sync"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// A fetch group is a top-level fetch or import with the dependencies
+// it fetches, recursively. Dependencies of an image are fetched
+// concurrently, each (with its own dependencies) in a goroutine; at
+// most fetch.concurrency downloads of the group run at a time, while
+// verification, extraction, and registration of downloaded images
+// overlap with them. An image is rendered only when all its
+// dependencies are stored, so rootfs are still rendered in dependency
+// order. An image that several branches need is fetched once, the
+// other branches waiting for it; a branch that would wait for itself
+// fails with CircularDependencyError. Progress of the whole group goes
+// to its options' Progress, one report at a time. The first failure cancels
+// the group's downloads, and is reported with the dependency that
+// failed; downloads canceled by it fail with errFetchCanceled.
+
+// Cause of a fetch canceled by another fetch's failure
+var errFetchCanceled = stderrors.New("Fetch canceled")
+
+type fetchGroup struct {
+	h         *Host
+	opts      *ImageOptions
+	ctx       context.Context
+	cancel    func()
+	slots     chan struct{} // taken by running downloads
+	progress  fetch.ProgressFunc
+	resolving resolvingImages
+
+	mx      sync.Mutex
+	fetches map[string]*imageFetch
+}
+
+// Fetch of an image within a group
+type imageFetch struct {
+	done chan struct{} // closed when finished
+	img  *Image
+	err  error
+}
+
+// Returns fetch.concurrency.
+func fetchConcurrency() int {
+	if n := Config().GetInt("fetch.concurrency", 4); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Returns new fetch group with opts (defaults if nil).
+func (h *Host) newFetchGroup(opts *ImageOptions) *fetchGroup {
+	if opts == nil {
+		opts = &ImageOptions{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fg := &fetchGroup{
+		h:       h,
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		slots:   make(chan struct{}, fetchConcurrency()),
+		fetches: make(map[string]*imageFetch),
+	}
+	if progress := opts.Progress; progress != nil {
+		var mx sync.Mutex
+		fg.progress = func(p fetch.Progress) {
+			mx.Lock()
+			defer mx.Unlock()
+			progress(p)
+		}
+	}
+	return fg
+}
+
+// Waits for a download slot; returns function that frees it.
+func (fg *fetchGroup) acquire() (func(), error) {
+	if fg.ctx.Err() != nil {
+		return nil, errFetchCanceled
+	}
+	select {
+	case fg.slots <- struct{}{}:
+		return func() { <-fg.slots }, nil
+	case <-fg.ctx.Done():
+		return nil, errFetchCanceled
+	}
+}
+
+// Returns err of a download, or errFetchCanceled if the group has been
+// canceled meanwhile.
+func (fg *fetchGroup) downloadError(err error) error {
+	if fg.ctx.Err() != nil {
+		return errFetchCanceled
+	}
+	return err
+}
+
+// Finds dependency of image name in the store, or fetches it.
+func (fg *fetchGroup) getDependency(name types.ACIdentifier, dep types.Dependency) (*Image, error) {
+	// TODO: validate dep.Size
+	var hash types.Hash
+	if dep.ImageID != nil {
+		hash = *dep.ImageID
+	}
+	if img, err := fg.h.GetLocalImage(hash, dep.ImageName, dep.Labels); errors.Cause(err) != ErrNotFound || dep.ImageName.Empty() {
+		return img, errors.Trace(err)
+	} else if !Config().GetBool("allow.autodiscovery", true) {
+		return nil, errors.Annotatef(err, "Image %v (allow.autodiscovery is off)", dep.ImageName)
+	}
+
+	leave, err := fg.resolving.wait(name, dep.ImageName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer leave()
+	img, err := fg.fetch(dep.ImageName, dep.Labels)
+	if err != nil {
+		if cause := errors.Cause(err); cause != ErrNotFound && cause != fetch.ErrDiscoveryFailed && cause != errFetchCanceled {
+			fg.cancel()
+		}
+		return nil, errors.Trace(err)
+	}
+	if err := fg.h.doubleCheckImage(img, hash, dep.ImageName, dep.Labels); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return img, nil
+}
+
+// Fetches an image once per group: fetching an image that is being
+// fetched waits for it.
+func (fg *fetchGroup) fetch(name types.ACIdentifier, labels types.Labels) (*Image, error) {
+	sorted := append(types.Labels(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	key := imageString(name, sorted)
+
+	fg.mx.Lock()
+	f, fetching := fg.fetches[key]
+	if !fetching {
+		f = &imageFetch{done: make(chan struct{})}
+		fg.fetches[key] = f
+	}
+	fg.mx.Unlock()
+
+	if fetching {
+		fg.h.log().Debugf("waiting for fetch of %v", key)
+		<-f.done
+	} else {
+		f.img, f.err = fg.h.fetchImage(fg, name, labels)
+		close(f.done)
+	}
+	return f.img, f.err
+}
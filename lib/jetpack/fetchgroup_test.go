@@ -0,0 +1,50 @@
+package jetpack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties"
+)
+
+func TestFetchGroupSlots(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	configProperties.Set("fetch.concurrency", "2")
+
+	fg := (&Host{}).newFetchGroup(nil)
+	defer fg.cancel()
+	release1, err := fg.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fg.acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		_, err := fg.acquire()
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more slots than fetch.concurrency")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release1()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceled group doesn't wait
+	fg.cancel()
+	if _, err := fg.acquire(); err != errFetchCanceled {
+		t.Errorf("expected errFetchCanceled, got %v", err)
+	}
+	if err := fg.downloadError(ErrNotFound); err != errFetchCanceled {
+		t.Errorf("expected errFetchCanceled, got %v", err)
+	}
+}
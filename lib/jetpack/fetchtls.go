@@ -0,0 +1,99 @@
+package jetpack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+)
+
+// TLS settings of image servers and registries are read from fetch.tls
+// (relative to jetpack.conf's directory), in the same format as
+// fetch.credentials, with a table for each host pattern:
+//
+//     ["images.internal.example.com"]
+//     ca = "internal-ca.pem"
+//     cert = "client.pem"
+//     key = "client.key"
+//
+//     ["dev-registry.example.com:5000"]
+//     allow-insecure = "skip-verify, http"
+//
+// Paths are relative to the file's directory. allow-insecure needs a
+// host name, not a pattern: there is no global switch to skip
+// verification. The first matching host pattern wins.
+
+// Reads TLS settings from a structured file. Missing file is not an
+// error.
+func readTLSConfigs(path string) ([]*fetch.TLSConfig, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	entries, err := parseConfigFile(path, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	relPath := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(path), p)
+	}
+	var rv []*fetch.TLSConfig
+	byHost := make(map[string]*fetch.TLSConfig)
+	for _, entry := range entries {
+		dot := strings.LastIndex(entry.Name, ".")
+		if dot < 0 {
+			return nil, errors.Errorf("%v: %v: expected a [HOST] table", entry.Source, entry.Name)
+		}
+		host, key := entry.Name[:dot], entry.Name[dot+1:]
+		tc := byHost[host]
+		if tc == nil {
+			tc = &fetch.TLSConfig{Host: host, Source: path}
+			byHost[host] = tc
+			rv = append(rv, tc)
+		}
+		switch key {
+		case "ca":
+			tc.CAFile = relPath(entry.Value)
+		case "cert":
+			tc.CertFile = relPath(entry.Value)
+		case "key":
+			tc.KeyFile = relPath(entry.Value)
+		case "allow-insecure":
+			for _, opt := range strings.Split(entry.Value, ",") {
+				switch strings.TrimSpace(opt) {
+				case "skip-verify":
+					tc.SkipVerify = true
+				case "http":
+					tc.AllowHTTP = true
+				default:
+					return nil, errors.Errorf("%v: %v: expected skip-verify or http, got %#v", entry.Source, entry.Name, opt)
+				}
+			}
+		default:
+			return nil, errors.Errorf("%v: unknown key %v", entry.Source, key)
+		}
+	}
+	for _, tc := range rv {
+		if err := tc.Validate(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return rv, nil
+}
+
+// Returns TLS settings of image servers from configuration.
+func (h *Host) loadTLSConfigs() ([]*fetch.TLSConfig, error) {
+	path := configFilePath("fetch.tls")
+	if path == "" {
+		return nil, nil
+	}
+	tcs, err := readTLSConfigs(path)
+	return tcs, errors.Trace(err)
+}
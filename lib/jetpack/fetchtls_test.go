@@ -0,0 +1,54 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadTLSConfigs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeTestFiles(t, tmp, map[string]string{"tls.toml": `
+["*.internal.example.com"]
+ca = "internal-ca.pem"
+cert = "/etc/ssl/client.pem"
+key = "/etc/ssl/client.key"
+
+["dev.example.com:5000"]
+allow-insecure = "skip-verify, http"
+`})
+	tcs, err := readTLSConfigs(filepath.Join(tmp, "tls.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tcs) != 2 {
+		t.Fatalf("expected 2 entries, got %v", tcs)
+	}
+	if tc := tcs[0]; tc.CAFile != filepath.Join(tmp, "internal-ca.pem") || tc.CertFile != "/etc/ssl/client.pem" || tc.KeyFile != "/etc/ssl/client.key" || tc.SkipVerify || tc.AllowHTTP {
+		t.Errorf("unexpected entry %#v", tc)
+	}
+	if tc := tcs[1]; tc.Host != "dev.example.com:5000" || !tc.SkipVerify || !tc.AllowHTTP {
+		t.Errorf("unexpected entry %#v", tc)
+	}
+
+	if tcs, err := readTLSConfigs(filepath.Join(tmp, "missing.toml")); err != nil || tcs != nil {
+		t.Errorf("missing file: %v, %v", tcs, err)
+	}
+
+	for name, body := range map[string]string{
+		"pattern.toml": "[\"*.example.com\"]\nallow-insecure = \"skip-verify\"\n",
+		"option.toml":  "[\"example.com\"]\nallow-insecure = \"everything\"\n",
+		"key.toml":     "[\"example.com\"]\ncert = \"client.pem\"\n",
+	} {
+		writeTestFiles(t, tmp, map[string]string{name: body})
+		if _, err := readTLSConfigs(filepath.Join(tmp, name)); err == nil {
+			t.Errorf("%v: expected error", name)
+		}
+	}
+}
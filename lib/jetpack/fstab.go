@@ -0,0 +1,152 @@
+package jetpack
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Line of pod's fstab(5)
+type fstabEntry struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options string
+	Dump    int
+}
+
+func (e fstabEntry) String() string {
+	return fmt.Sprintf("%v %v %v %v %d 0", e.Source, e.Target, e.FSType, e.Options, e.Dump)
+}
+
+// Spaces and tabs in fstab fields are escaped as octal, as described
+// in fstab(5). Other characters that would break the line can't be
+// represented.
+var fstabEscaper = strings.NewReplacer(" ", `\040`, "\t", `\011`)
+var fstabUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t")
+
+func fstabEscape(field string) (string, error) {
+	if field == "" {
+		return "", errors.New("Empty fstab field")
+	}
+	if i := strings.IndexAny(field, "\n\r\x00\\"); i >= 0 {
+		return "", errors.Errorf("Character %q can't be used in fstab field %#v", field[i], field)
+	}
+	return fstabEscaper.Replace(field), nil
+}
+
+func formatFstab(entries []fstabEntry) (string, error) {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		fields := []string{e.Source, e.Target, e.FSType, e.Options}
+		for j, field := range fields {
+			if escaped, err := fstabEscape(field); err != nil {
+				return "", errors.Annotatef(err, "Mount on %v", e.Target)
+			} else {
+				fields[j] = escaped
+			}
+		}
+		lines[i] = fmt.Sprintf("%v %d 0\n", strings.Join(fields, " "), e.Dump)
+	}
+	return strings.Join(lines, ""), nil
+}
+
+func parseFstab(fstab string) ([]fstabEntry, error) {
+	var entries []fstabEntry
+	for _, line := range strings.Split(fstab, "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, errors.Errorf("Invalid fstab line %#v", line)
+		}
+		e := fstabEntry{
+			Source:  fstabUnescaper.Replace(fields[0]),
+			Target:  fstabUnescaper.Replace(fields[1]),
+			FSType:  fstabUnescaper.Replace(fields[2]),
+			Options: fstabUnescaper.Replace(fields[3]),
+		}
+		if len(fields) > 4 {
+			if dump, err := strconv.Atoi(fields[4]); err != nil {
+				return nil, errors.Annotatef(err, "Invalid fstab line %#v", line)
+			} else {
+				e.Dump = dump
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Returns true if path is dir or is below dir.
+func pathUnder(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// Orders fstab entries by target path depth (parents before children,
+// otherwise the parent would shadow the child), and then makes sure
+// that every mount comes after the ones mounted on its source (e.g.
+// host volume nullfs-mounted to the pod's volume directory needs to
+// be mounted before it's mounted in the app). Otherwise, manifest
+// order is kept.
+// Returns an error for duplicate entries, or for different entries
+// mounted on the same target.
+func sortFstab(fstab []fstabEntry) ([]fstabEntry, error) {
+	type entry struct {
+		fstabEntry
+		source, target string
+		done           bool
+	}
+
+	entries := make([]*entry, len(fstab))
+	targets := make(map[string]*entry)
+	for i, fe := range fstab {
+		e := &entry{fstabEntry: fe, source: filepath.Clean(fe.Source), target: filepath.Clean(fe.Target)}
+		if other, ok := targets[e.target]; ok {
+			if other.fstabEntry == fe {
+				return nil, errors.Errorf("Duplicate mount on %v", e.target)
+			}
+			return nil, errors.Errorf("Conflicting mounts on %v: %#v and %#v", e.target, other.fstabEntry.String(), fe.String())
+		}
+		targets[e.target] = e
+		entries[i] = e
+	}
+
+	depth := func(e *entry) int { return strings.Count(e.target, "/") }
+	sort.SliceStable(entries, func(i, j int) bool { return depth(entries[i]) < depth(entries[j]) })
+
+	dependsOn := func(e, other *entry) bool {
+		return e != other &&
+			((pathUnder(e.target, other.target) && e.target != other.target) ||
+				(filepath.IsAbs(e.source) && pathUnder(e.source, other.target)))
+	}
+
+	sorted := make([]fstabEntry, 0, len(fstab))
+	for len(sorted) < len(entries) {
+		progress := false
+	next:
+		for _, e := range entries {
+			if e.done {
+				continue
+			}
+			for _, other := range entries {
+				if !other.done && dependsOn(e, other) {
+					continue next
+				}
+			}
+			e.done = true
+			sorted = append(sorted, e.fstabEntry)
+			progress = true
+			break
+		}
+		if !progress {
+			return nil, errors.New("Circular dependency between mounts")
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,147 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testPod = "/var/jetpack/pods/1234"
+
+func TestSortFstabNested(t *testing.T) {
+	entries := []fstabEntry{
+		// host volume for /data/cache, declared first
+		{"/srv/cache", testPod + "/rootfs/vol/cache", "nullfs", "rw", 0},
+		// app mounts: child before parent
+		{testPod + "/rootfs/vol/cache", testPod + "/rootfs/0/data/cache", "nullfs", "rw", 1},
+		{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+	}
+	expected := []fstabEntry{entries[0], entries[2], entries[1]}
+
+	if sorted, err := sortFstab(entries); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("Got %#v, expected %#v", sorted, expected)
+	}
+}
+
+func TestSortFstabSourceDependency(t *testing.T) {
+	entries := []fstabEntry{
+		// App mount of a host volume listed before the host volume
+		{testPod + "/rootfs/vol/shared", testPod + "/rootfs/0/shared", "nullfs", "ro", 1},
+		{"/srv/shared", testPod + "/rootfs/vol/shared", "nullfs", "ro", 0},
+	}
+	expected := []fstabEntry{entries[1], entries[0]}
+
+	if sorted, err := sortFstab(entries); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("Got %#v, expected %#v", sorted, expected)
+	}
+}
+
+func TestSortFstabLinux(t *testing.T) {
+	entries := []fstabEntry{
+		{".", testPod + "/rootfs/0/dev", "devfs", "ruleset=4", 0},
+		{"linproc", testPod + "/rootfs/0/proc", "linprocfs", "rw", 0},
+		{"linsys", testPod + "/rootfs/0/sys", "linsysfs", "rw", 0},
+		{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/proc/data", "nullfs", "rw", 1},
+		{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+		{".", testPod + "/rootfs/1/dev", "devfs", "ruleset=4", 0},
+	}
+
+	// Volume below /proc goes after all the top-level mounts, other
+	// entries keep their order
+	expected := []fstabEntry{entries[0], entries[1], entries[2], entries[4], entries[5], entries[3]}
+	for _, input := range [][]fstabEntry{
+		entries,
+		{entries[3], entries[0], entries[1], entries[2], entries[4], entries[5]},
+	} {
+		if sorted, err := sortFstab(input); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(sorted, expected) {
+			t.Errorf("Got %#v, expected %#v", sorted, expected)
+		}
+	}
+}
+
+func TestSortFstabConflicts(t *testing.T) {
+	for _, entries := range [][]fstabEntry{
+		// Exact duplicate
+		{
+			{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+			{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+		},
+		// Two sources for one target
+		{
+			{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+			{testPod + "/rootfs/vol/other", testPod + "/rootfs/0/data/", "nullfs", "rw", 1},
+		},
+		// Same source, different options
+		{
+			{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "rw", 1},
+			{testPod + "/rootfs/vol/data", testPod + "/rootfs/0/data", "nullfs", "ro", 1},
+		},
+	} {
+		if sorted, err := sortFstab(entries); err == nil {
+			t.Errorf("Expected error for %#v, got %#v", entries, sorted)
+		}
+	}
+}
+
+func TestFormatFstabEscaping(t *testing.T) {
+	entries := []fstabEntry{
+		{"/srv/My Files", testPod + "/rootfs/vol/files", "nullfs", "ro", 0},
+		{testPod + "/rootfs/vol/files", testPod + "/rootfs/0/srv/tab\there", "nullfs", "ro", 1},
+		{"/srv/zażółć gęślą", testPod + "/rootfs/0/données", "nullfs", "rw", 1},
+	}
+	expected := "/srv/My\\040Files " + testPod + "/rootfs/vol/files nullfs ro 0 0\n" +
+		testPod + "/rootfs/vol/files " + testPod + "/rootfs/0/srv/tab\\011here nullfs ro 1 0\n" +
+		"/srv/zażółć\\040gęślą " + testPod + "/rootfs/0/données nullfs rw 1 0\n"
+
+	if fstab, err := formatFstab(entries); err != nil {
+		t.Fatal(err)
+	} else if fstab != expected {
+		t.Errorf("Got %#v, expected %#v", fstab, expected)
+	} else if parsed, err := parseFstab(fstab); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(parsed, entries) {
+		t.Errorf("Round trip: got %#v, expected %#v", parsed, entries)
+	}
+}
+
+func TestFormatFstabInvalid(t *testing.T) {
+	for _, path := range []string{"/srv/new\nline", "/srv/back\\slash", "/srv/nul\x00", ""} {
+		if fstab, err := formatFstab([]fstabEntry{{path, testPod + "/rootfs/0/data", "nullfs", "rw", 1}}); err == nil {
+			t.Errorf("Expected error for %#v, got %#v", path, fstab)
+		}
+	}
+}
+
+func TestFileCopiesRoundTrip(t *testing.T) {
+	copies := [][2]string{
+		{"/etc/my config.conf", testPod + "/rootfs/0/etc/app\tconfig.conf"},
+		{"/srv/żółw", testPod + "/rootfs/0/etc/żółw"},
+	}
+	if str, err := formatFileCopies(copies); err != nil {
+		t.Fatal(err)
+	} else if parsed, err := parseFileCopies(str); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(parsed, copies) {
+		t.Errorf("Got %#v, expected %#v", parsed, copies)
+	}
+}
+
+func TestSortFstabFdescfs(t *testing.T) {
+	entries := []fstabEntry{
+		{"fdesc", testPod + "/rootfs/0/dev/fd", "fdescfs", "rw", 0},
+		{"proc", testPod + "/rootfs/0/proc", "procfs", "rw", 0},
+		{".", testPod + "/rootfs/0/dev", "devfs", "ruleset=4", 0},
+	}
+	expected := []fstabEntry{entries[1], entries[2], entries[0]}
+
+	if sorted, err := sortFstab(entries); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("Got %#v, expected %#v", sorted, expected)
+	}
+}
@@ -0,0 +1,147 @@
+package jetpack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Operator hooks: hooks.pod-started and hooks.pod-stopped properties
+// name an executable, or a directory of executables run in lexical
+// order (as in rc.d), that jetpack runs after pod's jail is created
+// or removed. Hooks get the pod's details in JETPACK_* environment
+// variables, and are killed after hooks.timeout. Their failures are
+// logged and recorded in the pod's event log, with the hook's output,
+// but don't fail the pod operation.
+
+const (
+	hookPodStarted = "pod-started"
+	hookPodStopped = "pod-stopped"
+)
+
+// Hook output recorded in the event log is truncated to this size
+const hookOutputMax = 4096
+
+// Returns hook executables at path: path itself, or executable
+// files in a directory, skipping hidden ones.
+func hookScripts(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var rv []string
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+			continue
+		}
+		rv = append(rv, filepath.Join(path, fi.Name()))
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+// Returns environment for pod's hooks.
+func (pod *Pod) hookEnv(hook string) []string {
+	ip, _ := pod.IPAddress()
+	var images []string
+	for _, app := range pod.Manifest.Apps {
+		if app.Image.Name != nil {
+			images = append(images, app.Image.Name.String())
+		} else {
+			images = append(images, app.Image.ID.String())
+		}
+	}
+	env := append(os.Environ(),
+		"JETPACK_HOOK="+hook,
+		"JETPACK_POD_UUID="+pod.UUID.String(),
+		"JETPACK_POD_NAME="+pod.Hostname(),
+		"JETPACK_POD_IP="+ip,
+		"JETPACK_POD_IMAGES="+strings.Join(images, " "),
+	)
+	if len(images) > 0 {
+		env = append(env, "JETPACK_POD_IMAGE="+images[0])
+	}
+	return env
+}
+
+// Runs pod's hooks for the event, if there are any. Failures are only
+// logged.
+func (pod *Pod) runHooks(hook string) {
+	path := Config().GetString("hooks."+hook, "")
+	if path == "" {
+		return
+	}
+	log := pod.log().With("hook", hook)
+	scripts, err := hookScripts(path)
+	if err != nil {
+		log.Errorf("cannot find hooks: %v", err)
+		pod.logEvent(&Event{Type: EventHook, Hook: hook, Exec: []string{path}, Error: err.Error()})
+		return
+	}
+	timeout, err := time.ParseDuration(Config().GetString("hooks.timeout", "30s"))
+	if err != nil {
+		log.Errorf("invalid hooks.timeout: %v", err)
+		return
+	}
+	env := pod.hookEnv(hook)
+	for _, script := range scripts {
+		ev := runHook(script, env, timeout)
+		ev.Hook = hook
+		if ev.Error != "" {
+			log.Warnf("hook %v failed: %v", script, ev.Error)
+		} else {
+			log.Debugf("hook %v finished", script)
+		}
+		pod.logEvent(ev)
+	}
+}
+
+// Runs a single hook; returns event to record.
+func runHook(script string, env []string, timeout time.Duration) *Event {
+	ev := &Event{Type: EventHook, Exec: []string{script}}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = env
+	cmd.Dir = "/"
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if out.Len() > hookOutputMax {
+		out.Truncate(hookOutputMax)
+	}
+	ev.Details = out.String()
+	if ps := cmd.ProcessState; ps != nil {
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				ev.Signal = ws.Signal().String()
+			} else {
+				code := ws.ExitStatus()
+				ev.Code = &code
+			}
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		ev.Error = "timed out after " + timeout.String()
+	} else if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
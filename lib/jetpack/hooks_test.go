@@ -0,0 +1,74 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestRunHooks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	pod.Manifest.Annotations.Set("hostname", "web")
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := filepath.Join(tmp, "hooks")
+	os.Mkdir(hooks, 0755)
+	scripts := map[string]string{
+		"10-env":  "#!/bin/sh\necho $JETPACK_HOOK $JETPACK_POD_UUID $JETPACK_POD_NAME\n",
+		"20-fail": "#!/bin/sh\necho oops >&2\nexit 3\n",
+		"30-slow": "#!/bin/sh\nexec sleep 5\n",
+		".hidden": "#!/bin/sh\nexit 1\n",
+	}
+	for name, body := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(hooks, name), []byte(body), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(hooks, "README"), []byte("not a hook\n"), 0644)
+
+	Config().Set("hooks.pod-started", hooks)
+	Config().Set("hooks.timeout", "300ms")
+	defer Config().Set("hooks.pod-started", "")
+	defer Config().Set("hooks.timeout", "30s")
+
+	pod.runHooks(hookPodStarted)
+	pod.runHooks(hookPodStopped) // not configured
+
+	evs, err := pod.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran []string
+	for _, ev := range evs {
+		if ev.Type != EventHook || ev.Hook != hookPodStarted {
+			t.Errorf("Unexpected event %#v", ev)
+		}
+		ran = append(ran, filepath.Base(ev.Exec[0]))
+	}
+	if expected := []string{"10-env", "20-fail", "30-slow"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("Expected hooks %v, ran %v", expected, ran)
+	}
+	if ev := evs[0]; ev.Error != "" || *ev.Code != 0 ||
+		strings.TrimSpace(ev.Details) != "pod-started "+pod.UUID.String()+" web" {
+		t.Errorf("Unexpected event of successful hook %#v", ev)
+	}
+	if ev := evs[1]; ev.Error == "" || *ev.Code != 3 || ev.Details != "oops\n" {
+		t.Errorf("Unexpected event of failed hook %#v", ev)
+	}
+	if ev := evs[2]; !strings.Contains(ev.Error, "timed out") || ev.Signal == "" {
+		t.Errorf("Unexpected event of timed out hook %#v", ev)
+	}
+}
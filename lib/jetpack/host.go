@@ -1,17 +1,21 @@
 package jetpack
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/json"
 	stderrors "errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/appc/spec/discovery"
@@ -32,6 +36,23 @@ import (
 var ErrUsage = stderrors.New("Invalid usage")
 var ErrNotFound = stderrors.New("Not found")
 var ErrManyFound = stderrors.New("Multiple results found")
+var ErrNoCommand = stderrors.New("App has no command to run")
+var ErrNoLogs = stderrors.New("App has no logs")
+var ErrPodStopped = stderrors.New("Pod is not running")
+var ErrPodBusy = stderrors.New("Pod is busy")
+var ErrHostBusy = stderrors.New("Host is busy")
+var ErrHostFull = stderrors.New("Host is full")
+var ErrImageModified = stderrors.New("Image content doesn't match its hash")
+var ErrImageUnsealed = stderrors.New("Image has no content hash to verify, skipped")
+var ErrImageInUse = stderrors.New("Image is in use")
+var ErrPodBroken = stderrors.New("Pod is broken")
+var ErrTimeout = stderrors.New("Timed out")
+
+// Returns true if err is caused by ErrTimeout, or by a command that
+// has timed out (see timeout.* properties).
+func IsTimeout(err error) bool {
+	return errors.Cause(err) == ErrTimeout || run.IsTimeout(err)
+}
 
 type JailStatus struct {
 	Jid   int
@@ -40,17 +61,74 @@ type JailStatus struct {
 
 var NoJailStatus = JailStatus{}
 
+// jls(8) binary; tests replace it
+var jlsPath = "/usr/sbin/jls"
+
 type Host struct {
 	Dataset *zfs.Dataset
 
+	jailStatusMx        sync.Mutex
 	jailStatusTimestamp time.Time
 	jailStatusCache     map[string]JailStatus
+	jailStatusStale     map[string]bool
 	mdsUid, mdsGid      int
+	mds                 *MetadataServer // embedded in this process
 	ui                  *ui.UI
+	lock                hostLock
+	events              eventBroker
+	tagsMx              sync.Mutex // serializes changes of the tag index within the process
+
+	// Typed configuration of subsystems; replaced by ReloadConfig
+	// under settingsMx
+	Settings   *HostSettings
+	settingsMx sync.RWMutex
+
+	// Diagnostics go here; see Logger
+	Log Logger
+
+	// Operations on host's datasets; zfs.Native if nil
+	ZFS zfs.Interface
+
+	// Context of commands that host's operations run; see
+	// CancelCommands
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// Returns new host, logging to stderr.
 func NewHost() (*Host, error) {
-	h := Host{mdsUid: -1, mdsGid: -1}
+	return NewHostWithLogger(nil)
+}
+
+// Returns new host that sends its diagnostics to log (stderr, if nil).
+func NewHostWithLogger(log Logger) (*Host, error) {
+	return NewHostWithOptions(&HostOptions{Log: log})
+}
+
+// Options of NewHostWithOptions
+type HostOptions struct {
+	Log Logger // see NewHostWithLogger
+
+	// Don't verify that host's datasets are mounted where they're
+	// expected (see MountError), and don't sweep pods left behind by
+	// interrupted creations. For jetpack init, which checks and fixes
+	// the datasets itself.
+	SkipMountCheck bool
+}
+
+// Returns new host configured with opts.
+func NewHostWithOptions(opts *HostOptions) (*Host, error) {
+	if opts == nil {
+		opts = &HostOptions{}
+	}
+	if err := LoadConfig(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log := opts.Log
+	if log == nil {
+		log = NewStderrLogger()
+	}
+	h := Host{mdsUid: -1, mdsGid: -1, Log: log}
 
 	// FIXME: changing global switch based on struct instance
 	// variable. There should be only one instance created at a time
@@ -60,6 +138,29 @@ func NewHost() (*Host, error) {
 	// it.
 	ui.Debug = ui.Debug || Config().GetBool("debug", false)
 	h.ui = ui.NewUI("green", "jetpack", "")
+	run.Trace = log.With("op", "run").Debugf
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	setCommandContext(h.ctx)
+
+	props := Config()
+	if err := h.validateConfig(props); err != nil {
+		return nil, errors.Trace(err)
+	}
+	configMx.RLock()
+	shadowed := make([]string, 0, len(configShadowed))
+	for k := range configShadowed {
+		shadowed = append(shadowed, k)
+	}
+	sort.Strings(shadowed)
+	for _, k := range shadowed {
+		h.log().Warnf("%v set in %v is overridden by %v; jetpack.conf is deprecated, move it to %v", k, configShadowed[k], configPath, structuredConfigFile)
+	}
+	configMx.RUnlock()
+	if settings, err := loadHostSettings(props); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		h.setSettings(settings)
+	}
 
 	if ds, err := zfs.GetDataset(Config().MustGetString("root.zfs")); err == zfs.ErrNotFound {
 		return &h, nil
@@ -68,6 +169,14 @@ func NewHost() (*Host, error) {
 	} else {
 		h.Dataset = ds
 	}
+	if opts.SkipMountCheck {
+		return &h, nil
+	}
+	if err := h.checkMounts(); err != nil {
+		return nil, err
+	}
+
+	h.sweepCreatingPods()
 
 	return &h, nil
 }
@@ -75,6 +184,31 @@ func NewHost() (*Host, error) {
 // Host-global stuff
 //////////////////////////////////////////////////////////////////////////////
 
+// Returns context of commands that host's operations run.
+func (h *Host) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
+// Kills jail, zfs and system commands that host's operations run, and
+// makes the ones they start later fail right away. The operations fail
+// with errors that run.IsCanceled recognizes. For shutdown.
+func (h *Host) CancelCommands() {
+	if h.cancel != nil {
+		h.cancel()
+	}
+}
+
+// Returns h.ZFS, or zfs.Native.
+func (h *Host) datasets() zfs.Interface {
+	if h.ZFS != nil {
+		return h.ZFS
+	}
+	return zfs.Native
+}
+
 func (h *Host) Path(elem ...string) string {
 	return h.Dataset.Path(elem...)
 }
@@ -86,45 +220,13 @@ func (h *Host) zfsOptions(prefix string, opts ...string) []string {
 	return opts
 }
 
-func (h *Host) Initialize() error {
-	if h.Dataset != nil {
-		return errors.New("Host already initialized")
-	}
-
-	// We use GetString, as user can specify "root.zfs.mountpoint=" (set
-	// to empty string) in config to unset property
-	if mntpnt := Config().GetString("root.zfs.mountpoint", ""); mntpnt != "" {
-		if err := os.MkdirAll(mntpnt, 0755); err != nil {
-			return errors.Trace(err)
-		}
-	}
-
-	dsName := Config().MustGetString("root.zfs")
-	dsOptions := h.zfsOptions("root.zfs.", "-p")
-	h.ui.Printf("Creating ZFS dataset %v %v", dsName, dsOptions)
-	if ds, err := zfs.CreateDataset(dsName, dsOptions...); err != nil {
-		return errors.Trace(err)
-	} else {
-		h.Dataset = ds
-	}
-
-	dsOptions = h.zfsOptions("images.zfs.")
-	h.ui.Printf("Creating ZFS dataset %v/images %v", dsName, dsOptions)
-	if _, err := h.Dataset.CreateDataset("images", dsOptions...); err != nil {
-		return errors.Trace(err)
-	}
-
-	dsOptions = h.zfsOptions("pods.zfs.")
-	h.ui.Printf("Creating ZFS dataset %v/pods %v", dsName, dsOptions)
-	if _, err := h.Dataset.CreateDataset("pods", dsOptions...); err != nil {
-		return errors.Trace(err)
-	}
-
-	return nil
+func (h *Host) HostIP() (net.IP, *net.IPNet, error) {
+	return interfaceIP(h.settings().Network.Interface)
 }
 
-func (h *Host) HostIP() (net.IP, *net.IPNet, error) {
-	ifi, err := net.InterfaceByName(Config().MustGetString("jail.interface"))
+// Returns first address of a network interface
+func interfaceIP(name string) (net.IP, *net.IPNet, error) {
+	ifi, err := net.InterfaceByName(name)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -137,125 +239,178 @@ func (h *Host) HostIP() (net.IP, *net.IPNet, error) {
 	ip, ipnet, err := net.ParseCIDR(addrs[0].String())
 	return ip, ipnet, errors.Trace(err)
 }
+
+// Jail status is cached: passive reads (status displays, metrics,
+// stats) use results of jls(8) up to jailStatusTTL old, while state
+// transitions force a refresh. Our own operations on a jail invalidate
+// its entry, so that the next read of it runs jls(8) again.
+const jailStatusTTL = 2 * time.Second
+
 func (h *Host) getJailStatus(name string, refresh bool) (JailStatus, error) {
-	if refresh || h.jailStatusCache == nil || time.Now().Sub(h.jailStatusTimestamp) > (2*time.Second) {
-		// FIXME: nicer cache/expiry implementation?
-		if lines, err := run.Command("/usr/sbin/jls", "-d", "jid", "dying", "name").OutputLines(); err != nil {
-			return NoJailStatus, errors.Trace(err)
+	h.jailStatusMx.Lock()
+	defer h.jailStatusMx.Unlock()
+	if err := h.refreshJailStatus(refresh || h.jailStatusStale[name]); err != nil {
+		return NoJailStatus, errors.Trace(err)
+	}
+	return h.jailStatusCache[name], nil
+}
+
+// Returns status of all jetpack's jails (named with jail.namePrefix)
+// by jail name, from a single jls(8) run.
+func (h *Host) jailStatuses(refresh bool) (map[string]JailStatus, error) {
+	h.jailStatusMx.Lock()
+	defer h.jailStatusMx.Unlock()
+	if err := h.refreshJailStatus(refresh || len(h.jailStatusStale) > 0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	prefix := Config().MustGetString("jail.namePrefix")
+	rv := make(map[string]JailStatus)
+	for name, status := range h.jailStatusCache {
+		if strings.HasPrefix(name, prefix) {
+			rv[name] = status
+		}
+	}
+	return rv, nil
+}
+
+// Marks cached status of a jail as stale.
+func (h *Host) invalidateJailStatus(name string) {
+	h.jailStatusMx.Lock()
+	defer h.jailStatusMx.Unlock()
+	if h.jailStatusStale == nil {
+		h.jailStatusStale = make(map[string]bool)
+	}
+	h.jailStatusStale[name] = true
+}
+
+// Reloads jail status cache if it's expired or refresh is requested;
+// jailStatusMx must be held.
+func (h *Host) refreshJailStatus(refresh bool) error {
+	if !refresh && h.jailStatusCache != nil && time.Since(h.jailStatusTimestamp) < jailStatusTTL {
+		return nil
+	}
+	lines, err := systemCommand(jlsPath, "-d", "jid", "dying", "name").OutputLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	stat := make(map[string]JailStatus)
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 3)
+		status := NoJailStatus
+		if len(fields) != 3 {
+			return errors.Errorf("Cannot parse jls line %#v", line)
+		}
+
+		if jid, err := strconv.Atoi(fields[0]); err != nil {
+			return errors.Annotatef(err, "Cannot parse jls line %#v", line)
 		} else {
-			stat := make(map[string]JailStatus)
-			for _, line := range lines {
-				fields := strings.SplitN(line, " ", 3)
-				status := NoJailStatus
-				if len(fields) != 3 {
-					return NoJailStatus, errors.Errorf("Cannot parse jls line %#v", line)
-				}
-
-				if jid, err := strconv.Atoi(fields[0]); err != nil {
-					return NoJailStatus, errors.Annotatef(err, "Cannot parse jls line %#v", line)
-				} else {
-					status.Jid = jid
-				}
-
-				if dying, err := strconv.Atoi(fields[1]); err != nil {
-					return NoJailStatus, errors.Annotatef(err, "Cannot parse jls line %#v", line)
-				} else {
-					status.Dying = (dying != 0)
-				}
-
-				stat[fields[2]] = status
-			}
-			h.jailStatusCache = stat
+			status.Jid = jid
+		}
+
+		if dying, err := strconv.Atoi(fields[1]); err != nil {
+			return errors.Annotatef(err, "Cannot parse jls line %#v", line)
+		} else {
+			status.Dying = (dying != 0)
 		}
+
+		stat[fields[2]] = status
 	}
-	return h.jailStatusCache[name], nil
+	h.jailStatusCache = stat
+	h.jailStatusTimestamp = time.Now()
+	h.jailStatusStale = nil
+	return nil
+}
+
+// Returns first free IP address for a pod on given interface. The
+// address is drawn from the `ips.pool.INTERFACE` network if it's
+// set, or from the interface's network otherwise.
+func (h *Host) nextIP(ifname string) (net.IP, error) {
+	return h.claimIP(ifname, nil)
 }
 
-func (h *Host) nextIP() (net.IP, error) {
-	ip, ipnet, err := h.HostIP()
+// Returns want if it's a free address in the interface's pool, or
+// the first free address otherwise; see nextIP.
+func (h *Host) claimIP(ifname string, want net.IP) (net.IP, error) {
+	ifip, ipnet, err := interfaceIP(ifname)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ips := make(map[string]bool)
+	ip := ifip
+	if pool, ok := h.settings().Network.Pools[ifname]; ok {
+		if _, ipnet, err = net.ParseCIDR(pool); err != nil {
+			return nil, errors.Annotatef(err, "ips.pool.%v", ifname)
+		}
+		ip = ipnet.IP
+	}
+
+	ips := map[string]bool{ifip.String(): true}
 	for _, c := range h.Pods() {
 		if ip, ok := c.Manifest.Annotations.Get("ip-address"); ok {
 			ips[ip] = true
 		}
 	}
 
+	if want != nil && ipnet.Contains(want) && !want.Equal(ipnet.IP) && !ips[want.String()] {
+		return want, nil
+	}
+
 	for ip = nextIP(ip); ip != nil && ips[ip.String()]; ip = nextIP(ip) {
 	}
 
 	if ip == nil {
-		return nil, errors.New("Out of IPs")
+		return nil, errors.Errorf("Out of IPs on %v", ifname)
 	}
 
 	if ipnet.Contains(ip) {
 		return ip, nil
 	} else {
-		return nil, errors.New("Out of IPs")
+		return nil, errors.Errorf("Out of IPs on %v", ifname)
 	}
 }
 
 // Pods
 //////////////////////////////////////////////////////////////////////////////
 
+// Resolves images of pm's apps, names them, and binds their mount
+// points to volumes, as PodManifestFromApps does.
 func (h *Host) ReifyPodManifest(pm *schema.PodManifest) (*schema.PodManifest, error) {
+	specs := make([]AppSpec, len(pm.Apps))
 	for i, rtapp := range pm.Apps {
-		img, err := h.getRuntimeImage(rtapp.Image)
-		if err != nil {
-			return nil, err
-		}
-
-		pm.Apps[i].Image.ID = *img.Hash
-
-		app := rtapp.App
-		if app == nil {
-			app = img.Manifest.App
-		}
-		if app == nil {
-			continue
-		}
-
-	mntpnts:
-		for _, mntpnt := range app.MountPoints {
-			var mnt *schema.Mount
-			for _, mntc := range rtapp.Mounts {
-				if mntc.Path == mntpnt.Path || mntc.Path == mntpnt.Name.String() {
-					if mnt != nil {
-						fmt.Printf("WARNING: multiple mounts for %v:%v, using first one")
-					} else {
-						mnt = &mntc
-					}
-				}
-			}
-			if mnt == nil {
-				fmt.Printf("INFO: mount for %v:%v not found, inserting mount for volume %v\n", rtapp.Name, mntpnt.Name, mntpnt.Name)
-				mnt = &schema.Mount{Path: mntpnt.Name.String(), Volume: mntpnt.Name}
-				pm.Apps[i].Mounts = append(pm.Apps[i].Mounts, *mnt)
-			}
-			for _, vol := range pm.Volumes {
-				if vol.Name == mnt.Volume {
-					continue mntpnts
-				}
-			}
-			fmt.Printf("INFO: volume %v not found, inserting empty volume\n", mnt.Volume)
-			_mode := "0755"
-			_ugid := 0
-			pm.Volumes = append(pm.Volumes, types.Volume{Name: mnt.Volume, Kind: "empty", Mode: &_mode, UID: &_ugid, GID: &_ugid})
+		specs[i] = AppSpec{
+			Image:          rtapp.Image,
+			Name:           rtapp.Name,
+			App:            rtapp.App,
+			Mounts:         rtapp.Mounts,
+			Annotations:    rtapp.Annotations,
+			ReadOnlyRootFS: rtapp.ReadOnlyRootFS,
 		}
 	}
-
+	if err := h.reifyApps(pm, specs); err != nil {
+		return nil, errors.Trace(err)
+	}
 	return pm, nil
 }
 
+// Options of Host.CreatePod
+type CreateOptions struct {
+	IgnoreLimits bool // create the pod even if host limits are exceeded
+}
+
 // Create new pod from a fully reified manifest.
-func (h *Host) CreatePod(pm *schema.PodManifest) (*Pod, error) {
-	return CreatePod(h, pm)
+func (h *Host) CreatePod(pm *schema.PodManifest, opts *CreateOptions) (*Pod, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	return createPod(h, pm, &podCreateOptions{ignoreLimits: opts.IgnoreLimits})
 }
 
 func (h *Host) GetPod(id uuid.UUID) (*Pod, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
 	if c, err := LoadPod(h, id); err != nil {
 		return nil, errors.Trace(err)
 	} else {
@@ -263,14 +418,39 @@ func (h *Host) GetPod(id uuid.UUID) (*Pod, error) {
 	}
 }
 
+// Runs app of a pod on the caller's stdio, with run options.
+func (h *Host) RunApp(id uuid.UUID, name types.ACName, opts *RunOptions) (*ExitStatus, error) {
+	pod, err := h.GetPod(id)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	app := pod.App(name)
+	if app == nil {
+		return nil, ErrNotFound
+	}
+	if _, err := app.command(opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+	es, err := app.Run(os.Stdin, os.Stdout, os.Stderr, opts)
+	return es, errors.Trace(err)
+}
+
 func (h *Host) Pods() []*Pod {
+	if unlock, err := h.lockShared(); err != nil {
+		h.log().Warnf("listing pods without host lock: %v", err)
+	} else {
+		defer unlock()
+	}
 	mm, _ := filepath.Glob(h.Path("pods/*/manifest"))
 	rv := make([]*Pod, 0, len(mm))
 	for _, m := range mm {
 		if id := uuid.Parse(filepath.Base(filepath.Dir(m))); id == nil {
 			panic(fmt.Sprintf("Invalid UUID: %#v", filepath.Base(filepath.Dir(m))))
-		} else if c, err := h.GetPod(id); err != nil {
-			h.ui.Printf("WARNING: pods/%v: %v\n", id, err)
+		} else if c, err := h.GetPod(id); errors.Cause(err) == ErrNotFound {
+			// Being created, or destroyed meanwhile
+			continue
+		} else if err != nil {
+			h.log().Warnf("pods/%v: %v", id, err)
 		} else {
 			rv = append(rv, c)
 		}
@@ -290,19 +470,19 @@ func (h *Host) getRuntimeImage(rtimg schema.RuntimeImage) (*Image, error) {
 	return h.GetImage(rtimg.ID, name, rtimg.Labels)
 }
 
-func (h *Host) getImageDependency(dep types.Dependency) (*Image, error) {
-	var hash types.Hash
-	if dep.ImageID != nil {
-		hash = *dep.ImageID
-	}
-	return h.GetImage(hash, dep.ImageName, dep.Labels)
-	// TODO: validate dep.Size
-}
-
 func (h *Host) GetImage(hash types.Hash, name types.ACIdentifier, labels types.Labels) (*Image, error) {
+	if img, err := h.GetLocalImage(hash, name, labels); errors.Cause(err) != ErrNotFound || name.Empty() {
+		return img, errors.Trace(err)
+	}
+	// Fetch it, unless another process has done it meanwhile
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
 	if img, err := h.getImage(hash, name, labels); err != nil {
 		return nil, errors.Trace(err)
-	} else if err := doubleCheckImage(img, hash, name, labels); err != nil {
+	} else if err := h.doubleCheckImage(img, hash, name, labels); err != nil {
 		return nil, errors.Trace(err)
 	} else {
 		return img, nil
@@ -310,48 +490,77 @@ func (h *Host) GetImage(hash types.Hash, name types.ACIdentifier, labels types.L
 }
 
 func (h *Host) GetLocalImage(hash types.Hash, name types.ACIdentifier, labels types.Labels) (*Image, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
 	if img, err := h.getLocalImage(hash, name, labels); err != nil {
 		return nil, errors.Trace(err)
-	} else if err := doubleCheckImage(img, hash, name, labels); err != nil {
+	} else if err := h.doubleCheckImage(img, hash, name, labels); err != nil {
 		return nil, errors.Trace(err)
 	} else {
 		return img, nil
 	}
 }
 
-func (h *Host) FetchImage(hash types.Hash, name types.ACIdentifier, labels types.Labels) (*Image, error) {
-	if img, err := h.fetchImage(name, labels); err != nil {
+// Discovers and imports an image with opts (defaults if nil).
+func (h *Host) FetchImage(hash types.Hash, name types.ACIdentifier, labels types.Labels, opts *ImageOptions) (*Image, error) {
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	fg := h.newFetchGroup(opts)
+	defer fg.cancel()
+	if img, err := h.fetchImage(fg, name, labels); err != nil {
 		return nil, errors.Trace(err)
-	} else if err := doubleCheckImage(img, hash, name, labels); err != nil {
+	} else if err := h.doubleCheckImage(img, hash, name, labels); err != nil {
 		return nil, errors.Trace(err)
 	} else {
 		return img, nil
 	}
 }
 
-func doubleCheckImage(img *Image, hash types.Hash, name types.ACIdentifier, labels types.Labels) error {
-	if !hash.Empty() && hash != *img.Hash {
+// Checks that image has hash, and is named (by its manifest, or by a
+// tag) with name and labels.
+func (h *Host) doubleCheckImage(img *Image, hash types.Hash, name types.ACIdentifier, labels types.Labels) error {
+	if !hash.Empty() && !strings.HasPrefix(img.Hash.String(), hash.String()) {
 		return stderrors.New("Image hash mismatch")
 	}
-	if !name.Empty() && name != img.Manifest.Name {
-		return stderrors.New("Image name mismatch")
+	if name.Empty() || name == img.Manifest.Name {
+		if acutil.MatchLabels(labels, img.Manifest.Labels) {
+			return nil
+		} else if name.Empty() {
+			return stderrors.New("Image label mismatch")
+		}
 	}
-	if !acutil.MatchLabels(labels, img.Manifest.Labels) {
-		return stderrors.New("Image label mismatch")
+	if img.Hash != nil {
+		tags, err := h.imageTags()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, tag := range tags {
+			if tag.Image == *img.Hash && tagMatches(tag, img, name, labels) {
+				return nil
+			}
+		}
 	}
-	return nil
+	return stderrors.New("Image name mismatch")
 }
 
 func (h *Host) getImage(hash types.Hash, name types.ACIdentifier, labels types.Labels) (*Image, error) {
 	if img, err := h.getLocalImage(hash, name, labels); err == nil {
 		return img, nil
 	} else if err == ErrNotFound {
-		// TODO: possibility to switch off autodiscovery?
 		if name.Empty() {
 			// Can't (auto)discover anonymous image
 			return nil, err
 		}
-		return h.fetchImage(name, labels)
+		if !Config().GetBool("allow.autodiscovery", true) {
+			return nil, errors.Annotatef(err, "Image %v (allow.autodiscovery is off)", name)
+		}
+		return h.fetchImage(nil, name, labels)
 	} else {
 		return nil, errors.Trace(err)
 	}
@@ -363,6 +572,13 @@ func (h *Host) getLocalImage(hash types.Hash, name types.ACIdentifier, labels ty
 	}
 
 	if !hash.Empty() {
+		if full, err := h.resolveImageHash(hash); err == ErrNotFound {
+			return nil, err
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			hash = full
+		}
 		if idStr, err := os.Readlink(h.Path("images", hash.String())); os.IsNotExist(err) {
 			return nil, ErrNotFound
 		} else if err != nil {
@@ -374,35 +590,114 @@ func (h *Host) getLocalImage(hash types.Hash, name types.ACIdentifier, labels ty
 		} else {
 			return img, nil
 		}
-	} else if imgs, err := h.Images(); err != nil {
+	} else if tagged, err := h.taggedImages(name); err != nil {
 		return nil, errors.Trace(err)
+	} else if img, err := selectImage(tagged, name, labels); err == ErrNotFound {
+		return nil, err
 	} else {
-		for _, img := range imgs {
-			if img.Manifest.Name != name {
-				continue
-			}
-			if !acutil.MatchLabels(labels, img.Manifest.Labels) {
+		return img, errors.Trace(err)
+	}
+}
+
+// Returns images with tags that have name.
+func (h *Host) taggedImages(name types.ACIdentifier) ([]taggedImage, error) {
+	tags, err := h.imageTags()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var rv []taggedImage
+	imgs := make(map[types.Hash]*Image)
+	for _, tag := range tags {
+		if tag.Name != name {
+			continue
+		}
+		img, ok := imgs[tag.Image]
+		if !ok {
+			if img, err = h.getLocalImage(tag.Image, "", nil); err == ErrNotFound {
+				h.log().Warnf("Tag %v: image %v not found", tag, tag.Image)
 				continue
+			} else if err != nil {
+				return nil, errors.Trace(err)
 			}
-			// TODO: multiple matches?
-			return img, nil
+			imgs[tag.Image] = img
 		}
+		rv = append(rv, taggedImage{tag, img})
+	}
+	return rv, nil
+}
 
-		return nil, ErrNotFound
+// Returns options of fetching images, from configuration.
+func (h *Host) FetchOptions() (*fetch.Options, error) {
+	creds, err := h.loadCredentials()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tlsConfigs, err := h.loadTLSConfigs()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opts := &fetch.Options{
+		AllowHTTP:   Config().GetBool("allow.http", false),
+		Timeout:     Config().GetDuration("fetch.timeout", fetch.DefaultTimeout),
+		Retries:     Config().GetInt("fetch.retries", 2),
+		Credentials: creds,
+		TLS:         tlsConfigs,
+		Warnf:       h.log().Warnf,
+	}
+	if h.Dataset != nil {
+		opts.Spool = h.Path("spool")
+		if size, err := parseLogSize(Config().GetString("fetch.cache.size", "")); err != nil {
+			return nil, errors.Annotate(err, "fetch.cache.size")
+		} else if size > 0 {
+			opts.Cache = &fetch.Cache{Dir: h.Path("cache"), MaxSize: size}
+		}
 	}
+	opts.Mirrors = strings.Fields(Config().GetString("fetch.mirrors", ""))
+	return opts, nil
 }
 
-func (h *Host) fetchImage(name types.ACIdentifier, labels types.Labels) (*Image, error) {
-	if aci, asc, err := fetch.DiscoverACI(discovery.App{Name: name, Labels: labels.ToMap()}); err != nil {
+// Discovers and imports an image, as a part of fg (a new fetch if
+// nil).
+func (h *Host) fetchImage(fg *fetchGroup, name types.ACIdentifier, labels types.Labels) (_ *Image, erv error) {
+	defer func() { h.countOperation("image-fetch", erv) }()
+	started := time.Now()
+	if fg == nil {
+		fg = h.newFetchGroup(nil)
+		defer fg.cancel()
+	}
+	opts, err := h.FetchOptions()
+	if err != nil {
 		return nil, errors.Trace(err)
-	} else if aci == nil {
-		return nil, ErrNotFound
-	} else {
-		return h.ImportImage(name, aci, asc)
 	}
+	opts.Context, opts.Progress = fg.ctx, fg.progress
+	release, err := fg.acquire()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	app := discovery.App{Name: name, Labels: labels.ToMap()}
+	aci, asc, origin, err := opts.FetchACI(app)
+	release()
+	if err != nil {
+		return nil, errors.Trace(fg.downloadError(err))
+	}
+	defer aci.Close()
+	if asc != nil {
+		defer asc.Close()
+	}
+	img, err := h.importImage(fg, name, aci, asc, started, string(origin), newProvenance(ProvenanceDiscovery, imageString(name, labels)))
+	if errors.Cause(err) == fetch.ErrVerificationFailed {
+		// Don't serve it from the cache again
+		opts.Cache.Remove(app)
+	}
+	return img, err
 }
 
 func (h *Host) Images() ([]*Image, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
 	mm, _ := filepath.Glob(h.Path("images/*/manifest"))
 	rv := make([]*Image, 0, len(mm))
 	for _, m := range mm {
@@ -424,7 +719,7 @@ func (h *Host) Images() ([]*Image, error) {
 			if img != nil {
 				id = img.UUID.String()
 			}
-			h.ui.Printf("WARNING: images/%v: %v", id, err)
+			h.log().Warnf("images/%v: %v", id, err)
 		} else {
 			rv = append(rv, img)
 		}
@@ -432,7 +727,159 @@ func (h *Host) Images() ([]*Image, error) {
 	return rv, nil
 }
 
-func (h *Host) ImportImage(name types.ACIdentifier, aci, asc *os.File) (_ *Image, erv error) {
+// Per-call options of fetching, importing, and receiving images
+type ImageOptions struct {
+	// Import images without signature; needs allow.no-signature on
+	AllowUnsigned bool
+
+	// If set, keys of unknown signers are discovered when importing
+	// images, and trusted if it returns true
+	ConfirmKey func(*TrustedKey) bool
+
+	// Receives progress of fetching and importing images; nil is
+	// silent
+	Progress fetch.ProgressFunc
+}
+
+// Returns error unless images without signature may be imported:
+// opts.AllowUnsigned needs to be set, and allow.no-signature needs to
+// be on.
+func (h *Host) checkUnsigned(name types.ACIdentifier, opts *ImageOptions) error {
+	var reason string
+	switch {
+	case opts == nil || !opts.AllowUnsigned:
+		reason = "no signature"
+	case !Config().GetBool("allow.no-signature", false):
+		reason = "no signature, and allow.no-signature is off"
+	default:
+		return nil
+	}
+	location := name.String()
+	if name.Empty() {
+		location = "image"
+	}
+	return &fetch.Error{Stage: fetch.ErrVerificationFailed, Location: location, Err: errors.New(reason)}
+}
+
+// Options of importing an image
+type ImportOptions struct {
+	ImageOptions
+	Name      types.ACIdentifier // expected name of the image; needed to verify a signature
+	Signature io.Reader          // detached signature of the ACI, or nil
+	Source    string             // URL or path of the ACI, recorded in image's provenance
+}
+
+// Imports an image from an ACI stream, compressed or not. If
+// opts.Signature is given, the signature is verified against the
+// keystore (discovering an unknown key if opts.ConfirmKey is set), and
+// the verification result is recorded in image's metadata; see
+// checkUnsigned for importing images without signature. A stream that
+// is not a regular file is spooled first. If an image with the same
+// hash has been imported already, it is returned. Summary of the
+// import is in image's Import.
+func (h *Host) ImportImage(r io.Reader, opts *ImportOptions) (*Image, error) {
+	started := time.Now()
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	aci, closeACI, err := h.seekableFile(r, "import.")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeACI()
+	var asc *os.File
+	if opts.Signature != nil {
+		f, closeASC, err := h.seekableFile(opts.Signature, "import-sig.")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer closeASC()
+		asc = f
+	}
+	fg := h.newFetchGroup(&opts.ImageOptions)
+	defer fg.cancel()
+	return h.importImage(fg, opts.Name, aci, asc, started, "", newProvenance(ProvenanceACI, opts.Source))
+}
+
+// Imports an image from ACI file at path, or from stdin if path is
+// "-".
+func (h *Host) ImportImageFile(path string, opts *ImportOptions) (*Image, error) {
+	if path == "-" {
+		return h.ImportImage(os.Stdin, opts)
+	}
+	if opts == nil || opts.Source == "" {
+		fileOpts := ImportOptions{}
+		if opts != nil {
+			fileOpts = *opts
+		}
+		if abs, err := filepath.Abs(path); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			fileOpts.Source = abs
+		}
+		opts = &fileOpts
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	return h.ImportImage(f, opts)
+}
+
+// Returns r if it is a regular file, or an unlinked spool file with
+// r's contents. Returned function closes the spool file.
+func (h *Host) seekableFile(r io.Reader, prefix string) (*os.File, func(), error) {
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			return f, func() {}, nil
+		}
+	}
+	spool, err := h.spoolDir()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	f, err := ioutil.TempFile(spool, prefix)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// Returns spool directory for temporary files, creating it; "" (the
+// system default) if host is not initialized.
+func (h *Host) spoolDir() (string, error) {
+	if h.Dataset == nil {
+		return "", nil
+	}
+	spool := h.Path("spool")
+	return spool, errors.Trace(os.MkdirAll(spool, 0700))
+}
+
+// Imports an image as a part of fg (a new fetch if nil); started is
+// when its fetch started, origin is where the ACI was fetched from ("" if
+// it wasn't), and prov is recorded as its provenance.
+// Nothing is changed until the ACI is verified, and a failed import is
+// removed.
+func (h *Host) importImage(fg *fetchGroup, name types.ACIdentifier, aci, asc *os.File, started time.Time, origin string, prov *ImageProvenance) (_ *Image, erv error) {
+	if fg == nil {
+		fg = h.newFetchGroup(nil)
+		defer fg.cancel()
+	}
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
 	newId := uuid.NewRandom()
 	newIdStr := newId.String()
 	ui := ui.NewUI("magenta", "import", newIdStr)
@@ -441,38 +888,69 @@ func (h *Host) ImportImage(name types.ACIdentifier, aci, asc *os.File) (_ *Image
 	} else {
 		ui.Printf("Starting import of %v", name)
 	}
+	var sig *ImageSignature
 	if asc != nil {
 		ui.Debug("Checking signature")
+		fg.progress.Phase(fetch.PhaseVerifying, name.String())
 		didKeyDiscovery := false
 		ks := h.Keystore()
 	checkSig:
-		if ety, err := ks.CheckSignature(name, aci, asc); err == openpgp_err.ErrUnknownIssuer && !didKeyDiscovery {
+		if ety, err := ks.CheckSignature(name, aci, asc); err == openpgp_err.ErrUnknownIssuer && !didKeyDiscovery && fg.opts.ConfirmKey != nil && !name.Empty() {
 			ui.Println("Image signed by an unknown issuer, attempting to discover public key...")
-			if err := h.TrustKey(name, "", ""); err != nil {
-				return nil, errors.Trace(err)
+			if _, err := h.FetchTrustedKey(name.String(), "", &TrustOptions{Confirm: fg.opts.ConfirmKey}); err != nil {
+				return nil, &fetch.Error{Stage: fetch.ErrVerificationFailed, Location: name.String(), Err: err}
 			}
 			didKeyDiscovery = true
 			aci.Seek(0, os.SEEK_SET)
 			asc.Seek(0, os.SEEK_SET)
 			goto checkSig
+		} else if err == openpgp_err.ErrUnknownIssuer {
+			return nil, &fetch.Error{Stage: fetch.ErrVerificationFailed, Location: name.String(), Err: errors.New("signed by an untrusted key")}
 		} else if err != nil {
-			return nil, errors.Trace(err)
+			return nil, &fetch.Error{Stage: fetch.ErrVerificationFailed, Location: name.String(), Err: err}
 		} else {
 			ui.Println("Valid signature for", name, "by:")
 			ui.Println(keystore.KeyDescription(ety)) // FIXME:ui
+			sig = &ImageSignature{
+				Fingerprint: keystore.KeyFingerprint(ety),
+				Signer:      keystore.KeyIdentity(ety),
+				Verified:    time.Now(),
+			}
 
 			aci.Seek(0, os.SEEK_SET)
 			asc.Seek(0, os.SEEK_SET)
 		}
+	} else if err := h.checkUnsigned(name, fg.opts); err != nil {
+		return nil, errors.Trace(err)
 	} else {
-		ui.Debug("No signature to check")
+		ui.Println("WARNING: importing image without signature")
+	}
+
+	// Load manifest
+	ui.Debug("Loading manifest")
+	manifestBytes, err := readACIManifest(aci)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aci.Seek(0, os.SEEK_SET)
+
+	var manifest schema.ImageManifest
+	if err = json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if !name.Empty() && name != manifest.Name {
+		return nil, errors.Errorf("ACI name mismatch: downloaded %#v, got %#v instead", name, manifest.Name)
 	}
 
 	img := NewImage(h, newId)
+	img.Signature = sig
+	img.Manifest = manifest
+	img.Provenance = prov
 
 	defer func() {
 		if erv != nil {
-			img.Destroy()
+			img.abortImport()
 		}
 	}()
 
@@ -494,49 +972,22 @@ func (h *Host) ImportImage(name types.ACIdentifier, aci, asc *os.File) (_ *Image
 		}
 	}
 
-	// Load manifest
-	ui.Debug("Loading manifest")
-	manifestBytes, err := run.Command("tar", "-xOqf", "-", "manifest").ReadFrom(aci).Output()
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	aci.Seek(0, os.SEEK_SET)
-
-	if err = json.Unmarshal(manifestBytes, &img.Manifest); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	if !name.Empty() && name != img.Manifest.Name {
-		return nil, errors.Errorf("ACI name mismatch: downloaded %#v, got %#v instead", name, img.Manifest.Name)
+	if err := img.checkPlatform(); err != nil {
+		ui.Printf("WARNING: %v", err)
 	}
 
 	if len(img.Manifest.Dependencies) == 0 {
 		ui.Debug("No dependencies to fetch")
-		if _, err := h.Dataset.CreateDataset(path.Join("images", newIdStr), "-o", "mountpoint="+h.Dataset.Path("images", newIdStr, "rootfs")); err != nil {
+		props := h.imageZFSProperties(h.Dataset.Path("images", newIdStr, "rootfs"))
+		if ds, err := createWithProperties(h.datasets(), h.Dataset.ChildName(path.Join("images", newIdStr)), props, "images.zfs.* settings"); err != nil {
 			return nil, errors.Trace(err)
+		} else {
+			img.rootfs = ds
 		}
-	} else {
-		for i, dep := range img.Manifest.Dependencies {
-			ui.Println("Looking for dependency:", dep.ImageName, dep.Labels, dep.ImageID)
-			if dimg, err := h.getImageDependency(dep); err != nil {
-				return nil, errors.Trace(err)
-			} else {
-				// We get a copy of the dependency struct when iterating, not
-				// a pointer to it. We need to write to the slice's index to
-				// save the hash to the real manifest.
-				img.Manifest.Dependencies[i].ImageID = dimg.Hash
-				if i == 0 {
-					ui.Printf("Cloning parent %v as base rootfs\n", dimg)
-					if ds, err := dimg.Clone(path.Join(h.Dataset.Name, "images", newIdStr), h.Dataset.Path("images", newIdStr, "rootfs")); err != nil {
-						return nil, errors.Trace(err)
-					} else {
-						img.rootfs = ds
-					}
-				} else {
-					return nil, errors.New("Not implemented")
-				}
-			}
-		}
+	} else if dimgs, err := h.resolveDependencies(&img.Manifest, fg); err != nil {
+		return nil, errors.Trace(err)
+	} else if err := img.renderDependencies(dimgs); err != nil {
+		return nil, errors.Trace(err)
 	}
 
 	if err := img.saveManifest(); err != nil {
@@ -544,6 +995,10 @@ func (h *Host) ImportImage(name types.ACIdentifier, aci, asc *os.File) (_ *Image
 	}
 
 	ui.Println("Unpacking rootfs")
+	aciSize := int64(-1)
+	if fi, err := aci.Stat(); err == nil {
+		aciSize = fi.Size()
+	}
 
 	// Save us a copy of the original, compressed ACI
 	aciCopy, err := os.OpenFile(img.Path("aci"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0400)
@@ -551,89 +1006,54 @@ func (h *Host) ImportImage(name types.ACIdentifier, aci, asc *os.File) (_ *Image
 		return nil, errors.Trace(err)
 	}
 	defer aciCopy.Close()
-	aciZRd := io.TeeReader(fetch.ProgressBarFileReader(aci), aciCopy)
-
-	// Decompress tarball for checksum
-	aciRd, err := DecompressingReader(aciZRd)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	hash := sha512.New()
-	aciRd = io.TeeReader(aciRd, hash)
+	aciZRd := io.TeeReader(fg.progress.Reader(aci, fetch.Progress{Phase: fetch.PhaseExtracting, Location: name.String(), Total: aciSize}), aciCopy)
 
-	// Unpack the image. We trust system's tar, no need to roll our own
-	untarCmd := run.Command("tar", "-C", img.Path(), "-xf", "-", "rootfs")
-	untar, err := untarCmd.StdinPipe()
+	aciRd, _, err := DecompressingReader(aciZRd)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	if err := untarCmd.Start(); err != nil {
-		return nil, errors.Trace(err)
+	defer aciRd.Close()
+
+	// Image ID is hashed in the same pass, from the whole tarball,
+	// including what the tar reader leaves unread at its end
+	hasher := sha512.New()
+	tarRd := io.TeeReader(aciRd, hasher)
+	if err := extractRootfs(tarRd, img.Path("rootfs")); err != nil {
+		return nil, errors.Annotate(err, "Unpacking rootfs")
 	}
-	// FIXME: defer killing process if survived
-
-	if _, err := io.Copy(untar, aciRd); err != nil {
+	if _, err := io.Copy(ioutil.Discard, tarRd); err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	if err := untar.Close(); err != nil {
+	hash, err := types.NewHash(fmt.Sprintf("sha512-%x", hasher.Sum(nil)))
+	if err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	if err := untarCmd.Wait(); err != nil {
+	if dup, err := h.getLocalImage(*hash, "", nil); err == nil {
+		ui.Println("Image", hash, "is already imported")
+		img.abortImport()
+		return dup, nil
+	} else if err != ErrNotFound {
 		return nil, errors.Trace(err)
 	}
 
-	if hash, err := types.NewHash(fmt.Sprintf("sha512-%x", hash.Sum(nil))); err != nil {
-		// CAN'T HAPPEN
-		return nil, errors.Trace(err)
-	} else {
-		ui.Println("Successfully imported", hash)
-		img.Hash = hash
+	// Whitelist applies to the rendered rootfs, with dependencies
+	if len(img.Manifest.PathWhitelist) > 0 {
+		ui.Debug("Applying path whitelist")
+		if err := applyPathWhitelist(img.Path("rootfs"), img.Manifest.PathWhitelist); err != nil {
+			return nil, errors.Annotate(err, "Applying path whitelist")
+		}
 	}
 
-	// TODO: enforce PathWhiteList
+	ui.Println("Successfully imported", hash)
+	img.Hash = hash
 
+	fg.progress.Phase(fetch.PhaseRegistering, name.String())
+	img.Import = &ImportSummary{Size: aciSize, Duration: time.Since(started), Origin: origin}
 	if err := img.sealImage(); err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	h.log().With("image", img.Hash.String()).Infof("imported %v: %v", img, img.Import)
+	h.logEvent(&Event{Type: EventImport, Image: img.Hash.String(), Details: img.String()})
 	return img, nil
 }
-
-// Keystore and trust
-//////////////////////////////////////////////////////////////////////////////
-
-func (h *Host) Keystore() *keystore.Keystore {
-	return keystore.New(h.Path("keys"))
-}
-
-func (h *Host) TrustKey(prefix types.ACIdentifier, location, fingerprint string) error {
-	if location == "" {
-		if prefix == keystore.Root {
-			return errors.New("Cannot discover root key!")
-		}
-		location = prefix.String()
-	}
-
-	_, kf, err := fetch.OpenPubKey(location)
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	defer kf.Close()
-
-	path, err := h.Keystore().StoreTrustedKey(prefix, kf, fingerprint)
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	if path == "" {
-		h.ui.Println("Key NOT accepted")
-	} else {
-		h.ui.Printf("Key accepted and saved as %v\n", path)
-	}
-
-	return nil
-}
@@ -0,0 +1,319 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// User property that marks the root dataset as jetpack's; its value
+// is the version that initialized the host.
+const hostMarkerProperty = "jetpack:version"
+
+// Properties set on the root dataset unless configured otherwise
+// (root.zfs.*); pods and images inherit them.
+var recommendedRootProperties = map[string]string{
+	"atime":       "off",
+	"compression": "lz4",
+}
+
+// Directories in the root dataset that jetpack expects to exist.
+var hostDirectories = []struct {
+	name string
+	mode os.FileMode
+}{
+	{"keys", 0750},
+	{"stats", 0750},
+}
+
+type InitOptions struct {
+	Dataset    string // root.zfs if empty
+	Mountpoint string // root.zfs.mountpoint if empty
+	Fix        bool   // fix differences found on an initialized host
+}
+
+// What Host.Initialize did or found
+type InitReport struct {
+	Created     []string
+	Differences []string
+	Fixed       []string
+}
+
+func (rep *InitReport) created(format string, args ...interface{}) {
+	rep.Created = append(rep.Created, fmt.Sprintf(format, args...))
+}
+
+// A property that is not set as configured
+type propertyDiff struct {
+	Name, Want, Have string
+}
+
+func (pd propertyDiff) String() string {
+	return fmt.Sprintf("%v=%v (is %v)", pd.Name, pd.Want, pd.Have)
+}
+
+// Configured properties of a dataset (config properties starting with
+// prefix) on top of defaults, with aliases expanded. Empty values are
+// left out, so that a property can be unset in config
+// (e.g. "root.zfs.mountpoint=").
+func datasetProperties(prefix string, defaults map[string]string) map[string]string {
+	rv := make(map[string]string)
+	for k, v := range defaults {
+		rv[k] = v
+	}
+	pp := Config().FilterPrefix(prefix)
+	for _, pk := range pp.Keys() {
+		k := pk[len(prefix):]
+		if k == "compress" {
+			k = "compression"
+		}
+		rv[k], _ = pp.Get(pk)
+	}
+	for k, v := range rv {
+		if v == "" {
+			delete(rv, k)
+		}
+	}
+	return rv
+}
+
+// Returns properties whose values in have are not as in want, sorted
+// by name.
+func diffProperties(want, have map[string]string) []propertyDiff {
+	var rv []propertyDiff
+	for k, v := range want {
+		if have[k] != v {
+			rv = append(rv, propertyDiff{k, v, have[k]})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+func zfsCreateOptions(props map[string]string) []string {
+	opts := make([]string, 0, len(props))
+	for k, v := range props {
+		opts = append(opts, fmt.Sprintf("-o%v=%v", k, v))
+	}
+	sort.Strings(opts)
+	return opts
+}
+
+func propertyNames(props map[string]string) []string {
+	rv := make([]string, 0, len(props))
+	for k := range props {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Initializes the host: creates the root dataset with its pods and
+// images children, directories, and a default config file. On an
+// already initialized host, it reports datasets and properties that
+// are not as configured, and fixes them if opts.Fix is set. Refuses to
+// touch an existing root dataset that is not marked as jetpack's.
+func (h *Host) Initialize(opts *InitOptions) (*InitReport, error) {
+	if opts == nil {
+		opts = &InitOptions{}
+	}
+	dsName := opts.Dataset
+	if dsName == "" {
+		dsName = Config().MustGetString("root.zfs")
+	}
+	rootProps := datasetProperties("root.zfs.", recommendedRootProperties)
+	if opts.Mountpoint != "" {
+		rootProps["mountpoint"] = opts.Mountpoint
+	}
+	rootProps[hostMarkerProperty] = version
+
+	rep := &InitReport{}
+	create := opts.Fix
+	ds, err := zfs.GetDataset(dsName)
+	switch {
+	case err == zfs.ErrNotFound:
+		create = true
+		if mntpnt := rootProps["mountpoint"]; mntpnt != "" {
+			if err := os.MkdirAll(mntpnt, 0755); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		dsOptions := append([]string{"-p"}, zfsCreateOptions(rootProps)...)
+		h.ui.Printf("Creating ZFS dataset %v %v", dsName, dsOptions)
+		if ds, err = zfs.CreateDataset(dsName, dsOptions...); err != nil {
+			return nil, errors.Trace(err)
+		}
+		rep.created("ZFS dataset %v", dsName)
+	case err != nil:
+		return nil, errors.Trace(err)
+	default:
+		if err := h.checkRootDataset(ds, rootProps, opts.Fix, rep); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	h.Dataset = ds
+
+	for _, child := range []string{"images", "pods"} {
+		if err := h.initChildDataset(child, create, rep); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	for _, dir := range hostDirectories {
+		path := h.Path(dir.name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Trace(err)
+		}
+		if !create {
+			rep.Differences = append(rep.Differences, fmt.Sprintf("%v: missing", path))
+			continue
+		}
+		h.ui.Printf("Creating directory %v", path)
+		if err := os.MkdirAll(path, dir.mode); err != nil {
+			return nil, errors.Trace(err)
+		}
+		rep.created("directory %v", path)
+	}
+
+	if err := h.initConfig(dsName, rootProps["mountpoint"], rep); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	h.ui.Println("Summary:")
+	for _, what := range rep.Created {
+		h.ui.Println("  created", what)
+	}
+	for _, what := range rep.Fixed {
+		h.ui.Println("  fixed", what)
+	}
+	for _, what := range rep.Differences {
+		h.ui.Println("  differs:", what)
+	}
+	if len(rep.Created)+len(rep.Fixed)+len(rep.Differences) == 0 {
+		h.ui.Println("  nothing to do")
+	}
+	return rep, nil
+}
+
+// Verifies that existing root dataset is jetpack's, and compares its
+// properties. Datasets initialized before the marker was introduced
+// are recognized by their pods and images children.
+func (h *Host) checkRootDataset(ds *zfs.Dataset, props map[string]string, fix bool, rep *InitReport) error {
+	have, err := ds.GetMany(propertyNames(props)...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if mp, ok := have["mountpoint"]; ok {
+		// zfs reports it with pool's altroot
+		if have["mountpoint"], err = zfs.MountpointProperty(ds.Name, mp); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if marker := have[hostMarkerProperty]; marker == "" || marker == "-" {
+		for _, child := range []string{"images", "pods"} {
+			if _, err := ds.GetDataset(child); err == zfs.ErrNotFound {
+				return errors.Errorf("Dataset %v exists, but it is not a jetpack host (no %v property)", ds.Name, hostMarkerProperty)
+			} else if err != nil {
+				return errors.Trace(err)
+			}
+		}
+	} else {
+		// Keep the version that initialized the host
+		props[hostMarkerProperty] = marker
+	}
+	return errors.Trace(h.reconcileProperties(ds, props, have, fix, rep))
+}
+
+// Creates child dataset if it's missing and create is set (reports it
+// otherwise), or compares its properties.
+func (h *Host) initChildDataset(name string, create bool, rep *InitReport) error {
+	props := datasetProperties(name+".zfs.", nil)
+	ds, err := h.Dataset.GetDataset(name)
+	if err == zfs.ErrNotFound {
+		if !create {
+			rep.Differences = append(rep.Differences, fmt.Sprintf("%v: missing", h.Dataset.ChildName(name)))
+			return nil
+		}
+		dsOptions := zfsCreateOptions(props)
+		h.ui.Printf("Creating ZFS dataset %v %v", h.Dataset.ChildName(name), dsOptions)
+		if _, err := h.Dataset.CreateDataset(name, dsOptions...); err != nil {
+			return errors.Trace(err)
+		}
+		rep.created("ZFS dataset %v", h.Dataset.ChildName(name))
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	have, err := ds.GetMany(propertyNames(props)...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(h.reconcileProperties(ds, props, have, create, rep))
+}
+
+func (h *Host) reconcileProperties(ds *zfs.Dataset, want, have map[string]string, fix bool, rep *InitReport) error {
+	diffs := diffProperties(want, have)
+	if len(diffs) == 0 {
+		return nil
+	}
+	if !fix {
+		for _, diff := range diffs {
+			rep.Differences = append(rep.Differences, fmt.Sprintf("%v: %v", ds.Name, diff))
+		}
+		return nil
+	}
+	set := make(map[string]string)
+	for _, diff := range diffs {
+		set[diff.Name] = diff.Want
+	}
+	h.ui.Printf("Setting %v properties %v", ds.Name, set)
+	if err := ds.SetMany(set); err != nil {
+		return errors.Trace(err)
+	}
+	for _, diff := range diffs {
+		rep.Fixed = append(rep.Fixed, fmt.Sprintf("%v: %v", ds.Name, diff))
+	}
+	return nil
+}
+
+// Writes a default config file pointing at the root dataset if there
+// is none. An existing config file is never changed.
+func (h *Host) initConfig(dsName, mountpoint string, rep *InitReport) error {
+	if _, err := os.Stat(configPath); err == nil {
+		if cfgDs := Config().MustGetString("root.zfs"); cfgDs != dsName {
+			rep.Differences = append(rep.Differences,
+				fmt.Sprintf("%v: root.zfs is %v, not %v", configPath, cfgDs, dsName))
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	lines := []string{
+		"# Created by jetpack init; see jetpack.conf(5)",
+		"root.zfs = " + dsName,
+	}
+	if mountpoint != "" {
+		lines = append(lines, "root.zfs.mountpoint = "+mountpoint)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	h.ui.Printf("Writing %v", configPath)
+	if err := ioutil.WriteFile(configPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	rep.created("config file %v", configPath)
+	return nil
+}
@@ -0,0 +1,46 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/magiconair/properties"
+)
+
+func TestDiffProperties(t *testing.T) {
+	want := map[string]string{"atime": "off", "compression": "lz4", "mountpoint": "/var/jetpack"}
+	have := map[string]string{"atime": "on", "compression": "lz4"}
+	diffs := diffProperties(want, have)
+	expected := []propertyDiff{{"atime", "off", "on"}, {"mountpoint", "/var/jetpack", ""}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected %v, got %v", expected, diffs)
+	}
+	if diffs := diffProperties(want, want); len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %v", diffs)
+	}
+}
+
+func TestDatasetProperties(t *testing.T) {
+	// Work on a copy: Delete of the vendored properties breaks keys
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	Config().Set("test-init.zfs.compress", "gzip")
+	Config().Set("test-init.zfs.atime", "")
+
+	props := datasetProperties("test-init.zfs.", recommendedRootProperties)
+	if expected := map[string]string{"compression": "gzip"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+	if recommendedRootProperties["atime"] != "off" {
+		t.Error("Defaults were modified")
+	}
+}
+
+func TestZfsCreateOptions(t *testing.T) {
+	opts := zfsCreateOptions(map[string]string{"compression": "lz4", "atime": "off"})
+	if expected := []string{"-oatime=off", "-ocompression=lz4"}; !reflect.DeepEqual(opts, expected) {
+		t.Errorf("Expected %v, got %v", expected, opts)
+	}
+}
@@ -0,0 +1,139 @@
+package jetpack
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Host lock (`host.lock` in host's dataset) serializes jetpack
+// processes that change shared host state: pod creation (IP pool,
+// ports), image imports and removal, managed volumes, and trusted
+// keys take it exclusively; listing and loading pods and images take
+// it shared. It's a fcntl(2) record lock: it belongs to the process,
+// so nested and concurrent locking within one process doesn't block,
+// the kernel releases it when its holder dies (there are no stale
+// locks), and a waiter can find out the holder's pid. A process waits
+// for the lock up to lock.timeout, and fails with ErrHostBusy then.
+
+const hostLockPollInterval = 100 * time.Millisecond
+
+type hostLock struct {
+	mx        sync.Mutex
+	f         *os.File
+	shared    int // holders in this process
+	exclusive int
+}
+
+func (h *Host) lockShared() (func(), error) {
+	return h.takeLock(false)
+}
+
+func (h *Host) lockExclusive() (func(), error) {
+	return h.takeLock(true)
+}
+
+func (h *Host) takeLock(exclusive bool) (func(), error) {
+	if h.Dataset == nil {
+		// Host is not initialized
+		return func() {}, nil
+	}
+	timeout, err := time.ParseDuration(Config().GetString("lock.timeout", "5m"))
+	if err != nil {
+		return nil, errors.Annotate(err, "Invalid lock.timeout")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		pid, err := h.lock.acquire(h.Path("host.lock"), exclusive)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if pid == 0 {
+			return func() { h.lock.release(exclusive) }, nil
+		}
+		if time.Now().After(deadline) {
+			if pid < 0 {
+				return nil, errors.Trace(ErrHostBusy)
+			}
+			return nil, errors.Annotatef(ErrHostBusy, "Host lock is held by pid %d", pid)
+		}
+		if pid > 0 {
+			h.log().Debugf("Waiting for host lock held by pid %d", pid)
+		}
+		time.Sleep(hostLockPollInterval)
+	}
+}
+
+func lockType(exclusive bool) int16 {
+	if exclusive {
+		return syscall.F_WRLCK
+	}
+	return syscall.F_RDLCK
+}
+
+// Tries to take the lock without waiting. Returns pid of the process
+// holding a conflicting lock if it can't.
+func (hl *hostLock) acquire(path string, exclusive bool) (int, error) {
+	hl.mx.Lock()
+	defer hl.mx.Unlock()
+	if hl.exclusive > 0 || (!exclusive && hl.shared > 0) {
+		// This process holds a strong enough lock already
+		hl.count(exclusive, 1)
+		return 0, nil
+	}
+	if hl.f == nil {
+		// Kept open for process' lifetime: closing any descriptor of the
+		// file releases process' locks on it
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		hl.f = f
+	}
+	lk := syscall.Flock_t{Type: lockType(exclusive), Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(hl.f.Fd(), syscall.F_SETLK, &lk); err == nil {
+		hl.count(exclusive, 1)
+		return 0, nil
+	} else if err != syscall.EAGAIN && err != syscall.EACCES {
+		return 0, errors.Trace(err)
+	}
+	lk = syscall.Flock_t{Type: lockType(exclusive), Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(hl.f.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if lk.Type == syscall.F_UNLCK {
+		// Released meanwhile; caller will retry
+		return -1, nil
+	}
+	return int(lk.Pid), nil
+}
+
+func (hl *hostLock) count(exclusive bool, n int) {
+	if exclusive {
+		hl.exclusive += n
+	} else {
+		hl.shared += n
+	}
+}
+
+// Releases one hold, downgrading or unlocking the file lock if it's
+// the last one of its kind.
+func (hl *hostLock) release(exclusive bool) {
+	hl.mx.Lock()
+	defer hl.mx.Unlock()
+	hl.count(exclusive, -1)
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: 0, Start: 0, Len: 0}
+	switch {
+	case hl.exclusive > 0:
+		return
+	case hl.shared > 0:
+		if !exclusive {
+			return
+		}
+		lk.Type = syscall.F_RDLCK
+	}
+	syscall.FcntlFlock(hl.f.Fd(), syscall.F_SETLK, &lk)
+}
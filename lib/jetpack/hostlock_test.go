@@ -0,0 +1,95 @@
+package jetpack
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Holds the host lock in a separate process for TestHostLock
+func TestHostLockHelper(t *testing.T) {
+	dir := os.Getenv("JETPACK_TEST_LOCK_DIR")
+	if dir == "" {
+		t.Skip("Helper process")
+	}
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: dir}}
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("locked\n")
+	ioutil.ReadAll(os.Stdin)
+	unlock()
+}
+
+func TestHostLock(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	Config().Set("lock.timeout", "300ms")
+	defer Config().Set("lock.timeout", "5m")
+
+	// Nested locks of one process don't block
+	unlock1, err := h.lockShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2, err := h.lockExclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock3, err := h.lockShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock3()
+	unlock2()
+	unlock1()
+	if h.lock.shared != 0 || h.lock.exclusive != 0 {
+		t.Errorf("Lock still held: %d shared, %d exclusive", h.lock.shared, h.lock.exclusive)
+	}
+
+	// Another process' lock
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHostLockHelper$")
+	cmd.Env = append(os.Environ(), "JETPACK_TEST_LOCK_DIR="+tmp)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("Helper failed: %#v %v", line, err)
+	}
+
+	if _, err := h.lockShared(); errors.Cause(err) != ErrHostBusy {
+		t.Errorf("Expected ErrHostBusy, got %v", err)
+	} else if expected := errors.Annotatef(ErrHostBusy, "Host lock is held by pid %d", cmd.Process.Pid).Error(); err.Error() != expected {
+		t.Errorf("Expected %#v, got %#v", expected, err.Error())
+	}
+
+	// Released when holder exits
+	stdin.Close()
+	cmd.Wait()
+	if unlock, err := h.lockExclusive(); err != nil {
+		t.Errorf("Expected lock after helper exited, got %v", err)
+	} else {
+		unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package jetpack
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Paths of pods and images are derived from the root dataset's
+// mountpoint (Host.Path), so the pods and images datasets need to be
+// mounted right below it; a dataset with its own mountpoint, or one
+// that is not mounted, would have jetpack write files to the
+// directory underneath. The host checks this when it's created, and
+// fails with *MountError, unless HostOptions.SkipMountCheck is set (as
+// it is for jetpack init). Datasets with mountpoint=legacy are
+// supported as long as they are mounted where they're expected;
+// MountError.Mount can mount them there.
+
+// A dataset that the host needs is not mounted where it's expected.
+type MountError struct {
+	Dataset *zfs.Dataset
+	Path    string // where it should be mounted; "" if unknown
+}
+
+func (e *MountError) Error() string {
+	ds := e.Dataset
+	switch {
+	case e.Path == "":
+		return fmt.Sprintf("ZFS dataset %v is not mounted, and has no mountpoint; set root.zfs.mountpoint", ds.Name)
+	case ds.Legacy && ds.Mounted:
+		return fmt.Sprintf("ZFS dataset %v (mountpoint=legacy) is mounted at %v, not at %v", ds.Name, ds.Mountpoint, e.Path)
+	case ds.Legacy:
+		return fmt.Sprintf("ZFS dataset %v (mountpoint=legacy) is not mounted; mount it with `mount -t zfs %v %v`",
+			ds.Name, ds.Name, e.Path)
+	case ds.Mountpoint != e.Path:
+		state, mp := "is mounted at", ds.Mountpoint
+		if !ds.Mounted {
+			state = "has mountpoint"
+		}
+		if mp == "" {
+			mp = "none"
+		}
+		return fmt.Sprintf("ZFS dataset %v %v %v, not %v; set its mountpoint to %v, or inherit it",
+			ds.Name, state, mp, e.Path, e.Path)
+	}
+	return fmt.Sprintf("ZFS dataset %v is not mounted at %v; mount it with `zfs mount %v`", ds.Name, e.Path, ds.Name)
+}
+
+// Returns true if Mount can fix the error.
+func (e *MountError) CanMount() bool {
+	if e.Dataset.Mounted || e.Path == "" {
+		return false
+	}
+	return e.Dataset.Legacy || e.Dataset.Mountpoint == e.Path
+}
+
+// Mounts the dataset where it's expected.
+func (e *MountError) Mount() error {
+	if !e.CanMount() {
+		return errors.New(e.Error())
+	}
+	if e.Dataset.Legacy {
+		return errors.Trace(e.Dataset.MountLegacy(e.Path))
+	}
+	return errors.Trace(e.Dataset.Mount())
+}
+
+// Verifies that the root dataset, and its pods and images children (if
+// they exist), are mounted where host's paths expect them.
+func (h *Host) checkMounts() error {
+	if !h.Dataset.Mounted || h.Dataset.Mountpoint == "" {
+		path := h.Dataset.Mountpoint
+		if h.Dataset.Legacy {
+			if mp := Config().GetString("root.zfs.mountpoint", ""); mp != "" {
+				altroot, err := zfs.Altroot(zfs.PoolOf(h.Dataset.Name))
+				if err != nil {
+					return errors.Trace(err)
+				}
+				path = altroot + mp
+			}
+		}
+		return &MountError{Dataset: h.Dataset, Path: path}
+	}
+	for _, child := range []string{"pods", "images"} {
+		ds, err := h.datasets().GetDataset(h.Dataset.ChildName(child))
+		if err == zfs.ErrNotFound {
+			// jetpack init creates it
+			continue
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if path := h.Path(child); !ds.Mounted || ds.Mountpoint != path {
+			return &MountError{Dataset: ds, Path: path}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package jetpack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestCheckMounts(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	h.Dataset.Mounted = true
+
+	if err := h.checkMounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Own mountpoint
+	if err := f.SetProperty("zroot/jetpack/pods", "mountpoint", "/srv/pods"); err != nil {
+		t.Fatal(err)
+	}
+	err := h.checkMounts()
+	if merr, ok := err.(*MountError); !ok {
+		t.Fatalf("Expected MountError, got %v", err)
+	} else if merr.Dataset.Name != "zroot/jetpack/pods" || merr.Path != h.Path("pods") || merr.CanMount() {
+		t.Errorf("Unexpected error %#v", merr)
+	} else if !strings.Contains(err.Error(), "is mounted at /srv/pods") {
+		t.Errorf("Unexpected message: %v", err)
+	}
+	if err := f.SetProperty("zroot/jetpack/pods", "mountpoint", h.Path("pods")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Legacy dataset that is not mounted
+	if err := f.SetProperty("zroot/jetpack/images", "mountpoint", "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	err = h.checkMounts()
+	if merr, ok := err.(*MountError); !ok {
+		t.Fatalf("Expected MountError, got %v", err)
+	} else if !merr.CanMount() || !strings.Contains(err.Error(), "mount -t zfs zroot/jetpack/images "+h.Path("images")) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Unmounted root
+	h.Dataset.Mounted = false
+	if merr, ok := h.checkMounts().(*MountError); !ok || merr.Dataset != h.Dataset || !merr.CanMount() {
+		t.Errorf("Expected mountable root, got %v", merr)
+	}
+}
+
+func TestMountErrorMessages(t *testing.T) {
+	for _, tc := range []struct {
+		ds       zfs.Dataset
+		path     string
+		canMount bool
+		message  string
+	}{
+		{zfs.Dataset{Name: "p/j", Mountpoint: "/j"}, "/j", true, "mount it with `zfs mount p/j`"},
+		{zfs.Dataset{Name: "p/j"}, "/j", false, "has mountpoint none, not /j"},
+		{zfs.Dataset{Name: "p/j", Legacy: true, Mounted: true, Mountpoint: "/k"}, "/j", false, "is mounted at /k, not at /j"},
+		{zfs.Dataset{Name: "p/j", Legacy: true}, "", false, "set root.zfs.mountpoint"},
+	} {
+		merr := &MountError{Dataset: &tc.ds, Path: tc.path}
+		if merr.CanMount() != tc.canMount {
+			t.Errorf("%v: expected CanMount %v", merr, tc.canMount)
+		}
+		if !strings.Contains(merr.Error(), tc.message) {
+			t.Errorf("Expected %#v in %#v", tc.message, merr.Error())
+		}
+	}
+}
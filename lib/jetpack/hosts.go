@@ -0,0 +1,132 @@
+package jetpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Markers of the section jetpack maintains in pods' /etc/hosts
+const (
+	hostsBeginMarker = "# BEGIN jetpack pods -- do not edit, will be overwritten"
+	hostsEndMarker   = "# END jetpack pods"
+)
+
+// Returns hostname of the pod: `hostname` annotation, or the UUID.
+func (pod *Pod) Hostname() string {
+	if hostname, ok := pod.Manifest.Annotations.Get("hostname"); ok {
+		return hostname
+	}
+	return pod.UUID.String()
+}
+
+// Returns /etc/hosts lines for all running pods, sorted.
+func (h *Host) podHostsEntries() ([]string, error) {
+	// Make sure we're not looking at stale jail status
+	if _, err := h.getJailStatus("", true); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var entries []string
+	for _, pod := range h.Pods() {
+		if pod.Status() != PodStatusRunning {
+			continue
+		}
+		ip, ok := pod.IPAddress()
+		if !ok {
+			continue
+		}
+		names := []string{pod.Hostname()}
+		if names[0] != pod.UUID.String() {
+			names = append(names, pod.UUID.String())
+		}
+		entries = append(entries, fmt.Sprintf("%v\t%v", ip, strings.Join(names, " ")))
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// Rewrites the host-level registry of running pods (`hosts` file in
+// the host directory), and -- if `hosts.inject` is on -- jetpack's
+// section of /etc/hosts in all running pods. The registry is always
+// generated from scratch, so it never contains destroyed pods.
+func (h *Host) updateHosts() error {
+	entries, err := h.podHostsEntries()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	hostsBody := strings.Join(entries, "\n")
+	if hostsBody != "" {
+		hostsBody += "\n"
+	}
+
+	if err := writeFileAtomic(h.Path("hosts"), []byte(hostsBody), 0644); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !Config().GetBool("hosts.inject", false) {
+		return nil
+	}
+
+	for _, pod := range h.Pods() {
+		if pod.Status() != PodStatusRunning {
+			continue
+		}
+		if err := pod.injectHosts(entries); err != nil {
+			h.log().Warnf("pod %v: cannot update /etc/hosts: %v", pod.UUID, err)
+		}
+	}
+
+	return nil
+}
+
+// Replaces jetpack's section of /etc/hosts in each app's rootfs.
+func (pod *Pod) injectHosts(entries []string) error {
+	for _, app := range pod.Manifest.Apps {
+		etcPath := pod.Path("rootfs", "app", app.Name.String(), "rootfs", "etc")
+		if fi, err := os.Stat(etcPath); err != nil || !fi.IsDir() {
+			continue
+		}
+		hostsPath := filepath.Join(etcPath, "hosts")
+		orig, err := ioutil.ReadFile(hostsPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if err := writeFileAtomic(hostsPath, replaceHostsSection(orig, entries), 0644); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Returns hosts file contents with jetpack's section replaced by entries.
+func replaceHostsSection(orig []byte, entries []string) []byte {
+	var buf bytes.Buffer
+	inSection := false
+	for _, line := range strings.SplitAfter(string(orig), "\n") {
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == hostsBeginMarker:
+			inSection = true
+		case trimmed == hostsEndMarker:
+			inSection = false
+		case !inSection && line != "":
+			buf.WriteString(line)
+		}
+	}
+	if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(hostsBeginMarker + "\n")
+	for _, entry := range entries {
+		buf.WriteString(entry + "\n")
+	}
+	buf.WriteString(hostsEndMarker + "\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,315 @@
+package jetpack
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Typed configuration of host's subsystems, read from properties at
+// host construction and on reload. Properties' types are validated by
+// validateConfig against propertySchema; each section also checks its
+// values, and its problems are reported with the section's name.
+
+type NetworkSettings struct {
+	Interface         string            // jail.interface
+	Pools             map[string]string // ips.pool.INTERFACE
+	NAT               bool              // nat.enable
+	ExternalInterface string            // nat.external-interface
+	Isolate           bool              // net.isolate
+	Accounting        bool              // net.accounting
+}
+
+type GCSettings struct {
+	GracePeriod     time.Duration // gc.grace-period; 0 if off
+	CreationTimeout time.Duration // gc.creation-timeout
+	SpoolMaxAge     time.Duration // gc.spool-max-age; 0 if off
+	ImageMinAge     time.Duration // gc.image-min-age; 0 if off
+	PinnedTags      []pinnedTag   // gc.pinned-tags
+}
+
+type LoggingSettings struct {
+	MaxSize    int64         // log.max-size; 0 if off
+	MaxAge     time.Duration // log.max-age; 0 if off
+	Keep       int           // log.keep
+	Compress   bool          // log.compress
+	Timestamps bool          // log.timestamps
+}
+
+type ImagesSettings struct {
+	Compression string            // images.aci.compression
+	Verify      bool              // images.verify
+	ZFS         map[string]string // images.zfs.PROPERTY
+}
+
+type LimitsSettings struct {
+	Pods    int   // limits.pods; 0 if off
+	Quota   int64 // limits.quota; 0 if off
+	MinFree int64 // limits.min-free; 0 if off
+}
+
+type TimeoutSettings struct {
+	ZFS    time.Duration // timeout.zfs; 0 if off
+	Jail   time.Duration // timeout.jail; 0 if off
+	System time.Duration // timeout.system; 0 if off
+}
+
+type HostSettings struct {
+	Network  NetworkSettings
+	GC       GCSettings
+	Logging  LoggingSettings
+	Images   ImagesSettings
+	Limits   LimitsSettings
+	Timeouts TimeoutSettings
+}
+
+// Collects problems of one section.
+type settingsSection struct {
+	name     string
+	props    *properties.Properties
+	problems []string
+}
+
+func (ss *settingsSection) fail(key, format string, args ...interface{}) {
+	ss.problems = append(ss.problems, ss.name+": "+key+": "+errors.Errorf(format, args...).Error())
+}
+
+func (ss *settingsSection) bool(key string) bool {
+	v := ss.props.GetString(key, "")
+	switch strings.ToLower(v) {
+	case "on", "true", "yes", "1":
+		return true
+	case "", "off", "false", "no", "0":
+		return false
+	}
+	ss.fail(key, "invalid boolean %#v", v)
+	return false
+}
+
+func (ss *settingsSection) int(key string) int {
+	v := ss.props.GetString(key, "")
+	if v == "" || v == "off" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		ss.fail(key, "invalid number %#v", v)
+	}
+	return n
+}
+
+func (ss *settingsSection) duration(key string) time.Duration {
+	v := ss.props.GetString(key, "")
+	if v == "" || v == "off" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		ss.fail(key, "invalid duration %#v", v)
+	}
+	return d
+}
+
+func (ss *settingsSection) size(key string) int64 {
+	v := ss.props.GetString(key, "")
+	if v == "off" {
+		return 0
+	}
+	n, err := parseLogSize(v)
+	if err != nil {
+		ss.fail(key, "invalid size %#v", v)
+	}
+	return n
+}
+
+// Returns non-empty values of properties with prefix, by the rest of
+// their names.
+func (ss *settingsSection) prefix(prefix string) map[string]string {
+	rv := make(map[string]string)
+	pp := ss.props.FilterPrefix(prefix)
+	for _, k := range pp.Keys() {
+		if v := pp.GetString(k, ""); v != "" {
+			rv[k[len(prefix):]] = v
+		}
+	}
+	return rv
+}
+
+// Reads host settings from props.
+func loadHostSettings(props *properties.Properties) (*HostSettings, error) {
+	hs := &HostSettings{}
+	var problems []string
+
+	net := &settingsSection{name: "network", props: props}
+	hs.Network = NetworkSettings{
+		Interface:         props.GetString("jail.interface", ""),
+		Pools:             net.prefix("ips.pool."),
+		NAT:               net.bool("nat.enable"),
+		ExternalInterface: props.GetString("nat.external-interface", ""),
+		Isolate:           net.bool("net.isolate"),
+		Accounting:        net.bool("net.accounting"),
+	}
+	problems = append(problems, net.problems...)
+
+	gc := &settingsSection{name: "gc", props: props}
+	hs.GC = GCSettings{
+		GracePeriod:     gc.duration("gc.grace-period"),
+		CreationTimeout: gc.duration("gc.creation-timeout"),
+		SpoolMaxAge:     gc.duration("gc.spool-max-age"),
+		ImageMinAge:     gc.duration("gc.image-min-age"),
+	}
+	if pinned, err := parsePinnedTags(props.GetString("gc.pinned-tags", "")); err != nil {
+		gc.fail("gc.pinned-tags", "%v", err)
+	} else {
+		hs.GC.PinnedTags = pinned
+	}
+	problems = append(problems, gc.problems...)
+
+	lg := &settingsSection{name: "logging", props: props}
+	hs.Logging = LoggingSettings{
+		MaxSize:    lg.size("log.max-size"),
+		MaxAge:     lg.duration("log.max-age"),
+		Keep:       lg.int("log.keep"),
+		Compress:   lg.bool("log.compress"),
+		Timestamps: lg.bool("log.timestamps"),
+	}
+	problems = append(problems, lg.problems...)
+
+	img := &settingsSection{name: "images", props: props}
+	hs.Images = ImagesSettings{
+		Compression: props.GetString("images.aci.compression", ""),
+		Verify:      img.bool("images.verify"),
+		ZFS:         img.prefix("images.zfs."),
+	}
+	if v, ok := hs.Images.ZFS["compress"]; ok {
+		delete(hs.Images.ZFS, "compress")
+		hs.Images.ZFS["compression"] = v
+	}
+	problems = append(problems, img.problems...)
+
+	lim := &settingsSection{name: "limits", props: props}
+	hs.Limits = LimitsSettings{
+		Pods:    lim.int("limits.pods"),
+		Quota:   lim.size("limits.quota"),
+		MinFree: lim.size("limits.min-free"),
+	}
+	problems = append(problems, lim.problems...)
+
+	to := &settingsSection{name: "timeouts", props: props}
+	hs.Timeouts = TimeoutSettings{
+		ZFS:    to.duration("timeout.zfs"),
+		Jail:   to.duration("timeout.jail"),
+		System: to.duration("timeout.system"),
+	}
+	problems = append(problems, to.problems...)
+
+	if len(problems) > 0 {
+		return nil, errors.Errorf("Invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return hs, nil
+}
+
+// Re-reads configuration files, and reloads host's settings. If the
+// new configuration is invalid, the current one is kept.
+func (h *Host) ReloadConfig() error {
+	lc, err := loadConfig()
+	if err != nil {
+		return errors.Annotate(err, "Cannot read configuration")
+	}
+	if err := h.validateConfig(lc.props); err != nil {
+		return errors.Trace(err)
+	}
+	settings, err := loadHostSettings(lc.props)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	configMx.Lock()
+	lc.use()
+	configMx.Unlock()
+	h.setSettings(settings)
+	h.log().Infof("configuration reloaded")
+	return nil
+}
+
+// Replaces host's settings, and applies them.
+func (h *Host) setSettings(settings *HostSettings) {
+	h.settingsMx.Lock()
+	defer h.settingsMx.Unlock()
+	h.Settings = settings
+	settings.apply()
+}
+
+// A configuration property's effective value, and where it's been set
+type ConfigValue struct {
+	Name   string
+	Value  string
+	Source string // "default", FILE:LINE, path of jetpack.conf, or "command line"
+}
+
+// Returns all configuration properties, sorted by name.
+func (h *Host) EffectiveConfig() []ConfigValue {
+	props := Config()
+	keys := props.Keys()
+	sort.Strings(keys)
+	rv := make([]ConfigValue, len(keys))
+	for i, k := range keys {
+		rv[i] = ConfigValue{Name: k, Value: props.GetString(k, ""), Source: configSource(k)}
+		if rv[i].Source == "" {
+			rv[i].Source = "runtime"
+		}
+	}
+	return rv
+}
+
+// Applies settings that are global to the process: timeouts of zfs
+// and system commands. Commands already running keep theirs.
+func (hs *HostSettings) apply() {
+	zfs.SetTimeout(hs.Timeouts.ZFS)
+	atomic.StoreInt64(&systemTimeout, int64(hs.Timeouts.System))
+}
+
+// Time that system utilities (jls, ps, sysctl, pfctl, ifconfig, etc)
+// can take, in nanoseconds; accessed atomically, as a reload may set
+// it while commands run
+var systemTimeout int64
+
+// Context of system utilities (a context.Context); see
+// setCommandContext
+var systemContext atomic.Value
+
+// Sets context of zfs commands and system utilities; like run.Trace,
+// it's set by the host, whose CancelCommands cancels it.
+func setCommandContext(ctx context.Context) {
+	zfs.SetContext(ctx)
+	systemContext.Store(ctx)
+}
+
+// Returns command of a system utility, which is killed after
+// timeout.system, or when host's commands are cancelled.
+func systemCommand(name string, args ...string) *run.Cmd {
+	cmd := run.Command(name, args...).Stream().WithTimeout(time.Duration(atomic.LoadInt64(&systemTimeout)))
+	if ctx, ok := systemContext.Load().(context.Context); ok {
+		cmd.WithContext(ctx)
+	}
+	return cmd
+}
+
+// Returns time that jail(8) can take to start or stop a pod's jail; 0
+// if there's no limit.
+func (h *Host) jailTimeout() time.Duration {
+	h.settingsMx.RLock()
+	defer h.settingsMx.RUnlock()
+	if h.Settings == nil {
+		return 0
+	}
+	return h.Settings.Timeouts.Jail
+}
@@ -0,0 +1,206 @@
+package jetpack
+
+import (
+	"fmt"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Managed volumes are datasets below host's `volumes` dataset. They
+// outlive pods, and can be shared between pods. A pod uses a managed
+// volume by setting `jetpack/volume/NAME/managed` annotation to the
+// managed volume's name; the pod's volume NAME becomes a host volume
+// with the managed volume as source.
+
+type ManagedVolume struct {
+	Name    types.ACName
+	Dataset *zfs.Dataset
+	Host    *Host
+}
+
+func (mv *ManagedVolume) Path() string {
+	return mv.Dataset.Mountpoint
+}
+
+// Returns space used by the volume, as reported by ZFS.
+func (mv *ManagedVolume) Used() string {
+	if used, ok := mv.Dataset.Properties["used"]; ok {
+		return used
+	}
+	if used, err := mv.Dataset.Get("used"); err != nil {
+		return "?"
+	} else {
+		return used
+	}
+}
+
+// Returns pods that use the volume. References are counted by looking
+// at pods' manifests, so they're never stale, even after a crash.
+func (mv *ManagedVolume) Pods() []*Pod {
+	var pods []*Pod
+	for _, pod := range mv.Host.Pods() {
+		for _, vol := range pod.Manifest.Volumes {
+			if managed, ok := pod.volumeAnnotation(vol.Name, "managed"); ok && managed == mv.Name.String() {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	return pods
+}
+
+func (mv *ManagedVolume) String() string {
+	return fmt.Sprintf("%v (%v)", mv.Name, mv.Path())
+}
+
+func (h *Host) volumesDataset(create bool) (*zfs.Dataset, error) {
+	if ds, err := h.Dataset.GetDataset("volumes"); err == nil {
+		return ds, nil
+	} else if err != zfs.ErrNotFound {
+		return nil, errors.Trace(err)
+	} else if !create {
+		return nil, err
+	}
+	dsOptions := h.zfsOptions("volumes.zfs.")
+	h.ui.Printf("Creating ZFS dataset %v/volumes %v", h.Dataset.Name, dsOptions)
+	ds, err := h.Dataset.CreateDataset("volumes", dsOptions...)
+	return ds, errors.Trace(err)
+}
+
+// Creates a managed volume. Properties are ZFS properties of its
+// dataset, over ones of the volumes.zfs.* host properties.
+func (h *Host) CreateVolume(name types.ACName, properties map[string]string) (*ManagedVolume, error) {
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	if _, err := h.GetVolume(name); err == nil {
+		return nil, errors.Errorf("Volume %v already exists", name)
+	} else if err != ErrNotFound {
+		return nil, errors.Trace(err)
+	}
+
+	vds, err := h.volumesDataset(true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	props, err := zfsPropertySet("volumes.zfs.", nil, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for k, v := range properties {
+		props[k] = v
+	}
+
+	if ds, err := createWithProperties(h.datasets(), vds.ChildName(name.String()), props, "volumes.zfs.* settings"); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		return &ManagedVolume{Name: name, Dataset: ds, Host: h}, nil
+	}
+}
+
+func (h *Host) GetVolume(name types.ACName) (*ManagedVolume, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	vds, err := h.volumesDataset(false)
+	if err == zfs.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if ds, err := vds.GetDataset(name.String()); err == zfs.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		return &ManagedVolume{Name: name, Dataset: ds, Host: h}, nil
+	}
+}
+
+func (h *Host) Volumes() ([]*ManagedVolume, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	vds, err := h.volumesDataset(false)
+	if err == zfs.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dss, err := vds.Children(1, "used")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	mvs := make([]*ManagedVolume, 0, len(dss))
+	for _, ds := range dss {
+		if name, err := types.NewACName(ds.Name[len(vds.Name)+1:]); err != nil {
+			h.log().Warnf("%v: %v", ds.Name, err)
+		} else {
+			mvs = append(mvs, &ManagedVolume{Name: *name, Dataset: ds, Host: h})
+		}
+	}
+	return mvs, nil
+}
+
+// Destroys a managed volume. Refuses to destroy volume used by any
+// pod, unless force is true; volume used by a running pod is never
+// destroyed.
+func (h *Host) RemoveVolume(name types.ACName, force bool) error {
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
+	mv, err := h.GetVolume(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if pods := mv.Pods(); len(pods) > 0 {
+		if !force {
+			return errors.Errorf("Volume %v is used by %d pod(s), including %v", name, len(pods), pods[0].UUID)
+		}
+		for _, pod := range pods {
+			if pod.Status() != PodStatusStopped {
+				return errors.Errorf("Volume %v is used by running pod %v", name, pod.UUID)
+			}
+		}
+	}
+	return errors.Trace(mv.Dataset.Destroy("-r"))
+}
+
+// Turns pod's volumes with `jetpack/volume/NAME/managed` annotation
+// into host volumes with managed volume's path as source.
+func (pod *Pod) resolveManagedVolumes() error {
+	for i, vol := range pod.Manifest.Volumes {
+		managed, ok := pod.volumeAnnotation(vol.Name, "managed")
+		if !ok {
+			continue
+		}
+		name, err := types.NewACName(managed)
+		if err != nil {
+			return errors.Annotatef(err, "Volume %v", vol.Name)
+		}
+		mv, err := pod.Host.GetVolume(*name)
+		if err != nil {
+			return errors.Annotatef(err, "Volume %v: managed volume %v", vol.Name, name)
+		}
+		pod.Manifest.Volumes[i] = types.Volume{
+			Name:      vol.Name,
+			Kind:      "host",
+			Source:    mv.Path(),
+			ReadOnly:  vol.ReadOnly,
+			Recursive: vol.Recursive,
+		}
+	}
+	return nil
+}
@@ -28,11 +28,53 @@ type Image struct {
 
 	Hash      *types.Hash `json:",omitempty"`
 	Timestamp time.Time
+	Signature *ImageSignature `json:",omitempty"` // nil if imported without signature, or built
+	Import    *ImportSummary  `json:",omitempty"` // nil if built
+
+	// Where the image comes from; nil for images stored before it was
+	// recorded
+	Provenance *ImageProvenance `json:",omitempty"`
+
+	// Hash of the image's content when sealed (see Verify); nil for
+	// images sealed before it was recorded
+	ContentHash *types.Hash `json:",omitempty"`
+
+	// Resolved hashes of manifest's dependencies, in order
+	Dependencies []types.Hash `json:",omitempty"`
 
 	rootfs *zfs.Dataset
 	ui     *ui.UI
 }
 
+// Result of image's signature verification at import
+type ImageSignature struct {
+	Fingerprint string // of the signing key
+	Signer      string // key's identity
+	Verified    time.Time
+}
+
+// Summary of image's fetch and import
+type ImportSummary struct {
+	Size     int64         // of the ACI; -1 if unknown
+	Duration time.Duration // from start of the fetch, or of the import
+	Origin   string        `json:",omitempty"` // cache, mirror, or upstream if fetched by name; replication if received
+}
+
+func (is *ImportSummary) String() string {
+	if is.Origin != "" {
+		return fmt.Sprintf("%d bytes in %v from %v", is.Size, is.Duration, is.Origin)
+	}
+	return fmt.Sprintf("%d bytes in %v", is.Size, is.Duration)
+}
+
+// Returns identity of the image's signer, or "unsigned".
+func (img *Image) SignedBy() string {
+	if img.Signature == nil {
+		return "unsigned"
+	}
+	return img.Signature.Signer
+}
+
 func NewImage(h *Host, id uuid.UUID) *Image {
 	if id == nil {
 		id = uuid.NewRandom()
@@ -67,8 +109,13 @@ func (img *Image) ID() string {
 }
 
 func (img *Image) String() string {
-	labels := make([]string, len(img.Manifest.Labels))
-	for i, label := range img.Manifest.Labels {
+	return imageString(img.Manifest.Name, img.Manifest.Labels)
+}
+
+// Returns name with labels, version first.
+func imageString(name types.ACIdentifier, imageLabels types.Labels) string {
+	labels := make([]string, len(imageLabels))
+	for i, label := range imageLabels {
 		// FIXME: URL-escape values
 		if label.Name == "version" {
 			// HACK: we want version to `sort.Strings()` before all other
@@ -82,11 +129,11 @@ func (img *Image) String() string {
 		}
 	}
 	sort.Strings(labels)
-	if labels[0][0] == '+' {
+	if len(labels) > 0 && labels[0][0] == '+' {
 		labels[0] = ":" + labels[0][1:]
 	}
 
-	return string(img.Manifest.Name) + strings.Join(labels, "")
+	return string(name) + strings.Join(labels, "")
 }
 
 func (img *Image) Path(elem ...string) string {
@@ -98,7 +145,7 @@ func (img *Image) Path(elem ...string) string {
 
 func (img *Image) getRootfs() *zfs.Dataset {
 	if img.rootfs == nil {
-		ds, err := img.Host.Dataset.GetDataset(path.Join("images", img.UUID.String()))
+		ds, err := img.Host.datasets().GetDataset(img.Host.Dataset.ChildName(path.Join("images", img.UUID.String())))
 		if err != nil {
 			panic(err)
 		}
@@ -147,28 +194,28 @@ func (img *Image) loadManifest() error {
 	return nil
 }
 
-func (img *Image) Destroy() (err error) {
-	if pods, err := img.Pods(); err != nil {
+// Destroys the image. Returns ImageInUseError if pods or other images
+// use it.
+func (img *Image) Destroy() error {
+	return img.destroy(false)
+}
+
+// Destroys the image; see Host.RemoveImage.
+func (img *Image) destroy(force bool) (err error) {
+	unlock, err := img.Host.lockExclusive()
+	if err != nil {
 		return errors.Trace(err)
-	} else if len(pods) > 0 {
-		ids := make([]string, len(pods))
-		for i, pod := range pods {
-			ids[i] = pod.UUID.String()
-		}
-		return errors.Errorf("Cannot destroy image %s: %d pods run it: %v", img.Hash, len(ids), ids)
 	}
-
-	if dimgs, err := img.DependantImages(); err != nil {
+	defer unlock()
+	broken, err := img.checkUsers(force)
+	if err != nil {
 		return errors.Trace(err)
-	} else if len(dimgs) > 0 {
-		hashes := make([]string, len(dimgs))
-		for i, dimg := range dimgs {
-			hashes[i] = dimg.Hash.String()
-		}
-		return errors.Errorf("Cannot destroy image %s: %d other images need it: %v", img.Hash, len(hashes), hashes)
 	}
 	img.ui.Println("Destroying")
-	err = errors.Trace(img.getRootfs().Destroy("-r"))
+	if err := img.releaseDependencies(); err != nil {
+		return errors.Trace(err)
+	}
+	err = errors.Trace(img.Host.datasets().Destroy(img.getRootfs().Name, true))
 	if img.Hash != nil {
 		if err2 := os.Remove(img.Path("..", img.Hash.String())); err2 != nil && err == nil {
 			err = errors.Trace(err2)
@@ -176,18 +223,43 @@ func (img *Image) Destroy() (err error) {
 		if err2 := os.RemoveAll(img.Path()); err2 != nil && err == nil {
 			err = errors.Trace(err2)
 		}
+		if err2 := img.untagAll(); err2 != nil && err == nil {
+			err = errors.Trace(err2)
+		}
+	}
+	if err == nil {
+		img.markPodsBroken(broken)
 	}
 	return
 }
 
+// Removes what a failed import has created: rootfs dataset, hash
+// symlink, and image's directory.
+func (img *Image) abortImport() {
+	if img.rootfs != nil {
+		if err := img.Host.datasets().Destroy(img.rootfs.Name, true); err != nil {
+			img.log().Warnf("Cannot destroy rootfs of failed import: %v", err)
+		}
+	}
+	if img.Hash != nil {
+		link := img.Path("..", img.Hash.String())
+		if target, err := os.Readlink(link); err == nil && target == img.UUID.String() {
+			os.Remove(link)
+		}
+	}
+	if err := os.RemoveAll(img.Path()); err != nil {
+		img.log().Warnf("Cannot remove failed import: %v", err)
+	}
+}
+
 func (img *Image) Clone(dest, mountpoint string) (*zfs.Dataset, error) {
-	img.ui.Debugf("Cloning rootfs as %v at %v", dest, mountpoint)
+	img.log().Debugf("Cloning rootfs as %v at %v", dest, mountpoint)
 	snap, err := img.getRootfs().GetSnapshot(imageSnapshotName)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ds, err := snap.Clone(dest, "-o", "mountpoint="+mountpoint)
+	ds, err := snap.Clone("", dest, map[string]string{"mountpoint": mountpoint})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -219,7 +291,7 @@ func (img *Image) RuntimeApp() schema.RuntimeApp {
 }
 
 func (img *Image) saveManifest() error {
-	img.ui.Debug("Saving manifest")
+	img.log().Debugf("Saving manifest")
 	if manifestBytes, err := json.Marshal(img.Manifest); err != nil {
 		return errors.Trace(err)
 	} else {
@@ -238,7 +310,21 @@ func (img *Image) saveManifest() error {
 
 // Finalize unpacked/built image
 func (img *Image) sealImage() error {
-	img.ui.Debug("Sealing")
+	img.log().Debugf("Sealing")
+	if err := img.recordContent(); err != nil {
+		return errors.Annotate(err, "Recording content hash")
+	}
+
+	if _, err := img.getRootfs().Snapshot(imageSnapshotName, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(img.register())
+}
+
+// Saves metadata of a sealed image, makes its rootfs read-only, and
+// makes it available by hash and tags.
+func (img *Image) register() error {
 	img.Timestamp = time.Now()
 
 	// Set access mode for the metadata server
@@ -272,12 +358,12 @@ func (img *Image) sealImage() error {
 		return errors.Trace(err)
 	}
 
-	if _, err := img.getRootfs().Snapshot(imageSnapshotName); err != nil {
+	if err := img.getRootfs().Zfs("set", "readonly=on"); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := img.getRootfs().Zfs("set", "readonly=on"); err != nil {
-		return errors.Trace(err)
+	if err := img.tagFromManifest(); err != nil {
+		return errors.Annotate(err, "Tagging image")
 	}
 
 	return nil
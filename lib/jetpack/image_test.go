@@ -0,0 +1,170 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestCheckUnsigned(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+
+	h := &Host{}
+	if err := h.checkUnsigned("example.com/img", nil); errors.Cause(err) != fetch.ErrVerificationFailed {
+		t.Errorf("nil options: expected verification failure, got %v", err)
+	}
+	for _, c := range []struct {
+		flag, property bool
+		allowed        bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	} {
+		configProperties.Set("allow.no-signature", map[bool]string{true: "on", false: "off"}[c.property])
+		err := h.checkUnsigned("example.com/img", &ImageOptions{AllowUnsigned: c.flag})
+		if c.allowed && err != nil {
+			t.Errorf("%+v: %v", c, err)
+		} else if !c.allowed && errors.Cause(err) != fetch.ErrVerificationFailed {
+			t.Errorf("%+v: expected verification failure, got %v", c, err)
+		}
+	}
+}
+
+func TestImageSignatureMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+
+	unsigned := saveTestImage(t, h, "example.com/unsigned")
+	if img, err := LoadImage(h, unsigned.UUID); err != nil {
+		t.Fatal(err)
+	} else if img.Signature != nil || img.SignedBy() != "unsigned" {
+		t.Errorf("unexpected signature %#v", img.Signature)
+	}
+
+	signed := saveTestImage(t, h, "example.com/signed")
+	signed.Signature = &ImageSignature{Fingerprint: "0123 4567", Signer: "Jane <jane@example.com>", Verified: time.Now()}
+	if bb, err := json.Marshal(signed); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(signed.Path("metadata"), bb, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := LoadImage(h, signed.UUID); err != nil {
+		t.Fatal(err)
+	} else if img.Signature == nil || img.SignedBy() != "Jane <jane@example.com>" || img.Signature.Fingerprint != "0123 4567" {
+		t.Errorf("unexpected signature %#v", img.Signature)
+	}
+}
+
+func testImageACI(t *testing.T, name string) []byte {
+	im := schema.BlankImageManifest()
+	im.Name = *types.MustACIdentifier(name)
+	manifest, err := json.Marshal(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.WriteHeader(&tar.Header{Name: "rootfs/", Typeflag: tar.TypeDir, Mode: 0755})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportImage(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	configProperties.Set("allow.no-signature", "on")
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	allow := ImageOptions{AllowUnsigned: true}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image ID is known only once the rootfs is extracted, into a
+	// dataset this host can't create; failed imports leave nothing
+	// behind
+	aci := testImageACI(t, "example.com/test")
+	existing := saveTestImage(t, h, "example.com/test")
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write(aci)
+	gzw.Close()
+	if _, err := h.ImportImage(io.MultiReader(&gz), &ImportOptions{ImageOptions: allow}); err == nil {
+		t.Error("stream: expected error")
+	}
+
+	aciPath := filepath.Join(tmp, "test.aci")
+	ioutil.WriteFile(aciPath, aci, 0644)
+	for _, c := range []struct {
+		path string
+		opts *ImportOptions
+	}{
+		{filepath.Join(tmp, "no-such.aci"), nil},
+		{h.Path("images", existing.UUID.String(), "manifest"), &ImportOptions{ImageOptions: allow}},
+		{aciPath, &ImportOptions{ImageOptions: allow, Name: "example.com/other"}},
+		{aciPath, &ImportOptions{ImageOptions: allow}},
+		{aciPath, nil},
+	} {
+		if _, err := h.ImportImageFile(c.path, c.opts); err == nil {
+			t.Errorf("%v: expected error", c.path)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(h.Path("images")); len(entries) != 2 {
+		t.Errorf("images/ has %d entries, expected the existing image and its hash", len(entries))
+	}
+
+	// Already imported image is returned, and the new one is aborted
+	fh, _, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	existing = saveTestImage(t, fh, "example.com/test")
+	os.Remove(fh.Path("images", existing.Hash.String()))
+	if err := os.Symlink(existing.UUID.String(), fh.Path("images", fmt.Sprintf("sha512-%x", sha512.Sum512(aci)))); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := fh.ImportImageFile(aciPath, &ImportOptions{ImageOptions: allow}); err != nil {
+		t.Error(err)
+	} else if !uuid.Equal(img.UUID, existing.UUID) {
+		t.Errorf("imported %v, expected existing %v", img.UUID, existing.UUID)
+	}
+	if entries, _ := ioutil.ReadDir(fh.Path("images")); len(entries) != 2 {
+		t.Errorf("images/ has %d entries, expected the existing image and its hash", len(entries))
+	}
+}
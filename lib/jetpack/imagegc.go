@@ -0,0 +1,357 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/juju/errors"
+)
+
+// Image GC destroys images that no pod needs, unlike Prune without
+// touching pods. An image is needed if a pod runs it, and so are its
+// dependencies, their dependencies, and so on. Images that are kept
+// for another reason (a keep annotation, a tag pinned by
+// gc.pinned-tags, or being imported or used more recently than
+// gc.image-min-age) keep their dependencies too. Images are destroyed
+// after images that depend on them, and after images whose rootfs has
+// been cloned from theirs (e.g. from shared rendered dependencies), so
+// that no promotion is needed when both go. If a kept dataset is a
+// clone of a destroyed image, it's promoted (see releaseDependencies).
+
+// Options of GCImages
+type ImageGCOptions struct {
+	DryRun bool          // only report what would be destroyed
+	MinAge time.Duration // negative: gc.image-min-age
+}
+
+// Image destroyed (or, in dry run, destroyable) by GCImages
+type ImageGCItem struct {
+	Hash  types.Hash
+	Name  string // image's name with labels
+	Bytes uint64 // disk space destroying the image frees
+}
+
+type ImageGCReport struct {
+	DryRun bool
+	Images []ImageGCItem
+	Bytes  uint64   // total of images' disk space
+	Kept   []string // images kept although no pod needs them, with the reason
+}
+
+// Image kept although no pod needs it
+type keptImage struct {
+	img    *Image
+	reason string
+}
+
+// Tags that keep their images from GC: NAME[:VERSION][,LABEL=VALUE...],
+// with NAME a pattern (as path.Match, but `*` matches slashes too),
+// e.g. "*:stable".
+type pinnedTag struct {
+	name   string
+	labels types.Labels
+}
+
+// Parses gc.pinned-tags: pinned tags separated by whitespace.
+func parsePinnedTags(str string) ([]pinnedTag, error) {
+	var rv []pinnedTag
+	for _, field := range strings.Fields(str) {
+		var pt pinnedTag
+		pt.name = field
+		rest := ""
+		if i := strings.IndexAny(field, ":,"); i >= 0 {
+			pt.name, rest = field[:i], field[i:]
+		}
+		if _, err := path.Match(pt.name, ""); err != nil || pt.name == "" {
+			return nil, errors.Errorf("Invalid pinned tag %#v", field)
+		}
+		if strings.HasPrefix(rest, ":") {
+			version := strings.SplitN(rest[1:], ",", 2)
+			pt.labels = append(pt.labels, types.Label{Name: "version", Value: version[0]})
+			rest = ""
+			if len(version) > 1 {
+				rest = "," + version[1]
+			}
+		}
+		for _, label := range strings.Split(strings.TrimPrefix(rest, ","), ",") {
+			if label == "" {
+				continue
+			}
+			pieces := strings.SplitN(label, "=", 2)
+			name, err := types.NewACIdentifier(pieces[0])
+			if len(pieces) != 2 || err != nil {
+				return nil, errors.Errorf("Invalid pinned tag %#v", field)
+			}
+			pt.labels = append(pt.labels, types.Label{Name: *name, Value: pieces[1]})
+		}
+		rv = append(rv, pt)
+	}
+	return rv, nil
+}
+
+func validatePinnedTags(name, value string) error {
+	_, err := parsePinnedTags(value)
+	return errors.Annotate(err, name)
+}
+
+func (pt pinnedTag) matches(tag ImageTag) bool {
+	// Slashes are not separators in names
+	pattern := strings.Replace(pt.name, "/", "|", -1)
+	if ok, _ := path.Match(pattern, strings.Replace(tag.Name.String(), "/", "|", -1)); !ok {
+		return false
+	}
+	for _, label := range pt.labels {
+		if v, ok := tag.Labels.Get(label.Name.String()); !ok || v != label.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns images that can be destroyed, in order, and images that are
+// kept only because keep returned a reason. origins maps an image to
+// the image its rootfs is cloned from.
+func planImageGC(imgs []*Image, pods []*Pod, keep func(*Image) string, origins map[types.Hash]types.Hash) (gc []*Image, kept []keptImage) {
+	byHash := make(map[types.Hash]*Image)
+	for _, img := range imgs {
+		if img.Hash != nil {
+			byHash[*img.Hash] = img
+		}
+	}
+
+	needed := make(map[types.Hash]bool)
+	var need func(types.Hash)
+	need = func(hash types.Hash) {
+		if needed[hash] {
+			return
+		}
+		needed[hash] = true
+		if img := byHash[hash]; img != nil {
+			for _, dep := range img.Manifest.Dependencies {
+				if dep.ImageID != nil {
+					need(*dep.ImageID)
+				}
+			}
+		}
+	}
+	for _, pod := range pods {
+		for _, app := range pod.Manifest.Apps {
+			need(app.Image.ID)
+		}
+	}
+	podsNeed := make(map[types.Hash]bool, len(needed))
+	for hash := range needed {
+		podsNeed[hash] = true
+	}
+	for _, img := range imgs {
+		if img.Hash == nil {
+			continue
+		}
+		if reason := keep(img); reason != "" {
+			if !podsNeed[*img.Hash] {
+				kept = append(kept, keptImage{img, reason})
+			}
+			need(*img.Hash)
+		}
+	}
+
+	// Destroy dependants before their dependencies, and clones before
+	// their origins. A promotion can make an image a clone of its own
+	// dependant; then clones are ordered by dependencies only, and
+	// Destroy promotes them.
+	dependencies := func(img *Image) []types.Hash {
+		var rv []types.Hash
+		for _, dep := range img.Manifest.Dependencies {
+			if dep.ImageID != nil {
+				rv = append(rv, *dep.ImageID)
+			}
+		}
+		return rv
+	}
+	gc = orderImageGC(imgs, needed, func(img *Image) []types.Hash {
+		if origin, ok := origins[*img.Hash]; ok {
+			return append(dependencies(img), origin)
+		}
+		return dependencies(img)
+	})
+	unneeded := 0
+	for _, img := range imgs {
+		if img.Hash != nil && !needed[*img.Hash] {
+			unneeded++
+		}
+	}
+	if len(gc) < unneeded {
+		gc = orderImageGC(imgs, needed, dependencies)
+	}
+	return gc, kept
+}
+
+// Returns images that are not needed, each after all images that have
+// it among their parents.
+func orderImageGC(imgs []*Image, needed map[types.Hash]bool, parents func(*Image) []types.Hash) []*Image {
+	var rv []*Image
+	dependants := make(map[types.Hash]int)
+	for _, img := range imgs {
+		if img.Hash == nil || needed[*img.Hash] {
+			continue
+		}
+		for _, parent := range parents(img) {
+			dependants[parent]++
+		}
+	}
+	done := make(map[types.Hash]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, img := range imgs {
+			if img.Hash == nil || needed[*img.Hash] || done[*img.Hash] || dependants[*img.Hash] > 0 {
+				continue
+			}
+			rv = append(rv, img)
+			done[*img.Hash] = true
+			progress = true
+			for _, parent := range parents(img) {
+				dependants[parent]--
+			}
+		}
+	}
+	return rv
+}
+
+// Returns images' origins: for each image whose rootfs is a clone of
+// another image's snapshot, the image it's cloned from.
+func (h *Host) imageOrigins(imgs []*Image) (map[types.Hash]types.Hash, error) {
+	imagesDs := h.Dataset.ChildName("images")
+	dss, err := h.datasets().Children(imagesDs, 1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	byUUID := make(map[string]*Image, len(imgs))
+	for _, img := range imgs {
+		byUUID[img.UUID.String()] = img
+	}
+	rv := make(map[types.Hash]types.Hash)
+	for _, ds := range dss {
+		img := byUUID[path.Base(ds.Name)]
+		pieces := strings.SplitN(ds.Origin, "@", 2)
+		if img == nil || img.Hash == nil || len(pieces) != 2 || path.Dir(pieces[0]) != imagesDs {
+			continue
+		}
+		if origin := byUUID[path.Base(pieces[0])]; origin != nil && origin.Hash != nil && origin != img {
+			rv[*img.Hash] = *origin.Hash
+		}
+	}
+	return rv, nil
+}
+
+// Returns the later of image's import and its last use by a pod.
+func (img *Image) lastActivity() time.Time {
+	if fi, err := os.Stat(img.Path("last-used")); err == nil && fi.ModTime().After(img.Timestamp) {
+		return fi.ModTime()
+	}
+	return img.Timestamp
+}
+
+// Loads images listed by ListImages, for GC and prune, with space
+// destroying each one frees, by UUID.
+func (h *Host) gcImages() ([]*Image, map[string]uint64, error) {
+	iss, err := h.ListImages(nil)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	imgs := make([]*Image, 0, len(iss))
+	freed := make(map[string]uint64, len(iss))
+	for _, is := range iss {
+		img, err := is.Image()
+		if err != nil {
+			h.log().Warnf("images/%v: %v", is.UUID, err)
+			continue
+		}
+		imgs = append(imgs, img)
+		if is.Unique >= 0 {
+			freed[img.UUID.String()] = uint64(is.Unique)
+		} else {
+			du, _ := img.DiskUsage()
+			freed[img.UUID.String()] = du.Used
+		}
+	}
+	return imgs, freed, nil
+}
+
+// Destroys images that no pod needs (see planImageGC). Errors don't
+// stop GC; they are returned together with the report.
+func (h *Host) GCImages(opts *ImageGCOptions) (*ImageGCReport, error) {
+	if opts == nil {
+		opts = &ImageGCOptions{MinAge: -1}
+	}
+	gs := h.settings().GC
+	minAge := opts.MinAge
+	if minAge < 0 {
+		minAge = gs.ImageMinAge
+	}
+	pinned := gs.PinnedTags
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	imgs, freedBy, err := h.gcImages()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tags, err := h.imageTags()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pinnedBy := make(map[types.Hash]ImageTag)
+	for _, tag := range tags {
+		for _, pt := range pinned {
+			if pt.matches(tag) {
+				pinnedBy[tag.Image] = tag
+			}
+		}
+	}
+	origins, err := h.imageOrigins(imgs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	gc, kept := planImageGC(imgs, h.Pods(), func(img *Image) string {
+		switch {
+		case hasKeepAnnotation(img.Manifest.Annotations):
+			return keepAnnotation + " annotation"
+		case pinnedBy[*img.Hash].Name != "":
+			return fmt.Sprintf("pinned tag %v", pinnedBy[*img.Hash])
+		case minAge > 0 && time.Since(img.lastActivity()) < minAge:
+			return fmt.Sprintf("used within %v", minAge)
+		}
+		return ""
+	}, origins)
+
+	rep := &ImageGCReport{DryRun: opts.DryRun}
+	for _, ki := range kept {
+		rep.Kept = append(rep.Kept, fmt.Sprintf("%v (%v)", ki.img.Hash, ki.reason))
+	}
+	var erv error
+	for _, img := range gc {
+		freed := freedBy[img.UUID.String()]
+		if !opts.DryRun {
+			if err := img.Destroy(); err != nil {
+				erv = multierror.Append(erv, errors.Annotatef(err, "Image %v", img.Hash))
+				continue
+			}
+		}
+		rep.Images = append(rep.Images, ImageGCItem{Hash: *img.Hash, Name: img.String(), Bytes: freed})
+		rep.Bytes += freed
+	}
+	if !opts.DryRun {
+		h.log().Infof("image GC destroyed %d images, %d bytes", len(rep.Images), rep.Bytes)
+	}
+	return rep, erv
+}
@@ -0,0 +1,143 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestPlanImageGC(t *testing.T) {
+	imgs := []*Image{
+		testImage(t, "0a", false),       // base of a running image
+		testImage(t, "1a", false, "0a"), // run by a pod
+		testImage(t, "0b", false),       // origin of 1c's rendered dependencies
+		testImage(t, "1b", false, "0b"), // pinned
+		testImage(t, "1c", false, "0c"), // cloned from 0b
+		testImage(t, "0c", false),
+		testImage(t, "2c", false, "1c"),
+	}
+	hash := func(s string) types.Hash {
+		h, _ := types.NewHash("sha512-" + s)
+		return *h
+	}
+	origins := map[types.Hash]types.Hash{hash("1c"): hash("0b")}
+	keep := func(img *Image) string {
+		if img.Hash.Val == "1b" {
+			return "pinned tag example.com/app:stable"
+		}
+		return ""
+	}
+
+	gc, kept := planImageGC(imgs, []*Pod{testPodRunning("1a")}, keep, origins)
+	if expected := []string{"2c", "1c", "0c"}; !reflect.DeepEqual(imageHashes(gc), expected) {
+		t.Errorf("Expected GC of %v, got %v", expected, imageHashes(gc))
+	}
+	if len(kept) != 1 || kept[0].img.Hash.Val != "1b" {
+		t.Errorf("Unexpected kept images %v", kept)
+	}
+
+	// Clones go before their origins
+	gc, _ = planImageGC(imgs, []*Pod{testPodRunning("1a")}, func(*Image) string { return "" }, origins)
+	if expected := []string{"1b", "2c", "1c", "0c", "0b"}; !reflect.DeepEqual(imageHashes(gc), expected) {
+		t.Errorf("Expected GC of %v, got %v", expected, imageHashes(gc))
+	}
+
+	// Origin that depends on its clone: ordered by dependencies only
+	origins[hash("0c")] = hash("1c")
+	gc, _ = planImageGC(imgs, nil, func(*Image) string { return "" }, origins)
+	if len(gc) != len(imgs) {
+		t.Errorf("Cycle left images out: %v", imageHashes(gc))
+	}
+}
+
+func TestPinnedTags(t *testing.T) {
+	pinned, err := parsePinnedTags("*:stable  example.com/db,channel=lts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := func(name string, labels ...string) ImageTag {
+		tag := ImageTag{Name: types.ACIdentifier(name)}
+		for i := 0; i < len(labels); i += 2 {
+			tag.Labels = append(tag.Labels, types.Label{Name: types.ACIdentifier(labels[i]), Value: labels[i+1]})
+		}
+		return tag
+	}
+	for _, c := range []struct {
+		tag      ImageTag
+		expected bool
+	}{
+		{tag("example.com/app", "version", "stable"), true},
+		{tag("example.com/app", "version", "1.0"), false},
+		{tag("example.com/db", "channel", "lts", "version", "9.6"), true},
+		{tag("example.com/db"), false},
+	} {
+		matches := false
+		for _, pt := range pinned {
+			matches = matches || pt.matches(c.tag)
+		}
+		if matches != c.expected {
+			t.Errorf("%v: expected %v", c.tag, c.expected)
+		}
+	}
+
+	for _, invalid := range []string{":stable", "example.com/app,channel", "[:stable"} {
+		if _, err := parsePinnedTags(invalid); err == nil {
+			t.Errorf("%#v accepted", invalid)
+		}
+	}
+}
+
+func TestGCImagesFakeZFS(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	// app's rootfs is cloned from base's; a pod's rootfs is cloned
+	// from app's, and keeps it after GC
+	base := saveTestImage(t, h, "example.com/base")
+	app := saveTestImage(t, h, "example.com/app")
+	baseDs, appDs := h.Dataset.ChildName("images/"+base.UUID.String()), h.Dataset.ChildName("images/"+app.UUID.String())
+	if _, err := f.CreateDataset(baseDs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Snapshot(baseDs, imageSnapshotName, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Clone(baseDs+"@"+imageSnapshotName, appDs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Snapshot(appDs, imageSnapshotName, nil); err != nil {
+		t.Fatal(err)
+	}
+	pod := fakeZFSPod(t, h, f)
+	podRootfs := h.Dataset.ChildName("pods/" + pod.UUID.String() + "/rootfs.1")
+	if _, err := f.Clone(appDs+"@"+imageSnapshotName, podRootfs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Ops = nil
+	rep, err := h.GCImages(&ImageGCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Images) != 2 || rep.Images[0].Hash != *app.Hash || rep.Images[1].Hash != *base.Hash {
+		t.Errorf("Unexpected GC report: %v", rep.Images)
+	}
+	// Promoted rootfs becomes a clone of base, and takes over its
+	// snapshot too, under another name
+	expected := []string{
+		"promote " + podRootfs,
+		"destroy -r " + appDs,
+		"rename " + baseDs + "@seal " + baseDs + "@seal-" + base.UUID.String(),
+		"promote " + podRootfs,
+		"destroy -r " + baseDs,
+	}
+	if !reflect.DeepEqual(f.Ops, expected) {
+		t.Errorf("Expected operations %q, got %q", expected, f.Ops)
+	}
+	if !f.Exists(podRootfs+"@"+imageSnapshotName) || !f.Exists(podRootfs+"@seal-"+base.UUID.String()) {
+		t.Errorf("Pod's rootfs lost the snapshots: %v", f.Names())
+	}
+}
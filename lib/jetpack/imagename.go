@@ -0,0 +1,221 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/coreos/go-semver/semver"
+	"github.com/juju/errors"
+)
+
+// Images are found by name the way discovery finds them: an image
+// matches if it has a tag with the name and all the given labels (see
+// ImageTag). If os or arch label is not given, images for the host's
+// native platform (or without the label) are preferred to others. If
+// version is not given, the latest image is selected: semantic
+// versions of images (with an optional "v" prefix) are ordered as
+// such, and are later than any other version; images with the same
+// version, or without a semantic one, are ordered by the time they
+// were imported. When this leaves
+// more than one image, the name is ambiguous.
+
+const hashPrefix = "sha512-"
+
+var hexRegexp = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// Returned when several images match a name and labels, or an ID
+// prefix; its cause is ErrManyFound.
+type AmbiguousImageError struct {
+	Query      string // name with labels, or ID prefix
+	Candidates []*Image
+}
+
+func (e *AmbiguousImageError) Error() string {
+	candidates := make([]string, len(e.Candidates))
+	for i, img := range e.Candidates {
+		candidates[i] = fmt.Sprintf("%v %v", img, img.ID())
+	}
+	return fmt.Sprintf("Image %v is ambiguous: %v", e.Query, strings.Join(candidates, "; "))
+}
+
+func (e *AmbiguousImageError) Cause() error {
+	return ErrManyFound
+}
+
+// Returns stored image with name and labels. Returns ErrNotFound if
+// there is none, and AmbiguousImageError if there are several.
+func (h *Host) GetImageByName(name types.ACIdentifier, labels types.Labels) (*Image, error) {
+	if name.Empty() {
+		return nil, errors.Trace(ErrUsage)
+	}
+	return h.GetLocalImage(types.Hash{}, name, labels)
+}
+
+// Returns stored image whose ID is id, or starts with it; id may be
+// given with or without the "sha512-" scheme. Returns ErrNotFound if
+// no image matches, and AmbiguousImageError if several do.
+func (h *Host) GetImageByHash(id string) (*Image, error) {
+	id = strings.ToLower(id)
+	if !strings.HasPrefix(id, hashPrefix) {
+		id = hashPrefix + id
+	}
+	hash, err := types.NewHash(id)
+	if err != nil {
+		return nil, errors.Annotatef(ErrUsage, "Invalid image ID %#v", id)
+	}
+	return h.GetLocalImage(*hash, "", nil)
+}
+
+// Returns full hash of the stored image whose ID is prefix's, or
+// starts with it. Prefix is matched against the images/ hash symlinks,
+// so only the matching images are loaded. Returns ErrNotFound if no
+// image matches, and AmbiguousImageError if several do.
+func (h *Host) resolveImageHash(prefix types.Hash) (types.Hash, error) {
+	if !strings.HasPrefix(prefix.String(), hashPrefix) || !hexRegexp.MatchString(prefix.Val) {
+		return types.Hash{}, errors.Annotatef(ErrUsage, "Invalid image ID %#v", prefix.String())
+	}
+	if _, err := os.Lstat(h.Path("images", prefix.String())); err == nil {
+		return prefix, nil
+	}
+	dir, err := os.Open(h.Path("images"))
+	if os.IsNotExist(err) {
+		return types.Hash{}, ErrNotFound
+	} else if err != nil {
+		return types.Hash{}, errors.Trace(err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return types.Hash{}, errors.Trace(err)
+	}
+	var matches []types.Hash
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix.String()) {
+			if hash, err := types.NewHash(name); err == nil {
+				matches = append(matches, *hash)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return types.Hash{}, ErrNotFound
+	case 1:
+		return matches[0], nil
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].String() < matches[j].String() })
+	candidates := make([]*Image, len(matches))
+	for i, hash := range matches {
+		if candidates[i], err = h.getLocalImage(hash, "", nil); err != nil {
+			return types.Hash{}, errors.Trace(err)
+		}
+	}
+	return types.Hash{}, &AmbiguousImageError{Query: prefix.String(), Candidates: candidates}
+}
+
+// Image with one of its tags
+type taggedImage struct {
+	Tag   ImageTag
+	Image *Image
+}
+
+// Selects image tagged with name and labels.
+func selectImage(tagged []taggedImage, name types.ACIdentifier, labels types.Labels) (*Image, error) {
+	var candidates []*Image
+	seen := make(map[*Image]bool)
+	for _, ti := range tagged {
+		if !seen[ti.Image] && tagMatches(ti.Tag, ti.Image, name, labels) {
+			candidates = append(candidates, ti.Image)
+			seen[ti.Image] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNotFound
+	}
+
+	given := labels.ToMap()
+	if _, ok := given["os"]; !ok {
+		candidates = preferImages(candidates, func(img *Image) bool {
+			os_, ok := img.Manifest.GetLabel("os")
+			return !ok || os_ == runtime.GOOS
+		})
+	}
+	if _, ok := given["arch"]; !ok {
+		candidates = preferImages(candidates, func(img *Image) bool {
+			arch, ok := img.Manifest.GetLabel("arch")
+			if alias, isAlias := archAliases[arch]; isAlias {
+				arch = alias
+			}
+			return !ok || arch == runtime.GOARCH
+		})
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	if _, ok := given["version"]; !ok {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return compareImageVersions(candidates[i], candidates[j]) > 0
+		})
+		if compareImageVersions(candidates[0], candidates[1]) != 0 {
+			return candidates[0], nil
+		}
+	}
+	query := name.String()
+	for _, label := range labels {
+		query += fmt.Sprintf(",%v=%v", label.Name, label.Value)
+	}
+	return nil, &AmbiguousImageError{Query: query, Candidates: candidates}
+}
+
+// Returns images for which pred is true, or all images if it is
+// false for all of them.
+func preferImages(imgs []*Image, pred func(*Image) bool) []*Image {
+	var rv []*Image
+	for _, img := range imgs {
+		if pred(img) {
+			rv = append(rv, img)
+		}
+	}
+	if len(rv) == 0 {
+		return imgs
+	}
+	return rv
+}
+
+func imageSemver(img *Image) *semver.Version {
+	if version, ok := img.Manifest.GetLabel("version"); ok {
+		if v, err := semver.NewVersion(strings.TrimPrefix(version, "v")); err == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// Returns positive number if a is later than b, negative if it's
+// earlier, and zero if neither is.
+func compareImageVersions(a, b *Image) int {
+	va, vb := imageSemver(a), imageSemver(b)
+	switch {
+	case va != nil && vb == nil:
+		return 1
+	case va == nil && vb != nil:
+		return -1
+	case va != nil && vb != nil:
+		if c := va.Compare(*vb); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a.Timestamp.After(b.Timestamp):
+		return 1
+	case a.Timestamp.Before(b.Timestamp):
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func testNamedImage(name string, imported time.Time, labels ...string) *Image {
+	img := NewImage(nil, nil)
+	img.Manifest.Name = *types.MustACIdentifier(name)
+	img.Timestamp = imported
+	for i := 0; i < len(labels); i += 2 {
+		img.Manifest.Labels = append(img.Manifest.Labels, types.Label{Name: types.ACIdentifier(labels[i]), Value: labels[i+1]})
+	}
+	return img
+}
+
+// Tags images with their manifests' names and labels.
+func manifestTagged(imgs ...*Image) []taggedImage {
+	rv := make([]taggedImage, len(imgs))
+	for i, img := range imgs {
+		labels, _ := tagLabels(img.Manifest.Labels)
+		rv[i] = taggedImage{ImageTag{Name: img.Manifest.Name, Labels: labels}, img}
+	}
+	return rv
+}
+
+func TestSelectImage(t *testing.T) {
+	t0 := time.Now()
+	v1 := testNamedImage("example.com/app", t0.Add(2*time.Hour), "version", "1.2.0")
+	v10 := testNamedImage("example.com/app", t0, "version", "v1.10.0")
+	latest := testNamedImage("example.com/app", t0.Add(3*time.Hour), "version", "latest")
+	foreign := testNamedImage("example.com/app", t0.Add(4*time.Hour), "version", "2.0.0", "arch", "not-"+runtime.GOARCH)
+	other := testNamedImage("example.com/other", t0)
+	imgs := []*Image{v1, v10, latest, foreign, other}
+
+	for _, c := range []struct {
+		name     types.ACIdentifier
+		labels   types.Labels
+		expected *Image
+		err      error
+	}{
+		{"example.com/app", nil, v10, nil},
+		{"example.com/app", types.Labels{{Name: "version", Value: "1.2.0"}}, v1, nil},
+		{"example.com/app", types.Labels{{Name: "version", Value: "latest"}}, latest, nil},
+		{"example.com/app", types.Labels{{Name: "arch", Value: "not-" + runtime.GOARCH}}, foreign, nil},
+		{"example.com/app", types.Labels{{Name: "version", Value: "3.0"}}, nil, ErrNotFound},
+		{"example.com/none", nil, nil, ErrNotFound},
+		{"example.com/other", nil, other, nil},
+	} {
+		img, err := selectImage(manifestTagged(imgs...), c.name, c.labels)
+		if errors.Cause(err) != c.err {
+			t.Errorf("%v %v: expected error %v, got %v", c.name, c.labels, c.err, err)
+		} else if img != c.expected {
+			t.Errorf("%v %v: selected %v, expected %v", c.name, c.labels, img, c.expected)
+		}
+	}
+
+	// Without semantic versions, the latest import wins
+	a := testNamedImage("example.com/nover", t0)
+	b := testNamedImage("example.com/nover", t0.Add(time.Minute))
+	if img, err := selectImage(manifestTagged(b, a), "example.com/nover", nil); err != nil || img != b {
+		t.Errorf("selected %v (%v), expected %v", img, err, b)
+	}
+
+	// Ties are ambiguous
+	c := testNamedImage("example.com/nover", t0.Add(time.Minute))
+	_, err := selectImage(manifestTagged(a, b, c), "example.com/nover", nil)
+	if aerr, ok := err.(*AmbiguousImageError); !ok {
+		t.Errorf("expected ambiguous image, got %v", err)
+	} else if len(aerr.Candidates) != 3 || errors.Cause(aerr) != ErrManyFound {
+		t.Errorf("unexpected error %#v", aerr)
+	}
+	v1b := testNamedImage("example.com/app", t0, "version", "1.2.0")
+	if _, err := selectImage(manifestTagged(v1, v1b), "example.com/app", types.Labels{{Name: "version", Value: "1.2.0"}}); errors.Cause(err) != ErrManyFound {
+		t.Errorf("expected ambiguous image, got %v", err)
+	}
+}
+
+func TestGetImageByHash(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// More images than hex digits: some share the first one
+	byFirst := make(map[byte][]*Image)
+	for c := 'a'; c <= 'z'; c++ {
+		img := saveTestImage(t, h, "example.com/"+string(c))
+		hex := strings.TrimPrefix(img.Hash.String(), "sha512-")
+		byFirst[hex[0]] = append(byFirst[hex[0]], img)
+
+		for _, prefix := range []string{hex[:20], "sha512-" + hex[:20], strings.ToUpper(hex[:20])} {
+			if found, err := h.GetImageByHash(prefix); err != nil {
+				t.Errorf("%v: %v", prefix, err)
+			} else if found.UUID.String() != img.UUID.String() {
+				t.Errorf("%v: found %v, expected %v", prefix, found, img)
+			}
+		}
+		// Every lookup by hash takes prefixes
+		if hash, err := types.NewHash("sha512-" + hex[:20]); err != nil {
+			t.Fatal(err)
+		} else if found, err := h.GetImage(*hash, "", nil); err != nil || found.UUID.String() != img.UUID.String() {
+			t.Errorf("%v: found %v (%v), expected %v", hex[:20], found, err, img)
+		}
+	}
+
+	for first, imgs := range byFirst {
+		_, err := h.GetImageByHash(string(first))
+		if len(imgs) == 1 {
+			if err != nil {
+				t.Errorf("%c: %v", first, err)
+			}
+			continue
+		}
+		if errors.Cause(err) != ErrManyFound {
+			t.Errorf("%c: expected ambiguous image, got %v", first, err)
+		}
+		prefix, _ := types.NewHash("sha512-" + string(first))
+		if _, err := h.resolveImageHash(*prefix); err == nil {
+			t.Errorf("%c: expected ambiguous image", first)
+		} else if aerr, ok := err.(*AmbiguousImageError); !ok {
+			t.Errorf("%c: expected ambiguous image, got %v", first, err)
+		} else if len(aerr.Candidates) != len(imgs) {
+			t.Errorf("%c: candidates %v, expected %v", first, aerr.Candidates, imgs)
+		}
+	}
+	for _, first := range []byte("0123456789abcdef") {
+		if _, ok := byFirst[first]; !ok {
+			if _, err := h.GetImageByHash(string(first)); errors.Cause(err) != ErrNotFound {
+				t.Errorf("%c: expected not found, got %v", first, err)
+			}
+			break
+		}
+	}
+	if _, err := h.GetImageByHash("example"); errors.Cause(err) != ErrUsage {
+		t.Errorf("expected usage error, got %v", err)
+	}
+}
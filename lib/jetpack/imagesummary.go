@@ -0,0 +1,338 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/acutil"
+)
+
+// Image summaries are a cheap way to list images, like pod headers
+// for pods: only name, labels, and dependencies are decoded from the
+// manifest, and images are never loaded in full. Sizes of all images
+// come from a single zfs run (see ImageDiskUsage), and pods are read only if an image
+// matches the filter. An image is referenced if a pod runs it or
+// another image depends on it. Image GC and Prune enumerate images
+// with ListImages too, and take the space destroying one frees from
+// its summary.
+
+type ImageSummary struct {
+	UUID       uuid.UUID
+	Hash       *types.Hash `json:",omitempty"`
+	Name       types.ACIdentifier
+	Labels     types.Labels
+	Tags       []ImageTag      `json:",omitempty"`
+	Imported   time.Time       // image's timestamp
+	LastUsed   time.Time       // last pod created from the image; zero if none
+	Size       int64           // used by image's dataset, or ACI size if no dataset
+	Unique     int64           // space destroying the image frees; -1 if unknown
+	Referenced bool            // a pod runs it, or another image depends on it
+	Signature  *ImageSignature `json:",omitempty"`
+	Import     *ImportSummary  `json:",omitempty"`
+
+	host *Host
+}
+
+// Loads the full image.
+func (is *ImageSummary) Image() (*Image, error) {
+	return LoadImage(is.host, is.UUID)
+}
+
+// Name with labels, as Image.String()
+func (is *ImageSummary) String() string {
+	return imageString(is.Name, is.Labels)
+}
+
+// Image's tags, or "-" if it has none
+func (is *ImageSummary) TagsString() string {
+	if len(is.Tags) == 0 {
+		return "-"
+	}
+	tags := make([]string, len(is.Tags))
+	for i, tag := range is.Tags {
+		tags[i] = tag.String()
+	}
+	return strings.Join(tags, " ")
+}
+
+// Image's os/arch, as Image.OSArch()
+func (is *ImageSummary) OSArch() string {
+	return osArch(is.Labels)
+}
+
+// Signer's identity, as Image.SignedBy()
+func (is *ImageSummary) SignedBy() string {
+	if is.Signature == nil {
+		return "unsigned"
+	}
+	return is.Signature.Signer
+}
+
+// Whether ListImages returns referenced images, unreferenced ones, or
+// both
+type ImageReferenceFilter int
+
+const (
+	AnyImages ImageReferenceFilter = iota
+	ReferencedImages
+	UnreferencedImages
+)
+
+// Orders of ListImages
+type ImageSort int
+
+const (
+	SortImagesByName     ImageSort = iota // newest first within a name
+	SortImagesByImported                  // newest first
+	SortImagesBySize                      // largest first
+)
+
+// Selects images listed by ListImages. Zero values don't filter.
+type ImageFilter struct {
+	Name           string       // pattern of name or of a tag's name (as path.Match)
+	Labels         types.Labels // labels that images need to have
+	ImportedBefore time.Time
+	ImportedAfter  time.Time
+	MinSize        int64
+	Referenced     ImageReferenceFilter
+	Sort           ImageSort
+	Reverse        bool
+}
+
+// Fields of the manifest that summaries need
+type imageSummaryManifest struct {
+	Name         types.ACIdentifier `json:"name"`
+	Labels       types.Labels       `json:"labels"`
+	Dependencies []struct {
+		ImageID *types.Hash `json:"imageID"`
+	} `json:"dependencies"`
+}
+
+// Fields of the metadata that summaries need
+type imageSummaryMetadata struct {
+	Hash      *types.Hash
+	Timestamp time.Time
+	Signature *ImageSignature
+	Import    *ImportSummary
+}
+
+// Returns summaries of images that match filter (all images, if it is
+// nil), in filter's order.
+func (h *Host) ListImages(filter *ImageFilter) ([]*ImageSummary, error) {
+	if filter == nil {
+		filter = &ImageFilter{}
+	}
+	if filter.Name != "" {
+		if _, err := path.Match(filter.Name, ""); err != nil {
+			return nil, errors.Annotatef(err, "Invalid name pattern %#v", filter.Name)
+		}
+	}
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	allTags, err := h.imageTags()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tags := make(map[types.Hash][]ImageTag)
+	for _, tag := range allTags {
+		tags[tag.Image] = append(tags[tag.Image], tag)
+	}
+
+	var candidates []*ImageSummary
+	referenced := make(map[types.Hash]bool)
+	mm, _ := filepath.Glob(h.Path("images/*/metadata"))
+	for _, m := range mm {
+		d := filepath.Dir(m)
+		if fi, err := os.Lstat(d); err != nil || !fi.IsDir() {
+			// Hash symlink
+			continue
+		}
+		id := uuid.Parse(filepath.Base(d))
+		if id == nil {
+			continue
+		}
+		is, deps, err := h.readImageSummary(id)
+		if err != nil {
+			h.log().Warnf("images/%v: %v", id, err)
+			continue
+		}
+		for _, dep := range deps {
+			referenced[dep] = true
+		}
+		if is.Hash != nil {
+			is.Tags = tags[*is.Hash]
+		}
+		if filter.matches(is) {
+			candidates = append(candidates, is)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	pods, err := h.PodHeaders()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, ph := range pods {
+		for _, id := range ph.Images {
+			if hash, err := types.NewHash(id); err == nil {
+				referenced[*hash] = true
+			}
+		}
+	}
+	var sizes map[string]ImageDiskUsage
+	if isu, err := h.ImageDiskUsage(); err == nil {
+		sizes = isu.ByImage
+	} else {
+		h.log().Debugf("image sizes from ACIs: %v", err)
+	}
+
+	rv := make([]*ImageSummary, 0, len(candidates))
+	for _, is := range candidates {
+		is.Referenced = is.Hash != nil && referenced[*is.Hash]
+		is.Unique = -1
+		if du, ok := sizes[is.UUID.String()]; ok {
+			is.Size = int64(du.Used)
+			is.Unique = int64(du.Unique)
+		} else if is.Import != nil && is.Import.Size > 0 {
+			is.Size = is.Import.Size
+		}
+		switch {
+		case filter.Referenced == ReferencedImages && !is.Referenced:
+		case filter.Referenced == UnreferencedImages && is.Referenced:
+		case is.Size < filter.MinSize:
+		default:
+			rv = append(rv, is)
+		}
+	}
+	sortImageSummaries(rv, filter.Sort, filter.Reverse)
+	return rv, nil
+}
+
+// Reads image's summary, without its size and references, and hashes
+// of its dependencies.
+func (h *Host) readImageSummary(id uuid.UUID) (*ImageSummary, []types.Hash, error) {
+	img := NewImage(h, id)
+	var md imageSummaryMetadata
+	if bb, err := ioutil.ReadFile(img.Path("metadata")); err != nil {
+		return nil, nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &md); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var im imageSummaryManifest
+	if bb, err := ioutil.ReadFile(img.Path("manifest")); err != nil {
+		return nil, nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &im); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	is := &ImageSummary{
+		UUID:      id,
+		Hash:      md.Hash,
+		Name:      im.Name,
+		Labels:    im.Labels,
+		Imported:  md.Timestamp,
+		Signature: md.Signature,
+		Import:    md.Import,
+		host:      h,
+	}
+	if fi, err := os.Stat(img.Path("last-used")); err == nil {
+		is.LastUsed = fi.ModTime()
+	}
+	var deps []types.Hash
+	for _, dep := range im.Dependencies {
+		if dep.ImageID != nil {
+			deps = append(deps, *dep.ImageID)
+		}
+	}
+	return is, deps, nil
+}
+
+// Checks filter's fields that don't need size and references.
+func (f *ImageFilter) matches(is *ImageSummary) bool {
+	if !f.ImportedBefore.IsZero() && !is.Imported.Before(f.ImportedBefore) {
+		return false
+	}
+	if !f.ImportedAfter.IsZero() && !is.Imported.After(f.ImportedAfter) {
+		return false
+	}
+	if f.Name != "" && !f.matchesName(is) {
+		return false
+	}
+	return acutil.MatchLabels(f.Labels, is.Labels)
+}
+
+func (f *ImageFilter) matchesName(is *ImageSummary) bool {
+	if ok, _ := path.Match(f.Name, is.Name.String()); ok {
+		return true
+	}
+	for _, tag := range is.Tags {
+		if ok, _ := path.Match(f.Name, tag.Name.String()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func sortImageSummaries(iss []*ImageSummary, by ImageSort, reverse bool) {
+	less := func(a, b *ImageSummary) bool {
+		switch by {
+		case SortImagesBySize:
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		case SortImagesByName:
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+		}
+		if !a.Imported.Equal(b.Imported) {
+			return a.Imported.After(b.Imported)
+		}
+		return a.UUID.String() < b.UUID.String()
+	}
+	sort.Slice(iss, func(i, j int) bool {
+		if reverse {
+			return less(iss[j], iss[i])
+		}
+		return less(iss[i], iss[j])
+	})
+}
+
+// Records that a pod has been created from the image.
+func (img *Image) markUsed() error {
+	now := time.Now()
+	if err := os.Chtimes(img.Path("last-used"), now, now); os.IsNotExist(err) {
+		return errors.Trace(ioutil.WriteFile(img.Path("last-used"), nil, 0440))
+	} else {
+		return errors.Trace(err)
+	}
+}
+
+var imageSortNames = map[string]ImageSort{
+	"name":     SortImagesByName,
+	"imported": SortImagesByImported,
+	"size":     SortImagesBySize,
+}
+
+// Parses image order: "name", "imported", or "size".
+func ParseImageSort(s string) (ImageSort, error) {
+	if by, ok := imageSortNames[s]; ok {
+		return by, nil
+	}
+	return 0, errors.Errorf("Invalid image order %#v (name, imported, or size)", s)
+}
@@ -0,0 +1,102 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestListImages(t *testing.T) {
+	// The pod runs image named "image"
+	h, cleanup := podHeadersTestHost(t, 1)
+	defer cleanup()
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	images := make(map[string]*Image)
+	for i, spec := range []struct {
+		name string
+		size int64
+		deps []string
+	}{
+		{"image", 300, nil},
+		{"example.com/base", 100, nil},
+		{"example.com/app", 200, []string{"example.com/base"}},
+		{"example.com/unused", 50, nil},
+	} {
+		img := saveTestImage(t, h, spec.name)
+		img.Timestamp = now.Add(time.Duration(i) * time.Hour)
+		img.Import = &ImportSummary{Size: spec.size}
+		img.Manifest.Labels = types.Labels{{Name: "os", Value: "freebsd"}}
+		for _, dep := range spec.deps {
+			img.Manifest.Dependencies = append(img.Manifest.Dependencies,
+				types.Dependency{ImageName: *types.MustACIdentifier(dep), ImageID: images[dep].Hash})
+		}
+		for file, v := range map[string]interface{}{"manifest": &img.Manifest, "metadata": img} {
+			if bb, err := json.Marshal(v); err != nil {
+				t.Fatal(err)
+			} else if err := ioutil.WriteFile(img.Path(file), bb, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		images[spec.name] = img
+	}
+
+	for _, tc := range []struct {
+		filter   *ImageFilter
+		expected []string
+	}{
+		{nil, []string{"example.com/app", "example.com/base", "example.com/unused", "image"}},
+		{&ImageFilter{Name: "example.com/*", Sort: SortImagesBySize},
+			[]string{"example.com/app", "example.com/base", "example.com/unused"}},
+		{&ImageFilter{Sort: SortImagesByImported, Reverse: true},
+			[]string{"image", "example.com/base", "example.com/app", "example.com/unused"}},
+		{&ImageFilter{Referenced: ReferencedImages}, []string{"example.com/base", "image"}},
+		{&ImageFilter{Referenced: UnreferencedImages}, []string{"example.com/app", "example.com/unused"}},
+		{&ImageFilter{ImportedAfter: now, ImportedBefore: now.Add(3 * time.Hour)},
+			[]string{"example.com/app", "example.com/base"}},
+		{&ImageFilter{MinSize: 150, Sort: SortImagesBySize}, []string{"image", "example.com/app"}},
+		{&ImageFilter{Labels: types.Labels{{Name: "os", Value: "linux"}}}, nil},
+	} {
+		iss, err := h.ListImages(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, is := range iss {
+			names = append(names, is.Name.String())
+		}
+		if len(names) != len(tc.expected) {
+			t.Errorf("%+v: listed %v, expected %v", tc.filter, names, tc.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.expected[i] {
+				t.Errorf("%+v: listed %v, expected %v", tc.filter, names, tc.expected)
+				break
+			}
+		}
+	}
+
+	if _, err := h.ListImages(&ImageFilter{Name: "["}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+
+	// Last use is recorded
+	if err := images["image"].markUsed(); err != nil {
+		t.Fatal(err)
+	}
+	iss, err := h.ListImages(&ImageFilter{Name: "image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iss) != 1 || iss[0].LastUsed.IsZero() || iss[0].Size != 300 || !iss[0].Referenced {
+		t.Errorf("summary: %+v", iss)
+	}
+}
@@ -0,0 +1,282 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/acutil"
+)
+
+// Image tags name images: the tag index (images/tags.json) maps a name
+// with labels to an image's ID, and images are found by name through
+// it. An image can have any number of tags; a name with labels tags
+// one image at most, so tagging another image with it moves the tag.
+// A tag's labels override the image's labels of the same names; other
+// labels of the image (e.g. os and arch) still match. Imported images
+// are tagged with their manifest's name and labels. An image with no
+// tags left stays in the store, and can be found only by its ID.
+// Hosts without an index get one made of their images' manifests, the
+// latest import winning, on the first change.
+
+type ImageTag struct {
+	Name   types.ACIdentifier `json:"name"`
+	Labels types.Labels       `json:"labels,omitempty"` // sorted by name
+	Image  types.Hash         `json:"image"`
+}
+
+// Name with labels, as Image.String()
+func (t ImageTag) String() string {
+	return imageString(t.Name, t.Labels)
+}
+
+// Returns the tag's labels together with other labels of its image.
+func (t ImageTag) imageLabels(labels types.Labels) types.Labels {
+	rv := append(types.Labels(nil), t.Labels...)
+	for _, label := range labels {
+		if _, ok := t.Labels.Get(label.Name.String()); !ok {
+			rv = append(rv, label)
+		}
+	}
+	return rv
+}
+
+// Whether tag has exactly name and (sorted) labels.
+func (t ImageTag) is(name types.ACIdentifier, labels types.Labels) bool {
+	if t.Name != name || len(t.Labels) != len(labels) {
+		return false
+	}
+	for i, label := range labels {
+		if t.Labels[i] != label {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns labels sorted by name. Returns ErrUsage if a label is given
+// twice.
+func tagLabels(labels types.Labels) (types.Labels, error) {
+	rv := append(types.Labels(nil), labels...)
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	for i := 1; i < len(rv); i++ {
+		if rv[i].Name == rv[i-1].Name {
+			return nil, errors.Annotatef(ErrUsage, "Label %v given twice", rv[i].Name)
+		}
+	}
+	return rv, nil
+}
+
+// Returns tags with tag added, and removes the name and labels from
+// the image they tagged before.
+func addImageTag(tags []ImageTag, tag ImageTag) []ImageTag {
+	rv := make([]ImageTag, 0, len(tags)+1)
+	for _, t := range tags {
+		if !t.is(tag.Name, tag.Labels) {
+			rv = append(rv, t)
+		}
+	}
+	return append(rv, tag)
+}
+
+func (h *Host) imageTagsPath() string {
+	return h.Path("images", "tags.json")
+}
+
+// Returns all image tags.
+func (h *Host) ImageTags() ([]ImageTag, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	return h.imageTags()
+}
+
+func (h *Host) imageTags() ([]ImageTag, error) {
+	bb, err := ioutil.ReadFile(h.imageTagsPath())
+	if os.IsNotExist(err) {
+		return h.manifestTags()
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var tags []ImageTag
+	if err := json.Unmarshal(bb, &tags); err != nil {
+		return nil, errors.Annotate(err, "Image tags")
+	}
+	return tags, nil
+}
+
+// Returns tags made of manifests of stored images.
+func (h *Host) manifestTags() ([]ImageTag, error) {
+	imgs, err := h.Images()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.SliceStable(imgs, func(i, j int) bool { return imgs[i].Timestamp.Before(imgs[j].Timestamp) })
+	var tags []ImageTag
+	for _, img := range imgs {
+		if img.Hash == nil || img.Manifest.Name.Empty() {
+			continue
+		}
+		labels, err := tagLabels(img.Manifest.Labels)
+		if err != nil {
+			h.log().Warnf("Not tagging %v: %v", img.Hash, err)
+			continue
+		}
+		tags = addImageTag(tags, ImageTag{Name: img.Manifest.Name, Labels: labels, Image: *img.Hash})
+	}
+	return tags, nil
+}
+
+// Replaces the tag index. Needs exclusive host lock.
+func (h *Host) saveImageTags(tags []ImageTag) error {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Name != tags[j].Name {
+			return tags[i].Name < tags[j].Name
+		}
+		return tags[i].String() < tags[j].String()
+	})
+	if tags == nil {
+		tags = []ImageTag{}
+	}
+	bb, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := h.imageTagsPath() + ".new"
+	if err := ioutil.WriteFile(tmp, bb, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, h.imageTagsPath()))
+}
+
+// Changes the tag index with modify under exclusive host lock.
+func (h *Host) updateImageTags(modify func([]ImageTag) ([]ImageTag, error)) error {
+	h.tagsMx.Lock()
+	defer h.tagsMx.Unlock()
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
+	tags, err := h.imageTags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if tags, err = modify(tags); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(h.saveImageTags(tags))
+}
+
+// Tags image with name and labels. If another image had this tag, the
+// tag is moved.
+func (h *Host) TagImage(hash types.Hash, name types.ACIdentifier, labels types.Labels) error {
+	if name.Empty() {
+		return errors.Annotate(ErrUsage, "Tag needs a name")
+	}
+	labels, err := tagLabels(labels)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tag := ImageTag{Name: name, Labels: labels, Image: hash}
+	err = h.updateImageTags(func(tags []ImageTag) ([]ImageTag, error) {
+		if _, err := h.getLocalImage(hash, "", nil); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return addImageTag(tags, tag), nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	h.log().With("image", hash.String()).Infof("tagged as %v", tag)
+	return nil
+}
+
+// Removes tag with name and labels. Returns ErrNotFound if there is no
+// such tag. The image stays, even if it has no tags left.
+func (h *Host) UntagImage(name types.ACIdentifier, labels types.Labels) error {
+	labels, err := tagLabels(labels)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var untagged *ImageTag
+	err = h.updateImageTags(func(tags []ImageTag) ([]ImageTag, error) {
+		rv := make([]ImageTag, 0, len(tags))
+		for i, tag := range tags {
+			if tag.is(name, labels) {
+				untagged = &tags[i]
+			} else {
+				rv = append(rv, tag)
+			}
+		}
+		if untagged == nil {
+			return nil, errors.Annotatef(ErrNotFound, "Tag %v", imageString(name, labels))
+		}
+		return rv, nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	h.log().With("image", untagged.Image.String()).Infof("untagged %v", untagged)
+	return nil
+}
+
+// Tags image with its manifest's name and labels.
+func (img *Image) tagFromManifest() error {
+	if img.Hash == nil || img.Manifest.Name.Empty() {
+		return nil
+	}
+	labels, err := tagLabels(img.Manifest.Labels)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tag := ImageTag{Name: img.Manifest.Name, Labels: labels, Image: *img.Hash}
+	return errors.Trace(img.Host.updateImageTags(func(tags []ImageTag) ([]ImageTag, error) {
+		return addImageTag(tags, tag), nil
+	}))
+}
+
+// Removes destroyed image's tags.
+func (img *Image) untagAll() error {
+	if img.Hash == nil {
+		return nil
+	}
+	return errors.Trace(img.Host.updateImageTags(func(tags []ImageTag) ([]ImageTag, error) {
+		rv := make([]ImageTag, 0, len(tags))
+		for _, tag := range tags {
+			if tag.Image != *img.Hash {
+				rv = append(rv, tag)
+			}
+		}
+		return rv, nil
+	}))
+}
+
+// Returns whether image is tagged with name, and labels match the tag.
+func tagMatches(tag ImageTag, img *Image, name types.ACIdentifier, labels types.Labels) bool {
+	return tag.Name == name && acutil.MatchLabels(labels, tag.imageLabels(img.Manifest.Labels))
+}
+
+// Returns image's tags.
+func (img *Image) Tags() ([]ImageTag, error) {
+	if img.Hash == nil {
+		return nil, nil
+	}
+	tags, err := img.Host.ImageTags()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var rv []ImageTag
+	for _, tag := range tags {
+		if tag.Image == *img.Hash {
+			rv = append(rv, tag)
+		}
+	}
+	return rv, nil
+}
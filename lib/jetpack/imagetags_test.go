@@ -0,0 +1,91 @@
+package jetpack
+
+import (
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+func TestImageTags(t *testing.T) {
+	h, cleanup := podHeadersTestHost(t, 0)
+	defer cleanup()
+	os.MkdirAll(h.Path("images"), 0700)
+	worker := saveTestImage(t, h, "example.com/worker")
+	build := saveTestImage(t, h, "example.com/worker-build")
+	v := func(version string) types.Labels { return types.Labels{{Name: "version", Value: version}} }
+
+	// Without an index, images are tagged by their manifests
+	if img, err := h.GetImageByName("example.com/worker", nil); err != nil || *img.Hash != *worker.Hash {
+		t.Fatalf("by manifest: %v (%v)", img, err)
+	}
+
+	for _, version := range []string{"1.4", "latest"} {
+		if err := h.TagImage(*worker.Hash, "example.com/worker", v(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if img, err := h.GetImageByName("example.com/worker", v("1.4")); err != nil || *img.Hash != *worker.Hash {
+		t.Errorf("by tag: %v (%v)", img, err)
+	}
+	if tags, err := worker.Tags(); err != nil || len(tags) != 3 {
+		t.Errorf("tags: %v (%v)", tags, err)
+	}
+
+	// Tagging another image moves the tag
+	if err := h.TagImage(*build.Hash, "example.com/worker", v("stable")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.TagImage(*build.Hash, "example.com/worker", v("latest")); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := h.GetImageByName("example.com/worker", v("latest")); err != nil || *img.Hash != *build.Hash {
+		t.Errorf("moved tag: %v (%v)", img, err)
+	}
+	if img, err := h.GetImage(*build.Hash, "example.com/worker", v("stable")); err != nil || *img.Hash != *build.Hash {
+		t.Errorf("by hash and tag: %v (%v)", img, err)
+	}
+
+	// Untagged image stays, found by its ID only
+	if err := h.UntagImage("example.com/worker-build", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.UntagImage("example.com/worker-build", nil); errors.Cause(err) != ErrNotFound {
+		t.Errorf("untagging again: %v", err)
+	}
+	if _, err := h.GetImageByName("example.com/worker-build", nil); errors.Cause(err) != ErrNotFound {
+		t.Errorf("untagged name: %v", err)
+	}
+	if _, err := h.GetLocalImage(*build.Hash, "", nil); err != nil {
+		t.Errorf("untagged image: %v", err)
+	}
+
+	if err := h.TagImage(*types.NewHashSHA512([]byte("none")), "example.com/none", nil); errors.Cause(err) != ErrNotFound {
+		t.Errorf("tagging missing image: %v", err)
+	}
+	if err := h.TagImage(*worker.Hash, "example.com/worker", append(v("1"), v("2")...)); errors.Cause(err) != ErrUsage {
+		t.Errorf("duplicate label: %v", err)
+	}
+
+	iss, err := h.ListImages(&ImageFilter{Name: "example.com/worker"})
+	if err != nil || len(iss) != 2 {
+		t.Fatalf("listing: %v (%v)", iss, err)
+	}
+	for _, is := range iss {
+		if *is.Hash == *worker.Hash && is.TagsString() != "example.com/worker example.com/worker:1.4" {
+			t.Errorf("worker's tags: %v", is.TagsString())
+		}
+	}
+}
+
+func TestImageTagLabels(t *testing.T) {
+	tag := ImageTag{Name: "example.com/app", Labels: types.Labels{{Name: "version", Value: "stable"}}}
+	labels := tag.imageLabels(types.Labels{{Name: "os", Value: "freebsd"}, {Name: "version", Value: "1.4.2"}})
+	if version, _ := labels.Get("version"); version != "stable" {
+		t.Errorf("version: %v", version)
+	}
+	if os_, _ := labels.Get("os"); os_ != "freebsd" {
+		t.Errorf("os: %v", os_)
+	}
+}
@@ -0,0 +1,178 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+)
+
+// An image is used by pods that run it, or run an image that depends
+// on it (directly or not), and by stored images that depend on it.
+// Destroying an image in use fails with ImageInUseError, instead of
+// failing in ZFS (the pods' rootfs are its clones) or leaving pods that
+// can't start. Destroying it by force promotes the clones, so that
+// pods and images that depend on it keep their rootfs, and marks pods
+// that run the image itself broken: they have lost their image's app,
+// and refuse to start. An image run by a running pod is never
+// destroyed.
+
+// Returned when destroying an image that is in use; its cause is
+// ErrImageInUse.
+type ImageInUseError struct {
+	Image  types.Hash
+	Pods   []uuid.UUID  // pods that run the image or its dependants
+	Images []types.Hash // stored images that depend on it, directly or not
+}
+
+func (e *ImageInUseError) Error() string {
+	return fmt.Sprintf("Image %v is used by %d pods %v and %d images %v", e.Image, len(e.Pods), e.Pods, len(e.Images), e.Images)
+}
+
+func (e *ImageInUseError) Cause() error {
+	return ErrImageInUse
+}
+
+// Why a pod can't start anymore
+type PodBroken struct {
+	Reason string
+	Image  *types.Hash `json:",omitempty"` // destroyed image the pod runs
+	Time   time.Time
+}
+
+func (pb *PodBroken) String() string {
+	return pb.Reason
+}
+
+// Returns why the pod is broken, or nil if it isn't.
+func (pod *Pod) Broken() (*PodBroken, error) {
+	bb, err := ioutil.ReadFile(pod.Path("broken"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pb := &PodBroken{}
+	if err := json.Unmarshal(bb, pb); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return pb, nil
+}
+
+func (pod *Pod) markBroken(pb *PodBroken) error {
+	bb, err := json.Marshal(pb)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFileAtomic(pod.Path("broken"), bb, 0640))
+}
+
+// Returns images that depend on the image, directly or not, and pods
+// that run the image or one of them.
+func (img *Image) users() ([]*Pod, []*Image, error) {
+	if img.Hash == nil {
+		return nil, nil, nil
+	}
+	imgs, err := img.Host.Images()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	dependants := make(map[types.Hash][]*Image)
+	for _, oimg := range imgs {
+		for _, dep := range oimg.Manifest.Dependencies {
+			if dep.ImageID != nil && oimg.Hash != nil {
+				dependants[*dep.ImageID] = append(dependants[*dep.ImageID], oimg)
+			}
+		}
+	}
+	var dimgs []*Image
+	used := map[types.Hash]bool{*img.Hash: true}
+	for queue := []types.Hash{*img.Hash}; len(queue) > 0; queue = queue[1:] {
+		for _, dimg := range dependants[queue[0]] {
+			if !used[*dimg.Hash] {
+				used[*dimg.Hash] = true
+				dimgs = append(dimgs, dimg)
+				queue = append(queue, *dimg.Hash)
+			}
+		}
+	}
+	var pods []*Pod
+	for _, pod := range img.Host.Pods() {
+		for _, app := range pod.Manifest.Apps {
+			if used[app.Image.ID] {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	return pods, dimgs, nil
+}
+
+// Returns pods that destroying the image will break. Unless force is
+// true, returns ImageInUseError if the image is in use; an error is
+// returned also if a pod that runs the image is running.
+func (img *Image) checkUsers(force bool) ([]*Pod, error) {
+	pods, dimgs, err := img.users()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(pods) == 0 && len(dimgs) == 0 {
+		return nil, nil
+	}
+	if !force {
+		e := &ImageInUseError{Image: *img.Hash}
+		for _, pod := range pods {
+			e.Pods = append(e.Pods, pod.UUID)
+		}
+		for _, dimg := range dimgs {
+			e.Images = append(e.Images, *dimg.Hash)
+		}
+		return nil, e
+	}
+	var broken []*Pod
+	for _, pod := range pods {
+		for _, app := range pod.Manifest.Apps {
+			if app.Image.ID != *img.Hash {
+				continue
+			}
+			if pod.Status() != PodStatusStopped {
+				return nil, errors.Errorf("Image %v is used by running pod %v", img.Hash, pod.UUID)
+			}
+			broken = append(broken, pod)
+			break
+		}
+	}
+	return broken, nil
+}
+
+// Marks pods broken after the image has been destroyed.
+func (img *Image) markPodsBroken(pods []*Pod) {
+	pb := &PodBroken{
+		Reason: fmt.Sprintf("image %v (%v) has been destroyed", img.Hash, img),
+		Image:  img.Hash,
+		Time:   time.Now(),
+	}
+	for _, pod := range pods {
+		if err := pod.markBroken(pb); err != nil {
+			pod.log().Warnf("cannot mark pod broken: %v", err)
+		} else {
+			pod.log().Infof("broken: %v", pb)
+		}
+	}
+}
+
+// Destroys an image. Refuses to destroy an image in use (see
+// ImageInUseError), unless force is true; an image run by a running
+// pod is never destroyed.
+func (h *Host) RemoveImage(hash types.Hash, force bool) error {
+	img, err := h.GetLocalImage(hash, "", nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(img.destroy(force))
+}
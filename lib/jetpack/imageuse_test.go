@@ -0,0 +1,78 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+func TestImageUsers(t *testing.T) {
+	h, cleanup := podHeadersTestHost(t, 2)
+	defer cleanup()
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	base := saveTestImage(t, h, "base")
+	img := saveTestImage(t, h, "image")
+	img.Manifest.Dependencies = types.Dependencies{{ImageName: base.Manifest.Name, ImageID: base.Hash}}
+	if bb, err := json.Marshal(&img.Manifest); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(img.Path("manifest"), bb, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := saveTestImage(t, h, "other")
+
+	if pods, dimgs, err := other.users(); err != nil {
+		t.Fatal(err)
+	} else if len(pods) != 0 || len(dimgs) != 0 {
+		t.Errorf("Expected no users of other, got %v pods, %v images", len(pods), len(dimgs))
+	}
+
+	// Pods run image, which depends on base
+	if err := base.Destroy(); errors.Cause(err) != ErrImageInUse {
+		t.Fatalf("Expected ErrImageInUse, got %v", err)
+	}
+	_, err := base.checkUsers(false)
+	iue, ok := err.(*ImageInUseError)
+	if !ok {
+		t.Fatalf("Expected ImageInUseError, got %#v", err)
+	}
+	if len(iue.Pods) != 2 || len(iue.Images) != 1 || iue.Images[0] != *img.Hash {
+		t.Errorf("Expected 2 pods and image %v, got %v", img.Hash, iue)
+	}
+
+	// Destroying base by force breaks no pod
+	if broken, err := base.checkUsers(true); err != nil {
+		t.Error(err)
+	} else if len(broken) != 0 {
+		t.Errorf("Expected no broken pods, got %v", len(broken))
+	}
+	// The first pod is running
+	if _, err := img.checkUsers(true); err == nil {
+		t.Error("Expected error for image of a running pod")
+	}
+}
+
+func TestPodBroken(t *testing.T) {
+	h, cleanup := podHeadersTestHost(t, 1)
+	defer cleanup()
+	pod := h.Pods()[0]
+	if pb, err := pod.Broken(); err != nil || pb != nil {
+		t.Fatalf("Expected pod not broken, got %v, %v", pb, err)
+	}
+	if err := pod.markBroken(&PodBroken{Reason: "image gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if pb, err := pod.Broken(); err != nil {
+		t.Fatal(err)
+	} else if pb == nil || pb.Reason != "image gone" {
+		t.Errorf("Expected pod broken, got %v", pb)
+	}
+	if err := pod.runJail("-c"); errors.Cause(err) != ErrPodBroken {
+		t.Errorf("Expected ErrPodBroken, got %v", err)
+	}
+}
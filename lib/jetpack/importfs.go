@@ -0,0 +1,256 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/ui"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// A directory tree (e.g. a world installed with DESTDIR, or a
+// poudriere jail) becomes an image without an ACI: the tree is copied
+// with system's tar, which keeps ownership, modes, hard links, device
+// nodes, and symlinks as they are; a tree that is a whole ZFS dataset
+// is received from its snapshot instead. The image's ID is the hash of
+// its canonical ACI (see Export), which is saved as the image's ACI,
+// so exporting the image and importing it elsewhere keeps the ID.
+
+// Options of importing an image from a directory tree
+type FSImportOptions struct {
+	ImageOptions
+
+	// Make minimal manifest from the given one's name and labels, with
+	// os and arch labels of the host unless given
+	GenerateManifest bool
+}
+
+// Imports directory tree at dir as an image with manifest. The
+// manifest can't have dependencies: the tree is the complete rootfs.
+// Like other images without a signature, it needs opts.AllowUnsigned
+// and allow.no-signature. If an image with the same ID has been
+// imported already, it is returned.
+func (h *Host) ImportImageFromFS(dir string, manifest schema.ImageManifest, opts *FSImportOptions) (_ *Image, erv error) {
+	started := time.Now()
+	if opts == nil {
+		opts = &FSImportOptions{}
+	}
+	if opts.GenerateManifest {
+		manifest = minimalManifest(manifest.Name, manifest.Labels)
+	}
+	if err := validateFSManifest(&manifest); err != nil {
+		return nil, errors.Trace(err)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, errors.Trace(err)
+	} else if !fi.IsDir() {
+		return nil, errors.Errorf("%v is not a directory", dir)
+	}
+	if err := h.checkUnsigned(manifest.Name, &opts.ImageOptions); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	img := NewImage(h, uuid.NewRandom())
+	img.Manifest = manifest
+	img.Provenance = newProvenance(ProvenanceDirectory, dir)
+	ui := ui.NewUI("magenta", "import", img.UUID.String())
+	ui.Printf("Importing %v from %v", manifest.Name, dir)
+	defer func() {
+		if erv != nil {
+			img.abortImport()
+		}
+	}()
+	if err := os.MkdirAll(img.Path(), 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := img.checkPlatform(); err != nil {
+		ui.Printf("WARNING: %v", err)
+	}
+
+	dsName := path.Join("images", img.UUID.String())
+	mountpoint := img.Path("rootfs")
+	if src, err := treeDataset(dir); err != nil {
+		return nil, errors.Trace(err)
+	} else if src != nil {
+		ui.Printf("Receiving dataset %v", src.Name)
+		if img.rootfs, err = receiveTree(src, h.Dataset.ChildName(dsName), mountpoint); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else {
+		ui.Println("Copying rootfs")
+		props := h.imageZFSProperties(mountpoint)
+		if img.rootfs, err = createWithProperties(h.datasets(), h.Dataset.ChildName(dsName), props, "images.zfs.* settings"); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := overlayRootfs(dir, mountpoint); err != nil {
+			return nil, errors.Annotatef(err, "Copying %v", dir)
+		}
+	}
+
+	if err := img.saveManifest(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ui.Println("Writing ACI")
+	aci, err := os.OpenFile(img.Path("aci"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0400)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hash, err := img.writeCanonicalACI(aci, &ExportOptions{Gzip: true}, nil)
+	if err == nil {
+		err = aci.Sync()
+	}
+	aciSize := int64(-1)
+	if fi, err := aci.Stat(); err == nil {
+		aciSize = fi.Size()
+	}
+	aci.Close()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if existing, err := h.getLocalImage(*hash, "", nil); err == nil {
+		ui.Println("Image", hash, "is already imported")
+		img.abortImport()
+		return existing, nil
+	} else if err != ErrNotFound {
+		return nil, errors.Trace(err)
+	}
+
+	img.Hash = hash
+	img.Import = &ImportSummary{Size: aciSize, Duration: time.Since(started)}
+	if err := img.sealImage(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	ui.Println("Successfully imported", hash)
+	h.log().With("image", img.Hash.String()).Infof("imported %v from %v: %v", img, dir, img.Import)
+	h.logEvent(&Event{Type: EventImport, Image: img.Hash.String(), Details: img.String()})
+	return img, nil
+}
+
+// Returns manifest with only name and labels, and os and arch labels
+// of the host if labels don't have them.
+func minimalManifest(name types.ACIdentifier, labels types.Labels) schema.ImageManifest {
+	manifest := schema.BlankImageManifest()
+	manifest.Name = name
+	manifest.Labels = append(manifest.Labels, labels...)
+	if _, ok := manifest.GetLabel("os"); !ok {
+		manifest.Labels = append(manifest.Labels, types.Label{Name: "os", Value: runtime.GOOS})
+	}
+	if _, ok := manifest.GetLabel("arch"); !ok {
+		manifest.Labels = append(manifest.Labels, types.Label{Name: "arch", Value: runtime.GOARCH})
+	}
+	return *manifest
+}
+
+// Checks that manifest is valid, and complete without dependencies.
+func validateFSManifest(manifest *schema.ImageManifest) error {
+	if manifest.ACKind == "" {
+		manifest.ACKind = schema.ImageManifestKind
+	}
+	if manifest.ACVersion.Empty() {
+		manifest.ACVersion = schema.AppContainerVersion
+	}
+	if manifest.Name.Empty() {
+		return errors.Annotate(ErrUsage, "Image needs a name")
+	}
+	if len(manifest.Dependencies) > 0 {
+		return errors.Annotate(ErrUsage, "Image imported from a directory can't have dependencies")
+	}
+	if len(manifest.PathWhitelist) > 0 {
+		return errors.Annotate(ErrUsage, "Image imported from a directory can't have a path whitelist")
+	}
+	// Manifest is validated when it's unmarshaled
+	bb, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var check schema.ImageManifest
+	return errors.Annotate(json.Unmarshal(bb, &check), "Invalid manifest")
+}
+
+// Returns ZFS dataset mounted at dir, or nil if dir is not a dataset's
+// mount point, or if other datasets are mounted under it (sending it
+// wouldn't send them).
+func treeDataset(dir string) (*zfs.Dataset, error) {
+	fields, err := zfs.ZfsFields("list", "-t", "filesystem", "-o", "name,mountpoint,mounted")
+	if err != nil {
+		// No ZFS to receive from
+		return nil, nil
+	}
+	if name := treeDatasetName(fields, dir); name != "" {
+		return zfs.GetDataset(name)
+	}
+	return nil, nil
+}
+
+// Returns name of the dataset mounted at dir, as treeDataset, from
+// `zfs list -o name,mountpoint,mounted` fields; "" if there's none.
+func treeDatasetName(fields [][]string, dir string) string {
+	dir = filepath.Clean(dir)
+	var name string
+	for _, f := range fields {
+		if len(f) < 3 || f[2] != "yes" || !filepath.IsAbs(f[1]) {
+			// Not mounted, or mounted by hand ("legacy")
+			continue
+		}
+		switch mp := filepath.Clean(f[1]); {
+		case mp == dir:
+			name = f[0]
+		case pathUnder(mp, dir):
+			return ""
+		}
+	}
+	return name
+}
+
+// Receives snapshot of src as dataset name, mounted at mountpoint.
+func receiveTree(src *zfs.Dataset, name, mountpoint string) (*zfs.Dataset, error) {
+	snapName := "jetpack-import-" + path.Base(name)
+	snap, err := src.Snapshot(snapName, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer snap.Destroy()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(zfs.ZfsSend(pw, snap.Name))
+	}()
+	ds, err := zfs.ReceiveDataset(pr, name, false)
+	pr.CloseWithError(errors.New("receive finished"))
+	if err != nil {
+		return nil, errors.Annotatef(err, "Receiving %v", src.Name)
+	}
+	if rsnap, err := ds.GetSnapshot(snapName); err == nil {
+		if err := rsnap.Destroy(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := ds.Set("mountpoint", mountpoint); err != nil {
+		return ds, errors.Trace(err)
+	}
+	if err := ds.Mount(); err != nil {
+		return ds, errors.Trace(err)
+	}
+	return ds, nil
+}
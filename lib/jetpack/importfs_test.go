@@ -0,0 +1,84 @@
+package jetpack
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+func TestMinimalManifest(t *testing.T) {
+	manifest := minimalManifest("example.com/world", types.Labels{{Name: "version", Value: "10.2"}})
+	for name, expected := range map[string]string{
+		"version": "10.2",
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+	} {
+		if value, ok := manifest.GetLabel(name); !ok || value != expected {
+			t.Errorf("label %v: %q (%v)", name, value, ok)
+		}
+	}
+
+	manifest = minimalManifest("example.com/world", types.Labels{{Name: "arch", Value: "i386"}})
+	if value, _ := manifest.GetLabel("arch"); value != "i386" || len(manifest.Labels) != 2 {
+		t.Errorf("labels: %v", manifest.Labels)
+	}
+}
+
+func TestValidateFSManifest(t *testing.T) {
+	manifest := minimalManifest("example.com/world", nil)
+	manifest.ACKind = ""
+	if err := validateFSManifest(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ACKind == "" {
+		t.Error("acKind not filled in")
+	}
+
+	noName := minimalManifest("", nil)
+	if err := validateFSManifest(&noName); errors.Cause(err) != ErrUsage {
+		t.Errorf("no name: %v", err)
+	}
+	withDeps := minimalManifest("example.com/world", nil)
+	withDeps.Dependencies = types.Dependencies{{ImageName: "example.com/base"}}
+	if err := validateFSManifest(&withDeps); errors.Cause(err) != ErrUsage {
+		t.Errorf("dependencies: %v", err)
+	}
+	withWhitelist := minimalManifest("example.com/world", nil)
+	withWhitelist.PathWhitelist = []string{"/bin/sh"}
+	if err := validateFSManifest(&withWhitelist); errors.Cause(err) != ErrUsage {
+		t.Errorf("path whitelist: %v", err)
+	}
+	invalid := minimalManifest("example.com/world", nil)
+	invalid.ACKind = "PodManifest"
+	if err := validateFSManifest(&invalid); err == nil {
+		t.Error("invalid manifest accepted")
+	}
+}
+
+func TestTreeDatasetName(t *testing.T) {
+	fields := [][]string{
+		{"zroot", "/zroot", "yes"},
+		{"zroot/ROOT/default", "/", "yes"},
+		{"zroot/world", "/srv/world", "yes"},
+		{"zroot/world/usr", "/srv/world/usr", "no"},
+		{"zroot/tree", "/srv/tree", "yes"},
+		{"zroot/tree/var", "/srv/tree/var", "yes"},
+		{"zroot/legacy", "legacy", "yes"},
+	}
+	for dir, expected := range map[string]string{
+		"/srv/world":  "zroot/world",
+		"/srv/world/": "zroot/world",
+		"/srv/tree":   "", // var wouldn't be sent
+		"/srv":        "",
+		"/":           "", // everything is mounted under it
+	} {
+		if name := treeDatasetName(fields, dir); name != expected {
+			t.Errorf("%v: expected %#v, got %#v", dir, expected, name)
+		}
+	}
+	if name := treeDatasetName(fields[1:2], "/"); name != "zroot/ROOT/default" {
+		t.Errorf("Expected root dataset, got %#v", name)
+	}
+}
@@ -0,0 +1,98 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Installs a fake jls(8) that logs its runs; returns function
+// counting them, and cleanup.
+func countingJls(t *testing.T) (func() int, func()) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jls := filepath.Join(tmp, "jls")
+	script := "#!/bin/sh\necho run >> " + filepath.Join(tmp, "runs") + "\necho '7 0 jetpack/one'\necho '8 1 jetpack/two'\n"
+	if err := ioutil.WriteFile(jls, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	saved := jlsPath
+	jlsPath = jls
+	runs := func() int {
+		bb, _ := ioutil.ReadFile(filepath.Join(tmp, "runs"))
+		return strings.Count(string(bb), "run\n")
+	}
+	return runs, func() {
+		jlsPath = saved
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestJailStatusCache(t *testing.T) {
+	runs, cleanup := countingJls(t)
+	defer cleanup()
+	h := &Host{}
+
+	if st, err := h.getJailStatus("jetpack/one", false); err != nil {
+		t.Fatal(err)
+	} else if st.Jid != 7 || st.Dying {
+		t.Errorf("unexpected status %#v", st)
+	}
+	if st, _ := h.getJailStatus("jetpack/two", false); st.Jid != 8 || !st.Dying {
+		t.Errorf("unexpected status %#v", st)
+	}
+	if st, _ := h.getJailStatus("jetpack/three", false); st != NoJailStatus {
+		t.Errorf("unexpected status %#v", st)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("passive reads ran jls %d times", n)
+	}
+
+	// Invalidated entry is refreshed, others are not
+	h.invalidateJailStatus("jetpack/two")
+	h.getJailStatus("jetpack/one", false)
+	if n := runs(); n != 1 {
+		t.Errorf("jls ran for a fresh entry")
+	}
+	h.getJailStatus("jetpack/two", false)
+	h.getJailStatus("jetpack/two", false)
+	if n := runs(); n != 2 {
+		t.Errorf("invalidated entry: jls ran %d times, expected 2", n)
+	}
+
+	h.getJailStatus("jetpack/one", true)
+	if n := runs(); n != 3 {
+		t.Errorf("forced refresh didn't run jls")
+	}
+}
+
+func TestJailStatusCacheConcurrent(t *testing.T) {
+	runs, cleanup := countingJls(t)
+	defer cleanup()
+	h := &Host{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				h.invalidateJailStatus("jetpack/one")
+			}
+			if st, err := h.getJailStatus("jetpack/one", false); err != nil {
+				t.Error(err)
+			} else if st.Jid != 7 {
+				t.Errorf("unexpected status %#v", st)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := runs(); n < 1 || n > 5 {
+		t.Errorf("jls ran %d times", n)
+	}
+}
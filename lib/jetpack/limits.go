@@ -0,0 +1,210 @@
+package jetpack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/juju/errors"
+)
+
+// Host limits are checked under the host lock before a pod is
+// created: limits.pods caps the number of pods, limits.quota the
+// total of quotas of pods' datasets (pods' storage limits, or volumes'
+// quotas set with `jetpack/volume/NAME/quota` annotations), and
+// limits.min-free is space that must remain available in the root
+// dataset. CreateOptions.IgnoreLimits overrides them in an emergency.
+// Limits come from Host.Settings, so they change when configuration is
+// reloaded.
+
+// Returned when creating a pod would exceed a host limit; its cause
+// is ErrHostFull.
+type HostFullError struct {
+	Limit     string // property of the exceeded limit
+	Max       int64
+	Used      int64
+	Requested int64
+}
+
+func (e *HostFullError) Error() string {
+	if e.Limit == "limits.min-free" {
+		return fmt.Sprintf("Host is full: %d bytes available, %v is %d", e.Used, e.Limit, e.Max)
+	}
+	return fmt.Sprintf("Host is full: %v is %d, %d used, %d requested", e.Limit, e.Max, e.Used, e.Requested)
+}
+
+func (e *HostFullError) Cause() error {
+	return ErrHostFull
+}
+
+// Current use of a host limit
+type LimitUsage struct {
+	Limit string
+	Max   int64 // 0 if not limited
+	Used  int64 // for limits.min-free, available space
+}
+
+// Returns settings, loading them from configuration if the host was
+// constructed without them.
+func (h *Host) settings() *HostSettings {
+	h.settingsMx.RLock()
+	hs := h.Settings
+	h.settingsMx.RUnlock()
+	if hs != nil {
+		return hs
+	}
+	if hs, err := loadHostSettings(Config()); err == nil {
+		return hs
+	}
+	return &HostSettings{}
+}
+
+// Returns number of pods.
+func (h *Host) podCount() int64 {
+	mm, _ := filepath.Glob(h.Path("pods", "*", "manifest"))
+	return int64(len(mm))
+}
+
+// Returns total of quotas of pods' datasets and their volumes, in all
+// storage classes.
+func (h *Host) podQuotaTotal() (int64, error) {
+	podsDatasets, err := h.podsDatasets()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	var rows [][]string
+	for _, name := range podsDatasets {
+		dss, err := h.datasets().Children(name, -1, "quota")
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		for _, ds := range dss {
+			rows = append(rows, []string{ds.Name, ds.Properties["quota"]})
+		}
+	}
+	return sumQuotas(rows), nil
+}
+
+// Sums quotas from name, value rows (of parents before their
+// children), skipping
+// datasets within another dataset's quota (volumes of a pod with a
+// storage limit).
+func sumQuotas(rows [][]string) int64 {
+	var total int64
+	var limited []string
+	for _, row := range rows {
+		if len(row) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(row[1]), 10, 64)
+		if err != nil || n == 0 {
+			continue
+		}
+		within := false
+		for _, name := range limited {
+			if strings.HasPrefix(row[0], name+"/") {
+				within = true
+				break
+			}
+		}
+		if !within {
+			total += n
+			limited = append(limited, row[0])
+		}
+	}
+	return total
+}
+
+// Returns space available in the root dataset.
+func (h *Host) availableSpace() (int64, error) {
+	n, err := h.Dataset.GetUint64("available")
+	return int64(n), errors.Trace(err)
+}
+
+// Returns quota that pm requests: its storage limit, or total of its
+// volumes' quotas.
+func requestedQuota(pm *schema.PodManifest) (int64, error) {
+	if limit, err := storageSetting(pm, "limit"); err != nil {
+		return 0, errors.Trace(err)
+	} else if limit > 0 {
+		return limit, nil
+	}
+	var total int64
+	for _, vol := range pm.Volumes {
+		v, ok := pm.Annotations.Get("jetpack/volume/" + vol.Name.String() + "/quota")
+		if !ok || v == "none" {
+			continue
+		}
+		n, err := parseLogSize(v)
+		if err != nil {
+			return 0, errors.Errorf("Volume %v: invalid quota %#v", vol.Name, v)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Checks whether a pod with manifest pm fits within host limits,
+// unless they are ignored.
+func (h *Host) checkLimits(pm *schema.PodManifest, ignore bool) error {
+	limits := h.settings().Limits
+	if limits.Pods == 0 && limits.Quota == 0 && limits.MinFree == 0 {
+		return nil
+	}
+	if ignore {
+		h.log().Warnf("ignoring host limits")
+		return nil
+	}
+	if limits.Pods > 0 {
+		if n := h.podCount(); n+1 > int64(limits.Pods) {
+			return &HostFullError{Limit: "limits.pods", Max: int64(limits.Pods), Used: n, Requested: 1}
+		}
+	}
+	if limits.Quota > 0 {
+		requested, err := requestedQuota(pm)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		used, err := h.podQuotaTotal()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if used+requested > limits.Quota {
+			return &HostFullError{Limit: "limits.quota", Max: limits.Quota, Used: used, Requested: requested}
+		}
+	}
+	if limits.MinFree > 0 {
+		available, err := h.availableSpace()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if available < limits.MinFree {
+			return &HostFullError{Limit: "limits.min-free", Max: limits.MinFree, Used: available}
+		}
+	}
+	return nil
+}
+
+// Returns current use of host limits. Pool is queried only for
+// limits that are set.
+func (h *Host) LimitsUsage() ([]LimitUsage, error) {
+	limits := h.settings().Limits
+	rv := []LimitUsage{{Limit: "limits.pods", Max: int64(limits.Pods), Used: h.podCount()}}
+	if limits.Quota > 0 {
+		used, err := h.podQuotaTotal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rv = append(rv, LimitUsage{Limit: "limits.quota", Max: limits.Quota, Used: used})
+	}
+	if limits.MinFree > 0 {
+		available, err := h.availableSpace()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rv = append(rv, LimitUsage{Limit: "limits.min-free", Max: limits.MinFree, Used: available})
+	}
+	return rv, nil
+}
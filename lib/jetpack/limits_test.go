@@ -0,0 +1,109 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestCheckLimitsPods(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}, Settings: &HostSettings{}}
+	h.Settings.Limits.Pods = 2
+	pm := schema.BlankPodManifest()
+
+	for i := 0; i < 2; i++ {
+		if err := h.checkLimits(pm, false); err != nil {
+			t.Fatalf("pod %d: %v", i, err)
+		}
+		writeTestFiles(t, tmp, map[string]string{"pods/" + newPod(h, nil).UUID.String() + "/manifest": "{}"})
+	}
+
+	err = h.checkLimits(pm, false)
+	if errors.Cause(err) != ErrHostFull {
+		t.Fatalf("expected ErrHostFull, got %v", err)
+	}
+	if hfe, ok := err.(*HostFullError); !ok || hfe.Limit != "limits.pods" || hfe.Used != 2 {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if ae := apiError(errors.Trace(err)); ae.Kind != "host-full" {
+		t.Errorf("API error kind %v", ae.Kind)
+	}
+
+	if err := h.checkLimits(pm, true); err != nil {
+		t.Errorf("limits not ignored: %v", err)
+	}
+}
+
+func TestRequestedQuota(t *testing.T) {
+	pm := schema.BlankPodManifest()
+	for _, name := range []string{"data", "cache", "tmp"} {
+		pm.Volumes = append(pm.Volumes, types.Volume{Name: types.ACName(name), Kind: "empty"})
+	}
+	pm.Annotations.Set("jetpack/volume/data/quota", "1g")
+	pm.Annotations.Set("jetpack/volume/cache/quota", "512m")
+	pm.Annotations.Set("jetpack/volume/tmp/quota", "none")
+	if n, err := requestedQuota(pm); err != nil {
+		t.Fatal(err)
+	} else if n != 1536<<20 {
+		t.Errorf("requested %d", n)
+	}
+
+	pm.Annotations.Set("jetpack/volume/tmp/quota", "lots")
+	if _, err := requestedQuota(pm); err == nil {
+		t.Error("invalid quota accepted")
+	}
+
+	// Storage limit covers the volumes
+	pm.Annotations.Set("jetpack/storage/limit", "10g")
+	if n, err := requestedQuota(pm); err != nil {
+		t.Fatal(err)
+	} else if n != 10<<30 {
+		t.Errorf("requested %d with storage limit", n)
+	}
+}
+
+func TestSumQuotas(t *testing.T) {
+	rows := [][]string{
+		{"zroot/jetpack/pods", "0"},
+		{"zroot/jetpack/pods/a", "1000"},
+		{"zroot/jetpack/pods/a/volume.0", "500"},
+		{"zroot/jetpack/pods/ab", "0"},
+		{"zroot/jetpack/pods/ab/volume.0", "200"},
+		{"zroot/jetpack/pods/ab/volume.1", "-"},
+	}
+	if n := sumQuotas(rows); n != 1200 {
+		t.Errorf("Expected 1200, got %d", n)
+	}
+}
+
+func TestLimitsSettings(t *testing.T) {
+	props := properties.NewProperties()
+	props.Set("limits.pods", "10")
+	props.Set("limits.quota", "2g")
+	props.Set("limits.min-free", "off")
+	hs, err := loadHostSettings(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Limits != (LimitsSettings{Pods: 10, Quota: 2 << 30}) {
+		t.Errorf("unexpected limits %#v", hs.Limits)
+	}
+
+	props.Set("limits.pods", "many")
+	if _, err := loadHostSettings(props); err == nil || !strings.Contains(err.Error(), "limits: limits.pods") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
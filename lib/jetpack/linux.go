@@ -0,0 +1,74 @@
+package jetpack
+
+import (
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Linux pods need the Linux ABI and linprocfs/linsysfs kernel
+// modules. Missing modules are loaded if linux.autoload property is
+// on; otherwise, pod won't start.
+
+// Kernel modules needed by Linux pods: file name and module name, as
+// seen by kldstat -m.
+func linuxModules() [][2]string {
+	abi := [2]string{"linux", "linuxelf"}
+	if runtime.GOARCH == "amd64" {
+		abi = [2]string{"linux64", "linux64elf"}
+	}
+	return [][2]string{abi, {"linprocfs", "linprocfs"}, {"linsysfs", "linsysfs"}}
+}
+
+var linuxOSReleaseRegexp = regexp.MustCompile(`^[2-9]\.[0-9]+(\.[0-9]+)*$`)
+
+// Returns true if any of the pod's apps has a Linux image.
+func (pod *Pod) IsLinux() bool {
+	for _, rtApp := range pod.Manifest.Apps {
+		if img, err := pod.Host.getRuntimeImage(rtApp.Image); err != nil {
+			pod.log().Debugf("Cannot get image of %v: %v", rtApp.Name, err)
+		} else if os_, _ := img.Manifest.GetLabel("os"); os_ == "linux" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns Linux kernel version emulated by the host
+// (compat.linux.osrelease sysctl).
+func LinuxOSRelease() (string, error) {
+	rel, err := systemCommand("sysctl", "-n", "compat.linux.osrelease").Quiet().OutputString()
+	return strings.TrimSpace(rel), errors.Trace(err)
+}
+
+// Makes sure that kernel modules needed by Linux pods are loaded, and
+// that compat.linux.osrelease is sane.
+func checkLinuxSupport() error {
+	autoload := Config().GetBool("linux.autoload", false)
+	var missing []string
+	for _, mod := range linuxModules() {
+		if systemCommand("kldstat", "-q", "-m", mod[1]).Quiet().Run() == nil {
+			continue
+		}
+		if autoload {
+			if err := systemCommand("kldload", "-n", mod[0]).Run(); err != nil {
+				return errors.Annotatef(err, "Cannot load %v kernel module", mod[0])
+			}
+		} else {
+			missing = append(missing, mod[0])
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("Kernel modules needed by Linux pods are not loaded: %v (load them, or set linux.autoload = on)",
+			strings.Join(missing, ", "))
+	}
+
+	if rel, err := LinuxOSRelease(); err != nil {
+		return errors.Annotate(err, "Cannot get compat.linux.osrelease")
+	} else if !linuxOSReleaseRegexp.MatchString(rel) {
+		return errors.Errorf("Invalid compat.linux.osrelease: %#v", rel)
+	}
+	return nil
+}
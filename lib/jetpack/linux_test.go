@@ -0,0 +1,19 @@
+package jetpack
+
+import "testing"
+
+func TestLinuxOSReleaseRegexp(t *testing.T) {
+	for rel, valid := range map[string]bool{
+		"2.6.32":  true,
+		"3.2.0":   true,
+		"4.4":     true,
+		"":        false,
+		"0.0.0":   false,
+		"3.2.0-x": false,
+		"latest":  false,
+	} {
+		if linuxOSReleaseRegexp.MatchString(rel) != valid {
+			t.Errorf("%#v: expected valid=%v", rel, valid)
+		}
+	}
+}
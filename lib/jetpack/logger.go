@@ -0,0 +1,102 @@
+package jetpack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/3ofcoins/jetpack/lib/ui"
+)
+
+// Logger receives Host's diagnostics: external commands, jail state
+// transitions, pod preparation, and warnings that don't stop an
+// operation. Embedding applications can pass their own implementation
+// to NewHostWithLogger to route them to their logging library.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// Returns a logger that adds key-value pairs (e.g. "pod", UUID) as
+	// context to every line.
+	With(keyvals ...interface{}) Logger
+}
+
+type stderrLogger struct {
+	ui      *ui.UI
+	keyvals []interface{}
+}
+
+// Returns the default logger, which writes to stderr. Debug lines are
+// written only when the `debug` property (or command line switch) is
+// on.
+func NewStderrLogger() Logger {
+	return &stderrLogger{ui: ui.NewUI("green", "jetpack", "")}
+}
+
+func (l *stderrLogger) With(keyvals ...interface{}) Logger {
+	return &stderrLogger{
+		ui:      l.ui,
+		keyvals: append(append([]interface{}(nil), l.keyvals...), keyvals...),
+	}
+}
+
+func (l *stderrLogger) log(level, format string, args ...interface{}) {
+	l.ui.Printf("%v%v%v", level, fmt.Sprintf(format, args...), formatKeyvals(l.keyvals))
+}
+
+func (l *stderrLogger) Debugf(format string, args ...interface{}) {
+	if ui.Debug {
+		l.log("DEBUG: ", format, args...)
+	}
+}
+
+func (l *stderrLogger) Infof(format string, args ...interface{}) {
+	l.log("", format, args...)
+}
+
+func (l *stderrLogger) Warnf(format string, args ...interface{}) {
+	l.log("WARNING: ", format, args...)
+}
+
+func (l *stderrLogger) Errorf(format string, args ...interface{}) {
+	l.log("ERROR: ", format, args...)
+}
+
+// Formats key-value pairs as ` key=value` suffix, quoting values that
+// need it.
+func formatKeyvals(keyvals []interface{}) string {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, nil)
+	}
+	var buf []string
+	for i := 0; i < len(keyvals); i += 2 {
+		v := fmt.Sprint(keyvals[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		buf = append(buf, fmt.Sprintf(" %v=%v", keyvals[i], v))
+	}
+	return strings.Join(buf, "")
+}
+
+// Host's logger, defaulting to stderr for hosts that were not
+// constructed with NewHost.
+func (h *Host) log() Logger {
+	if h.Log == nil {
+		h.Log = NewStderrLogger()
+	}
+	return h.Log
+}
+
+func (pod *Pod) log() Logger {
+	return pod.Host.log().With("pod", pod.UUID)
+}
+
+func (app *App) log() Logger {
+	return app.Pod.log().With("app", app.Name)
+}
+
+func (img *Image) log() Logger {
+	return img.Host.log().With("image", img.UUID)
+}
@@ -0,0 +1,28 @@
+package jetpack
+
+import "testing"
+
+func TestFormatKeyvals(t *testing.T) {
+	for expected, keyvals := range map[string][]interface{}{
+		"":                       nil,
+		" pod=foo":               {"pod", "foo"},
+		" pod=foo op=start":      {"pod", "foo", "op", "start"},
+		` msg="two words"`:       {"msg", "two words"},
+		` empty=""`:              {"empty", ""},
+		` odd=<nil>`:             {"odd"},
+		` quote="a \"b\" c" n=3`: {"quote", `a "b" c`, "n", 3},
+	} {
+		if actual := formatKeyvals(keyvals); actual != expected {
+			t.Errorf("formatKeyvals(%#v): expected %#v, got %#v", keyvals, expected, actual)
+		}
+	}
+}
+
+func TestStderrLoggerWith(t *testing.T) {
+	log := NewStderrLogger().With("pod", "foo")
+	app := log.With("app", "bar")
+	log.With("op", "start")
+	if kv := formatKeyvals(app.(*stderrLogger).keyvals); kv != " pod=foo app=bar" {
+		t.Errorf("unexpected context: %#v", kv)
+	}
+}
@@ -0,0 +1,69 @@
+package jetpack
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/passwd"
+)
+
+// Apps' processes get resource limits, priority, umask, and
+// environment of a login class from the image's /etc/login.conf, as
+// setusercontext(3) would set them. The class is taken from app's
+// `jetpack/login-class` annotation, or from the user's entry in the
+// image's /etc/master.passwd. Resource limits and umask set with
+// annotations take precedence over the class.
+
+// Returns names (and aliases) of classes defined in a login.conf(5)
+// file.
+func loginClasses(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	classes := make(map[string]bool)
+	continued := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		wasContinued := continued
+		continued = strings.HasSuffix(line, "\\")
+		if wasContinued || line == "" || line[0] == '#' || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		names := strings.SplitN(line, ":", 2)[0]
+		for _, name := range strings.Split(names, "|") {
+			classes[name] = true
+		}
+	}
+	return classes, errors.Trace(scanner.Err())
+}
+
+// Returns login class of the app's user, or empty string if it has
+// none.
+func (app *App) LoginClass(username string) (string, error) {
+	class, ok := app.Pod.appAnnotation(app.Name, "jetpack/login-class")
+	if !ok {
+		pwf, err := passwd.ReadMasterPasswd(app.Path("etc", "master.passwd"))
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if pwent := pwf.FindByUsername(username); pwent == nil || pwent.Class == "" {
+			return "", nil
+		} else {
+			class = pwent.Class
+		}
+	}
+
+	if classes, err := loginClasses(app.Path("etc", "login.conf")); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return "", errors.Trace(err)
+	} else if !classes[class] {
+		return "", errors.Errorf("App %v: unknown login class %#v", app.Name, class)
+	}
+	return class, nil
+}
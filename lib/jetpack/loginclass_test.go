@@ -0,0 +1,42 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testLoginConf = `# login.conf
+default:\
+	:passwd_format=sha512:\
+	:umask=022:
+
+daemon:\
+	:memorylocked=128M:\
+	:tc=default:
+standard|users:\
+	:tc=default:
+`
+
+func TestLoginClasses(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "login.conf")
+	if err := ioutil.WriteFile(path, []byte(testLoginConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	classes, err := loginClasses(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"default": true, "daemon": true, "standard": true, "users": true}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Expected %v, got %v", expected, classes)
+	}
+}
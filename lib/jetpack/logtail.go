@@ -0,0 +1,308 @@
+package jetpack
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// How often followed log is checked for new data, rotation, and pod's
+// destruction.
+const logFollowInterval = 250 * time.Millisecond
+
+type LogsOptions struct {
+	Stream string    // "out" (default) or "err"
+	Lines  int       // only last Lines lines (0 for all)
+	Since  time.Time // only lines timestamped at or after Since
+	Follow bool      // keep streaming new lines
+
+	// Stops following when done; follow also stops when pod is
+	// destroyed, or the reader is closed.
+	Context context.Context `json:"-"`
+}
+
+// Returns reader of the app's captured log, including rotated files.
+// ErrNoLogs is returned if the app has never written the log (or its
+// output isn't captured). Since filter needs timestamped logs (see
+// captureOutput); lines without a timestamp follow the preceding one.
+func (pod *Pod) Logs(name types.ACName, opts *LogsOptions) (io.ReadCloser, error) {
+	app := pod.App(name)
+	if app == nil {
+		return nil, errors.Annotatef(ErrNotFound, "App %v", name)
+	}
+	if opts == nil {
+		opts = &LogsOptions{}
+	}
+	stream := opts.Stream
+	if stream == "" {
+		stream = "out"
+	}
+	if stream != "out" && stream != "err" {
+		return nil, errors.Errorf("Invalid log stream %#v", stream)
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	path := app.LogPath(stream)
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+	var rotated []string
+	if all, err := rotatedLogs(path); err != nil {
+		return nil, errors.Trace(err)
+	} else {
+		for _, rpath := range all {
+			// Skip files that were finished before since
+			if fi, err := os.Stat(rpath); err == nil && !fi.ModTime().Before(opts.Since) {
+				rotated = append(rotated, rpath)
+			}
+		}
+		if f == nil && len(all) == 0 {
+			return nil, errors.Annotatef(ErrNoLogs, "App %v", name)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	lr := &logReader{PipeReader: pr, done: make(chan struct{})}
+	lt := &logTail{
+		pod:   pod,
+		path:  path,
+		since: opts.Since,
+		w:     pw,
+		stop:  lr.done,
+		ctx:   ctx,
+	}
+	if f != nil {
+		lt.file, lt.rd = f, bufio.NewReader(f)
+	}
+	go func() {
+		err := lt.run(rotated, opts.Lines, opts.Follow)
+		if lt.file != nil {
+			lt.file.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return lr, nil
+}
+
+// Reader end of logs; closing it stops the tail.
+type logReader struct {
+	*io.PipeReader
+	done chan struct{}
+	once sync.Once
+}
+
+func (lr *logReader) Close() error {
+	lr.once.Do(func() { close(lr.done) })
+	return lr.PipeReader.Close()
+}
+
+type logTail struct {
+	pod     *Pod
+	path    string
+	file    *os.File
+	rd      *bufio.Reader
+	offset  int64
+	partial string
+	since   time.Time
+	passing bool // last line passed the since filter
+	w       io.Writer
+	stop    chan struct{}
+	ctx     context.Context
+}
+
+func (lt *logTail) run(rotated []string, lines int, follow bool) error {
+	// Existing content
+	var last []string
+	emit := func(line string) error {
+		if !lt.filter(line) {
+			return nil
+		}
+		if lines <= 0 {
+			return lt.write(line)
+		}
+		last = append(last, line)
+		if len(last) > lines {
+			last = last[1:]
+		}
+		return nil
+	}
+	for _, rpath := range rotated {
+		if err := readRotatedLog(rpath, emit); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := lt.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+	for _, line := range last {
+		if err := lt.write(line); err != nil {
+			return err
+		}
+	}
+
+	if !follow {
+		if lt.partial != "" && lt.filter(lt.partial) {
+			return lt.write(lt.partial)
+		}
+		return nil
+	}
+
+	for {
+		line, err := lt.readLine()
+		if err == nil {
+			if lt.filter(line) {
+				if err := lt.write(line); err != nil {
+					return err
+				}
+			}
+			continue
+		} else if err != io.EOF {
+			return errors.Trace(err)
+		}
+
+		select {
+		case <-lt.stop:
+			return nil
+		case <-lt.ctx.Done():
+			return nil
+		case <-time.After(logFollowInterval):
+		}
+
+		if _, err := os.Stat(lt.pod.Path()); os.IsNotExist(err) {
+			// Pod was destroyed
+			return nil
+		}
+		if err := lt.checkFile(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// Reads next complete line. Incomplete last line is kept until it's
+// finished.
+func (lt *logTail) readLine() (string, error) {
+	if lt.file == nil {
+		return "", io.EOF
+	}
+	chunk, err := lt.rd.ReadString('\n')
+	lt.offset += int64(len(chunk))
+	lt.partial += chunk
+	if err != nil {
+		return "", err
+	}
+	line := lt.partial
+	lt.partial = ""
+	return line, nil
+}
+
+// Reopens the log if it was rotated, rewinds it if it was truncated.
+func (lt *logTail) checkFile() error {
+	fi, err := os.Stat(lt.path)
+	if os.IsNotExist(err) {
+		// Rotated, new log not created yet
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if lt.file == nil {
+		// Log didn't exist when tail started
+		f, err := os.Open(lt.path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		lt.file, lt.rd = f, bufio.NewReader(f)
+	} else if cur, err := lt.file.Stat(); err != nil {
+		return errors.Trace(err)
+	} else if !os.SameFile(fi, cur) {
+		// Old file has been read to the end already
+		f, err := os.Open(lt.path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		lt.file.Close()
+		lt.file = f
+		lt.rd.Reset(f)
+		lt.offset = 0
+		lt.partial = ""
+	} else if fi.Size() < lt.offset {
+		if _, err := lt.file.Seek(0, io.SeekStart); err != nil {
+			return errors.Trace(err)
+		}
+		lt.rd.Reset(lt.file)
+		lt.offset = 0
+		lt.partial = ""
+	}
+	return nil
+}
+
+// Passes lines of a rotated (and possibly gzipped) log to emit.
+func readRotatedLog(path string, emit func(string) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Pruned meanwhile
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return errors.Annotate(err, path)
+		}
+		defer zr.Close()
+		rd = zr
+	}
+	brd := bufio.NewReader(rd)
+	for {
+		line, err := brd.ReadString('\n')
+		if line != "" {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Annotate(err, path)
+		}
+	}
+}
+
+func (lt *logTail) filter(line string) bool {
+	if lt.since.IsZero() {
+		return true
+	}
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if ts, err := time.Parse(time.RFC3339, line[:i]); err == nil {
+			lt.passing = !ts.Before(lt.since.Truncate(time.Second))
+		}
+	}
+	return lt.passing
+}
+
+func (lt *logTail) write(line string) error {
+	_, err := io.WriteString(lt.w, line)
+	return err
+}
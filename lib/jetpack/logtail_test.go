@@ -0,0 +1,84 @@
+package jetpack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestPodLogs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name, App: &types.App{User: "0", Group: "0"}}}
+	if err := os.MkdirAll(pod.Path("logs"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pod.Logs(name, nil); errors.Cause(err) != ErrNoLogs {
+		t.Errorf("Expected ErrNoLogs, got %v", err)
+	}
+
+	path := pod.App(name).LogPath("out")
+	log := "2016-01-01T10:00:00Z one\n2016-01-01T11:00:00Z two\ncontinued\n2016-01-01T12:00:00Z three\n"
+	if err := ioutil.WriteFile(path, []byte(log), 0640); err != nil {
+		t.Fatal(err)
+	}
+	since, _ := time.Parse(time.RFC3339, "2016-01-01T11:00:00Z")
+	for expected, opts := range map[string]*LogsOptions{
+		log: nil,
+		"continued\n2016-01-01T12:00:00Z three\n":                           {Lines: 2},
+		"2016-01-01T11:00:00Z two\ncontinued\n2016-01-01T12:00:00Z three\n": {Since: since},
+		"2016-01-01T12:00:00Z three\n":                                      {Since: since, Lines: 1},
+	} {
+		if rd, err := pod.Logs(name, opts); err != nil {
+			t.Errorf("%#v: %v", opts, err)
+		} else if bb, err := ioutil.ReadAll(rd); err != nil {
+			t.Errorf("%#v: %v", opts, err)
+		} else if string(bb) != expected {
+			t.Errorf("%#v: expected %#v, got %#v", opts, expected, string(bb))
+		}
+	}
+
+	// Follow across rotation, until cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	rd, err := pod.Logs(name, &LogsOptions{Lines: 1, Follow: true, Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		bb, _ := ioutil.ReadAll(rd)
+		done <- string(bb)
+	}()
+	time.Sleep(2 * logFollowInterval)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("four\n")
+	f.Close()
+	time.Sleep(2 * logFollowInterval)
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("five\n"), 0640)
+	time.Sleep(2 * logFollowInterval)
+	cancel()
+	select {
+	case out := <-done:
+		if expected := "2016-01-01T12:00:00Z three\nfour\nfive\n"; out != expected {
+			t.Errorf("Follow: expected %#v, got %#v", expected, out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Follow didn't stop after cancel")
+	}
+}
@@ -1,29 +1,39 @@
 package jetpack
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os/user"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/pborman/uuid"
-
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
 	"github.com/juju/errors"
+	"github.com/pborman/uuid"
 )
 
 type MDSInfo struct {
 	Pid, Uid, Gid, Port int
 	Version, IP         string
+	Embedded            bool // served by `jetpack api`
 }
 
 func (mdsi *MDSInfo) String() string {
-	return fmt.Sprintf("MDS[%d] (u%d g%d %v:%d %v)",
-		mdsi.Pid, mdsi.Uid, mdsi.Gid, mdsi.IP, mdsi.Port, mdsi.Version)
+	embedded := ""
+	if mdsi.Embedded {
+		embedded = " embedded"
+	}
+	return fmt.Sprintf("MDS[%d] (u%d g%d %v:%d %v%v)",
+		mdsi.Pid, mdsi.Uid, mdsi.Gid, mdsi.IP, mdsi.Port, mdsi.Version, embedded)
 }
 
 var mdsUid = -1
@@ -160,7 +170,7 @@ func (h *Host) validateMDSInfo(mdsi *MDSInfo) error {
 		return errors.Errorf("Version mismatch: ours %v, mds %v", Version(), mdsi.Version)
 	}
 
-	if !Config().GetBool("mds.keep-uid", false) {
+	if !mdsi.Embedded && !Config().GetBool("mds.keep-uid", false) {
 		uid, gid := MDSUidGid()
 		if mdsi.Uid != uid {
 			return errors.Errorf("UID mismatch: should be %d, is %d", uid, mdsi.Uid)
@@ -199,3 +209,96 @@ func (h *Host) CheckMDS() (*MDSInfo, error) {
 
 	return mdsi, nil
 }
+
+// Returns false if the metadata service is disabled (mds.enable is
+// off): it's not checked, pods are not registered, and apps don't get
+// AC_METADATA_URL.
+func metadataEnabled() bool {
+	return Config().GetBool("mds.enable", true)
+}
+
+// Checks the metadata service, if it is enabled.
+func (h *Host) ensureMDS() error {
+	if !metadataEnabled() {
+		return nil
+	}
+	_, err := h.CheckMDS()
+	return errors.Trace(err)
+}
+
+// Returns pod's registration with the metadata service.
+func (pod *Pod) mdsRegistration() (*mdsRegistration, error) {
+	reg := &mdsRegistration{
+		UUID:     pod.UUID,
+		Manifest: pod.Manifest,
+		Images:   make(map[types.ACName]schema.ImageManifest, len(pod.Manifest.Apps)),
+	}
+	reg.IP, _ = pod.IPAddress()
+	for _, rtApp := range pod.Manifest.Apps {
+		img, err := pod.Host.getRuntimeImage(rtApp.Image)
+		if err != nil {
+			return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+		reg.Images[rtApp.Name] = img.Manifest
+	}
+	return reg, nil
+}
+
+// Registers pod with the metadata service, replacing its previous
+// registration, when its jail has started.
+func (pod *Pod) registerMetadata(started time.Time) error {
+	if !metadataEnabled() {
+		return nil
+	}
+	reg, err := pod.mdsRegistration()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	reg.Started = started
+	if ms := pod.Host.mds; ms != nil {
+		return errors.Trace(ms.register(reg))
+	}
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(mdsRegistrationRequest("PUT", pod.UUID, body))
+}
+
+// Deregisters pod from the metadata service; a pod that isn't
+// registered is fine.
+func (pod *Pod) deregisterMetadata() error {
+	if !metadataEnabled() {
+		return nil
+	}
+	if ms := pod.Host.mds; ms != nil {
+		ms.deregister(pod.UUID.String())
+		return nil
+	}
+	return errors.Trace(mdsRegistrationRequest("DELETE", pod.UUID, nil))
+}
+
+// Sends a registration request to the metadata service on mds.socket.
+func mdsRegistrationRequest(method string, id uuid.UUID, body []byte) error {
+	path := Config().MustGetString("mds.socket")
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}},
+	}
+	req, err := http.NewRequest(method, "http://mds/pods/"+id.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("Metadata service: %v %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,504 @@
+package jetpack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+)
+
+// The appc metadata service is served on the host's jail interface
+// address, port mds.port. It runs as a separate process (cmd/mds), or,
+// with mds.embed set, within `jetpack api`. A pod is registered with
+// the service, with its manifest, address, and apps' image manifests,
+// when its jail is started, and deregistered when it's stopped: by a
+// direct call within the embedding process, and otherwise by a request
+// on mds.socket (PUT or DELETE /pods/UUID). Registering a pod again
+// replaces its registration. When the service starts, it registers
+// all running pods, so that a restart loses nothing. A request is
+// served to the registered pod whose address it comes from; a request
+// from any other address gets 404. With mds.token-key set, paths are
+// prefixed with the pod's token (see MetadataURL). Endpoints under
+// /acMetadata/v1/:
+//
+//   pod/uuid                   pod's UUID
+//   pod/manifest               pod manifest
+//   pod/annotations            pod manifest's annotations
+//   apps/APP/image/id          app's image ID
+//   apps/APP/image/manifest    app's image manifest
+//   apps/APP/annotations       image's annotations, overridden by app's
+//   pod/hmac/sign              pod identity (see below)
+//   pod/hmac/verify
+//
+// GET /_info (with the host's token) returns MDSInfo, which `jetpack
+// mds` checks.
+//
+// Pod identity: each registered pod gets a random secret, which is
+// kept only in the service's memory. POST pod/hmac/sign with a content
+// form value returns base64 of HMAC-SHA512 of the content, keyed by the
+// calling pod's secret; POST pod/hmac/verify with uuid, content, and
+// signature form values returns 200 if the signature is the pod's with
+// that UUID, and 403 otherwise. The secret is replaced when the pod's
+// jail is started again, and forgotten when the pod is deregistered,
+// so signatures only verify while the pod that made them is running.
+
+// Serves the metadata service
+type MetadataServer struct {
+	Info MDSInfo
+	// Combined log of requests, if set
+	AccessLog io.Writer
+
+	h           *Host
+	srv         *http.Server
+	listener    net.Listener
+	regSrv      *http.Server
+	regListener net.Listener
+	regPath     string
+
+	mx      sync.RWMutex
+	pods    map[string]*mdsRegistration // by UUID
+	byIP    map[string]*mdsRegistration
+	secrets map[string][]byte // pod identity secrets, by UUID
+}
+
+// Pod's registration with the metadata service
+type mdsRegistration struct {
+	UUID     uuid.UUID
+	IP       string
+	Manifest schema.PodManifest
+	Images   map[types.ACName]schema.ImageManifest // by app name
+	Started  time.Time                             // jail's start; zero if unknown
+}
+
+// Length of pods' identity secrets
+const mdsSecretSize = sha512.BlockSize
+
+func newMetadataServer(h *Host) (*MetadataServer, error) {
+	ms := &MetadataServer{
+		h:       h,
+		pods:    make(map[string]*mdsRegistration),
+		byIP:    make(map[string]*mdsRegistration),
+		secrets: make(map[string][]byte),
+	}
+	ms.srv = &http.Server{Handler: ms}
+	ms.regSrv = &http.Server{Handler: http.HandlerFunc(ms.serveRegistration)}
+	ms.Info = MDSInfo{
+		Pid:     os.Getpid(),
+		Uid:     os.Getuid(),
+		Gid:     os.Getgid(),
+		Port:    Config().MustGetInt("mds.port"),
+		Version: Version(),
+	}
+	return ms, nil
+}
+
+// Returns HTTP handler of the metadata service, e.g. for serving on
+// another listener.
+func (h *Host) MetadataHandler() (http.Handler, error) {
+	ms, err := newMetadataServer(h)
+	return ms, errors.Trace(err)
+}
+
+// Listens on the host's jail interface address, port mds.port, and on
+// mds.socket, registers running pods, and returns server ready to
+// Serve. With embed, pods started by this process are registered
+// directly.
+func (h *Host) ListenMetadata(embed bool) (*MetadataServer, error) {
+	ms, err := newMetadataServer(h)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hostip, _, err := h.HostIP()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ms.Info.IP = hostip.String()
+	ms.Info.Embedded = embed
+	addr := net.JoinHostPort(ms.Info.IP, fmt.Sprint(ms.Info.Port))
+	if ms.listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, errors.Annotatef(err, "Cannot listen on %v", addr)
+	}
+
+	ms.regPath = Config().MustGetString("mds.socket")
+	if c, err := net.Dial("unix", ms.regPath); err == nil {
+		c.Close()
+		ms.listener.Close()
+		return nil, errors.Errorf("Metadata socket %v is in use", ms.regPath)
+	}
+	removeSocket(ms.regPath)
+	if ms.regListener, err = net.Listen("unix", ms.regPath); err != nil {
+		ms.listener.Close()
+		return nil, errors.Trace(err)
+	}
+	// Only root registers pods
+	if err := os.Chmod(ms.regPath, 0600); err != nil {
+		ms.listener.Close()
+		ms.regListener.Close()
+		return nil, errors.Trace(err)
+	}
+
+	ms.replay()
+	if embed {
+		h.mds = ms
+	}
+	return ms, nil
+}
+
+// Serves requests until Shutdown.
+func (ms *MetadataServer) Serve() error {
+	ms.h.log().Infof("Serving metadata on %v", ms.listener.Addr())
+	errch := make(chan error, 1)
+	go func() { errch <- ms.regSrv.Serve(ms.regListener) }()
+	err := ms.srv.Serve(ms.listener)
+	if err == http.ErrServerClosed {
+		err = <-errch
+	} else {
+		ms.regSrv.Close()
+	}
+	if err != http.ErrServerClosed {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Stops accepting requests, and waits for requests in progress to
+// finish or ctx to be done.
+func (ms *MetadataServer) Shutdown(ctx context.Context) error {
+	if ms.h.mds == ms {
+		ms.h.mds = nil
+	}
+	err := ms.srv.Shutdown(ctx)
+	if err2 := ms.regSrv.Shutdown(ctx); err == nil {
+		err = err2
+	}
+	removeSocket(ms.regPath)
+	return errors.Trace(err)
+}
+
+// Registers running pods, e.g. after a restart.
+func (ms *MetadataServer) replay() {
+	statuses, err := ms.h.jailStatuses(true)
+	if err != nil {
+		ms.h.log().Warnf("metadata: cannot find running pods: %v", err)
+		return
+	}
+	for _, pod := range ms.h.Pods() {
+		if podStatusOf(statuses[pod.jailName()]) != PodStatusRunning {
+			continue
+		}
+		if reg, err := pod.mdsRegistration(); err != nil {
+			pod.log().Warnf("metadata: cannot register: %v", err)
+		} else if err := ms.register(reg); err != nil {
+			pod.log().Warnf("metadata: cannot register: %v", err)
+		}
+	}
+}
+
+// Registers a pod, replacing its previous registration. The pod gets a
+// new secret, unless it's registered again for the same jail start.
+func (ms *MetadataServer) register(reg *mdsRegistration) error {
+	id := reg.UUID.String()
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	secret := ms.secrets[id]
+	if old := ms.pods[id]; old == nil || !old.Started.Equal(reg.Started) || reg.Started.IsZero() {
+		secret = make([]byte, mdsSecretSize)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	ms.unmapLocked(id)
+	ms.pods[id] = reg
+	ms.secrets[id] = secret
+	if reg.IP != "" {
+		ms.byIP[reg.IP] = reg
+	}
+	return nil
+}
+
+// Deregisters a pod; a pod that isn't registered is fine.
+func (ms *MetadataServer) deregister(id string) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.deregisterLocked(id)
+}
+
+func (ms *MetadataServer) deregisterLocked(id string) {
+	ms.unmapLocked(id)
+	if secret := ms.secrets[id]; secret != nil {
+		// Don't leave it in memory
+		for i := range secret {
+			secret[i] = 0
+		}
+		delete(ms.secrets, id)
+	}
+}
+
+// Removes pod's registration, but not its secret.
+func (ms *MetadataServer) unmapLocked(id string) {
+	if old := ms.pods[id]; old != nil {
+		if ms.byIP[old.IP] == old {
+			delete(ms.byIP, old.IP)
+		}
+		delete(ms.pods, id)
+	}
+}
+
+// Returns HMAC-SHA512 of content keyed by the pod's secret; nil if the
+// pod isn't registered.
+func (ms *MetadataServer) podHMAC(id uuid.UUID, content string) []byte {
+	ms.mx.RLock()
+	defer ms.mx.RUnlock()
+	secret := ms.secrets[id.String()]
+	if secret == nil {
+		return nil
+	}
+	h := hmac.New(sha512.New, secret)
+	h.Write([]byte(content))
+	return h.Sum(nil)
+}
+
+// Returns the registered pod with address ip, nil if there's none.
+func (ms *MetadataServer) podByIP(ip string) *mdsRegistration {
+	ms.mx.RLock()
+	defer ms.mx.RUnlock()
+	return ms.byIP[ip]
+}
+
+// Serves PUT and DELETE /pods/UUID on mds.socket.
+func (ms *MetadataServer) serveRegistration(w http.ResponseWriter, r *http.Request) {
+	id := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/pods/"))
+	if id == nil || !strings.HasPrefix(r.URL.Path, "/pods/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		var reg mdsRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if !uuid.Equal(reg.UUID, id) {
+			http.Error(w, "UUID mismatch", http.StatusBadRequest)
+			return
+		}
+		if err := ms.register(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ms.h.log().With("pod", id.String()).Debugf("metadata: registered at %v", reg.IP)
+	case "DELETE":
+		ms.deregister(id.String())
+		ms.h.log().With("pod", id.String()).Debugf("metadata: deregistered")
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns path without token, and the token ("" if there's none).
+func extractMetadataToken(path string) (string, string) {
+	if !strings.HasPrefix(path, "/~") {
+		return path, ""
+	}
+	pieces := strings.SplitN(path[2:], "/", 2)
+	if len(pieces) < 2 {
+		return "/", pieces[0]
+	}
+	return "/" + pieces[1], pieces[0]
+}
+
+// Response of the metadata service
+type mdsResponse struct {
+	status      int
+	body        []byte
+	contentType string
+}
+
+const mdsTextContentType = "text/plain; charset=us-ascii"
+
+func mdsText(status int, format string, args ...interface{}) *mdsResponse {
+	return &mdsResponse{status, []byte(fmt.Sprintf(format, args...)), mdsTextContentType}
+}
+
+func mdsJSON(v interface{}) *mdsResponse {
+	if bb, err := json.Marshal(v); err != nil {
+		return mdsError(err)
+	} else {
+		return &mdsResponse{http.StatusOK, bb, "application/json"}
+	}
+}
+
+func mdsStatus(status int) *mdsResponse {
+	return mdsText(status, "%v\n", http.StatusText(status))
+}
+
+func mdsError(err error) *mdsResponse {
+	return mdsText(http.StatusInternalServerError, "%v\n", err)
+}
+
+func (ms *MetadataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, token := extractMetadataToken(r.URL.Path)
+	user, resp := ms.serve(r, path, token)
+	if resp.status == http.StatusInternalServerError {
+		ms.h.log().With("op", "mds").Errorf("%v %v: %s", r.Method, path, resp.body)
+	}
+	if ms.AccessLog != nil {
+		// Combined log format, with the token stripped
+		fmt.Fprintf(ms.AccessLog, "%v - %v [%v] \"%v %v %v\" %d %d \"-\" %q\n",
+			clientIP(r), user, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, path, r.Proto, resp.status, len(resp.body), r.UserAgent())
+	}
+	w.Header().Set("Content-Type", resp.contentType)
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// Returns address of request's client.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Returns response, and user for the access log.
+func (ms *MetadataServer) serve(r *http.Request, path, token string) (string, *mdsResponse) {
+	if path == "/" {
+		// We introduce ourselves, no questions asked
+		return "-", mdsText(http.StatusOK, "Jetpack metadata service version %v\n", Version())
+	}
+
+	if path == "/_info" {
+		if !VerifyMetadataToken(uuid.NIL, token) {
+			return "-", mdsStatus(http.StatusForbidden)
+		}
+		return "host", mdsJSON(&ms.Info)
+	}
+
+	// All other requests need to come from a registered pod
+	pod := ms.podByIP(clientIP(r))
+	if pod == nil {
+		return "-", mdsStatus(http.StatusNotFound)
+	}
+	user := pod.UUID.String()
+	if !VerifyMetadataToken(pod.UUID, token) {
+		return user, mdsStatus(http.StatusForbidden)
+	}
+	if !strings.HasPrefix(path, "/acMetadata/v1/") {
+		return user, mdsStatus(http.StatusNotFound)
+	}
+	return user, ms.servePod(r, pod, strings.TrimPrefix(path, "/acMetadata/v1/"))
+}
+
+func (ms *MetadataServer) servePod(r *http.Request, pod *mdsRegistration, path string) *mdsResponse {
+	switch path {
+	case "pod/uuid":
+		return mdsText(http.StatusOK, "%v", pod.UUID)
+	case "pod/manifest":
+		return mdsJSON(pod.Manifest)
+	case "pod/annotations":
+		return mdsJSON(pod.Manifest.Annotations)
+	case "pod/hmac/sign":
+		return ms.sign(r, pod)
+	case "pod/hmac/verify":
+		return ms.verify(r)
+	}
+
+	if !strings.HasPrefix(path, "apps/") {
+		return mdsStatus(http.StatusNotFound)
+	}
+	pieces := strings.SplitN(strings.TrimPrefix(path, "apps/"), "/", 2)
+	if len(pieces) < 2 {
+		return mdsStatus(http.StatusNotFound)
+	}
+	rtApp := pod.Manifest.Apps.Get(types.ACName(pieces[0]))
+	if rtApp == nil {
+		return mdsStatus(http.StatusNotFound)
+	}
+	im, ok := pod.Images[rtApp.Name]
+	if !ok {
+		return mdsStatus(http.StatusNotFound)
+	}
+	switch pieces[1] {
+	case "image/id":
+		return mdsText(http.StatusOK, "%v", rtApp.Image.ID)
+	case "image/manifest":
+		return mdsJSON(im)
+	case "annotations":
+		anns := make(types.Annotations, len(im.Annotations))
+		copy(anns, im.Annotations)
+		for _, ann := range rtApp.Annotations {
+			anns.Set(ann.Name, ann.Value)
+		}
+		return mdsJSON(anns)
+	}
+	return mdsStatus(http.StatusNotFound)
+}
+
+func (ms *MetadataServer) sign(r *http.Request, pod *mdsRegistration) *mdsResponse {
+	if r.Method != "POST" {
+		return mdsStatus(http.StatusMethodNotAllowed)
+	}
+	content, ok := mdsFormValue(r, "content")
+	if !ok {
+		return mdsText(http.StatusBadRequest, "content form value not found\n")
+	}
+	sig := ms.podHMAC(pod.UUID, content)
+	if sig == nil {
+		// Deregistered meanwhile
+		return mdsStatus(http.StatusNotFound)
+	}
+	return mdsText(http.StatusOK, "%v", base64.StdEncoding.EncodeToString(sig))
+}
+
+func (ms *MetadataServer) verify(r *http.Request) *mdsResponse {
+	if r.Method != "POST" {
+		return mdsStatus(http.StatusMethodNotAllowed)
+	}
+	id := uuid.Parse(r.PostFormValue("uuid"))
+	if id == nil {
+		return mdsText(http.StatusBadRequest, "Invalid UUID: %#v\n", r.PostFormValue("uuid"))
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.PostFormValue("signature"))
+	if err != nil {
+		return mdsText(http.StatusBadRequest, "Invalid signature: %#v\n", r.PostFormValue("signature"))
+	}
+	content, ok := mdsFormValue(r, "content")
+	if !ok {
+		return mdsText(http.StatusBadRequest, "content form value not found\n")
+	}
+	if expected := ms.podHMAC(id, content); expected != nil && hmac.Equal(sig, expected) {
+		return mdsStatus(http.StatusOK)
+	}
+	return mdsStatus(http.StatusForbidden)
+}
+
+// Returns a POST form value, and whether it was sent; empty content
+// can be signed.
+func mdsFormValue(r *http.Request, key string) (string, bool) {
+	if err := r.ParseForm(); err != nil {
+		return "", false
+	}
+	vv, ok := r.PostForm[key]
+	if !ok || len(vv) == 0 {
+		return "", false
+	}
+	return vv[0], true
+}
@@ -0,0 +1,298 @@
+package jetpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestExtractMetadataToken(t *testing.T) {
+	for url, expected := range map[string][2]string{
+		"/acMetadata/v1/pod/uuid":         {"/acMetadata/v1/pod/uuid", ""},
+		"/~abc123/acMetadata/v1/pod/uuid": {"/acMetadata/v1/pod/uuid", "abc123"},
+		"/~abc123":                        {"/", "abc123"},
+	} {
+		if path, token := extractMetadataToken(url); path != expected[0] || token != expected[1] {
+			t.Errorf("%v: expected %v, got %v %v", url, expected, path, token)
+		}
+	}
+}
+
+func TestMetadataServer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	img := saveTestImage(t, h, "example.com/app")
+	img.Manifest.Annotations.Set("from", "image")
+
+	pod := newPod(h, nil)
+	pod.Manifest = *schema.BlankPodManifest()
+	pod.Manifest.Annotations.Set("pod", "annotation")
+	pod.Manifest.Apps = schema.AppList{{
+		Name:        "app",
+		Image:       schema.RuntimeImage{ID: *img.Hash},
+		Annotations: types.Annotations{{Name: "from", Value: "app"}},
+	}}
+
+	ms, err := newMetadataServer(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+	reg, err := pod.mdsRegistration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		bb, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(bb)
+	}
+
+	// Not a registered pod's address
+	reg.IP = "192.0.2.1"
+	if err := ms.register(reg); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get("/acMetadata/v1/pod/uuid"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown address, got %d", status)
+	}
+	if status, body := get("/_info"); status != http.StatusOK {
+		t.Errorf("Expected info, got %d %v", status, body)
+	} else {
+		var mdsi MDSInfo
+		if err := json.Unmarshal([]byte(body), &mdsi); err != nil || mdsi.Version != Version() {
+			t.Errorf("Unexpected info %v (%v)", body, err)
+		}
+	}
+
+	// Registering again replaces the registration
+	reg2 := *reg
+	reg2.IP = "127.0.0.1"
+	if err := ms.register(&reg2); err != nil {
+		t.Fatal(err)
+	}
+	if ms.podByIP("192.0.2.1") != nil || len(ms.pods) != 1 {
+		t.Errorf("Previous registration is left: %v", ms.byIP)
+	}
+	if status, body := get("/acMetadata/v1/pod/uuid"); status != http.StatusOK || body != pod.UUID.String() {
+		t.Errorf("Unexpected pod UUID %d %v", status, body)
+	}
+	if status, body := get("/acMetadata/v1/apps/app/image/id"); status != http.StatusOK || body != img.Hash.String() {
+		t.Errorf("Unexpected image ID %d %v", status, body)
+	}
+	var anns types.Annotations
+	if status, body := get("/acMetadata/v1/pod/annotations"); status != http.StatusOK {
+		t.Errorf("Unexpected pod annotations %d %v", status, body)
+	} else if err := json.Unmarshal([]byte(body), &anns); err != nil {
+		t.Error(err)
+	} else if v, _ := anns.Get("pod"); v != "annotation" {
+		t.Errorf("Unexpected pod annotations %v", anns)
+	}
+	if status, body := get("/acMetadata/v1/apps/app/annotations"); status != http.StatusOK {
+		t.Errorf("Unexpected app annotations %d %v", status, body)
+	} else if err := json.Unmarshal([]byte(body), &anns); err != nil {
+		t.Error(err)
+	} else if v, _ := anns.Get("from"); v != "app" {
+		t.Errorf("Unexpected app annotations %v", anns)
+	}
+	var im schema.ImageManifest
+	if status, body := get("/acMetadata/v1/apps/app/image/manifest"); status != http.StatusOK {
+		t.Errorf("Unexpected image manifest %d %v", status, body)
+	} else if err := json.Unmarshal([]byte(body), &im); err != nil {
+		t.Error(err)
+	} else if im.Name != img.Manifest.Name {
+		t.Errorf("Unexpected image manifest %v", body)
+	}
+	for _, path := range []string{"/acMetadata/v1/apps/other/image/id", "/acMetadata/v1/nothing", "/other", "/acMetadata/v1/apps/app"} {
+		if status, _ := get(path); status != http.StatusNotFound {
+			t.Errorf("%v: expected 404, got %d", path, status)
+		}
+	}
+	if status, _ := get("/~" + uuid.NewRandom().String() + "/acMetadata/v1/pod/uuid"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a wrong token, got %d", status)
+	}
+
+	ms.deregister(pod.UUID.String())
+	ms.deregister(pod.UUID.String())
+	if status, _ := get("/acMetadata/v1/pod/uuid"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 after deregistration, got %d", status)
+	}
+}
+
+func TestMetadataRegistration(t *testing.T) {
+	ms, err := newMetadataServer(&Host{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(ms.serveRegistration))
+	defer srv.Close()
+
+	id := uuid.NewRandom()
+	im := schema.BlankImageManifest()
+	im.Name = "example.com/app"
+	reg := &mdsRegistration{
+		UUID:     id,
+		IP:       "192.0.2.7",
+		Manifest: *schema.BlankPodManifest(),
+		Images:   map[types.ACName]schema.ImageManifest{"app": *im},
+	}
+	body, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string, body []byte) int {
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Twice, as after a crash
+	for i := 0; i < 2; i++ {
+		if status := do("PUT", "/pods/"+id.String(), body); status != http.StatusNoContent {
+			t.Fatalf("Registration failed: %d", status)
+		}
+	}
+	if got := ms.podByIP("192.0.2.7"); got == nil || !uuid.Equal(got.UUID, id) || got.Images["app"].Name != "example.com/app" {
+		t.Errorf("Unexpected registration %#v", got)
+	} else if len(ms.pods) != 1 {
+		t.Errorf("Unexpected registrations %v", ms.pods)
+	}
+	if status := do("PUT", "/pods/"+uuid.NewRandom().String(), body); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for mismatched UUID, got %d", status)
+	}
+	if status := do("PUT", "/pods/nope", body); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for invalid UUID, got %d", status)
+	}
+	if status := do("DELETE", "/pods/"+id.String(), nil); status != http.StatusNoContent {
+		t.Errorf("Deregistration failed: %d", status)
+	}
+	if ms.podByIP("192.0.2.7") != nil {
+		t.Error("Pod is still registered")
+	}
+}
+
+func TestMetadataIdentity(t *testing.T) {
+	ms, err := newMetadataServer(&Host{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+
+	started := time.Now()
+	reg := &mdsRegistration{UUID: uuid.NewRandom(), IP: "127.0.0.1", Started: started}
+	other := &mdsRegistration{UUID: uuid.NewRandom(), IP: "192.0.2.7", Started: started}
+	for _, r := range []*mdsRegistration{reg, other} {
+		if err := ms.register(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(path string, form url.Values) (int, string) {
+		resp, err := http.PostForm(srv.URL+"/acMetadata/v1/pod/hmac/"+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		bb, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(bb)
+	}
+	sign := func(content string) string {
+		status, sig := post("sign", url.Values{"content": {content}})
+		if status != http.StatusOK {
+			t.Fatalf("Cannot sign: %d %v", status, sig)
+		}
+		return sig
+	}
+	verify := func(id uuid.UUID, content, sig string) int {
+		status, _ := post("verify", url.Values{"uuid": {id.String()}, "content": {content}, "signature": {sig}})
+		return status
+	}
+
+	sig := sign("hello")
+	if status := verify(reg.UUID, "hello", sig); status != http.StatusOK {
+		t.Errorf("Expected signature to verify, got %d", status)
+	}
+	if status := verify(reg.UUID, "goodbye", sig); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for other content, got %d", status)
+	}
+	if status := verify(other.UUID, "hello", sig); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for other pod, got %d", status)
+	}
+	if status, _ := post("sign", url.Values{}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without content, got %d", status)
+	}
+	if sig := sign(""); sig == "" {
+		t.Error("Expected empty content to be signed")
+	}
+	if resp, err := http.Get(srv.URL + "/acMetadata/v1/pod/hmac/sign?content=hello"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+
+	// Registered again for the same start: same secret
+	if err := ms.register(&mdsRegistration{UUID: reg.UUID, IP: reg.IP, Started: started}); err != nil {
+		t.Fatal(err)
+	} else if status := verify(reg.UUID, "hello", sig); status != http.StatusOK {
+		t.Errorf("Expected signature to verify after repeated registration, got %d", status)
+	}
+	// Restarted: new secret
+	if err := ms.register(&mdsRegistration{UUID: reg.UUID, IP: reg.IP, Started: started.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	} else if status := verify(reg.UUID, "hello", sig); status != http.StatusForbidden {
+		t.Errorf("Expected 403 after restart, got %d", status)
+	}
+
+	sig = sign("hello")
+	ms.deregister(reg.UUID.String())
+	if _, ok := ms.secrets[reg.UUID.String()]; ok {
+		t.Error("Secret is kept after deregistration")
+	}
+	if status, _ := post("sign", url.Values{"content": {"hello"}}); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for deregistered pod, got %d", status)
+	}
+	// Verified by another pod, which is still registered
+	ms.register(&mdsRegistration{UUID: other.UUID, IP: "127.0.0.1", Started: started})
+	if status := verify(reg.UUID, "hello", sig); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for deregistered pod's signature, got %d", status)
+	}
+}
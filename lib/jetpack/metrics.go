@@ -0,0 +1,402 @@
+package jetpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// Metrics of the host and its pods, in Prometheus text format, served
+// by `jetpack metrics` on metrics.listen address. Each scrape runs a
+// fixed number of commands (jls, ps, zfs get) regardless of the
+// number of pods. If a collector fails, its last good samples are
+// served, and its jetpack_collector_success gauge is 0.
+//
+// Operation counters are kept in `counters.json` in host's dataset,
+// as operations are performed by separate jetpack processes.
+
+type metricSample struct {
+	labels []string // name, value, name, value...
+	value  float64
+}
+
+type metricFamily struct {
+	name, help, typ string
+	samples         []metricSample
+}
+
+func (mf *metricFamily) add(value float64, labels ...string) {
+	mf.samples = append(mf.samples, metricSample{labels, value})
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer, families []*metricFamily) error {
+	buf := &bytes.Buffer{}
+	for _, mf := range families {
+		fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v %v\n", mf.name, mf.help, mf.name, mf.typ)
+		for _, s := range mf.samples {
+			buf.WriteString(mf.name)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(buf, `%v="%v"`, s.labels[i], metricLabelEscaper.Replace(s.labels[i+1]))
+				}
+				buf.WriteByte('}')
+			}
+			fmt.Fprintf(buf, " %v\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Collects metrics families; name is used for jetpack_collector_success.
+type metricsCollector struct {
+	name    string
+	collect func(h *Host, pods []*Pod) ([]*metricFamily, error)
+}
+
+var metricsCollectors = []metricsCollector{
+	{"pods", collectPodStatus},
+	{"processes", collectPodProcesses},
+	{"zfs", collectDatasetUsage},
+	{"counters", collectOperationCounters},
+	{"limits", collectLimits},
+}
+
+type metricsHandler struct {
+	h    *Host
+	mx   sync.Mutex
+	last map[string][]*metricFamily // last good samples of collectors
+}
+
+// Returns HTTP handler serving host's metrics.
+func (h *Host) MetricsHandler() http.Handler {
+	return &metricsHandler{h: h, last: make(map[string][]*metricFamily)}
+}
+
+// Serves metrics on metrics.listen address; doesn't return unless
+// there's an error.
+func (h *Host) ServeMetrics() error {
+	addr := Config().GetString("metrics.listen", "")
+	if addr == "" || addr == "off" {
+		return errors.New("Metrics are disabled (metrics.listen is not set)")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h.MetricsHandler())
+	h.log().Infof("Serving metrics on %v", addr)
+	return errors.Trace(http.ListenAndServe(addr, mux))
+}
+
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mh.mx.Lock()
+	defer mh.mx.Unlock()
+
+	success := &metricFamily{name: "jetpack_collector_success", help: "Whether the collector succeeded; stale samples are served if not.", typ: "gauge"}
+	var families []*metricFamily
+	pods := mh.h.Pods()
+	// Refresh jail statuses once for all pods
+	if _, err := mh.h.getJailStatus("", true); err != nil {
+		mh.h.log().Warnf("metrics: cannot read jail status: %v", err)
+	}
+	for _, c := range metricsCollectors {
+		if mfs, err := c.collect(mh.h, pods); err != nil {
+			mh.h.log().Warnf("metrics: %v collector: %v", c.name, err)
+			success.add(0, "collector", c.name)
+			families = append(families, mh.last[c.name]...)
+		} else {
+			success.add(1, "collector", c.name)
+			mh.last[c.name] = mfs
+			families = append(families, mfs...)
+		}
+	}
+	families = append(families, success)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := writeMetrics(w, families); err != nil {
+		mh.h.log().Debugf("metrics: %v", err)
+	}
+}
+
+func collectPodStatus(h *Host, pods []*Pod) ([]*metricFamily, error) {
+	status := &metricFamily{name: "jetpack_pod_status", help: "Pod status (1 for the current one).", typ: "gauge"}
+	for _, pod := range pods {
+		st, err := pod.jailStatus(false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		current := PodStatusStopped
+		if st.Dying {
+			current = PodStatusDying
+		} else if st != NoJailStatus {
+			current = PodStatusRunning
+		}
+		for _, s := range []PodStatus{PodStatusRunning, PodStatusDying, PodStatusStopped} {
+			value := 0.0
+			if s == current {
+				value = 1
+			}
+			status.add(value, "pod", pod.UUID.String(), "status", s.String())
+		}
+	}
+	return []*metricFamily{status}, nil
+}
+
+// Per-jail totals of processes
+type jailProcesses struct {
+	count int
+	cpu   float64 // seconds
+	rssKB int64
+}
+
+func collectPodProcesses(h *Host, pods []*Pod) ([]*metricFamily, error) {
+	lines, err := systemCommand("/bin/ps", "-ax", "-o", "jid=", "-o", "cputime=", "-o", "rss=").OutputLines()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	jails, err := parseJailProcesses(lines)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	cpu := &metricFamily{name: "jetpack_pod_cpu_seconds_total", help: "CPU time of pod's current processes.", typ: "counter"}
+	mem := &metricFamily{name: "jetpack_pod_memory_bytes", help: "Resident memory of pod's processes.", typ: "gauge"}
+	procs := &metricFamily{name: "jetpack_pod_processes", help: "Number of pod's processes.", typ: "gauge"}
+	for _, pod := range pods {
+		st, err := pod.jailStatus(false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if st.Jid == 0 {
+			continue
+		}
+		jp := jails[st.Jid]
+		id := pod.UUID.String()
+		cpu.add(jp.cpu, "pod", id)
+		mem.add(float64(jp.rssKB*1024), "pod", id)
+		procs.add(float64(jp.count), "pod", id)
+	}
+	return []*metricFamily{cpu, mem, procs}, nil
+}
+
+func parseJailProcesses(lines []string) (map[int]jailProcesses, error) {
+	jails := make(map[int]jailProcesses)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("Cannot parse ps line %#v", line)
+		}
+		jid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		cpu, err := parseCPUTime(fields[1])
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		rss, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		jp := jails[jid]
+		jp.count++
+		jp.cpu += cpu
+		jp.rssKB += rss
+		jails[jid] = jp
+	}
+	return jails, nil
+}
+
+// Parses ps(1) cputime: [[DAYS-]HOURS:]MINUTES:SECONDS.FRACTION
+func parseCPUTime(str string) (float64, error) {
+	days := 0.0
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		d, err := strconv.Atoi(str[:i])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		days, str = float64(d), str[i+1:]
+	}
+	parts := strings.Split(str, ":")
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	mult := 60.0
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		secs += float64(n) * mult
+		mult *= 60
+	}
+	return secs + days*86400, nil
+}
+
+func collectDatasetUsage(h *Host, pods []*Pod) ([]*metricFamily, error) {
+	hdu, err := h.DiskUsage()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	podUsed := &metricFamily{name: "jetpack_pod_dataset_bytes", help: "Space used by pod's dataset.", typ: "gauge"}
+	podReferenced := &metricFamily{name: "jetpack_pod_dataset_referenced_bytes", help: "Space referenced by pod's dataset.", typ: "gauge"}
+	podLogical := &metricFamily{name: "jetpack_pod_dataset_logical_bytes", help: "Space used by pod's dataset before compression.", typ: "gauge"}
+	for _, pod := range pods {
+		if du, ok := hdu.ByPod[pod.UUID.String()]; ok {
+			podUsed.add(float64(du.Used), "pod", pod.UUID.String())
+			podReferenced.add(float64(du.Referenced), "pod", pod.UUID.String())
+			podLogical.add(float64(du.Logical), "pod", pod.UUID.String())
+		}
+	}
+	isu, err := h.ImageDiskUsage()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	images := &metricFamily{name: "jetpack_images", help: "Number of images.", typ: "gauge"}
+	imagesUsed := &metricFamily{name: "jetpack_images_bytes", help: "Space used by images.", typ: "gauge"}
+	imagesUnique := &metricFamily{name: "jetpack_images_unique_bytes", help: "Space destroying all images would free.", typ: "gauge"}
+	imageUsed := &metricFamily{name: "jetpack_image_dataset_bytes", help: "Space used by image's dataset.", typ: "gauge"}
+	imageReferenced := &metricFamily{name: "jetpack_image_referenced_bytes", help: "Space referenced by image's dataset.", typ: "gauge"}
+	imageLogical := &metricFamily{name: "jetpack_image_logical_bytes", help: "Space referenced by image's dataset before compression.", typ: "gauge"}
+	imageUnique := &metricFamily{name: "jetpack_image_unique_bytes", help: "Space destroying the image would free.", typ: "gauge"}
+	imageClones := &metricFamily{name: "jetpack_image_clones", help: "Pods and images cloned from the image.", typ: "gauge"}
+	ids := make([]string, 0, len(isu.ByImage))
+	for id := range isu.ByImage {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		idu := isu.ByImage[id]
+		imageUsed.add(float64(idu.Used), "image", id)
+		imageReferenced.add(float64(idu.Referenced), "image", id)
+		imageLogical.add(float64(idu.Logical), "image", id)
+		imageUnique.add(float64(idu.Unique), "image", id)
+		imageClones.add(float64(idu.Pods), "image", id, "kind", "pod")
+		imageClones.add(float64(idu.Images), "image", id, "kind", "image")
+	}
+	images.add(float64(len(ids)))
+	imagesUsed.add(float64(isu.Used))
+	imagesUnique.add(float64(isu.Unique))
+	return []*metricFamily{podUsed, podReferenced, podLogical, images, imagesUsed, imagesUnique,
+		imageUsed, imageReferenced, imageLogical, imageUnique, imageClones}, nil
+}
+
+func collectOperationCounters(h *Host, pods []*Pod) ([]*metricFamily, error) {
+	counters, err := h.operationCounters()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ops := &metricFamily{name: "jetpack_operations_total", help: "Operations performed on the host.", typ: "counter"}
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if op := strings.SplitN(key, "/", 2); len(op) == 2 {
+			ops.add(float64(counters[key]), "operation", op[0], "result", op[1])
+		}
+	}
+	return []*metricFamily{ops}, nil
+}
+
+func collectLimits(h *Host, pods []*Pod) ([]*metricFamily, error) {
+	usage, err := h.LimitsUsage()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	limit := &metricFamily{name: "jetpack_limit", help: "Host limit (0 if not limited).", typ: "gauge"}
+	used := &metricFamily{name: "jetpack_limit_usage", help: "Current use of host limit; available bytes for limits.min-free.", typ: "gauge"}
+	for _, lu := range usage {
+		limit.add(float64(lu.Max), "limit", lu.Limit)
+		used.add(float64(lu.Used), "limit", lu.Limit)
+	}
+	return []*metricFamily{limit, used}, nil
+}
+
+func (h *Host) countersPath() string {
+	return h.Path("counters.json")
+}
+
+func (h *Host) operationCounters() (map[string]uint64, error) {
+	counters := make(map[string]uint64)
+	f, err := os.Open(h.countersPath())
+	if os.IsNotExist(err) {
+		return counters, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if bb, err := ioutil.ReadAll(f); err != nil {
+		return nil, errors.Trace(err)
+	} else if len(bb) > 0 {
+		if err := json.Unmarshal(bb, &counters); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return counters, nil
+}
+
+// Counts an operation (e.g. "pod-create"), as success or failure
+// depending on err.
+func (h *Host) countOperation(op string, err error) {
+	if h.Dataset == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	if err := h.incrementCounter(op + "/" + result); err != nil {
+		h.log().Warnf("cannot update operation counters: %v", err)
+	}
+}
+
+func (h *Host) incrementCounter(key string) error {
+	f, err := os.OpenFile(h.countersPath(), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Trace(err)
+	}
+	counters := make(map[string]uint64)
+	if bb, err := ioutil.ReadAll(f); err != nil {
+		return errors.Trace(err)
+	} else if len(bb) > 0 {
+		if err := json.Unmarshal(bb, &counters); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	counters[key]++
+	bb, err := json.Marshal(counters)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return errors.Trace(err)
+	}
+	_, err = f.WriteAt(bb, 0)
+	return errors.Trace(err)
+}
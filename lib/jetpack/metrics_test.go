@@ -0,0 +1,80 @@
+package jetpack
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestParseCPUTime(t *testing.T) {
+	for str, expected := range map[string]float64{
+		"0:00.25":    0.25,
+		"12:34.50":   754.5,
+		"1:02:03.00": 3723,
+		"2-00:00:01": 172801,
+		"1234:00.00": 74040,
+	} {
+		if actual, err := parseCPUTime(str); err != nil {
+			t.Errorf("%#v: %v", str, err)
+		} else if actual != expected {
+			t.Errorf("%#v: expected %v, got %v", str, expected, actual)
+		}
+	}
+	if _, err := parseCPUTime("soon"); err == nil {
+		t.Error("Expected error for invalid time")
+	}
+}
+
+func TestParseJailProcesses(t *testing.T) {
+	jails, err := parseJailProcesses([]string{
+		"   0  0:01.00  1000",
+		"   3  0:00.50   200",
+		"   3  1:00.00   300",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jp := jails[3]; jp.count != 2 || jp.cpu != 60.5 || jp.rssKB != 500 {
+		t.Errorf("Unexpected jail 3 totals: %#v", jp)
+	}
+	if _, err := parseJailProcesses([]string{"garbage"}); err == nil {
+		t.Error("Expected error for invalid line")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	mf := &metricFamily{name: "jetpack_test", help: "Test.", typ: "gauge"}
+	mf.add(1, "pod", "a", "status", `we"ird`)
+	mf.add(0.5)
+	buf := &bytes.Buffer{}
+	if err := writeMetrics(buf, []*metricFamily{mf}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# HELP jetpack_test Test.\n# TYPE jetpack_test gauge\n" +
+		`jetpack_test{pod="a",status="we\"ird"} 1` + "\njetpack_test 0.5\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %#v, got %#v", expected, buf.String())
+	}
+}
+
+func TestOperationCounters(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	h.countOperation("pod-create", nil)
+	h.countOperation("pod-create", nil)
+	h.countOperation("pod-create", errors.New("oops"))
+	if counters, err := h.operationCounters(); err != nil {
+		t.Fatal(err)
+	} else if counters["pod-create/success"] != 2 || counters["pod-create/failure"] != 1 || len(counters) != 2 {
+		t.Errorf("Unexpected counters: %v", counters)
+	}
+}
@@ -0,0 +1,20 @@
+package jetpack
+
+import "github.com/juju/errors"
+
+// Returns mount points of mounted filesystems, in mount order.
+func mountPoints() ([]string, error) {
+	out, err := systemCommand("mount", "-p").OutputString()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	mounts, err := parseFstab(out)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rv := make([]string, len(mounts))
+	for i, mnt := range mounts {
+		rv[i] = mnt.Target
+	}
+	return rv, nil
+}
@@ -0,0 +1,8 @@
+// +build !freebsd
+
+package jetpack
+
+// Mounts are listed only on FreeBSD.
+func mountPoints() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,259 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Pod's network traffic counters. In and Out are from the pod's point
+// of view.
+type NetStats struct {
+	BytesIn    uint64 `json:"bytesIn"`
+	BytesOut   uint64 `json:"bytesOut"`
+	PacketsIn  uint64 `json:"packetsIn"`
+	PacketsOut uint64 `json:"packetsOut"`
+}
+
+func (ns NetStats) String() string {
+	return fmt.Sprintf("in %d bytes/%d packets, out %d bytes/%d packets",
+		ns.BytesIn, ns.PacketsIn, ns.BytesOut, ns.PacketsOut)
+}
+
+func (ns NetStats) add(other NetStats) NetStats {
+	return NetStats{
+		BytesIn:    ns.BytesIn + other.BytesIn,
+		BytesOut:   ns.BytesOut + other.BytesOut,
+		PacketsIn:  ns.PacketsIn + other.PacketsIn,
+		PacketsOut: ns.PacketsOut + other.PacketsOut,
+	}
+}
+
+// Counters are reset when the jail is restarted (pf anchor is
+// reloaded, epair is recreated), so last seen values are persisted in
+// the pod directory and added to the total when the jail is started
+// again.
+type netStatsState struct {
+	Total NetStats `json:"total"`
+	Last  NetStats `json:"last"`
+}
+
+func (pod *Pod) loadNetStatsState() (netStatsState, error) {
+	var st netStatsState
+	if bb, err := ioutil.ReadFile(pod.Path("netstats")); err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, &st); err != nil {
+		return st, errors.Trace(err)
+	}
+	return st, nil
+}
+
+func (pod *Pod) saveNetStatsState(st netStatsState) error {
+	if bb, err := json.Marshal(st); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(writeFileAtomic(pod.Path("netstats"), bb, 0644))
+	}
+}
+
+// Returns pod's traffic since the jail was started.
+func (pod *Pod) NetStats() (NetStats, error) {
+	if !pod.Host.settings().Network.Accounting {
+		return NetStats{}, errors.New("net.accounting is off")
+	}
+	if pod.Status() != PodStatusRunning {
+		return NetStats{}, errors.New("Pod is not running")
+	}
+
+	var ns NetStats
+	var err error
+	if _, isVNET := pod.VNETBridge(); isVNET {
+		ns, err = pod.vnetNetStats()
+	} else {
+		ns, err = pod.pfNetStats()
+	}
+	if err != nil {
+		return ns, errors.Trace(err)
+	}
+
+	if st, err := pod.loadNetStatsState(); err != nil {
+		return ns, errors.Trace(err)
+	} else {
+		st.Last = ns
+		return ns, errors.Trace(pod.saveNetStatsState(st))
+	}
+}
+
+// Returns pod's traffic over all jail runs.
+func (pod *Pod) NetStatsTotal() (NetStats, error) {
+	st, err := pod.loadNetStatsState()
+	if err != nil {
+		return NetStats{}, errors.Trace(err)
+	}
+	return st.Total.add(st.Last), nil
+}
+
+// Adds last seen counters to the total; called before jail is started.
+func (pod *Pod) rollNetStats() error {
+	if !pod.Host.settings().Network.Accounting {
+		return nil
+	}
+	st, err := pod.loadNetStatsState()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	st.Total = st.Total.add(st.Last)
+	st.Last = NetStats{}
+	return errors.Trace(pod.saveNetStatsState(st))
+}
+
+// Shared network stack: pf label rules
+//////////////////////////////////////////////////////////////////////////////
+
+func (pod *Pod) acctAnchor() string {
+	return pfAnchorPrefix + "acct/" + pod.UUID.String()
+}
+
+func (pod *Pod) acctRules() ([]string, error) {
+	ip, ok := pod.IPAddress()
+	if !ok {
+		return nil, errors.New("Pod has no IP address")
+	}
+	// match rules only count: whether the traffic passes is up to the
+	// operator's filter rules
+	return []string{
+		fmt.Sprintf("match inet from %v to any label \"%v:out\"", ip, pod.UUID),
+		fmt.Sprintf("match inet from any to %v label \"%v:in\"", ip, pod.UUID),
+	}, nil
+}
+
+// Loads pod's accounting anchor; called when jail is started.
+func (pod *Pod) loadAccounting() error {
+	if !pod.Host.settings().Network.Accounting {
+		return nil
+	}
+	if _, isVNET := pod.VNETBridge(); isVNET || pod.hostNetwork() {
+		// VNET pods are accounted on the epair; there's nothing to
+		// account for in host network
+		return nil
+	}
+
+	if err := pfCheckEnabled("net.accounting"); err != nil {
+		return errors.Trace(err)
+	}
+
+	rules, err := pod.acctRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	pod.log().Debugf("Loading pf anchor %v", pod.acctAnchor())
+	if err := pfLoadAnchor(pod.acctAnchor(), rules); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !pfMainReferences("rules", "anchor") {
+		pod.log().Warnf("pf anchor %v loaded, but the main ruleset has no `anchor \"%vacct/*\"` rule; traffic won't be accounted", pod.acctAnchor(), pfAnchorPrefix)
+	}
+	return nil
+}
+
+// Flushes pod's accounting anchor; called when jail is removed.
+func (pod *Pod) flushAccounting() error {
+	if !pod.Host.settings().Network.Accounting {
+		return nil
+	}
+	if _, isVNET := pod.VNETBridge(); isVNET || pod.hostNetwork() {
+		return nil
+	}
+	if enabled, err := pfEnabled(); err != nil || !enabled {
+		return nil
+	}
+	return errors.Trace(pfFlushAnchor(pod.acctAnchor()))
+}
+
+// Reads counters of the accounting rules. Packets of a state are
+// counted on the rule that created it: packets in the direction of
+// the first packet go to the first counter, replies to the second.
+func (pod *Pod) pfNetStats() (NetStats, error) {
+	var ns NetStats
+	lines, err := pfRules(pod.acctAnchor(), "labels")
+	if err != nil {
+		return ns, errors.Trace(err)
+	}
+	for _, line := range lines {
+		// label evaluations packets bytes packets-fwd bytes-fwd packets-rev bytes-rev states
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			return ns, errors.Errorf("Cannot parse pf label line %#v", line)
+		}
+		var counters [4]uint64
+		for i := range counters {
+			if counters[i], err = strconv.ParseUint(fields[4+i], 10, 64); err != nil {
+				return ns, errors.Annotatef(err, "Cannot parse pf label line %#v", line)
+			}
+		}
+		switch fields[0] {
+		case pod.UUID.String() + ":out":
+			ns.PacketsOut += counters[0]
+			ns.BytesOut += counters[1]
+			ns.PacketsIn += counters[2]
+			ns.BytesIn += counters[3]
+		case pod.UUID.String() + ":in":
+			ns.PacketsIn += counters[0]
+			ns.BytesIn += counters[1]
+			ns.PacketsOut += counters[2]
+			ns.BytesOut += counters[3]
+		}
+	}
+	return ns, nil
+}
+
+// VNET: epair counters
+//////////////////////////////////////////////////////////////////////////////
+
+type netstatOutput struct {
+	Statistics struct {
+		Interface []struct {
+			Name            string `json:"name"`
+			Network         string `json:"network"`
+			ReceivedPackets uint64 `json:"received-packets"`
+			ReceivedBytes   uint64 `json:"received-bytes"`
+			SentPackets     uint64 `json:"sent-packets"`
+			SentBytes       uint64 `json:"sent-bytes"`
+		} `json:"interface"`
+	} `json:"statistics"`
+}
+
+// Reads counters of the host side of pod's epair. What the host side
+// receives, the pod has sent.
+func (pod *Pod) vnetNetStats() (NetStats, error) {
+	var ns NetStats
+	hostSide, _ := pod.epairNames()
+	bb, err := systemCommand("/usr/bin/netstat", "--libxo", "json", "-b", "-n", "-I", hostSide).Output()
+	if err != nil {
+		return ns, errors.Trace(err)
+	}
+	var out netstatOutput
+	if err := json.Unmarshal(bb, &out); err != nil {
+		return ns, errors.Trace(err)
+	}
+	for _, ifstat := range out.Statistics.Interface {
+		if ifstat.Name == hostSide && strings.HasPrefix(ifstat.Network, "<Link#") {
+			ns.PacketsOut = ifstat.ReceivedPackets
+			ns.BytesOut = ifstat.ReceivedBytes
+			ns.PacketsIn = ifstat.SentPackets
+			ns.BytesIn = ifstat.SentBytes
+			return ns, nil
+		}
+	}
+	return ns, errors.Errorf("No link statistics for %v", hostSide)
+}
@@ -0,0 +1,53 @@
+package jetpack
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+// Removes from rootfs everything that is not in whitelist, or a parent
+// directory of a whitelisted path. Paths are absolute within rootfs.
+// Symlinks are not followed: a whitelisted symlink is kept, but its
+// target is not, unless it is whitelisted too.
+func applyPathWhitelist(rootfs string, whitelist []string) error {
+	keep := make(map[string]bool, len(whitelist))
+	for _, p := range whitelist {
+		for p = path.Clean("/" + p); p != "/"; p = path.Dir(p) {
+			keep[p] = true
+		}
+	}
+
+	var remove []string
+	err := filepath.Walk(rootfs, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, fpath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if !keep["/"+filepath.ToSlash(rel)] {
+			remove = append(remove, fpath)
+			if fi.IsDir() {
+				// Nothing inside is kept
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, fpath := range remove {
+		if err := os.RemoveAll(fpath); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
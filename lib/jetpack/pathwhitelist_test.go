@@ -0,0 +1,57 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyPathWhitelist(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	// Dependency's files, overlaid by image's own
+	writeTestFiles(t, rootfs, map[string]string{
+		"bin/sh":          "base",
+		"bin/app":         "app",
+		"etc/build.conf":  "build",
+		"secret/key":      "key",
+		"usr/lib/libx.so": "lib",
+		"usr/src/x.c":     "src",
+	})
+	if err := os.Symlink("../secret", filepath.Join(rootfs, "etc/keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyPathWhitelist(rootfs, []string{"/bin/app", "/etc/keys", "/etc/keys/key", "usr/lib/libx.so", "/no/such/file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if rel, _ := filepath.Rel(rootfs, path); err == nil && rel != "." {
+			found = append(found, rel)
+		}
+		return nil
+	})
+	expected := []string{"bin", "bin/app", "etc", "etc/keys", "usr", "usr/lib", "usr/lib/libx.so"}
+	if len(found) != len(expected) {
+		t.Fatalf("rootfs has %v, expected %v", found, expected)
+	}
+	for i := range found {
+		if found[i] != expected[i] {
+			t.Fatalf("rootfs has %v, expected %v", found, expected)
+		}
+	}
+	// Whitelisted symlink doesn't keep its target
+	if target, err := os.Readlink(filepath.Join(rootfs, "etc/keys")); err != nil || target != "../secret" {
+		t.Errorf("symlink is %#v (%v)", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/keys/key")); !os.IsNotExist(err) {
+		t.Errorf("symlink's target survived: %v", err)
+	}
+}
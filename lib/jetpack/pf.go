@@ -0,0 +1,515 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// Jetpack keeps its pf rules in anchors below `jetpack/`, so that the
+// operator's own pf.conf is never touched. The main ruleset needs to
+// reference them, e.g. with `nat-anchor "jetpack/*"`.
+const pfAnchorPrefix = "jetpack/"
+
+func pfctl(args ...string) *run.Cmd {
+	// pfctl is chatty on stderr ("No ALTQ support in kernel" etc)
+	return systemCommand("/sbin/pfctl", args...).Quiet()
+}
+
+// Returns true if pf is loaded and enabled.
+func pfEnabled() (bool, error) {
+	if lines, err := pfctl("-s", "info").OutputLines(); err != nil {
+		return false, errors.Trace(err)
+	} else {
+		for _, line := range lines {
+			if strings.HasPrefix(line, "Status:") {
+				return strings.HasPrefix(strings.TrimSpace(line[len("Status:"):]), "Enabled"), nil
+			}
+		}
+		return false, errors.New("Cannot find pf status in `pfctl -s info` output")
+	}
+}
+
+// Returns an actionable error if pf is not enabled.
+func pfCheckEnabled(feature string) error {
+	if enabled, err := pfEnabled(); err != nil {
+		return errors.Annotatef(err, "Cannot check pf status (needed by %v)", feature)
+	} else if !enabled {
+		return errors.Errorf("%v requires pf, but pf is disabled. Enable it with `service pf start` (and pf_enable=YES in rc.conf), or turn %v off.", feature, feature)
+	}
+	return nil
+}
+
+// Returns rules of a kind ("nat", "rules", ...) currently loaded into
+// the main ruleset (anchor == "") or an anchor.
+func pfRules(anchor, kind string) ([]string, error) {
+	args := []string{"-s", kind}
+	if anchor != "" {
+		args = append([]string{"-a", anchor}, args...)
+	}
+	return pfctl(args...).OutputLines()
+}
+
+// Returns true if the main ruleset references jetpack's anchors with
+// an anchor rule of given type (e.g. "nat-anchor").
+func pfMainReferences(kind, anchorRule string) bool {
+	lines, err := pfRules("", kind)
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, anchorRule+" \""+pfAnchorPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Atomically replaces contents of anchor with rules.
+func pfLoadAnchor(anchor string, rules []string) error {
+	return errors.Trace(
+		pfctl("-a", anchor, "-f", "-").
+			ReadFrom(strings.NewReader(strings.Join(rules, "\n") + "\n")).
+			Run())
+}
+
+// Removes all rules from the anchor.
+func pfFlushAnchor(anchor string) error {
+	return errors.Trace(pfctl("-a", anchor, "-F", "all").Run())
+}
+
+// Outbound NAT
+//////////////////////////////////////////////////////////////////////////////
+
+const pfNATAnchor = pfAnchorPrefix + "nat"
+
+// Returns networks that pods get their addresses from: the
+// `ips.pool.INTERFACE` network, or the interface's own network, of
+// jail.interface, of each configured pool, and of interfaces that
+// pods are bound to by their `jetpack/interface` annotation.
+func (h *Host) podNetworks() ([]*net.IPNet, error) {
+	ns := h.settings().Network
+	jailIf := ns.Interface
+	ifnames := map[string]bool{jailIf: true}
+	pools := ns.Pools
+	for ifname := range pools {
+		ifnames[ifname] = true
+	}
+	mm, _ := filepath.Glob(h.Path("pods/*/manifest"))
+	for _, m := range mm {
+		if id := uuid.Parse(filepath.Base(filepath.Dir(m))); id == nil {
+			continue
+		} else if ph, err := h.readPodHeader(id); err == nil && ph.Interface != "" {
+			ifnames[ph.Interface] = true
+		}
+	}
+
+	var names []string
+	for ifname := range ifnames {
+		names = append(names, ifname)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	var rv []*net.IPNet
+	for _, ifname := range names {
+		var ipnet *net.IPNet
+		if pool, ok := pools[ifname]; ok {
+			var err error
+			if _, ipnet, err = net.ParseCIDR(pool); err != nil {
+				return nil, errors.Annotatef(err, "ips.pool.%v", ifname)
+			}
+		} else if _, ifnet, err := interfaceIP(ifname); err == nil {
+			ipnet = ifnet
+		} else if ifname == jailIf {
+			return nil, errors.Trace(err)
+		} else {
+			// Pods bound to it won't start either
+			h.log().Warnf("no NAT for pods on %v: %v", ifname, err)
+			continue
+		}
+		if !seen[ipnet.String()] {
+			seen[ipnet.String()] = true
+			rv = append(rv, ipnet)
+		}
+	}
+	return rv, nil
+}
+
+func (h *Host) natRules() ([]string, error) {
+	extIf := h.settings().Network.ExternalInterface
+	if extIf == "" {
+		return nil, errors.New("nat.enable is on, but nat.external-interface is not set")
+	}
+
+	ipnets, err := h.podNetworks()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rules := make([]string, len(ipnets))
+	for i, ipnet := range ipnets {
+		rules[i] = fmt.Sprintf("nat on %v inet from %v to ! %v -> (%v)", extIf, ipnet, ipnet, extIf)
+	}
+	return rules, nil
+}
+
+// Ensures that NAT anchor is loaded and up to date, if nat.enable is
+// on. Last loaded ruleset is saved in the host directory to avoid
+// reloading the anchor every time a jail starts.
+func (h *Host) ensureNAT() error {
+	if !h.settings().Network.NAT {
+		return nil
+	}
+
+	if err := pfCheckEnabled("nat.enable"); err != nil {
+		return errors.Trace(err)
+	}
+
+	rules, err := h.natRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rulesStr := strings.Join(rules, "\n") + "\n"
+
+	savedPath := h.Path("nat.pf")
+	if saved, err := ioutil.ReadFile(savedPath); err == nil && string(saved) == rulesStr {
+		if loaded, err := pfRules(pfNATAnchor, "nat"); err == nil && len(loaded) > 0 {
+			// Rules didn't change and anchor is loaded
+			return nil
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+
+	h.log().Debugf("Loading pf anchor %v", pfNATAnchor)
+	if err := pfLoadAnchor(pfNATAnchor, rules); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !pfMainReferences("nat", "nat-anchor") {
+		h.log().Warnf("pf anchor %v loaded, but the main ruleset has no `nat-anchor \"%v*\"` rule; NAT won't be applied", pfNATAnchor, pfAnchorPrefix)
+	}
+
+	return errors.Trace(ioutil.WriteFile(savedPath, []byte(rulesStr), 0644))
+}
+
+// Port forwarding
+//////////////////////////////////////////////////////////////////////////////
+
+// PortForward describes a host port redirected to a pod's app port,
+// as requested by the pod manifest's ports section.
+type PortForward struct {
+	Name     types.ACName
+	App      types.ACName
+	Protocol string
+	HostPort uint
+	Port     uint
+	Count    uint
+}
+
+func (pf PortForward) String() string {
+	return fmt.Sprintf("%v/%v %v -> %v:%v", pf.Protocol, pf.portRange(pf.HostPort), pf.Name, pf.App, pf.portRange(pf.Port))
+}
+
+func (pf PortForward) portRange(port uint) string {
+	if pf.Count > 1 {
+		return fmt.Sprintf("%d:%d", port, port+pf.Count-1)
+	}
+	return fmt.Sprintf("%d", port)
+}
+
+// Conflict keys of all the host ports used by this forwarding
+func (pf PortForward) hostPortKeys() []string {
+	count := pf.Count
+	if count == 0 {
+		count = 1
+	}
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%v/%d", pf.Protocol, pf.HostPort+uint(i))
+	}
+	return keys
+}
+
+func (pf PortForward) rdrRule(extIf, ip string) string {
+	target := pf.portRange(pf.Port)
+	if pf.Count > 1 {
+		target = fmt.Sprintf("%d:*", pf.Port)
+	}
+	return fmt.Sprintf("rdr pass on %v inet proto %v from any to (%v) port %v -> %v port %v",
+		extIf, pf.Protocol, extIf, pf.portRange(pf.HostPort), ip, target)
+}
+
+// Pods that share host's network stack have nothing to forward to
+func (pod *Pod) hostNetwork() bool {
+	ip4, _ := pod.Manifest.Annotations.Get("jetpack/jail.conf/ip4")
+	return ip4 == "inherit"
+}
+
+// Returns port forwardings requested by the pod manifest.
+func (pod *Pod) PortForwards() ([]PortForward, error) {
+	if len(pod.Manifest.Ports) == 0 || pod.hostNetwork() {
+		return nil, nil
+	}
+	apps := pod.Apps()
+	pfs := make([]PortForward, 0, len(pod.Manifest.Ports))
+ports:
+	for _, ep := range pod.Manifest.Ports {
+		for _, app := range apps {
+			if app == nil {
+				continue
+			}
+			for _, port := range app.app.Ports {
+				if port.Name == ep.Name {
+					pf := PortForward{
+						Name:     ep.Name,
+						App:      app.Name,
+						Protocol: port.Protocol,
+						HostPort: ep.HostPort,
+						Port:     port.Port,
+						Count:    port.Count,
+					}
+					if pf.HostPort == 0 {
+						pf.HostPort = pf.Port
+					}
+					switch pf.Protocol {
+					case "tcp", "udp":
+					default:
+						return nil, errors.Errorf("Port %v: unsupported protocol %#v", ep.Name, port.Protocol)
+					}
+					pfs = append(pfs, pf)
+					continue ports
+				}
+			}
+		}
+		return nil, errors.Errorf("Exposed port %v not found in any app", ep.Name)
+	}
+	return pfs, nil
+}
+
+// Returns an error if any of pod's host ports is already forwarded to
+// another pod.
+func (pod *Pod) checkPortConflicts() error {
+	pfs, err := pod.PortForwards()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(pfs) == 0 {
+		return nil
+	}
+
+	used := make(map[string]string)
+	for _, pf := range pfs {
+		for _, key := range pf.hostPortKeys() {
+			if other, ok := used[key]; ok {
+				return errors.Errorf("Host port %v used by both %v and %v", key, other, pf.Name)
+			}
+			used[key] = pf.Name.String()
+		}
+	}
+
+	for _, other := range pod.Host.Pods() {
+		if uuid.Equal(other.UUID, pod.UUID) {
+			continue
+		}
+		opfs, err := other.PortForwards()
+		if err != nil {
+			// Broken pod won't get any forwardings anyway
+			continue
+		}
+		for _, opf := range opfs {
+			for _, key := range opf.hostPortKeys() {
+				if name, ok := used[key]; ok {
+					return errors.Errorf("Host port %v of %v is already forwarded to pod %v", key, name, other.UUID)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pod *Pod) rdrAnchor() string {
+	return pfAnchorPrefix + "rdr/" + pod.UUID.String()
+}
+
+// Loads pod's port forwarding anchor; called when jail is started.
+func (pod *Pod) loadPortForwards() error {
+	pfs, err := pod.PortForwards()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(pfs) == 0 {
+		return nil
+	}
+
+	if err := pfCheckEnabled("Port forwarding"); err != nil {
+		return errors.Trace(err)
+	}
+
+	extIf := pod.Host.settings().Network.ExternalInterface
+	if extIf == "" {
+		return errors.New("Pod exposes ports, but nat.external-interface is not set")
+	}
+
+	ip, ok := pod.IPAddress()
+	if !ok {
+		return errors.New("Pod has no IP address")
+	}
+	rules := make([]string, len(pfs))
+	for i, pf := range pfs {
+		rules[i] = pf.rdrRule(extIf, ip)
+	}
+
+	pod.log().Debugf("Loading pf anchor %v", pod.rdrAnchor())
+	if err := pfLoadAnchor(pod.rdrAnchor(), rules); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !pfMainReferences("nat", "rdr-anchor") {
+		pod.log().Warnf("pf anchor %v loaded, but the main ruleset has no `rdr-anchor \"%vrdr/*\"` rule; ports won't be forwarded", pod.rdrAnchor(), pfAnchorPrefix)
+	}
+	return nil
+}
+
+// Flushes pod's port forwarding anchor; called when jail is removed.
+func (pod *Pod) flushPortForwards() error {
+	if pfs, err := pod.PortForwards(); err != nil || len(pfs) == 0 {
+		return nil
+	}
+	if enabled, err := pfEnabled(); err != nil || !enabled {
+		// Nothing to flush
+		return nil
+	}
+	return errors.Trace(pfFlushAnchor(pod.rdrAnchor()))
+}
+
+// Returns rdr rules currently loaded for the pod.
+func (pod *Pod) LivePortForwards() ([]string, error) {
+	if pfs, err := pod.PortForwards(); err != nil || len(pfs) == 0 {
+		return nil, errors.Trace(err)
+	}
+	return pfRules(pod.rdrAnchor(), "nat")
+}
+
+// Isolation
+//////////////////////////////////////////////////////////////////////////////
+
+// With net.isolate on, jetpack keeps block rules for traffic between
+// running pods in the jetpack/isolate anchor. A pod accepts traffic
+// from other pods only if they're listed in its `jetpack/allow-from`
+// annotation: a comma-separated list of pod hostnames, UUIDs, or
+// CIDR networks. Only traffic from pod addresses is blocked, so the
+// host can always reach the pods, and pods can reach the host
+// (e.g. the metadata service).
+
+const pfIsolateAnchor = pfAnchorPrefix + "isolate"
+
+// Returns true if traffic from pod src is allowed by pod's
+// jetpack/allow-from annotation.
+func (pod *Pod) allowsFrom(src *Pod, srcIP net.IP) bool {
+	allowFrom, _ := pod.Manifest.Annotations.Get("jetpack/allow-from")
+	for _, allowed := range strings.Split(allowFrom, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(allowed); err == nil {
+			if ipnet.Contains(srcIP) {
+				return true
+			}
+		} else if allowed == src.Hostname() || allowed == src.UUID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns isolation rules for currently running pods. Rules are
+// sorted, so that the same set of pods always gives the same ruleset.
+func (h *Host) isolationRules() ([]string, error) {
+	if _, err := h.getJailStatus("", true); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	type podIP struct {
+		pod *Pod
+		ip  net.IP
+	}
+	var pods []podIP
+	for _, pod := range h.Pods() {
+		if pod.Status() != PodStatusRunning || pod.hostNetwork() {
+			continue
+		}
+		if ip, ok := pod.IPAddress(); ok {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				pods = append(pods, podIP{pod, parsed})
+			}
+		}
+	}
+
+	var rules []string
+	for _, dst := range pods {
+		var blocked []string
+		for _, src := range pods {
+			if uuid.Equal(src.pod.UUID, dst.pod.UUID) || dst.pod.allowsFrom(src.pod, src.ip) {
+				continue
+			}
+			blocked = append(blocked, src.ip.String())
+		}
+		if len(blocked) == 0 {
+			continue
+		}
+		sort.Strings(blocked)
+		rules = append(rules, fmt.Sprintf("block drop quick inet from { %v } to %v", strings.Join(blocked, " "), dst.ip))
+	}
+	sort.Strings(rules)
+	return rules, nil
+}
+
+// Brings jetpack/isolate anchor up to date with running pods, or
+// removes it if net.isolate is off.
+func (h *Host) updateIsolation() error {
+	savedPath := h.Path("isolate.pf")
+	if !h.settings().Network.Isolate {
+		if _, err := os.Stat(savedPath); os.IsNotExist(err) {
+			// Never enabled, or already removed
+			return nil
+		}
+		h.log().Debugf("Flushing pf anchor %v", pfIsolateAnchor)
+		if err := pfFlushAnchor(pfIsolateAnchor); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(os.Remove(savedPath))
+	}
+
+	if err := pfCheckEnabled("net.isolate"); err != nil {
+		return errors.Trace(err)
+	}
+
+	rules, err := h.isolationRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	h.log().Debugf("Loading pf anchor %v", pfIsolateAnchor)
+	if err := pfLoadAnchor(pfIsolateAnchor, rules); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !pfMainReferences("rules", "anchor") {
+		h.log().Warnf("pf anchor %v loaded, but the main ruleset has no `anchor \"%v*\"` rule; pods are not isolated", pfIsolateAnchor, pfAnchorPrefix)
+	}
+
+	return errors.Trace(ioutil.WriteFile(savedPath, []byte(strings.Join(rules, "\n")+"\n"), 0644))
+}
@@ -0,0 +1,72 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNATRules(t *testing.T) {
+	h, _, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	Config().Set("nat.external-interface", "em0")
+	Config().Set("ips.pool.lo1", "172.23.0.0/16")
+	Config().Set("ips.pool.lo2", "10.1.0.0/24")
+	Config().Set("ips.pool.lo3", "10.1.0.0/24")
+	defer Config().Set("nat.external-interface", "")
+	defer Config().Set("ips.pool.lo1", "")
+	defer Config().Set("ips.pool.lo2", "")
+	defer Config().Set("ips.pool.lo3", "")
+
+	expected := []string{
+		"nat on em0 inet from 172.23.0.0/16 to ! 172.23.0.0/16 -> (em0)",
+		"nat on em0 inet from 10.1.0.0/24 to ! 10.1.0.0/24 -> (em0)",
+	}
+	if rules, err := h.natRules(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %q, got %q", expected, rules)
+	}
+
+	// Pods bound to another interface get its network NATed
+	ifname, ipnet := testInterface(t)
+	pod := newPod(h, nil)
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	manifest := fmt.Sprintf(`{"acKind":"PodManifest","acVersion":"0.8.11","apps":[],"annotations":[{"name":"jetpack/interface","value":%q}]}`, ifname)
+	if err := ioutil.WriteFile(pod.Path("manifest"), []byte(manifest), 0400); err != nil {
+		t.Fatal(err)
+	}
+	rule := fmt.Sprintf("nat on em0 inet from %v to ! %v -> (em0)", ipnet, ipnet)
+	if rules, err := h.natRules(); err != nil {
+		t.Fatal(err)
+	} else if found := map[string]bool{}; len(rules) != 3 {
+		t.Errorf("Expected %q and %q, got %q", expected, rule, rules)
+	} else {
+		for _, r := range rules {
+			found[r] = true
+		}
+		if !found[rule] || !found[expected[0]] || !found[expected[1]] {
+			t.Errorf("Expected %q and %q, got %q", expected, rule, rules)
+		}
+	}
+}
+
+// Returns name and network of an interface with an IPv4 address.
+func testInterface(t *testing.T) (string, *net.IPNet) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifis {
+		if _, ipnet, err := interfaceIP(ifi.Name); err == nil && ipnet.IP.To4() != nil {
+			return ifi.Name, ipnet
+		}
+	}
+	t.Skip("No interface with IPv4 address")
+	return "", nil
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"os/signal"
 	"path"
 	"path/filepath"
 	"sort"
@@ -55,9 +55,10 @@ type Pod struct {
 	Host     *Host
 	Manifest schema.PodManifest
 
-	sealed bool
-	ui     *ui.UI
-	jailMx sync.Mutex
+	sealed       bool
+	ui           *ui.UI
+	jailMx       sync.Mutex
+	exitStatusMx sync.Mutex
 }
 
 func newPod(h *Host, id uuid.UUID) *Pod {
@@ -71,58 +72,209 @@ func newPod(h *Host, id uuid.UUID) *Pod {
 	}
 }
 
-func CreatePod(h *Host, pm *schema.PodManifest) (pod *Pod, rErr error) {
+func CreatePod(h *Host, pm *schema.PodManifest) (*Pod, error) {
+	return createPod(h, pm, nil)
+}
+
+// Optional settings of createPod
+type podCreateOptions struct {
+	uuid uuid.UUID // pod's UUID instead of a random one
+	ip   net.IP    // preferred IP address, used if it's free
+
+	// Snapshot to clone the first app's rootfs from, instead of its
+	// image (a cached build step)
+	rootfsSnapshot *zfs.Dataset
+
+	ignoreLimits bool // create the pod even if host limits are exceeded
+}
+
+func createPod(h *Host, pm *schema.PodManifest, opts *podCreateOptions) (pod *Pod, rErr error) {
+	if opts == nil {
+		opts = &podCreateOptions{}
+	}
 	if pm == nil {
 		return nil, errors.New("Pod manifest is nil")
 	}
 	if len(pm.Apps) == 0 {
 		return nil, errors.New("Pod manifest has no apps")
 	}
-	pod = newPod(h, nil)
+	defer func() { h.countOperation("pod-create", rErr) }()
+	// IP address and ports are allocated against other pods
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	if err := h.checkLimits(pm, opts.ignoreLimits); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i := 0; ; i++ {
+		pod = newPod(h, opts.uuid)
+		if collides, err := pod.collides(); err != nil {
+			return nil, errors.Trace(err)
+		} else if !collides {
+			break
+		} else if opts.uuid != nil {
+			return nil, errors.Errorf("Pod %v already exists", opts.uuid)
+		} else if i == podUUIDAttempts-1 {
+			return nil, errors.Errorf("Cannot find an unused pod UUID")
+		}
+		pod.log().Warnf("UUID is already in use, generating a new one")
+	}
 	pod.Manifest = *pm
 
-	pod.ui.Debug("Initializing dataset")
-	ds, err := h.Dataset.CreateDataset(path.Join("pods", pod.UUID.String()))
-	if err != nil {
+	if err := pod.checkPortConflicts(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := pod.checkMACAddress(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := pod.checkAppOptions(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ds *zfs.Dataset
+	if pod.Ephemeral() {
+		if opts.rootfsSnapshot != nil {
+			return nil, errors.New("Build pods can't be ephemeral")
+		}
+		pod.log().Debugf("Initializing directory")
+		if err := os.Mkdir(pod.Path(), 0750); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if ds, err = pod.createDataset(); err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	// If we haven't finished successfully, clean up the remains
 	defer func() {
 		if rErr != nil {
-			ds.Destroy("-r")
+			if err := pod.removeRemnants(ds); err != nil {
+				pod.log().Errorf("cannot remove remnants of failed creation: %v", err)
+			}
 		}
 	}()
+	if pod.Ephemeral() {
+		// Images' rootfs are mounted while the pod is created
+		defer func() {
+			if err := pod.unmountAll(); err != nil && rErr == nil {
+				rErr = errors.Trace(err)
+			}
+		}()
+	}
+
+	if err := pod.markCreating(); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	_, mdsGID := MDSUidGid()
-	if err := os.Chown(ds.Mountpoint, 0, mdsGID); err != nil {
+	if err := os.Chown(pod.Path(), 0, mdsGID); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	if err := os.Chmod(ds.Mountpoint, 0750); err != nil {
+	if err := os.Chmod(pod.Path(), 0750); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	if err := os.Mkdir(ds.Path("rootfs"), 0700); err != nil {
+	if err := os.Mkdir(pod.Path("rootfs"), 0700); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	if err := os.Mkdir(ds.Path("rootfs", "app"), 0755); err != nil {
+	if err := os.Mkdir(pod.Path("rootfs", "app"), 0755); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	var fstab []string
+	coredumpPolicy, err := pod.CoredumpPolicy()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Policy can't change once cores are (or aren't) mounted
+	pod.Manifest.Annotations.Set(coredumpAnnotation, coredumpPolicy)
+	if coredumpPolicy == CoredumpPod {
+		if err := os.Mkdir(pod.Path("cores"), 0777|os.ModeSticky); err != nil {
+			return nil, errors.Trace(err)
+		}
+		// Mkdir's mode is subject to umask
+		if err := os.Chmod(pod.Path("cores"), 0777|os.ModeSticky); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	var fstab []fstabEntry
+
+	if err := pod.resolveManagedVolumes(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if !Config().GetBool("allow.foreign-platform", false) {
+		if err := pod.checkPlatform(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if h.settings().Images.Verify {
+		if err := pod.verifyImages(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if err := pod.checkHostVolumes(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	extraMounts, err := pod.checkExtraMounts()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Host volumes whose source is a file
+	fileVolumes := make(map[types.ACName]bool)
 
 	if len(pod.Manifest.Volumes) > 0 {
 		for i, vol := range pod.Manifest.Volumes {
-			volPath := ds.Path("rootfs", "vol", vol.Name.String())
-			if err := os.MkdirAll(volPath, 0755); err != nil {
+			if _, isTmpfs := pod.volumeAnnotation(vol.Name, "tmpfs"); isTmpfs {
+				if vol.Kind != "empty" {
+					return nil, errors.Errorf("Volume %v: only empty volumes can be tmpfs", vol.Name)
+				}
+				// Mounted directly at the mount point
+				continue
+			}
+			volPath := pod.Path("rootfs", "vol", vol.Name.String())
+			if isFile, err := hostVolumeIsFile(vol); err != nil {
+				return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+			} else if isFile {
+				fileVolumes[vol.Name] = true
+				if pod.volumeCopied(vol.Name) {
+					if vol.ReadOnly == nil || !*vol.ReadOnly {
+						return nil, errors.Errorf("Volume %v: copied file volume needs to be read-only", vol.Name)
+					}
+					// Copied to mount points by prepJail
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(volPath), 0755); err != nil {
+					return nil, errors.Trace(err)
+				}
+				if err := ioutil.WriteFile(volPath, nil, 0644); err != nil {
+					return nil, errors.Trace(err)
+				}
+			} else if err := os.MkdirAll(volPath, 0755); err != nil {
 				return nil, errors.Trace(err)
 			}
 			switch vol.Kind {
 			case "empty":
-				pod.ui.Debugf("Creating volume.%v for volume %v", i, vol.Name)
-				if volds, err := ds.CreateDataset(fmt.Sprintf("volume.%v", i), "-omountpoint="+volPath); err != nil {
+				if pod.Ephemeral() {
+					// tmpfs scratch, mounted with perms below
+					continue
+				}
+				pod.log().Debugf("Creating volume.%v for volume %v", i, vol.Name)
+				volProps, err := pod.volumeZFSProps(vol.Name)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				volProps["mountpoint"] = volPath
+				if volds, err := createWithProperties(h.datasets(), ds.ChildName(fmt.Sprintf("volume.%v", i)), volProps, "volumes.zfs.* settings, jetpack/volume/"+vol.Name.String()+"/ annotations"); err != nil {
 					return nil, errors.Trace(err)
 				} else if err := volds.Set("jetpack:name", string(vol.Name)); err != nil {
 					return nil, errors.Trace(err)
@@ -132,70 +284,142 @@ func CreatePod(h *Host, pm *schema.PodManifest) (pod *Pod, rErr error) {
 				if vol.ReadOnly != nil && *vol.ReadOnly {
 					opts = "ro"
 				}
-				fstab = append(fstab, fmt.Sprintf("%v %v nullfs %v 0 0\n",
-					vol.Source, volPath, opts))
+				fstab = append(fstab, fstabEntry{vol.Source, volPath, "nullfs", opts, 0})
 			default:
 				return nil, errors.Errorf("Unknown volume kind: %v", vol.Kind)
 			}
 		}
 	}
 
+	// Image's directories at empty volumes' mount points
+	volumeModels := make(map[types.ACName][]volumeModel)
+	// Image directories to seed volumes from
+	volumeSeeds := make(map[types.ACName]string)
+	// Mount points of tmpfs volumes
+	tmpfsTargets := make(map[types.ACName]string)
+	// Copied file volumes: source and target
+	var fileCopies [][2]string
+
 	for i, rtApp := range pod.Manifest.Apps {
-		pod.ui.Debugf("Cloning rootfs.%d for app %v", i, rtApp.Name)
 		img, err := h.getRuntimeImage(rtApp.Image)
 		if err != nil {
 			return nil, errors.Annotate(err, rtApp.Image.ID.String())
 		}
 
-		appRootfs := ds.Path("rootfs", strconv.Itoa(i))
-		rootds, err := img.Clone(ds.ChildName(fmt.Sprintf("rootfs.%v", i)), appRootfs)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+		appRootfs := pod.Path("rootfs", strconv.Itoa(i))
+		// Ephemeral app's paths with scratch mounted over them
+		var writable []string
+		if pod.Ephemeral() {
+			pod.log().Debugf("Mounting rootfs.%d for app %v", i, rtApp.Name)
+			entries, err := pod.ephemeralRootfsFstab(i, img.Path("rootfs"), appRootfs)
+			if err != nil {
+				return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+			}
+			fstab = append(fstab, entries...)
+			for _, e := range entries {
+				if e.FSType == "unionfs" {
+					writable = append(writable, "/"+strings.TrimPrefix(e.Target, appRootfs+"/"))
+				}
+			}
+			// Mount points below are looked up in the read-only image;
+			// unmounted when creation is done
+			if err := os.Mkdir(appRootfs, 0755); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if err := mount(entries[0]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		} else {
+			pod.log().Debugf("Cloning rootfs.%d for app %v", i, rtApp.Name)
+			var rootds *zfs.Dataset
+			if i == 0 && opts.rootfsSnapshot != nil {
+				pod.log().Debugf("Cloning rootfs.0 from %v", opts.rootfsSnapshot.Name)
+				rootds, err = opts.rootfsSnapshot.Clone("", ds.ChildName("rootfs.0"), map[string]string{"mountpoint": appRootfs})
+			} else {
+				rootds, err = img.cloneTo(ds.ChildName(fmt.Sprintf("rootfs.%v", i)), appRootfs)
+			}
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
 
-		if err := rootds.Set("jetpack:name", string(rtApp.Name)); err != nil {
-			return nil, errors.Trace(err)
-		}
+			if err := rootds.Set("jetpack:name", string(rtApp.Name)); err != nil {
+				return nil, errors.Trace(err)
+			}
 
-		if _, err := rootds.Snapshot("parent"); err != nil {
-			return nil, errors.Trace(err)
+			if _, err := rootds.Snapshot("parent", nil); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			if pod.readonlyRootfs() {
+				if err := pod.createWritablePaths(ds, i, appRootfs); err != nil {
+					return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+				}
+			}
+		}
+		if err := img.markUsed(); err != nil {
+			pod.log().Warnf("Cannot record use of image %v: %v", img.ID(), err)
 		}
 
-		if err := os.Mkdir(ds.Path("rootfs", "app", rtApp.Name.String()), 0755); err != nil {
+		if err := os.Mkdir(pod.Path("rootfs", "app", rtApp.Name.String()), 0755); err != nil {
 			return nil, errors.Trace(err)
 		}
 
 		if err := os.Symlink(
 			filepath.Join("..", "..", strconv.Itoa(i)),
-			ds.Path("rootfs", "app", rtApp.Name.String(), "rootfs"),
+			pod.Path("rootfs", "app", rtApp.Name.String(), "rootfs"),
 		); err != nil {
 			return nil, errors.Trace(err)
 		}
 
-		app := rtApp.App
-		if app == nil {
-			app = img.Manifest.App
-		}
+		app := mergeApps(img.Manifest.App, rtApp.App)
 
 		// TODO: way to disable auto-devfs? Custom ruleset?
-		if err := os.Mkdir(filepath.Join(appRootfs, "dev"), 0555); err != nil && !os.IsExist(err) {
-			return nil, errors.Trace(err)
+		if err := pod.mkdirFSMountPoint(appRootfs, "dev", 0555); err != nil {
+			return nil, errors.Annotatef(err, "App %v", rtApp.Name)
 		}
 
+		os_, _ := img.Manifest.GetLabel("os")
+		isLinux := os_ == "linux"
+
 		devfsRuleset, devfsRulesetFound := pod.Manifest.Annotations.Get("jetpack/devfs-ruleset")
+		if !devfsRulesetFound && isLinux {
+			devfsRuleset, devfsRulesetFound = Config().Get("linux.devfs-ruleset")
+		}
 		if !devfsRulesetFound {
 			devfsRuleset = "4"
 		}
-		fstab = append(fstab, fmt.Sprintf(". %v devfs ruleset=%v 0 0\n", filepath.Join(appRootfs, "dev"), devfsRuleset))
+		fstab = append(fstab, fstabEntry{".", filepath.Join(appRootfs, "dev"), "devfs", fmt.Sprintf("ruleset=%v", devfsRuleset), 0})
 
-		if os_, _ := img.Manifest.GetLabel("os"); os_ == "linux" {
+		if isLinux {
 			for _, dir := range []string{"sys", "proc"} {
-				if err := os.MkdirAll(filepath.Join(appRootfs, dir), 0755); err != nil && !os.IsExist(err) {
-					return nil, errors.Trace(err)
+				if err := pod.mkdirFSMountPoint(appRootfs, dir, 0755); err != nil {
+					return nil, errors.Annotatef(err, "App %v", rtApp.Name)
 				}
 			}
-			fstab = append(fstab, fmt.Sprintf("linproc %v linprocfs rw 0 0\n", filepath.Join(appRootfs, "proc")))
-			fstab = append(fstab, fmt.Sprintf("linsys %v linsysfs  rw 0 0\n", filepath.Join(appRootfs, "sys")))
+			fstab = append(fstab, fstabEntry{"linproc", filepath.Join(appRootfs, "proc"), "linprocfs", "rw", 0})
+			fstab = append(fstab, fstabEntry{"linsys", filepath.Join(appRootfs, "sys"), "linsysfs", "rw", 0})
+			if size, ok := pod.linuxShmSize(); ok {
+				if opts, err := tmpfsMountOptions("size="+size, volumePerms{Mode: 0777 | os.ModeSticky}); err != nil {
+					return nil, errors.Annotate(err, "/dev/shm")
+				} else {
+					fstab = append(fstab, fstabEntry{"tmpfs", filepath.Join(appRootfs, "dev", "shm"), "tmpfs", opts, 0})
+				}
+			}
+		} else if pod.mountOption("procfs", false) {
+			if err := pod.mkdirFSMountPoint(appRootfs, "proc", 0555); err != nil {
+				return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+			}
+			fstab = append(fstab, fstabEntry{"proc", filepath.Join(appRootfs, "proc"), "procfs", "rw", 0})
+		}
+
+		// Linux pods get fdescfs by default
+		if pod.mountOption("fdescfs", isLinux) {
+			opts := "rw"
+			if isLinux {
+				opts = "rw,linrdlnk"
+			}
+			// dev/fd comes from devfs, sortFstab puts it after devfs
+			fstab = append(fstab, fstabEntry{"fdesc", filepath.Join(appRootfs, "dev", "fd"), "fdescfs", opts, 0})
 		}
 
 		for _, mnt := range rtApp.Mounts {
@@ -223,34 +447,172 @@ func CreatePod(h *Host, pm *schema.PodManifest) (pod *Pod, rErr error) {
 						return nil, errors.Errorf("Mount point %#v not found", mnt.Path)
 					}
 				}
-			} // TODO: (else?) { verify that target path exists }
+			}
+
+			if fileVolumes[mnt.Volume] {
+				if pod.Ephemeral() && pod.volumeCopied(mnt.Volume) {
+					// Created in the scratch by prepJail
+					if err := checkEphemeralFileCopy(appRootfs, filepath.Clean(path), writable); err != nil {
+						return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+					}
+				} else if err := pod.mkFileMountPoint(appRootfs, path); err != nil {
+					return nil, errors.Annotatef(err, "App %v, mount point %v", rtApp.Name, mnt.Path)
+				}
+				path = filepath.Join(appRootfs, path)
+				if pod.volumeCopied(mnt.Volume) {
+					for _, vol := range pod.Manifest.Volumes {
+						if vol.Name == mnt.Volume {
+							fileCopies = append(fileCopies, [2]string{vol.Source, path})
+						}
+					}
+					continue
+				}
+				opts := "rw"
+				if readOnly {
+					opts = "ro"
+				}
+				fstab = append(fstab, fstabEntry{pod.Path("rootfs", "vol", mnt.Volume.String()), path, "nullfs", opts, 1})
+				continue
+			}
+
+			var modelFi os.FileInfo
+			for _, vol := range pod.Manifest.Volumes {
+				if vol.Name == mnt.Volume && vol.Kind == "host" {
+					if fi, err := os.Stat(vol.Source); err != nil {
+						return nil, errors.Trace(err)
+					} else {
+						modelFi = fi
+					}
+				}
+			}
+
+			if fi, err := os.Stat(filepath.Join(appRootfs, path)); err == nil && fi.IsDir() {
+				volumeModels[mnt.Volume] = append(volumeModels[mnt.Volume], volumeModel{rtApp.Name, fileInfoPerms(fi)})
+				if _, ok := volumeSeeds[mnt.Volume]; !ok {
+					volumeSeeds[mnt.Volume] = filepath.Join(appRootfs, path)
+				}
+			}
 
+			if err := pod.mkdirMountPoint(appRootfs, path, modelFi); err != nil {
+				return nil, errors.Annotatef(err, "App %v, mount point %v", rtApp.Name, mnt.Path)
+			}
 			path = filepath.Join(appRootfs, path)
-			if err := os.MkdirAll(path, 0755); err != nil && !os.IsExist(err) {
-				return nil, errors.Trace(err)
+
+			if _, isTmpfs := pod.volumeAnnotation(mnt.Volume, "tmpfs"); isTmpfs {
+				if _, ok := tmpfsTargets[mnt.Volume]; ok {
+					// Separate mounts wouldn't share the data
+					return nil, errors.Errorf("Volume %v: tmpfs volume can be mounted only once", mnt.Volume)
+				}
+				tmpfsTargets[mnt.Volume] = path
+				continue
 			}
 
 			opts := "rw"
 			if readOnly {
 				opts = "ro"
 			}
-			fstab = append(fstab, fmt.Sprintf("%v %v nullfs %v 1 0\n",
-				ds.Path("rootfs", "vol", mnt.Volume.String()), path, opts))
+			fstab = append(fstab, fstabEntry{pod.Path("rootfs", "vol", mnt.Volume.String()), path, "nullfs", opts, 1})
+		}
+
+		if coredumpPolicy == CoredumpPod {
+			if err := pod.mkdirMountPoint(appRootfs, coresMountPoint, nil); err != nil {
+				return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+			}
+			fstab = append(fstab, fstabEntry{pod.Path("cores"), filepath.Join(appRootfs, coresMountPoint), "nullfs", "rw", 0})
+		}
+
+		if entries, err := pod.extraMountsFstab(extraMounts, appRootfs); err != nil {
+			return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+		} else {
+			fstab = append(fstab, entries...)
+		}
+
+		tmpMounted := false
+		for _, mnt := range rtApp.Mounts {
+			tmpMounted = tmpMounted || filepath.Clean(mnt.Path) == "/tmp"
+		}
+		for _, em := range extraMounts {
+			tmpMounted = tmpMounted || filepath.Clean(em.Target) == "/tmp"
+		}
+		if tmpMounted {
+			if _, ok := pod.TmpfsTmp(); ok {
+				pod.log().Debugf("App %v mounts a volume on /tmp, not mounting tmpfs", rtApp.Name)
+			}
+		} else if entry, err := pod.tmpfsTmpEntry(appRootfs); err != nil {
+			return nil, errors.Annotatef(err, "App %v", rtApp.Name)
+		} else if entry != nil {
+			fstab = append(fstab, *entry)
 		}
 
 		// TODO: verify app's unfulfilled mount points
 		// TODO: auto-mount mount points if volume of the same name exists?
 	}
 
-	if err := ioutil.WriteFile(pod.Path("fstab"), []byte(strings.Join(fstab, "")), 0400); err != nil {
+	for i, vol := range pod.Manifest.Volumes {
+		if vol.Kind != "empty" {
+			continue
+		}
+		union, _ := pod.volumeAnnotation(vol.Name, "perms")
+		perms, err := emptyVolumePerms(vol, volumeModels[vol.Name], union == "union")
+		if err != nil {
+			return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+		}
+		if tmpfsOpts, isTmpfs := pod.volumeAnnotation(vol.Name, "tmpfs"); isTmpfs {
+			if target, ok := tmpfsTargets[vol.Name]; !ok {
+				pod.log().Warnf("tmpfs volume %v is not mounted", vol.Name)
+			} else if opts, err := tmpfsMountOptions(tmpfsOpts, perms); err != nil {
+				return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+			} else {
+				fstab = append(fstab, fstabEntry{"tmpfs", target, "tmpfs", opts, 0})
+			}
+			perms.record(&pod.Manifest.Volumes[i])
+			continue
+		}
+		if pod.Ephemeral() {
+			if seed, _ := pod.volumeAnnotation(vol.Name, "seed"); seed == "true" {
+				return nil, errors.Errorf("Volume %v: volumes of ephemeral pods can't be seeded", vol.Name)
+			}
+			if opts, err := tmpfsMountOptions("size="+pod.ephemeralScratchSize(), perms); err != nil {
+				return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+			} else {
+				fstab = append(fstab, fstabEntry{"tmpfs", pod.Path("rootfs", "vol", vol.Name.String()), "tmpfs", opts, 0})
+			}
+			perms.record(&pod.Manifest.Volumes[i])
+			continue
+		}
+		if seed, _ := pod.volumeAnnotation(vol.Name, "seed"); seed == "true" {
+			if err := seedVolume(pod.Path("rootfs", "vol", vol.Name.String()), volumeSeeds[vol.Name]); err != nil {
+				return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+			}
+		}
+		if err := perms.apply(&pod.Manifest.Volumes[i], pod.Path("rootfs", "vol", vol.Name.String())); err != nil {
+			return nil, errors.Annotatef(err, "Volume %v", vol.Name)
+		}
+	}
+
+	if fstab, err = sortFstab(fstab); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if fstabStr, err := formatFstab(fstab); err != nil {
+		return nil, errors.Trace(err)
+	} else if err := ioutil.WriteFile(pod.Path("fstab"), []byte(fstabStr), 0400); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if fileCopiesStr, err := formatFileCopies(fileCopies); err != nil {
+		return nil, errors.Trace(err)
+	} else if err := ioutil.WriteFile(pod.Path("file-copies"), []byte(fileCopiesStr), 0400); err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	// FIXME: smarter IP allocation?
-	if ip, err := h.nextIP(); err != nil {
+	if pod.IsDHCP() {
+		pod.log().Debugf("Address will be configured by DHCP")
+	} else if ip, err := h.claimIP(pod.Interface(), opts.ip); err != nil {
 		return nil, errors.Trace(err)
 	} else {
-		pod.ui.Debug("Using IP", ip)
+		pod.log().Debugf("Using IP %v", ip)
 		pod.Manifest.Annotations.Set("ip-address", ip.String())
 	}
 
@@ -258,18 +620,115 @@ func CreatePod(h *Host, pm *schema.PodManifest) (pod *Pod, rErr error) {
 		return nil, errors.Trace(err)
 	}
 
-	pod.ui.Debug("Saving manifest")
-	if manifestJSON, err := json.Marshal(pod.Manifest); err != nil {
-		return nil, errors.Trace(err)
-	} else if err := ioutil.WriteFile(pod.Path("manifest"), manifestJSON, 0440); err != nil {
+	if err := pod.saveManifest(); err != nil {
 		return nil, errors.Trace(err)
-	} else if err := os.Chown(pod.Path("manifest"), 0, mdsGID); err != nil {
+	}
+	if err := pod.unmarkCreating(); err != nil {
 		return nil, errors.Trace(err)
 	}
 	pod.sealed = true
+	pod.logEvent(&Event{Type: EventCreate})
 	return pod, nil
 }
 
+// Creates dataset of a new pod, in its storage class.
+func (pod *Pod) createDataset() (*zfs.Dataset, error) {
+	zfsProps, err := podZFSProperties(&pod.Manifest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	storageClass := storageClassOf(&pod.Manifest)
+	podsName, err := pod.Host.ensurePodsDataset(storageClass)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Class can't change without moving the datasets
+	pod.Manifest.Annotations.Set(storageClassAnnotation, storageClass)
+	if storageClass != DefaultStorageClass {
+		zfsProps["mountpoint"] = pod.Path()
+	}
+
+	pod.log().Debugf("Initializing dataset")
+	ds, err := createWithProperties(pod.Host.datasets(), path.Join(podsName, pod.UUID.String()), zfsProps, "pods.zfs.* settings, "+zfsPropertiesAnnotation)
+	return ds, errors.Trace(err)
+}
+
+// Writes pod's manifest, readable by the metadata service.
+func (pod *Pod) saveManifest() error {
+	pod.log().Debugf("Saving manifest")
+	_, mdsGID := MDSUidGid()
+	if manifestJSON, err := json.Marshal(pod.Manifest); err != nil {
+		return errors.Trace(err)
+	} else if err := writeFileAtomic(pod.Path("manifest"), manifestJSON, 0440); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(os.Chown(pod.Path("manifest"), 0, mdsGID))
+	}
+}
+
+// Returns true if optional filesystem should be mounted in the pod's
+// apps: `jetpack/mount-NAME` annotation, or mount.NAME property if
+// the default is off.
+func (pod *Pod) mountOption(name string, def bool) bool {
+	if v, ok := pod.Manifest.Annotations.Get("jetpack/mount-" + name); ok {
+		return v == "true"
+	}
+	return def || Config().GetBool("mount."+name, false)
+}
+
+// Returns size of Linux pod's /dev/shm tmpfs (`jetpack/linux-shm`
+// annotation or linux.shm-size property), and false if it's off.
+func (pod *Pod) linuxShmSize() (string, bool) {
+	size, ok := pod.Manifest.Annotations.Get("jetpack/linux-shm")
+	if !ok {
+		size = Config().GetString("linux.shm-size", "off")
+	}
+	if size == "" || size == "off" {
+		return "", false
+	}
+	return size, true
+}
+
+// Creates mount point directory path inside rootfs, if it doesn't
+// exist. New directories get mode and ownership of modelFi if it's
+// not nil (for host volumes, it's the volume's source), or of the
+// nearest existing parent.
+func mkdirMountPoint(rootfs, path string, modelFi os.FileInfo) error {
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(filepath.Join(rootfs, dir)); err == nil {
+			if !fi.IsDir() {
+				return errors.Errorf("%v exists in rootfs and is not a directory", dir)
+			}
+			if modelFi == nil {
+				modelFi = fi
+			}
+			break
+		} else if !os.IsNotExist(err) || dir == "/" {
+			return errors.Trace(err)
+		}
+		missing = append(missing, dir)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		dirPath := filepath.Join(rootfs, missing[i])
+		if err := os.Mkdir(dirPath, modelFi.Mode().Perm()); err != nil {
+			return errors.Trace(err)
+		}
+		// Mkdir's mode is subject to umask
+		if err := os.Chmod(dirPath, modelFi.Mode().Perm()); err != nil {
+			return errors.Trace(err)
+		}
+		if st, ok := modelFi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(dirPath, int(st.Uid), int(st.Gid)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
 func LoadPod(h *Host, id uuid.UUID) (*Pod, error) {
 	if id == nil {
 		panic("No UUID provided")
@@ -292,6 +751,15 @@ func (pod *Pod) Path(elem ...string) string {
 	)...)
 }
 
+// Returns pod's IP address: the allocated one, or the one leased by
+// DHCP.
+func (pod *Pod) IPAddress() (string, bool) {
+	if pod.IsDHCP() {
+		return pod.dhcpAddress()
+	}
+	return pod.Manifest.Annotations.Get("ip-address")
+}
+
 func (pod *Pod) Exists() bool {
 	if _, err := os.Stat(pod.Path("manifest")); err != nil {
 		if os.IsNotExist(err) {
@@ -299,11 +767,12 @@ func (pod *Pod) Exists() bool {
 		}
 		panic(err)
 	}
-	return true
+	// Not finished creating
+	return !pod.isCreating()
 }
 
 func (pod *Pod) loadManifest() error {
-	pod.ui.Debug("Loading manifest")
+	pod.log().Debugf("Loading manifest")
 	manifestJSON, err := ioutil.ReadFile(pod.Path("manifest"))
 	if err != nil {
 		return errors.Trace(err)
@@ -333,8 +802,10 @@ func (pod *Pod) Load() error {
 		return errors.Errorf("No application set?")
 	}
 
-	if len(pod.Manifest.Isolators) != 0 {
-		return errors.Errorf("TODO: isolators are not supported")
+	for _, iso := range pod.Manifest.Isolators {
+		if !podIsolators[iso.Name] {
+			return errors.Errorf("Pod isolator %v is not supported", iso.Name)
+		}
 	}
 
 	pod.sealed = true
@@ -345,11 +816,15 @@ func (pod *Pod) jailConf() string {
 	parameters := map[string]string{
 		"exec.clean":    "true",
 		"host.hostuuid": pod.UUID.String(),
-		"interface":     Config().MustGetString("jail.interface"),
+		"interface":     pod.Interface(),
 		"path":          pod.Path("rootfs"),
 		"persist":       "true",
 		"mount.fstab":   pod.Path("fstab"),
 	}
+	if pod.Ephemeral() {
+		// Mounted by runJail, before prepJail writes to the rootfs
+		delete(parameters, "mount.fstab")
+	}
 
 	for pk, pv := range ConfigPrefix("ace.jailConf.") {
 		parameters[pk] = pv
@@ -361,10 +836,16 @@ func (pod *Pod) jailConf() string {
 		parameters["host.hostname"] = parameters["host.hostuuid"]
 	}
 
-	if ip, ok := pod.Manifest.Annotations.Get("ip-address"); ok {
-		parameters["ip4.addr"] = ip
-	} else {
+	if ip, ok := pod.Manifest.Annotations.Get("ip-address"); !ok && !pod.IsDHCP() {
 		panic(fmt.Sprintf("No IP address for pod %v", pod.UUID))
+	} else if _, isVNET := pod.VNETBridge(); isVNET {
+		// Address is configured inside the jail by configureVNET()
+		_, jailSide := pod.epairNames()
+		delete(parameters, "interface")
+		parameters["vnet"] = "new"
+		parameters["vnet.interface"] = jailSide
+	} else {
+		parameters["ip4.addr"] = ip
 	}
 
 	for _, antn := range pod.Manifest.Annotations {
@@ -382,11 +863,74 @@ func (pod *Pod) jailConf() string {
 	return fmt.Sprintf("%#v {\n%v\n}\n", pod.jailName(), strings.Join(lines, "\n"))
 }
 
+// Returns host interface the pod's address is bound to: value of
+// `jetpack/interface` annotation, or the jail.interface property.
+func (pod *Pod) Interface() string {
+	if ifname, ok := pod.Manifest.Annotations.Get("jetpack/interface"); ok {
+		return ifname
+	}
+	return pod.Host.settings().Network.Interface
+}
+
+func (pod *Pod) checkInterface() error {
+	if _, isVNET := pod.VNETBridge(); isVNET || pod.hostNetwork() {
+		return nil
+	}
+	ifname := pod.Interface()
+	if ifi, err := net.InterfaceByName(ifname); err != nil {
+		return errors.Annotatef(err, "Interface %v", ifname)
+	} else if ifi.Flags&net.FlagUp == 0 {
+		return errors.Errorf("Interface %v is down", ifname)
+	}
+	return nil
+}
+
 func (pod *Pod) prepJail() error {
+	pod.log().Debugf("Preparing jail")
+	if err := pod.checkInterface(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := pod.checkHostVolumes(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := pod.checkExtraMounts(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if pod.IsLinux() {
+		if err := checkLinuxSupport(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := pod.checkPlatform(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if pod.readonlyRootfs() {
+		// Unlock rootfs to write files below, lock it again at the end
+		if err := pod.setRootfsReadonly(false); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	pod.log().Debugf("Copying file volumes")
+	if err := pod.copyFileVolumes(); err != nil {
+		return errors.Trace(err)
+	}
+
+	pod.log().Debugf("Checking working directories")
+	if err := pod.checkWorkingDirectories(); err != nil {
+		return errors.Trace(err)
+	}
+
 	for _, app := range pod.Manifest.Apps {
 		etcPath := pod.Path("rootfs", "app", app.Name.String(), "rootfs", "etc")
 		if fi, err := os.Stat(etcPath); err == nil && fi.IsDir() {
 			// TODO: option (isolator?) to prevent creation of resolv.conf
+			pod.log().Debugf("Writing resolv.conf for %v", app.Name)
 			if dnsServers, ok := Config().Get("ace.dns-servers"); !ok {
 				// By default, copy /etc/resolv.conf from host
 				if bb, err := ioutil.ReadFile("/etc/resolv.conf"); err != nil {
@@ -406,6 +950,12 @@ func (pod *Pod) prepJail() error {
 			}
 		}
 	}
+
+	if pod.readonlyRootfs() {
+		if err := pod.setRootfsReadonly(true); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
@@ -413,44 +963,238 @@ func (pod *Pod) Status() PodStatus {
 	if status, err := pod.jailStatus(false); err != nil {
 		panic(err)
 	} else {
-		if status == NoJailStatus {
-			return PodStatusStopped
-		}
-		if status.Dying {
-			return PodStatusDying
-		}
-		return PodStatusRunning
+		return podStatusOf(status)
 	}
 }
 
+// Operations of jail(8) that runJail performs, for logging
+var jailOps = map[string]string{"-c": "start", "-r": "stop"}
+
 func (pod *Pod) runJail(op string) error {
+	if op == "-c" {
+		if pb, err := pod.Broken(); err != nil {
+			return errors.Trace(err)
+		} else if pb != nil {
+			return errors.Annotatef(ErrPodBroken, "Pod %v: %v", pod.UUID, pb)
+		}
+		if pod.Ephemeral() {
+			if err := pod.mountEphemeral(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
 	if err := pod.prepJail(); err != nil {
 		return err
 	}
+	if op == "-c" {
+		if err := pod.Host.ensureNAT(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := pod.setupVNET(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := pod.rollNetStats(); err != nil {
+			return errors.Trace(err)
+		}
+		if pod.Host.settings().Network.Isolate {
+			// Don't start a pod we can't isolate
+			if err := pfCheckEnabled("net.isolate"); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err := pod.checkRctl(); err != nil {
+			return errors.Trace(err)
+		}
+		pod.checkCoredump()
+	} else if op == "-r" && pod.Host.settings().Network.Accounting {
+		// Save last counters before they're gone
+		if _, err := pod.NetStats(); err != nil {
+			pod.log().Warnf("cannot read network statistics: %v", err)
+		}
+	}
 	verbosity := "-q"
 	if Config().GetBool("debug", false) {
 		verbosity = "-v"
 	}
-	pod.ui.Debug("Running: jail", op)
-	return run.Command("jail", "-f", pod.Path("jail.conf"), verbosity, op, pod.jailName()).Run()
+	log := pod.log().With("op", jailOps[op])
+	log.Debugf("Running: jail %v", op)
+	ev := &Event{Type: EventStart}
+	if op == "-r" {
+		ev.Type = EventStop
+	}
+	cmd := run.Command("jail", "-f", pod.Path("jail.conf"), verbosity, op, pod.jailName()).
+		Stream().WithTimeout(pod.Host.jailTimeout()).WithContext(pod.Host.context())
+	err := cmd.Run()
+	ev.traceCommand(cmd)
+	pod.Host.invalidateJailStatus(pod.jailName())
+	if run.IsTimeout(err) && op == "-c" {
+		// Don't leave a half-started jail behind
+		log.Errorf("jail %v timed out, removing the jail: %v", op, err)
+		ev.traceCommand(pod.removeJail(log))
+	}
+	if err != nil {
+		log.Errorf("jail %v failed: %v", op, err)
+		ev.Error = err.Error()
+		pod.logEvent(ev)
+		return err
+	}
+	log.Infof("Jail %v", map[string]string{"-c": "created", "-r": "removed"}[op])
+	pod.logEvent(ev)
+	switch op {
+	case "-c":
+		if err := pod.setupJail(); err != nil {
+			// Don't leave a pod without its limits, network or
+			// isolation running
+			log.Errorf("cannot set up jail, removing the jail: %v", err)
+			pod.abortJail(log)
+			return errors.Trace(err)
+		}
+		// Before any app runs
+		if err := pod.registerMetadata(time.Now()); err != nil {
+			pod.log().Warnf("cannot register with metadata service: %v", err)
+		}
+	case "-r":
+		if err := pod.stopSyslogForwarder(); err != nil {
+			pod.log().Warnf("cannot stop syslog forwarder: %v", err)
+		}
+		if err := pod.teardownVNET(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := pod.flushPortForwards(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := pod.flushAccounting(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := pod.flushRctl(); err != nil {
+			pod.log().Warnf("cannot remove rctl rules: %v", err)
+		}
+		if err := pod.Host.updateIsolation(); err != nil {
+			pod.log().Warnf("cannot update pod isolation rules: %v", err)
+		}
+	}
+	if err := pod.Host.updateHosts(); err != nil {
+		pod.log().Warnf("cannot update hosts registry: %v", err)
+	}
+	if op == "-c" {
+		pod.runHooks(hookPodStarted)
+	} else {
+		pod.runHooks(hookPodStopped)
+	}
+	return nil
+}
+
+// Sets up what a created jail needs before its apps run: rctl rules,
+// network, pf anchors and syslog forwarder.
+func (pod *Pod) setupJail() error {
+	if err := pod.loadRctl(); err != nil {
+		return errors.Annotate(err, "cannot add rctl rules")
+	}
+	if err := pod.configureVNET(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := pod.loadPortForwards(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := pod.loadAccounting(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := pod.Host.updateIsolation(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(pod.startSyslogForwarder())
+}
+
+// Removes a jail whose setup has failed, and everything setupJail may
+// have set up for it; problems are only logged.
+func (pod *Pod) abortJail(log Logger) {
+	pod.removeJail(log)
+	if err := pod.stopSyslogForwarder(); err != nil {
+		log.Warnf("cannot stop syslog forwarder: %v", err)
+	}
+	if err := pod.teardownVNET(); err != nil {
+		log.Warnf("cannot tear down VNET interface: %v", err)
+	}
+	if err := pod.flushPortForwards(); err != nil {
+		log.Warnf("cannot remove port forwards: %v", err)
+	}
+	if err := pod.flushAccounting(); err != nil {
+		log.Warnf("cannot remove accounting rules: %v", err)
+	}
+	if err := pod.flushRctl(); err != nil {
+		log.Warnf("cannot remove rctl rules: %v", err)
+	}
+	if err := pod.Host.updateIsolation(); err != nil {
+		log.Warnf("cannot update pod isolation rules: %v", err)
+	}
+}
+
+// Removes pod's jail after a failed start. It isn't cancelled with
+// host's commands, so that a half-started jail isn't left behind;
+// failure is only logged. Returns the jail(8) command that has run.
+func (pod *Pod) removeJail(log Logger) *run.Cmd {
+	rm := run.Command("jail", "-q", "-r", pod.jailName()).Stream().WithTimeout(pod.Host.jailTimeout())
+	if err := rm.Run(); err != nil {
+		log.Warnf("cannot remove jail: %v", err)
+	}
+	pod.Host.invalidateJailStatus(pod.jailName())
+	return rm
 }
 
-func (pod *Pod) Kill() error {
+func (pod *Pod) Kill() (rErr error) {
 	pod.ui.Println("Shutting down")
+	defer func() {
+		ev := &Event{Type: EventKill}
+		if rErr != nil {
+			ev.Error = rErr.Error()
+		}
+		pod.logEvent(ev)
+	}()
 	spin := ui.NewSpinner("Waiting for jail to die", ui.SuffixElapsed(), nil)
 	defer spin.Finish()
+	dying, appsStopped := false, false
+	// A jail stuck dying, or a jail(8) that hangs, fails the kill after
+	// timeout.jail with ErrTimeout, rather than block forever
+	timeout := pod.Host.jailTimeout()
+	started := time.Now()
 retry:
-	switch status := pod.Status(); status {
+	if timeout > 0 && time.Since(started) > timeout {
+		return errors.Annotatef(ErrTimeout, "Pod %v did not stop within %v", pod.UUID, timeout)
+	}
+	st, err := pod.jailStatus(true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch status := podStatusOf(st); status {
 	case PodStatusStopped:
-		// All's fine
+		// All's fine; the jail may have died without us
+		if err := pod.deregisterMetadata(); err != nil {
+			pod.log().Debugf("cannot deregister from metadata service: %v", err)
+		}
+		if pod.Ephemeral() {
+			// Everything apps wrote is gone with the scratch
+			return errors.Trace(pod.unmountAll())
+		}
 		return nil
 	case PodStatusRunning:
-		if err := pod.runJail("-r"); err != nil {
+		if !appsStopped {
+			pod.stopDetachedApps(timeout)
+			appsStopped = true
+		}
+		if err := pod.runJail("-r"); run.IsCanceled(err) {
+			return errors.Trace(err)
+		} else if run.IsTimeout(err) {
+			// The jail may be dying; wait for it, up to the timeout
+			pod.log().Warnf("removing jail timed out: %v", err)
+		} else if err != nil {
 			return errors.Trace(err)
 		}
 		goto retry
 	case PodStatusDying:
-		// TODO: UI? Log?
+		if !dying {
+			pod.log().Debugf("Waiting for jail to die")
+			dying = true
+		}
 		spin.Step()
 		time.Sleep(250 * time.Millisecond)
 		goto retry
@@ -461,29 +1205,88 @@ retry:
 
 // FIXME: multi-app pods
 func (pod *Pod) getDataset() *zfs.Dataset {
-	if ds, err := pod.Host.Dataset.GetDataset(path.Join("pods", pod.UUID.String())); err == zfs.ErrNotFound {
-		return nil
-	} else if err != nil {
-		panic(err)
-	} else {
-		return ds
+	for _, name := range pod.datasetNames() {
+		if ds, err := pod.Host.datasets().GetDataset(name); err == zfs.ErrNotFound {
+			continue
+		} else if err != nil {
+			panic(err)
+		} else {
+			return ds
+		}
 	}
+	return nil
 }
 
-func (pod *Pod) Destroy() error {
+func (pod *Pod) Destroy() (rErr error) {
 	pod.ui.Println("Destroying")
+	defer func() {
+		// Pod's event log is gone
+		ev := &Event{Type: EventDestroy, Pod: pod.UUID.String()}
+		if rErr != nil {
+			ev.Error = rErr.Error()
+		}
+		pod.Host.logEvent(ev)
+		pod.Host.countOperation("pod-destroy", rErr)
+	}()
+	unlock, err := pod.Host.lockShared()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
 	if jid := pod.Jid(); jid != 0 {
 		if err := pod.Kill(); err != nil {
 			// FIXME: plow through, ensure it's destroyed
 			return errors.Trace(err)
 		}
 	}
+	if err := pod.flushPortForwards(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := pod.stopSyslogForwarder(); err != nil {
+		pod.log().Warnf("cannot stop syslog forwarder: %v", err)
+	}
+	if err := pod.deregisterMetadata(); err != nil {
+		pod.log().Debugf("cannot deregister from metadata service: %v", err)
+	}
+	// The jail may have died without us
+	if err := pod.flushRctl(); err != nil {
+		pod.log().Debugf("cannot remove rctl rules: %v", err)
+	}
 	if ds := pod.getDataset(); ds != nil {
-		if err := ds.Destroy("-r"); err != nil {
+		if pod.readonlyRootfs() {
+			if err := pod.setRootfsReadonly(false); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		// A rootfs promoted when its image was destroyed by force has
+		// the image's clones
+		z := pod.Host.datasets()
+		if rootfses, err := z.Children(ds.Name, 1); err != nil {
 			return errors.Trace(err)
+		} else {
+			for _, rootfs := range rootfses {
+				if err := promoteClones(z, pod.log(), rootfs.Name, pod.UUID.String()); err != nil {
+					return errors.Trace(err)
+				}
+			}
 		}
+		if err := z.Destroy(ds.Name, true); err != nil {
+			return errors.Trace(err)
+		}
+	} else if err := pod.unmountAll(); err != nil {
+		// Removing the directory would remove images' files
+		return errors.Trace(err)
+	}
+	if err := os.RemoveAll(pod.Path()); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Remove(pod.Host.statsRingPath(pod.UUID.String())); err != nil && !os.IsNotExist(err) {
+		pod.log().Warnf("cannot remove stats history: %v", err)
 	}
-	return errors.Trace(os.RemoveAll(pod.Path()))
+	if err := pod.Host.updateHosts(); err != nil {
+		pod.log().Warnf("cannot update hosts registry: %v", err)
+	}
+	return nil
 }
 
 func (pod *Pod) jailName() string {
@@ -502,11 +1305,20 @@ func (pod *Pod) Jid() int {
 	}
 }
 
+// Returns jail ID, refreshing the jail status.
+func (pod *Pod) currentJid() int {
+	if status, err := pod.jailStatus(true); err != nil {
+		panic(err) // FIXME: better error flow
+	} else {
+		return status.Jid
+	}
+}
+
 // Return jail ID, start jail if necessary.
 func (pod *Pod) ensureJid() int {
 	pod.jailMx.Lock()
 	defer pod.jailMx.Unlock()
-	jid := pod.Jid()
+	jid := pod.currentJid()
 	if jid == 0 {
 		if err := errors.Trace(pod.runJail("-c")); err != nil {
 			panic(err)
@@ -519,6 +1331,21 @@ func (pod *Pod) ensureJid() int {
 	return jid
 }
 
+// Starts the pod's jail without running any app; does nothing if it
+// runs already. Returns ErrPodBusy if the jail is dying.
+func (pod *Pod) Start() error {
+	pod.jailMx.Lock()
+	defer pod.jailMx.Unlock()
+	if status, err := pod.jailStatus(true); err != nil {
+		return errors.Trace(err)
+	} else if status.Dying {
+		return errors.Annotatef(ErrPodBusy, "Pod %v is dying", pod.UUID)
+	} else if status.Jid != 0 {
+		return nil
+	}
+	return errors.Trace(pod.runJail("-c"))
+}
+
 func (pod *Pod) MetadataURL() (string, error) {
 	mds, err := pod.Host.MetadataURL(pod.UUID)
 	return mds, errors.Trace(err)
@@ -530,16 +1357,16 @@ func (pod *Pod) App(name types.ACName) *App {
 		return nil
 	}
 	app := rtapp.App
+	if img, err := pod.Host.getRuntimeImage(rtapp.Image); err == nil {
+		app = mergeApps(img.Manifest.App, rtapp.App)
+	} else if app == nil {
+		// FIXME: Report error to UI? Panic?
+		return nil
+	}
 	if app == nil {
-		img, err := pod.Host.getRuntimeImage(rtapp.Image)
-		if err != nil {
-			// FIXME: Report error to UI? Panic?
-			return nil
-		}
-		app = img.Manifest.App
-		if app == nil {
-			app = ConsoleApp("root")
-		}
+		// Image without an app; it can't be run, but console can be
+		// opened.
+		app = &types.App{User: "0", Group: "0"}
 	}
 	return &App{Name: name, Pod: pod, app: app}
 }
@@ -554,14 +1381,19 @@ func (pod *Pod) Apps() []*App {
 
 // Runs all the apps in parallel, with closed stdin & piped/logged
 // stdout and stderr
-func (pod *Pod) Run() error {
+func (pod *Pod) Run(opts *RunOptions) error {
 	// This is repeated in App.Run(); should we sync.Once it?
-	if _, err := pod.Host.CheckMDS(); err != nil {
+	if err := pod.Host.ensureMDS(); err != nil {
 		return errors.Trace(err)
 	}
 
 	// Context
 	apps := pod.Apps()
+	for _, app := range apps {
+		if _, err := app.command(opts); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	prefixes := make(map[*drain.Writer]string)
 	writers := make(map[*App][2]*drain.Writer)
 	dr := make(drain.Drain)
@@ -586,20 +1418,7 @@ func (pod *Pod) Run() error {
 		done <- struct{}{}
 	}()
 
-	// Signal handler
-	sigch := make(chan os.Signal, 1)
-	go func() {
-		if sig := <-sigch; sig != nil {
-			for _, app := range apps {
-				app.Kill()
-			}
-		}
-	}()
-	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL, syscall.SIGQUIT)
-	defer func() {
-		signal.Stop(sigch)
-		sigch <- nil
-	}()
+	// Signals are forwarded to the apps by App.Stage2
 
 	// Start the app goroutines
 	wg.Add(len(apps))
@@ -608,9 +1427,12 @@ func (pod *Pod) Run() error {
 			defer wg.Done()
 			defer writers[app][0].Close()
 			defer writers[app][1].Close()
-			if err := app.Run(nil, writers[app][0], writers[app][1]); err != nil {
+			if es, err := app.Run(nil, writers[app][0], writers[app][1], opts); err != nil {
 				pod.ui.Printf("%v: error: %v", app.Name, err)
 				errs[app] = err
+			} else if err := es.Err(); err != nil {
+				pod.ui.Printf("%v: %v", app.Name, es)
+				errs[app] = err
 			}
 		}(app)
 	}
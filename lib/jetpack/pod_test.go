@@ -0,0 +1,142 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+	"github.com/3ofcoins/jetpack/lib/zfs/zfstest"
+)
+
+// Returns a host in a temporary directory, with its datasets in a fake.
+func fakeZFSHost(t *testing.T) (*Host, *zfstest.Fake, func()) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := zfstest.NewFake("zroot")
+	if _, err := f.CreateDataset("zroot/jetpack", map[string]string{"mountpoint": tmp}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"pods", "images"} {
+		if _, err := f.CreateDataset("zroot/jetpack/"+dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(tmp+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Ops = nil
+	h := &Host{Dataset: &zfs.Dataset{Name: "zroot/jetpack", Mountpoint: tmp}, ZFS: f}
+	return h, f, func() { os.RemoveAll(tmp) }
+}
+
+// Creates a pod's directory and its dataset with one app's rootfs.
+func fakeZFSPod(t *testing.T, h *Host, f *zfstest.Fake) *Pod {
+	pod := newPod(h, nil)
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ds := h.Dataset.ChildName("pods/" + pod.UUID.String())
+	if _, err := f.CreateDataset(ds, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CreateDataset(ds+"/rootfs.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func TestPodDestroy(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	pod := fakeZFSPod(t, h, f)
+	ds := h.Dataset.ChildName("pods/" + pod.UUID.String())
+	f.Ops = nil
+	if err := pod.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Exists(ds) || f.Exists(ds+"/rootfs.0") {
+		t.Errorf("Pod's datasets not destroyed: %v", f.Names())
+	}
+	if _, err := os.Stat(pod.Path()); !os.IsNotExist(err) {
+		t.Errorf("Pod's directory not removed: %v", err)
+	}
+	if len(f.Ops) != 1 || f.Ops[0] != "destroy -r "+ds {
+		t.Errorf("Unexpected operations: %q", f.Ops)
+	}
+}
+
+func TestPodDestroyBusy(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	pod := fakeZFSPod(t, h, f)
+	ds := h.Dataset.ChildName("pods/" + pod.UUID.String())
+	f.SetBusy(ds+"/rootfs.0", true)
+	err := pod.Destroy()
+	if zfs.KindOf(err) != zfs.ErrorBusy {
+		t.Fatalf("Expected busy error, got %v", err)
+	}
+	if !f.Exists(ds + "/rootfs.0") {
+		t.Error("Busy dataset destroyed")
+	}
+	if _, err := os.Stat(pod.Path()); err != nil {
+		t.Errorf("Pod's directory removed after failed destroy: %v", err)
+	}
+
+	f.SetBusy(ds+"/rootfs.0", false)
+	if err := pod.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPodDestroyPromotesClones(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	// Rootfs that took over a destroyed image's snapshot, which
+	// another pod's rootfs is cloned from
+	pod := fakeZFSPod(t, h, f)
+	rootfs := h.Dataset.ChildName("pods/" + pod.UUID.String() + "/rootfs.0")
+	if err := f.Snapshot(rootfs, imageSnapshotName, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := fakeZFSPod(t, h, f)
+	otherRootfs := h.Dataset.ChildName("pods/" + other.UUID.String() + "/rootfs.1")
+	if _, err := f.Clone(rootfs+"@"+imageSnapshotName, otherRootfs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Destroying the snapshot alone is refused
+	if err := f.Destroy(rootfs+"@"+imageSnapshotName, false); zfs.KindOf(err) != zfs.ErrorHasClones {
+		t.Fatalf("Expected has-clones error, got %v", err)
+	}
+
+	f.Ops = nil
+	if err := pod.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Exists(rootfs) {
+		t.Errorf("Rootfs not destroyed: %v", f.Names())
+	}
+	if !f.Exists(otherRootfs + "@" + imageSnapshotName) {
+		t.Errorf("Snapshot not moved to the clone: %v", f.Names())
+	}
+	if ds, err := f.GetDataset(otherRootfs); err != nil {
+		t.Fatal(err)
+	} else if ds.Origin != "" {
+		t.Errorf("Clone not promoted, origin %v", ds.Origin)
+	}
+	if len(f.Ops) != 2 || f.Ops[0] != "promote "+otherRootfs {
+		t.Errorf("Unexpected operations: %q", f.Ops)
+	}
+}
@@ -0,0 +1,124 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// A pod that is being created has a `creating` marker in its
+// directory, holding pid of the creating process. The marker is
+// removed only after the manifest is saved; until then, the pod
+// doesn't exist for Load and listings. If creation fails, its
+// remnants are removed; markers left by a crash are swept at host
+// startup once they're older than gc.creation-timeout.
+
+const podCreatingMarker = "creating"
+
+// Attempts to find an unused UUID before giving up
+const podUUIDAttempts = 5
+
+// Returns true if anything already exists for the pod's UUID: a
+// dataset in any storage class, a directory, or a jail.
+func (pod *Pod) collides() (bool, error) {
+	podsDatasets, err := pod.Host.podsDatasets()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	for _, name := range podsDatasets {
+		if _, err := pod.Host.datasets().GetDataset(path.Join(name, pod.UUID.String())); err == nil {
+			return true, nil
+		} else if err != zfs.ErrNotFound {
+			return false, errors.Trace(err)
+		}
+	}
+	if _, err := os.Lstat(pod.Path()); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, errors.Trace(err)
+	}
+	if status, err := pod.Host.getJailStatus(pod.jailName(), true); err != nil {
+		return false, errors.Trace(err)
+	} else if status != NoJailStatus {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Returns true if pod has a creation marker.
+func (pod *Pod) isCreating() bool {
+	_, err := os.Lstat(pod.Path(podCreatingMarker))
+	return err == nil
+}
+
+func (pod *Pod) markCreating() error {
+	return errors.Trace(ioutil.WriteFile(pod.Path(podCreatingMarker), []byte(strconv.Itoa(os.Getpid())+"\n"), 0400))
+}
+
+func (pod *Pod) unmarkCreating() error {
+	return errors.Trace(os.Remove(pod.Path(podCreatingMarker)))
+}
+
+// Removes remains of a pod whose creation failed: its dataset (if
+// ds is not nil) and its directory, or, without a dataset, whatever is
+// mounted in the directory. If the dataset can't be destroyed, or
+// mounts can't be unmounted, the directory and its creation marker are
+// left for the startup sweep.
+func (pod *Pod) removeRemnants(ds *zfs.Dataset) error {
+	if ds != nil {
+		if err := ds.Destroy("-r"); err != nil {
+			return errors.Trace(err)
+		}
+	} else if err := pod.unmountAll(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.RemoveAll(pod.Path()))
+}
+
+// Returns UUIDs of pods with creation markers older than maxAge.
+func (h *Host) staleCreatingPods(maxAge time.Duration) []string {
+	markers, _ := filepath.Glob(h.Path("pods", "*", podCreatingMarker))
+	var rv []string
+	for _, marker := range markers {
+		if fi, err := os.Lstat(marker); err == nil && time.Since(fi.ModTime()) > maxAge {
+			rv = append(rv, filepath.Base(filepath.Dir(marker)))
+		}
+	}
+	return rv
+}
+
+// Removes remnants of pods whose creation was interrupted more than
+// gc.creation-timeout ago. Does nothing if another process holds the
+// host lock: it may be creating a pod right now.
+func (h *Host) sweepCreatingPods() {
+	stale := h.staleCreatingPods(h.settings().GC.CreationTimeout)
+	if len(stale) == 0 {
+		return
+	}
+	if pid, err := h.lock.acquire(h.Path("host.lock"), true); err != nil || pid != 0 {
+		return
+	}
+	defer h.lock.release(true)
+	for _, name := range stale {
+		id := uuid.Parse(name)
+		if id == nil {
+			continue
+		}
+		pod := newPod(h, id)
+		if !pod.isCreating() {
+			continue
+		}
+		pod.log().Warnf("removing remnants of interrupted pod creation")
+		if err := pod.removeRemnants(pod.getDataset()); err != nil {
+			pod.log().Errorf("cannot remove remnants of interrupted creation: %v", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestPodCreatingMarker(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+
+	pod := newPod(h, nil)
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := pod.markCreating(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(pod.Path("manifest"), []byte("{}"), 0600)
+	if pod.Exists() {
+		t.Error("Pod being created exists")
+	}
+	if _, err := LoadPod(h, pod.UUID); err == nil {
+		t.Error("Loaded pod being created")
+	}
+
+	if stale := h.staleCreatingPods(time.Hour); len(stale) != 0 {
+		t.Errorf("Fresh marker is stale: %v", stale)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(pod.Path(podCreatingMarker), old, old)
+	if stale := h.staleCreatingPods(time.Hour); !reflect.DeepEqual(stale, []string{pod.UUID.String()}) {
+		t.Errorf("Expected stale %v, got %v", pod.UUID, stale)
+	}
+
+	if err := pod.unmarkCreating(); err != nil {
+		t.Fatal(err)
+	}
+	if !pod.Exists() {
+		t.Error("Pod doesn't exist after creation finished")
+	}
+
+	if err := pod.removeRemnants(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pod.Path()); !os.IsNotExist(err) {
+		t.Errorf("Remnants not removed: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+)
+
+// Pod headers are a cheap way to enumerate pods: a header is read
+// from the pod's directory without a full Load. Only the apps' names
+// and annotations are decoded from the manifest, images are not
+// resolved, and the status of all jails comes from a single jls(8)
+// run. Use Pod() to load the full pod when it's needed.
+
+type PodHeader struct {
+	UUID      uuid.UUID
+	Name      string // hostname annotation, or the UUID
+	IP        string // ip-address annotation; empty for DHCP pods
+	Apps      []string
+	Images    []string // apps' image IDs
+	Status    PodStatus
+	Created   time.Time // manifest written
+	Modified  time.Time // last recorded event
+	Ephemeral bool      // jetpack/ephemeral annotation
+	Interface string    // jetpack/interface annotation
+
+	host *Host
+}
+
+// Fields of the manifest that headers need
+type podHeaderManifest struct {
+	Apps []struct {
+		Name  string `json:"name"`
+		Image struct {
+			ID string `json:"id"`
+		} `json:"image"`
+	} `json:"apps"`
+	Annotations []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"annotations"`
+}
+
+// Loads the full pod.
+func (ph *PodHeader) Pod() (*Pod, error) {
+	return ph.host.GetPod(ph.UUID)
+}
+
+// Returns why the pod is broken; see Pod.Broken.
+func (ph *PodHeader) Broken() (*PodBroken, error) {
+	return newPod(ph.host, ph.UUID).Broken()
+}
+
+// Returns the pod's most recent exit status; see Pod.LastExitStatus.
+func (ph *PodHeader) LastExitStatus() (*ExitStatus, error) {
+	return newPod(ph.host, ph.UUID).LastExitStatus()
+}
+
+func podStatusOf(status JailStatus) PodStatus {
+	switch {
+	case status == NoJailStatus:
+		return PodStatusStopped
+	case status.Dying:
+		return PodStatusDying
+	default:
+		return PodStatusRunning
+	}
+}
+
+// Returns headers of all pods, sorted by UUID.
+func (h *Host) PodHeaders() ([]*PodHeader, error) {
+	if unlock, err := h.lockShared(); err != nil {
+		h.log().Warnf("listing pods without host lock: %v", err)
+	} else {
+		defer unlock()
+	}
+	jails, err := h.jailStatuses(false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	prefix := Config().MustGetString("jail.namePrefix")
+	mm, _ := filepath.Glob(h.Path("pods/*/manifest"))
+	sort.Strings(mm)
+	rv := make([]*PodHeader, 0, len(mm))
+	for _, m := range mm {
+		id := uuid.Parse(filepath.Base(filepath.Dir(m)))
+		if id == nil {
+			continue
+		}
+		ph, err := h.readPodHeader(id)
+		if errors.Cause(err) == ErrNotFound {
+			// Being created, or destroyed meanwhile
+			continue
+		} else if err != nil {
+			h.log().Warnf("pods/%v: %v", id, err)
+			continue
+		}
+		ph.Status = podStatusOf(jails[prefix+id.String()])
+		rv = append(rv, ph)
+	}
+	return rv, nil
+}
+
+// Reads pod's header, without its status.
+func (h *Host) readPodHeader(id uuid.UUID) (*PodHeader, error) {
+	pod := newPod(h, id)
+	if pod.isCreating() {
+		return nil, ErrNotFound
+	}
+	bb, err := ioutil.ReadFile(pod.Path("manifest"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var pm podHeaderManifest
+	if err := json.Unmarshal(bb, &pm); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ph := &PodHeader{UUID: id, Name: id.String(), host: h}
+	for _, app := range pm.Apps {
+		ph.Apps = append(ph.Apps, app.Name)
+		ph.Images = append(ph.Images, app.Image.ID)
+	}
+	for _, ann := range pm.Annotations {
+		switch ann.Name {
+		case "hostname":
+			ph.Name = ann.Value
+		case "ip-address":
+			ph.IP = ann.Value
+		case ephemeralAnnotation:
+			ph.Ephemeral = ann.Value == "true"
+		case "jetpack/interface":
+			ph.Interface = ann.Value
+		}
+	}
+	if fi, err := os.Stat(pod.Path("manifest")); err == nil {
+		ph.Created = fi.ModTime()
+		ph.Modified = ph.Created
+	}
+	if fi, err := os.Stat(pod.EventLogPath()); err == nil {
+		ph.Modified = fi.ModTime()
+	}
+	return ph, nil
+}
@@ -0,0 +1,131 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Returns a host in a temporary directory with n pods, and a fake
+// jls(8) that reports the first pod as running.
+func podHeadersTestHost(tb testing.TB, n int) (*Host, func()) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	var first string
+	for i := 0; i < n; i++ {
+		pod := newPod(h, nil)
+		pm := schema.BlankPodManifest()
+		pm.Apps = schema.AppList{{
+			Name:  types.ACName(fmt.Sprintf("app-%d", i)),
+			Image: schema.RuntimeImage{ID: *types.NewHashSHA512([]byte("image"))},
+		}}
+		pm.Annotations.Set("hostname", fmt.Sprintf("pod-%d", i))
+		pm.Annotations.Set("ip-address", fmt.Sprintf("172.23.%d.%d", i/250, i%250+2))
+		bb, err := json.Marshal(pm)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pod.Path("manifest"), bb, 0600); err != nil {
+			tb.Fatal(err)
+		}
+		if i == 0 {
+			first = pod.jailName()
+		}
+	}
+
+	jls := filepath.Join(tmp, "jls")
+	script := fmt.Sprintf("#!/bin/sh\necho '7 0 %v'\necho '8 0 not-ours'\n", first)
+	if err := ioutil.WriteFile(jls, []byte(script), 0700); err != nil {
+		tb.Fatal(err)
+	}
+	saved := jlsPath
+	jlsPath = jls
+	return h, func() {
+		jlsPath = saved
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestPodHeaders(t *testing.T) {
+	h, cleanup := podHeadersTestHost(t, 3)
+	defer cleanup()
+
+	// Unfinished pod is skipped
+	creating := newPod(h, nil)
+	os.MkdirAll(creating.Path(), 0700)
+	creating.markCreating()
+	ioutil.WriteFile(creating.Path("manifest"), []byte("{}"), 0600)
+
+	phs, err := h.PodHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(phs) != 3 {
+		t.Fatalf("Expected 3 pod headers, got %d", len(phs))
+	}
+	running := 0
+	for _, ph := range phs {
+		pod, err := ph.Pod()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, _ := pod.IPAddress()
+		if ph.Name != pod.Hostname() || ph.IP != ip || len(ph.Apps) != 1 || ph.Apps[0] != pod.Manifest.Apps[0].Name.String() {
+			t.Errorf("Header %#v doesn't match pod %v", ph, pod.Manifest)
+		}
+		if ph.Created.IsZero() || ph.Modified.Before(ph.Created) {
+			t.Errorf("Invalid timestamps %v, %v", ph.Created, ph.Modified)
+		}
+		if ph.Status == PodStatusRunning {
+			running++
+		} else if ph.Status != PodStatusStopped {
+			t.Errorf("Unexpected status %v", ph.Status)
+		}
+	}
+	if running != 1 {
+		t.Errorf("Expected 1 running pod, got %d", running)
+	}
+}
+
+func benchmarkPodCount() int {
+	if testing.Short() {
+		return 100
+	}
+	return 1000
+}
+
+func BenchmarkPods(b *testing.B) {
+	h, cleanup := podHeadersTestHost(b, benchmarkPodCount())
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pod := range h.Pods() {
+			pod.Status()
+		}
+	}
+}
+
+func BenchmarkPodHeaders(b *testing.B) {
+	h, cleanup := podHeadersTestHost(b, benchmarkPodCount())
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.PodHeaders(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
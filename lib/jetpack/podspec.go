@@ -0,0 +1,197 @@
+package jetpack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// App of a pod to create with CreatePodFromApps.
+type AppSpec struct {
+	Image          schema.RuntimeImage // image hash, or name and labels
+	Name           types.ACName        // runtime app name; empty to derive it from the image's name
+	App            *types.App          // runtime app override, as in a pod manifest
+	Exec           types.Exec          // overrides the image's exec
+	Environment    types.Environment   // added to the image's environment
+	Mounts         []schema.Mount      // volume bindings; unbound mount points get a volume named after them
+	Annotations    types.Annotations
+	ReadOnlyRootFS bool
+}
+
+// Pod-wide settings of a pod to create with CreatePodFromApps.
+type PodOptions struct {
+	Volumes     []types.Volume // volumes not declared here are empty
+	Annotations types.Annotations
+	Ports       []types.ExposedPort
+	EnvFiles    []string // env files of all apps, read when they run
+	Ephemeral   bool     // images are mounted read-only, not cloned
+}
+
+// Describes the spec in error messages.
+func (spec *AppSpec) describe(i int) string {
+	switch {
+	case !spec.Name.Empty():
+		return fmt.Sprintf("app %d (%v)", i+1, spec.Name)
+	case spec.Image.Name != nil:
+		return fmt.Sprintf("app %d (%v)", i+1, spec.Image.Name)
+	default:
+		return fmt.Sprintf("app %d (%v)", i+1, spec.Image.ID)
+	}
+}
+
+// Returns a pod manifest for apps: resolves (fetches, if needed)
+// images, names the apps, binds the apps' mount points to volumes,
+// declaring missing ones as empty volumes shared by all apps that
+// mount them, and applies matching presets.
+func (h *Host) PodManifestFromApps(specs []AppSpec, opts *PodOptions) (*schema.PodManifest, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("No apps")
+	}
+	pm := schema.BlankPodManifest()
+	if opts != nil {
+		pm.Volumes = append(pm.Volumes, opts.Volumes...)
+		pm.Annotations = append(pm.Annotations, opts.Annotations...)
+		pm.Ports = append(pm.Ports, opts.Ports...)
+		if len(opts.EnvFiles) > 0 {
+			if err := SetEnvFiles(pm, opts.EnvFiles); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if opts.Ephemeral {
+			SetEphemeral(pm)
+		}
+	}
+	if err := h.reifyApps(pm, specs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return pm, nil
+}
+
+// Creates a pod running apps; see PodManifestFromApps.
+func (h *Host) CreatePodFromApps(specs []AppSpec, opts *PodOptions) (*Pod, error) {
+	pm, err := h.PodManifestFromApps(specs, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.CreatePod(pm, nil)
+}
+
+// Fills pm's apps from specs, and declares volumes that the apps
+// mount, but pm doesn't have.
+func (h *Host) reifyApps(pm *schema.PodManifest, specs []AppSpec) error {
+	volumes := make(map[types.ACName]bool)
+	for _, vol := range pm.Volumes {
+		if volumes[vol.Name] {
+			return errors.Errorf("Volume %v declared more than once", vol.Name)
+		}
+		volumes[vol.Name] = true
+	}
+
+	// Explicit names are reserved first, so that generated ones
+	// don't take them.
+	names := make(map[types.ACName]bool)
+	for i, spec := range specs {
+		if spec.Name.Empty() {
+			continue
+		}
+		if names[spec.Name] {
+			return errors.Errorf("%v: duplicate app name", spec.describe(i))
+		}
+		names[spec.Name] = true
+	}
+
+	apps := make(schema.AppList, len(specs))
+	imageNames := make([]string, len(specs))
+	for i, spec := range specs {
+		rtapp, img, err := h.reifyApp(&spec, volumes, names)
+		if err != nil {
+			return errors.Annotate(err, spec.describe(i))
+		}
+		apps[i] = *rtapp
+		imageNames[i] = img.Manifest.Name.String()
+		for _, mnt := range rtapp.Mounts {
+			if !volumes[mnt.Volume] {
+				h.log().Infof("volume %v not found, inserting empty volume", mnt.Volume)
+				// Mode, uid and gid are left unset, to be taken from the
+				// image's mount point directory when the pod is created
+				pm.Volumes = append(pm.Volumes, types.Volume{Name: mnt.Volume, Kind: "empty"})
+				volumes[mnt.Volume] = true
+			}
+		}
+	}
+	pm.Apps = apps
+	if applied := applyPodPresets(pm, podPresets(), imageNames); len(applied) > 0 {
+		h.log().Debugf("applied presets: %v", strings.Join(applied, ", "))
+	}
+	return nil
+}
+
+func (h *Host) reifyApp(spec *AppSpec, volumes, names map[types.ACName]bool) (*schema.RuntimeApp, *Image, error) {
+	img, err := h.getRuntimeImage(spec.Image)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	rtapp := &schema.RuntimeApp{
+		Name:           spec.Name,
+		Image:          spec.Image,
+		App:            spec.App,
+		ReadOnlyRootFS: spec.ReadOnlyRootFS,
+		Annotations:    spec.Annotations,
+	}
+	rtapp.Image.ID = *img.Hash
+
+	if rtapp.Name.Empty() {
+		base := types.ACName(path.Base(img.Manifest.Name.String()))
+		if base.Empty() {
+			return nil, nil, errors.Errorf("Cannot derive app name from %v", img.Manifest.Name)
+		}
+		rtapp.Name = base
+		for n := 2; names[rtapp.Name]; n++ {
+			rtapp.Name = types.ACName(fmt.Sprintf("%v-%d", base, n))
+		}
+		names[rtapp.Name] = true
+	}
+
+	if spec.Exec != nil || len(spec.Environment) > 0 {
+		base := mergeApps(img.Manifest.App, spec.App)
+		if base == nil {
+			return nil, nil, errors.Errorf("Image %v has no app to override", img.Manifest.Name)
+		}
+		rtapp.App = mergeApps(base, &types.App{Exec: spec.Exec, Environment: spec.Environment})
+	}
+
+	app := mergeApps(img.Manifest.App, rtapp.App)
+	var mountPoints []types.MountPoint
+	if app != nil {
+		mountPoints = app.MountPoints
+	}
+	bound := make([]bool, len(spec.Mounts))
+	for _, mntpnt := range mountPoints {
+		var mnt *schema.Mount
+		for j, mntc := range spec.Mounts {
+			if mntc.Path == mntpnt.Path || mntc.Path == mntpnt.Name.String() {
+				if mnt != nil {
+					return nil, nil, errors.Errorf("Multiple mounts for mount point %v", mntpnt.Name)
+				}
+				mnt = &spec.Mounts[j]
+				bound[j] = true
+			}
+		}
+		if mnt == nil {
+			h.log().Infof("mount for %v:%v not found, inserting mount for volume %v", rtapp.Name, mntpnt.Name, mntpnt.Name)
+			rtapp.Mounts = append(rtapp.Mounts, schema.Mount{Path: mntpnt.Name.String(), Volume: mntpnt.Name})
+		} else {
+			rtapp.Mounts = append(rtapp.Mounts, *mnt)
+		}
+	}
+	for j, mnt := range spec.Mounts {
+		if !bound[j] {
+			return nil, nil, errors.Errorf("Mount of volume %v at %v matches no mount point", mnt.Volume, mnt.Path)
+		}
+	}
+	return rtapp, img, nil
+}
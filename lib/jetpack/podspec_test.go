@@ -0,0 +1,116 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Saves an image with an app that has the given mount points.
+func saveTestImage(t *testing.T, h *Host, name string, mountPoints ...string) *Image {
+	img := NewImage(h, nil)
+	img.Hash = types.NewHashSHA512([]byte(name))
+	img.Manifest.Name = *types.MustACIdentifier(name)
+	img.Manifest.App = &types.App{Exec: types.Exec{"/bin/true"}, User: "0", Group: "0"}
+	for _, mp := range mountPoints {
+		img.Manifest.App.MountPoints = append(img.Manifest.App.MountPoints,
+			types.MountPoint{Name: types.ACName(mp), Path: "/" + mp})
+	}
+	if err := os.MkdirAll(img.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for file, v := range map[string]interface{}{"manifest": &img.Manifest, "metadata": img} {
+		if bb, err := json.Marshal(v); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(img.Path(file), bb, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(img.UUID.String(), h.Path("images", img.Hash.String())); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestPodManifestFromApps(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	web := saveTestImage(t, h, "example.com/web", "data", "cache")
+	worker := saveTestImage(t, h, "example.com/worker", "data")
+	webName := web.Manifest.Name
+
+	pm, err := h.PodManifestFromApps([]AppSpec{
+		{Image: schema.RuntimeImage{Name: &webName}},
+		{Image: schema.RuntimeImage{ID: *web.Hash}, Exec: types.Exec{"/bin/sh"}},
+		{Image: schema.RuntimeImage{ID: *worker.Hash}, Name: "web-2",
+			Mounts: []schema.Mount{{Volume: "shared", Path: "data"}}},
+	}, &PodOptions{Volumes: []types.Volume{{Name: "data", Kind: "host", Source: "/srv"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Explicit names are kept; generated ones avoid them
+	var names []string
+	for _, rtapp := range pm.Apps {
+		names = append(names, rtapp.Name.String())
+	}
+	if strings.Join(names, " ") != "web web-3 web-2" {
+		t.Errorf("Unexpected app names %v", names)
+	}
+	if pm.Apps[0].Image.ID != *web.Hash {
+		t.Errorf("Image not resolved: %v", pm.Apps[0].Image)
+	}
+	if app := pm.Apps[1].App; app == nil || len(app.Exec) != 1 || app.Exec[0] != "/bin/sh" || app.User != "0" {
+		t.Errorf("Exec not overridden: %#v", app)
+	}
+
+	// Declared volume is used, missing ones are declared once
+	var vols []string
+	for _, vol := range pm.Volumes {
+		vols = append(vols, vol.Name.String()+":"+vol.Kind)
+	}
+	if strings.Join(vols, " ") != "data:host cache:empty shared:empty" {
+		t.Errorf("Unexpected volumes %v", vols)
+	}
+}
+
+func TestPodManifestFromAppsErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	img := saveTestImage(t, h, "example.com/web", "data")
+	rtimg := schema.RuntimeImage{ID: *img.Hash}
+
+	for _, tc := range []struct {
+		specs  []AppSpec
+		opts   *PodOptions
+		errors string
+	}{
+		{nil, nil, "No apps"},
+		{[]AppSpec{{Image: rtimg, Name: "a"}, {Image: rtimg, Name: "a"}}, nil, "app 2 (a): duplicate app name"},
+		{[]AppSpec{{Image: rtimg}, {Image: schema.RuntimeImage{ID: *types.NewHashSHA512([]byte("nope"))}}}, nil, "app 2 (sha512-"},
+		{[]AppSpec{{Image: rtimg, Mounts: []schema.Mount{{Volume: "v", Path: "/elsewhere"}}}}, nil, "app 1 (sha512-"},
+		{[]AppSpec{{Image: rtimg, Mounts: []schema.Mount{{Volume: "v", Path: "data"}, {Volume: "w", Path: "/data"}}}}, nil, "Multiple mounts"},
+		{[]AppSpec{{Image: rtimg}}, &PodOptions{Volumes: []types.Volume{{Name: "v", Kind: "empty"}, {Name: "v", Kind: "empty"}}}, "declared more than once"},
+	} {
+		if _, err := h.PodManifestFromApps(tc.specs, tc.opts); err == nil {
+			t.Errorf("Expected error %q, got none", tc.errors)
+		} else if !strings.Contains(err.Error(), tc.errors) {
+			t.Errorf("Expected error %q, got %q", tc.errors, err)
+		}
+	}
+}
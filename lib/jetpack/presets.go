@@ -0,0 +1,112 @@
+package jetpack
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Pod presets: `presets.NAME.images` lists glob patterns of image
+// names, and `presets.NAME.annotations.ANNOTATION` properties are
+// default pod annotations for pods running a matching image. Presets
+// are applied when a pod manifest is reified, beneath annotations set
+// explicitly; when several presets set the same annotation, the one
+// whose name sorts first wins. Applied presets are listed in the pod's
+// `jetpack/presets` annotation. As the values are copied into the pod
+// manifest, changing a preset doesn't affect existing pods.
+
+const presetsAnnotation = "jetpack/presets"
+
+type podPreset struct {
+	name        string
+	images      []string
+	annotations types.Annotations
+}
+
+// Returns presets from the configuration, sorted by name.
+func podPresets() []*podPreset {
+	byName := make(map[string]*podPreset)
+	for key, value := range ConfigPrefix("presets.") {
+		pieces := strings.SplitN(key, ".", 3)
+		if len(pieces) < 2 {
+			continue
+		}
+		pp := byName[pieces[0]]
+		if pp == nil {
+			pp = &podPreset{name: pieces[0]}
+			byName[pieces[0]] = pp
+		}
+		switch {
+		case pieces[1] == "images" && len(pieces) == 2:
+			pp.images = strings.Fields(value)
+		case pieces[1] == "annotations" && len(pieces) == 3:
+			if name, err := types.NewACIdentifier(pieces[2]); err == nil {
+				pp.annotations.Set(*name, value)
+			}
+		}
+	}
+	rv := make([]*podPreset, 0, len(byName))
+	for _, pp := range byName {
+		rv = append(rv, pp)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].name < rv[j].name })
+	return rv
+}
+
+func (pp *podPreset) matches(imageName string) bool {
+	for _, pattern := range pp.images {
+		if ok, _ := path.Match(pattern, imageName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds annotations of presets matching imageNames to pm, unless pm
+// sets them already. Returns names of applied presets.
+func applyPodPresets(pm *schema.PodManifest, presets []*podPreset, imageNames []string) []string {
+	var applied []string
+	for _, pp := range presets {
+		matched := false
+		for _, name := range imageNames {
+			matched = matched || pp.matches(name)
+		}
+		if !matched {
+			continue
+		}
+		for _, ann := range pp.annotations {
+			if _, ok := pm.Annotations.Get(ann.Name.String()); !ok {
+				pm.Annotations.Set(ann.Name, ann.Value)
+			}
+		}
+		applied = append(applied, pp.name)
+	}
+	if len(applied) > 0 {
+		pm.Annotations.Set(presetsAnnotation, strings.Join(applied, " "))
+	}
+	return applied
+}
+
+// Checks a presets.* property.
+func validatePreset(name, value string) error {
+	pieces := strings.SplitN(strings.TrimPrefix(name, "presets."), ".", 3)
+	switch {
+	case len(pieces) == 2 && pieces[1] == "images":
+		for _, pattern := range strings.Fields(value) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("%v: invalid pattern %#v", name, pattern)
+			}
+		}
+	case len(pieces) == 3 && pieces[1] == "annotations":
+		if _, err := types.NewACIdentifier(pieces[2]); err != nil {
+			return errors.Errorf("%v: invalid annotation name %#v", name, pieces[2])
+		}
+	default:
+		return errors.Errorf("%v: unknown preset property", name)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/magiconair/properties"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestPodPresets(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	Config().Set("presets.pg.images", "example.com/postgres* example.com/pg")
+	Config().Set("presets.pg.annotations.jetpack/jail.conf/allow.sysvipc", "true")
+	Config().Set("presets.pg.annotations.jetpack/log-capture", "file")
+	Config().Set("presets.all.images", "example.com/*")
+	Config().Set("presets.all.annotations.jetpack/log-capture", "syslog")
+	Config().Set("presets.web.images", "example.com/web")
+	Config().Set("presets.web.annotations.jetpack/syslog", "on")
+
+	presets := podPresets()
+	if len(presets) != 3 || presets[0].name != "all" || presets[1].name != "pg" {
+		t.Fatalf("Unexpected presets %#v", presets)
+	}
+
+	pm := schema.BlankPodManifest()
+	pm.Annotations.Set("jetpack/jail.conf/allow.sysvipc", "false")
+	applied := applyPodPresets(pm, presets, []string{"example.com/postgresql"})
+	if len(applied) != 2 || applied[0] != "all" || applied[1] != "pg" {
+		t.Errorf("Unexpected applied presets %v", applied)
+	}
+	for name, expected := range map[string]string{
+		"jetpack/jail.conf/allow.sysvipc": "false",  // explicit value wins
+		"jetpack/log-capture":             "syslog", // first preset wins
+		"jetpack/presets":                 "all pg",
+	} {
+		if v, _ := pm.Annotations.Get(name); v != expected {
+			t.Errorf("Expected %v=%v, got %#v", name, expected, v)
+		}
+	}
+	if _, ok := pm.Annotations.Get("jetpack/syslog"); ok {
+		t.Error("Non-matching preset applied")
+	}
+
+	// Applied when manifest is reified
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	img := saveTestImage(t, h, "example.com/web")
+	if pm, err := h.PodManifestFromApps([]AppSpec{{Image: schema.RuntimeImage{ID: *img.Hash}}}, nil); err != nil {
+		t.Fatal(err)
+	} else if v, _ := pm.Annotations.Get("jetpack/presets"); v != "all web" {
+		t.Errorf("Unexpected presets annotation %#v", v)
+	}
+}
+
+func TestValidatePreset(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"presets.pg.images":                       true,
+		"presets.pg.annotations.jetpack/log-keep": true,
+		"presets.pg.annotations.Invalid Name":     false,
+		"presets.pg.image":                        false,
+		"presets.pg":                              false,
+		"presets.pg.images.extra":                 false,
+	} {
+		if err := validatePreset(name, "x"); (err == nil) != valid {
+			t.Errorf("%v: unexpected validation result %v", name, err)
+		}
+	}
+	if err := validatePreset("presets.pg.images", "ok [invalid"); err == nil {
+		t.Error("Invalid pattern accepted")
+	}
+}
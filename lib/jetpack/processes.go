@@ -0,0 +1,152 @@
+package jetpack
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// A process attached to the pod's jail
+type Process struct {
+	Pid     int
+	Ppid    int
+	User    string // name from apps' passwd, or numeric uid
+	Started time.Time
+	CPUTime time.Duration
+	RSS     uint64 // bytes
+	Command []string
+
+	// Set for app's stage2 command (the "main" process of a running app)
+	Main bool
+	App  types.ACName `json:",omitempty"`
+}
+
+// Returns processes attached to the pod's jail, ordered by pid. The
+// list is read from the kernel, and processes that exit while it's
+// read are skipped, so it works on a dying jail as well. Returns
+// ErrPodStopped if the pod's jail doesn't exist.
+func (pod *Pod) Processes() ([]*Process, error) {
+	jid := pod.Jid()
+	if jid == 0 {
+		return nil, errors.Annotatef(ErrPodStopped, "Pod %v", pod.UUID)
+	}
+	procs, err := listJailProcesses(jid)
+	if err != nil {
+		// The jail may have died since its status was cached
+		pod.Host.invalidateJailStatus(pod.jailName())
+		return nil, errors.Trace(err)
+	}
+
+	mains := pod.mainPids()
+	users := make(map[int]string)
+	for _, proc := range procs {
+		proc.App, proc.Main = mains[proc.Pid]
+		uid, _ := strconv.Atoi(proc.User)
+		if name, ok := users[uid]; ok {
+			proc.User = name
+		} else {
+			users[uid] = pod.userName(uid)
+			proc.User = users[uid]
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	return procs, nil
+}
+
+// Maps pids of apps' running stage2 commands (recorded by supervisors
+// of detached runs, or started by this process) to app names.
+func (pod *Pod) mainPids() map[int]types.ACName {
+	rv := make(map[int]types.ACName)
+	for _, app := range pod.Apps() {
+		if sv, err := pod.Supervisor(app.Name); err != nil {
+			app.log().Warnf("cannot read supervisor state: %v", err)
+		} else if sv != nil && sv.AppPid != 0 {
+			rv[sv.AppPid] = app.Name
+		}
+		if app.cmd != nil && app.cmd.Cmd.Process != nil {
+			rv[app.cmd.Cmd.Process.Pid] = app.Name
+		}
+	}
+	return rv
+}
+
+// Looks uid up in apps' passwd files; returns numeric uid if none
+// knows it.
+func (pod *Pod) userName(uid int) string {
+	for _, app := range pod.Apps() {
+		if pwf, err := app.readPasswd(); err == nil {
+			if pwent := pwf.FindByUid(uid); pwent != nil {
+				return pwent.Username
+			}
+		}
+	}
+	return strconv.Itoa(uid)
+}
+
+// Offsets in FreeBSD's struct kinfo_proc (<sys/user.h>) on amd64;
+// stable since FreeBSD 10.
+const (
+	kinfoProcSize   = 1088
+	kinfoOffPid     = 72
+	kinfoOffPpid    = 76
+	kinfoOffUid     = 168
+	kinfoOffRssize  = 264 // pages
+	kinfoOffRuntime = 328 // microseconds
+	kinfoOffStart   = 336 // struct timeval
+	kinfoOffComm    = 447
+	kinfoCommLen    = 20
+	kinfoOffJid     = 592
+)
+
+// Parses kern.proc.proc sysctl output (an array of struct kinfo_proc),
+// and returns processes attached to jail jid. User is set to numeric
+// uid, and Command to the process' short name.
+func parseKinfoProcs(buf []byte, jid, pageSize int) ([]*Process, error) {
+	var procs []*Process
+	le := binary.LittleEndian
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errors.Errorf("Truncated kinfo_proc (%d bytes)", len(buf))
+		}
+		if size := int(le.Uint32(buf)); size != kinfoProcSize {
+			return nil, errors.Errorf("Unsupported kinfo_proc size %d", size)
+		}
+		if len(buf) < kinfoProcSize {
+			return nil, errors.Errorf("Truncated kinfo_proc (%d bytes)", len(buf))
+		}
+		ki := buf[:kinfoProcSize]
+		buf = buf[kinfoProcSize:]
+
+		if int(int32(le.Uint32(ki[kinfoOffJid:]))) != jid {
+			continue
+		}
+		comm := ki[kinfoOffComm : kinfoOffComm+kinfoCommLen]
+		if i := strings.IndexByte(string(comm), 0); i >= 0 {
+			comm = comm[:i]
+		}
+		procs = append(procs, &Process{
+			Pid:     int(int32(le.Uint32(ki[kinfoOffPid:]))),
+			Ppid:    int(int32(le.Uint32(ki[kinfoOffPpid:]))),
+			User:    strconv.FormatUint(uint64(le.Uint32(ki[kinfoOffUid:])), 10),
+			Started: time.Unix(int64(le.Uint64(ki[kinfoOffStart:])), int64(le.Uint64(ki[kinfoOffStart+8:]))*1000),
+			CPUTime: time.Duration(le.Uint64(ki[kinfoOffRuntime:])) * time.Microsecond,
+			RSS:     le.Uint64(ki[kinfoOffRssize:]) * uint64(pageSize),
+			Command: []string{string(comm)},
+		})
+	}
+	return procs, nil
+}
+
+// Splits kern.proc.args sysctl output (NUL-terminated arguments).
+func parseProcArgs(buf []byte) []string {
+	s := strings.TrimRight(string(buf), "\x00")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\x00")
+}
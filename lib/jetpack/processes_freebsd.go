@@ -0,0 +1,41 @@
+// +build freebsd,amd64
+
+package jetpack
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Reads the kernel's process list and returns processes of jail jid,
+// with their full command lines.
+func listJailProcesses(jid int) ([]*Process, error) {
+	var buf []byte
+	var err error
+	// Process list may grow between sizing the buffer and reading it
+	for i := 0; i < 5; i++ {
+		if buf, err = unix.SysctlRaw("kern.proc.proc"); err != syscall.ENOMEM {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "sysctl kern.proc.proc")
+	}
+	procs, err := parseKinfoProcs(buf, jid, os.Getpagesize())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, proc := range procs {
+		// Process may have exited meanwhile, or be a zombie without
+		// arguments; short name is good enough then
+		if args, err := unix.SysctlRaw("kern.proc.args", proc.Pid); err == nil {
+			if argv := parseProcArgs(args); len(argv) > 0 {
+				proc.Command = argv
+			}
+		}
+	}
+	return procs, nil
+}
@@ -0,0 +1,9 @@
+// +build !freebsd !amd64
+
+package jetpack
+
+import "github.com/juju/errors"
+
+func listJailProcesses(jid int) ([]*Process, error) {
+	return nil, errors.New("Listing jail processes is supported only on FreeBSD/amd64")
+}
@@ -0,0 +1,65 @@
+package jetpack
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func kinfoProc(pid, ppid, uid, jid int, comm string) []byte {
+	le := binary.LittleEndian
+	ki := make([]byte, kinfoProcSize)
+	le.PutUint32(ki, kinfoProcSize)
+	le.PutUint32(ki[kinfoOffPid:], uint32(pid))
+	le.PutUint32(ki[kinfoOffPpid:], uint32(ppid))
+	le.PutUint32(ki[kinfoOffUid:], uint32(uid))
+	le.PutUint32(ki[kinfoOffJid:], uint32(jid))
+	le.PutUint64(ki[kinfoOffRssize:], 3)
+	le.PutUint64(ki[kinfoOffRuntime:], 1500000)
+	le.PutUint64(ki[kinfoOffStart:], 1500000000)
+	le.PutUint64(ki[kinfoOffStart+8:], 250)
+	copy(ki[kinfoOffComm:], comm)
+	return ki
+}
+
+func TestParseKinfoProcs(t *testing.T) {
+	var buf []byte
+	buf = append(buf, kinfoProc(1, 0, 0, 0, "init")...)
+	buf = append(buf, kinfoProc(101, 1, 80, 7, "nginx")...)
+	buf = append(buf, kinfoProc(102, 101, 0, 8, "sh")...)
+	procs, err := parseKinfoProcs(buf, 7, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Process{{
+		Pid:     101,
+		Ppid:    1,
+		User:    "80",
+		Started: time.Unix(1500000000, 250000),
+		CPUTime: 1500 * time.Millisecond,
+		RSS:     3 * 4096,
+		Command: []string{"nginx"},
+	}}
+	if !reflect.DeepEqual(procs, expected) {
+		t.Errorf("Expected %#v, got %#v", expected[0], procs)
+	}
+
+	if _, err := parseKinfoProcs(buf[:kinfoProcSize+10], 7, 4096); err == nil {
+		t.Error("Expected error for truncated buffer")
+	}
+	bad := kinfoProc(1, 0, 0, 0, "init")
+	binary.LittleEndian.PutUint32(bad, 1000)
+	if _, err := parseKinfoProcs(bad, 7, 4096); err == nil {
+		t.Error("Expected error for unknown struct size")
+	}
+}
+
+func TestParseProcArgs(t *testing.T) {
+	if args := parseProcArgs([]byte("/bin/sh\x00-c\x00echo a b\x00")); !reflect.DeepEqual(args, []string{"/bin/sh", "-c", "echo a b"}) {
+		t.Errorf("Unexpected args %#v", args)
+	}
+	if args := parseProcArgs(nil); args != nil {
+		t.Errorf("Expected no args, got %#v", args)
+	}
+}
@@ -0,0 +1,180 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// Provenance is recorded in image's metadata when it's imported or
+// built: how and from where the image came, who brought it in, and,
+// for built images, the base image and build steps. Image.History()
+// puts it together with the rest of the metadata (import time,
+// signature, dependencies) into a story of the image, its
+// dependencies first. Images stored before provenance was recorded
+// have an "unknown" entry instead.
+
+// How an image came to the store
+type ProvenanceMethod string
+
+const (
+	ProvenanceDiscovery ProvenanceMethod = "discovery" // fetched by name
+	ProvenanceACI       ProvenanceMethod = "aci"       // imported from an ACI file, URL, or stream
+	ProvenanceDocker    ProvenanceMethod = "docker"    // pulled from a registry, or read from a docker-save archive
+	ProvenanceOCI       ProvenanceMethod = "oci"       // read from an OCI image layout
+	ProvenanceDirectory ProvenanceMethod = "directory" // imported from a directory tree
+	ProvenanceBuild     ProvenanceMethod = "build"     // built from a base image
+)
+
+// Where an image comes from
+type ImageProvenance struct {
+	Method ProvenanceMethod
+	Source string       `json:",omitempty"` // name, URL, path, or Docker reference; "" for a stream
+	Digest string       `json:",omitempty"` // registry's manifest digest of a Docker image
+	User   string       `json:",omitempty"` // who imported or built the image
+	Base   *types.Hash  `json:",omitempty"` // base of a built image
+	Steps  []types.Exec `json:",omitempty"` // build steps, in order
+}
+
+// Returns provenance with method and source, and the current user.
+func newProvenance(method ProvenanceMethod, source string) *ImageProvenance {
+	return &ImageProvenance{Method: method, Source: source, User: currentUser()}
+}
+
+// Returns name of the user running jetpack, and of the user who ran
+// it with sudo.
+func currentUser() string {
+	name := fmt.Sprintf("uid=%d", os.Getuid())
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != name {
+		name = fmt.Sprintf("%v (sudo by %v)", name, sudoUser)
+	}
+	return name
+}
+
+// Kinds of image history entries
+type ImageHistoryType string
+
+const (
+	HistoryUnknown    ImageHistoryType = "unknown"
+	HistoryDependency ImageHistoryType = "dependency"
+	HistoryImport     ImageHistoryType = "import"
+	HistoryBuild      ImageHistoryType = "build"
+	HistoryBuildStep  ImageHistoryType = "build-step"
+	HistorySignature  ImageHistoryType = "signature"
+)
+
+// What happened to an image, or what it is made of
+type ImageHistoryEntry struct {
+	Type    ImageHistoryType
+	Time    time.Time   // zero if unknown
+	Image   *types.Hash `json:",omitempty"` // dependency, or build's base
+	Details string
+}
+
+func (e ImageHistoryEntry) String() string {
+	return fmt.Sprintf("%v: %v", e.Type, e.Details)
+}
+
+const unknownProvenance = "unknown (imported before provenance tracking)"
+
+// Returns image's history: its dependencies (theirs first, in order of
+// rendering), how it has been imported or built, and its signature.
+func (img *Image) History() ([]ImageHistoryEntry, error) {
+	var rv []ImageHistoryEntry
+	deps, err := img.dependencyHistory(make(map[types.Hash]bool))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rv = append(rv, deps...)
+
+	prov := img.Provenance
+	switch {
+	case prov == nil:
+		rv = append(rv, ImageHistoryEntry{Type: HistoryUnknown, Time: img.Timestamp, Details: unknownProvenance})
+	case prov.Method == ProvenanceBuild:
+		details := fmt.Sprintf("built by %v", prov.User)
+		if prov.Base != nil {
+			details += fmt.Sprintf(" from %v", prov.Base)
+		}
+		rv = append(rv, ImageHistoryEntry{Type: HistoryBuild, Time: img.Timestamp, Image: prov.Base, Details: details})
+		for i, step := range prov.Steps {
+			rv = append(rv, ImageHistoryEntry{
+				Type:    HistoryBuildStep,
+				Details: fmt.Sprintf("%d/%d: %v", i+1, len(prov.Steps), run.ShellEscape(step...)),
+			})
+		}
+	default:
+		details := string(prov.Method)
+		if prov.Source != "" {
+			details += " " + prov.Source
+		}
+		if prov.Digest != "" {
+			details += " @ " + prov.Digest
+		}
+		details += fmt.Sprintf(" by %v", prov.User)
+		if img.Import != nil {
+			details += fmt.Sprintf(": %v", img.Import)
+		}
+		rv = append(rv, ImageHistoryEntry{Type: HistoryImport, Time: img.Timestamp, Details: details})
+	}
+
+	if img.Signature != nil {
+		rv = append(rv, ImageHistoryEntry{
+			Type:    HistorySignature,
+			Time:    img.Signature.Verified,
+			Details: fmt.Sprintf("signed by %v (key %v)", img.Signature.Signer, img.Signature.Fingerprint),
+		})
+	} else if prov == nil || prov.Method != ProvenanceBuild {
+		rv = append(rv, ImageHistoryEntry{Type: HistorySignature, Details: "unsigned"})
+	}
+	return rv, nil
+}
+
+// Returns entries of image's dependencies, and of their dependencies
+// before each of them. Dependencies in seen are skipped.
+func (img *Image) dependencyHistory(seen map[types.Hash]bool) ([]ImageHistoryEntry, error) {
+	hashes := img.Dependencies
+	if len(hashes) == 0 {
+		for _, dep := range img.Manifest.Dependencies {
+			if dep.ImageID != nil {
+				hashes = append(hashes, *dep.ImageID)
+			}
+		}
+	}
+	var rv []ImageHistoryEntry
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		hash := hash
+		dimg, err := img.Host.GetLocalImage(hash, "", nil)
+		if errors.Cause(err) == ErrNotFound {
+			rv = append(rv, ImageHistoryEntry{Type: HistoryDependency, Image: &hash, Details: "not in the store"})
+			continue
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		deps, err := dimg.dependencyHistory(seen)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rv = append(rv, deps...)
+		rv = append(rv, ImageHistoryEntry{
+			Type:    HistoryDependency,
+			Time:    dimg.Timestamp,
+			Image:   &hash,
+			Details: fmt.Sprintf("%v %v", dimg, hash),
+		})
+	}
+	return rv, nil
+}
@@ -0,0 +1,88 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func historyTypes(history []ImageHistoryEntry) []ImageHistoryType {
+	rv := make([]ImageHistoryType, len(history))
+	for i, entry := range history {
+		rv[i] = entry.Type
+	}
+	return rv
+}
+
+func TestImageHistory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	os.MkdirAll(h.Path("images"), 0700)
+	base := saveTestImage(t, h, "example.com/base")
+	middle := saveTestImage(t, h, "example.com/middle")
+	middle.Dependencies = []types.Hash{*base.Hash}
+	bb, _ := json.Marshal(middle)
+	if err := ioutil.WriteFile(middle.Path("metadata"), bb, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored before provenance was recorded
+	history, err := base.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Type != HistoryUnknown || history[0].Details != unknownProvenance || history[1].Details != "unsigned" {
+		t.Errorf("unknown provenance: %v", history)
+	}
+
+	img := NewImage(h, nil)
+	img.Manifest.Name = "example.com/app"
+	img.Dependencies = []types.Hash{*middle.Hash}
+	img.Provenance = &ImageProvenance{
+		Method: ProvenanceBuild,
+		User:   "root",
+		Base:   middle.Hash,
+		Steps:  []types.Exec{{"pkg", "install", "-y", "nginx"}, {"/bin/sh", "-e", "script"}},
+	}
+	if history, err = img.History(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ImageHistoryType{HistoryDependency, HistoryDependency, HistoryBuild, HistoryBuildStep, HistoryBuildStep}
+	if got := historyTypes(history); len(got) != len(expected) {
+		t.Fatalf("build history: %v", history)
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("build history: %v", history)
+				break
+			}
+		}
+	}
+	if *history[0].Image != *base.Hash || *history[1].Image != *middle.Hash {
+		t.Errorf("dependencies out of order: %v", history)
+	}
+	if history[3].Details != "1/2: pkg install -y nginx" {
+		t.Errorf("build step: %q", history[3].Details)
+	}
+
+	img.Dependencies = []types.Hash{*types.NewHashSHA512([]byte("gone"))}
+	img.Provenance = &ImageProvenance{Method: ProvenanceDocker, Source: "docker.io/library/nginx:1.25", Digest: "sha256:0123", User: "root"}
+	img.Signature = nil
+	if history, err = img.History(); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Details != "not in the store" ||
+		history[1].Details != "docker docker.io/library/nginx:1.25 @ sha256:0123 by root" ||
+		history[2].Type != HistorySignature {
+		t.Errorf("import history: %v", history)
+	}
+}
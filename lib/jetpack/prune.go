@@ -0,0 +1,264 @@
+package jetpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Prune reclaims disk space in one pass, under the exclusive host
+// lock: it destroys stopped pods that were idle for longer than the
+// grace period (gc.grace-period), then images that no remaining pod
+// runs, directly or as a dependency of its image, and finally
+// datasets under pods/ and images/ that have no pod or image
+// metadata. Partial downloads older than gc.spool-max-age are removed
+// from the spool, except in dry run. Core files that remaining pods
+// collected are removed past coredump.max-age and coredump.max-size.
+// Pods and images with a
+// `jetpack/keep` annotation set to "true" are never pruned, and
+// images they need are kept as well.
+
+const keepAnnotation = "jetpack/keep"
+
+type PruneOptions struct {
+	DryRun      bool          // only report what would be pruned
+	GracePeriod time.Duration // negative: gc.grace-period
+}
+
+// Pruned (or, in dry run, prunable) items of one kind
+type PruneCategory struct {
+	Items []string // pod UUIDs, image hashes, or dataset names
+	Bytes uint64   // disk space used by the items; for images, space destroying them frees
+}
+
+func (pc *PruneCategory) add(item string, bytes uint64) {
+	pc.Items = append(pc.Items, item)
+	pc.Bytes += bytes
+}
+
+func (pc PruneCategory) String() string {
+	return fmt.Sprintf("%d, %d bytes", len(pc.Items), pc.Bytes)
+}
+
+type PruneReport struct {
+	DryRun   bool
+	Pods     PruneCategory
+	Images   PruneCategory
+	Datasets PruneCategory // orphaned datasets
+	Spool    PruneCategory // stale partial downloads
+	Cores    PruneCategory // core files of remaining pods, as UUID/NAME
+	Kept     []string      // items kept because of jetpack/keep annotation
+}
+
+func hasKeepAnnotation(ann types.Annotations) bool {
+	v, _ := ann.Get(keepAnnotation)
+	return v == "true"
+}
+
+// Returns time of the pod's last recorded event, or of its manifest's
+// modification if it has no events.
+func (pod *Pod) lastActivity() time.Time {
+	if events, err := pod.Events(); err == nil && len(events) > 0 {
+		return events[len(events)-1].Time
+	}
+	if fi, err := os.Stat(pod.Path("manifest")); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Prunes stopped pods, unreferenced images, and orphaned datasets.
+// Errors don't stop the pass; they are returned together with the
+// report of what has been pruned.
+func (h *Host) Prune(opts *PruneOptions) (*PruneReport, error) {
+	if opts == nil {
+		opts = &PruneOptions{GracePeriod: -1}
+	}
+	grace := opts.GracePeriod
+	if grace < 0 {
+		grace = h.settings().GC.GracePeriod
+	}
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	rep := &PruneReport{DryRun: opts.DryRun}
+	var erv error
+
+	// Pods
+	var remaining []*Pod
+	for _, pod := range h.Pods() {
+		if pod.Status() != PodStatusStopped || time.Since(pod.lastActivity()) < grace {
+			remaining = append(remaining, pod)
+			continue
+		}
+		if hasKeepAnnotation(pod.Manifest.Annotations) {
+			rep.Kept = append(rep.Kept, "pod "+pod.UUID.String())
+			remaining = append(remaining, pod)
+			continue
+		}
+		du, _ := pod.DiskUsage()
+		if !opts.DryRun {
+			if err := pod.Destroy(); err != nil {
+				erv = multierror.Append(erv, errors.Annotatef(err, "Pod %v", pod.UUID))
+				remaining = append(remaining, pod)
+				continue
+			}
+		}
+		rep.Pods.add(pod.UUID.String(), du.Used)
+	}
+
+	// Core files
+	for _, pod := range remaining {
+		removed, err := pod.pruneCores(opts.DryRun)
+		if err != nil {
+			erv = multierror.Append(erv, errors.Annotatef(err, "Pod %v", pod.UUID))
+		}
+		for _, core := range removed {
+			rep.Cores.add(pod.UUID.String()+"/"+core.Name, uint64(core.Size))
+		}
+	}
+
+	// Images
+	imgs, freedBy, err := h.gcImages()
+	if err != nil {
+		return rep, errors.Trace(err)
+	}
+	prunable, kept := planImagePrune(imgs, remaining)
+	for _, img := range kept {
+		rep.Kept = append(rep.Kept, "image "+img.Hash.String())
+	}
+	for _, img := range prunable {
+		freed := freedBy[img.UUID.String()]
+		if !opts.DryRun {
+			if err := img.Destroy(); err != nil {
+				erv = multierror.Append(erv, errors.Annotatef(err, "Image %v", img.Hash))
+				continue
+			}
+		}
+		rep.Images.add(img.Hash.String(), freed)
+	}
+
+	// Orphaned datasets
+	orphans, err := h.orphanedDatasets()
+	if err != nil {
+		return rep, errors.Trace(err)
+	}
+	for _, orphan := range orphans {
+		if !opts.DryRun {
+			h.log().Infof("Destroying orphaned dataset %v", orphan.name)
+			if err := zfs.Zfs("destroy", "-r", orphan.name); err != nil {
+				erv = multierror.Append(erv, errors.Annotate(err, orphan.name))
+				continue
+			}
+		}
+		rep.Datasets.add(orphan.name, orphan.used)
+	}
+
+	// Stale partial downloads
+	if maxAge := h.settings().GC.SpoolMaxAge; maxAge > 0 && !opts.DryRun {
+		removed, bytes, err := fetch.CleanSpool(h.Path("spool"), maxAge)
+		if err != nil {
+			erv = multierror.Append(erv, err)
+		}
+		rep.Spool = PruneCategory{Items: removed, Bytes: bytes}
+	}
+
+	return rep, erv
+}
+
+// Returns images that can be pruned, ordered so that each image comes
+// before images it depends on, and images kept only because of their
+// keep annotation. An image is needed if one of pods runs it, if it
+// has a keep annotation, or if a needed image depends on it.
+func planImagePrune(imgs []*Image, pods []*Pod) (prunable []*Image, kept []*Image) {
+	prunable, keptImages := planImageGC(imgs, pods, func(img *Image) string {
+		if hasKeepAnnotation(img.Manifest.Annotations) {
+			return keepAnnotation + " annotation"
+		}
+		return ""
+	}, nil)
+	for _, ki := range keptImages {
+		kept = append(kept, ki.img)
+	}
+	return prunable, kept
+}
+
+type orphanedDataset struct {
+	name string
+	used uint64
+}
+
+// Returns datasets under pods/ (of all storage classes) and images/
+// named after a UUID that have no pod or image metadata.
+func (h *Host) orphanedDatasets() ([]orphanedDataset, error) {
+	podsDatasets, err := h.podsDatasets()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	imagesName := h.Dataset.ChildName("images")
+	args := []string{"-p", "-d", "1", "-o", "name,used", imagesName}
+	var podsNames []string
+	for _, name := range podsDatasets {
+		podsNames = append(podsNames, name)
+		args = append(args, name)
+	}
+	rows, err := zfs.ZfsFields("list", args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return findOrphanedDatasets(rows, podsNames, imagesName, func(kind, id string) bool {
+		if kind == "pods" {
+			// Under the host lock, a pod that is not finished is a remnant
+			return newPod(h, uuid.Parse(id)).Exists()
+		}
+		return !NewImage(h, uuid.Parse(id)).IsEmpty()
+	})
+}
+
+// Picks orphans from `zfs list -p -o name,used` rows of podsNames
+// (datasets that hold pods) and imagesName; hasMetadata tells whether
+// a pod or an image ("pods" or "images") exists.
+func findOrphanedDatasets(rows [][]string, podsNames []string, imagesName string, hasMetadata func(kind, id string) bool) ([]orphanedDataset, error) {
+	var rv []orphanedDataset
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, errors.Errorf("Cannot parse zfs list output %#v", row)
+		}
+		parent, id := path.Split(row[0])
+		var kind string
+		if parent == imagesName+"/" {
+			kind = "images"
+		}
+		for _, podsName := range podsNames {
+			if parent == podsName+"/" {
+				kind = "pods"
+			}
+		}
+		if kind == "" {
+			continue
+		}
+		if uuid.Parse(id) == nil || hasMetadata(kind, id) {
+			continue
+		}
+		used, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse used space of %v", row[0])
+		}
+		rv = append(rv, orphanedDataset{row[0], used})
+	}
+	return rv, nil
+}
@@ -0,0 +1,97 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func testImage(t *testing.T, hash string, keep bool, deps ...string) *Image {
+	img := NewImage(nil, nil)
+	h, err := types.NewHash("sha512-" + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Hash = h
+	for _, dep := range deps {
+		dh, _ := types.NewHash("sha512-" + dep)
+		img.Manifest.Dependencies = append(img.Manifest.Dependencies, types.Dependency{ImageID: dh})
+	}
+	if keep {
+		img.Manifest.Annotations.Set(keepAnnotation, "true")
+	}
+	return img
+}
+
+func testPodRunning(hashes ...string) *Pod {
+	pod := newPod(nil, nil)
+	for _, hash := range hashes {
+		h, _ := types.NewHash("sha512-" + hash)
+		pod.Manifest.Apps = append(pod.Manifest.Apps, schema.RuntimeApp{Image: schema.RuntimeImage{ID: *h}})
+	}
+	return pod
+}
+
+func imageHashes(imgs []*Image) []string {
+	rv := make([]string, len(imgs))
+	for i, img := range imgs {
+		rv[i] = img.Hash.Val
+	}
+	return rv
+}
+
+func TestPlanImagePrune(t *testing.T) {
+	imgs := []*Image{
+		testImage(t, "0a", false),       // base, needed via 1a
+		testImage(t, "1a", false, "0a"), // run by a pod
+		testImage(t, "0b", false),       // base of an unused chain
+		testImage(t, "1b", false, "0b"), // unused
+		testImage(t, "2b", false, "1b"), // unused, depends on 1b
+		testImage(t, "0c", false),       // needed only by a kept image
+		testImage(t, "1c", true, "0c"),  // kept by annotation
+		testImage(t, "1d", false, "0a"), // unused child of a needed base
+	}
+	prunable, kept := planImagePrune(imgs, []*Pod{testPodRunning("1a")})
+	if expected := []string{"2b", "1d", "1b", "0b"}; !reflect.DeepEqual(imageHashes(prunable), expected) {
+		t.Errorf("Expected prunable %v, got %v", expected, imageHashes(prunable))
+	}
+	if expected := []string{"1c"}; !reflect.DeepEqual(imageHashes(kept), expected) {
+		t.Errorf("Expected kept %v, got %v", expected, imageHashes(kept))
+	}
+
+	// Image run by a pod is not reported as kept by annotation
+	imgs[1].Manifest.Annotations.Set(keepAnnotation, "true")
+	if _, kept := planImagePrune(imgs, []*Pod{testPodRunning("1a")}); len(kept) != 1 {
+		t.Errorf("Unexpected kept images %v", imageHashes(kept))
+	}
+}
+
+func TestFindOrphanedDatasets(t *testing.T) {
+	rows := [][]string{
+		{"zroot/jetpack/pods", "3000"},
+		{"zroot/jetpack/pods/6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5", "1000"},
+		{"zroot/jetpack/pods/0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0", "2000"},
+		{"zroot/jetpack/pods/scratch", "500"},
+		{"zroot/jetpack/images", "700"},
+		{"zroot/jetpack/images/9d4354db-2f2d-4b75-bcdb-7036ddd65d79", "700"},
+		{"fast/jetpack/pods", "400"},
+		{"fast/jetpack/pods/3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21", "400"},
+	}
+	podsNames := []string{"zroot/jetpack/pods", "fast/jetpack/pods"}
+	orphans, err := findOrphanedDatasets(rows, podsNames, "zroot/jetpack/images", func(kind, id string) bool {
+		return kind == "pods" && id == "6bd3f5f8-5a88-4b4e-9a9e-2b5f27c1f2d5"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []orphanedDataset{
+		{"zroot/jetpack/pods/0f1d7b4a-9d73-4bd4-8c6b-2d6b9b8ff1a0", 2000},
+		{"zroot/jetpack/images/9d4354db-2f2d-4b75-bcdb-7036ddd65d79", 700},
+		{"fast/jetpack/pods/3c2a1e44-1f0b-4c1e-8a55-0d9e3a6f7b21", 400},
+	}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("Expected %v, got %v", expected, orphans)
+	}
+}
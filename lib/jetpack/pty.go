@@ -0,0 +1,76 @@
+package jetpack
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Copies window size of terminal from to terminal to.
+func copyWinsize(from, to *os.File) error {
+	var ws [4]uint16 // struct winsize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, from.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, to.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Relays caller's terminal (switched to raw mode) to and from pty's
+// master until run finishes, and restores the terminal. Run is called
+// with the pty's slave, which it needs to close after starting the
+// process.
+func relayPTY(run func(slave *os.File) error) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer master.Close()
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		if err := copyWinsize(os.Stdin, master); err != nil {
+			slave.Close()
+			return errors.Trace(err)
+		}
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			slave.Close()
+			return errors.Trace(err)
+		}
+		defer terminal.Restore(int(os.Stdin.Fd()), state)
+
+		// Terminal's size changes are propagated to the pty for the
+		// whole session; kernel sends SIGWINCH to the session's
+		// foreground process group.
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer func() {
+			signal.Stop(winch)
+			close(winch)
+		}()
+		go func() {
+			for range winch {
+				copyWinsize(os.Stdin, master)
+			}
+		}()
+	}
+
+	go io.Copy(master, os.Stdin)
+	outDone := make(chan struct{})
+	go func() {
+		// Read from master fails with EIO once the slave is closed
+		io.Copy(os.Stdout, master)
+		close(outDone)
+	}()
+
+	err = run(slave)
+	<-outDone
+	return err
+}
@@ -0,0 +1,47 @@
+package jetpack
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/juju/errors"
+)
+
+// struct fiodgname_arg from <sys/filio.h>
+type fiodgnameArg struct {
+	len int32
+	buf unsafe.Pointer
+}
+
+// FIODGNAME = _IOW('f', 120, struct fiodgname_arg)
+var fiodgname = 0x80000000 | (uintptr(unsafe.Sizeof(fiodgnameArg{}))&0x1fff)<<16 | 'f'<<8 | 120
+
+// Opens a new pseudo-terminal pair.
+func openPTY() (master, slave *os.File, err error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_POSIX_OPENPT, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0, 0)
+	if errno != 0 {
+		return nil, nil, errors.Annotate(errno, "posix_openpt")
+	}
+	master = os.NewFile(fd, "/dev/ptmx")
+
+	buf := make([]byte, 64)
+	arg := fiodgnameArg{len: int32(len(buf)), buf: unsafe.Pointer(&buf[0])}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, fiodgname, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		master.Close()
+		return nil, nil, errors.Annotate(errno, "ioctl(FIODGNAME)")
+	}
+	name := string(buf)
+	for i, c := range buf {
+		if c == 0 {
+			name = string(buf[:i])
+			break
+		}
+	}
+
+	if slave, err = os.OpenFile("/dev/"+name, os.O_RDWR|syscall.O_NOCTTY, 0); err != nil {
+		master.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,13 @@
+// +build !freebsd
+
+package jetpack
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("Pseudo-terminals are supported only on FreeBSD")
+}
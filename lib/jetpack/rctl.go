@@ -0,0 +1,713 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+	"k8s.io/kubernetes/pkg/api/resource"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// Resource limits of a pod are rctl(8) rules on its jail, added right
+// after the jail is created and removed with it. They come from the
+// resource/cpu and resource/memory isolators, jetpack/RESOURCE
+// annotations and isolators, and rctl.RESOURCE host defaults; how they
+// are enforced, from jetpack/rctl/RESOURCE annotations and
+// rctl.enforce.RESOURCE. There is one rule per resource and action, as
+// the kernel keeps them, so that Pod.ReconcileRctl can fix them without
+// adding duplicates.
+
+// An rctl(8) rule on pod's jail
+type RctlRule struct {
+	Resource string // e.g. "memoryuse"
+	Action   string // e.g. "deny", "devctl"
+	Amount   uint64
+}
+
+func (r RctlRule) String() string {
+	return fmt.Sprintf("%v:%v=%d", r.Resource, r.Action, r.Amount)
+}
+
+// Returns true if the rule stops the jail from going above the amount,
+// rather than only reporting it.
+func (r RctlRule) Enforced() bool {
+	return r.Action != "devctl" && r.Action != "log"
+}
+
+// Pod isolators that jetpack knows how to enforce
+var podIsolators = map[types.ACIdentifier]bool{
+	types.ResourceCPUName:     true,
+	types.ResourceMemoryName:  true,
+	"jetpack/maxproc":         true,
+	"jetpack/openfiles":       true,
+	"jetpack/pseudoterminals": true,
+	"jetpack/storage":         true, // dataset's quota and reservation (see storage.go)
+}
+
+// Resources limited by a count of things (see Pod.countLimit)
+var countLimits = []string{"maxproc", "openfiles", "pseudoterminals"}
+
+// Per-process rlimits (see Rlimit) of count resources
+var countRlimits = map[string]string{
+	"maxproc":         "nproc",
+	"openfiles":       "nofile",
+	"pseudoterminals": "npts",
+}
+
+// A resource.Quantity (appc vendors its own copy of the package)
+type quantity interface {
+	Value() int64
+	MilliValue() int64
+}
+
+// Quantity of memory in bytes
+func bytesAmount(q quantity) uint64 {
+	if q.Value() <= 0 {
+		return 0
+	}
+	return uint64(q.Value())
+}
+
+// Quantity of CPU in millicores
+func millicoresAmount(q quantity) uint64 {
+	if q.MilliValue() <= 0 {
+		return 0
+	}
+	return uint64(q.MilliValue())
+}
+
+// Returns rctl pcpu amount for CPU limit in millicores.
+func pcpuPercent(millicores uint64) uint64 {
+	return (millicores + 9) / 10
+}
+
+// Returns limit and request of isolator name in an isolator list, as
+// amount; 0 if unset.
+func resourceIsolator(isos types.Isolators, name types.ACIdentifier, amount func(quantity) uint64) (limit, request uint64) {
+	for _, iso := range isos {
+		if res, ok := iso.Value().(types.Resource); ok && iso.Name == name {
+			if q := res.Limit(); q != nil {
+				limit = amount(q)
+			}
+			if q := res.Request(); q != nil {
+				request = amount(q)
+			}
+		}
+	}
+	return limit, request
+}
+
+// Returns pod's limit and request of isolator name (or, if it has
+// none, the sum of apps' isolators).
+func podResource(podIsos types.Isolators, appIsos []types.Isolators, name types.ACIdentifier, amount func(quantity) uint64) (limit, request uint64) {
+	if limit, request = resourceIsolator(podIsos, name, amount); limit > 0 || request > 0 {
+		return limit, request
+	}
+	for _, isos := range appIsos {
+		l, r := resourceIsolator(isos, name, amount)
+		if l == 0 {
+			// One unlimited app leaves the jail unlimited
+			return 0, 0
+		}
+		limit += l
+		request += r
+	}
+	return limit, request
+}
+
+// Returns rules enforcing pod's isolators, with memory limit enforced
+// by memoryAction.
+func rctlRules(podIsos types.Isolators, appIsos []types.Isolators, memoryAction string) []RctlRule {
+	var rules []RctlRule
+	limit, request := podResource(podIsos, appIsos, types.ResourceMemoryName, bytesAmount)
+	if limit > 0 {
+		rules = append(rules, RctlRule{"memoryuse", memoryAction, limit})
+	}
+	if request > 0 && (limit == 0 || request < limit) {
+		rules = append(rules, RctlRule{"memoryuse", "devctl", request})
+	}
+	if limit, _ := podResource(podIsos, appIsos, types.ResourceCPUName, millicoresAmount); limit > 0 {
+		rules = append(rules, RctlRule{"pcpu", "deny", pcpuPercent(limit)})
+	}
+	return rules
+}
+
+// Applies CPU limit in millicores (0 for none) to rules.
+func withCPULimit(rules []RctlRule, millicores uint64) []RctlRule {
+	rv := make([]RctlRule, 0, len(rules)+1)
+	for _, rule := range rules {
+		if rule.Resource != "pcpu" {
+			rv = append(rv, rule)
+		}
+	}
+	if millicores > 0 {
+		rv = append(rv, RctlRule{"pcpu", "deny", pcpuPercent(millicores)})
+	}
+	if len(rv) == 0 {
+		return nil
+	}
+	return rv
+}
+
+// Returns CPU limit in millicores from jetpack/cpu-limit annotation,
+// and whether it is set.
+func (pod *Pod) cpuLimitAnnotation() (uint64, bool, error) {
+	v, ok := pod.Manifest.Annotations.Get("jetpack/cpu-limit")
+	if !ok {
+		return 0, false, nil
+	}
+	if v == "off" || v == "" {
+		return 0, true, nil
+	}
+	q, err := resource.ParseQuantity(v)
+	if err != nil || q.MilliValue() <= 0 {
+		return 0, false, errors.Errorf("Invalid jetpack/cpu-limit annotation %#v of pod %v", v, pod.UUID)
+	}
+	return millicoresAmount(&q), true, nil
+}
+
+// Returns rctl rules that enforce pod's resource limits.
+func (pod *Pod) RctlRules() ([]RctlRule, error) {
+	appIsos := make([]types.Isolators, 0, len(pod.Manifest.Apps))
+	for _, rtApp := range pod.Manifest.Apps {
+		app := pod.App(rtApp.Name)
+		if app == nil {
+			return nil, errors.Errorf("Cannot find app %v of pod %v", rtApp.Name, pod.UUID)
+		}
+		appIsos = append(appIsos, app.app.Isolators)
+	}
+	rules := rctlRules(pod.Manifest.Isolators, appIsos, Config().GetString("rctl.memory.action", "deny"))
+	// Hard limits that enforcements are a percentage of; a memory
+	// request alone is not one.
+	limits := make(map[string]uint64)
+	if limit, _ := podResource(pod.Manifest.Isolators, appIsos, types.ResourceMemoryName, bytesAmount); limit > 0 {
+		limits["memoryuse"] = limit
+	}
+	cpu, _ := podResource(pod.Manifest.Isolators, appIsos, types.ResourceCPUName, millicoresAmount)
+	if annotated, ok, err := pod.cpuLimitAnnotation(); err != nil {
+		return nil, errors.Trace(err)
+	} else if ok {
+		cpu = annotated
+		rules = withCPULimit(rules, cpu)
+	}
+	if cpu > 0 {
+		limits["pcpu"] = pcpuPercent(cpu)
+	}
+	for _, res := range countLimits {
+		n, err := pod.countLimit(res)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n > 0 {
+			limits[res] = n
+			rules = append(rules, RctlRule{res, "deny", n})
+			if Config().GetBool("rctl."+res+".alert", false) {
+				rules = append(rules, RctlRule{res, "devctl", n})
+			}
+		}
+	}
+	enforcements := make(map[string]rctlEnforcement)
+	for _, res := range rctlResources {
+		if enf, err := pod.rctlEnforcement(res); err != nil {
+			return nil, errors.Trace(err)
+		} else if enf != nil {
+			enforcements[res] = enf
+		}
+	}
+	return enforceRctlRules(rules, limits, enforcements), nil
+}
+
+// Resources that pods can be limited by
+var rctlResources = []string{"maxproc", "memoryuse", "openfiles", "pcpu", "pseudoterminals"}
+
+// Actions that rules can take (the kernel supports more)
+var rctlActions = map[string]bool{"deny": true, "devctl": true, "log": true, "sigterm": true, "sigkill": true}
+
+// One action of a limit's enforcement
+type rctlThreshold struct {
+	Action  string
+	Percent uint64 // of the limit
+}
+
+// How a limit is enforced; nil for the default (deny when it's
+// reached)
+type rctlEnforcement []rctlThreshold
+
+// Parses enforcement of a limit: comma-separated ACTION[=PERCENT%]
+// entries (e.g. "devctl=90%,sigkill=110%"); percent defaults to 100.
+// The kernel keeps one rule per resource and action, so an action can
+// be used only once.
+func parseRctlEnforcement(str string) (rctlEnforcement, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var enf rctlEnforcement
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		th := rctlThreshold{Action: kv[0], Percent: 100}
+		if !rctlActions[th.Action] {
+			return nil, errors.Errorf("Invalid action %#v in %#v", th.Action, str)
+		}
+		if seen[th.Action] {
+			return nil, errors.Errorf("Action %v used more than once in %#v", th.Action, str)
+		}
+		seen[th.Action] = true
+		if len(kv) == 2 {
+			n, err := strconv.ParseUint(strings.TrimSuffix(kv[1], "%"), 10, 64)
+			if err != nil || !strings.HasSuffix(kv[1], "%") || n == 0 || n > 1000 {
+				return nil, errors.Errorf("Invalid percentage %#v in %#v", kv[1], str)
+			}
+			th.Percent = n
+		}
+		enf = append(enf, th)
+	}
+	return enf, nil
+}
+
+func validateRctlEnforcement(name, value string) error {
+	res := strings.TrimPrefix(name, "rctl.enforce.")
+	known := false
+	for _, r := range rctlResources {
+		known = known || r == res
+	}
+	if !known {
+		return errors.Errorf("%v: unknown resource %#v (known resources: %v)", name, res, strings.Join(rctlResources, ", "))
+	}
+	if _, err := parseRctlEnforcement(value); err != nil {
+		return errors.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+// Returns enforcement of pod's limit of res: from jetpack/rctl/RES
+// annotation, "enforce" field of pod's jetpack/RES isolator (for
+// count limits, which have one), or rctl.enforce.RES host property;
+// nil for the default.
+func (pod *Pod) rctlEnforcement(res string) (rctlEnforcement, error) {
+	if v, ok := pod.Manifest.Annotations.Get("jetpack/rctl/" + res); ok {
+		enf, err := parseRctlEnforcement(v)
+		return enf, errors.Annotatef(err, "jetpack/rctl/%v annotation of pod %v", res, pod.UUID)
+	}
+	if _, ok := countRlimits[res]; ok {
+		if value, err := pod.countIsolator(res); err != nil {
+			return nil, errors.Trace(err)
+		} else if value != nil && value.Enforce != "" {
+			enf, err := parseRctlEnforcement(value.Enforce)
+			return enf, errors.Annotatef(err, "jetpack/%v isolator of pod %v", res, pod.UUID)
+		}
+	}
+	enf, err := parseRctlEnforcement(Config().GetString("rctl.enforce."+res, ""))
+	return enf, errors.Annotatef(err, "rctl.enforce.%v", res)
+}
+
+// Applies enforcements by resource to rules, as percentages of the
+// resource's hard limit in limits, replacing the limit's own rule
+// (the first rule of the resource with the limit's amount) and rules
+// of the same actions. Resources without a hard limit, such as memory
+// with only a request, are not enforced. Returns rules sorted by
+// resource and action, with one rule for each, as the kernel keeps
+// them, so that they can be compared with rules that are loaded.
+func enforceRctlRules(rules []RctlRule, limits map[string]uint64, enforcements map[string]rctlEnforcement) []RctlRule {
+	var rv []RctlRule
+	seen := make(map[[2]string]bool)
+	add := func(rule RctlRule) {
+		if key := [2]string{rule.Resource, rule.Action}; !seen[key] {
+			seen[key] = true
+			rv = append(rv, rule)
+		}
+	}
+	for _, res := range rctlResources {
+		if limit := limits[res]; limit > 0 {
+			for _, th := range enforcements[res] {
+				add(RctlRule{res, th.Action, (limit*th.Percent + 99) / 100})
+			}
+		}
+	}
+	limitRules := make(map[string]bool)
+	for _, rule := range rules {
+		if limit := limits[rule.Resource]; limit > 0 && rule.Amount == limit && enforcements[rule.Resource] != nil && !limitRules[rule.Resource] {
+			// The limit itself, replaced by its enforcement
+			limitRules[rule.Resource] = true
+			continue
+		}
+		add(rule)
+	}
+	sortRctlRules(rv)
+	return rv
+}
+
+// Sorts rules by resource and action.
+func sortRctlRules(rules []RctlRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Resource != rules[j].Resource {
+			return rules[i].Resource < rules[j].Resource
+		}
+		return rules[i].Action < rules[j].Action
+	})
+}
+
+// Returns pod's limit of resource res (0 for none): from jetpack/RES
+// annotation ("off" for none), pod's jetpack/RES isolator, or rctl.RES
+// host property.
+func (pod *Pod) countLimit(res string) (uint64, error) {
+	name := "jetpack/" + res
+	if v, ok := pod.Manifest.Annotations.Get(name); ok {
+		if v == "off" {
+			return 0, nil
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("Invalid %v annotation %#v of pod %v", name, v, pod.UUID)
+		}
+		return n, nil
+	}
+	if value, err := pod.countIsolator(res); err != nil {
+		return 0, errors.Trace(err)
+	} else if value != nil {
+		return value.Limit, nil
+	}
+	return uint64(Config().GetInt("rctl."+res, 0)), nil
+}
+
+// Value of a pod's jetpack/RES isolator
+type countIsolatorValue struct {
+	Limit   uint64 `json:"limit"`
+	Enforce string `json:"enforce,omitempty"` // as in jetpack/rctl/RES annotation
+}
+
+// Returns value of pod's jetpack/RES isolator; nil if there's none.
+func (pod *Pod) countIsolator(res string) (*countIsolatorValue, error) {
+	name := "jetpack/" + res
+	for _, iso := range pod.Manifest.Isolators {
+		if iso.Name != types.ACIdentifier(name) {
+			continue
+		}
+		if iso.ValueRaw == nil {
+			return nil, errors.Errorf("Isolator %v of pod %v has no value", name, pod.UUID)
+		}
+		value := &countIsolatorValue{}
+		if err := json.Unmarshal(*iso.ValueRaw, value); err != nil {
+			return nil, errors.Annotatef(err, "Isolator %v of pod %v", name, pod.UUID)
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// Returns a warning if maxproc limit won't work as expected with
+// host's kern.maxproc and kern.maxprocperuid; "" if it will.
+func maxprocWarning(limit, maxproc, perUID uint64) string {
+	switch {
+	case maxproc > 0 && limit > maxproc:
+		return fmt.Sprintf("maxproc limit %d exceeds kern.maxproc (%d), the host will run out of processes first", limit, maxproc)
+	case perUID > 0 && limit > perUID:
+		return fmt.Sprintf("maxproc limit %d exceeds kern.maxprocperuid (%d), each user in the pod can't have more processes than that", limit, perUID)
+	}
+	return ""
+}
+
+// Returns warnings for app's rlimits that exceed pod's limits of the
+// same resource, as these won't be reached.
+func rlimitWarnings(rules []RctlRule, rls []Rlimit) []string {
+	var warnings []string
+	for _, rule := range rules {
+		rlName, ok := countRlimits[rule.Resource]
+		if !ok || !rule.Enforced() {
+			continue
+		}
+		for _, rl := range rls {
+			if rl.Name != rlName {
+				continue
+			}
+			if hard, err := strconv.ParseUint(rl.Hard, 10, 64); rl.Hard == rlimInfinity || (err == nil && hard > rule.Amount) {
+				warnings = append(warnings, fmt.Sprintf("%v rlimit (%v) exceeds pod's %v limit (%d), which applies to all its processes", rl.Name, rl.Hard, rule.Resource, rule.Amount))
+			}
+		}
+	}
+	return warnings
+}
+
+// Returns value of a numeric sysctl.
+func sysctlUint(name string) (uint64, error) {
+	out, err := systemCommand("/sbin/sysctl", "-n", name).OutputString()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	return n, errors.Annotatef(err, "sysctl %v", name)
+}
+
+func (pod *Pod) rctlSubject() string {
+	return "jail:" + pod.jailName()
+}
+
+// Checks that pod's limits can be enforced; called before the jail is
+// created.
+func (pod *Pod) checkRctl() error {
+	rules, err := pod.RctlRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, rule := range rules {
+		if rule.Resource == "maxproc" && rule.Enforced() {
+			maxproc, _ := sysctlUint("kern.maxproc")
+			perUID, _ := sysctlUint("kern.maxprocperuid")
+			if warning := maxprocWarning(rule.Amount, maxproc, perUID); warning != "" {
+				pod.log().Warnf("%v", warning)
+			}
+		}
+	}
+	for _, rtApp := range pod.Manifest.Apps {
+		rls, err := pod.appRlimits(rtApp.Name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, warning := range rlimitWarnings(rules, rls) {
+			pod.log().Warnf("app %v: %v", rtApp.Name, warning)
+		}
+	}
+	if len(rules) == 0 || racctEnabled() {
+		return nil
+	}
+	if Config().GetBool("rctl.required", true) {
+		return errors.Errorf("Pod %v has resource limits, but RACCT/RCTL is not enabled in the kernel; set kern.racct.enable=1 in /boot/loader.conf and reboot, or turn rctl.required off to run pods without limits", pod.UUID)
+	}
+	pod.log().Warnf("RACCT/RCTL is not enabled in the kernel, resource limits are not enforced: %v", rules)
+	return nil
+}
+
+// Adds rules that enforce pod's limits; called when jail is started.
+func (pod *Pod) loadRctl() error {
+	return errors.Trace(pod.ReconcileRctl())
+}
+
+// Brings rules on pod's jail that are loaded in the kernel in line
+// with pod's limits: removes the ones it shouldn't have, and adds the
+// missing or changed ones. Rules that are already there are kept, so
+// it can be called any number of times.
+func (pod *Pod) ReconcileRctl() error {
+	if !racctEnabled() {
+		return nil
+	}
+	rules, err := pod.RctlRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	live, err := pod.LiveRctlRules()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	remove, add := rctlChanges(live, rules)
+	for _, rule := range remove {
+		filter := fmt.Sprintf("%v:%v:%v", pod.rctlSubject(), rule.Resource, rule.Action)
+		pod.log().Debugf("Removing rctl rule %v", rule)
+		if err := systemCommand("/usr/bin/rctl", "-r", filter).Run(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	args := make([]string, len(add))
+	for i, rule := range add {
+		args[i] = pod.rctlSubject() + ":" + rule.String()
+	}
+	pod.log().Debugf("Adding rctl rules %v", args)
+	return errors.Trace(systemCommand("/usr/bin/rctl", append([]string{"-a"}, args...)...).Run())
+}
+
+// Returns rules to remove from live rules, and rules to add to them,
+// so that they become desired rules. A rule replaces a live one with
+// the same resource and action, which doesn't need to be removed.
+func rctlChanges(live, desired []RctlRule) (remove, add []RctlRule) {
+	type key struct{ resource, action string }
+	want := make(map[key]uint64, len(desired))
+	for _, rule := range desired {
+		want[key{rule.Resource, rule.Action}] = rule.Amount
+	}
+	have := make(map[key]uint64, len(live))
+	for _, rule := range live {
+		k := key{rule.Resource, rule.Action}
+		have[k] = rule.Amount
+		if _, ok := want[k]; !ok {
+			remove = append(remove, rule)
+		}
+	}
+	for _, rule := range desired {
+		if amount, ok := have[key{rule.Resource, rule.Action}]; !ok || amount != rule.Amount {
+			add = append(add, rule)
+		}
+	}
+	return remove, add
+}
+
+// Reconciles rctl rules of all running pods (see Pod.ReconcileRctl),
+// e.g. after host properties have changed, or rules have been lost.
+func (h *Host) ReconcileRctl() error {
+	var errs []string
+	for _, pod := range h.Pods() {
+		if pod.Status() != PodStatusRunning {
+			continue
+		}
+		if err := pod.ReconcileRctl(); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", pod.UUID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("Cannot reconcile rctl rules of pods: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Removes pod's rules; called when jail is removed, and when pod is
+// destroyed.
+func (pod *Pod) flushRctl() error {
+	if !racctEnabled() {
+		return nil
+	}
+	err := systemCommand("/usr/bin/rctl", "-r", pod.rctlSubject()).Quiet().Run()
+	if cerr, ok := err.(*run.CmdError); ok && strings.Contains(cerr.Stderr, "No such process") {
+		// There were no rules
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// Returns rules on pod's jail that are loaded in the kernel.
+func (pod *Pod) LiveRctlRules() ([]RctlRule, error) {
+	lines, err := systemCommand("/usr/bin/rctl", pod.rctlSubject()).OutputLines()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseRctlRules(lines)
+}
+
+// Returns rules that are in effect on pod's jail, sorted as RctlRules:
+// the ones loaded in the kernel. Returns nil if the pod isn't running,
+// or RACCT is not enabled, as nothing is enforced then.
+func (pod *Pod) EffectiveRctlRules() ([]RctlRule, error) {
+	if pod.Jid() == 0 || !racctEnabled() {
+		return nil, nil
+	}
+	rules, err := pod.LiveRctlRules()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sortRctlRules(rules)
+	return rules, nil
+}
+
+// Parses `rctl` output (subject:id:resource:action=amount lines; the
+// id may contain colons).
+func parseRctlRules(lines []string) ([]RctlRule, error) {
+	var rules []RctlRule
+	for _, line := range lines {
+		pieces := strings.Split(line, ":")
+		if len(pieces) < 4 {
+			return nil, errors.Errorf("Cannot parse rctl rule %#v", line)
+		}
+		pieces = pieces[len(pieces)-2:]
+		kv := strings.SplitN(pieces[1], "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("Cannot parse rctl rule %#v", line)
+		}
+		// Amount may be followed by "/per" (e.g. "/jail")
+		amount, err := strconv.ParseUint(strings.SplitN(kv[1], "/", 2)[0], 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse rctl rule %#v", line)
+		}
+		rules = append(rules, RctlRule{Resource: pieces[0], Action: kv[0], Amount: amount})
+	}
+	return rules, nil
+}
+
+// Returns CPUs that pod's jail may run on, from cpuset(1); nil if the
+// pod isn't running.
+func (pod *Pod) CPUSet() ([]int, error) {
+	jid := pod.Jid()
+	if jid == 0 {
+		return nil, nil
+	}
+	lines, err := systemCommand("/usr/bin/cpuset", "-g", "-j", strconv.Itoa(jid)).OutputLines()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseCPUSet(lines)
+}
+
+// Parses `cpuset -g` output ("jail 5 mask: 0, 1, 2, 3").
+func parseCPUSet(lines []string) ([]int, error) {
+	for _, line := range lines {
+		pieces := strings.SplitN(line, " mask: ", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+		var cpus []int
+		for _, field := range strings.Split(pieces[1], ",") {
+			cpu, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return nil, errors.Annotatef(err, "Cannot parse cpuset %#v", line)
+			}
+			cpus = append(cpus, cpu)
+		}
+		return cpus, nil
+	}
+	return nil, errors.Errorf("Cannot find mask in cpuset output %#v", lines)
+}
+
+// Records a match of a devctl rule, reported by devd(8) as rule
+// (e.g. "jail:jetpack/UUID:maxproc:devctl=512") and pid of the process
+// that matched it, in the event log of the rule's pod.
+func (h *Host) RecordRctlEvent(rule string, pid int) error {
+	id, rr, err := parseRctlEventRule(rule, Config().MustGetString("jail.namePrefix"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pod, err := h.GetPod(id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	details := rr.String() + " matched"
+	if enf, err := pod.rctlEnforcement(rr.Resource); err == nil {
+		for _, th := range enf {
+			if th.Action == rr.Action {
+				details += fmt.Sprintf(" (%d%% of %v limit)", th.Percent, rr.Resource)
+			}
+		}
+	}
+	if pid > 0 {
+		details += fmt.Sprintf(" by pid %d", pid)
+	}
+	pod.logEvent(&Event{Type: EventLimit, Details: details})
+	return nil
+}
+
+// Returns UUID of pod, whose jail names start with prefix, that rule
+// applies to, and the rule.
+func parseRctlEventRule(rule, prefix string) (uuid.UUID, *RctlRule, error) {
+	pieces := strings.Split(rule, ":")
+	if len(pieces) < 4 || pieces[0] != "jail" {
+		return nil, nil, errors.Errorf("Not a jail rule: %#v", rule)
+	}
+	rules, err := parseRctlRules([]string{rule})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	jailName := strings.Join(pieces[1:len(pieces)-2], ":")
+	if !strings.HasPrefix(jailName, prefix) {
+		return nil, nil, errors.Errorf("Jail %v of rule %#v is not a pod", jailName, rule)
+	}
+	id := uuid.Parse(jailName[len(prefix):])
+	if id == nil {
+		return nil, nil, errors.Errorf("Jail %v of rule %#v is not a pod", jailName, rule)
+	}
+	return id, &rules[0], nil
+}
@@ -0,0 +1,376 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func memoryIsolators(t *testing.T, value string) types.Isolators {
+	var isos types.Isolators
+	if value == "" {
+		return isos
+	}
+	if err := json.Unmarshal([]byte(`[{"name":"resource/memory","value":`+value+`}]`), &isos); err != nil {
+		t.Fatal(err)
+	}
+	return isos
+}
+
+func TestRctlRules(t *testing.T) {
+	for _, tc := range []struct {
+		pod      string
+		apps     []string
+		expected []RctlRule
+	}{
+		{"", []string{"", ""}, nil},
+		{`{"limit":"1Gi","request":"512Mi"}`, []string{""}, []RctlRule{
+			{"memoryuse", "deny", 1 << 30},
+			{"memoryuse", "devctl", 512 << 20},
+		}},
+		// Pod's isolator wins
+		{`{"limit":"1Gi"}`, []string{`{"limit":"2Gi"}`}, []RctlRule{{"memoryuse", "deny", 1 << 30}}},
+		// Apps' isolators are summed
+		{"", []string{`{"limit":"1Gi","request":"256Mi"}`, `{"limit":"512Mi","request":"256Mi"}`}, []RctlRule{
+			{"memoryuse", "deny", 1<<30 + 512<<20},
+			{"memoryuse", "devctl", 512 << 20},
+		}},
+		// Unless an app is unlimited
+		{"", []string{`{"limit":"1Gi"}`, ""}, nil},
+		// Request is only an alert
+		{`{"request":"512Mi"}`, nil, []RctlRule{{"memoryuse", "devctl", 512 << 20}}},
+		{`{"limit":"1Gi","request":"1Gi"}`, nil, []RctlRule{{"memoryuse", "deny", 1 << 30}}},
+	} {
+		appIsos := make([]types.Isolators, len(tc.apps))
+		for i, app := range tc.apps {
+			appIsos[i] = memoryIsolators(t, app)
+		}
+		if rules := rctlRules(memoryIsolators(t, tc.pod), appIsos, "deny"); !reflect.DeepEqual(rules, tc.expected) {
+			t.Errorf("%v %v: expected %v, got %v", tc.pod, tc.apps, tc.expected, rules)
+		}
+	}
+}
+
+func TestRctlRuleString(t *testing.T) {
+	if s := (RctlRule{"memoryuse", "sigterm", 1024}).String(); s != "memoryuse:sigterm=1024" {
+		t.Errorf("Unexpected rule %v", s)
+	}
+}
+
+func TestParseRctlRules(t *testing.T) {
+	for _, line := range []string{"jail:pod1:memoryuse", "jail:pod1:memoryuse:deny", "jail:pod1:memoryuse:deny=lots"} {
+		if rules, err := parseRctlRules([]string{line}); err == nil {
+			t.Errorf("Expected error for %#v, got %v", line, rules)
+		}
+	}
+
+	rules, err := parseRctlRules([]string{
+		"jail:jetpack/pod1:memoryuse:deny=1073741824",
+		"jail:jetpack:pod1:memoryuse:devctl=536870912/jail",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RctlRule{{"memoryuse", "deny", 1 << 30}, {"memoryuse", "devctl", 512 << 20}}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %v, got %v", expected, rules)
+	}
+}
+
+func TestRctlRulesCPU(t *testing.T) {
+	var podIsos types.Isolators
+	if err := json.Unmarshal([]byte(`[{"name":"resource/cpu","value":{"limit":"2500m","request":"1"}}]`), &podIsos); err != nil {
+		t.Fatal(err)
+	}
+	expected := []RctlRule{{"pcpu", "deny", 250}}
+	if rules := rctlRules(podIsos, nil, "deny"); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %v, got %v", expected, rules)
+	}
+
+	var appIsos []types.Isolators
+	for _, limit := range []string{"500m", "1"} {
+		var isos types.Isolators
+		if err := json.Unmarshal([]byte(`[{"name":"resource/cpu","value":{"limit":"`+limit+`"}}]`), &isos); err != nil {
+			t.Fatal(err)
+		}
+		appIsos = append(appIsos, isos)
+	}
+	expected = []RctlRule{{"memoryuse", "deny", 1 << 30}, {"pcpu", "deny", 150}}
+	if rules := rctlRules(memoryIsolators(t, `{"limit":"1Gi"}`), appIsos, "deny"); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %v, got %v", expected, rules)
+	}
+
+	// Override
+	if rules := withCPULimit(expected, 0); !reflect.DeepEqual(rules, expected[:1]) {
+		t.Errorf("Unexpected rules without CPU limit: %v", rules)
+	}
+	if rules := withCPULimit(nil, 3000); !reflect.DeepEqual(rules, []RctlRule{{"pcpu", "deny", 300}}) {
+		t.Errorf("Unexpected rules with CPU limit: %v", rules)
+	}
+}
+
+func TestPcpuPercent(t *testing.T) {
+	for millicores, percent := range map[uint64]uint64{
+		1: 1, 10: 1, 11: 2, 500: 50, 1000: 100, 2500: 250, 16000: 1600,
+	} {
+		if p := pcpuPercent(millicores); p != percent {
+			t.Errorf("%dm: expected %d%%, got %d%%", millicores, percent, p)
+		}
+	}
+}
+
+func TestCPULimitAnnotation(t *testing.T) {
+	pod := &Pod{}
+	for value, expected := range map[string]uint64{"2500m": 2500, "2": 2000, "0.5": 500, "off": 0} {
+		pod.Manifest.Annotations.Set("jetpack/cpu-limit", value)
+		if mc, ok, err := pod.cpuLimitAnnotation(); err != nil {
+			t.Errorf("%v: %v", value, err)
+		} else if !ok || mc != expected {
+			t.Errorf("%v: expected %dm, got %dm", value, expected, mc)
+		}
+	}
+	pod.Manifest.Annotations.Set("jetpack/cpu-limit", "lots")
+	if _, _, err := pod.cpuLimitAnnotation(); err == nil {
+		t.Error("Expected error for invalid annotation")
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	cpus, err := parseCPUSet([]string{"jail 5 mask: 0, 1, 2, 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cpus, []int{0, 1, 2, 3}) {
+		t.Errorf("Unexpected cpuset %v", cpus)
+	}
+	if _, err := parseCPUSet([]string{"jail 5 mask: 0, x"}); err == nil {
+		t.Error("Expected error for invalid mask")
+	}
+	if _, err := parseCPUSet(nil); err == nil {
+		t.Error("Expected error for missing mask")
+	}
+}
+
+func TestCountLimit(t *testing.T) {
+	pod := &Pod{}
+	if n, err := pod.countLimit("maxproc"); err != nil || n != 0 {
+		t.Errorf("Expected no limit by default, got %v, %v", n, err)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"name":"jetpack/maxproc","value":{"limit":256}}]`), &pod.Manifest.Isolators); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := pod.countLimit("maxproc"); err != nil || n != 256 {
+		t.Errorf("Expected isolator's limit, got %v, %v", n, err)
+	}
+
+	for value, expected := range map[string]uint64{"512": 512, "off": 0} {
+		pod.Manifest.Annotations.Set("jetpack/maxproc", value)
+		if n, err := pod.countLimit("maxproc"); err != nil || n != expected {
+			t.Errorf("%v: expected %v, got %v, %v", value, expected, n, err)
+		}
+	}
+	pod.Manifest.Annotations.Set("jetpack/maxproc", "many")
+	if _, err := pod.countLimit("maxproc"); err == nil {
+		t.Error("Expected error for invalid annotation")
+	}
+}
+
+func TestMaxprocWarning(t *testing.T) {
+	for _, tc := range []struct {
+		limit, maxproc, perUID uint64
+		warning                string
+	}{
+		{512, 10000, 9000, ""},
+		{9500, 10000, 9000, "kern.maxprocperuid (9000)"},
+		{20000, 10000, 9000, "kern.maxproc (10000)"},
+		{20000, 0, 0, ""},
+	} {
+		warning := maxprocWarning(tc.limit, tc.maxproc, tc.perUID)
+		if (tc.warning == "") != (warning == "") || !strings.Contains(warning, tc.warning) {
+			t.Errorf("%v: expected %#v, got %#v", tc, tc.warning, warning)
+		}
+	}
+}
+
+func TestParseRctlEventRule(t *testing.T) {
+	id, rule, err := parseRctlEventRule("jail:jetpack/6ba7b810-9dad-11d1-80b4-00c04fd430c8:maxproc:devctl=512", "jetpack/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" || *rule != (RctlRule{"maxproc", "devctl", 512}) {
+		t.Errorf("Unexpected pod %v, rule %v", id, rule)
+	}
+	for _, rule := range []string{
+		"process:1234:maxproc:devctl=512",
+		"jail:www:maxproc:devctl=512",
+		"jail:jetpack/nope:maxproc:devctl=512",
+		"jail:jetpack/6ba7b810-9dad-11d1-80b4-00c04fd430c8:maxproc",
+	} {
+		if _, _, err := parseRctlEventRule(rule, "jetpack/"); err == nil {
+			t.Errorf("Expected error for %#v", rule)
+		}
+	}
+}
+
+func TestRlimitWarnings(t *testing.T) {
+	rules := []RctlRule{{"openfiles", "deny", 1024}, {"openfiles", "devctl", 1024}, {"memoryuse", "deny", 1 << 30}}
+	warnings := rlimitWarnings(rules, []Rlimit{
+		{"nofile", "512", "4096"},
+		{"nproc", "infinity", "infinity"},
+		{"vmem", "infinity", "infinity"},
+	})
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "nofile rlimit (4096) exceeds pod's openfiles limit (1024)") {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+	if warnings := rlimitWarnings(rules, []Rlimit{{"nofile", "512", "1024"}}); len(warnings) != 0 {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+	if warnings := rlimitWarnings(rules, []Rlimit{{"nofile", "infinity", "infinity"}}); len(warnings) != 1 {
+		t.Errorf("Expected warning for unlimited nofile, got %q", warnings)
+	}
+}
+
+func TestParseRctlEnforcement(t *testing.T) {
+	for str, expected := range map[string]rctlEnforcement{
+		"":                        nil,
+		"sigkill":                 {{"sigkill", 100}},
+		"devctl=90%,sigkill=110%": {{"devctl", 90}, {"sigkill", 110}},
+		"log=50%, deny":           {{"log", 50}, {"deny", 100}},
+	} {
+		if enf, err := parseRctlEnforcement(str); err != nil || !reflect.DeepEqual(enf, expected) {
+			t.Errorf("%#v: expected %v, got %v, %v", str, expected, enf, err)
+		}
+	}
+	for _, str := range []string{"throttle", "devctl=90", "devctl=0%", "devctl=x%", "deny,deny=110%"} {
+		if _, err := parseRctlEnforcement(str); err == nil {
+			t.Errorf("Expected error for %#v", str)
+		}
+	}
+}
+
+func TestEnforceRctlRules(t *testing.T) {
+	rules := []RctlRule{
+		{"memoryuse", "deny", 1000},
+		{"memoryuse", "devctl", 500},
+		{"pcpu", "deny", 50},
+		{"maxproc", "deny", 100},
+		{"maxproc", "devctl", 100},
+	}
+	limits := map[string]uint64{"memoryuse": 1000, "pcpu": 50, "maxproc": 100}
+	if rv := enforceRctlRules(rules, limits, nil); !reflect.DeepEqual(rv, []RctlRule{
+		{"maxproc", "deny", 100},
+		{"maxproc", "devctl", 100},
+		{"memoryuse", "deny", 1000},
+		{"memoryuse", "devctl", 500},
+		{"pcpu", "deny", 50},
+	}) {
+		t.Errorf("Unexpected rules %v", rv)
+	}
+
+	enforcements := map[string]rctlEnforcement{
+		"memoryuse": {{"devctl", 90}, {"sigkill", 110}},
+		"maxproc":   {{"sigterm", 100}},
+		"openfiles": {{"deny", 100}},
+	}
+	rv := enforceRctlRules(rules, limits, enforcements)
+	if expected := []RctlRule{
+		{"maxproc", "devctl", 100},
+		{"maxproc", "sigterm", 100},
+		{"memoryuse", "devctl", 900},
+		{"memoryuse", "sigkill", 1100},
+		{"pcpu", "deny", 50},
+	}; !reflect.DeepEqual(rv, expected) {
+		t.Errorf("Expected %v, got %v", expected, rv)
+	}
+
+	// A memory request alone is not a limit to enforce
+	rules = []RctlRule{{"memoryuse", "devctl", 500}}
+	if rv := enforceRctlRules(rules, nil, enforcements); !reflect.DeepEqual(rv, rules) {
+		t.Errorf("Expected %v, got %v", rules, rv)
+	}
+}
+
+func TestRctlRulesEnforcement(t *testing.T) {
+	h, _, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	pod := newPod(h, nil)
+	if err := json.Unmarshal([]byte(`[{"name":"resource/memory","value":{"request":"1Ki"}},{"name":"resource/cpu","value":{"limit":"500m"}}]`), &pod.Manifest.Isolators); err != nil {
+		t.Fatal(err)
+	}
+	pod.Manifest.Annotations.Set("jetpack/rctl/memoryuse", "sigkill")
+	pod.Manifest.Annotations.Set("jetpack/rctl/pcpu", "devctl=80%,deny")
+	pod.Manifest.Annotations.Set("jetpack/cpu-limit", "2")
+	rules, err := pod.RctlRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []RctlRule{
+		{"memoryuse", "devctl", 1024},
+		{"pcpu", "deny", 200},
+		{"pcpu", "devctl", 160},
+	}; !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %v, got %v", expected, rules)
+	}
+}
+
+func TestRctlEnforcement(t *testing.T) {
+	pod := &Pod{}
+	if enf, err := pod.rctlEnforcement("maxproc"); err != nil || enf != nil {
+		t.Errorf("Expected default enforcement, got %v, %v", enf, err)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"name":"jetpack/maxproc","value":{"limit":256,"enforce":"sigkill"}}]`), &pod.Manifest.Isolators); err != nil {
+		t.Fatal(err)
+	}
+	if enf, err := pod.rctlEnforcement("maxproc"); err != nil || !reflect.DeepEqual(enf, rctlEnforcement{{"sigkill", 100}}) {
+		t.Errorf("Expected isolator's enforcement, got %v, %v", enf, err)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/rctl/maxproc", "devctl=80%,deny")
+	if enf, err := pod.rctlEnforcement("maxproc"); err != nil || !reflect.DeepEqual(enf, rctlEnforcement{{"devctl", 80}, {"deny", 100}}) {
+		t.Errorf("Expected annotation's enforcement, got %v, %v", enf, err)
+	}
+	pod.Manifest.Annotations.Set("jetpack/rctl/maxproc", "devctl=80")
+	if _, err := pod.rctlEnforcement("maxproc"); err == nil {
+		t.Error("Expected error for invalid annotation")
+	}
+}
+
+func TestRctlChanges(t *testing.T) {
+	live := []RctlRule{
+		{"maxproc", "deny", 100},
+		{"memoryuse", "deny", 1000},
+		{"memoryuse", "devctl", 500},
+	}
+	desired := []RctlRule{
+		{"maxproc", "deny", 100},
+		{"memoryuse", "devctl", 900},
+		{"memoryuse", "sigkill", 1100},
+	}
+	remove, add := rctlChanges(live, desired)
+	if !reflect.DeepEqual(remove, []RctlRule{{"memoryuse", "deny", 1000}}) {
+		t.Errorf("Unexpected rules to remove %v", remove)
+	}
+	if !reflect.DeepEqual(add, desired[1:]) {
+		t.Errorf("Unexpected rules to add %v", add)
+	}
+	if remove, add := rctlChanges(desired, desired); remove != nil || add != nil {
+		t.Errorf("Expected no changes, got %v, %v", remove, add)
+	}
+}
+
+func TestValidateRctlEnforcement(t *testing.T) {
+	if err := validateRctlEnforcement("rctl.enforce.memoryuse", "devctl=90%,sigkill=110%"); err != nil {
+		t.Error(err)
+	}
+	if err := validateRctlEnforcement("rctl.enforce.vmemoryuse", "deny"); err == nil {
+		t.Error("Expected error for unknown resource")
+	}
+	if err := validateRctlEnforcement("rctl.enforce.pcpu", "throttle"); err == nil {
+		t.Error("Expected error for unknown action")
+	}
+}
@@ -0,0 +1,663 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/3ofcoins/jetpack/lib/keystore"
+	"github.com/3ofcoins/jetpack/lib/ui"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Images are replicated between hosts as ZFS streams, without going
+// through an ACI. Image.Send writes a preamble line,
+// "jetpack-image-stream 2 LENGTH", LENGTH bytes of JSON metadata
+// (manifest, hashes, provenance), the image's signed ACI and its
+// signature if it has them, and a zfs send stream of the image's
+// sealed snapshot. Host.ReceiveImage receives the dataset under a new
+// UUID, checks its content against the content hash from the metadata
+// (see Verify; an image that is unsealed on the sender is sealed as
+// received, with a warning), and registers the image with the sender's
+// ID. An incremental stream, sent from a base image's sealed snapshot,
+// is received as a clone of the base, which the receiving host needs
+// to have received from the same snapshot (replicated, not imported
+// again).
+//
+// Nothing the sender says about the signature is taken on trust: the
+// image is signed on the receiving host only if the ACI's signature
+// is valid for the image's name with the keys trusted there, the ACI
+// has the image's ID and manifest, and the received rootfs holds the
+// ACI's files, and otherwise the files of the image's dependencies
+// only. Otherwise the image is received as unsigned, which needs
+// allow.no-signature. Unsigned images are received without an ACI.
+
+const imageStreamMagic = "jetpack-image-stream 2"
+
+// Preamble of streams without signed ACIs, which are still received
+const imageStreamMagicV1 = "jetpack-image-stream 1"
+
+// Longest metadata accepted by ReceiveImage
+const maxImageStreamMetadata = 1 << 20
+
+// Options of sending an image
+type SendOptions struct {
+	// Send increments from this image's sealed snapshot, which needs to
+	// be an origin of the image's rootfs (e.g. its first dependency);
+	// nil sends the whole rootfs
+	Base *types.Hash
+}
+
+// Metadata of an image stream
+type imageStreamMetadata struct {
+	Manifest     json.RawMessage
+	Hash         *types.Hash
+	ContentHash  *types.Hash      `json:",omitempty"`
+	Signature    *ImageSignature  `json:",omitempty"` // as the sender has it, informational
+	ACISize      int64            `json:",omitempty"` // of the signed ACI that follows metadata
+	ACISignature []byte           `json:",omitempty"` // armored detached signature of the ACI
+	Provenance   *ImageProvenance `json:",omitempty"`
+	Dependencies []types.Hash     `json:",omitempty"`
+	Base         *types.Hash      `json:",omitempty"` // of an incremental stream
+}
+
+// Writes image to w as a stream that Host.ReceiveImage receives.
+func (img *Image) Send(w io.Writer, opts *SendOptions) error {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	if img.Hash == nil {
+		return errors.Errorf("Image %v has no ID to send", img.ID())
+	}
+	snap, err := img.getRootfs().GetSnapshot(imageSnapshotName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var sendArgs []string
+	if opts.Base != nil {
+		base, err := img.Host.getLocalImage(*opts.Base, "", nil)
+		if err != nil {
+			return errors.Annotatef(err, "Base image %v", opts.Base)
+		}
+		sendArgs = []string{"-i", base.getRootfs().SnapshotName(imageSnapshotName)}
+	}
+
+	manifest, err := ioutil.ReadFile(img.Path("manifest"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	metadata := &imageStreamMetadata{
+		Manifest:     manifest,
+		Hash:         img.Hash,
+		ContentHash:  img.ContentHash,
+		Signature:    img.Signature,
+		Provenance:   img.Provenance,
+		Dependencies: img.Dependencies,
+		Base:         opts.Base,
+	}
+	var aci *os.File
+	if img.Signature != nil {
+		// The receiver checks the signature itself
+		if asc, err := ioutil.ReadFile(img.Path("aci.asc")); err != nil {
+			img.log().Warnf("sending as unsigned: %v", err)
+		} else if aci, err = os.Open(img.Path("aci")); err != nil {
+			img.log().Warnf("sending as unsigned: %v", err)
+		} else {
+			defer aci.Close()
+			fi, err := aci.Stat()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			metadata.ACISize = fi.Size()
+			metadata.ACISignature = asc
+		}
+	}
+	if err := writeImageStreamMetadata(w, metadata); err != nil {
+		return errors.Trace(err)
+	}
+	if metadata.ACISize > 0 {
+		if _, err := io.CopyN(w, aci, metadata.ACISize); err != nil {
+			return errors.Annotate(err, "Sending signed ACI")
+		}
+	}
+	img.log().Debugf("Sending %v %v", snap.Name, sendArgs)
+	return errors.Annotatef(snap.Send(w, sendArgs...), "Sending %v", img)
+}
+
+// Writes preamble of an image stream.
+func writeImageStreamMetadata(w io.Writer, metadata *imageStreamMetadata) error {
+	bb, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := fmt.Fprintf(w, "%v %d\n", imageStreamMagic, len(bb)); err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.Write(bb)
+	return errors.Trace(err)
+}
+
+// Reads preamble of an image stream.
+func readImageStreamMetadata(r *bufio.Reader) (*imageStreamMetadata, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, errors.Annotate(err, "Not an image stream")
+	}
+	var length int
+	magic := imageStreamMagic
+	v1 := strings.HasPrefix(line, imageStreamMagicV1+" ")
+	if v1 {
+		magic = imageStreamMagicV1
+	}
+	if n, err := fmt.Sscanf(line, magic+" %d\n", &length); err != nil || n != 1 {
+		return nil, errors.New("Not an image stream")
+	} else if length <= 0 || length > maxImageStreamMetadata {
+		return nil, errors.Errorf("Invalid image stream metadata length %d", length)
+	}
+	bb := make([]byte, length)
+	if _, err := io.ReadFull(r, bb); err != nil {
+		return nil, errors.Annotate(err, "Reading image stream metadata")
+	}
+	var metadata imageStreamMetadata
+	if err := json.Unmarshal(bb, &metadata); err != nil {
+		return nil, errors.Annotate(err, "Invalid image stream metadata")
+	}
+	if metadata.Hash == nil {
+		return nil, errors.New("Image stream has no image ID")
+	}
+	if metadata.ACISize < 0 || v1 && metadata.ACISize != 0 {
+		return nil, errors.Errorf("Invalid signed ACI size %d", metadata.ACISize)
+	}
+	return &metadata, nil
+}
+
+// Counts bytes read
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Receives an image written by Image.Send. If an image with the same
+// ID is already imported, it is returned, and the rest of the stream
+// is not read. Nothing is left behind if the receive or verification
+// fails. Images without a signature need opts.AllowUnsigned.
+func (h *Host) ReceiveImage(r io.Reader, opts *ImageOptions) (_ *Image, erv error) {
+	started := time.Now()
+	cr := &countingReader{Reader: r}
+	br := bufio.NewReader(cr)
+	metadata, err := readImageStreamMetadata(br)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var manifest schema.ImageManifest
+	if err := json.Unmarshal(metadata.Manifest, &manifest); err != nil {
+		return nil, errors.Annotate(err, "Invalid manifest")
+	}
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	img := NewImage(h, uuid.NewRandom())
+	ui := ui.NewUI("magenta", "receive", img.UUID.String())
+	ui.Printf("Receiving %v %v", manifest.Name, metadata.Hash)
+	if existing, err := h.getLocalImage(*metadata.Hash, "", nil); err == nil {
+		ui.Println("Image", metadata.Hash, "is already imported")
+		return existing, nil
+	} else if err != ErrNotFound {
+		return nil, errors.Trace(err)
+	}
+
+	img.Hash = metadata.Hash
+	defer func() {
+		if erv != nil {
+			img.abortImport()
+		}
+	}()
+	if err := os.MkdirAll(img.Path(), 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var signer *openpgp.Entity
+	if metadata.ACISize > 0 {
+		ui.Debug("Checking signature")
+		if signer, err = img.receiveSignedACI(br, &manifest, metadata); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if signer == nil {
+		if err := h.checkUnsigned(manifest.Name, opts); err != nil {
+			return nil, errors.Trace(err)
+		}
+		ui.Println("WARNING: receiving image without signature")
+	}
+
+	recvArgs := []string{"-u"}
+	if metadata.Base != nil {
+		base, err := h.getLocalImage(*metadata.Base, "", nil)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Base image %v of incremental stream", metadata.Base)
+		}
+		recvArgs = append(recvArgs, "-o", "origin="+base.getRootfs().SnapshotName(imageSnapshotName))
+	}
+
+	img.Manifest = manifest
+	img.Provenance = metadata.Provenance
+	img.Dependencies = metadata.Dependencies
+	if err := img.checkPlatform(); err != nil {
+		ui.Printf("WARNING: %v", err)
+	}
+
+	dsName := h.Dataset.ChildName(path.Join("images", img.UUID.String()))
+	err = zfs.ZfsReceive(br, append(recvArgs, dsName)...)
+	if ds, err2 := zfs.GetDataset(dsName); err2 == nil {
+		// Destroyed by abortImport if anything fails, even a receive
+		// that has left a partial dataset
+		img.rootfs = ds
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "Receiving rootfs")
+	}
+	if img.rootfs == nil {
+		return nil, errors.Errorf("Received dataset %v not found", dsName)
+	}
+	if _, err := img.rootfs.GetSnapshot(imageSnapshotName); err != nil {
+		return nil, errors.Annotatef(err, "Received dataset has no %v snapshot", imageSnapshotName)
+	}
+	if err := img.rootfs.Set("mountpoint", img.Path("rootfs")); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := img.rootfs.Mount(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if signer != nil {
+		ui.Debug("Checking rootfs against signed ACI")
+		if err := img.checkSignedRootfs(); err != nil {
+			ui.Printf("WARNING: signature doesn't cover received rootfs: %v", err)
+			signer = nil
+			if err := h.checkUnsigned(manifest.Name, opts); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if err := img.removeSignedACI(); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+	if signer != nil {
+		ui.Println("Valid signature for", manifest.Name, "by:")
+		ui.Println(keystore.KeyDescription(signer))
+		img.Signature = &ImageSignature{
+			Fingerprint: keystore.KeyFingerprint(signer),
+			Signer:      keystore.KeyIdentity(signer),
+			Verified:    time.Now(),
+		}
+	}
+
+	if err := img.saveManifest(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if metadata.ContentHash != nil {
+		ui.Println("Verifying content")
+	} else {
+		// Nothing to verify against; the content is sealed as received
+		img.log().Warnf("image is unsealed on the sending host, its content is not verified")
+	}
+	computed, entries, err := img.digestContent()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if expected := metadata.ContentHash; expected != nil && *computed != *expected {
+		return nil, &ImageVerificationError{Image: metadata.Hash.String(), Expected: expected, Computed: computed, EntriesUnknown: true}
+	}
+	if err := img.saveContent(computed, entries); err != nil {
+		return nil, errors.Annotate(err, "Recording content hash")
+	}
+
+	img.Import = &ImportSummary{Size: cr.n, Duration: time.Since(started), Origin: "replication"}
+	if err := img.register(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	ui.Println("Successfully received", img.Hash)
+	h.log().With("image", img.Hash.String()).Infof("received %v: %v", img, img.Import)
+	h.logEvent(&Event{Type: EventImport, Image: img.Hash.String(), Details: img.String()})
+	return img, nil
+}
+
+// Reads signed ACI of metadata from r into the image's directory, and
+// checks it: its signature needs to be valid for manifest's name, and
+// it needs to have the image's ID and manifest. Returns the signing
+// key, or nil (with the ACI removed) if the ACI isn't valid.
+func (img *Image) receiveSignedACI(r io.Reader, manifest *schema.ImageManifest, metadata *imageStreamMetadata) (*openpgp.Entity, error) {
+	aci, err := os.OpenFile(img.Path("aci"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0400)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer aci.Close()
+	if _, err := io.CopyN(aci, r, metadata.ACISize); err != nil {
+		return nil, errors.Annotate(err, "Receiving signed ACI")
+	}
+	if err := ioutil.WriteFile(img.Path("aci.asc"), metadata.ACISignature, 0400); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := img.checkSignedACI(aci, manifest, metadata); err != nil {
+		img.log().Warnf("invalid signed ACI: %v", err)
+		return nil, errors.Trace(img.removeSignedACI())
+	}
+	if _, err := aci.Seek(0, os.SEEK_SET); err != nil {
+		return nil, errors.Trace(err)
+	}
+	signer, err := img.Host.Keystore().CheckSignature(manifest.Name, aci, bytes.NewReader(metadata.ACISignature))
+	if err != nil {
+		img.log().Warnf("invalid signature: %v", err)
+		return nil, errors.Trace(img.removeSignedACI())
+	}
+	return signer, nil
+}
+
+// Checks that aci has the image's ID and manifest.
+func (img *Image) checkSignedACI(aci io.ReadSeeker, manifest *schema.ImageManifest, metadata *imageStreamMetadata) error {
+	if _, err := aci.Seek(0, os.SEEK_SET); err != nil {
+		return errors.Trace(err)
+	}
+	manifestBytes, err := readACIManifest(aci)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var aciManifest schema.ImageManifest
+	if err := json.Unmarshal(manifestBytes, &aciManifest); err != nil {
+		return errors.Annotate(err, "ACI's manifest")
+	}
+	if a, err := json.Marshal(aciManifest); err != nil {
+		return errors.Trace(err)
+	} else if b, err := json.Marshal(manifest); err != nil {
+		return errors.Trace(err)
+	} else if !bytes.Equal(a, b) {
+		return errors.New("ACI's manifest is not the image's")
+	}
+
+	if _, err := aci.Seek(0, os.SEEK_SET); err != nil {
+		return errors.Trace(err)
+	}
+	rd, _, err := DecompressingReader(aci)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rd.Close()
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, rd); err != nil {
+		return errors.Trace(err)
+	}
+	if hash, err := types.NewHash(fmt.Sprintf("sha512-%x", hasher.Sum(nil))); err != nil {
+		return errors.Trace(err)
+	} else if *hash != *metadata.Hash {
+		return errors.Errorf("ACI's ID is %v, not %v", hash, metadata.Hash)
+	}
+	return nil
+}
+
+// Removes the image's signed ACI and its signature.
+func (img *Image) removeSignedACI() error {
+	for _, name := range []string{"aci", "aci.asc"} {
+		if err := os.Remove(img.Path(name)); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Entry of a signed ACI's rootfs
+type signedEntry struct {
+	hdr    *tar.Header
+	digest []byte // of a regular file's content
+}
+
+// Checks that the image's rootfs is its signed ACI's one over its
+// dependencies' ones: each entry of the ACI's rootfs is in the rootfs
+// as it is in the ACI, and every other entry is in one of the
+// dependencies' rootfs.
+func (img *Image) checkSignedRootfs() error {
+	aci, err := os.Open(img.Path("aci"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer aci.Close()
+	rd, _, err := DecompressingReader(aci)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rd.Close()
+	entries, err := readSignedEntries(rd)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	root := img.Path("rootfs")
+	for rel, entry := range entries {
+		if err := checkSignedEntry(filepath.Join(root, rel), entry); err != nil {
+			return errors.Annotate(err, rel)
+		}
+	}
+
+	deps, err := img.signedDependencies()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || entries[filepath.ToSlash(rel)] != nil {
+			return nil
+		}
+		for _, dep := range deps {
+			if same, err := sameEntry(path, filepath.Join(dep, rel)); err != nil {
+				return err
+			} else if same {
+				return nil
+			}
+		}
+		return errors.Errorf("%v is not in the ACI or its dependencies", filepath.ToSlash(rel))
+	})
+}
+
+// Reads entries of an ACI's rootfs by their path in the rootfs; hard
+// links are entries of their targets.
+func readSignedEntries(r io.Reader) (map[string]*signedEntry, error) {
+	entries := make(map[string]*signedEntry)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, errors.Annotate(err, "Invalid tar archive")
+		}
+		rel, ok := signedEntryPath(hdr.Name)
+		if !ok || hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		entry := &signedEntry{hdr: hdr}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			hash := sha512.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return nil, errors.Trace(err)
+			}
+			entry.digest = hash.Sum(nil)
+		case tar.TypeLink:
+			target, ok := signedEntryPath(hdr.Linkname)
+			if !ok || entries[target] == nil {
+				return nil, errors.Errorf("%v: link to %v is not in rootfs", hdr.Name, hdr.Linkname)
+			}
+			entry = entries[target]
+		}
+		entries[rel] = entry
+	}
+}
+
+// Returns path of tar entry name in the rootfs, and false if the entry
+// is not in the rootfs.
+func signedEntryPath(name string) (string, bool) {
+	name = path.Clean(name)
+	if name == "rootfs" {
+		return ".", true
+	} else if !strings.HasPrefix(name, "rootfs/") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, "rootfs/"), true
+}
+
+// Checks that file at path is the entry.
+func checkSignedEntry(path string, entry *signedEntry) error {
+	hdr := entry.hdr
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var ok bool
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		ok = fi.IsDir()
+	case tar.TypeReg, tar.TypeRegA:
+		if ok = fi.Mode().IsRegular() && fi.Size() == hdr.Size; ok {
+			digest, err := fileDigest(path)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ok = bytes.Equal(digest, entry.digest)
+		}
+	case tar.TypeSymlink:
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.New("not a symlink")
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return errors.Trace(err)
+		} else if target != hdr.Linkname {
+			return errors.New("different symlink")
+		}
+		return nil
+	case tar.TypeChar:
+		ok = fi.Mode()&os.ModeCharDevice != 0
+	case tar.TypeBlock:
+		ok = fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+	case tar.TypeFifo:
+		ok = fi.Mode()&os.ModeNamedPipe != 0
+	default:
+		return errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+	if !ok {
+		return errors.New("different content")
+	}
+	if mode := formatVolumeMode(fi.Mode()); mode != fmt.Sprintf("%04o", hdr.Mode&07777) {
+		return errors.Errorf("mode is %v", mode)
+	}
+	if perms := fileInfoPerms(fi); perms.UID != hdr.Uid || perms.GID != hdr.Gid {
+		return errors.Errorf("owned by %d:%d", perms.UID, perms.GID)
+	}
+	return nil
+}
+
+// Returns true if files at a and b are the same: of the same type,
+// mode, and owner, with the same content or symlink target.
+func sameEntry(a, b string) (bool, error) {
+	afi, err := os.Lstat(a)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	bfi, err := os.Lstat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	if afi.Mode() != bfi.Mode() || fileInfoPerms(afi) != fileInfoPerms(bfi) {
+		return false, nil
+	}
+	switch {
+	case afi.Mode()&os.ModeSymlink != 0:
+		at, err := os.Readlink(a)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		bt, err := os.Readlink(b)
+		return at == bt, errors.Trace(err)
+	case afi.Mode().IsRegular():
+		if afi.Size() != bfi.Size() {
+			return false, nil
+		}
+		ad, err := fileDigest(a)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		bd, err := fileDigest(b)
+		return bytes.Equal(ad, bd), errors.Trace(err)
+	}
+	return true, nil
+}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	hash := sha512.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// Returns rootfs paths of the image's dependencies, as its signed
+// manifest names them.
+func (img *Image) signedDependencies() ([]string, error) {
+	var rv []string
+	for i, dep := range img.Manifest.Dependencies {
+		hash := dep.ImageID
+		if hash == nil && i < len(img.Dependencies) {
+			hash = &img.Dependencies[i]
+		}
+		if hash == nil {
+			return nil, errors.Errorf("Dependency %v has no ID", dep.ImageName)
+		}
+		dimg, err := img.Host.getLocalImage(*hash, "", nil)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Dependency %v", dep.ImageName)
+		}
+		if dimg.Manifest.Name != dep.ImageName {
+			return nil, errors.Errorf("Dependency %v is %v", dep.ImageName, dimg.Manifest.Name)
+		}
+		rv = append(rv, dimg.Path("rootfs"))
+	}
+	return rv, nil
+}
@@ -0,0 +1,154 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/magiconair/properties"
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/3ofcoins/jetpack/lib/fetch"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestImageStreamMetadata(t *testing.T) {
+	hash := types.NewHashSHA512([]byte("image"))
+	var buf bytes.Buffer
+	if err := writeImageStreamMetadata(&buf, &imageStreamMetadata{Manifest: json.RawMessage(`{"name":"example.com/app"}`), Hash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("ZFS STREAM")
+
+	br := bufio.NewReader(&buf)
+	if md, err := readImageStreamMetadata(br); err != nil {
+		t.Fatal(err)
+	} else if md.Hash.String() != hash.String() || string(md.Manifest) != `{"name":"example.com/app"}` {
+		t.Errorf("read %#v", md)
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "ZFS STREAM" {
+		t.Errorf("stream after metadata is %#v", string(rest))
+	}
+
+	for _, bad := range []string{
+		"",
+		"not an image stream\n",
+		imageStreamMagic + " 0\n",
+		imageStreamMagic + " 100000000\n{}",
+		imageStreamMagic + " 10\n{}",
+		imageStreamMagic + " 2\n{}",
+	} {
+		if _, err := readImageStreamMetadata(bufio.NewReader(strings.NewReader(bad))); err == nil {
+			t.Errorf("%#v: expected error", bad)
+		}
+	}
+}
+
+func TestReceiveImage(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	existing := saveTestImage(t, h, "example.com/existing")
+
+	stream := func(name string, hash *types.Hash, sig *ImageSignature) *bytes.Buffer {
+		var buf bytes.Buffer
+		manifest, _ := json.Marshal(minimalManifest(*types.MustACIdentifier(name), nil))
+		if err := writeImageStreamMetadata(&buf, &imageStreamMetadata{Manifest: manifest, Hash: hash, Signature: sig}); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("ZFS STREAM")
+		return &buf
+	}
+
+	// Already imported: stream is not received
+	if img, err := h.ReceiveImage(stream("example.com/existing", existing.Hash, nil), nil); err != nil {
+		t.Error(err)
+	} else if img.UUID.String() != existing.UUID.String() {
+		t.Errorf("received %v, expected existing %v", img.UUID, existing.UUID)
+	}
+
+	// Signed by a key that isn't trusted here: unsigned
+	sig := &ImageSignature{Fingerprint: "0123456789abcdef", Signer: "Example"}
+	if _, err := h.ReceiveImage(stream("example.com/new", types.NewHashSHA512([]byte("new")), sig), nil); errors.Cause(err) != fetch.ErrVerificationFailed {
+		t.Errorf("expected verification failure, got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(h.Path("images")); len(entries) != 2 {
+		t.Errorf("images/ has %d entries, expected the existing image and its hash", len(entries))
+	}
+}
+
+func TestReceiveSignedACI(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	signer, pubkey := testSigningKey(t, "signer")
+	if _, err := h.TrustKey("example.com/app", bytes.NewReader(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := minimalManifest(*types.MustACIdentifier("example.com/app"), nil)
+	manifestBytes, _ := json.Marshal(manifest)
+	var aci bytes.Buffer
+	tw := tar.NewWriter(&aci)
+	tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(manifestBytes)), Typeflag: tar.TypeReg})
+	tw.Write(manifestBytes)
+	tw.Close()
+	sign := func(data []byte) []byte {
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(data), nil); err != nil {
+			t.Fatal(err)
+		}
+		return sig.Bytes()
+	}
+
+	receive := func(hash *types.Hash, asc []byte) *openpgp.Entity {
+		img := NewImage(h, uuid.NewRandom())
+		if err := os.MkdirAll(img.Path(), 0700); err != nil {
+			t.Fatal(err)
+		}
+		md := &imageStreamMetadata{Hash: hash, ACISize: int64(aci.Len()), ACISignature: asc}
+		entity, err := img.receiveSignedACI(bytes.NewReader(aci.Bytes()), &manifest, md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(img.Path("aci.asc")); (entity != nil) != (err == nil) {
+			t.Errorf("signer %v, but aci.asc: %v", entity, err)
+		}
+		return entity
+	}
+
+	hash := types.NewHashSHA512(aci.Bytes())
+	if receive(hash, sign(aci.Bytes())) == nil {
+		t.Error("valid signature rejected")
+	}
+	// The signature must be of the received ACI, not just any signature by a trusted key
+	if receive(hash, sign([]byte("image"))) != nil {
+		t.Error("signature of another file accepted")
+	}
+	// The ACI must be the image's
+	if receive(types.NewHashSHA512([]byte("other")), sign(aci.Bytes())) != nil {
+		t.Error("ACI of another image accepted")
+	}
+}
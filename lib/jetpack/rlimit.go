@@ -0,0 +1,179 @@
+package jetpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Resource limits are set for app's processes by stage2 with
+// setrlimit(2). They are configured with `jetpack/rlimit/NAME`
+// annotations of the pod or of the app (app's take precedence), set to
+// "SOFT[:HARD]". Values are numbers with optional k/m/g/t suffix, or
+// "unlimited". Isolators can't be used, as appc refuses to serialize
+// isolators it doesn't know. Without a core annotation, the pod's core
+// dump policy (see CoredumpPolicy) can set the core limit. Limits that
+// a running app's process actually has are read from the kernel, as
+// `procstat -l` does (see App.EffectiveRlimits).
+
+const rlimitPrefix = "jetpack/rlimit/"
+
+// Names of limits, as in login.conf(5), with their RLIMIT_* numbers
+// from sys/resource.h (vmem is RLIMIT_AS)
+var rlimitResources = map[string]int{
+	"cpu": 0, "fsize": 1, "data": 2, "stack": 3, "core": 4, "rss": 5,
+	"memlock": 6, "nproc": 7, "nofile": 8, "sbsize": 9, "vmem": 10,
+	"npts": 11, "swap": 12, "kqueues": 13,
+}
+
+const rlimInfinity = "infinity"
+
+// RLIM_INFINITY
+const rlimInfinityValue = 1<<63 - 1
+
+type Rlimit struct {
+	Name       string
+	Soft, Hard string // decimal number or "infinity"
+}
+
+func (rl Rlimit) String() string {
+	return fmt.Sprintf("%v=%v:%v", rl.Name, rl.Soft, rl.Hard)
+}
+
+var rlimitMultipliers = map[byte]uint64{
+	'k': 1 << 10, 'K': 1 << 10,
+	'm': 1 << 20, 'M': 1 << 20,
+	'g': 1 << 30, 'G': 1 << 30,
+	't': 1 << 40, 'T': 1 << 40,
+}
+
+func parseRlimitValue(str string) (string, error) {
+	if str == "unlimited" || str == "infinity" {
+		return rlimInfinity, nil
+	}
+	mult := uint64(1)
+	if str != "" {
+		if m, ok := rlimitMultipliers[str[len(str)-1]]; ok {
+			mult = m
+			str = str[:len(str)-1]
+		}
+	}
+	v, err := strconv.ParseUint(str, 10, 64)
+	if err != nil || v > (1<<63-1)/mult {
+		return "", errors.Errorf("Invalid value %#v", str)
+	}
+	return strconv.FormatUint(v*mult, 10), nil
+}
+
+func parseRlimit(name, str string) (Rlimit, error) {
+	rl := Rlimit{Name: name}
+	if _, ok := rlimitResources[name]; !ok {
+		return rl, errors.Errorf("Unknown resource limit %#v", name)
+	}
+	pieces := strings.Split(str, ":")
+	if len(pieces) > 2 {
+		return rl, errors.Errorf("Invalid resource limit %v %#v", name, str)
+	}
+	var err error
+	if rl.Soft, err = parseRlimitValue(pieces[0]); err != nil {
+		return rl, errors.Annotatef(err, "Resource limit %v", name)
+	}
+	rl.Hard = rl.Soft
+	if len(pieces) == 2 {
+		if rl.Hard, err = parseRlimitValue(pieces[1]); err != nil {
+			return rl, errors.Annotatef(err, "Resource limit %v", name)
+		}
+	}
+	if rl.Hard != rlimInfinity {
+		soft, _ := strconv.ParseUint(rl.Soft, 10, 64)
+		hard, _ := strconv.ParseUint(rl.Hard, 10, 64)
+		if rl.Soft == rlimInfinity || soft > hard {
+			return rl, errors.Errorf("Resource limit %v: soft limit above hard limit", name)
+		}
+	}
+	return rl, nil
+}
+
+// Returns app's resource limits, sorted by name.
+func (app *App) Rlimits() ([]Rlimit, error) {
+	return app.Pod.appRlimits(app.Name)
+}
+
+func (pod *Pod) appRlimits(name types.ACName) ([]Rlimit, error) {
+	specs := make(map[string]string)
+	for _, ann := range pod.Manifest.Annotations {
+		if strings.HasPrefix(string(ann.Name), rlimitPrefix) {
+			specs[strings.TrimPrefix(string(ann.Name), rlimitPrefix)] = ann.Value
+		}
+	}
+	if rtApp := pod.Manifest.Apps.Get(name); rtApp != nil {
+		for _, ann := range rtApp.Annotations {
+			if strings.HasPrefix(string(ann.Name), rlimitPrefix) {
+				specs[strings.TrimPrefix(string(ann.Name), rlimitPrefix)] = ann.Value
+			}
+		}
+	}
+
+	if _, ok := specs["core"]; !ok {
+		if spec, err := pod.coredumpRlimit(); err != nil {
+			return nil, errors.Trace(err)
+		} else if spec != "" {
+			specs["core"] = spec
+		}
+	}
+
+	rls := make([]Rlimit, 0, len(specs))
+	for name, spec := range specs {
+		if rl, err := parseRlimit(name, spec); err != nil {
+			return nil, errors.Trace(err)
+		} else {
+			rls = append(rls, rl)
+		}
+	}
+	sort.Slice(rls, func(i, j int) bool { return rls[i].Name < rls[j].Name })
+	return rls, nil
+}
+
+// Parses struct rlimit (two 64-bit numbers, current and maximum) of
+// limit name, as kern.proc.rlimit sysctl returns it.
+func parseKernelRlimit(name string, buf []byte) (Rlimit, error) {
+	if len(buf) != 16 {
+		return Rlimit{}, errors.Errorf("Invalid %v limit of %d bytes", name, len(buf))
+	}
+	format := func(v uint64) string {
+		if v == rlimInfinityValue {
+			return rlimInfinity
+		}
+		return strconv.FormatUint(v, 10)
+	}
+	return Rlimit{
+		Name: name,
+		Soft: format(binary.LittleEndian.Uint64(buf[:8])),
+		Hard: format(binary.LittleEndian.Uint64(buf[8:])),
+	}, nil
+}
+
+// Returns limits that app's running process has, as the kernel
+// reports them, for each of app's configured limits (see Rlimits);
+// nil if the app isn't running detached, so there is no process to
+// read them from.
+func (app *App) EffectiveRlimits() ([]Rlimit, error) {
+	sv, err := app.Pod.Supervisor(app.Name)
+	if err != nil || sv == nil || sv.AppPid == 0 {
+		return nil, errors.Trace(err)
+	}
+	rls, err := app.Rlimits()
+	if err != nil || len(rls) == 0 {
+		return nil, errors.Trace(err)
+	}
+	names := make([]string, len(rls))
+	for i, rl := range rls {
+		names[i] = rl.Name
+	}
+	return processRlimits(sv.AppPid, names)
+}
@@ -0,0 +1,30 @@
+// +build freebsd,amd64
+
+package jetpack
+
+import (
+	"syscall"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Reads limits of process pid, by name, from the kernel; nil if the
+// process has exited.
+func processRlimits(pid int, names []string) ([]Rlimit, error) {
+	rls := make([]Rlimit, 0, len(names))
+	for _, name := range names {
+		buf, err := unix.SysctlRaw("kern.proc.rlimit", pid, rlimitResources[name])
+		if err == syscall.ESRCH {
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "sysctl kern.proc.rlimit %d %v", pid, name)
+		}
+		rl, err := parseKernelRlimit(name, buf)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rls = append(rls, rl)
+	}
+	return rls, nil
+}
@@ -0,0 +1,9 @@
+// +build !freebsd !amd64
+
+package jetpack
+
+import "github.com/juju/errors"
+
+func processRlimits(pid int, names []string) ([]Rlimit, error) {
+	return nil, errors.New("Reading process limits is supported only on FreeBSD/amd64")
+}
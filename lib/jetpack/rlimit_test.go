@@ -0,0 +1,74 @@
+package jetpack
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestParseRlimit(t *testing.T) {
+	for str, expected := range map[string]Rlimit{
+		"1024":              {"nofile", "1024", "1024"},
+		"1024:4096":         {"nofile", "1024", "4096"},
+		"1k:unlimited":      {"nofile", "1024", "infinity"},
+		"unlimited":         {"nofile", "infinity", "infinity"},
+		"256m:2G":           {"nofile", "268435456", "2147483648"},
+		"0":                 {"nofile", "0", "0"},
+		"infinity:infinity": {"nofile", "infinity", "infinity"},
+	} {
+		if rl, err := parseRlimit("nofile", str); err != nil {
+			t.Errorf("%#v: %v", str, err)
+		} else if rl != expected {
+			t.Errorf("%#v: got %#v, expected %#v", str, rl, expected)
+		}
+	}
+
+	for _, str := range []string{"", "lots", "1.5g", "-1", "10:5", "unlimited:1024", "1:2:3", "1x", "99999999999t"} {
+		if rl, err := parseRlimit("nofile", str); err == nil {
+			t.Errorf("%#v: expected error, got %#v", str, rl)
+		}
+	}
+
+	if rl, err := parseRlimit("files", "1024"); err == nil {
+		t.Errorf("Expected error for unknown limit, got %#v", rl)
+	}
+}
+
+func TestAppRlimits(t *testing.T) {
+	pod := newPod(nil, nil)
+	pod.Manifest.Annotations.Set("jetpack/rlimit/nofile", "1024")
+	pod.Manifest.Annotations.Set("jetpack/rlimit/core", "0")
+	name := *types.MustACName("app")
+	rtApp := schema.RuntimeApp{Name: name}
+	rtApp.Annotations.Set("jetpack/rlimit/nofile", "4096:8192")
+	pod.Manifest.Apps = schema.AppList{rtApp}
+
+	expected := []Rlimit{{"core", "0", "0"}, {"nofile", "4096", "8192"}}
+	if rls, err := pod.appRlimits(name); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rls, expected) {
+		t.Errorf("Got %#v, expected %#v", rls, expected)
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/rlimit/stack", "huge")
+	if err := pod.checkAppOptions(); err == nil {
+		t.Error("Invalid limit passed validation")
+	}
+}
+
+func TestParseKernelRlimit(t *testing.T) {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, 1024)
+	binary.LittleEndian.PutUint64(buf[8:], rlimInfinityValue)
+	if rl, err := parseKernelRlimit("nofile", buf); err != nil {
+		t.Fatal(err)
+	} else if expected := (Rlimit{"nofile", "1024", "infinity"}); rl != expected {
+		t.Errorf("Expected %#v, got %#v", expected, rl)
+	}
+	if _, err := parseKernelRlimit("nofile", buf[:8]); err == nil {
+		t.Error("Short limit accepted")
+	}
+}
@@ -0,0 +1,90 @@
+package jetpack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Pods with `jetpack/readonly-rootfs` annotation set to "true" have
+// apps' rootfs datasets set read-only after prepJail has written its
+// files. Paths listed in `jetpack/writable-paths` annotation (or in
+// the readonly.writable-paths property) get their own writable
+// datasets, seeded with the image's contents. The datasets are
+// children of the pod's dataset, so they don't inherit the readonly
+// property.
+
+func (pod *Pod) readonlyRootfs() bool {
+	if pod.Ephemeral() {
+		// Read-only already, and there are no datasets to set
+		return false
+	}
+	ro, _ := pod.Manifest.Annotations.Get("jetpack/readonly-rootfs")
+	return ro == "true"
+}
+
+func (pod *Pod) writablePaths() []string {
+	paths, ok := pod.Manifest.Annotations.Get("jetpack/writable-paths")
+	if !ok {
+		paths = Config().GetString("readonly.writable-paths", "")
+	}
+	return strings.FieldsFunc(paths, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// Creates writable datasets for app i of a read-only rootfs pod.
+func (pod *Pod) createWritablePaths(ds *zfs.Dataset, i int, appRootfs string) error {
+	for j, path := range pod.writablePaths() {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("Writable path %#v is not absolute", path)
+		}
+		if err := mkdirMountPoint(appRootfs, path, nil); err != nil {
+			return errors.Annotatef(err, "Writable path %v", path)
+		}
+
+		// Create the dataset in a temporary location first, to copy
+		// the image's contents that will be covered by the mount.
+		tmpPath := ds.Path(fmt.Sprintf("writable.%d.%d", i, j))
+		pod.log().Debugf("Creating writable.%d.%d for %v", i, j, path)
+		wds, err := ds.CreateDataset(fmt.Sprintf("writable.%d.%d", i, j), "-omountpoint="+tmpPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := seedVolume(tmpPath, filepath.Join(appRootfs, path)); err != nil {
+			return errors.Trace(err)
+		}
+		if err := wds.Set("mountpoint", filepath.Join(appRootfs, path)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Sets readonly property of apps' rootfs datasets.
+func (pod *Pod) setRootfsReadonly(readonly bool) error {
+	ds := pod.getDataset()
+	if ds == nil {
+		return errors.Errorf("Pod %v has no dataset", pod.UUID)
+	}
+	z := pod.Host.datasets()
+	value := "off"
+	if readonly {
+		value = "on"
+	}
+	for i := range pod.Manifest.Apps {
+		name := ds.ChildName(fmt.Sprintf("rootfs.%d", i))
+		if props, err := z.GetProperties(name, "readonly"); err != nil {
+			return errors.Trace(err)
+		} else if current, err := props["readonly"].Bool(); err != nil {
+			return errors.Trace(err)
+		} else if current != readonly {
+			if err := z.SetProperty(name, "readonly", value); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package jetpack
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Options of a single run of an app's commands. They are not saved
+// in the pod's manifest.
+type RunOptions struct {
+	// Additional VAR=value environment; overrides the app's
+	// environment.
+	Env []string
+
+	// Env files (absolute paths) read for this run; they override
+	// the app's environment and the pod's env files, and are
+	// overridden by Env.
+	EnvFiles []string
+
+	// Exec override: with ExecReplace mode, Exec replaces the app's
+	// exec; with ExecAppend, it's appended to the app's exec as
+	// additional arguments. Empty mode means no override.
+	ExecMode string
+	Exec     []string
+
+	// Commands' stdin: StdinCaller (default) passes stdin given by the
+	// caller (for pod runs, it's /dev/null), StdinNull attaches
+	// /dev/null, StdinReader streams from Stdin.
+	StdinMode string
+	Stdin     io.Reader `json:"-"`
+}
+
+const (
+	ExecReplace = "replace"
+	ExecAppend  = "append"
+
+	StdinCaller = "caller"
+	StdinNull   = "null"
+	StdinReader = "reader"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Verifies the options.
+func (opts *RunOptions) Check() error {
+	if opts == nil {
+		return nil
+	}
+	for _, ev := range opts.Env {
+		if name := strings.SplitN(ev, "=", 2)[0]; name == ev || !envNameRegexp.MatchString(name) {
+			return errors.Errorf("Invalid environment variable %#v, expected NAME=VALUE", ev)
+		}
+	}
+	if err := checkEnvFiles(opts.EnvFiles); err != nil {
+		return errors.Trace(err)
+	}
+	switch opts.ExecMode {
+	case "":
+		if len(opts.Exec) > 0 {
+			return errors.New("Exec override needs a mode")
+		}
+	case ExecReplace:
+		if len(opts.Exec) == 0 {
+			return errors.New("Replacement exec is empty")
+		}
+		if !strings.HasPrefix(opts.Exec[0], "/") {
+			return errors.Errorf("Replacement exec %#v needs an absolute path", opts.Exec[0])
+		}
+	case ExecAppend:
+	default:
+		return errors.Errorf("Invalid exec override mode %#v", opts.ExecMode)
+	}
+	switch opts.StdinMode {
+	case "", StdinCaller, StdinNull:
+	case StdinReader:
+		if opts.Stdin == nil {
+			return errors.New("No reader for stdin")
+		}
+	default:
+		return errors.Errorf("Invalid stdin mode %#v", opts.StdinMode)
+	}
+	return nil
+}
+
+// Returns stdin for commands, given caller's one. Nil means
+// /dev/null.
+func (opts *RunOptions) stdin(caller io.Reader) io.Reader {
+	switch {
+	case opts == nil:
+		return caller
+	case opts.StdinMode == StdinNull:
+		return nil
+	case opts.StdinMode == StdinReader:
+		return opts.Stdin
+	default:
+		return caller
+	}
+}
+
+// Returns a copy of opts that attaches /dev/null to stdin.
+func (opts *RunOptions) nullStdin() *RunOptions {
+	rv := &RunOptions{}
+	if opts != nil {
+		*rv = *opts
+	}
+	rv.StdinMode, rv.Stdin = StdinNull, nil
+	return rv
+}
+
+// Returns the app's exec with the override applied.
+func (opts *RunOptions) exec(appExec []string) []string {
+	switch {
+	case opts == nil:
+		return appExec
+	case opts.ExecMode == ExecReplace:
+		return opts.Exec
+	case opts.ExecMode == ExecAppend:
+		return append(append([]string(nil), appExec...), opts.Exec...)
+	default:
+		return appExec
+	}
+}
+
+// Describes the options for the pod's event log.
+func (opts *RunOptions) String() string {
+	if opts == nil || (len(opts.Env) == 0 && len(opts.EnvFiles) == 0 && opts.ExecMode == "") {
+		return "no options"
+	}
+	var desc []string
+	if len(opts.Env) > 0 {
+		desc = append(desc, "env "+quoteAll(opts.Env))
+	}
+	if len(opts.EnvFiles) > 0 {
+		desc = append(desc, "env files "+quoteAll(opts.EnvFiles))
+	}
+	if opts.ExecMode != "" {
+		desc = append(desc, opts.ExecMode+" exec "+quoteAll(opts.Exec))
+	}
+	return strings.Join(desc, ", ")
+}
+
+func quoteAll(strs []string) string {
+	quoted := make([]string, len(strs))
+	for i, str := range strs {
+		quoted[i] = strconv.Quote(str)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Returns env with variables of extra set, replacing the ones of the
+// same name.
+func mergeEnv(env, extra []string) []string {
+	rv := make([]string, 0, len(env)+len(extra))
+	overridden := make(map[string]bool, len(extra))
+	for _, ev := range extra {
+		overridden[strings.SplitN(ev, "=", 2)[0]] = true
+	}
+	for _, ev := range env {
+		if !overridden[strings.SplitN(ev, "=", 2)[0]] {
+			rv = append(rv, ev)
+		}
+	}
+	return append(rv, extra...)
+}
@@ -0,0 +1,117 @@
+package jetpack
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunOptionsCheck(t *testing.T) {
+	var opts *RunOptions
+	if err := opts.Check(); err != nil {
+		t.Error("nil options:", err)
+	}
+	opts = &RunOptions{Env: []string{"DSN=postgres://db/app?sslmode=disable", "MULTI=line\nline", "EMPTY="}}
+	if err := opts.Check(); err != nil {
+		t.Error(err)
+	}
+	for _, ev := range []string{"NOVALUE", "=value", "/PATH=x", "1ST=x", "A-B=x"} {
+		if err := (&RunOptions{Env: []string{ev}}).Check(); err == nil {
+			t.Errorf("%#v: expected error", ev)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	env := mergeEnv(
+		[]string{"PATH=/bin", "MODE=production", "LANG=C"},
+		[]string{"MODE=debug=1", "NEW=x"})
+	expected := []string{"PATH=/bin", "LANG=C", "MODE=debug=1", "NEW=x"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Got %v, expected %v", env, expected)
+	}
+}
+
+func TestRunOptionsExec(t *testing.T) {
+	appExec := []string{"/usr/local/bin/server", "-v"}
+
+	var opts *RunOptions
+	if exec := opts.exec(appExec); !reflect.DeepEqual(exec, appExec) {
+		t.Errorf("nil options: got %v", exec)
+	}
+
+	opts = &RunOptions{ExecMode: ExecReplace, Exec: []string{"/usr/local/bin/migrate", "up"}}
+	if err := opts.Check(); err != nil {
+		t.Error(err)
+	}
+	if exec := opts.exec(appExec); !reflect.DeepEqual(exec, opts.Exec) {
+		t.Errorf("replace: got %v", exec)
+	}
+
+	opts = &RunOptions{ExecMode: ExecAppend, Exec: []string{"--debug"}}
+	if err := opts.Check(); err != nil {
+		t.Error(err)
+	}
+	if exec := opts.exec(appExec); !reflect.DeepEqual(exec, []string{"/usr/local/bin/server", "-v", "--debug"}) {
+		t.Errorf("append: got %v", exec)
+	}
+	if len(appExec) != 2 {
+		t.Errorf("App's exec modified: %v", appExec)
+	}
+
+	for _, opts := range []*RunOptions{
+		{ExecMode: ExecReplace},
+		{ExecMode: ExecReplace, Exec: []string{}},
+		{ExecMode: ExecReplace, Exec: []string{"migrate"}},
+		{Exec: []string{"/bin/sh"}},
+		{ExecMode: "prepend", Exec: []string{"/bin/sh"}},
+		{EnvFiles: []string{"app.env"}},
+	} {
+		if err := opts.Check(); err == nil {
+			t.Errorf("%v: expected error", opts)
+		}
+	}
+}
+
+func TestRunOptionsStdin(t *testing.T) {
+	caller, reader := strings.NewReader("caller"), strings.NewReader("reader")
+
+	var opts *RunOptions
+	if stdin := opts.stdin(caller); stdin != caller {
+		t.Errorf("nil options: got %v", stdin)
+	}
+	for _, tc := range []struct {
+		opts     *RunOptions
+		expected io.Reader
+	}{
+		{&RunOptions{}, caller},
+		{&RunOptions{StdinMode: StdinCaller}, caller},
+		{&RunOptions{StdinMode: StdinNull}, nil},
+		{&RunOptions{StdinMode: StdinReader, Stdin: reader}, reader},
+	} {
+		if err := tc.opts.Check(); err != nil {
+			t.Errorf("%#v: %v", tc.opts.StdinMode, err)
+		}
+		if stdin := tc.opts.stdin(caller); stdin != tc.expected {
+			t.Errorf("%#v: got %v, expected %v", tc.opts.StdinMode, stdin, tc.expected)
+		}
+	}
+
+	for _, opts := range []*RunOptions{{StdinMode: StdinReader}, {StdinMode: "tty"}} {
+		if err := opts.Check(); err == nil {
+			t.Errorf("%#v: expected error", opts.StdinMode)
+		}
+	}
+
+	// Event handlers' stdin
+	if stdin := opts.nullStdin().stdin(caller); stdin != nil {
+		t.Errorf("nil options with null stdin: got %v", stdin)
+	}
+	withReader := &RunOptions{StdinMode: StdinReader, Stdin: reader, Env: []string{"A=1"}}
+	if nopts := withReader.nullStdin(); nopts.stdin(caller) != nil || len(nopts.Env) != 1 {
+		t.Errorf("Unexpected options %#v", nopts)
+	} else if withReader.stdin(caller) != reader {
+		t.Error("Options modified")
+	}
+}
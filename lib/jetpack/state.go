@@ -0,0 +1,293 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+)
+
+// Host state archive, for disaster recovery: a tar file with
+// `state.json` (configuration, images the pods run, and pods' IP
+// addresses) and each pod's manifest and runtime metadata (exit
+// statuses and event log) under `pods/UUID/`. Image data and
+// contents of pods' volumes are not included.
+
+const stateFormatVersion = 1
+
+// Pod files included in the state archive
+var statePodFiles = []string{"manifest", "exit-status", "events.log"}
+
+type stateImage struct {
+	Hash   types.Hash
+	Name   types.ACIdentifier `json:",omitempty"`
+	Labels types.Labels       `json:",omitempty"`
+}
+
+type hostState struct {
+	Version  int
+	Exported time.Time
+	Config   map[string]string
+	Images   []stateImage
+	IPs      map[string]string // pod UUID to IP address
+	Pods     []string          // pod UUIDs
+}
+
+// Writes archive of the host's state to w.
+func (h *Host) ExportState(w io.Writer) error {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
+
+	st := &hostState{
+		Version:  stateFormatVersion,
+		Exported: time.Now(),
+		Config:   make(map[string]string),
+		IPs:      make(map[string]string),
+	}
+	for _, key := range Config().Keys() {
+		st.Config[key] = Config().GetString(key, "")
+	}
+
+	pods := h.Pods()
+	images := make(map[types.Hash]bool)
+	for _, pod := range pods {
+		id := pod.UUID.String()
+		st.Pods = append(st.Pods, id)
+		if ip, ok := pod.Manifest.Annotations.Get("ip-address"); ok {
+			st.IPs[id] = ip
+		}
+		for _, rtapp := range pod.Manifest.Apps {
+			if images[rtapp.Image.ID] {
+				continue
+			}
+			images[rtapp.Image.ID] = true
+			si := stateImage{Hash: rtapp.Image.ID}
+			if img, err := h.GetLocalImage(rtapp.Image.ID, "", nil); err == nil {
+				si.Name = img.Manifest.Name
+				si.Labels = img.Manifest.Labels
+			} else {
+				h.log().Warnf("pod %v: image %v: %v", id, rtapp.Image.ID, err)
+			}
+			st.Images = append(st.Images, si)
+		}
+	}
+	sort.Strings(st.Pods)
+
+	tw := tar.NewWriter(w)
+	if bb, err := json.MarshalIndent(st, "", "  "); err != nil {
+		return errors.Trace(err)
+	} else if err := writeTarFile(tw, "state.json", bb); err != nil {
+		return errors.Trace(err)
+	}
+	for _, pod := range pods {
+		for _, file := range statePodFiles {
+			bb, err := ioutil.ReadFile(pod.Path(file))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return errors.Annotatef(err, "pod %v", pod.UUID)
+			}
+			if err := writeTarFile(tw, path.Join("pods", pod.UUID.String(), file), bb); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return errors.Trace(tw.Close())
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0400, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := tw.Write(data)
+	return errors.Trace(err)
+}
+
+type RestoreOptions struct {
+	Fetch bool // fetch missing images by name; otherwise images need to be imported already
+}
+
+type RestoreReport struct {
+	Restored    []string          // UUIDs of restored pods
+	Skipped     map[string]string // pods that were not restored, with reason, by UUID
+	Readdressed map[string]string // pods with new IP address ("OLD -> NEW"), by UUID
+	Config      []string          // configuration properties that differ from the exporting host
+}
+
+// Recreates pods from a state archive written by ExportState. Restored
+// pods are created, but not started; their volumes are empty. IP
+// addresses are kept if the pool they've been allocated from hasn't
+// changed and they're free. Pods that already exist, or can't be
+// restored, are skipped and reported.
+func (h *Host) RestoreState(r io.Reader, opts *RestoreOptions) (*RestoreReport, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	st, files, err := readStateArchive(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+
+	rep := &RestoreReport{Skipped: make(map[string]string), Readdressed: make(map[string]string)}
+	rep.Config = configDifferences(st.Config)
+
+	images := make(map[types.Hash]stateImage)
+	for _, si := range st.Images {
+		images[si.Hash] = si
+	}
+
+	for _, id := range st.Pods {
+		if err := h.restorePod(id, st, files[id], images, opts, rep); err != nil {
+			h.log().Warnf("pod %v not restored: %v", id, err)
+			rep.Skipped[id] = err.Error()
+		} else {
+			rep.Restored = append(rep.Restored, id)
+		}
+	}
+	return rep, nil
+}
+
+func (h *Host) restorePod(id string, st *hostState, files map[string][]byte, images map[types.Hash]stateImage, opts *RestoreOptions, rep *RestoreReport) error {
+	uid := uuid.Parse(id)
+	if uid == nil {
+		return errors.Errorf("Invalid UUID")
+	}
+	if collides, err := newPod(h, uid).collides(); err != nil {
+		return errors.Trace(err)
+	} else if collides {
+		return errors.New("Pod already exists")
+	}
+
+	pm := &schema.PodManifest{}
+	if bb, ok := files["manifest"]; !ok {
+		return errors.New("No manifest in archive")
+	} else if err := json.Unmarshal(bb, pm); err != nil {
+		return errors.Annotate(err, "manifest")
+	}
+
+	for _, rtapp := range pm.Apps {
+		if _, err := h.GetLocalImage(rtapp.Image.ID, "", nil); err == nil {
+			continue
+		} else if errors.Cause(err) != ErrNotFound {
+			return errors.Trace(err)
+		}
+		si, known := images[rtapp.Image.ID]
+		if !opts.Fetch || !known || si.Name.Empty() {
+			return errors.Errorf("Image %v is not imported", rtapp.Image.ID)
+		}
+		if _, err := h.FetchImage(si.Hash, si.Name, si.Labels, nil); err != nil {
+			return errors.Annotatef(err, "Image %v", si.Name)
+		}
+	}
+
+	// Keep the address if the pool it's been allocated from is the same
+	pco := &podCreateOptions{uuid: uid}
+	oldIP := st.IPs[id]
+	probe := newPod(h, uid)
+	probe.Manifest = *pm
+	ifname := probe.Interface()
+	if oldIP != "" && st.Config["ips.pool."+ifname] == h.settings().Network.Pools[ifname] {
+		pco.ip = net.ParseIP(oldIP)
+	}
+
+	pod, err := createPod(h, pm, pco)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if newIP, _ := pod.Manifest.Annotations.Get("ip-address"); oldIP != "" && newIP != oldIP {
+		rep.Readdressed[id] = oldIP + " -> " + newIP
+	}
+
+	if bb, ok := files["exit-status"]; ok {
+		if err := writeFileAtomic(pod.Path("exit-status"), bb, 0640); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if bb, ok := files["events.log"]; ok {
+		// Exported events come before the restored pod's creation
+		current, _ := ioutil.ReadFile(pod.EventLogPath())
+		if err := writeFileAtomic(pod.EventLogPath(), append(bb, current...), 0640); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Reads state archive; returns state and pods' files by UUID and name.
+func readStateArchive(r io.Reader) (*hostState, map[string]map[string][]byte, error) {
+	var st *hostState
+	files := make(map[string]map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, errors.Annotate(err, "Cannot read state archive")
+		}
+		bb, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, errors.Annotate(err, "Cannot read state archive")
+		}
+		if hdr.Name == "state.json" {
+			st = &hostState{}
+			if err := json.Unmarshal(bb, st); err != nil {
+				return nil, nil, errors.Annotate(err, "state.json")
+			}
+			continue
+		}
+		dir, file := path.Split(hdr.Name)
+		if parent, id := path.Split(path.Clean(dir)); parent == "pods/" && uuid.Parse(id) != nil {
+			if files[id] == nil {
+				files[id] = make(map[string][]byte)
+			}
+			files[id][file] = bb
+		}
+	}
+	if st == nil {
+		return nil, nil, errors.New("No state.json in state archive")
+	}
+	if st.Version != stateFormatVersion {
+		return nil, nil, errors.Errorf("Unsupported state archive version %d", st.Version)
+	}
+	return st, files, nil
+}
+
+// Returns names of properties whose values differ from exported ones.
+func configDifferences(exported map[string]string) []string {
+	seen := make(map[string]bool)
+	var rv []string
+	for _, key := range Config().Keys() {
+		seen[key] = true
+		if v, ok := exported[key]; !ok || v != Config().GetString(key, "") {
+			rv = append(rv, key)
+		}
+	}
+	for key := range exported {
+		if !seen[key] {
+			rv = append(rv, key)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
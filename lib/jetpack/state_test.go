@@ -0,0 +1,117 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/magiconair/properties"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestExportState(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	img := saveTestImage(t, h, "example.com/web")
+
+	var ids []string
+	for i, ip := range []string{"172.23.0.2", "172.23.0.3"} {
+		pod := newPod(h, nil)
+		pm := schema.BlankPodManifest()
+		pm.Apps = schema.AppList{{Name: "web", Image: schema.RuntimeImage{ID: *img.Hash}}}
+		pm.Annotations.Set("ip-address", ip)
+		bb, _ := json.Marshal(pm)
+		os.MkdirAll(pod.Path(), 0700)
+		ioutil.WriteFile(pod.Path("manifest"), bb, 0600)
+		if i == 0 {
+			ioutil.WriteFile(pod.Path("exit-status"), []byte("{}"), 0600)
+		}
+		ids = append(ids, pod.UUID.String())
+		pod.logEvent(&Event{Type: EventCreate})
+	}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+
+	var buf bytes.Buffer
+	if err := h.ExportState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	st, files, err := readStateArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Pods, ids) {
+		t.Errorf("Expected pods %v, got %v", ids, st.Pods)
+	}
+	if len(st.IPs) != 2 {
+		t.Errorf("Unexpected IP map %v", st.IPs)
+	}
+	if len(st.Images) != 1 || st.Images[0].Hash != *img.Hash || st.Images[0].Name != img.Manifest.Name {
+		t.Errorf("Unexpected images %v", st.Images)
+	}
+	if st.Config["jail.namePrefix"] != Config().GetString("jail.namePrefix", "") {
+		t.Errorf("Configuration not exported")
+	}
+	exits := 0
+	for _, id := range ids {
+		if len(files[id]["manifest"]) == 0 || len(files[id]["events.log"]) == 0 {
+			t.Errorf("Missing files of pod %v: %v", id, files[id])
+		}
+		if _, ok := files[id]["exit-status"]; ok {
+			exits++
+		}
+	}
+	if exits != 1 {
+		t.Errorf("Expected 1 exit status, got %d", exits)
+	}
+
+	// Existing pods are reported, not restored
+	rep, err := h.RestoreState(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Restored) != 0 || len(rep.Skipped) != 2 {
+		t.Errorf("Unexpected restore report %#v", rep)
+	}
+}
+
+func TestReadStateArchiveErrors(t *testing.T) {
+	if _, _, err := readStateArchive(bytes.NewReader(nil)); err == nil {
+		t.Error("Archive without state.json accepted")
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	writeTarFile(tw, "state.json", []byte(`{"Version": 99}`))
+	tw.Close()
+	if _, _, err := readStateArchive(&buf); err == nil {
+		t.Error("Unsupported version accepted")
+	}
+}
+
+func TestConfigDifferences(t *testing.T) {
+	saved := Config()
+	configProperties = properties.NewProperties()
+	configProperties.Merge(saved)
+	defer func() { configProperties = saved }()
+	exported := make(map[string]string)
+	for _, key := range Config().Keys() {
+		exported[key] = Config().GetString(key, "")
+	}
+	Config().Set("test-state.changed", "new")
+	exported["test-state.changed"] = "old"
+	exported["test-state.gone"] = "x"
+	if diff := configDifferences(exported); !reflect.DeepEqual(diff, []string{"test-state.changed", "test-state.gone"}) {
+		t.Errorf("Unexpected differences %v", diff)
+	}
+}
@@ -0,0 +1,172 @@
+package jetpack
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Resource usage of a running pod's jail
+type PodStats struct {
+	Source          string // "rctl" (kernel's RACCT), or "ps" (summed per-process data)
+	CPUTime         time.Duration
+	CPUPercent      float64
+	Memory          uint64 // resident, bytes
+	Swap            uint64 // bytes; only with rctl
+	Processes       int
+	Threads         int
+	OpenFiles       int
+	PseudoTerminals int        // only with rctl
+	Limits          []RctlRule `json:",omitempty"` // only with rctl
+}
+
+// Returns the lowest enforced limit of resource (e.g. "maxproc") in
+// st.Limits; 0 if there's none.
+func (st *PodStats) Limit(resource string) uint64 {
+	var limit uint64
+	for _, rule := range st.Limits {
+		if rule.Resource == resource && rule.Enforced() &&
+			(limit == 0 || rule.Amount < limit) {
+			limit = rule.Amount
+		}
+	}
+	return limit
+}
+
+// Returns current resource usage of the pod. Uses rctl(8) if RACCT is
+// enabled in the kernel, and sums data of the jail's processes
+// otherwise. Returns ErrPodStopped if the pod isn't running.
+func (pod *Pod) Stats() (*PodStats, error) {
+	if pod.Jid() == 0 {
+		return nil, errors.Annotatef(ErrPodStopped, "Pod %v", pod.UUID)
+	}
+	if racctEnabled() {
+		lines, err := systemCommand("/usr/bin/rctl", "-u", "jail:"+pod.jailName()).OutputLines()
+		if err != nil {
+			// The jail may have died since its status was cached
+			pod.Host.invalidateJailStatus(pod.jailName())
+			return nil, errors.Trace(err)
+		}
+		st, err := parseRctlUsage(lines)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if st.Limits, err = pod.LiveRctlRules(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return st, nil
+	}
+	return pod.psStats()
+}
+
+func racctEnabled() bool {
+	out, err := systemCommand("/sbin/sysctl", "-n", "kern.racct.enable").OutputString()
+	return err == nil && strings.TrimSpace(out) == "1"
+}
+
+// Parses `rctl -u` output (resource=value lines)
+func parseRctlUsage(lines []string) (*PodStats, error) {
+	st := &PodStats{Source: "rctl"}
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("Cannot parse rctl line %#v", line)
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Cannot parse rctl line %#v", line)
+		}
+		switch kv[0] {
+		case "cputime":
+			st.CPUTime = time.Duration(n) * time.Second
+		case "pcpu":
+			st.CPUPercent = float64(n)
+		case "memoryuse":
+			st.Memory = n
+		case "swapuse":
+			st.Swap = n
+		case "maxproc":
+			st.Processes = int(n)
+		case "nthr":
+			st.Threads = int(n)
+		case "openfiles":
+			st.OpenFiles = int(n)
+		case "pseudoterminals":
+			st.PseudoTerminals = int(n)
+		}
+	}
+	return st, nil
+}
+
+// Sums data of the jail's processes from ps(1), and counts their
+// descriptors with procstat(1); two commands regardless of number of
+// processes.
+func (pod *Pod) psStats() (*PodStats, error) {
+	lines, err := systemCommand("/bin/ps", "-ax", "-J", strconv.Itoa(pod.Jid()),
+		"-o", "pid=", "-o", "cputime=", "-o", "pcpu=", "-o", "rss=", "-o", "nlwp=").OutputLines()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	st, pids, err := parsePsStats(lines)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(pids) > 0 {
+		// Processes may exit meanwhile; procstat reports what it can
+		cmd := systemCommand("/usr/bin/procstat", append([]string{"-h", "-f"}, pids...)...).Quiet()
+		if lines, err := cmd.OutputLines(); err == nil {
+			st.OpenFiles = countDescriptors(lines)
+		}
+	}
+	return st, nil
+}
+
+func parsePsStats(lines []string) (*PodStats, []string, error) {
+	st := &PodStats{Source: "ps"}
+	var pids []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, nil, errors.Errorf("Cannot parse ps line %#v", line)
+		}
+		cpu, err := parseCPUTime(fields[1])
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		pcpu, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		rss, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		nlwp, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "Cannot parse ps line %#v", line)
+		}
+		pids = append(pids, fields[0])
+		st.CPUTime += time.Duration(cpu * float64(time.Second))
+		st.CPUPercent += pcpu
+		st.Memory += rss * 1024
+		st.Processes++
+		st.Threads += nlwp
+	}
+	return st, pids, nil
+}
+
+// Counts numbered descriptors in `procstat -h -f` output (skipping
+// text, cwd, root, and jail entries).
+func countDescriptors(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 2 {
+			if _, err := strconv.Atoi(fields[2]); err == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
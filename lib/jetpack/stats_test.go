@@ -0,0 +1,67 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRctlUsage(t *testing.T) {
+	st, err := parseRctlUsage([]string{
+		"cputime=90", "datasize=1024", "memoryuse=4096", "swapuse=512",
+		"maxproc=3", "nthr=7", "openfiles=21", "pcpu=12", "pseudoterminals=2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PodStats{Source: "rctl", CPUTime: 90 * time.Second, CPUPercent: 12, Memory: 4096, Swap: 512, Processes: 3, Threads: 7, OpenFiles: 21, PseudoTerminals: 2}
+	if !reflect.DeepEqual(*st, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, *st)
+	}
+	if _, err := parseRctlUsage([]string{"cputime"}); err == nil {
+		t.Error("Expected error for invalid line")
+	}
+}
+
+func TestParsePsStats(t *testing.T) {
+	st, pids, err := parsePsStats([]string{
+		"  101  0:01.50  0.5  1000  1",
+		"  102  1:00.00 10.0   500  4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PodStats{Source: "ps", CPUTime: 61500 * time.Millisecond, CPUPercent: 10.5, Memory: 1500 * 1024, Processes: 2, Threads: 5}
+	if !reflect.DeepEqual(*st, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, *st)
+	}
+	if len(pids) != 2 || pids[0] != "101" || pids[1] != "102" {
+		t.Errorf("Unexpected pids: %v", pids)
+	}
+}
+
+func TestCountDescriptors(t *testing.T) {
+	if n := countDescriptors([]string{
+		"  101 sh                 text v r r------- - - - /bin/sh",
+		"  101 sh                  cwd v d r------- - - - /",
+		"  101 sh                    0 v c rw------ 3 0 - /dev/pts/0",
+		"  101 sh                    1 v c rw------ 3 0 - /dev/pts/0",
+		"  102 cat                   0 p - rw------ 1 0 - -",
+	}); n != 3 {
+		t.Errorf("Expected 3 descriptors, got %d", n)
+	}
+}
+
+func TestPodStatsLimit(t *testing.T) {
+	st := &PodStats{Limits: []RctlRule{
+		{"maxproc", "devctl", 100},
+		{"maxproc", "deny", 512},
+		{"memoryuse", "deny", 1024},
+	}}
+	if limit := st.Limit("maxproc"); limit != 512 {
+		t.Errorf("Expected maxproc limit 512, got %v", limit)
+	}
+	if limit := st.Limit("openfiles"); limit != 0 {
+		t.Errorf("Expected no openfiles limit, got %v", limit)
+	}
+}
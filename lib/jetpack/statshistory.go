@@ -0,0 +1,311 @@
+package jetpack
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Stats history: if stats.interval is set, a recorder started with
+// Host.StartStatsRecorder samples Stats() of every running pod, and
+// appends the samples to the pod's ring file (`stats/UUID.ring` in
+// host's dataset; it's kept out of pod's dataset so that an open ring
+// can't keep the dataset busy). The ring holds at most stats.history
+// samples; the oldest ones are overwritten.
+//
+// Ring file is a header followed by fixed-size records. Header has
+// format version and record size: fields can be added at the end of
+// a record in a new version, and readers decode the fields they know.
+
+const statsRingMagic = "JPSTATS\x00"
+const statsRingVersion = 1
+
+// magic[8] version:u16 recordSize:u16 capacity:u32 next:u32 count:u32
+const statsRingHeaderSize = 24
+
+// time:i64 cputime:i64 cpupercent:f64 memory:u64 swap:u64
+// processes:u32 threads:u32 openfiles:u32 source:u8 pad[3]
+const statsRecordSizeV1 = 56
+
+var statsSources = []string{"", "rctl", "ps"}
+
+// A sample of pod's resource usage
+type StatsSample struct {
+	Time time.Time
+	PodStats
+}
+
+type statsRingHeader struct {
+	version    uint16
+	recordSize uint16
+	capacity   uint32
+	next       uint32 // index of the next record to write
+	count      uint32
+}
+
+func (hdr *statsRingHeader) encode() []byte {
+	buf := make([]byte, statsRingHeaderSize)
+	copy(buf, statsRingMagic)
+	le := binary.LittleEndian
+	le.PutUint16(buf[8:], hdr.version)
+	le.PutUint16(buf[10:], hdr.recordSize)
+	le.PutUint32(buf[12:], hdr.capacity)
+	le.PutUint32(buf[16:], hdr.next)
+	le.PutUint32(buf[20:], hdr.count)
+	return buf
+}
+
+func decodeStatsRingHeader(buf []byte) (*statsRingHeader, error) {
+	if len(buf) < statsRingHeaderSize || string(buf[:8]) != statsRingMagic {
+		return nil, errors.New("Not a stats ring file")
+	}
+	le := binary.LittleEndian
+	hdr := &statsRingHeader{
+		version:    le.Uint16(buf[8:]),
+		recordSize: le.Uint16(buf[10:]),
+		capacity:   le.Uint32(buf[12:]),
+		next:       le.Uint32(buf[16:]),
+		count:      le.Uint32(buf[20:]),
+	}
+	if hdr.version < 1 || hdr.recordSize < statsRecordSizeV1 || hdr.capacity == 0 ||
+		hdr.next >= hdr.capacity || hdr.count > hdr.capacity {
+		return nil, errors.Errorf("Invalid stats ring header (version %d)", hdr.version)
+	}
+	return hdr, nil
+}
+
+func encodeStatsSample(s *StatsSample) []byte {
+	buf := make([]byte, statsRecordSizeV1)
+	le := binary.LittleEndian
+	le.PutUint64(buf[0:], uint64(s.Time.UnixNano()))
+	le.PutUint64(buf[8:], uint64(s.CPUTime))
+	le.PutUint64(buf[16:], math.Float64bits(s.CPUPercent))
+	le.PutUint64(buf[24:], s.Memory)
+	le.PutUint64(buf[32:], s.Swap)
+	le.PutUint32(buf[40:], uint32(s.Processes))
+	le.PutUint32(buf[44:], uint32(s.Threads))
+	le.PutUint32(buf[48:], uint32(s.OpenFiles))
+	for i, src := range statsSources {
+		if src == s.Source {
+			buf[52] = byte(i)
+		}
+	}
+	return buf
+}
+
+// Decodes a record; fields of newer versions are ignored.
+func decodeStatsSample(buf []byte) *StatsSample {
+	le := binary.LittleEndian
+	s := &StatsSample{Time: time.Unix(0, int64(le.Uint64(buf[0:])))}
+	s.CPUTime = time.Duration(le.Uint64(buf[8:]))
+	s.CPUPercent = math.Float64frombits(le.Uint64(buf[16:]))
+	s.Memory = le.Uint64(buf[24:])
+	s.Swap = le.Uint64(buf[32:])
+	s.Processes = int(le.Uint32(buf[40:]))
+	s.Threads = int(le.Uint32(buf[44:]))
+	s.OpenFiles = int(le.Uint32(buf[48:]))
+	if i := int(buf[52]); i < len(statsSources) {
+		s.Source = statsSources[i]
+	}
+	return s
+}
+
+// Reads samples from the ring, oldest first.
+func readStatsRing(f *os.File) (*statsRingHeader, []*StatsSample, error) {
+	buf := make([]byte, statsRingHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	hdr, err := decodeStatsRingHeader(buf)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	samples := make([]*StatsSample, 0, hdr.count)
+	rec := make([]byte, hdr.recordSize)
+	first := (hdr.next + hdr.capacity - hdr.count) % hdr.capacity
+	for i := uint32(0); i < hdr.count; i++ {
+		idx := (first + i) % hdr.capacity
+		if _, err := f.ReadAt(rec, statsRingHeaderSize+int64(idx)*int64(hdr.recordSize)); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		samples = append(samples, decodeStatsSample(rec))
+	}
+	return hdr, samples, nil
+}
+
+// Writes a new ring with given samples (the newest ones that fit).
+func writeStatsRing(f *os.File, capacity int, samples []*StatsSample) error {
+	if len(samples) > capacity {
+		samples = samples[len(samples)-capacity:]
+	}
+	hdr := &statsRingHeader{
+		version:    statsRingVersion,
+		recordSize: statsRecordSizeV1,
+		capacity:   uint32(capacity),
+		next:       uint32(len(samples) % capacity),
+		count:      uint32(len(samples)),
+	}
+	if err := f.Truncate(0); err != nil {
+		return errors.Trace(err)
+	}
+	buf := hdr.encode()
+	for _, s := range samples {
+		buf = append(buf, encodeStatsSample(s)...)
+	}
+	_, err := f.WriteAt(buf, 0)
+	return errors.Trace(err)
+}
+
+// Appends sample to the ring file at path, creating it or changing its
+// capacity as needed.
+func appendStatsSample(path string, capacity int, s *StatsSample) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Empty or unreadable ring is started over
+	hdr, samples, _ := readStatsRing(f)
+	if hdr == nil || hdr.version != statsRingVersion || int(hdr.capacity) != capacity {
+		// New file, old version, or changed capacity: rewrite
+		return errors.Trace(writeStatsRing(f, capacity, append(samples, s)))
+	}
+
+	if _, err := f.WriteAt(encodeStatsSample(s), statsRingHeaderSize+int64(hdr.next)*int64(hdr.recordSize)); err != nil {
+		return errors.Trace(err)
+	}
+	hdr.next = (hdr.next + 1) % hdr.capacity
+	if hdr.count < hdr.capacity {
+		hdr.count++
+	}
+	_, err = f.WriteAt(hdr.encode(), 0)
+	return errors.Trace(err)
+}
+
+func (h *Host) statsRingPath(id string) string {
+	return h.Path("stats", id+".ring")
+}
+
+// Returns recorded resource usage samples taken at or after since,
+// oldest first.
+func (pod *Pod) StatsHistory(since time.Time) ([]*StatsSample, error) {
+	f, err := os.Open(pod.Host.statsRingPath(pod.UUID.String()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, samples, err := readStatsRing(f)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Pod %v stats history", pod.UUID)
+	}
+	for i, s := range samples {
+		if !s.Time.Before(since) {
+			return samples[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Records pods' resource usage in the background
+type StatsRecorder struct {
+	h        *Host
+	interval time.Duration
+	capacity int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Starts recording pods' stats every stats.interval. Returns nil if
+// stats.interval is off.
+func (h *Host) StartStatsRecorder() (*StatsRecorder, error) {
+	interval := Config().GetString("stats.interval", "off")
+	if interval == "off" || interval == "" {
+		return nil, nil
+	}
+	sr := &StatsRecorder{h: h, stop: make(chan struct{}), done: make(chan struct{})}
+	var err error
+	if sr.interval, err = time.ParseDuration(interval); err != nil || sr.interval <= 0 {
+		return nil, errors.Errorf("Invalid stats.interval %#v", interval)
+	}
+	history := Config().GetString("stats.history", "1440")
+	if sr.capacity, err = strconv.Atoi(history); err != nil || sr.capacity <= 0 {
+		return nil, errors.Errorf("Invalid stats.history %#v", history)
+	}
+	if err := os.MkdirAll(h.Path("stats"), 0750); err != nil {
+		return nil, errors.Trace(err)
+	}
+	h.log().Infof("Recording pods' stats every %v", sr.interval)
+	go sr.run()
+	return sr, nil
+}
+
+// Stops the recorder, waiting for the current round to finish.
+func (sr *StatsRecorder) Stop() {
+	close(sr.stop)
+	<-sr.done
+}
+
+func (sr *StatsRecorder) run() {
+	defer close(sr.done)
+	ticker := time.NewTicker(sr.interval)
+	defer ticker.Stop()
+	for {
+		sr.record()
+		select {
+		case <-sr.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Samples all running pods, and removes rings of destroyed pods.
+func (sr *StatsRecorder) record() {
+	live := make(map[string]bool)
+	for _, pod := range sr.h.Pods() {
+		id := pod.UUID.String()
+		live[id] = true
+		if status, err := pod.jailStatus(false); err != nil {
+			pod.log().Warnf("cannot check jail status: %v", err)
+			continue
+		} else if status.Jid == 0 {
+			continue
+		}
+		st, err := pod.Stats()
+		if err != nil {
+			pod.log().Warnf("cannot sample stats: %v", err)
+			continue
+		}
+		if _, err := os.Stat(pod.Path()); os.IsNotExist(err) {
+			// Destroyed meanwhile
+			continue
+		}
+		if err := appendStatsSample(sr.h.statsRingPath(id), sr.capacity, &StatsSample{time.Now(), *st}); err != nil {
+			pod.log().Warnf("cannot record stats: %v", err)
+		}
+	}
+	rings, _ := filepath.Glob(sr.h.statsRingPath("*"))
+	for _, ring := range rings {
+		if id := strings.TrimSuffix(filepath.Base(ring), ".ring"); !live[id] {
+			if _, err := os.Stat(sr.h.Path("pods", id)); os.IsNotExist(err) {
+				os.Remove(ring)
+			}
+		}
+	}
+}
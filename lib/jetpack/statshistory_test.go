@@ -0,0 +1,101 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsRing(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "test.ring")
+
+	t0 := time.Unix(1500000000, 0)
+	sample := func(i int) *StatsSample {
+		return &StatsSample{t0.Add(time.Duration(i) * time.Minute), PodStats{
+			Source: "rctl", CPUTime: time.Duration(i) * time.Second, CPUPercent: 1.5,
+			Memory: uint64(i * 1024), Processes: i, Threads: 2 * i, OpenFiles: 3,
+		}}
+	}
+	read := func() []*StatsSample {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, samples, err := readStatsRing(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return samples
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := appendStatsSample(path, 3, sample(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != statsRingHeaderSize+3*statsRecordSizeV1 {
+		t.Errorf("Ring file has grown to %d bytes", fi.Size())
+	}
+	samples := read()
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(samples))
+	}
+	for i, s := range samples {
+		if expected := sample(i + 2); s.Time != expected.Time || !reflect.DeepEqual(s.PodStats, expected.PodStats) {
+			t.Errorf("Sample %d: expected %#v, got %#v", i, expected, s)
+		}
+	}
+
+	// Changed capacity keeps the newest samples
+	if err := appendStatsSample(path, 2, sample(5)); err != nil {
+		t.Fatal(err)
+	}
+	if samples := read(); len(samples) != 2 || samples[0].Processes != 4 || samples[1].Processes != 5 {
+		t.Errorf("Unexpected samples after resize: %#v", samples)
+	}
+
+	// Garbage is started over
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendStatsSample(path, 2, sample(6)); err != nil {
+		t.Fatal(err)
+	}
+	if samples := read(); len(samples) != 1 || samples[0].Processes != 6 {
+		t.Errorf("Unexpected samples after garbage: %#v", samples)
+	}
+}
+
+func TestStatsRingNewerRecords(t *testing.T) {
+	// Records of a future version are longer; known fields are read
+	hdr := &statsRingHeader{version: statsRingVersion + 1, recordSize: statsRecordSizeV1 + 8, capacity: 2, next: 1, count: 1}
+	rec := append(encodeStatsSample(&StatsSample{time.Unix(1500000000, 0), PodStats{Source: "ps", Processes: 7}}), 1, 2, 3, 4, 5, 6, 7, 8)
+	buf := append(hdr.encode(), rec...)
+	buf = append(buf, make([]byte, len(rec))...)
+
+	f, err := ioutil.TempFile("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, samples, err := readStatsRing(f); err != nil {
+		t.Fatal(err)
+	} else if len(samples) != 1 || samples[0].Processes != 7 || samples[0].Source != "ps" {
+		t.Errorf("Unexpected samples %#v", samples)
+	}
+}
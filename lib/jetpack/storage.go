@@ -0,0 +1,144 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// A pod's storage limit is the quota of its dataset, so it covers the
+// rootfs, empty volumes, and everything else beneath it; its storage
+// reservation is the dataset's reservation. They come from the
+// jetpack/storage/limit and jetpack/storage/reservation annotations,
+// or the pod's jetpack/storage isolator ({"limit": "10G",
+// "reservation": "1G"}), or the storage.limit and storage.reservation
+// host properties, and are set when the pod's dataset is created.
+// Pod.SetStorageLimit changes the limit of an existing pod, and
+// records it in the pod's annotation, so that it's kept when the pod
+// is exported and restored.
+
+// Returned when a pod's storage limit would be below what it uses
+type StorageLimitError struct {
+	Pod   string
+	Limit int64
+	Used  int64
+}
+
+func (e *StorageLimitError) Error() string {
+	return fmt.Sprintf("Storage limit of pod %v can't be %d bytes, it already uses %d bytes", e.Pod, e.Limit, e.Used)
+}
+
+// Returns pod manifest's storage setting ("limit" or "reservation") in
+// bytes; 0 if none.
+func storageSetting(pm *schema.PodManifest, key string) (int64, error) {
+	if v, ok := pm.Annotations.Get("jetpack/storage/" + key); ok {
+		n, err := ParseStorageLimit(v)
+		return n, errors.Annotatef(err, "jetpack/storage/%v annotation", key)
+	}
+	for _, iso := range pm.Isolators {
+		if iso.Name != "jetpack/storage" {
+			continue
+		}
+		value := make(map[string]string)
+		if iso.ValueRaw == nil {
+			return 0, errors.New("Isolator jetpack/storage has no value")
+		}
+		if err := json.Unmarshal(*iso.ValueRaw, &value); err != nil {
+			return 0, errors.Annotate(err, "Isolator jetpack/storage")
+		}
+		n, err := ParseStorageLimit(value[key])
+		return n, errors.Annotatef(err, "jetpack/storage isolator's %v", key)
+	}
+	n, err := parseLogSize(Config().GetString("storage."+key, "off"))
+	return n, errors.Annotatef(err, "storage.%v", key)
+}
+
+// Returns ZFS properties setting quota and reservation of pod
+// manifest's dataset.
+func storageZFSProperties(pm *schema.PodManifest) (map[string]string, error) {
+	props := make(map[string]string)
+	for _, setting := range [][2]string{{"limit", "quota"}, {"reservation", "reservation"}} {
+		if n, err := storageSetting(pm, setting[0]); err != nil {
+			return nil, errors.Trace(err)
+		} else if n > 0 {
+			props[setting[1]] = strconv.FormatInt(n, 10)
+		}
+	}
+	return props, nil
+}
+
+// Parses a storage limit: bytes, with optional unit (e.g. "10G"), or
+// "off" (0).
+func ParseStorageLimit(str string) (int64, error) {
+	n, err := parseLogSize(str)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("Invalid storage limit %#v", str)
+	}
+	return n, nil
+}
+
+// Returns storage limit of the pod in bytes; 0 if none.
+func (pod *Pod) StorageLimit() (int64, error) {
+	return storageSetting(&pod.Manifest, "limit")
+}
+
+// Changes storage limit of the pod (0 for none), in its dataset's
+// quota and in its manifest. Returns *StorageLimitError if the pod
+// uses more than limit already.
+func (pod *Pod) SetStorageLimit(limit int64) error {
+	if limit < 0 {
+		return errors.Errorf("Invalid storage limit %d", limit)
+	}
+	unlock, err := pod.Host.lockExclusive()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
+
+	ds := pod.getDataset()
+	if ds == nil {
+		return errors.Errorf("Pod %v has no dataset", pod.UUID)
+	}
+	z := pod.Host.datasets()
+	props, err := z.GetProperties(ds.Name, "used", "quota")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if limit > 0 {
+		used, err := strconv.ParseInt(props["used"].Value, 10, 64)
+		if err != nil {
+			return errors.Annotatef(err, "Cannot parse used space of %v", ds.Name)
+		}
+		if used > limit {
+			return &StorageLimitError{Pod: pod.UUID.String(), Limit: limit, Used: used}
+		}
+	}
+
+	quota, annotation := "none", "off"
+	if limit > 0 {
+		quota = strconv.FormatInt(limit, 10)
+		annotation = quota
+	}
+	pod.log().Debugf("Setting quota of %v to %v", ds.Name, quota)
+	if err := z.SetProperty(ds.Name, "quota", quota); err != nil {
+		return errors.Trace(err)
+	}
+	oldAnnotations := append(types.Annotations(nil), pod.Manifest.Annotations...)
+	pod.Manifest.Annotations.Set("jetpack/storage/limit", annotation)
+	if err := pod.saveManifest(); err != nil {
+		pod.Manifest.Annotations = oldAnnotations
+		oldQuota := props["quota"].Value
+		if oldQuota == "0" || oldQuota == "-" {
+			oldQuota = "none"
+		}
+		if rerr := z.SetProperty(ds.Name, "quota", oldQuota); rerr != nil {
+			pod.log().Errorf("cannot restore quota of %v to %v: %v", ds.Name, oldQuota, rerr)
+		}
+		return errors.Trace(err)
+	}
+	return nil
+}
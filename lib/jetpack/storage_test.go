@@ -0,0 +1,130 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+)
+
+func TestStorageSettings(t *testing.T) {
+	pm := schema.BlankPodManifest()
+	if props, err := storageZFSProperties(pm); err != nil || len(props) != 0 {
+		t.Errorf("Expected no properties by default, got %v, %v", props, err)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"name":"jetpack/storage","value":{"limit":"10G","reservation":"1G"}}]`), &pm.Isolators); err != nil {
+		t.Fatal(err)
+	}
+	if props, err := storageZFSProperties(pm); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]string{"quota": "10737418240", "reservation": "1073741824"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+
+	// Annotation wins
+	pm.Annotations.Set("jetpack/storage/limit", "off")
+	if props, err := storageZFSProperties(pm); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]string{"reservation": "1073741824"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+
+	pm.Annotations.Set("jetpack/storage/limit", "huge")
+	if _, err := storageZFSProperties(pm); err == nil {
+		t.Error("Expected error for invalid annotation")
+	}
+}
+
+func TestSetStorageLimit(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	defer func(uid, gid int) { mdsUid, mdsGid = uid, gid }(mdsUid, mdsGid)
+	mdsUid, mdsGid = os.Getuid(), os.Getgid()
+
+	pod := fakeZFSPod(t, h, f)
+	pod.Manifest = *schema.BlankPodManifest()
+	ds := h.Dataset.ChildName("pods/" + pod.UUID.String())
+	f.SetStatistic(ds, "used", "1000")
+
+	err := pod.SetStorageLimit(500)
+	if serr, ok := err.(*StorageLimitError); !ok || serr.Used != 1000 || serr.Limit != 500 {
+		t.Fatalf("Expected StorageLimitError, got %v", err)
+	}
+
+	readLimit := func() string {
+		bb, err := ioutil.ReadFile(pod.Path("manifest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pm schema.PodManifest
+		if err := json.Unmarshal(bb, &pm); err != nil {
+			t.Fatal(err)
+		}
+		v, _ := pm.Annotations.Get("jetpack/storage/limit")
+		return v
+	}
+
+	if err := pod.SetStorageLimit(2000); err != nil {
+		t.Fatal(err)
+	}
+	if props, _ := f.GetProperties(ds, "quota"); props["quota"].Value != "2000" {
+		t.Errorf("Unexpected quota %v", props["quota"])
+	}
+	if limit := readLimit(); limit != "2000" {
+		t.Errorf("Unexpected saved limit %#v", limit)
+	}
+	if limit, err := pod.StorageLimit(); err != nil || limit != 2000 {
+		t.Errorf("Unexpected limit %v, %v", limit, err)
+	}
+
+	if err := pod.SetStorageLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	if props, _ := f.GetProperties(ds, "quota"); props["quota"].Value != "none" {
+		t.Errorf("Unexpected quota %v", props["quota"])
+	}
+	if limit := readLimit(); limit != "off" {
+		t.Errorf("Unexpected saved limit %#v", limit)
+	}
+}
+
+func TestStorageIsolatorRoundTrip(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	defer func(uid, gid int) { mdsUid, mdsGid = uid, gid }(mdsUid, mdsGid)
+	mdsUid, mdsGid = os.Getuid(), os.Getgid()
+
+	pod := newPod(h, nil)
+	if err := json.Unmarshal([]byte(`{
+		"acKind": "PodManifest", "acVersion": "0.8.11",
+		"apps": [{"name": "app", "image": {"id": "sha512-0000000000000000000000000000000000000000000000000000000000000000"}}],
+		"isolators": [{"name": "jetpack/storage", "value": {"limit": "10G"}}]
+	}`), &pod.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(pod.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := pod.createDataset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props, _ := f.GetProperties(ds.Name, "quota"); props["quota"].Value != "10737418240" {
+		t.Errorf("Unexpected quota %v", props["quota"])
+	}
+	if err := pod.saveManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := h.GetPod(pod.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit, err := loaded.StorageLimit(); err != nil || limit != 10737418240 {
+		t.Errorf("Unexpected limit %v, %v", limit, err)
+	}
+}
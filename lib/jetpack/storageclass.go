@@ -0,0 +1,391 @@
+package jetpack
+
+import (
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Storage classes put pods' datasets on different pools (e.g. a small
+// fast one, and a large slow one). The storage.class.NAME host property
+// maps class NAME to a dataset; the "default" class is the host's
+// dataset (root.zfs). Pod's class is its jetpack/storage-class
+// annotation, or the storage.default-class host property, recorded in
+// the annotation when the pod is created; pods created without classes
+// are in the default class. Pod's dataset is pods/UUID under its
+// class' dataset, mounted at the pod's directory in the host's pods/,
+// so that pods look the same whatever their class.
+//
+// Datasets can be cloned only within their pool, so apps' rootfs on a
+// class of another pool than the images' are received from the
+// images' snapshots as full copies. Build pods always use the default
+// class, as their rootfs become images. Pod.MoveStorage moves a
+// stopped pod to another class.
+
+const storageClassAnnotation = "jetpack/storage-class"
+
+const DefaultStorageClass = "default"
+
+// Snapshot that Pod.MoveStorage sends datasets at
+const moveSnapshotName = "jetpack-move"
+
+var storageClassRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func validateStorageClass(name, value string) error {
+	class := strings.TrimPrefix(name, "storage.class.")
+	if class == DefaultStorageClass {
+		return errors.Errorf("%v: default class is root.zfs, it can't be set", name)
+	}
+	if !storageClassRegexp.MatchString(class) {
+		return errors.Errorf("%v: invalid class name %#v", name, class)
+	}
+	if value == "" || strings.HasPrefix(value, "/") || strings.HasSuffix(value, "/") || strings.ContainsAny(value, "@# ") {
+		return errors.Errorf("%v: invalid dataset name %#v", name, value)
+	}
+	return nil
+}
+
+func validateDefaultStorageClass(name, value string) error {
+	if value != DefaultStorageClass && ConfigPrefix("storage.class.")[value] == "" {
+		return errors.Errorf("%v: unknown storage class %#v", name, value)
+	}
+	return nil
+}
+
+// Returns datasets of host's storage classes by name, including the
+// default one.
+func (h *Host) StorageClasses() map[string]string {
+	classes := ConfigPrefix("storage.class.")
+	classes[DefaultStorageClass] = h.Dataset.Name
+	return classes
+}
+
+// Returns names of host's storage classes, the default one first.
+func (h *Host) storageClassNames() []string {
+	names := []string{DefaultStorageClass}
+	for class := range ConfigPrefix("storage.class.") {
+		if class != DefaultStorageClass {
+			names = append(names, class)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// Returns name of the dataset that holds pods of the storage class.
+func (h *Host) podsDatasetName(class string) (string, error) {
+	root, ok := h.StorageClasses()[class]
+	if !ok {
+		return "", errors.Errorf("Unknown storage class %#v", class)
+	}
+	return path.Join(root, "pods"), nil
+}
+
+// Returns names of existing datasets that hold pods, by storage class.
+func (h *Host) podsDatasets() (map[string]string, error) {
+	rv := make(map[string]string)
+	for _, class := range h.storageClassNames() {
+		name, err := h.podsDatasetName(class)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if class == DefaultStorageClass {
+			rv[class] = name
+		} else if _, err := h.datasets().GetDataset(name); err == nil {
+			rv[class] = name
+		} else if err != zfs.ErrNotFound {
+			return nil, errors.Trace(err)
+		}
+	}
+	return rv, nil
+}
+
+// Returns the dataset that holds pods of the storage class, creating
+// it if needed; class' own dataset needs to exist.
+func (h *Host) ensurePodsDataset(class string) (string, error) {
+	name, err := h.podsDatasetName(class)
+	if err != nil || class == DefaultStorageClass {
+		return name, errors.Trace(err)
+	}
+	z := h.datasets()
+	if _, err := z.GetDataset(name); err == nil {
+		return name, nil
+	} else if err != zfs.ErrNotFound {
+		return "", errors.Trace(err)
+	}
+	if _, err := z.GetDataset(path.Dir(name)); err == zfs.ErrNotFound {
+		return "", errors.Errorf("Dataset %v of storage class %v does not exist", path.Dir(name), class)
+	} else if err != nil {
+		return "", errors.Trace(err)
+	}
+	h.log().Debugf("Creating %v for storage class %v", name, class)
+	// Pods' datasets are mounted in the host's pods/
+	if _, err := z.CreateDataset(name, map[string]string{"mountpoint": "none"}); err != nil {
+		return "", errors.Trace(err)
+	}
+	return name, nil
+}
+
+// Returns storage class of a pod to create from pm.
+func storageClassOf(pm *schema.PodManifest) string {
+	if class, ok := pm.Annotations.Get(storageClassAnnotation); ok {
+		return class
+	}
+	return Config().GetString("storage.default-class", DefaultStorageClass)
+}
+
+// Returns pod's storage class.
+func (pod *Pod) StorageClass() string {
+	if class, ok := pod.Manifest.Annotations.Get(storageClassAnnotation); ok {
+		return class
+	}
+	return DefaultStorageClass
+}
+
+// Returns names that pod's dataset can have: in its storage class
+// first, then in other classes (for pods whose manifest wasn't saved).
+func (pod *Pod) datasetNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, class := range append([]string{pod.StorageClass()}, pod.Host.storageClassNames()...) {
+		if name, err := pod.Host.podsDatasetName(class); err == nil && !seen[name] {
+			seen[name] = true
+			names = append(names, path.Join(name, pod.UUID.String()))
+		}
+	}
+	return names
+}
+
+// Returns the dataset for pod's app rootfs at mountpoint: a clone of
+// img, or, on another pool, a copy of its snapshot.
+func (img *Image) cloneTo(dest, mountpoint string) (*zfs.Dataset, error) {
+	rootfs := img.getRootfs()
+	if zfs.PoolOf(rootfs.Name) == zfs.PoolOf(dest) {
+		return img.Clone(dest, mountpoint)
+	}
+	img.log().Debugf("Copying rootfs as %v at %v", dest, mountpoint)
+	snap := rootfs.SnapshotName(imageSnapshotName)
+	ds, err := receiveSnapshots(dest, false, snap)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rsnap, err := ds.GetSnapshot(imageSnapshotName); err == nil {
+		if err := rsnap.Destroy(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := ds.Set("mountpoint", mountpoint); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ds.Mount(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ds, nil
+}
+
+// Receives dest, unmounted, from a full stream of the first of snaps
+// (of one dataset), and then the increments up to the last one. With
+// props, dataset's properties are sent too.
+func receiveSnapshots(dest string, props bool, snaps ...string) (*zfs.Dataset, error) {
+	var ds *zfs.Dataset
+	for i, snap := range snaps {
+		var args []string
+		if props {
+			args = append(args, "-p")
+		}
+		switch {
+		case i == 0:
+			args = append(args, snap)
+		case i == len(snaps)-1:
+			args = append(args, "-I", snaps[0], snap)
+		default:
+			continue
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(zfs.ZfsSend(pw, args...))
+		}()
+		var err error
+		ds, err = zfs.ReceiveDataset(pr, dest, false)
+		pr.CloseWithError(errors.New("receive finished"))
+		if err != nil {
+			return nil, errors.Annotatef(err, "Receiving %v", snap)
+		}
+	}
+	return ds, nil
+}
+
+// Moves a stopped pod to the storage class: pod's datasets are sent,
+// with their snapshots and properties, as the pod's datasets in the
+// class, received unmounted. Once all are received, the old datasets
+// are unmounted, and the new ones mounted in their place; the old
+// datasets are destroyed only when the new ones are mounted. If
+// anything fails before that, the old datasets are mounted back, and
+// the new ones destroyed.
+func (pod *Pod) MoveStorage(class string) error {
+	if _, err := pod.Host.podsDatasetName(class); err != nil {
+		return errors.Trace(err)
+	}
+	unlock, err := pod.Host.lockExclusive()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unlock()
+	if status := pod.Status(); status != PodStatusStopped {
+		return errors.Errorf("Pod %v is %v, it needs to be stopped to move", pod.UUID, status)
+	}
+	from := pod.StorageClass()
+	if from == class {
+		return nil
+	}
+	ds := pod.getDataset()
+	if ds == nil {
+		return errors.Errorf("Pod %v has no dataset", pod.UUID)
+	}
+	podsName, err := pod.Host.ensurePodsDataset(class)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	target := path.Join(podsName, pod.UUID.String())
+	z := pod.Host.datasets()
+	if _, err := z.GetDataset(target); err == nil {
+		return errors.Errorf("Dataset %v already exists", target)
+	} else if err != zfs.ErrNotFound {
+		return errors.Trace(err)
+	}
+
+	tree, err := ds.Children(-1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pod.ui.Printf("Moving from storage class %v to %v", from, class)
+	if _, err := ds.Snapshot(moveSnapshotName, &zfs.SnapshotOptions{Recursive: true}); err != nil {
+		return errors.Trace(err)
+	}
+	received, err := sendTree(tree, ds.Name, target)
+	if err == nil {
+		err = swapMounts(z, tree, ds.Name, target)
+	}
+	if err != nil {
+		if received != nil {
+			if err := received.Destroy("-r"); err != nil {
+				pod.log().Errorf("cannot destroy %v: %v", target, err)
+			}
+		}
+		if err := ds.Zfs("destroy", "-r", ds.SnapshotName(moveSnapshotName)); err != nil {
+			pod.log().Errorf("cannot destroy move snapshots: %v", err)
+		}
+		return errors.Trace(err)
+	}
+
+	// The pod is in the new class now; the old datasets are unmounted
+	pod.Manifest.Annotations.Set(storageClassAnnotation, class)
+	if err := pod.saveManifest(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := received.Zfs("destroy", "-r", received.SnapshotName(moveSnapshotName)); err != nil {
+		pod.log().Warnf("cannot destroy move snapshots: %v", err)
+	}
+	if err := z.Destroy(ds.Name, true); err != nil {
+		pod.log().Errorf("old datasets are left unmounted in %v", ds.Name)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Mounts datasets received as target at mountpoints of tree's
+// datasets (root, then its descendants), which are unmounted first.
+// If any can't be mounted, the received ones are unmounted, and the
+// tree is mounted back. Datasets without a mountpoint (none or
+// legacy) keep the received property.
+func swapMounts(z zfs.Interface, tree []*zfs.Dataset, root, target string) (rErr error) {
+	unmounted := 0 // datasets at the end of tree
+	var mounted []*zfs.Dataset
+	mountable := func(ds *zfs.Dataset) bool { return ds.Mountpoint != "" && !ds.Legacy }
+	defer func() {
+		if rErr == nil {
+			return
+		}
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := mounted[i].Set("mountpoint", "none"); err != nil {
+				rErr = errors.Annotatef(rErr, "cannot unmount %v: %v", mounted[i].Name, err)
+			}
+		}
+		for _, old := range tree[len(tree)-unmounted:] {
+			if !mountable(old) {
+				continue
+			}
+			ods := &zfs.Dataset{Name: old.Name}
+			err := ods.Set("mountpoint", old.Mountpoint)
+			if err == nil {
+				err = ods.Mount()
+			}
+			if err != nil {
+				rErr = errors.Annotatef(rErr, "cannot mount %v back: %v", old.Name, err)
+			}
+		}
+	}()
+
+	// Deepest first, so that nothing stays mounted under an unmounted
+	// dataset
+	for i := len(tree) - 1; i >= 0; i-- {
+		if mountable(tree[i]) {
+			if err := (&zfs.Dataset{Name: tree[i].Name}).Set("mountpoint", "none"); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		unmounted++
+	}
+	for _, old := range tree {
+		if !mountable(old) {
+			continue
+		}
+		nds, err := z.GetDataset(target + strings.TrimPrefix(old.Name, root))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := nds.Set("mountpoint", old.Mountpoint); err != nil {
+			return errors.Trace(err)
+		}
+		mounted = append(mounted, nds)
+		if err := nds.Mount(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Receives datasets of tree (root, then its descendants, as listed by
+// Children(-1)), with all their snapshots up to moveSnapshotName, as
+// target. Returns target's dataset, if it was received.
+func sendTree(tree []*zfs.Dataset, root, target string) (*zfs.Dataset, error) {
+	var received *zfs.Dataset
+	for _, ds := range tree {
+		infos, err := ds.Snapshots()
+		if err != nil {
+			return received, errors.Trace(err)
+		}
+		var snaps []string
+		for _, info := range infos {
+			snaps = append(snaps, ds.SnapshotName(info.Name))
+			if info.Name == moveSnapshotName {
+				break
+			}
+		}
+		rds, err := receiveSnapshots(target+strings.TrimPrefix(ds.Name, root), true, snaps...)
+		if err != nil {
+			return received, errors.Trace(err)
+		}
+		if received == nil {
+			received = rds
+		}
+	}
+	return received, nil
+}
@@ -0,0 +1,160 @@
+package jetpack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+)
+
+func TestStorageClassValidation(t *testing.T) {
+	for name, value := range map[string]string{
+		"storage.class.fast":   "fast/jetpack",
+		"storage.class.slow-1": "tank",
+	} {
+		if err := validateStorageClass(name, value); err != nil {
+			t.Errorf("%v = %v: %v", name, value, err)
+		}
+	}
+	for name, value := range map[string]string{
+		"storage.class.default": "fast/jetpack",
+		"storage.class.Fast":    "fast/jetpack",
+		"storage.class.":        "fast/jetpack",
+		"storage.class.fast":    "/fast/jetpack",
+		"storage.class.slow":    "tank@snap",
+		"storage.class.empty":   "",
+	} {
+		if err := validateStorageClass(name, value); err == nil {
+			t.Errorf("%v = %#v passed validation", name, value)
+		}
+	}
+
+	Config().Set("storage.class.fast", "fast/jetpack")
+	defer Config().Set("storage.class.fast", "")
+	for value, ok := range map[string]bool{"default": true, "fast": true, "slow": false} {
+		if err := validateDefaultStorageClass("storage.default-class", value); (err == nil) != ok {
+			t.Errorf("%v: unexpected validation result %v", value, err)
+		}
+	}
+}
+
+func TestStorageClasses(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	Config().Set("storage.class.fast", "zroot/fast")
+	Config().Set("storage.class.archive", "tank/jetpack")
+	defer Config().Set("storage.class.fast", "")
+	defer Config().Set("storage.class.archive", "")
+
+	if names := h.storageClassNames(); !reflect.DeepEqual(names, []string{"default", "archive", "fast"}) {
+		t.Errorf("Unexpected classes %v", names)
+	}
+	if name, err := h.podsDatasetName("fast"); err != nil || name != "zroot/fast/pods" {
+		t.Errorf("Unexpected pods dataset %v, %v", name, err)
+	}
+	if _, err := h.podsDatasetName("nope"); err == nil {
+		t.Error("Unknown class has a dataset")
+	}
+	if dss, err := h.podsDatasets(); err != nil || !reflect.DeepEqual(dss, map[string]string{"default": "zroot/jetpack/pods"}) {
+		t.Errorf("Unexpected pods datasets %v, %v", dss, err)
+	}
+
+	// Class' dataset needs to exist
+	if _, err := h.ensurePodsDataset("fast"); err == nil {
+		t.Error("Pods dataset created without class' dataset")
+	}
+	if _, err := f.CreateDataset("zroot/fast", nil); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := h.ensurePodsDataset("fast"); err != nil || name != "zroot/fast/pods" {
+		t.Errorf("Unexpected pods dataset %v, %v", name, err)
+	}
+	if props, err := f.GetProperties("zroot/fast/pods", "mountpoint"); err != nil || props["mountpoint"].Value != "none" {
+		t.Errorf("Unexpected mountpoint %v, %v", props, err)
+	}
+	if dss, err := h.podsDatasets(); err != nil || !reflect.DeepEqual(dss, map[string]string{"default": "zroot/jetpack/pods", "fast": "zroot/fast/pods"}) {
+		t.Errorf("Unexpected pods datasets %v, %v", dss, err)
+	}
+
+	pm := schema.BlankPodManifest()
+	if class := storageClassOf(pm); class != DefaultStorageClass {
+		t.Errorf("Expected default class, got %v", class)
+	}
+	Config().Set("storage.default-class", "fast")
+	defer Config().Set("storage.default-class", DefaultStorageClass)
+	if class := storageClassOf(pm); class != "fast" {
+		t.Errorf("Expected host's default class, got %v", class)
+	}
+	pm.Annotations.Set(storageClassAnnotation, "archive")
+	if class := storageClassOf(pm); class != "archive" {
+		t.Errorf("Expected annotated class, got %v", class)
+	}
+}
+
+func TestPodDatasetInStorageClass(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	Config().Set("storage.class.fast", "zroot/fast")
+	defer Config().Set("storage.class.fast", "")
+
+	pod := newPod(h, nil)
+	if class := pod.StorageClass(); class != DefaultStorageClass {
+		t.Errorf("Expected default class, got %v", class)
+	}
+	if ds := pod.getDataset(); ds != nil {
+		t.Errorf("Unexpected dataset %v", ds)
+	}
+
+	// Found in any class, even if the manifest doesn't say
+	name := "zroot/fast/pods/" + pod.UUID.String()
+	for _, ds := range []string{"zroot/fast", "zroot/fast/pods", name} {
+		if _, err := f.CreateDataset(ds, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ds := pod.getDataset(); ds == nil || ds.Name != name {
+		t.Errorf("Expected %v, got %v", name, ds)
+	}
+
+	pod.Manifest.Annotations.Set(storageClassAnnotation, "fast")
+	if names := pod.datasetNames(); names[0] != name || len(names) != 2 {
+		t.Errorf("Unexpected dataset names %v", names)
+	}
+}
+
+func TestPodsInAllStorageClasses(t *testing.T) {
+	_, jlsCleanup := countingJls(t)
+	defer jlsCleanup()
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	Config().Set("storage.class.fast", "zroot/fast")
+	defer Config().Set("storage.class.fast", "")
+
+	inDefault, inFast := newPod(h, nil), newPod(h, nil)
+	for _, ds := range []struct{ name, quota string }{
+		{"zroot/fast", ""},
+		{"zroot/fast/pods", ""},
+		{"zroot/jetpack/pods/" + inDefault.UUID.String(), "1024"},
+		{"zroot/fast/pods/" + inFast.UUID.String(), "2048"},
+	} {
+		props := map[string]string{}
+		if ds.quota != "" {
+			props["quota"] = ds.quota
+		}
+		if _, err := f.CreateDataset(ds.name, props); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total, err := h.podQuotaTotal(); err != nil || total != 3072 {
+		t.Errorf("Expected total quota 3072, got %v, %v", total, err)
+	}
+	for _, pod := range []*Pod{inDefault, inFast} {
+		if collides, err := pod.collides(); err != nil || !collides {
+			t.Errorf("Pod %v doesn't collide: %v", pod.UUID, err)
+		}
+	}
+	if collides, err := newPod(h, nil).collides(); err != nil || collides {
+		t.Errorf("New pod collides: %v", err)
+	}
+}
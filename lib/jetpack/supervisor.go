@@ -0,0 +1,177 @@
+package jetpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Detached runs: App.RunDetached starts a supervisor process (`jetpack
+// supervise`) in its own session, which runs the app with stdin on
+// /dev/null and output in the app's log files, and records its exit
+// status. Supervisor's state is kept in `supervisors/APP.json` in the
+// pod's directory while it runs.
+
+type Supervisor struct {
+	App     types.ACName
+	Pid     int // supervisor's pid
+	AppPid  int `json:",omitempty"` // pid of app's current stage2 command
+	Started time.Time
+
+	pod *Pod
+}
+
+func (pod *Pod) supervisorPath(name types.ACName) string {
+	return pod.Path("supervisors", name.String()+".json")
+}
+
+// Returns supervisor of the app's detached run, or nil if app doesn't
+// run detached.
+func (pod *Pod) Supervisor(name types.ACName) (*Supervisor, error) {
+	sv := &Supervisor{pod: pod}
+	if bb, err := ioutil.ReadFile(pod.supervisorPath(name)); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	} else if err := json.Unmarshal(bb, sv); err != nil {
+		return nil, errors.Annotatef(err, "App %v supervisor state", name)
+	}
+	if !sv.Alive() {
+		// Supervisor died without cleaning up
+		os.Remove(pod.supervisorPath(name))
+		return nil, nil
+	}
+	return sv, nil
+}
+
+func (sv *Supervisor) Alive() bool {
+	err := syscall.Kill(sv.Pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Sends signal to the detached app. SIGKILL goes directly to app's
+// process group (supervisor needs to survive to record exit status);
+// other signals are forwarded by the supervisor.
+func (sv *Supervisor) Signal(sig syscall.Signal) error {
+	pid := sv.Pid
+	if sig == syscall.SIGKILL {
+		if sv.AppPid == 0 {
+			return errors.Errorf("App %v has not started yet", sv.App)
+		}
+		pid = -sv.AppPid
+	}
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Waits for the supervisor to finish, and returns app's exit status
+// it recorded.
+func (sv *Supervisor) Wait() (*ExitStatus, error) {
+	for sv.Alive() {
+		time.Sleep(250 * time.Millisecond)
+	}
+	statuses, err := sv.pod.ExitStatuses()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if es := statuses[sv.App]; es != nil && !es.Finished.Before(sv.Started) {
+		return es, nil
+	}
+	return nil, errors.Errorf("App %v supervisor exited without recording status", sv.App)
+}
+
+func (sv *Supervisor) save() error {
+	if bb, err := json.Marshal(sv); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(writeFileAtomic(sv.pod.supervisorPath(sv.App), bb, 0640))
+	}
+}
+
+// Starts the app detached, under a supervisor process. Returns the
+// supervisor. Only one detached run of an app can exist at a time.
+func (app *App) RunDetached(opts *RunOptions) (*Supervisor, error) {
+	if _, err := app.command(opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if opts != nil && opts.StdinMode == StdinReader {
+		return nil, errors.New("Detached app can't read stdin from a reader")
+	}
+	if sv, err := app.Pod.Supervisor(app.Name); err != nil {
+		return nil, errors.Trace(err)
+	} else if sv != nil {
+		return nil, errors.Errorf("App %v already runs detached (supervisor pid %d)", app.Name, sv.Pid)
+	}
+	if err := os.MkdirAll(app.Pod.Path("supervisors"), 0750); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	optsJSON, err := json.Marshal(opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	args := append(ConfigFlags(), "supervise", app.Pod.UUID.String()+":"+app.Name.String(), string(optsJSON))
+	cmd := exec.Command(self, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sv := &Supervisor{App: app.Name, Pid: cmd.Process.Pid, Started: time.Now(), pod: app.Pod}
+	if err := sv.save(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.Trace(err)
+	}
+	app.Pod.logEvent(&Event{Type: EventDetach, App: app.Name, Details: fmt.Sprintf("supervisor pid %d", sv.Pid)})
+	return sv, errors.Trace(cmd.Process.Release())
+}
+
+// Runs the app as a detached run's supervisor (in a process started by
+// RunDetached).
+func (app *App) Supervise(opts *RunOptions) (*ExitStatus, error) {
+	// Wait for the parent to save the state
+	var sv *Supervisor
+	for i := 0; ; i++ {
+		var err error
+		if sv, err = app.Pod.Supervisor(app.Name); err != nil {
+			return nil, errors.Trace(err)
+		} else if sv != nil && sv.Pid == os.Getpid() {
+			break
+		} else if i == 100 {
+			return nil, errors.Errorf("App %v: no supervisor state for pid %d", app.Name, os.Getpid())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer os.Remove(app.Pod.supervisorPath(app.Name))
+
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	opts.StdinMode = StdinNull
+	app.started = func(pid int) {
+		sv.AppPid = pid
+		if err := sv.save(); err != nil {
+			app.log().Warnf("cannot save supervisor state: %v", err)
+		}
+	}
+	es, err := app.Run(nil, nil, nil, opts)
+	if err != nil {
+		// Nobody sees supervisor's stderr
+		app.Pod.logEvent(&Event{Type: EventSupervisorError, App: app.Name, Error: err.Error()})
+	}
+	return es, errors.Trace(err)
+}
@@ -0,0 +1,93 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestSupervisorState(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	name := *types.MustACName("app")
+	if err := os.MkdirAll(pod.Path("supervisors"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if sv, err := pod.Supervisor(name); err != nil || sv != nil {
+		t.Errorf("No state: got %v, %v", sv, err)
+	}
+
+	alive := &Supervisor{App: name, Pid: os.Getpid(), AppPid: 42, Started: time.Now(), pod: pod}
+	if err := alive.save(); err != nil {
+		t.Fatal(err)
+	}
+	if sv, err := pod.Supervisor(name); err != nil {
+		t.Error(err)
+	} else if sv == nil || sv.Pid != alive.Pid || sv.AppPid != 42 {
+		t.Errorf("Got %v, expected %v", sv, alive)
+	}
+
+	// State of a dead supervisor is stale
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("cannot run true:", err)
+	}
+	dead := &Supervisor{App: name, Pid: cmd.Process.Pid, Started: time.Now(), pod: pod}
+	if err := dead.save(); err != nil {
+		t.Fatal(err)
+	}
+	if sv, err := pod.Supervisor(name); err != nil || sv != nil {
+		t.Errorf("Dead supervisor: got %v, %v", sv, err)
+	}
+	if _, err := os.Stat(filepath.Join(pod.Path("supervisors"), "app.json")); !os.IsNotExist(err) {
+		t.Errorf("Stale state not removed: %v", err)
+	}
+}
+
+func TestStopDetachedApps(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}, nil)
+	name := *types.MustACName("app")
+	pod.Manifest.Apps = schema.AppList{{Name: name}}
+	if err := os.MkdirAll(pod.Path("supervisors"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// A supervisor that exits on SIGTERM
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip("cannot run sleep:", err)
+	}
+	exited := make(chan struct{})
+	go func() { cmd.Wait(); close(exited) }()
+	sv := &Supervisor{App: name, Pid: cmd.Process.Pid, Started: time.Now(), pod: pod}
+	if err := sv.save(); err != nil {
+		t.Fatal(err)
+	}
+	pod.stopDetachedApps(time.Second)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		cmd.Process.Kill()
+		t.Error("Supervisor not stopped")
+	}
+}
@@ -0,0 +1,219 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Pods with `jetpack/syslog` annotation set to "host" get their apps'
+// syslog(3) messages forwarded to the host's syslogd. When the jail
+// starts, a forwarder process (`jetpack syslog-forward`) listens on
+// /var/run/log in each app's rootfs, and re-sends messages to the
+// host's /var/run/log with the pod's hostname prepended to the tag.
+// Apps whose rootfs already has a listening socket (e.g. image runs its
+// own syslogd) are left alone. The forwarder is stopped and its
+// sockets are removed when the jail is removed.
+
+const hostSyslogSocket = "/var/run/log"
+const podSyslogSocket = "/var/run/log"
+
+func (pod *Pod) syslogMode() (string, error) {
+	mode, _ := pod.Manifest.Annotations.Get("jetpack/syslog")
+	switch mode {
+	case "", "host":
+		return mode, nil
+	default:
+		return "", errors.Errorf("Invalid jetpack/syslog annotation %#v", mode)
+	}
+}
+
+func (pod *Pod) syslogForwarderPidPath() string {
+	return pod.Path("syslog-forwarder.pid")
+}
+
+// Starts the syslog forwarder, if the pod wants it.
+func (pod *Pod) startSyslogForwarder() error {
+	if mode, err := pod.syslogMode(); err != nil {
+		return errors.Trace(err)
+	} else if mode != "host" {
+		return nil
+	}
+	if err := pod.stopSyslogForwarder(); err != nil {
+		return errors.Trace(err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cmd := exec.Command(self, append(ConfigFlags(), "syslog-forward", pod.UUID.String())...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Trace(err)
+	}
+	pod.log().Debugf("Started syslog forwarder, pid %d", cmd.Process.Pid)
+	if err := ioutil.WriteFile(pod.syslogForwarderPidPath(), []byte(strconv.Itoa(cmd.Process.Pid)), 0640); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.Trace(err)
+	}
+	return errors.Trace(cmd.Process.Release())
+}
+
+// Stops the syslog forwarder, if it runs, and removes its sockets.
+func (pod *Pod) stopSyslogForwarder() error {
+	bb, err := ioutil.ReadFile(pod.syslogForwarderPidPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(bb))); err != nil {
+		pod.log().Warnf("invalid syslog forwarder pid file: %v", err)
+	} else if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return errors.Trace(err)
+	} else {
+		pod.log().Debugf("Stopped syslog forwarder, pid %d", pid)
+	}
+	for _, app := range pod.Apps() {
+		if path, err := resolveInRootfs(app.Path(), podSyslogSocket); err == nil {
+			removeSocket(path)
+		}
+	}
+	return errors.Trace(os.Remove(pod.syslogForwarderPidPath()))
+}
+
+// Removes path if it's a socket.
+func removeSocket(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// Forwards apps' syslog messages to the host until terminated, or
+// until the pod is destroyed. Runs in the forwarder process started
+// with the jail.
+func (pod *Pod) ForwardSyslog() error {
+	prefix := pod.UUID.String()
+	if hostname, ok := pod.Manifest.Annotations.Get("hostname"); ok {
+		prefix = hostname
+	}
+	prefix += "/"
+
+	var sockets []string
+	var conns []*net.UnixConn
+	defer func() {
+		for i, conn := range conns {
+			conn.Close()
+			removeSocket(sockets[i])
+		}
+	}()
+	for _, app := range pod.Apps() {
+		path, err := resolveInRootfs(app.Path(), podSyslogSocket)
+		if err != nil {
+			return errors.Annotatef(err, "App %v", app.Name)
+		}
+		if c, err := net.Dial("unixgram", path); err == nil {
+			// Someone listens already
+			c.Close()
+			pod.log().Debugf("App %v has its own syslog, not forwarding", app.Name)
+			continue
+		}
+		removeSocket(path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Trace(err)
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			return errors.Annotatef(err, "App %v", app.Name)
+		}
+		sockets = append(sockets, path)
+		conns = append(conns, conn)
+		if err := os.Chmod(path, 0666); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(conns) == 0 {
+		return nil
+	}
+
+	for _, conn := range conns {
+		go pod.relaySyslog(conn, prefix)
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigch)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigch:
+			return nil
+		case <-ticker.C:
+			if _, err := os.Stat(pod.Path()); os.IsNotExist(err) {
+				return nil
+			}
+		}
+	}
+}
+
+func (pod *Pod) relaySyslog(conn *net.UnixConn, prefix string) {
+	var host net.Conn
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// Socket closed
+			return
+		}
+		msg := rewriteSyslogMessage(buf[:n], prefix)
+		// Reconnect once if host's syslogd has been restarted
+		for i := 0; i < 2; i++ {
+			if host == nil {
+				if host, err = net.Dial("unixgram", hostSyslogSocket); err != nil {
+					host = nil
+					continue
+				}
+			}
+			if _, err = host.Write(msg); err == nil {
+				break
+			}
+			host.Close()
+			host = nil
+		}
+		if err != nil {
+			pod.log().Warnf("cannot forward syslog message: %v", err)
+		}
+	}
+}
+
+// Inserts prefix before the tag of a syslog(3) message, after its
+// priority and timestamp.
+func rewriteSyslogMessage(msg []byte, prefix string) []byte {
+	header := 0
+	if len(msg) > 0 && msg[0] == '<' {
+		if i := strings.IndexByte(string(msg), '>'); i > 0 && i < 5 {
+			header = i + 1
+		}
+	}
+	if rest := msg[header:]; len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, string(rest[:len(time.Stamp)])); err == nil {
+			header += len(time.Stamp) + 1
+		}
+	}
+	rv := make([]byte, 0, len(msg)+len(prefix))
+	rv = append(rv, msg[:header]...)
+	rv = append(rv, prefix...)
+	return append(rv, msg[header:]...)
+}
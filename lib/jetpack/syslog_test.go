@@ -0,0 +1,17 @@
+package jetpack
+
+import "testing"
+
+func TestRewriteSyslogMessage(t *testing.T) {
+	for msg, expected := range map[string]string{
+		"<13>Jan  2 15:04:05 app[42]: hello": "<13>Jan  2 15:04:05 pod/app[42]: hello",
+		"<13>app: hello":                     "<13>pod/app: hello",
+		"app: hello":                         "pod/app: hello",
+		"<13>Jan  2 15:04:05":                "<13>pod/Jan  2 15:04:05",
+		"":                                   "pod/",
+	} {
+		if actual := string(rewriteSyslogMessage([]byte(msg), "pod/")); actual != expected {
+			t.Errorf("%#v: expected %#v, got %#v", msg, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package jetpack
+
+import (
+	"bytes"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/3ofcoins/jetpack/lib/keystore"
+)
+
+// Trusted image signing keys are stored in the `keys` directory of
+// the host, in a subdirectory per image name prefix (with slashes
+// escaped as commas; `@` for the root prefix, which matches all
+// images), in files named by the key's fingerprint. A key verifies
+// images whose name is its prefix, or is below it (a key for
+// example.com/foo is trusted for example.com/foo/bar, but not for
+// example.com/foobar). Changes of the keystore are serialized with the
+// host lock.
+
+var ErrKeyNotConfirmed = stderrors.New("Key not confirmed")
+
+// A trusted signing key
+type TrustedKey struct {
+	Prefix      string // image name prefix; empty for the root prefix
+	Fingerprint string
+	Identities  []string
+}
+
+// How a key fetched from a location is accepted
+type TrustOptions struct {
+	Fingerprint string                 // accept key with this fingerprint
+	Confirm     func(*TrustedKey) bool // otherwise, ask to confirm the key; it's rejected if nil
+}
+
+func (h *Host) Keystore() *keystore.Keystore {
+	return keystore.New(h.Path("keys"))
+}
+
+func keystorePrefix(prefix string) (types.ACIdentifier, error) {
+	if prefix == "" {
+		return keystore.Root, nil
+	}
+	if name, err := types.NewACIdentifier(prefix); err != nil {
+		return "", errors.Annotatef(err, "Invalid prefix %#v", prefix)
+	} else {
+		return *name, nil
+	}
+}
+
+// Returns key's description; prefix is not set.
+func readTrustedKey(pubkey []byte) (*TrustedKey, error) {
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(pubkey))
+	if err != nil {
+		return nil, errors.Annotate(err, "Cannot read public key")
+	}
+	if len(el) != 1 {
+		return nil, errors.Errorf("Expected one public key, got %d", len(el))
+	}
+	return newTrustedKey(el[0], ""), nil
+}
+
+func newTrustedKey(ety *openpgp.Entity, prefix types.ACIdentifier) *TrustedKey {
+	tk := &TrustedKey{Fingerprint: normalizeFingerprint(keystore.KeyFingerprint(ety))}
+	if prefix != keystore.Root {
+		tk.Prefix = prefix.String()
+	}
+	for name := range ety.Identities {
+		tk.Identities = append(tk.Identities, name)
+	}
+	sort.Strings(tk.Identities)
+	return tk
+}
+
+// Returns fingerprint in lowercase hex without spaces, as used in
+// keystore file names.
+func normalizeFingerprint(fpr string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, fpr))
+}
+
+// Stores armored public key read from r as trusted for images whose
+// names start with prefix (empty prefix trusts it for all images).
+func (h *Host) TrustKey(prefix string, r io.Reader) (*TrustedKey, error) {
+	ksPrefix, err := keystorePrefix(prefix)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pubkey, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tk, err := readTrustedKey(pubkey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tk.Prefix = prefix
+
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	if _, err := h.Keystore().StoreKey(ksPrefix, pubkey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	h.log().Infof("trusted key %v for %v", tk.Fingerprint, ksPrefix)
+	return tk, nil
+}
+
+// Fetches public key from location (path, URL, or image name for
+// appc discovery; prefix is discovered if location is empty), and
+// trusts it for prefix if it has the expected fingerprint, or if it's
+// confirmed. Returns ErrKeyNotConfirmed otherwise.
+func (h *Host) FetchTrustedKey(prefix, location string, opts *TrustOptions) (*TrustedKey, error) {
+	if opts == nil {
+		opts = &TrustOptions{}
+	}
+	if location == "" {
+		if prefix == "" {
+			return nil, errors.New("Cannot discover root key")
+		}
+		location = prefix
+	}
+
+	fo, err := h.FetchOptions()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, kf, err := fo.OpenPubKey(location)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pubkey, err := ioutil.ReadAll(kf)
+	kf.Close()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tk, err := readTrustedKey(pubkey)
+	if err != nil {
+		return nil, errors.Annotate(err, location)
+	}
+	tk.Prefix = prefix
+
+	switch {
+	case opts.Fingerprint != "":
+		if normalizeFingerprint(opts.Fingerprint) != tk.Fingerprint {
+			return nil, errors.Annotatef(ErrKeyNotConfirmed, "Fingerprint mismatch: expected %v, got %v", opts.Fingerprint, tk.Fingerprint)
+		}
+	case opts.Confirm == nil || !opts.Confirm(tk):
+		return nil, errors.Annotatef(ErrKeyNotConfirmed, "Key %v from %v", tk.Fingerprint, location)
+	}
+
+	return h.TrustKey(prefix, bytes.NewReader(pubkey))
+}
+
+// Returns trusted keys, sorted by prefix and fingerprint.
+func (h *Host) ListTrustedKeys() ([]*TrustedKey, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	kr, err := h.Keystore().GetAllKeys()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	el := kr.Entities()
+	sort.Sort(el)
+	rv := make([]*TrustedKey, len(el))
+	for i, ety := range el {
+		rv[i] = newTrustedKey(ety.Entity, ety.Prefix)
+	}
+	return rv, nil
+}
+
+// Removes key with fingerprint from all prefixes; returns the
+// prefixes, or ErrNotFound if the key isn't trusted.
+func (h *Host) UntrustKey(fingerprint string) ([]string, error) {
+	unlock, err := h.lockExclusive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	removed, err := h.Keystore().UntrustKey(normalizeFingerprint(fingerprint))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(removed) == 0 {
+		return nil, errors.Annotatef(ErrNotFound, "Key %v", fingerprint)
+	}
+	rv := make([]string, len(removed))
+	for i, prefix := range removed {
+		if prefix != keystore.Root {
+			rv[i] = prefix.String()
+		}
+	}
+	h.log().Infof("untrusted key %v", fingerprint)
+	return rv, nil
+}
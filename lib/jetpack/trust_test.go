@@ -0,0 +1,109 @@
+package jetpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Returns a new signing key, and its armored public key.
+func testSigningKey(t *testing.T, name string) (*openpgp.Entity, []byte) {
+	ety, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Self-signs the identity
+	if err := ety.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ety.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return ety, buf.Bytes()
+}
+
+func TestTrustedKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+
+	signer, pubkey := testSigningKey(t, "signer")
+	tk, err := h.TrustKey("example.com/foo", bytes.NewReader(pubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Prefix != "example.com/foo" || !reflect.DeepEqual(tk.Identities, []string{"signer <signer@example.com>"}) {
+		t.Errorf("unexpected key %#v", tk)
+	}
+
+	sig := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(sig, signer, bytes.NewReader([]byte("image")), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, trusted := range map[string]bool{
+		"example.com/foo":     true,
+		"example.com/foo/bar": true,
+		"example.com/foobar":  false,
+		"example.com":         false,
+	} {
+		_, err := h.Keystore().CheckSignature(types.ACIdentifier(name), bytes.NewReader([]byte("image")), bytes.NewReader(sig.Bytes()))
+		if trusted && err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if !trusted && err == nil {
+			t.Errorf("%v: key is out of scope", name)
+		}
+	}
+
+	// Fetched keys need confirmation
+	_, rootKey := testSigningKey(t, "root")
+	keyPath := filepath.Join(tmp, "root.asc")
+	if err := ioutil.WriteFile(keyPath, rootKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.FetchTrustedKey("", keyPath, nil); errors.Cause(err) != ErrKeyNotConfirmed {
+		t.Errorf("expected ErrKeyNotConfirmed, got %v", err)
+	}
+	confirmed := 0
+	confirm := func(*TrustedKey) bool { confirmed++; return true }
+	if _, err := h.FetchTrustedKey("", keyPath, &TrustOptions{Fingerprint: "00", Confirm: confirm}); errors.Cause(err) != ErrKeyNotConfirmed || confirmed != 0 {
+		t.Errorf("fingerprint mismatch accepted: %v", err)
+	}
+	root, err := h.FetchTrustedKey("", keyPath, &TrustOptions{Confirm: confirm})
+	if err != nil || confirmed != 1 {
+		t.Fatalf("key not trusted: %v", err)
+	}
+
+	keys, err := h.ListTrustedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Prefix != "" || keys[0].Fingerprint != root.Fingerprint || keys[1].Fingerprint != tk.Fingerprint {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+
+	if removed, err := h.UntrustKey(root.Fingerprint); err != nil || !reflect.DeepEqual(removed, []string{""}) {
+		t.Errorf("untrust: %v %v", removed, err)
+	}
+	if _, err := h.UntrustKey(root.Fingerprint); errors.Cause(err) != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ACI's rootfs is extracted in process, entry by entry, as it's read
+// from the decompressed stream. Files, directories, symlinks, hard
+// links, FIFOs, and device nodes keep their numeric ownership, mode
+// (including setuid, setgid, and sticky bits), and modification time;
+// symlinks keep the time of their extraction. Entries outside rootfs/
+// (the manifest) are skipped. An entry whose name is absolute or has
+// a ".." component, a hard link to such a path, or an entry whose
+// parent directory is a symlink (which could point out of the rootfs)
+// fails the extraction with an error that names the entry. An entry
+// replaces an existing file, as when the image's layer is extracted
+// over rendered dependencies; a directory is kept and gets the
+// entry's ownership and mode.
+
+// Extracts rootfs/ entries of tar stream r into dir.
+func extractRootfs(r io.Reader, dir string) error {
+	x := &rootfsExtractor{dir: dir, dirTimes: make(map[string]*tar.Header)}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Annotate(err, "Invalid tar archive")
+		}
+		if err := x.extract(hdr, tr); err != nil {
+			return errors.Annotatef(err, "%v", hdr.Name)
+		}
+	}
+	return errors.Trace(x.finish())
+}
+
+type rootfsExtractor struct {
+	dir string
+	// Directories' times are set when all entries are extracted, as
+	// extracting their contents changes them
+	dirTimes map[string]*tar.Header
+}
+
+// Returns path of tar entry name in the rootfs, "" if the entry is not
+// in the rootfs.
+func (x *rootfsExtractor) entryPath(name string) (string, error) {
+	if strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute path")
+	}
+	for _, elt := range strings.Split(name, "/") {
+		if elt == ".." {
+			return "", errors.New("path escapes rootfs")
+		}
+	}
+	name = path.Clean(name)
+	if name == "rootfs" {
+		return x.dir, nil
+	} else if !strings.HasPrefix(name, "rootfs/") {
+		return "", nil
+	}
+	rel := filepath.FromSlash(strings.TrimPrefix(name, "rootfs/"))
+	// Check parents
+	for parent := filepath.Dir(rel); parent != "."; parent = filepath.Dir(parent) {
+		if fi, err := os.Lstat(filepath.Join(x.dir, parent)); err != nil && !os.IsNotExist(err) {
+			return "", err
+		} else if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", errors.Errorf("parent %v is a symlink", filepath.ToSlash(parent))
+		}
+	}
+	return filepath.Join(x.dir, rel), nil
+}
+
+func (x *rootfsExtractor) extract(hdr *tar.Header, r io.Reader) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	dest, err := x.entryPath(hdr.Name)
+	if err != nil || dest == "" {
+		return err
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	if hdr.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		if fi, err := os.Lstat(dest); err == nil && fi.IsDir() {
+			// Keep it
+		} else if err := removeExisting(dest); err != nil {
+			return err
+		} else if err := os.MkdirAll(dest, 0700); err != nil {
+			return err
+		}
+		x.dirTimes[dest] = hdr
+		return setAttrs(dest, hdr, mode)
+	}
+
+	if dest == x.dir {
+		return errors.New("rootfs is not a directory")
+	}
+	if err := removeExisting(dest); err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return err
+		}
+		return os.Lchown(dest, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		target, err := x.entryPath(hdr.Linkname)
+		if err != nil {
+			return errors.Annotatef(err, "link to %v", hdr.Linkname)
+		} else if target == "" || target == x.dir {
+			return errors.Errorf("link to %v is not in rootfs", hdr.Linkname)
+		}
+		if fi, err := os.Lstat(target); err != nil {
+			return err
+		} else if fi.IsDir() {
+			return errors.Errorf("link to directory %v", hdr.Linkname)
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			// Don't let link(2) follow it; a copy is the same symlink
+			if ln, err := os.Readlink(target); err != nil {
+				return err
+			} else {
+				return os.Symlink(ln, dest)
+			}
+		}
+		// A hard link shares the target's attributes
+		return os.Link(target, dest)
+	case tar.TypeChar, tar.TypeBlock:
+		devType := uint32(syscall.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devType = syscall.S_IFBLK
+		}
+		if err := mknod(dest, devType|0600, hdr.Devmajor, hdr.Devminor); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(dest, 0600); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+	if err := setAttrs(dest, hdr, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+}
+
+// Removes existing file at dest; a directory only if it is empty.
+func removeExisting(dest string) error {
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sets ownership, and then mode, as chown clears setuid and setgid
+// bits.
+func setAttrs(dest string, hdr *tar.Header, mode os.FileMode) error {
+	if err := os.Lchown(dest, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	return os.Chmod(dest, mode)
+}
+
+// Sets times of extracted directories, deepest first.
+func (x *rootfsExtractor) finish() error {
+	dirs := make([]string, 0, len(x.dirTimes))
+	for dir := range x.dirTimes {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		hdr := x.dirTimes[dir]
+		if err := os.Chtimes(dir, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Annotatef(err, "%v", hdr.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package jetpack
+
+import "golang.org/x/sys/unix"
+
+// Creates a device node of major and minor.
+func mknod(path string, mode uint32, major, minor int64) error {
+	return unix.Mknod(path, mode, makedev(uint64(major), uint64(minor)))
+}
+
+// Returns dev_t of major and minor, as makedev(3) of FreeBSD 12 and
+// newer.
+func makedev(major, minor uint64) uint64 {
+	return (major&0xffffff00)<<32 | (major&0xff)<<8 |
+		(minor&0xff00)<<24 | minor&0xffff00ff
+}
@@ -0,0 +1,17 @@
+// +build !freebsd
+
+package jetpack
+
+import "golang.org/x/sys/unix"
+
+// Creates a device node of major and minor; images are run only on
+// FreeBSD.
+func mknod(path string, mode uint32, major, minor int64) error {
+	return unix.Mknod(path, mode, int(makedev(uint64(major), uint64(minor))))
+}
+
+// Returns dev_t of major and minor, as Linux's makedev(3).
+func makedev(major, minor uint64) uint64 {
+	return (major&0xfffff000)<<32 | (major&0xfff)<<8 |
+		(minor&0xffffff00)<<12 | minor&0xff
+}
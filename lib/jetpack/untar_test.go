@@ -0,0 +1,283 @@
+package jetpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+type testTarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func testTar(t testing.TB, entries ...testTarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRootfs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "rootfs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Rendered dependency, replaced by the entry
+	writeTestFiles(t, dir, map[string]string{"etc/motd": "old\n"})
+
+	mtime := time.Unix(1400000000, 0)
+	if err := extractRootfs(bytes.NewReader(testTar(t,
+		testTarEntry{hdr: tar.Header{Name: "manifest"}, content: "{}"},
+		testTarEntry{hdr: tar.Header{Name: "./rootfs/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/bin/", Typeflag: tar.TypeDir, Mode: 0711, ModTime: mtime}},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/bin/su", Mode: 04755, ModTime: mtime}, content: "#!/bin/sh\n"},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/bin/su2", Typeflag: tar.TypeLink, Linkname: "rootfs/bin/su"}},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/etc/motd", ModTime: mtime}, content: "hello\n"},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/etc/su", Typeflag: tar.TypeSymlink, Linkname: "/bin/su"}},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/tmp/", Typeflag: tar.TypeDir, Mode: 01777, ModTime: mtime}},
+		testTarEntry{hdr: tar.Header{Name: "rootfs/tmp/fifo", Typeflag: tar.TypeFifo, Mode: 0600, ModTime: mtime}},
+	)), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmp, "manifest")); !os.IsNotExist(err) {
+		t.Error("manifest extracted")
+	}
+	for path, mode := range map[string]os.FileMode{
+		"bin":      os.ModeDir | 0711,
+		"bin/su":   os.ModeSetuid | 0755,
+		"etc/motd": 0644,
+		"tmp":      os.ModeDir | os.ModeSticky | 0777,
+		"tmp/fifo": os.ModeNamedPipe | 0600,
+	} {
+		if fi, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+			t.Error(err)
+		} else if fi.Mode() != mode {
+			t.Errorf("%v: mode is %v, expected %v", path, fi.Mode(), mode)
+		} else if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%v: modified at %v, expected %v", path, fi.ModTime(), mtime)
+		}
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(dir, "etc/motd")); err != nil || string(bb) != "hello\n" {
+		t.Errorf("etc/motd is %#v (%v)", string(bb), err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "etc/su")); err != nil || target != "/bin/su" {
+		t.Errorf("etc/su links to %#v (%v)", target, err)
+	}
+	fi1, _ := os.Stat(filepath.Join(dir, "bin/su"))
+	fi2, _ := os.Stat(filepath.Join(dir, "bin/su2"))
+	if fi1 == nil || fi2 == nil || !os.SameFile(fi1, fi2) {
+		t.Error("bin/su2 is not a hard link")
+	}
+}
+
+func TestExtractRootfsUnsafe(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, outside, map[string]string{"passwd": "root\n"})
+
+	symlink := testTarEntry{hdr: tar.Header{Name: "rootfs/link", Typeflag: tar.TypeSymlink, Linkname: outside}}
+	for _, tc := range []struct {
+		bad     string
+		entries []testTarEntry
+	}{
+		{"/rootfs/evil", []testTarEntry{{hdr: tar.Header{Name: "/rootfs/evil"}}}},
+		{"rootfs/../evil", []testTarEntry{{hdr: tar.Header{Name: "rootfs/../evil"}}}},
+		{"rootfs/a/../../evil", []testTarEntry{{hdr: tar.Header{Name: "rootfs/a/../../evil"}}}},
+		{"rootfs/link/evil", []testTarEntry{symlink, {hdr: tar.Header{Name: "rootfs/link/evil"}}}},
+		{"rootfs/link/sub/", []testTarEntry{symlink, {hdr: tar.Header{Name: "rootfs/link/sub/", Typeflag: tar.TypeDir}}}},
+		{"rootfs/passwd", []testTarEntry{{hdr: tar.Header{Name: "rootfs/passwd", Typeflag: tar.TypeLink, Linkname: "rootfs/../outside/passwd"}}}},
+		{"rootfs/passwd", []testTarEntry{{hdr: tar.Header{Name: "rootfs/passwd", Typeflag: tar.TypeLink, Linkname: filepath.Join(outside, "passwd")}}}},
+		{"rootfs/passwd", []testTarEntry{symlink, {hdr: tar.Header{Name: "rootfs/passwd", Typeflag: tar.TypeLink, Linkname: "rootfs/link/passwd"}}}},
+	} {
+		dir := filepath.Join(tmp, "rootfs")
+		os.RemoveAll(dir)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := extractRootfs(bytes.NewReader(testTar(t, tc.entries...)), dir)
+		if err == nil {
+			t.Errorf("%v: extracted", tc.bad)
+		} else if !strings.HasPrefix(err.Error(), tc.bad+": ") {
+			t.Errorf("%v: error doesn't name the entry: %v", tc.bad, err)
+		}
+		for _, path := range []string{filepath.Join(tmp, "evil"), filepath.Join(outside, "evil"), filepath.Join(outside, "sub")} {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("%v: created %v", tc.bad, path)
+				os.RemoveAll(path)
+			}
+		}
+		if fi, err := os.Stat(filepath.Join(outside, "passwd")); err != nil {
+			t.Fatal(err)
+		} else if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink != 1 {
+			t.Errorf("%v: linked to a file outside rootfs", tc.bad)
+		}
+	}
+}
+
+// Extracted rootfs exports to the same ACI
+func TestExtractRootfsExported(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	img := saveTestImage(t, h, "example.com/untar")
+	writeTestFiles(t, img.Path("rootfs"), map[string]string{
+		"bin/app":  "#!/bin/sh\n",
+		"etc/motd": "hello\n",
+	})
+	os.Chmod(img.Path("rootfs", "bin/app"), 0755)
+	os.Symlink("../bin/app", img.Path("rootfs", "etc/app"))
+	os.Link(img.Path("rootfs", "etc/motd"), img.Path("rootfs", "etc/motd.link"))
+
+	var buf bytes.Buffer
+	hash, err := img.Export(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2 := saveTestImage(t, h, "example.com/untar-copy")
+	img2.Manifest = img.Manifest
+	if err := extractRootfs(&buf, img2.Path("rootfs")); err != nil {
+		t.Fatal(err)
+	}
+	if hash2, err := img2.Export(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	} else if hash2.String() != hash.String() {
+		t.Errorf("re-exported hash is %v, expected %v", hash2, hash)
+	}
+}
+
+// Size of the benchmark's ACI; multi-gigabyte unless -short
+func benchmarkACISize() int64 {
+	if testing.Short() {
+		return 64 << 20
+	}
+	return 4 << 30
+}
+
+// Writes tar of files in directories, size bytes in total, to path.
+func writeBenchmarkACI(b *testing.B, path string, size int64) {
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	content := bytes.Repeat([]byte("jetpack\n"), 1<<17) // 1MiB
+	tw.WriteHeader(&tar.Header{Name: "rootfs/", Typeflag: tar.TypeDir, Mode: 0755})
+	for i := 0; int64(i)*int64(len(content)) < size; i++ {
+		if i%100 == 0 {
+			tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("rootfs/%d/", i/100), Typeflag: tar.TypeDir, Mode: 0755})
+		}
+		// Files of all sizes up to 1MiB
+		n := len(content) >> uint(i%8)
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("rootfs/%d/%d", i/100, i), Mode: 0644, Size: int64(n)}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write(content[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkExtractRootfs(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "jetpack-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	aciPath := filepath.Join(tmp, "aci")
+	writeBenchmarkACI(b, aciPath, benchmarkACISize())
+	fi, err := os.Stat(aciPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name    string
+		extract func(r io.Reader, dir string) error
+	}{
+		{"native", extractRootfs},
+		// Replaced by extractRootfs
+		{"tar", func(r io.Reader, dir string) error {
+			cmd := exec.Command("tar", "-C", filepath.Dir(dir), "-xf", "-", "rootfs")
+			cmd.Stdin = r
+			return cmd.Run()
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			if _, err := exec.LookPath("tar"); bc.name == "tar" && err != nil {
+				b.Skip("tar is not installed")
+			}
+			b.SetBytes(fi.Size())
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := filepath.Join(tmp, "rootfs")
+				os.RemoveAll(dir)
+				if err := os.Mkdir(dir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				f, err := os.Open(aciPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				err = bc.extract(f, dir)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,25 +1,12 @@
 package jetpack
 
-import "bufio"
-import "bytes"
-import "compress/bzip2"
-import "compress/gzip"
-
-import "fmt"
-import "io"
+import "io/ioutil"
 import "net"
+import "os"
+import "path/filepath"
 
-import "github.com/appc/spec/aci"
-import "github.com/appc/spec/schema/types"
 import "github.com/juju/errors"
 
-func ConsoleApp(username string) *types.App {
-	return &types.App{
-		Exec: []string{"/usr/bin/login", "-fp", username},
-		User: "root",
-	}
-}
-
 func nextIP(ip net.IP) net.IP {
 	for i := len(ip) - 1; i >= 0; i-- {
 		ip[i] += 1
@@ -30,39 +17,26 @@ func nextIP(ip net.IP) net.IP {
 	return nil
 }
 
-// FIXME: mostly copy/paste from github.com/appc/spec/actool/validate.go
-func DecompressingReader(rd io.Reader) (io.Reader, error) {
-	brd := bufio.NewReaderSize(rd, 1024)
-	header, err := brd.Peek(768)
+// Writes data to a temporary file next to path, and renames it over
+// path, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tf, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
 	}
+	defer os.Remove(tf.Name())
 
-	typ, err := aci.DetectFileType(bytes.NewReader(header))
+	_, err = tf.Write(data)
+	if err2 := tf.Close(); err == nil {
+		err = err2
+	}
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
 	}
 
-	var r io.Reader
-	switch typ {
-	case aci.TypeGzip:
-		r, err = gzip.NewReader(brd)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-	case aci.TypeBzip2:
-		r = bzip2.NewReader(brd)
-	case aci.TypeXz:
-		r, err = aci.NewXzReader(brd)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-	case aci.TypeTar:
-		r = brd
-	case aci.TypeUnknown:
-		return nil, errors.New("unknown filetype")
-	default:
-		panic(fmt.Sprintf("bad type returned from DetectFileType: %v", typ))
+	if err := os.Chmod(tf.Name(), perm); err != nil {
+		return errors.Trace(err)
 	}
-	return r, nil
+
+	return errors.Trace(os.Rename(tf.Name(), path))
 }
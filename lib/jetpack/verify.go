@@ -0,0 +1,220 @@
+package jetpack
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+)
+
+// Image's content is its manifest and rootfs, written as a canonical
+// ACI (see Export). When an image is sealed, hash of its content is
+// saved in the metadata, and digest of each entry in the `contents`
+// file. Verification writes the content again: a different hash
+// means that the rootfs has changed, and the digests tell which
+// entries. Images sealed before content hashes were recorded have
+// nothing to be verified against: their verification is skipped with
+// ErrImageUnsealed, rather than trusting whatever their rootfs is now.
+
+// Entries listed by ImageVerificationError, per kind
+const maxListedEntries = 10
+
+// Returned when image's content doesn't match its hash; its cause is
+// ErrImageModified.
+type ImageVerificationError struct {
+	Image          string // ID
+	Expected       *types.Hash
+	Computed       *types.Hash
+	Changed        []string // entries
+	Added, Removed []string
+	EntriesUnknown bool // no recorded digests to compare entries with
+}
+
+func (e *ImageVerificationError) Error() string {
+	msg := fmt.Sprintf("Image %v failed verification: content hash is %v, expected %v", e.Image, e.Computed, e.Expected)
+	for _, kind := range []struct {
+		name    string
+		entries []string
+	}{{"changed", e.Changed}, {"added", e.Added}, {"removed", e.Removed}} {
+		if len(kind.entries) == 0 {
+			continue
+		}
+		entries := kind.entries
+		more := ""
+		if len(entries) > maxListedEntries {
+			more = fmt.Sprintf(" and %d more", len(entries)-maxListedEntries)
+			entries = entries[:maxListedEntries]
+		}
+		msg += fmt.Sprintf("; %v: %v%v", kind.name, strings.Join(entries, ", "), more)
+	}
+	return msg
+}
+
+func (e *ImageVerificationError) Cause() error {
+	return ErrImageModified
+}
+
+// Digests of canonical ACI entries, in order
+type contentEntry struct {
+	name   string
+	digest string
+}
+
+// Returns hash of image's content, and digests of its entries.
+func (img *Image) digestContent() (*types.Hash, []contentEntry, error) {
+	var entries []contentEntry
+	hash, err := img.writeCanonicalACI(ioutil.Discard, nil, func(name string, digest []byte) {
+		entries = append(entries, contentEntry{name, hex.EncodeToString(digest)})
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return hash, entries, nil
+}
+
+// Saves hash of image's content in ContentHash, and its entries'
+// digests in the contents file.
+func (img *Image) recordContent() error {
+	hash, entries, err := img.digestContent()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(img.saveContent(hash, entries))
+}
+
+// Saves content hash and entries' digests computed by digestContent.
+func (img *Image) saveContent(hash *types.Hash, entries []contentEntry) error {
+	f, err := os.OpenFile(img.Path("contents"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0440)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%v %v\n", entry.digest, entry.name)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	img.ContentHash = hash
+	return nil
+}
+
+func (img *Image) loadContent() ([]contentEntry, error) {
+	bb, err := ioutil.ReadFile(img.Path("contents"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var entries []contentEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(bb), "\n"), "\n") {
+		if pieces := strings.SplitN(line, " ", 2); len(pieces) == 2 {
+			entries = append(entries, contentEntry{name: pieces[1], digest: pieces[0]})
+		}
+	}
+	return entries, nil
+}
+
+// Checks that image's manifest and rootfs are what they were when the
+// image was sealed. Returns ImageVerificationError if they are not,
+// and ErrImageUnsealed if the image has no content hash.
+func (img *Image) Verify() error {
+	expected := img.ContentHash
+	if expected == nil {
+		return ErrImageUnsealed
+	}
+	img.log().Debugf("Verifying content against %v", expected)
+	computed, entries, err := img.digestContent()
+	if err != nil {
+		return errors.Annotatef(err, "Verifying %v", img.ID())
+	}
+	if *computed == *expected {
+		return nil
+	}
+
+	verr := &ImageVerificationError{Image: img.ID(), Expected: expected, Computed: computed}
+	recorded, err := img.loadContent()
+	if err != nil {
+		verr.EntriesUnknown = true
+		return verr
+	}
+	digests := make(map[string]string, len(recorded))
+	for _, entry := range recorded {
+		digests[entry.name] = entry.digest
+	}
+	for _, entry := range entries {
+		if digest, ok := digests[entry.name]; !ok {
+			verr.Added = append(verr.Added, entry.name)
+		} else {
+			if digest != entry.digest {
+				verr.Changed = append(verr.Changed, entry.name)
+			}
+			delete(digests, entry.name)
+		}
+	}
+	for _, entry := range recorded {
+		if _, ok := digests[entry.name]; ok {
+			verr.Removed = append(verr.Removed, entry.name)
+		}
+	}
+	return verr
+}
+
+// Result of verifying an image
+type ImageVerification struct {
+	Image *Image
+	Err   error // nil if image is intact, ErrImageUnsealed if skipped
+}
+
+// Returns true if the image was not verified, as it is unsealed.
+func (iv *ImageVerification) Skipped() bool {
+	return iv.Err == ErrImageUnsealed
+}
+
+// Verifies all stored images. Returns result for each image; error is
+// returned only if images can't be listed.
+func (h *Host) VerifyImages() ([]ImageVerification, error) {
+	unlock, err := h.lockShared()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer unlock()
+	imgs, err := h.Images()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rv := make([]ImageVerification, len(imgs))
+	failed, skipped := 0, 0
+	for i, img := range imgs {
+		rv[i] = ImageVerification{Image: img, Err: img.Verify()}
+		if rv[i].Skipped() {
+			skipped++
+		} else if rv[i].Err != nil {
+			failed++
+			h.log().With("image", img.ID()).Warnf("%v", rv[i].Err)
+		}
+	}
+	h.log().Infof("verified %d images, %d failed, %d unsealed skipped", len(imgs)-skipped, failed, skipped)
+	return rv, nil
+}
+
+// Verifies images of the pod's apps.
+func (pod *Pod) verifyImages() error {
+	for _, rtApp := range pod.Manifest.Apps {
+		if img, err := pod.Host.getRuntimeImage(rtApp.Image); err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		} else if err := img.Verify(); err == ErrImageUnsealed {
+			pod.log().Warnf("App %v: image %v is unsealed, not verified", rtApp.Name, img.ID())
+		} else if err != nil {
+			return errors.Annotatef(err, "App %v", rtApp.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestImageVerify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	if err := os.MkdirAll(h.Path("images"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	img := saveTestImage(t, h, "example.com/verify")
+	rootfs := img.Path("rootfs")
+	writeTestFiles(t, rootfs, map[string]string{
+		"bin/app":  "app",
+		"etc/motd": "hello",
+		"etc/old":  "old",
+	})
+
+	// Legacy image: nothing to verify against
+	if err := img.Verify(); err != ErrImageUnsealed {
+		t.Errorf("expected unsealed image to be skipped, got %v", err)
+	}
+
+	if err := img.recordContent(); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Verify(); err != nil {
+		t.Errorf("intact image: %v", err)
+	}
+	if exported, err := img.Export(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	} else if *exported != *img.ContentHash {
+		t.Errorf("content hash %v, exported %v", img.ContentHash, exported)
+	}
+
+	// Tampered rootfs
+	ioutil.WriteFile(filepath.Join(rootfs, "etc/motd"), []byte("pwned"), 0644)
+	ioutil.WriteFile(filepath.Join(rootfs, "bin/backdoor"), []byte("x"), 0755)
+	os.Remove(filepath.Join(rootfs, "etc/old"))
+
+	err = img.Verify()
+	verr, ok := err.(*ImageVerificationError)
+	if !ok {
+		t.Fatalf("expected verification error, got %v", err)
+	} else if errors.Cause(err) != ErrImageModified {
+		t.Errorf("unexpected cause of %v", err)
+	}
+	for _, c := range []struct {
+		kind             string
+		actual, expected []string
+	}{
+		{"added", verr.Added, []string{"rootfs/bin/backdoor"}},
+		{"removed", verr.Removed, []string{"rootfs/etc/old"}},
+	} {
+		if len(c.actual) != len(c.expected) || len(c.actual) > 0 && c.actual[0] != c.expected[0] {
+			t.Errorf("%v entries are %v, expected %v", c.kind, c.actual, c.expected)
+		}
+	}
+	// Directory mtimes change with added and removed files
+	changed := false
+	for _, name := range verr.Changed {
+		if name == "rootfs/etc/motd" {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Errorf("changed entries are %v", verr.Changed)
+	}
+	if *verr.Expected != *img.ContentHash || verr.Computed == nil || *verr.Computed == *verr.Expected {
+		t.Errorf("unexpected hashes in %v", verr)
+	}
+}
@@ -0,0 +1,261 @@
+package jetpack
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+)
+
+// VNET pods get their own network stack, connected to a bridge on
+// the host with an epair(4) interface pair. Pod opts in by setting
+// `jetpack/vnet-bridge` annotation to name of the bridge.
+
+// Returns name of the bridge, if pod is a VNET pod.
+func (pod *Pod) VNETBridge() (string, bool) {
+	return pod.Manifest.Annotations.Get("jetpack/vnet-bridge")
+}
+
+// Returns names of host and jail sides of pod's epair. The names are
+// derived from the UUID to be stable across restarts, and fit in
+// IFNAMSIZ.
+func (pod *Pod) epairNames() (string, string) {
+	base := fmt.Sprintf("jp%x", []byte(pod.UUID[:4]))
+	return base + "a", base + "b"
+}
+
+// Returns a stable, locally administered unicast MAC derived from
+// pod's UUID.
+func deriveMAC(id uuid.UUID) net.HardwareAddr {
+	sum := sha1.Sum(id)
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac
+}
+
+func parseMAC(str string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(str)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(mac) != 6 {
+		return nil, errors.Errorf("Not an Ethernet MAC address: %v", str)
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, errors.Errorf("Multicast MAC address: %v", str)
+	}
+	return mac, nil
+}
+
+// Returns MAC address of pod's VNET interface: value of
+// `jetpack/mac-address` annotation, or an address derived from the
+// UUID. Returns nil for non-VNET pods.
+func (pod *Pod) MACAddress() (net.HardwareAddr, error) {
+	if _, ok := pod.VNETBridge(); !ok {
+		return nil, nil
+	}
+	if str, ok := pod.Manifest.Annotations.Get("jetpack/mac-address"); ok {
+		mac, err := parseMAC(str)
+		return mac, errors.Annotate(err, "jetpack/mac-address")
+	}
+	return deriveMAC(pod.UUID), nil
+}
+
+// Returns an error if pod's MAC address is invalid, or is used by
+// another pod on the host.
+func (pod *Pod) checkMACAddress() error {
+	mac, err := pod.MACAddress()
+	if err != nil || mac == nil {
+		return errors.Trace(err)
+	}
+	for _, other := range pod.Host.Pods() {
+		if uuid.Equal(other.UUID, pod.UUID) {
+			continue
+		}
+		if omac, err := other.MACAddress(); err == nil && omac.String() == mac.String() {
+			return errors.Errorf("MAC address %v is already used by pod %v", mac, other.UUID)
+		}
+	}
+	return nil
+}
+
+func ifconfig(args ...string) *run.Cmd {
+	return systemCommand("/sbin/ifconfig", args...)
+}
+
+// Creates pod's epair before the jail is started: the jail side gets
+// pod's MAC address, and the host side is added to the bridge.
+func (pod *Pod) setupVNET() error {
+	bridge, ok := pod.VNETBridge()
+	if !ok {
+		return nil
+	}
+
+	mac, err := pod.MACAddress()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	hostSide, jailSide := pod.epairNames()
+	if _, err := net.InterfaceByName(hostSide); err == nil {
+		// Left over after a crash; epair is destroyed as a whole.
+		pod.log().Debugf("Destroying stale epair %v", hostSide)
+		if err := ifconfig(hostSide, "destroy").Run(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	pod.log().Debugf("Creating epair %v %v", hostSide, jailSide)
+	epairA, err := ifconfig("epair", "create").OutputString()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	epairB := epairA[:len(epairA)-1] + "b"
+
+	for _, args := range [][]string{
+		{epairA, "name", hostSide},
+		{epairB, "name", jailSide},
+		{jailSide, "ether", mac.String()},
+		{bridge, "addm", hostSide},
+		{hostSide, "up"},
+	} {
+		if err := ifconfig(args...).Run(); err != nil {
+			ifconfig(epairA, "destroy").Run()
+			ifconfig(hostSide, "destroy").Run()
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Runs a command as root inside the jail, chrooted to the app's
+// rootfs, without environment. Unlike App.Stage2, this doesn't
+// ensure the jail is running, so it's safe to call while starting
+// the jail.
+func (pod *Pod) stage2Root(jid int, exec ...string) error {
+	if len(pod.Manifest.Apps) == 0 {
+		return errors.New("No apps")
+	}
+	stage2 := filepath.Join(Config().MustGetString("path.libexec"), "stage2")
+	cmd := run.Command(stage2, append(
+		[]string{fmt.Sprintf("%d:0:0:%s:/", jid, pod.Manifest.Apps[0].Name)},
+		exec...)...)
+	cmd.Cmd.Stdin = nil
+	cmd.Cmd.Stdout = nil
+	return cmd.Stream().Run()
+}
+
+// Configures pod's address on the jail side of the epair, after the
+// jail has been created.
+func (pod *Pod) configureVNET() error {
+	if _, ok := pod.VNETBridge(); !ok {
+		return nil
+	}
+	status, err := pod.jailStatus(true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if pod.IsDHCP() {
+		return errors.Trace(pod.startDHCP(status.Jid))
+	}
+	ip, ok := pod.Manifest.Annotations.Get("ip-address")
+	if !ok {
+		return errors.New("No IP address")
+	}
+	hostip, ipnet, err := pod.Host.HostIP()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	_, jailSide := pod.epairNames()
+	if err := pod.stage2Root(status.Jid, "/sbin/ifconfig", jailSide, "inet", ip+"/"+strconv.Itoa(ones), "up"); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(pod.stage2Root(status.Jid, "/sbin/route", "-q", "add", "default", hostip.String()))
+}
+
+// Destroys pod's epair after the jail is removed.
+func (pod *Pod) teardownVNET() error {
+	if _, ok := pod.VNETBridge(); !ok {
+		return nil
+	}
+	hostSide, _ := pod.epairNames()
+	if _, err := net.InterfaceByName(hostSide); err != nil {
+		// Already gone
+		return nil
+	}
+	return errors.Trace(ifconfig(hostSide, "destroy").Run())
+}
+
+// DHCP
+//////////////////////////////////////////////////////////////////////////////
+
+// VNET pods with `jetpack/vnet-dhcp` annotation set to "true" don't
+// get an address from jetpack's pool; dhclient(8) from the first
+// app's image is started inside the jail instead. It keeps running
+// (and renewing the lease) as long as the jail exists, independently
+// of the apps, and is killed with all other jail's processes when the
+// jail is removed.
+
+// Returns true if VNET pod gets its address by DHCP.
+func (pod *Pod) IsDHCP() bool {
+	if _, ok := pod.VNETBridge(); !ok {
+		return false
+	}
+	dhcp, _ := pod.Manifest.Annotations.Get("jetpack/vnet-dhcp")
+	return dhcp == "true"
+}
+
+func (pod *Pod) dhcpLeasePath() string {
+	_, jailSide := pod.epairNames()
+	return pod.Path("rootfs", "app", pod.Manifest.Apps[0].Name.String(), "rootfs", "var", "db", "dhclient.leases."+jailSide)
+}
+
+// Returns the most recent fixed-address from dhclient's lease file.
+func (pod *Pod) dhcpAddress() (string, bool) {
+	leases, err := ioutil.ReadFile(pod.dhcpLeasePath())
+	if err != nil {
+		return "", false
+	}
+	addr := ""
+	for _, line := range strings.Split(string(leases), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "fixed-address ") {
+			addr = strings.TrimSuffix(strings.TrimPrefix(line, "fixed-address "), ";")
+		}
+	}
+	return addr, addr != ""
+}
+
+// Starts dhclient inside the jail, and waits until it gets a lease.
+func (pod *Pod) startDHCP(jid int) error {
+	_, jailSide := pod.epairNames()
+	os.Remove(pod.dhcpLeasePath())
+	if err := pod.stage2Root(jid, "/sbin/ifconfig", jailSide, "up"); err != nil {
+		return errors.Trace(err)
+	}
+	// dhclient forks into background after getting a lease, or after
+	// failing to get one.
+	if err := pod.stage2Root(jid, "/sbin/dhclient", jailSide); err != nil {
+		return errors.Trace(err)
+	}
+	for i := 0; i < 30; i++ {
+		if addr, ok := pod.dhcpAddress(); ok {
+			pod.log().Debugf("Got DHCP lease: %v", addr)
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return errors.Errorf("No DHCP lease for %v", jailSide)
+}
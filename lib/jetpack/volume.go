@@ -0,0 +1,567 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/run"
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// Ownership and permissions of an empty volume's directory
+type volumePerms struct {
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// Special mode bits: Unix value and os.FileMode equivalent
+var specialModeBits = []struct {
+	unix uint64
+	mode os.FileMode
+}{
+	{04000, os.ModeSetuid},
+	{02000, os.ModeSetgid},
+	{01000, os.ModeSticky},
+}
+
+// Parses octal mode string, as in the volume's `mode` field
+func parseVolumeMode(str string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(str, 8, 32)
+	if err != nil {
+		return 0, errors.Annotatef(err, "Invalid mode %#v", str)
+	}
+	if m&^07777 != 0 {
+		return 0, errors.Errorf("Invalid mode %#v", str)
+	}
+	mode := os.FileMode(m & 0777)
+	for _, bit := range specialModeBits {
+		if m&bit.unix != 0 {
+			mode |= bit.mode
+		}
+	}
+	return mode, nil
+}
+
+func formatVolumeMode(mode os.FileMode) string {
+	m := uint64(mode.Perm())
+	for _, bit := range specialModeBits {
+		if mode&bit.mode != 0 {
+			m |= bit.unix
+		}
+	}
+	return fmt.Sprintf("%04o", m)
+}
+
+func fileInfoPerms(fi os.FileInfo) volumePerms {
+	perms := volumePerms{Mode: fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		perms.UID = int(st.Uid)
+		perms.GID = int(st.Gid)
+	}
+	return perms
+}
+
+// Permissions of an image's directory at an app's mount point
+type volumeModel struct {
+	App   types.ACName
+	Perms volumePerms
+}
+
+func (vm volumeModel) String() string {
+	return fmt.Sprintf("%v (%v %d:%d)", vm.App, formatVolumeMode(vm.Perms.Mode), vm.Perms.UID, vm.Perms.GID)
+}
+
+// Returns permissions for an empty volume. Mode, uid, and gid set in
+// the manifest take precedence; fields that are not set are taken
+// from the image's directories at the mount points (models), or from
+// appc defaults if there are none. If the models don't agree, it's an
+// error, unless union is true: then the volume gets the most
+// permissive union of the models' modes (see unionPerms).
+func emptyVolumePerms(vol types.Volume, models []volumeModel, union bool) (volumePerms, error) {
+	perms := volumePerms{Mode: 0755}
+	conflict := false
+	for i, model := range models {
+		if i == 0 {
+			perms = model.Perms
+			continue
+		}
+		// Fields set in the manifest don't need to agree
+		if (vol.Mode == nil && model.Perms.Mode != perms.Mode) ||
+			(vol.UID == nil && model.Perms.UID != perms.UID) ||
+			(vol.GID == nil && model.Perms.GID != perms.GID) {
+			conflict = true
+		}
+	}
+	if conflict {
+		if !union {
+			descs := make([]string, len(models))
+			for i, model := range models {
+				descs[i] = model.String()
+			}
+			return perms, errors.Errorf("Conflicting mount point permissions of volume %v: %v", vol.Name, strings.Join(descs, ", "))
+		}
+		perms = unionPerms(models)
+	}
+
+	if vol.Mode != nil {
+		if mode, err := parseVolumeMode(*vol.Mode); err != nil {
+			return perms, errors.Trace(err)
+		} else {
+			perms.Mode = mode
+		}
+	}
+	if vol.UID != nil {
+		perms.UID = *vol.UID
+	}
+	if vol.GID != nil {
+		perms.GID = *vol.GID
+	}
+	return perms, nil
+}
+
+// Returns union of models' modes, owned by the first model's owner.
+// Apps whose image has a different owner get their owner permissions
+// through the group (if uids differ) or others (if gids differ too),
+// so that every app can do what it could do in its own image.
+func unionPerms(models []volumeModel) volumePerms {
+	perms := models[0].Perms
+	for _, model := range models[1:] {
+		perms.Mode |= model.Perms.Mode
+	}
+	for _, model := range models[1:] {
+		ownerBits := (model.Perms.Mode & 0700) >> 6
+		if model.Perms.UID != perms.UID {
+			perms.Mode |= ownerBits << 3
+		}
+		if model.Perms.GID != perms.GID {
+			perms.Mode |= ownerBits | ((model.Perms.Mode & 0070) >> 3)
+		}
+	}
+	return perms
+}
+
+// Applies permissions to the volume's directory, and records them in
+// the volume, so that the saved manifest is complete.
+func (perms volumePerms) apply(vol *types.Volume, path string) error {
+	if err := os.Chown(path, perms.UID, perms.GID); err != nil {
+		return errors.Trace(err)
+	}
+	// Chown may clear setuid/setgid bits, so chmod goes last
+	if err := os.Chmod(path, perms.Mode); err != nil {
+		return errors.Trace(err)
+	}
+	perms.record(vol)
+	return nil
+}
+
+// Records permissions in the volume
+func (perms volumePerms) record(vol *types.Volume) {
+	mode := formatVolumeMode(perms.Mode)
+	uid, gid := perms.UID, perms.GID
+	vol.Mode, vol.UID, vol.GID = &mode, &uid, &gid
+}
+
+// Marker of a seeded volume
+const volumeSeededMarker = ".jetpack-seeded"
+
+// Copies contents of the image's directory at the mount point (src)
+// into empty volume at path, preserving ownership, modes, and
+// symlinks. Pod opts in per volume with `jetpack/volume/NAME/seed`
+// annotation set to "true". Volume is seeded only once; a marker file
+// is left in the volume.
+func seedVolume(path, src string) error {
+	marker := filepath.Join(path, volumeSeededMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+
+	if src != "" {
+		if err := run.Command("cp", "-a", src+"/.", path).Stream().Run(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(ioutil.WriteFile(marker, nil, 0400))
+}
+
+// Returns value of pod's `jetpack/volume/NAME/KEY` annotation
+func (pod *Pod) volumeAnnotation(name types.ACName, key string) (string, bool) {
+	return pod.Manifest.Annotations.Get("jetpack/volume/" + name.String() + "/" + key)
+}
+
+// tmpfs volumes
+//////////////////////////////////////////////////////////////////////////////
+
+// Empty volume with `jetpack/volume/NAME/tmpfs` annotation is a
+// memory-backed tmpfs(5) mounted directly at the mount point, and
+// vanishes when the pod is stopped. Annotation's value is a
+// comma-separated list of tmpfs options (e.g. "size=256m"); mode,
+// uid, and gid default to the volume's.
+
+var tmpfsSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[kKmMgGtT]?$`)
+
+// Returns validated tmpfs mount options.
+func tmpfsMountOptions(str string, perms volumePerms) (string, error) {
+	opts := map[string]string{
+		"mode": formatVolumeMode(perms.Mode),
+		"uid":  strconv.Itoa(perms.UID),
+		"gid":  strconv.Itoa(perms.GID),
+	}
+	for _, opt := range strings.Split(str, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return "", errors.Errorf("Invalid tmpfs option %#v", opt)
+		}
+		switch kv[0] {
+		case "size", "maxfilesize":
+			if !tmpfsSizeRegexp.MatchString(kv[1]) {
+				return "", errors.Errorf("Invalid tmpfs %v %#v", kv[0], kv[1])
+			}
+		case "mode":
+			if _, err := parseVolumeMode(kv[1]); err != nil {
+				return "", errors.Trace(err)
+			}
+		case "uid", "gid", "inodes":
+			if _, err := strconv.ParseUint(kv[1], 10, 32); err != nil {
+				return "", errors.Errorf("Invalid tmpfs %v %#v", kv[0], kv[1])
+			}
+		default:
+			return "", errors.Errorf("Unsupported tmpfs option %#v", kv[0])
+		}
+		opts[kv[0]] = kv[1]
+	}
+
+	if _, ok := opts["size"]; !ok {
+		// Unlimited tmpfs could eat all host's memory
+		return "", errors.New("tmpfs size is required")
+	}
+
+	optStrs := make([]string, 0, len(opts)+1)
+	for k, v := range opts {
+		optStrs = append(optStrs, k+"="+v)
+	}
+	sort.Strings(optStrs)
+	return strings.Join(append([]string{"rw"}, optStrs...), ","), nil
+}
+
+// Pods with `jetpack/tmpfs-tmp` annotation (or tmpfs.tmp property)
+// set to a size get a tmpfs of that size mounted on each app's /tmp,
+// unless the app already mounts a volume there.
+
+// Returns size of pod's /tmp tmpfs, and true if it's enabled. It's
+// always enabled for ephemeral pods, whose rootfs is read-only.
+func (pod *Pod) TmpfsTmp() (string, bool) {
+	size, ok := pod.Manifest.Annotations.Get("jetpack/tmpfs-tmp")
+	if !ok {
+		size = Config().GetString("tmpfs.tmp", "off")
+	}
+	if (size == "" || size == "off") && pod.Ephemeral() {
+		size = pod.ephemeralScratchSize()
+	}
+	if size == "" || size == "off" {
+		return "", false
+	}
+	return size, true
+}
+
+// Returns fstab entry for app's /tmp tmpfs, or nil if the pod
+// doesn't use it.
+func (pod *Pod) tmpfsTmpEntry(appRootfs string) (*fstabEntry, error) {
+	size, ok := pod.TmpfsTmp()
+	if !ok {
+		return nil, nil
+	}
+	opts, err := tmpfsMountOptions("size="+size, volumePerms{Mode: 0777 | os.ModeSticky})
+	if err != nil {
+		return nil, errors.Annotate(err, "/tmp")
+	}
+	if err := pod.mkdirMountPoint(appRootfs, "/tmp", nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fstabEntry{"tmpfs", filepath.Join(appRootfs, "tmp"), "tmpfs", opts, 0}, nil
+}
+
+// ZFS volumes
+//////////////////////////////////////////////////////////////////////////////
+
+// Empty volumes are child datasets of the pod's dataset. These ZFS
+// properties can be set per volume with `jetpack/volume/NAME/PROPERTY`
+// annotations, besides the volumes.zfs.* host properties and
+// `jetpack/volume/NAME/zfs-properties` annotation (see zfsprops.go).
+var volumeZFSProperties = []string{"compression", "quota", "recordsize", "refquota", "refreservation", "reservation"}
+
+// Returns dataset of an empty volume
+func (pod *Pod) volumeDataset(name types.ACName) (*zfs.Dataset, error) {
+	for i, vol := range pod.Manifest.Volumes {
+		if vol.Name != name {
+			continue
+		}
+		if _, isTmpfs := pod.volumeAnnotation(name, "tmpfs"); vol.Kind != "empty" || isTmpfs {
+			return nil, errors.Errorf("Volume %v has no dataset", name)
+		}
+		if ds := pod.getDataset(); ds == nil {
+			return nil, errors.Errorf("Pod %v has no dataset", pod.UUID)
+		} else {
+			ds, err := ds.GetDataset(fmt.Sprintf("volume.%v", i))
+			return ds, errors.Trace(err)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Snapshots an empty volume, without touching the rootfs.
+func (pod *Pod) VolumeSnapshot(name types.ACName, snap string) error {
+	if ds, err := pod.volumeDataset(name); err != nil {
+		return errors.Trace(err)
+	} else {
+		_, err := ds.Snapshot(snap, nil)
+		return errors.Trace(err)
+	}
+}
+
+// Rolls an empty volume back to a snapshot. Pod needs to be stopped.
+func (pod *Pod) VolumeRollback(name types.ACName, snap string) error {
+	if pod.Status() != PodStatusStopped {
+		return errors.New("Pod needs to be stopped")
+	}
+	if ds, err := pod.volumeDataset(name); err != nil {
+		return errors.Trace(err)
+	} else {
+		return errors.Trace(ds.Rollback(snap, false))
+	}
+}
+
+// File volumes
+//////////////////////////////////////////////////////////////////////////////
+
+// Host volume whose source is a regular file is nullfs-mounted over a
+// file at the mount point. With `jetpack/volume/NAME/copy` annotation
+// set to "true", a read-only file volume is instead copied to the
+// mount point every time the pod is started.
+
+// Returns true if host volume's source is a regular file.
+func hostVolumeIsFile(vol types.Volume) (bool, error) {
+	if vol.Kind != "host" {
+		return false, nil
+	}
+	fi, err := os.Stat(vol.Source)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	switch {
+	case fi.IsDir():
+		return false, nil
+	case fi.Mode().IsRegular():
+		return true, nil
+	default:
+		return false, errors.Errorf("%v is neither a directory nor a regular file", vol.Source)
+	}
+}
+
+func (pod *Pod) volumeCopied(name types.ACName) bool {
+	copied, _ := pod.volumeAnnotation(name, "copy")
+	return copied == "true"
+}
+
+// Creates an empty file to mount a file volume on, if it doesn't
+// exist.
+func mkFileMountPoint(rootfs, path string) error {
+	if fi, err := os.Stat(filepath.Join(rootfs, path)); err == nil {
+		if !fi.Mode().IsRegular() {
+			return errors.Errorf("File volume can't be mounted on %v: not a regular file", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	if err := mkdirMountPoint(rootfs, filepath.Dir(path), nil); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(filepath.Join(rootfs, path), nil, 0644))
+}
+
+// Copies copied file volumes to their mount points.
+func (pod *Pod) copyFileVolumes() error {
+	bb, err := ioutil.ReadFile(pod.Path("file-copies"))
+	if os.IsNotExist(err) {
+		// Pod created by older jetpack
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	copies, err := parseFileCopies(string(bb))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, cp := range copies {
+		if err := copyFile(cp[0], cp[1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// The file-copies file has a "SOURCE TARGET" line for each copied
+// file volume, with paths escaped as in fstab.
+func formatFileCopies(copies [][2]string) (string, error) {
+	lines := make([]string, len(copies))
+	for i, cp := range copies {
+		src, err := fstabEscape(cp[0])
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		dst, err := fstabEscape(cp[1])
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		lines[i] = src + "\t" + dst + "\n"
+	}
+	return strings.Join(lines, ""), nil
+}
+
+func parseFileCopies(str string) ([][2]string, error) {
+	var copies [][2]string
+	for _, line := range strings.Split(str, "\n") {
+		if line == "" {
+			continue
+		}
+		pieces := strings.Fields(line)
+		if len(pieces) != 2 {
+			return nil, errors.Errorf("Invalid file-copies line %#v", line)
+		}
+		copies = append(copies, [2]string{fstabUnescaper.Replace(pieces[0]), fstabUnescaper.Replace(pieces[1])})
+	}
+	return copies, nil
+}
+
+// Copies file contents and mode.
+func copyFile(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bb, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFileAtomic(dst, bb, fi.Mode().Perm()))
+}
+
+// Host volume sources
+//////////////////////////////////////////////////////////////////////////////
+
+// Host volume's source needs to exist when the pod is created and
+// each time it's started. With `jetpack/volume/NAME/create` annotation
+// set to "true", a missing source directory is created, with mode,
+// uid, and gid taken from `jetpack/volume/NAME/create-mode`,
+// `create-uid`, and `create-gid` annotations (default: 0755, owned by
+// root).
+
+// Returns permissions for a created host volume source directory.
+func (pod *Pod) hostVolumeCreatePerms(name types.ACName) (volumePerms, error) {
+	perms := volumePerms{Mode: 0755}
+	if str, ok := pod.volumeAnnotation(name, "create-mode"); ok {
+		if mode, err := parseVolumeMode(str); err != nil {
+			return perms, errors.Trace(err)
+		} else {
+			perms.Mode = mode
+		}
+	}
+	for _, id := range []struct {
+		key string
+		ptr *int
+	}{{"create-uid", &perms.UID}, {"create-gid", &perms.GID}} {
+		if str, ok := pod.volumeAnnotation(name, id.key); ok {
+			if v, err := strconv.Atoi(str); err != nil || v < 0 {
+				return perms, errors.Errorf("Invalid %v %#v", id.key, str)
+			} else {
+				*id.ptr = v
+			}
+		}
+	}
+	return perms, nil
+}
+
+// Verifies (and, if requested, creates) host volume's source.
+func (pod *Pod) checkHostVolume(vol types.Volume) error {
+	if !filepath.IsAbs(vol.Source) {
+		return errors.Errorf("Source %#v is not an absolute path", vol.Source)
+	}
+
+	if _, err := os.Stat(vol.Source); os.IsNotExist(err) {
+		if create, _ := pod.volumeAnnotation(vol.Name, "create"); create != "true" {
+			return errors.Errorf("Source %v does not exist (set jetpack/volume/%v/create=true annotation to create it)", vol.Source, vol.Name)
+		}
+		perms, err := pod.hostVolumeCreatePerms(vol.Name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		pod.ui.Printf("Creating %v for volume %v", vol.Source, vol.Name)
+		if err := os.MkdirAll(vol.Source, 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Chown(vol.Source, perms.UID, perms.GID); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Chmod(vol.Source, perms.Mode); err != nil {
+			return errors.Trace(err)
+		}
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := pod.checkOutsideRootfs(vol.Source); err != nil {
+		return errors.Trace(err)
+	}
+
+	if vol.ReadOnly == nil || !*vol.ReadOnly {
+		// access(2) with W_OK fails with EROFS on a read-only filesystem
+		if err := syscall.Access(vol.Source, 2); err == syscall.EROFS {
+			pod.log().Warnf("volume %v is mounted read-write, but %v is on a read-only filesystem", vol.Name, vol.Source)
+		}
+	}
+
+	return nil
+}
+
+// Mounting pod's own rootfs inside itself would create a loop.
+func (pod *Pod) checkOutsideRootfs(path string) error {
+	if src, err := filepath.EvalSymlinks(path); err != nil {
+		return errors.Trace(err)
+	} else if rootfs, err := filepath.EvalSymlinks(pod.Path("rootfs")); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	} else if err == nil && pathUnder(src, rootfs) {
+		return errors.Errorf("Source %v is inside the pod's rootfs", path)
+	}
+	return nil
+}
+
+// Verifies sources of all host volumes.
+func (pod *Pod) checkHostVolumes() error {
+	for _, vol := range pod.Manifest.Volumes {
+		if vol.Kind != "host" {
+			continue
+		}
+		if err := pod.checkHostVolume(vol); err != nil {
+			return errors.Annotatef(err, "Volume %v", vol.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package jetpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func TestParseVolumeMode(t *testing.T) {
+	for str, expected := range map[string]os.FileMode{
+		"0755": 0755,
+		"755":  0755,
+		"1777": 0777 | os.ModeSticky,
+		"2750": 0750 | os.ModeSetgid,
+		"4711": 0711 | os.ModeSetuid,
+	} {
+		if mode, err := parseVolumeMode(str); err != nil {
+			t.Errorf("parseVolumeMode(%#v): %v", str, err)
+		} else if mode != expected {
+			t.Errorf("parseVolumeMode(%#v) = %v, expected %v", str, mode, expected)
+		} else if formatted := formatVolumeMode(mode); formatted != "0"+str[len(str)-3:] && formatted != str {
+			t.Errorf("formatVolumeMode(%v) = %#v, expected %#v", mode, formatted, str)
+		}
+	}
+
+	for _, str := range []string{"", "abc", "0999", "10755", "-1"} {
+		if _, err := parseVolumeMode(str); err == nil {
+			t.Errorf("parseVolumeMode(%#v) didn't fail", str)
+		}
+	}
+}
+
+func TestEmptyVolumePerms(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	modelPath := filepath.Join(tmp, "model")
+	if err := os.Mkdir(modelPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(modelPath, 0700)
+	modelFi, err := os.Stat(modelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := []volumeModel{{*types.MustACName("app"), fileInfoPerms(modelFi)}}
+	modelPerms := model[0].Perms
+
+	mode, uid, gid := "0750", 1001, 1002
+
+	for _, tc := range []struct {
+		vol      types.Volume
+		models   []volumeModel
+		expected volumePerms
+	}{
+		// Nothing set: appc defaults
+		{types.Volume{}, nil, volumePerms{0755, 0, 0}},
+		// Nothing set: taken from image
+		{types.Volume{}, model, modelPerms},
+		// Manifest wins over image
+		{types.Volume{Mode: &mode, UID: &uid, GID: &gid}, model, volumePerms{0750, 1001, 1002}},
+		// Only some fields set
+		{types.Volume{UID: &uid}, model, volumePerms{0700, 1001, modelPerms.GID}},
+	} {
+		tc.vol.Name = *types.MustACName("test")
+		tc.vol.Kind = "empty"
+		if perms, err := emptyVolumePerms(tc.vol, tc.models, false); err != nil {
+			t.Errorf("emptyVolumePerms(%v): %v", tc.vol, err)
+		} else if perms != tc.expected {
+			t.Errorf("emptyVolumePerms(%v) = %v, expected %v", tc.vol, perms, tc.expected)
+		}
+	}
+}
+
+func testModels(perms ...volumePerms) []volumeModel {
+	models := make([]volumeModel, len(perms))
+	for i, p := range perms {
+		models[i] = volumeModel{*types.MustACName(fmt.Sprintf("app%d", i+1)), p}
+	}
+	return models
+}
+
+func TestEmptyVolumePermsConflicts(t *testing.T) {
+	mode, uid := "0770", 1001
+	vol := types.Volume{Name: *types.MustACName("test"), Kind: "empty"}
+	volMode := vol
+	volMode.Mode = &mode
+	volAll := volMode
+	volAll.UID, volAll.GID = &uid, &uid
+
+	for i, tc := range []struct {
+		vol      types.Volume
+		models   []volumeModel
+		union    bool
+		expected *volumePerms // nil if conflict expected
+	}{
+		// Two apps agree
+		{vol, testModels(volumePerms{0750, 1, 2}, volumePerms{0750, 1, 2}), false, &volumePerms{0750, 1, 2}},
+		// Three apps agree
+		{vol, testModels(volumePerms{0750, 1, 2}, volumePerms{0750, 1, 2}, volumePerms{0750, 1, 2}), false, &volumePerms{0750, 1, 2}},
+		// Two apps, conflicting mode
+		{vol, testModels(volumePerms{0750, 1, 2}, volumePerms{0700, 1, 2}), false, nil},
+		// Three apps, last one conflicting owner
+		{vol, testModels(volumePerms{0750, 1, 2}, volumePerms{0750, 1, 2}, volumePerms{0750, 3, 2}), false, nil},
+		// Conflicting field set in the manifest
+		{volMode, testModels(volumePerms{0750, 1, 2}, volumePerms{0700, 1, 2}), false, &volumePerms{0770, 1, 2}},
+		// Other fields still need to agree
+		{volMode, testModels(volumePerms{0750, 1, 2}, volumePerms{0700, 1, 3}), false, nil},
+		// All set in the manifest
+		{volAll, testModels(volumePerms{0750, 1, 2}, volumePerms{0700, 3, 4}, volumePerms{0755, 5, 6}), false, &volumePerms{0770, 1001, 1001}},
+		// Union of two modes
+		{vol, testModels(volumePerms{0750, 1, 2}, volumePerms{0705, 1, 2}), true, &volumePerms{0755, 1, 2}},
+		// Union: different uid, owner bits go to group
+		{vol, testModels(volumePerms{0700, 1, 2}, volumePerms{0700, 3, 2}), true, &volumePerms{0770, 1, 2}},
+		// Union of three: different gid, owner and group bits go to others
+		{vol, testModels(volumePerms{0700, 1, 2}, volumePerms{0700, 1, 2}, volumePerms{0750, 3, 4}), true, &volumePerms{0777, 1, 2}},
+	} {
+		perms, err := emptyVolumePerms(tc.vol, tc.models, tc.union)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%d: expected conflict, got %v", i, perms)
+			} else {
+				for _, model := range tc.models {
+					if !strings.Contains(err.Error(), model.App.String()) {
+						t.Errorf("%d: error doesn't name %v: %v", i, model.App, err)
+					}
+				}
+			}
+		} else if err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if perms != *tc.expected {
+			t.Errorf("%d: got %v, expected %v", i, perms, *tc.expected)
+		}
+	}
+}
+
+// A non-root app needs to be able to write to its empty volume on
+// first start.
+func TestVolumePermsApply(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Needs to run as root")
+	}
+
+	tmp, err := ioutil.TempDir("", "jetpack-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	volPath := filepath.Join(tmp, "vol")
+	if err := os.Mkdir(volPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	mode, uid, gid := "0750", 1001, 1002
+	vol := types.Volume{Name: *types.MustACName("test"), Kind: "empty", Mode: &mode, UID: &uid, GID: &gid}
+	perms, err := emptyVolumePerms(vol, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol.Mode, vol.UID, vol.GID = nil, nil, nil
+	if err := perms.apply(&vol, volPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.Mode == nil || *vol.Mode != "0750" || vol.UID == nil || *vol.UID != 1001 || vol.GID == nil || *vol.GID != 1002 {
+		t.Errorf("Volume not updated: %v", vol)
+	}
+
+	fi, err := os.Stat(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("Mode is %v, expected 0750", fi.Mode().Perm())
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1001 || st.Gid != 1002 {
+		t.Errorf("Owner is %d:%d, expected 1001:1002", st.Uid, st.Gid)
+	}
+
+	// The app's user can create files in the volume
+	if err := os.Chmod(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	written := filepath.Join(volPath, "written")
+	cmd := exec.Command("/bin/sh", "-c", `echo ok > "$0"`, written)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Cannot write to volume as %d:%d: %v: %s", uid, gid, err, out)
+	}
+	if fi, err := os.Stat(written); err != nil {
+		t.Error(err)
+	} else if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1001 || st.Gid != 1002 {
+		t.Errorf("Written file is owned by %d:%d, expected 1001:1002", st.Uid, st.Gid)
+	}
+}
+
+func TestSeedVolume(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, vol := filepath.Join(tmp, "src"), filepath.Join(tmp, "vol")
+	for _, dir := range []string{src, filepath.Join(src, "conf.d"), vol} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "conf.d", "default.conf"), []byte("default\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("conf.d/default.conf", filepath.Join(src, "current.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := seedVolume(vol, src); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(filepath.Join(vol, "conf.d", "default.conf")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("Seeded file's mode is %v, expected 0640", fi.Mode().Perm())
+	}
+	if target, err := os.Readlink(filepath.Join(vol, "current.conf")); err != nil {
+		t.Error(err)
+	} else if target != "conf.d/default.conf" {
+		t.Errorf("Seeded symlink points to %#v", target)
+	}
+
+	// Second seeding doesn't overwrite the app's changes
+	if err := ioutil.WriteFile(filepath.Join(vol, "conf.d", "default.conf"), []byte("changed\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedVolume(vol, src); err != nil {
+		t.Fatal(err)
+	}
+	if bb, err := ioutil.ReadFile(filepath.Join(vol, "conf.d", "default.conf")); err != nil {
+		t.Error(err)
+	} else if string(bb) != "changed\n" {
+		t.Errorf("Volume seeded twice")
+	}
+}
+
+func TestTmpfsMountOptions(t *testing.T) {
+	perms := volumePerms{0750, 1001, 1002}
+	for str, expected := range map[string]string{
+		"size=256m":                         "rw,gid=1002,mode=0750,size=256m,uid=1001",
+		"size=1G, mode=1777":                "rw,gid=1002,mode=1777,size=1G,uid=1001",
+		"size=1048576,uid=0,gid=0,inodes=5": "rw,gid=0,inodes=5,mode=0750,size=1048576,uid=0",
+	} {
+		if opts, err := tmpfsMountOptions(str, perms); err != nil {
+			t.Errorf("tmpfsMountOptions(%#v): %v", str, err)
+		} else if opts != expected {
+			t.Errorf("tmpfsMountOptions(%#v) = %#v, expected %#v", str, opts, expected)
+		}
+	}
+
+	for _, str := range []string{"", "mode=0755", "size=", "size=0", "size=-1m", "size=12q", "size=1m,mode=999", "size=1m,nosuid", "size=1m,foo=bar"} {
+		if opts, err := tmpfsMountOptions(str, perms); err == nil {
+			t.Errorf("tmpfsMountOptions(%#v) = %#v, expected error", str, opts)
+		}
+	}
+}
+
+func TestMkFileMountPoint(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "jetpack-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc", "ssl"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing file and parent directories get created
+	if err := mkFileMountPoint(rootfs, "/usr/local/etc/app.conf"); err != nil {
+		t.Error(err)
+	} else if fi, err := os.Stat(filepath.Join(rootfs, "usr", "local", "etc", "app.conf")); err != nil {
+		t.Error(err)
+	} else if !fi.Mode().IsRegular() {
+		t.Errorf("Mount point is not a regular file: %v", fi.Mode())
+	}
+
+	// Existing file is fine
+	if err := mkFileMountPoint(rootfs, "/usr/local/etc/app.conf"); err != nil {
+		t.Error(err)
+	}
+
+	// Directory is a mismatch
+	if err := mkFileMountPoint(rootfs, "/etc/ssl"); err == nil {
+		t.Error("File volume mounted on a directory")
+	}
+
+	// Directory volume on a file is a mismatch too
+	if err := mkdirMountPoint(rootfs, "/usr/local/etc/app.conf", nil); err == nil {
+		t.Error("Directory volume mounted on a file")
+	}
+}
+
+func TestCheckHostVolume(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pod := newPod(&Host{Dataset: &zfs.Dataset{Mountpoint: filepath.Join(tmp, "jetpack")}}, nil)
+	if err := os.MkdirAll(pod.Path("rootfs", "vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := *types.MustACName("data")
+	vol := types.Volume{Name: name, Kind: "host", Source: filepath.Join(tmp, "data", "sub")}
+
+	// Missing source is an error by default
+	if err := pod.checkHostVolume(vol); err == nil {
+		t.Error("No error for missing source")
+	}
+
+	// Missing source gets created with create=true
+	pod.Manifest.Annotations.Set("jetpack/volume/data/create", "true")
+	pod.Manifest.Annotations.Set("jetpack/volume/data/create-mode", "0750")
+	if os.Getuid() == 0 {
+		pod.Manifest.Annotations.Set("jetpack/volume/data/create-uid", "1001")
+	}
+	if err := pod.checkHostVolume(vol); err != nil {
+		t.Error(err)
+	} else if fi, err := os.Stat(vol.Source); err != nil {
+		t.Error(err)
+	} else if !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Errorf("Unexpected source mode %v", fi.Mode())
+	} else if st := fi.Sys().(*syscall.Stat_t); os.Getuid() == 0 && st.Uid != 1001 {
+		t.Errorf("Unexpected source uid %v", st.Uid)
+	}
+
+	// Invalid creation options
+	pod.Manifest.Annotations.Set("jetpack/volume/data/create-gid", "wheel")
+	if err := pod.checkHostVolume(types.Volume{Name: name, Kind: "host", Source: filepath.Join(tmp, "other")}); err == nil {
+		t.Error("No error for invalid create-gid")
+	}
+
+	// Relative source
+	if err := pod.checkHostVolume(types.Volume{Name: name, Kind: "host", Source: "data"}); err == nil {
+		t.Error("No error for relative source")
+	}
+
+	// Source inside pod's rootfs, directly and through a symlink
+	if err := os.Symlink(pod.Path("rootfs", "vol"), filepath.Join(tmp, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{pod.Path("rootfs", "vol"), filepath.Join(tmp, "loop")} {
+		if err := pod.checkHostVolume(types.Volume{Name: name, Kind: "host", Source: src}); err == nil {
+			t.Errorf("No error for source %v inside pod's rootfs", src)
+		}
+	}
+}
+
+func TestTmpfsTmpEntry(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	pod := newPod(nil, nil)
+	pod.Manifest.Annotations.Set("jetpack/tmpfs-tmp", "256m")
+	expected := fstabEntry{"tmpfs", filepath.Join(rootfs, "tmp"), "tmpfs", "rw,gid=0,mode=1777,size=256m,uid=0", 0}
+	if entry, err := pod.tmpfsTmpEntry(rootfs); err != nil {
+		t.Fatal(err)
+	} else if entry == nil || *entry != expected {
+		t.Errorf("Got %#v, expected %#v", entry, expected)
+	} else if fi, err := os.Stat(filepath.Join(rootfs, "tmp")); err != nil || !fi.IsDir() {
+		t.Errorf("/tmp not created: %v", err)
+	}
+
+	for _, size := range []string{"lots", "0", "1.5g", "-1m"} {
+		pod.Manifest.Annotations.Set("jetpack/tmpfs-tmp", size)
+		if entry, err := pod.tmpfsTmpEntry(rootfs); err == nil {
+			t.Errorf("Expected error for size %#v, got %#v", size, entry)
+		}
+	}
+
+	pod.Manifest.Annotations.Set("jetpack/tmpfs-tmp", "off")
+	if entry, err := pod.tmpfsTmpEntry(rootfs); err != nil || entry != nil {
+		t.Errorf("Expected no entry, got %#v, %v", entry, err)
+	}
+}
@@ -0,0 +1,343 @@
+package jetpack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Event subscriptions: events recorded by this process (see
+// logEvent) are also published to watchers registered with
+// WatchEvents. While there are watchers, a reconciler periodically
+// compares pods and their jails with what it has seen, and publishes
+// transitions caused outside of this process (a jail that died on
+// its own, a pod created by another jetpack command) with "detected"
+// in Details. Each watcher has a bounded queue: when it's full, the
+// oldest events are dropped, and the watcher gets an EventOverflow
+// with the number of dropped events before the next event.
+
+// Events queued for a watcher before the oldest ones are dropped
+const watchQueueSize = 256
+
+// Which events a watcher gets; empty lists match everything.
+type EventFilter struct {
+	Pods  []string // pod UUIDs
+	Types []EventType
+}
+
+func (f *EventFilter) matches(ev *Event) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, typ := range f.Types {
+			found = found || typ == ev.Type
+		}
+		if !found && ev.Type != EventOverflow {
+			return false
+		}
+	}
+	if len(f.Pods) > 0 && ev.Type != EventOverflow {
+		found := false
+		for _, id := range f.Pods {
+			found = found || id == ev.Pod
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type eventWatcher struct {
+	filter  *EventFilter
+	mx      sync.Mutex
+	queue   []*Event
+	dropped int
+	wake    chan struct{}
+}
+
+func newEventWatcher(filter *EventFilter) *eventWatcher {
+	return &eventWatcher{filter: filter, wake: make(chan struct{}, 1)}
+}
+
+// Queues event; never blocks.
+func (w *eventWatcher) push(ev *Event) {
+	if !w.filter.matches(ev) {
+		return
+	}
+	w.mx.Lock()
+	if len(w.queue) >= watchQueueSize {
+		w.queue = w.queue[1:]
+		w.dropped++
+	}
+	w.queue = append(w.queue, ev)
+	w.mx.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Takes queued events, preceded by an overflow marker if any were
+// dropped.
+func (w *eventWatcher) take() []*Event {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	evs := w.queue
+	w.queue = nil
+	if w.dropped > 0 {
+		evs = append([]*Event{{
+			Time:    time.Now(),
+			Type:    EventOverflow,
+			Details: fmt.Sprintf("%d events dropped", w.dropped),
+		}}, evs...)
+		w.dropped = 0
+	}
+	return evs
+}
+
+// Delivers events to out until ctx is done, then closes out.
+func (w *eventWatcher) run(ctx context.Context, out chan<- *Event, done func()) {
+	defer close(out)
+	defer done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+		for _, ev := range w.take() {
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+type eventBroker struct {
+	mx       sync.Mutex
+	watchers map[*eventWatcher]bool
+	stop     chan struct{}            // stops the reconciler
+	gen      int                      // generation of the running reconciler
+	known    map[string]podWatchState // pod states seen by the reconciler or published
+
+	// States published while the reconciler lists pods, nil for
+	// destroyed pods; they're newer than what it lists
+	published map[string]*podWatchState
+}
+
+// Returns a channel of events matching filter (nil for all events),
+// which is closed when ctx is done.
+func (h *Host) WatchEvents(ctx context.Context, filter *EventFilter) <-chan *Event {
+	w := newEventWatcher(filter)
+	b := &h.events
+	b.mx.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*eventWatcher]bool)
+	}
+	b.watchers[w] = true
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+		b.gen++
+		b.known = nil
+		go h.reconcileEvents(b.stop, b.gen)
+	}
+	b.mx.Unlock()
+
+	out := make(chan *Event)
+	go w.run(ctx, out, func() {
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		delete(b.watchers, w)
+		if len(b.watchers) == 0 && b.stop != nil {
+			close(b.stop)
+			b.stop = nil
+		}
+	})
+	return out
+}
+
+// Publishes a copy of event to watchers.
+func (h *Host) publishEvent(ev *Event) {
+	b := &h.events
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if len(b.watchers) == 0 {
+		return
+	}
+	evc := *ev
+	if st, ok := eventWatchState(&evc); ok && evc.Error == "" {
+		// Reconciler shouldn't report what's been published already
+		b.recordPublished(evc.Pod, st)
+	}
+	for w := range b.watchers {
+		w.push(&evc)
+	}
+}
+
+// Pod states the reconciler compares
+type podWatchState struct {
+	running bool
+}
+
+// Returns state of the pod after event (nil if it's destroyed), or
+// false if the event doesn't change it.
+func eventWatchState(ev *Event) (*podWatchState, bool) {
+	switch ev.Type {
+	case EventCreate, EventStop:
+		return &podWatchState{}, true
+	case EventStart:
+		return &podWatchState{running: true}, true
+	case EventDestroy:
+		return nil, true
+	}
+	return nil, false
+}
+
+// Records published state of pod id (nil if it's destroyed); b.mx must
+// be held.
+func (b *eventBroker) recordPublished(id string, st *podWatchState) {
+	if b.known != nil {
+		if st != nil {
+			b.known[id] = *st
+		} else {
+			delete(b.known, id)
+		}
+	}
+	if b.published != nil {
+		b.published[id] = st
+	}
+}
+
+// Periodically publishes pod creations, destructions, jail starts
+// and stops that happened outside of this process, until stop is
+// closed. Gen is the reconciler's generation: once another reconciler
+// has started, it doesn't touch the broker's state.
+func (h *Host) reconcileEvents(stop chan struct{}, gen int) {
+	interval, err := time.ParseDuration(Config().GetString("events.reconcile-interval", "5s"))
+	if err != nil || interval <= 0 {
+		h.log().Warnf("invalid events.reconcile-interval, not detecting external changes")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if _, ok := h.scanPodWatchStates(gen, h.podWatchStates); !ok {
+		return
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		evs, ok := h.scanPodWatchStates(gen, h.podWatchStates)
+		if !ok {
+			return
+		}
+		for _, ev := range evs {
+			h.publishEvent(ev)
+		}
+	}
+}
+
+// Lists pod states with list, and makes them known, with states
+// published meanwhile taking precedence. Returns events detected
+// since the last scan (none on the first one), or false if reconciler
+// of gen has been replaced.
+func (h *Host) scanPodWatchStates(gen int, list func() (map[string]podWatchState, error)) ([]*Event, bool) {
+	b := &h.events
+	b.mx.Lock()
+	if b.gen != gen {
+		b.mx.Unlock()
+		return nil, false
+	}
+	b.published = make(map[string]*podWatchState)
+	b.mx.Unlock()
+
+	current, err := list()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.gen != gen {
+		return nil, false
+	}
+	published := b.published
+	b.published = nil
+	if err != nil {
+		h.log().Warnf("cannot list pods: %v", err)
+		return nil, true
+	}
+	for id, st := range published {
+		if st != nil {
+			current[id] = *st
+		} else {
+			delete(current, id)
+		}
+	}
+	var evs []*Event
+	if b.known != nil {
+		evs = diffPodWatchStates(b.known, current)
+	}
+	b.known = current
+	return evs, true
+}
+
+func (h *Host) podWatchStates() (map[string]podWatchState, error) {
+	phs, err := h.PodHeaders()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rv := make(map[string]podWatchState, len(phs))
+	for _, ph := range phs {
+		rv[ph.UUID.String()] = podWatchState{running: ph.Status == PodStatusRunning}
+	}
+	return rv, nil
+}
+
+// Returns detected events that turn before into after.
+func diffPodWatchStates(before, after map[string]podWatchState) []*Event {
+	var evs []*Event
+	detected := func(typ EventType, id string) {
+		evs = append(evs, &Event{Time: time.Now(), Type: typ, Pod: id, Details: "detected"})
+	}
+	for _, id := range sortedKeys(after) {
+		st := after[id]
+		prev, existed := before[id]
+		if !existed {
+			detected(EventCreate, id)
+		}
+		if st.running != prev.running {
+			if st.running {
+				detected(EventStart, id)
+			} else {
+				detected(EventStop, id)
+			}
+		}
+	}
+	for _, id := range sortedKeys(before) {
+		if _, exists := after[id]; !exists {
+			if before[id].running {
+				detected(EventStop, id)
+			}
+			detected(EventDestroy, id)
+		}
+	}
+	return evs
+}
+
+func sortedKeys(states map[string]podWatchState) []string {
+	rv := make([]string, 0, len(states))
+	for id := range states {
+		rv = append(rv, id)
+	}
+	sort.Strings(rv)
+	return rv
+}
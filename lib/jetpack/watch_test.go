@@ -0,0 +1,131 @@
+package jetpack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+func nextEvent(t *testing.T, ch <-chan *Event) *Event {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+		return nil
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	h := &Host{Dataset: &zfs.Dataset{Mountpoint: tmp}}
+	defer Config().Set("events.reconcile-interval", Config().GetString("events.reconcile-interval", "5s"))
+	Config().Set("events.reconcile-interval", "1h")
+	pod, other := newPod(h, nil), newPod(h, nil)
+	os.MkdirAll(pod.Path(), 0700)
+	os.MkdirAll(other.Path(), 0700)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := h.WatchEvents(ctx, &EventFilter{Pods: []string{pod.UUID.String()}})
+
+	other.logEvent(&Event{Type: EventStart})
+	pod.logEvent(&Event{Type: EventStart})
+	if ev := nextEvent(t, ch); ev.Type != EventStart || ev.Pod != pod.UUID.String() {
+		t.Errorf("Unexpected event %#v", ev)
+	}
+
+	cancel()
+	for range ch {
+	}
+	h.events.mx.Lock()
+	if len(h.events.watchers) != 0 || h.events.stop != nil {
+		t.Errorf("Watcher not unregistered: %d watchers", len(h.events.watchers))
+	}
+	h.events.mx.Unlock()
+}
+
+func TestEventWatcherOverflow(t *testing.T) {
+	w := newEventWatcher(&EventFilter{Types: []EventType{EventExec}})
+	w.push(&Event{Type: EventStart})
+	for i := 0; i < watchQueueSize+10; i++ {
+		w.push(&Event{Type: EventExec})
+	}
+	evs := w.take()
+	if len(evs) != watchQueueSize+1 {
+		t.Fatalf("Expected %d events, got %d", watchQueueSize+1, len(evs))
+	}
+	if evs[0].Type != EventOverflow || evs[0].Details != "10 events dropped" {
+		t.Errorf("Expected overflow marker, got %#v", evs[0])
+	}
+	for _, ev := range evs[1:] {
+		if ev.Type != EventExec {
+			t.Fatalf("Unexpected event %#v", ev)
+		}
+	}
+	if evs := w.take(); len(evs) != 0 {
+		t.Errorf("Expected empty queue, got %v", evs)
+	}
+}
+
+func TestScanPodWatchStates(t *testing.T) {
+	h := &Host{}
+	b := &h.events
+	b.watchers = map[*eventWatcher]bool{newEventWatcher(nil): true}
+	b.gen = 2
+	b.known = map[string]podWatchState{"a": {}, "b": {running: true}}
+
+	// Published while listing: the listed states are older
+	evs, ok := h.scanPodWatchStates(2, func() (map[string]podWatchState, error) {
+		h.publishEvent(&Event{Type: EventStart, Pod: "a"})
+		h.publishEvent(&Event{Type: EventDestroy, Pod: "b"})
+		return map[string]podWatchState{"a": {}, "b": {running: true}}, nil
+	})
+	if !ok || len(evs) != 0 {
+		t.Errorf("Expected no events, got %v (%v)", evs, ok)
+	}
+	if expected := map[string]podWatchState{"a": {running: true}}; !reflect.DeepEqual(b.known, expected) {
+		t.Errorf("Expected %v, got %v", expected, b.known)
+	}
+
+	// Reconciler replaced while listing
+	if _, ok := h.scanPodWatchStates(2, func() (map[string]podWatchState, error) {
+		b.mx.Lock()
+		b.gen++
+		b.mx.Unlock()
+		return map[string]podWatchState{}, nil
+	}); ok {
+		t.Error("Stale reconciler not stopped")
+	}
+	if _, ok := h.scanPodWatchStates(2, nil); ok {
+		t.Error("Stale reconciler not stopped")
+	}
+	if len(b.known) != 1 {
+		t.Errorf("Stale reconciler changed known states %v", b.known)
+	}
+}
+
+func TestDiffPodWatchStates(t *testing.T) {
+	before := map[string]podWatchState{"a": {running: true}, "b": {running: true}, "c": {}}
+	after := map[string]podWatchState{"a": {running: true}, "b": {}, "d": {running: true}}
+	var got [][2]string
+	for _, ev := range diffPodWatchStates(before, after) {
+		if ev.Details != "detected" {
+			t.Errorf("Unexpected details %#v", ev)
+		}
+		got = append(got, [2]string{ev.Pod, string(ev.Type)})
+	}
+	expected := [][2]string{{"b", "stop"}, {"d", "create"}, {"d", "start"}, {"c", "destroy"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
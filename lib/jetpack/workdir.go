@@ -0,0 +1,149 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/passwd"
+)
+
+// Apps' working directories are checked before the pod starts: they
+// need to exist in the app's rootfs, or be covered by one of the pod's
+// mounts. With `jetpack/create-workdir` annotation set to "true",
+// missing working directory is created, owned by the app's user.
+
+// Resolves path inside rootfs, following symlinks as if rootfs was the
+// root directory, so that they can't escape it. Returns path on the
+// host. Components after the first missing one are resolved
+// lexically.
+func resolveInRootfs(rootfs, path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(path, "/")
+	hops := 0
+	for len(rest) > 0 {
+		comp := rest[0]
+		rest = rest[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, comp)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if os.IsNotExist(err) {
+			return filepath.Join(rootfs, filepath.Clean(next+"/"+strings.Join(rest, "/"))), nil
+		} else if err != nil {
+			return "", errors.Trace(err)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > 32 {
+			return "", errors.Errorf("Too many levels of symbolic links in %v", path)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// Verifies that working directories of the pod's apps exist, creating
+// them if requested.
+func (pod *Pod) checkWorkingDirectories() error {
+	var fstab []fstabEntry
+	if bb, err := ioutil.ReadFile(pod.Path("fstab")); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	} else if fstab, err = parseFstab(string(bb)); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i, rtApp := range pod.Manifest.Apps {
+		app := pod.App(rtApp.Name)
+		if app == nil || app.app.WorkingDirectory == "" {
+			continue
+		}
+		wd := app.app.WorkingDirectory
+		appRootfs := pod.Path("rootfs", strconv.Itoa(i))
+		path, err := resolveInRootfs(appRootfs, wd)
+		if err != nil {
+			return errors.Annotatef(err, "App %v: working directory %v", app.Name, wd)
+		}
+		covered := false
+		for _, entry := range fstab {
+			if pathUnder(path, entry.Target) && entry.Target != appRootfs {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			// Can't tell before it's mounted
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			if !fi.IsDir() {
+				return errors.Errorf("App %v: working directory %v is not a directory", app.Name, wd)
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if create, _ := pod.appAnnotation(app.Name, "jetpack/create-workdir"); create != "true" {
+			return errors.Errorf("App %v: working directory %v doesn't exist in the app's rootfs", app.Name, wd)
+		}
+		app.log().Debugf("Creating working directory %v", wd)
+		if err := app.createWorkingDirectory(appRootfs, path); err != nil {
+			return errors.Annotatef(err, "App %v: cannot create working directory %v", app.Name, wd)
+		}
+	}
+	return nil
+}
+
+// Creates missing directories of path (on host, inside appRootfs),
+// owned by the app's user and group.
+func (app *App) createWorkingDirectory(appRootfs, path string) error {
+	pwf, err := app.readPasswd()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	grf, err := passwd.ReadGroup(app.Path("etc", "group"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pwent, err := resolveUser(pwf, grf, app.app.User, app.app.Group)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var missing []string
+	for dir := path; dir != appRootfs; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Lchown(missing[i], pwent.Uid, pwent.Gid); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
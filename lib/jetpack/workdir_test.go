@@ -0,0 +1,53 @@
+package jetpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRootfs(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "jetpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "local", "www"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"srv":     "usr/local/www", // relative
+		"web":     "/srv",          // absolute, in rootfs
+		"escape":  "../../../..",   // can't escape rootfs
+		"hostetc": "/etc",          // rootfs's /etc, not host's
+		"loop":    "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(rootfs, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, expected := range map[string]string{
+		"/":                    "/",
+		"/usr/local/www":       "/usr/local/www",
+		"/srv":                 "/usr/local/www",
+		"/web/app":             "/usr/local/www/app",
+		"/escape":              "/",
+		"/escape/usr":          "/usr",
+		"/hostetc":             "/etc",
+		"/missing/../../../..": "/",
+		"/usr/../srv/./x/y":    "/usr/local/www/x/y",
+	} {
+		if resolved, err := resolveInRootfs(rootfs, path); err != nil {
+			t.Errorf("%v: %v", path, err)
+		} else if resolved != filepath.Join(rootfs, expected) {
+			t.Errorf("%v: got %v, expected %v", path, resolved, filepath.Join(rootfs, expected))
+		}
+	}
+
+	if resolved, err := resolveInRootfs(rootfs, "/loop/x"); err == nil {
+		t.Errorf("Symlink loop: expected error, got %v", resolved)
+	}
+}
@@ -0,0 +1,58 @@
+package jetpack
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var xattrNamespaces = []struct {
+	id   int
+	name string
+}{
+	{unix.EXTATTR_NAMESPACE_USER, "user"},
+	{unix.EXTATTR_NAMESPACE_SYSTEM, "system"},
+}
+
+// Returns extended attributes of path, not following a symlink, as
+// NAMESPACE.NAME. System namespace is skipped if it can't be read.
+func readXattrs(path string) (map[string]string, error) {
+	var rv map[string]string
+	for _, ns := range xattrNamespaces {
+		size, err := unix.ExtattrListLink(path, ns.id, 0, 0)
+		if err == unix.EOPNOTSUPP {
+			return nil, nil
+		} else if err == unix.EPERM && ns.id == unix.EXTATTR_NAMESPACE_SYSTEM {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			continue
+		}
+		list := make([]byte, size)
+		if size, err = unix.ExtattrListLink(path, ns.id, uintptr(unsafe.Pointer(&list[0])), size); err != nil {
+			return nil, err
+		}
+		// List is of names prefixed by their length byte
+		for list = list[:size]; len(list) > 0 && int(list[0]) < len(list); {
+			name := string(list[1 : 1+int(list[0])])
+			list = list[1+int(list[0]):]
+			vsize, err := unix.ExtattrGetLink(path, ns.id, name, 0, 0)
+			if err != nil {
+				return nil, err
+			}
+			value := make([]byte, vsize)
+			if vsize > 0 {
+				if vsize, err = unix.ExtattrGetLink(path, ns.id, name, uintptr(unsafe.Pointer(&value[0])), vsize); err != nil {
+					return nil, err
+				}
+			}
+			if rv == nil {
+				rv = make(map[string]string)
+			}
+			rv[ns.name+"."+name] = string(value[:vsize])
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,8 @@
+// +build !freebsd
+
+package jetpack
+
+// Extended attributes are exported only on FreeBSD.
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
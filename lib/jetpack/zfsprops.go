@@ -0,0 +1,218 @@
+package jetpack
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/juju/errors"
+
+	"github.com/3ofcoins/jetpack/lib/zfs"
+)
+
+// New datasets of pods, images, and empty and managed volumes are
+// created with the pods.zfs.PROPERTY, images.zfs.PROPERTY and
+// volumes.zfs.PROPERTY host properties, which are also set on the
+// pods, images and volumes datasets, so that changing them affects new
+// datasets even if the parent is left as it was. Pod's
+// jetpack/zfs-properties annotation, and volume's
+// jetpack/volume/NAME/zfs-properties one, are whitespace-separated
+// PROPERTY=VALUE lists (e.g. "compression=lz4 sync=disabled") that
+// override host's properties for one pod or volume; the
+// jetpack/volume/NAME/PROPERTY annotations, and pod's storage limit
+// and reservation, override both. Jetpack sets mountpoints itself, so
+// they can't be configured.
+//
+// Only property names and the lists' syntax are checked up front; zfs checks names and
+// values when it creates the dataset, and its complaint is reported
+// with where the properties came from. Properties are set only when a
+// dataset is created, so Pod.ZFSProperties shows effective properties
+// of the pod's dataset next to the configured ones, to make drift
+// (changed configuration, or `zfs set` by hand) visible.
+
+const zfsPropertiesAnnotation = "jetpack/zfs-properties"
+
+// Properties that Pod.ZFSProperties shows even if they aren't
+// configured
+var shownZFSProperties = []string{"atime", "compression", "recordsize", "sync"}
+
+var zfsPropertyRegexp = regexp.MustCompile(`^[a-z][a-z0-9_.:-]*$`)
+
+// Parses a whitespace-separated PROPERTY=VALUE list.
+func parseZFSProperties(str string) (map[string]string, error) {
+	props := make(map[string]string)
+	for _, field := range strings.Fields(str) {
+		eq := strings.Index(field, "=")
+		if eq < 0 {
+			return nil, errors.Errorf("Expected PROPERTY=VALUE, got %#v", field)
+		}
+		name, value := field[:eq], field[eq+1:]
+		if !zfsPropertyRegexp.MatchString(name) {
+			return nil, errors.Errorf("Invalid ZFS property name %#v", name)
+		}
+		if name == "mountpoint" {
+			return nil, errors.New("Mountpoint is set by jetpack")
+		}
+		if value == "" {
+			return nil, errors.Errorf("ZFS property %v has no value", name)
+		}
+		props[name] = value
+	}
+	return props, nil
+}
+
+// Checks PROPERTY of a pods.zfs.PROPERTY, images.zfs.PROPERTY or
+// volumes.zfs.PROPERTY host property. An empty value unsets the default.
+func validateZFSPropertyName(name, value string) error {
+	prop := name[strings.Index(name, ".zfs.")+len(".zfs."):]
+	if !zfsPropertyRegexp.MatchString(prop) {
+		return errors.Errorf("%v: Invalid ZFS property name %#v", name, prop)
+	}
+	if prop == "mountpoint" {
+		return errors.Errorf("%v: Mountpoint is set by jetpack", name)
+	}
+	return nil
+}
+
+// Returns properties of the host properties with prefix, overridden by
+// ones of pm's annotation, if pm has it.
+func zfsPropertySet(prefix string, pm *schema.PodManifest, annotation string) (map[string]string, error) {
+	props := datasetProperties(prefix, nil)
+	if pm == nil {
+		return props, nil
+	}
+	if str, ok := pm.Annotations.Get(annotation); ok {
+		aprops, err := parseZFSProperties(str)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%v annotation", annotation)
+		}
+		for k, v := range aprops {
+			props[k] = v
+		}
+	}
+	return props, nil
+}
+
+// Returns ZFS properties of pod manifest's dataset.
+func podZFSProperties(pm *schema.PodManifest) (map[string]string, error) {
+	props, err := zfsPropertySet("pods.zfs.", pm, zfsPropertiesAnnotation)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	storageProps, err := storageZFSProperties(pm)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for k, v := range storageProps {
+		props[k] = v
+	}
+	return props, nil
+}
+
+// Returns ZFS properties of the dataset of pod's empty volume.
+func (pod *Pod) volumeZFSProps(name types.ACName) (map[string]string, error) {
+	props, err := zfsPropertySet("volumes.zfs.", &pod.Manifest, "jetpack/volume/"+name.String()+"/zfs-properties")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, prop := range volumeZFSProperties {
+		if value, ok := pod.volumeAnnotation(name, prop); ok {
+			props[prop] = value
+		}
+	}
+	return props, nil
+}
+
+// Returns ZFS properties of a new image's dataset mounted at
+// mountpoint.
+func (h *Host) imageZFSProperties(mountpoint string) map[string]string {
+	props := map[string]string{"mountpoint": mountpoint}
+	for k, v := range h.settings().Images.ZFS {
+		props[k] = v
+	}
+	return props
+}
+
+// Creates dataset name with props, which come from source; zfs's
+// complaints about the properties say so.
+func createWithProperties(z zfs.Interface, name string, props map[string]string, source string) (*zfs.Dataset, error) {
+	ds, err := z.CreateDataset(name, props)
+	if zfs.KindOf(err) == zfs.ErrorBadProperty {
+		return nil, errors.Annotatef(err, "Invalid ZFS properties of %v (check %v)", name, source)
+	}
+	return ds, errors.Trace(err)
+}
+
+// Clones snapshot as target with props, as createWithProperties.
+func cloneWithProperties(z zfs.Interface, snapshot, target string, props map[string]string, source string) (*zfs.Dataset, error) {
+	ds, err := z.Clone(snapshot, target, props)
+	if zfs.KindOf(err) == zfs.ErrorBadProperty {
+		return nil, errors.Annotatef(err, "Invalid ZFS properties of %v (check %v)", target, source)
+	}
+	return ds, errors.Trace(err)
+}
+
+// Effective ZFS property of a pod's dataset
+type ZFSProperty struct {
+	Name       string
+	Value      string
+	Source     string // as zfs says: "local", "default", "inherited from DATASET", ...
+	Configured string // value the pod's dataset would be created with; "" if none
+}
+
+// Returns true if the property doesn't have its configured value.
+func (zp *ZFSProperty) Drifted() bool {
+	if zp.Configured == "" || zp.Value == zp.Configured {
+		return false
+	}
+	// zfs reports numbers in bytes
+	value, err1 := parseLogSize(zp.Value)
+	configured, err2 := parseLogSize(zp.Configured)
+	return err1 != nil || err2 != nil || value != configured
+}
+
+func (zp *ZFSProperty) String() string {
+	str := fmt.Sprintf("%v=%v (%v)", zp.Name, zp.Value, zp.Source)
+	if zp.Drifted() {
+		str += fmt.Sprintf(", configured %v", zp.Configured)
+	}
+	return str
+}
+
+// Returns effective ZFS properties of pod's dataset: ones that are
+// configured for the pod, and the shownZFSProperties, by name; nil if
+// the pod has no dataset.
+func (pod *Pod) ZFSProperties() ([]*ZFSProperty, error) {
+	ds := pod.getDataset()
+	if ds == nil {
+		return nil, nil
+	}
+	configured, err := podZFSProperties(&pod.Manifest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var names []string
+	for _, name := range shownZFSProperties {
+		if _, ok := configured[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	props, err := pod.Host.datasets().GetProperties(ds.Name, names...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rv := make([]*ZFSProperty, 0, len(names))
+	for _, name := range names {
+		if prop := props[name]; prop != nil {
+			rv = append(rv, &ZFSProperty{Name: name, Value: prop.Value, Source: prop.Source, Configured: configured[name]})
+		}
+	}
+	return rv, nil
+}
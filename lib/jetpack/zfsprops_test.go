@@ -0,0 +1,118 @@
+package jetpack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestParseZFSProperties(t *testing.T) {
+	if props, err := parseZFSProperties(" compression=lz4\tcom.example:tag=a=b \n"); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]string{"compression": "lz4", "com.example:tag": "a=b"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+	for _, str := range []string{"compression", "Compression=lz4", "atime=", "mountpoint=/srv"} {
+		if _, err := parseZFSProperties(str); err == nil {
+			t.Errorf("%#v passed validation", str)
+		}
+	}
+}
+
+func TestZFSPropertySets(t *testing.T) {
+	Config().Set("pods.zfs.compress", "lz4")
+	Config().Set("pods.zfs.sync", "disabled")
+	Config().Set("pods.zfs.quota", "1G")
+	Config().Set("volumes.zfs.compress", "lz4")
+	Config().Set("volumes.zfs.recordsize", "8k")
+	defer Config().Set("pods.zfs.compress", "")
+	defer Config().Set("pods.zfs.sync", "")
+	defer Config().Set("pods.zfs.quota", "")
+	defer Config().Set("volumes.zfs.compress", "")
+	defer Config().Set("volumes.zfs.recordsize", "")
+
+	pm := schema.BlankPodManifest()
+	pm.Annotations.Set(zfsPropertiesAnnotation, "sync=standard atime=off")
+	pm.Annotations.Set("jetpack/storage/limit", "2G")
+	if props, err := podZFSProperties(pm); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]string{"compression": "lz4", "sync": "standard", "atime": "off", "quota": "2147483648"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+	pm.Annotations.Set(zfsPropertiesAnnotation, "sync")
+	if _, err := podZFSProperties(pm); err == nil || !strings.Contains(err.Error(), zfsPropertiesAnnotation) {
+		t.Errorf("Expected annotation's error, got %v", err)
+	}
+
+	pod := newPod(nil, nil)
+	name := *types.MustACName("db")
+	pod.Manifest.Annotations.Set("jetpack/volume/db/zfs-properties", "recordsize=16k logbias=throughput")
+	pod.Manifest.Annotations.Set("jetpack/volume/db/quota", "10G")
+	if props, err := pod.volumeZFSProps(name); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]string{"compression": "lz4", "recordsize": "16k", "logbias": "throughput", "quota": "10G"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+
+	if props, expected := (&Host{}).imageZFSProperties("/srv/rootfs"), map[string]string{"atime": "off", "compression": "lz4", "mountpoint": "/srv/rootfs"}; !reflect.DeepEqual(props, expected) {
+		t.Errorf("Expected %v, got %v", expected, props)
+	}
+
+	for name, ok := range map[string]bool{"images.zfs.atime": true, "pods.zfs.sync": true, "volumes.zfs.com.example:tag": true, "images.zfs.Atime": false, "volumes.zfs.mountpoint": false} {
+		if err := validateZFSPropertyName(name, "on"); (err == nil) != ok {
+			t.Errorf("%v: unexpected validation result %v", name, err)
+		}
+	}
+}
+
+func TestCreateWithProperties(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+
+	if ds, err := createWithProperties(h.datasets(), "zroot/jetpack/x", map[string]string{"sync": "disabled"}, "pods.zfs.* settings"); err != nil {
+		t.Fatal(err)
+	} else if props, err := f.GetProperties(ds.Name, "sync"); err != nil || props["sync"].Value != "disabled" {
+		t.Errorf("Unexpected properties %v, %v", props, err)
+	}
+	_, err := createWithProperties(h.datasets(), "zroot/jetpack/y", map[string]string{"used": "1"}, "pods.zfs.* settings")
+	if err == nil || !strings.Contains(err.Error(), "check pods.zfs.* settings") {
+		t.Errorf("Expected error naming the setting, got %v", err)
+	}
+}
+
+func TestPodZFSProperties(t *testing.T) {
+	h, f, cleanup := fakeZFSHost(t)
+	defer cleanup()
+	Config().Set("pods.zfs.compression", "lz4")
+	Config().Set("pods.zfs.recordsize", "8k")
+	defer Config().Set("pods.zfs.compression", "")
+	defer Config().Set("pods.zfs.recordsize", "")
+
+	pod := fakeZFSPod(t, h, f)
+	ds := h.Dataset.ChildName("pods/" + pod.UUID.String())
+	for k, v := range map[string]string{"compression": "gzip", "recordsize": "8192"} {
+		if err := f.SetProperty(ds, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	props, err := pod.ZFSProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, prop := range props {
+		strs = append(strs, prop.String())
+	}
+	if expected := []string{
+		"atime=on (default)",
+		"compression=gzip (local), configured lz4",
+		"recordsize=8192 (local)",
+		"sync=- (-)",
+	}; !reflect.DeepEqual(strs, expected) {
+		t.Errorf("Expected %q, got %q", expected, strs)
+	}
+}
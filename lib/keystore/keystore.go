@@ -54,6 +54,12 @@ func (ks *Keystore) StoreTrustedKey(prefix types.ACIdentifier, key *os.File, acc
 		return "", err
 	}
 
+	return ks.StoreKey(prefix, pubkeyBytes)
+}
+
+// Stores armored public key as trusted for prefix, without review;
+// returns path of the stored key.
+func (ks *Keystore) StoreKey(prefix types.ACIdentifier, pubkeyBytes []byte) (string, error) {
 	dir := ks.prefixPath(prefix)
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return "", err
@@ -63,6 +69,9 @@ func (ks *Keystore) StoreTrustedKey(prefix types.ACIdentifier, key *os.File, acc
 	if err != nil {
 		return "", err
 	}
+	if len(entityList) < 1 {
+		return "", errors.New("missing opengpg entity")
+	}
 
 	// FIXME: cargo cult from rkt
 	// FIXME: can we import more than one key here, and note only one?
@@ -103,7 +112,7 @@ func (ks *Keystore) walk(name types.ACIdentifier, fn func(prefix types.ACIdentif
 		}
 
 		if fi.IsDir() {
-			if namePath == "" || strings.HasPrefix(namePath, path) || fi.Name() == "@" {
+			if namePath == "" || path == ks.Path || fi.Name() == "@" || prefixMatches(fi.Name(), name) {
 				return nil
 			} else {
 				return filepath.SkipDir
@@ -118,6 +127,13 @@ func (ks *Keystore) walk(name types.ACIdentifier, fn func(prefix types.ACIdentif
 	})
 }
 
+// Returns true if name is within the prefix that an escaped directory
+// name stands for: it's the prefix itself, or one of its sub-names.
+func prefixMatches(dirname string, name types.ACIdentifier) bool {
+	prefix := strings.Replace(dirname, ",", "/", -1)
+	return string(name) == prefix || strings.HasPrefix(string(name), prefix+"/")
+}
+
 func walkLoaderFn(kr *Keyring) func(types.ACIdentifier, string) error {
 	return func(_ types.ACIdentifier, path string) error {
 		return kr.loadFile(path)
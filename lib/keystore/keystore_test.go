@@ -112,7 +112,7 @@ func TestGetKeyring(t *testing.T) {
 		types.ACIdentifier("example.com/foo/baz"):     1,
 		types.ACIdentifier("example.com/foo/bar"):     2,
 		types.ACIdentifier("example.com/foo/bar/baz"): 2,
-		types.ACIdentifier("example.com/foobar"):      1,
+		types.ACIdentifier("example.com/foobar"):      0,
 		types.ACIdentifier("example.com/baz"):         0,
 	})
 
@@ -129,7 +129,7 @@ func TestGetKeyring(t *testing.T) {
 		types.ACIdentifier("example.com/foo/baz"):     2,
 		types.ACIdentifier("example.com/foo/bar"):     3,
 		types.ACIdentifier("example.com/foo/bar/baz"): 3,
-		types.ACIdentifier("example.com/foobar"):      2,
+		types.ACIdentifier("example.com/foobar"):      1,
 		types.ACIdentifier("example.com/baz"):         1,
 	})
 }
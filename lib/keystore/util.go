@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"unicode"
 
@@ -30,6 +31,28 @@ func fingerToString(fpr [20]byte) string {
 	return str
 }
 
+// Returns fingerprint of the entity's primary key.
+func KeyFingerprint(ety *openpgp.Entity) string {
+	return fingerToString(ety.PrimaryKey.Fingerprint)
+}
+
+// Returns the entity's primary identity, or any identity if none is
+// marked as primary.
+func KeyIdentity(ety *openpgp.Entity) string {
+	var names []string
+	for name, id := range ety.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
 func KeyDescription(ety *openpgp.Entity) string {
 	rv := make([]string, 2+len(ety.Subkeys)+len(ety.Identities))
 	rv[0] = fmt.Sprintf("GPG key fingerprint: %s", fingerToString(ety.PrimaryKey.Fingerprint))
@@ -10,8 +10,9 @@ import (
 )
 
 type GroupEntry struct {
-	Name string
-	Gid  int
+	Name    string
+	Gid     int
+	Members []string
 }
 
 type GroupFile []GroupEntry
@@ -34,10 +35,14 @@ func ReadGroup(path string) (GroupFile, error) {
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
-			rv = append(rv, GroupEntry{
+			entry := GroupEntry{
 				Name: fields[0],
 				Gid:  gid,
-			})
+			}
+			if len(fields) > 3 && fields[3] != "" {
+				entry.Members = strings.Split(fields[3], ",")
+			}
+			rv = append(rv, entry)
 		}
 		return rv, nil
 	}
@@ -55,9 +60,27 @@ func (gf GroupFile) FindByName(name string) *GroupEntry {
 func (gf GroupFile) FindGid(spec string) int {
 	if grent := gf.FindByName(spec); grent != nil {
 		return grent.Gid
-	} else if gid, err := strconv.Atoi(spec); err != nil {
+	} else if gid, err := strconv.Atoi(spec); err != nil || gid < 0 {
 		return -1
 	} else {
 		return gid
 	}
 }
+
+// Returns gids of groups that list username as a member, as
+// initgroups(3) would.
+func (gf GroupFile) MemberGids(username string) []int {
+	var gids []int
+	if username == "" {
+		return nil
+	}
+	for _, entry := range gf {
+		for _, member := range entry.Members {
+			if member == username {
+				gids = append(gids, entry.Gid)
+				break
+			}
+		}
+	}
+	return gids
+}
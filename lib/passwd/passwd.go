@@ -12,12 +12,23 @@ import (
 type PasswdEntry struct {
 	Username    string
 	Uid, Gid    int
+	Class       string // only in master.passwd
 	Home, Shell string
 }
 
 type PasswdFile []PasswdEntry
 
 func ReadPasswd(path string) (PasswdFile, error) {
+	return readPasswd(path, false)
+}
+
+// Reads master.passwd(5) format file, which has additional fields
+// (including login class) that are not present in passwd(5).
+func ReadMasterPasswd(path string) (PasswdFile, error) {
+	return readPasswd(path, true)
+}
+
+func readPasswd(path string, master bool) (PasswdFile, error) {
 	if content, err := ioutil.ReadFile(path); os.IsNotExist(err) {
 		// No passwd file is same as empty passwd file
 		return PasswdFile{}, nil
@@ -31,6 +42,9 @@ func ReadPasswd(path string) (PasswdFile, error) {
 				continue
 			}
 			fields := strings.Split(line, ":")
+			if (master && len(fields) < 10) || len(fields) < 7 {
+				return nil, errors.Errorf("Invalid line in %v: %#v", path, line)
+			}
 			uid, err := strconv.Atoi(fields[2])
 			if err != nil {
 				return nil, errors.Trace(err)
@@ -39,13 +53,19 @@ func ReadPasswd(path string) (PasswdFile, error) {
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
-			rv = append(rv, PasswdEntry{
+			entry := PasswdEntry{
 				Username: fields[0],
 				Uid:      uid,
 				Gid:      gid,
 				Home:     fields[5],
 				Shell:    fields[6],
-			})
+			}
+			if master {
+				entry.Class = fields[4]
+				entry.Home = fields[8]
+				entry.Shell = fields[9]
+			}
+			rv = append(rv, entry)
 		}
 		return rv, nil
 	}
@@ -86,7 +106,7 @@ func (pwf PasswdFile) Find(spec string) *PasswdEntry {
 	if pwent := pwf.FindByUsername(spec); pwent != nil {
 		return pwent
 	}
-	if uid, err := strconv.Atoi(spec); err == nil {
+	if uid, err := strconv.Atoi(spec); err == nil && uid >= 0 {
 		if pwent := pwf.FindByUid(uid); pwent != nil {
 			return pwent
 		} else if uid == 0 {
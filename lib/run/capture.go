@@ -0,0 +1,149 @@
+package run
+
+import "bytes"
+import "io"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+// Commands' output is captured for CmdError: the last MaxStderr bytes
+// of stderr, and the last MaxStdout bytes of stdout. A stream that is
+// discarded (nil) or written to something other than an *os.File is
+// captured as it's written. Files (terminals, inherited descriptors,
+// pipes) are passed to the command directly and not captured, unless
+// Stream or StreamStderr is used; Quiet discards stderr and still
+// captures it.
+
+// How much of stderr is kept for CmdError
+var MaxStderr = 16 << 10
+
+// How much of stdout's tail is kept for CmdError
+var MaxStdout = 4 << 10
+
+// How long Wait waits for captured output after the command has
+// exited; a daemon started by the command may keep it open. Uses
+// exec.Cmd.WaitDelay, so lib/run needs Go 1.20 or newer.
+var CaptureWaitDelay = 5 * time.Second
+
+// Keeps the last max bytes written to it.
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+	mx        sync.Mutex
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	n := len(p)
+	if len(p) >= tb.max {
+		tb.truncated = tb.truncated || len(tb.buf) > 0 || len(p) > tb.max
+		tb.buf = append(tb.buf[:0], p[len(p)-tb.max:]...)
+		return n, nil
+	}
+	if over := len(tb.buf) + len(p) - tb.max; over > 0 {
+		tb.truncated = true
+		tb.buf = append(tb.buf[:0], tb.buf[over:]...)
+	}
+	tb.buf = append(tb.buf, p...)
+	return n, nil
+}
+
+// Returns captured text, without surrounding whitespace, marked with
+// "..." if its beginning has been dropped.
+func (tb *tailBuffer) String() string {
+	if tb == nil {
+		return ""
+	}
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	str := strings.TrimSpace(string(bytes.ToValidUTF8(tb.buf, nil)))
+	if tb.truncated && str != "" {
+		str = "..." + str
+	}
+	return str
+}
+
+// Makes command's current stdout and stderr captured too, even if
+// they're files, so that the output is shown live and its tail is
+// still included in errors. Not for interactive commands, which need
+// their terminal.
+func (c *Cmd) Stream() *Cmd {
+	c.streamStdout, c.streamStderr = true, true
+	return c
+}
+
+// Makes command's current stderr captured too, like Stream, leaving
+// stdout alone.
+func (c *Cmd) StreamStderr() *Cmd {
+	c.streamStderr = true
+	return c
+}
+
+// Discards command's stderr, which is still captured for errors.
+func (c *Cmd) Quiet() *Cmd {
+	c.Cmd.Stderr = nil
+	return c
+}
+
+// Returns captured stderr of a finished command.
+func (c *Cmd) CapturedStderr() string {
+	return c.stderrTail.String()
+}
+
+// Returns captured tail of stdout of a finished command.
+func (c *Cmd) CapturedStdout() string {
+	return c.stdoutTail.String()
+}
+
+// Sets up capture of command's output before it's started.
+func (c *Cmd) capture() {
+	c.stdoutTail = newTailBuffer(MaxStdout)
+	c.stderrTail = newTailBuffer(MaxStderr)
+	stdout, stderr := c.Cmd.Stdout, c.Cmd.Stderr
+	if _, isFile := stdout.(*os.File); stdout != nil && !isFile && sameWriter(stdout, stderr) {
+		// os/exec copies each stream in its own goroutine
+		shared := &lockedWriter{w: stdout}
+		stdout, stderr = shared, shared
+	}
+	c.Cmd.Stdout = tee(stdout, c.stdoutTail, c.streamStdout)
+	c.Cmd.Stderr = tee(stderr, c.stderrTail, c.streamStderr)
+	if c.Cmd.WaitDelay == 0 {
+		c.Cmd.WaitDelay = CaptureWaitDelay
+	}
+}
+
+func tee(w io.Writer, tail *tailBuffer, force bool) io.Writer {
+	if w == nil {
+		return tail
+	}
+	if _, isFile := w.(*os.File); isFile && !force {
+		return w
+	}
+	return io.MultiWriter(w, tail)
+}
+
+// Returns true if a and b are the same writer. Writers of types that
+// can't be compared aren't.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() { recover() }()
+	return a == b
+}
+
+// Serializes writes to a writer that both stdout and stderr go to.
+type lockedWriter struct {
+	w  io.Writer
+	mx sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mx.Lock()
+	defer lw.mx.Unlock()
+	return lw.w.Write(p)
+}
@@ -1,74 +1,283 @@
 package run
 
+import "bytes"
+import "context"
 import "fmt"
 import "io"
 import "os"
 import "os/exec"
 import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+import "github.com/juju/errors"
 
 import "github.com/3ofcoins/jetpack/lib/ui"
 
+// Receives trace lines of commands that are run (see Tracing). By
+// default, they're printed to stderr in debug mode.
+var Trace = func(format string, args ...interface{}) {
+	if ui.Debug {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// A command that has a timeout or a context runs in its own process
+// group. When the timeout passes or the context is done, the group
+// gets SIGTERM, and SIGKILL after KillGrace, and the command fails
+// with TimeoutError.
+
+// How long a timed out command has to exit after SIGTERM, unless the
+// command sets its own with WithKillGrace
+var KillGrace = 5 * time.Second
+
 type Cmd struct {
 	Cmd exec.Cmd
+
+	ctx       context.Context // caller's, see WithContext
+	timeout   time.Duration
+	killGrace time.Duration
+	cancel    context.CancelFunc
+	done      chan struct{} // closed when the command is waited for
+	watched   chan struct{} // closed when watch has returned
+	mx        sync.Mutex
+	expired   error // ctx.Err(), if the command was killed for it
+
+	streamStdout, streamStderr bool
+	stdoutTail, stderrTail     *tailBuffer
+
+	secretEnv  bool
+	invocation *Invocation
 }
 
 func (c *Cmd) commandString() string {
-	return ShellEscape(c.Cmd.Args...)
+	return ShellEscape(RedactAll(c.Cmd.Args)...)
 }
 
 func (c *Cmd) String() string {
 	return fmt.Sprintf("run.Command[%s]", c.commandString())
 }
 
+// Returned when a command fails. Its message includes the captured
+// output, so that it survives errors.Trace and errors.Annotate up to
+// the user.
 type CmdError struct {
-	ExecError error
-	Cmd       *Cmd
+	ExecError  error
+	Cmd        *Cmd
+	Args       []string // full argv, with sensitive values redacted
+	ExitStatus int      // -1 if the command didn't exit normally
+	Stderr     string   // captured stderr, see MaxStderr
+	Stdout     string   // captured tail of stdout, see MaxStdout
 }
 
 func (err *CmdError) Error() string {
-	return fmt.Sprintf("%v: %v", err.Cmd, err.ExecError)
+	msg := fmt.Sprintf("%v: %v", err.Cmd, err.ExecError)
+	if err.Stderr != "" {
+		return msg + ": " + err.Stderr
+	}
+	if err.Stdout != "" {
+		return msg + ": " + err.Stdout
+	}
+	return msg
+}
+
+// Returned when a command is killed because its timeout has passed,
+// or its context is done.
+type TimeoutError struct {
+	Cmd    *Cmd
+	Err    error  // context's error
+	Stderr string // captured stderr, see MaxStderr
+}
+
+func (err *TimeoutError) Error() string {
+	msg := fmt.Sprintf("%v: %v", err.Cmd, err.Err)
+	if err.Err == context.DeadlineExceeded && err.Cmd.timeout > 0 {
+		msg = fmt.Sprintf("%v: timed out after %v", err.Cmd, err.Cmd.timeout)
+	}
+	if err.Stderr != "" {
+		msg += ": " + err.Stderr
+	}
+	return msg
+}
+
+// Returns true if err is caused by TimeoutError.
+func IsTimeout(err error) bool {
+	_, ok := errors.Cause(err).(*TimeoutError)
+	return ok
+}
+
+// Returns true if err is caused by TimeoutError of a command whose
+// context has been cancelled.
+func IsCanceled(err error) bool {
+	terr, ok := errors.Cause(err).(*TimeoutError)
+	return ok && terr.Err == context.Canceled
 }
 
 func Command(command string, args ...string) *Cmd {
-	c := &Cmd{*exec.Command(command, args...)}
+	c := &Cmd{Cmd: *exec.Command(command, args...)}
 	c.Cmd.Stdin = os.Stdin
 	c.Cmd.Stdout = os.Stdout
 	c.Cmd.Stderr = os.Stderr
 	return c
 }
 
+// Sets time that command can take, counted from its start; 0 is no
+// limit.
+func (c *Cmd) WithTimeout(timeout time.Duration) *Cmd {
+	c.timeout = timeout
+	return c
+}
+
+// Sets context of the command: it is killed when ctx is done. A
+// timeout set with WithTimeout is counted within ctx's deadline.
+func (c *Cmd) WithContext(ctx context.Context) *Cmd {
+	c.ctx = ctx
+	return c
+}
+
+// Sets how long the command has to exit after SIGTERM when its
+// timeout passes or its context is done; KillGrace by default.
+func (c *Cmd) WithKillGrace(grace time.Duration) *Cmd {
+	c.killGrace = grace
+	return c
+}
+
 func (c *Cmd) wrapError(err error) error {
 	if err == nil {
 		return nil
 	}
-	return &CmdError{ExecError: err, Cmd: c}
+	switch err.(type) {
+	case *CmdError, *TimeoutError:
+		return err
+	}
+	cerr := &CmdError{
+		ExecError:  err,
+		Cmd:        c,
+		Args:       RedactAll(c.Cmd.Args),
+		ExitStatus: -1,
+		Stderr:     c.CapturedStderr(),
+		Stdout:     c.CapturedStdout(),
+	}
+	if ps := c.Cmd.ProcessState; ps != nil {
+		cerr.ExitStatus = ps.ExitCode()
+	}
+	return cerr
 }
 
 func (c *Cmd) Run() error {
-	if ui.Debug {
-		fmt.Fprintf(os.Stderr, "+ %v\n", c.commandString())
+	return c.wrapError(c.run())
+}
+
+func (c *Cmd) run() error {
+	if err := c.start(); err != nil {
+		return err
 	}
-	return c.wrapError(c.Cmd.Run())
+	return c.wait()
 }
 
 func (c *Cmd) Start() error {
-	if ui.Debug {
-		defer func() {
-			pid := -1
-			if p := c.Cmd.Process; p != nil {
-				pid = p.Pid
-			}
-			fmt.Fprintf(os.Stderr, "+ %v & [%v]\n", c.commandString(), pid)
-		}()
+	err := c.start()
+	if err == nil && c.invocation != nil {
+		Trace("& [%v] %v", c.Cmd.Process.Pid, c.commandString())
+	}
+	return c.wrapError(err)
+}
+
+func (c *Cmd) start() error {
+	c.traceStart()
+	if err := c.startCmd(); err != nil {
+		c.traceFinish(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Cmd) startCmd() error {
+	c.capture()
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	switch {
+	case c.timeout > 0:
+		ctx, c.cancel = context.WithTimeout(ctx, c.timeout)
+	case ctx.Done() != nil:
+		ctx, c.cancel = context.WithCancel(ctx)
+	default:
+		return c.Cmd.Start()
+	}
+	// Own process group, so that the command's children are killed too
+	if c.Cmd.SysProcAttr == nil {
+		c.Cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !c.Cmd.SysProcAttr.Setsid {
+		c.Cmd.SysProcAttr.Setpgid = true
+	}
+	if err := c.Cmd.Start(); err != nil {
+		c.cancel()
+		return err
+	}
+	if c.killGrace <= 0 {
+		c.killGrace = KillGrace
+	}
+	c.done, c.watched = make(chan struct{}), make(chan struct{})
+	go func(done, watched chan struct{}) {
+		defer close(watched)
+		c.watch(ctx, c.Cmd.Process.Pid, done)
+	}(c.done, c.watched)
+	return nil
+}
+
+// Kills command's process group when its timeout passes or its
+// context is done.
+func (c *Cmd) watch(ctx context.Context, pid int, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	c.mx.Lock()
+	c.expired = ctx.Err()
+	c.mx.Unlock()
+	Trace("! %v: %v, terminating", c.commandString(), ctx.Err())
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(c.killGrace):
+		syscall.Kill(-pid, syscall.SIGKILL)
 	}
-	return c.wrapError(c.Cmd.Start())
 }
 
 func (c *Cmd) Wait() error {
 	if c == nil {
 		return nil
 	}
-	return c.wrapError(c.Cmd.Wait())
+	return c.wrapError(c.wait())
+}
+
+func (c *Cmd) wait() error {
+	err := c.Cmd.Wait()
+	if err == exec.ErrWaitDelay {
+		// Command succeeded, something it started keeps the output open
+		err = nil
+	}
+	if c.done != nil {
+		close(c.done)
+		<-c.watched
+		c.done, c.watched = nil, nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.mx.Lock()
+	expired := c.expired
+	c.mx.Unlock()
+	if expired != nil {
+		err = &TimeoutError{Cmd: c, Err: expired, Stderr: c.CapturedStderr()}
+	}
+	c.traceFinish(err)
+	return err
 }
 
 func (c *Cmd) Kill() error {
@@ -88,25 +297,27 @@ func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
 }
 
 func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
-	c.Cmd.Stdout = nil
+	c.Cmd.Stdout, c.streamStdout = nil, false
 	rc, err := c.Cmd.StdoutPipe()
 	return rc, c.wrapError(err)
 }
 
 func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
-	c.Cmd.Stderr = nil
+	c.Cmd.Stderr, c.streamStderr = nil, false
 	rc, err := c.Cmd.StderrPipe()
 	return rc, c.wrapError(err)
 }
 
 func (c *Cmd) Output() ([]byte, error) {
-	if ui.Debug {
-		fmt.Fprintf(os.Stderr, "+ %v |", c.commandString())
+	var stdout bytes.Buffer
+	c.Cmd.Stdout = &stdout
+	err := c.run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		ee.Stderr = []byte(c.CapturedStderr())
 	}
-	c.Cmd.Stdout = nil
-	out, err := c.Cmd.Output()
-	if ui.Debug {
-		fmt.Fprintf(os.Stderr, " %#v\n", string(out))
+	out := stdout.Bytes()
+	if c.invocation != nil {
+		Trace("| %v: %#v", c.commandString(), string(out))
 	}
 	return out, c.wrapError(err)
 }
@@ -130,12 +341,19 @@ func (c *Cmd) OutputLines() ([]string, error) {
 	}
 }
 
+// Sets command's environment to env. Its values are never traced,
+// whatever the names.
+func (c *Cmd) WithSecretEnv(env []string) *Cmd {
+	c.Cmd.Env, c.secretEnv = env, true
+	return c
+}
+
 func (c *Cmd) ReadFrom(r io.Reader) *Cmd {
 	c.Cmd.Stdin = r
 	return c
 }
 
 func (c *Cmd) WriteTo(w io.Writer) *Cmd {
-	c.Cmd.Stdout = w
+	c.Cmd.Stdout, c.streamStdout = w, false
 	return c
 }
@@ -0,0 +1,202 @@
+package run
+
+import "bytes"
+import "context"
+import "fmt"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/juju/errors"
+
+func TestTimeout(t *testing.T) {
+	started := time.Now()
+	// The shell's child needs to be killed too, or Output waits for it
+	_, err := Command("/bin/sh", "-c", "sleep 10; echo done").WithTimeout(100 * time.Millisecond).Output()
+	if !IsTimeout(err) {
+		t.Fatalf("Expected timeout error, got %#v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Command was killed after %v", elapsed)
+	}
+	if IsTimeout(errors.New("failed")) || IsTimeout(Command("/bin/sh", "-c", "exit 1").Run()) {
+		t.Error("Ordinary failure is a timeout")
+	}
+	if out, err := Command("/bin/echo", "hello").WithTimeout(10 * time.Second).OutputString(); err != nil || out != "hello" {
+		t.Errorf("Unexpected output %#v (%v)", out, err)
+	}
+}
+
+func TestKillGrace(t *testing.T) {
+	started := time.Now()
+	err := Command("/bin/sh", "-c", "trap '' TERM; sleep 10").WithTimeout(100 * time.Millisecond).WithKillGrace(100 * time.Millisecond).Run()
+	if !IsTimeout(err) {
+		t.Fatalf("Expected timeout error, got %#v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Command ignoring SIGTERM was killed after %v", elapsed)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	err := Command("/bin/sh", "-c", "sleep 10; echo done").WithContext(ctx).Run()
+	if !IsCanceled(err) {
+		t.Fatalf("Expected cancellation error, got %#v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Command was killed after %v", elapsed)
+	}
+
+	// Timeout is counted within the context's deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = Command("/bin/sh", "-c", "sleep 10").WithContext(ctx).WithTimeout(time.Minute).Run()
+	if !IsTimeout(err) || IsCanceled(err) {
+		t.Fatalf("Expected timeout error, got %#v", err)
+	}
+
+	if err := Command("/bin/true").WithContext(context.Background()).Run(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCmdErrorOutput(t *testing.T) {
+	err := Command("/bin/sh", "-c", "echo partial; echo 'it broke' >&2; exit 3").Quiet().Run()
+	cerr, ok := err.(*CmdError)
+	if !ok {
+		t.Fatalf("Expected CmdError, got %#v", err)
+	}
+	if cerr.ExitStatus != 3 || cerr.Stderr != "it broke" || cerr.Args[0] != "/bin/sh" || len(cerr.Args) != 3 {
+		t.Errorf("Unexpected error %#v", cerr)
+	}
+	if annotated := errors.Annotate(errors.Trace(err), "Doing stuff").Error(); !strings.HasSuffix(annotated, ": exit status 3: it broke") {
+		t.Errorf("Captured stderr is lost: %v", annotated)
+	}
+	_, err = Command("/bin/sh", "-c", "echo partial; exit 1").Output()
+	if cerr, ok := err.(*CmdError); !ok || cerr.Stdout != "partial" || cerr.Stderr != "" {
+		t.Errorf("Unexpected error %#v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var live bytes.Buffer
+	cmd := Command("/bin/sh", "-c", "echo out; echo err >&2; exit 1")
+	cmd.Cmd.Stdout, cmd.Cmd.Stderr = &live, &live
+	err := cmd.Stream().Run()
+	if cerr, ok := err.(*CmdError); !ok || cerr.Stdout != "out" || cerr.Stderr != "err" {
+		t.Errorf("Unexpected error %#v", err)
+	}
+	if str := live.String(); !strings.Contains(str, "out\n") || !strings.Contains(str, "err\n") {
+		t.Errorf("Output not streamed: %#v", str)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := newTailBuffer(8)
+	tb.Write([]byte("1234"))
+	if tb.String() != "1234" {
+		t.Errorf("Unexpected tail %#v", tb.String())
+	}
+	tb.Write([]byte("56789"))
+	if tb.String() != "...23456789" {
+		t.Errorf("Unexpected tail %#v", tb.String())
+	}
+	tb.Write([]byte("abcdefghijk"))
+	if tb.String() != "...defghijk" {
+		t.Errorf("Unexpected tail %#v", tb.String())
+	}
+}
+
+func TestCaptureWaitDelay(t *testing.T) {
+	saved := CaptureWaitDelay
+	CaptureWaitDelay = 100 * time.Millisecond
+	defer func() { CaptureWaitDelay = saved }()
+	started := time.Now()
+	// Background child keeps the captured stderr open
+	if err := Command("/bin/sh", "-c", "sleep 10 >/dev/null & exit 0").Quiet().Run(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Waited for output for %v", elapsed)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for word, expected := range map[string]string{
+		"FOO=bar":                     "FOO=bar",
+		"DB_PASSWORD=hunter2":         "DB_PASSWORD=[REDACTED]",
+		"api_token=abc":               "api_token=[REDACTED]",
+		"AWS_SECRET_ACCESS_KEY=x":     "AWS_SECRET_ACCESS_KEY=[REDACTED]",
+		"AC_METADATA_URL=http://x/~y": "AC_METADATA_URL=[REDACTED]",
+		"MONKEY=banana":               "MONKEY=banana",
+		"--password":                  "--password",
+		"=TOKEN":                      "=TOKEN",
+	} {
+		if actual := Redact(word); actual != expected {
+			t.Errorf("Redact(%#v): expected %#v, got %#v", word, expected, actual)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	savedTracing, savedTrace := Tracing, Trace
+	defer func() { Tracing, Trace = savedTracing, savedTrace }()
+	var lines []string
+	Trace = func(format string, args ...interface{}) { lines = append(lines, fmt.Sprintf(format, args...)) }
+
+	Tracing = func() bool { return false }
+	cmd := Command("/bin/sh", "-c", "exit 0", "SECRET=hunter2")
+	if err := cmd.Run(); err != nil || cmd.Invocation() != nil || len(lines) != 0 {
+		t.Errorf("Traced with tracing off: %v %v %v", err, cmd.Invocation(), lines)
+	}
+
+	Tracing = func() bool { return true }
+	cmd = Command("/bin/sh", "-c", "exit 2", "SECRET=hunter2")
+	cmd.Cmd.Dir = "/"
+	cmd.Cmd.Env = []string{"PATH=/bin", "API_TOKEN=abc"}
+	err := cmd.Quiet().Run()
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Unexpected error %v", err)
+	} else if cerr, ok := err.(*CmdError); !ok || cerr.Args[3] != "SECRET=[REDACTED]" {
+		t.Errorf("Args of error not redacted: %#v", err)
+	}
+	inv := cmd.Invocation()
+	if inv == nil {
+		t.Fatal("No invocation")
+	}
+	if inv.ExitStatus != 2 || inv.Dir != "/" || inv.Args[3] != "SECRET=[REDACTED]" || inv.Env[1] != "API_TOKEN=[REDACTED]" || inv.Error == "" {
+		t.Errorf("Unexpected invocation %#v", inv)
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], "stderr>capture") || !strings.Contains(lines[1], "exit status 2") {
+		t.Errorf("Unexpected trace %#v", lines)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "hunter2") || strings.Contains(line, "abc") {
+			t.Errorf("Secret in trace: %v", line)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	savedTracing, savedTrace := Tracing, Trace
+	defer func() { Tracing, Trace = savedTracing, savedTrace }()
+	var lines []string
+	Trace = func(format string, args ...interface{}) { lines = append(lines, fmt.Sprintf(format, args...)) }
+	Tracing = func() bool { return true }
+
+	cmd := Command("/bin/sh", "-c", `test -n "$GREETING"`).WithSecretEnv([]string{"GREETING=hunter2"})
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Environment not passed: %v", err)
+	}
+	if inv := cmd.Invocation(); inv == nil || len(inv.Env) != 1 || inv.Env[0] != "GREETING=[REDACTED]" {
+		t.Errorf("Unexpected invocation %#v", inv)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "hunter2") {
+			t.Errorf("Secret in trace: %v", line)
+		}
+	}
+}
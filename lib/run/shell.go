@@ -25,8 +25,9 @@ func ShellEscapeWord(str string) string {
 }
 
 func ShellEscape(strs ...string) string {
+	words := make([]string, len(strs))
 	for i, str := range strs {
-		strs[i] = ShellEscapeWord(str)
+		words[i] = ShellEscapeWord(str)
 	}
-	return strings.Join(strs, " ")
+	return strings.Join(words, " ")
 }
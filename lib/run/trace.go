@@ -0,0 +1,163 @@
+package run
+
+import "fmt"
+import "io"
+import "os"
+import "regexp"
+import "strings"
+import "time"
+
+import "github.com/3ofcoins/jetpack/lib/ui"
+
+// When Tracing returns true, every command is traced before it's
+// executed (argv, working directory, and redirections) and after it
+// has finished (duration and exit status). When it's false, commands
+// aren't inspected at all. Values of sensitive environment variables
+// are redacted both in the trace and in errors (their command strings
+// and Args); a command's whole environment is redacted if it's set
+// with WithSecretEnv.
+
+// Returns true if commands should be traced. By default, in debug mode.
+var Tracing = func() bool { return ui.Debug }
+
+// Values of environment variables whose names match this are redacted,
+// whether they're passed in Env or as NAME=value arguments.
+// AC_METADATA_URL includes the metadata service's token.
+var SensitiveEnv = regexp.MustCompile(`(?i)(PASS|SECRET|TOKEN|CREDENTIAL|AUTH|(^|_)KEY$|^AC_METADATA_URL$)`)
+
+const redacted = "[REDACTED]"
+
+// Returns NAME=value with value replaced if NAME is sensitive; other
+// strings are returned unchanged.
+func Redact(word string) string {
+	if eq := strings.IndexByte(word, '='); eq > 0 && SensitiveEnv.MatchString(word[:eq]) {
+		return word[:eq+1] + redacted
+	}
+	return word
+}
+
+// Returns words with sensitive values redacted.
+func RedactAll(words []string) []string {
+	rv := make([]string, len(words))
+	for i, word := range words {
+		rv[i] = Redact(word)
+	}
+	return rv
+}
+
+// Returns NAME=value words with every value redacted.
+func redactValues(words []string) []string {
+	rv := make([]string, len(words))
+	for i, word := range words {
+		if eq := strings.IndexByte(word, '='); eq > 0 {
+			rv[i] = word[:eq+1] + redacted
+		} else {
+			rv[i] = redacted
+		}
+	}
+	return rv
+}
+
+// A traced command execution.
+type Invocation struct {
+	Args       []string // redacted argv
+	Dir        string   `json:",omitempty"`
+	Env        []string `json:",omitempty"` // redacted, if set explicitly
+	Redirects  []string `json:",omitempty"` // e.g. "stdout>capture"
+	Started    time.Time
+	Duration   time.Duration
+	ExitStatus int    // -1 if the command didn't exit normally
+	Error      string `json:",omitempty"`
+}
+
+func (inv *Invocation) String() string {
+	desc := []string{ShellEscape(inv.Args...)}
+	if inv.Dir != "" {
+		desc = append(desc, "dir="+inv.Dir)
+	}
+	if len(inv.Env) > 0 {
+		desc = append(desc, "env="+ShellEscape(inv.Env...))
+	}
+	desc = append(desc, inv.Redirects...)
+	return strings.Join(desc, " ")
+}
+
+// Returns trace of the command's last execution, or nil if it wasn't
+// traced.
+func (c *Cmd) Invocation() *Invocation {
+	return c.invocation
+}
+
+// Starts tracing the command, before it's executed.
+func (c *Cmd) traceStart() {
+	if !Tracing() {
+		c.invocation = nil
+		return
+	}
+	c.invocation = &Invocation{
+		Args:       RedactAll(c.Cmd.Args),
+		Dir:        c.Cmd.Dir,
+		Redirects:  redirects(c),
+		Started:    time.Now(),
+		ExitStatus: -1,
+	}
+	switch {
+	case c.secretEnv:
+		c.invocation.Env = redactValues(c.Cmd.Env)
+	case c.Cmd.Env != nil:
+		c.invocation.Env = RedactAll(c.Cmd.Env)
+	}
+	Trace("+ %v", c.invocation)
+}
+
+// Finishes tracing the command, after it's been waited for or it
+// failed to start.
+func (c *Cmd) traceFinish(err error) {
+	inv := c.invocation
+	if inv == nil {
+		return
+	}
+	inv.Duration = time.Since(inv.Started)
+	if ps := c.Cmd.ProcessState; ps != nil {
+		inv.ExitStatus = ps.ExitCode()
+	}
+	if err != nil {
+		inv.Error = err.Error()
+		Trace("! %v: %v after %v", ShellEscape(inv.Args...), err, inv.Duration)
+	} else {
+		Trace("= %v: exit status %d after %v", ShellEscape(inv.Args...), inv.ExitStatus, inv.Duration)
+	}
+}
+
+// Describes where command's stdin, stdout, and stderr go, unless it's
+// the caller's own stdio.
+func redirects(c *Cmd) []string {
+	var rv []string
+	for _, s := range []struct {
+		name, dir string
+		std       *os.File
+		stream    interface{}
+	}{
+		{"stdin", "<", os.Stdin, c.Cmd.Stdin},
+		{"stdout", ">", os.Stdout, c.Cmd.Stdout},
+		{"stderr", ">", os.Stderr, c.Cmd.Stderr},
+	} {
+		if s.stream == s.std {
+			continue
+		}
+		var target string
+		switch f := s.stream.(type) {
+		case nil:
+			target = "/dev/null"
+			if s.name != "stdin" {
+				target = "capture"
+			}
+		case *os.File:
+			target = f.Name()
+		case io.Reader, io.Writer:
+			target = fmt.Sprintf("%T", f)
+		}
+		rv = append(rv, s.name+s.dir+target)
+	}
+	return rv
+}
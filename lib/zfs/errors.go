@@ -0,0 +1,73 @@
+package zfs
+
+import "strings"
+
+import "github.com/juju/errors"
+
+import "github.com/3ofcoins/jetpack/lib/run"
+
+// Failures of zfs commands that callers may want to handle are
+// classified by the command's stderr, and returned as *Error of the
+// matching kind. Other failures are returned unchanged.
+
+type ErrorKind string
+
+const (
+	ErrorOther        ErrorKind = ""
+	ErrorExists       ErrorKind = "exists"        // dataset or snapshot already exists
+	ErrorNoDataset    ErrorKind = "no-dataset"    // dataset or snapshot does not exist
+	ErrorHasClones    ErrorKind = "has-clones"    // snapshot has dependent clones
+	ErrorHasSnapshots ErrorKind = "has-snapshots" // rollback target has more recent snapshots
+	ErrorBusy         ErrorKind = "busy"          // dataset is in use
+	ErrorBadProperty  ErrorKind = "bad-property"  // property name or value rejected
+)
+
+// Substrings of zfs(8) messages, checked in order
+var errorMessages = []struct {
+	substr string
+	kind   ErrorKind
+}{
+	{"dependent clones", ErrorHasClones},
+	{"more recent snapshots", ErrorHasSnapshots},
+	{"already exists", ErrorExists},
+	{"does not exist", ErrorNoDataset},
+	{"busy", ErrorBusy},
+	{"invalid property", ErrorBadProperty},
+	{"bad property value", ErrorBadProperty},
+	{"bad numeric value", ErrorBadProperty},
+	{"must be power of 2", ErrorBadProperty},
+	{"must be one of", ErrorBadProperty},
+	{"is readonly", ErrorBadProperty},
+}
+
+// A classified failure of a zfs command.
+type Error struct {
+	Kind ErrorKind
+	Err  error // *run.CmdError
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+// Returns kind of a zfs command's failure, ErrorOther if it's not
+// classified.
+func KindOf(err error) ErrorKind {
+	if zerr, ok := errors.Cause(err).(*Error); ok {
+		return zerr.Kind
+	}
+	return ErrorOther
+}
+
+func classify(err error) error {
+	cerr, ok := err.(*run.CmdError)
+	if !ok {
+		return err
+	}
+	for _, msg := range errorMessages {
+		if strings.Contains(cerr.Stderr, msg.substr) {
+			return &Error{Kind: msg.kind, Err: err}
+		}
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package zfs
+
+// Code that only needs to manage datasets by name can take an
+// Interface instead of calling zfs(8) itself. Native is the real
+// thing; zfstest.Fake keeps datasets in memory, so that the code can be
+// tested without root and a pool. Errors are the same: ErrNotFound from
+// GetDataset, and *Error of the matching kind from the other methods.
+
+// Operations on datasets by their full names
+type Interface interface {
+	// Returns ErrNotFound if there's no such dataset.
+	GetDataset(name string) (*Dataset, error)
+	CreateDataset(name string, props map[string]string) (*Dataset, error)
+	Destroy(name string, recursive bool) error
+	// Renames a dataset, or a snapshot (both names are full).
+	Rename(name, newName string) error
+
+	Snapshot(name, snapshot string, opts *SnapshotOptions) error
+	Snapshots(name string) ([]*SnapshotInfo, error)
+	// Clones a snapshot, given by full name, as target.
+	Clone(snapshot, target string, props map[string]string) (*Dataset, error)
+	Rollback(name, snapshot string, force bool) error
+	Promote(name string) error
+
+	GetProperties(name string, props ...string) (map[string]*Property, error)
+	SetProperty(name, prop, value string) error
+
+	// Lists descendant datasets, as Dataset.Children.
+	Children(name string, depth int, props ...string) ([]*Dataset, error)
+}
+
+// Interface that runs zfs(8)
+var Native Interface = native{}
+
+type native struct{}
+
+func (native) GetDataset(name string) (*Dataset, error) {
+	return GetDataset(name)
+}
+
+func (native) CreateDataset(name string, props map[string]string) (*Dataset, error) {
+	return CreateDataset(name, propertyArgs(props)...)
+}
+
+func (native) Destroy(name string, recursive bool) error {
+	ds := &Dataset{Name: name}
+	if recursive {
+		return ds.Destroy("-r")
+	}
+	return ds.Destroy()
+}
+
+func (native) Rename(name, newName string) error {
+	return Zfs("rename", name, newName)
+}
+
+func (native) Snapshot(name, snapshot string, opts *SnapshotOptions) error {
+	_, err := (&Dataset{Name: name}).Snapshot(snapshot, opts)
+	return err
+}
+
+func (native) Snapshots(name string) ([]*SnapshotInfo, error) {
+	return (&Dataset{Name: name}).Snapshots()
+}
+
+func (native) Clone(snapshot, target string, props map[string]string) (*Dataset, error) {
+	return (&Dataset{Name: snapshot, Type: "snapshot"}).Clone("", target, props)
+}
+
+func (native) Rollback(name, snapshot string, force bool) error {
+	return (&Dataset{Name: name}).Rollback(snapshot, force)
+}
+
+func (native) Promote(name string) error {
+	return Zfs("promote", name)
+}
+
+func (native) GetProperties(name string, props ...string) (map[string]*Property, error) {
+	return (&Dataset{Name: name}).GetProperties(props...)
+}
+
+func (native) SetProperty(name, prop, value string) error {
+	return Zfs("set", prop+"="+value, name)
+}
+
+func (native) Children(name string, depth int, props ...string) ([]*Dataset, error) {
+	return (&Dataset{Name: name}).Children(depth, props...)
+}
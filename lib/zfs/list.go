@@ -0,0 +1,74 @@
+package zfs
+
+import "fmt"
+import "strings"
+
+// Datasets are listed with a single `zfs list -Hp`, which returns
+// requested properties of all of them as tab-separated fields, so
+// names and values with spaces are safe. Unset values ("-") are left
+// out of Dataset.Properties. GetDataset uses the same parser for a
+// single dataset. Legacy datasets' mountpoints are filled in
+// afterwards (see mountpoint.go).
+
+// Properties that fill Dataset's own fields
+var datasetProperties = []string{"name", "type", "mounted", "mountpoint", "origin"}
+
+// Returns `zfs list` arguments to list datasetProperties and extra
+// properties.
+func listArgs(properties []string) []string {
+	return []string{"-p", "-o", strings.Join(append(append([]string(nil), datasetProperties...), properties...), ",")}
+}
+
+// Parses `zfs list -Hp` output of listArgs(properties).
+func parseDatasets(rows [][]string, properties []string) ([]*Dataset, error) {
+	dss := make([]*Dataset, len(rows))
+	for i, row := range rows {
+		if len(row) != len(datasetProperties)+len(properties) {
+			return nil, fmt.Errorf("Unexpected zfs list output: %q", row)
+		}
+		ds := &Dataset{
+			Name:    row[0],
+			Type:    row[1],
+			Mounted: row[2] == "yes",
+		}
+		switch row[3] {
+		case "none", "-":
+		case "legacy":
+			ds.Legacy = true
+		default:
+			ds.Mountpoint = row[3]
+		}
+		if row[4] != "-" {
+			ds.Origin = row[4]
+		}
+		if len(properties) > 0 {
+			ds.Properties = make(map[string]string, len(properties))
+			for j, prop := range properties {
+				if v := row[len(datasetProperties)+j]; v != "-" {
+					ds.Properties[prop] = v
+				}
+			}
+		}
+		dss[i] = ds
+	}
+	return dss, nil
+}
+
+// Returns datasets of all pools of type typ ("filesystem", "snapshot",
+// "all", ...; filesystems and volumes if empty), with extra
+// properties.
+func List(typ string, properties ...string) ([]*Dataset, error) {
+	args := listArgs(properties)
+	if typ != "" {
+		args = append(args, "-t", typ)
+	}
+	rows, err := ZfsFields("list", args...)
+	if err != nil {
+		return nil, err
+	}
+	dss, err := parseDatasets(rows, properties)
+	if err != nil {
+		return nil, err
+	}
+	return dss, resolveLegacy(dss)
+}
@@ -0,0 +1,151 @@
+package zfs
+
+import "fmt"
+import "path/filepath"
+import "strings"
+import "sync"
+
+// A dataset's Mountpoint is where the system sees it: zfs(8) reports
+// mountpoints of a pool imported with an altroot with the altroot
+// prefixed, but the mountpoint property is set without it. Set,
+// SetMany, CreateDataset and Clone take mountpoints as the system sees
+// them, and strip the altroot, so that a path from Dataset.Path can be
+// used as another dataset's mountpoint.
+//
+// Datasets with mountpoint=legacy are mounted by mount(8), not by zfs;
+// their Mountpoint is looked up in the mount table, and is empty if
+// they are not mounted. Datasets with mountpoint=none have an empty
+// Mountpoint too.
+
+var altroots = make(map[string]string)
+var altrootsMx sync.Mutex
+
+// Returns name of the pool that the dataset belongs to.
+func PoolOf(name string) string {
+	return strings.SplitN(strings.SplitN(name, "/", 2)[0], "@", 2)[0]
+}
+
+// Returns altroot of the pool, or "" if it is imported without one.
+func Altroot(pool string) (string, error) {
+	altrootsMx.Lock()
+	defer altrootsMx.Unlock()
+	if altroot, ok := altroots[pool]; ok {
+		return altroot, nil
+	}
+	altroot, err := timedCommand("/sbin/zpool", "get", "-Hp", "-o", "value", "altroot", pool).Quiet().OutputString()
+	if err != nil {
+		return "", classify(err)
+	}
+	if altroot == "-" || altroot == "/" {
+		altroot = ""
+	}
+	altroots[pool] = altroot
+	return altroot, nil
+}
+
+// Returns mountpoint property of dataset name that mounts it at path,
+// as the system sees it (i.e. path without the pool's altroot).
+func MountpointProperty(name, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		// none, legacy
+		return path, nil
+	}
+	altroot, err := Altroot(PoolOf(name))
+	if err != nil {
+		return "", err
+	}
+	return stripAltroot(altroot, path), nil
+}
+
+func stripAltroot(altroot, path string) string {
+	switch {
+	case altroot == "":
+		return path
+	case path == altroot:
+		return "/"
+	case strings.HasPrefix(path, altroot+"/"):
+		return path[len(altroot):]
+	}
+	return path
+}
+
+// Returns props with mountpoint, if any, as MountpointProperty.
+func mountpointProps(name string, props map[string]string) (map[string]string, error) {
+	mp, ok := props["mountpoint"]
+	if !ok {
+		return props, nil
+	}
+	prop, err := MountpointProperty(name, mp)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string]string, len(props))
+	for k, v := range props {
+		rv[k] = v
+	}
+	rv["mountpoint"] = prop
+	return rv, nil
+}
+
+// Returns `zfs create` arguments with mountpoint, given as
+// "-omountpoint=PATH" or "-o", "mountpoint=PATH", as
+// MountpointProperty.
+func mountpointArgs(name string, args []string) ([]string, error) {
+	var rv []string
+	for i, arg := range args {
+		prefix := ""
+		switch {
+		case strings.HasPrefix(arg, "-omountpoint="):
+			prefix = "-omountpoint="
+		case strings.HasPrefix(arg, "mountpoint=") && i > 0 && args[i-1] == "-o":
+			prefix = "mountpoint="
+		default:
+			continue
+		}
+		prop, err := MountpointProperty(name, arg[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		if rv == nil {
+			rv = append([]string(nil), args...)
+		}
+		rv[i] = prefix + prop
+	}
+	if rv == nil {
+		return args, nil
+	}
+	return rv, nil
+}
+
+// Returns mount points of mounted zfs datasets by name, from
+// `mount -p` output.
+func parseMountTable(lines []string) map[string]string {
+	rv := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[2] == "zfs" {
+			// mount -p escapes spaces in fstab(5) style
+			rv[strings.Replace(fields[0], "\\040", " ", -1)] = strings.Replace(fields[1], "\\040", " ", -1)
+		}
+	}
+	return rv
+}
+
+// Fills Mountpoint of mounted legacy datasets from the mount table.
+func resolveLegacy(dss []*Dataset) error {
+	var table map[string]string
+	for _, ds := range dss {
+		if !ds.Legacy || !ds.Mounted {
+			continue
+		}
+		if table == nil {
+			lines, err := timedCommand("/sbin/mount", "-p").Quiet().OutputLines()
+			if err != nil {
+				return fmt.Errorf("Cannot read mount table for legacy dataset %v: %v", ds.Name, err)
+			}
+			table = parseMountTable(lines)
+		}
+		ds.Mountpoint = table[ds.Name]
+	}
+	return nil
+}
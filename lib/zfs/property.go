@@ -0,0 +1,117 @@
+package zfs
+
+import "fmt"
+import "strconv"
+import "strings"
+
+// Properties are always read with `zfs get -p`, so that sizes and
+// other numbers come as exact integers ("1288490188", not "1.2G").
+// Failures to set a property carry zfs's own message (e.g. "'quota'
+// must be a number").
+
+// A property of a dataset, as reported by `zfs get`
+type Property struct {
+	Name   string
+	Value  string
+	Source string // "local", "default", "inherited from DATASET", "-", ...
+}
+
+// Returns true if the property is set on the dataset itself.
+func (prop *Property) IsLocal() bool {
+	return prop.Source == "local"
+}
+
+// Returns name of the dataset that the property is inherited from, or
+// "" if it's not inherited.
+func (prop *Property) InheritedFrom() string {
+	if !strings.HasPrefix(prop.Source, inheritedPrefix) {
+		return ""
+	}
+	return prop.Source[len(inheritedPrefix):]
+}
+
+const inheritedPrefix = "inherited from "
+
+// Returns property's value as a number, failing for "-" and "none".
+func (prop *Property) Uint64() (uint64, error) {
+	n, err := strconv.ParseUint(prop.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Property %v is not a number: %#v", prop.Name, prop.Value)
+	}
+	return n, nil
+}
+
+// Returns property's on/off (or yes/no) value.
+func (prop *Property) Bool() (bool, error) {
+	switch prop.Value {
+	case "on", "yes":
+		return true, nil
+	case "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("Property %v is not on/off: %#v", prop.Name, prop.Value)
+}
+
+// Returns a property of the dataset.
+func (ds *Dataset) GetProperty(name string) (*Property, error) {
+	props, err := ds.GetProperties(name)
+	if err != nil {
+		return nil, err
+	}
+	return props[name], nil
+}
+
+// Returns properties of the dataset with one `zfs get`, by name.
+func (ds *Dataset) GetProperties(names ...string) (map[string]*Property, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No properties to get from %v", ds.Name)
+	}
+	rows, err := ds.ZfsFields("get", "-p", "-o", "property,value,source", strings.Join(names, ","))
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]*Property, len(rows))
+	for _, row := range rows {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("Unexpected zfs get output for %v: %q", ds.Name, row)
+		}
+		props[row[0]] = &Property{Name: row[0], Value: row[1], Source: row[2]}
+	}
+	for _, name := range names {
+		if props[name] == nil {
+			return nil, fmt.Errorf("No property %v of %v", name, ds.Name)
+		}
+	}
+	return props, nil
+}
+
+// Returns a numeric property (e.g. a size) of the dataset.
+func (ds *Dataset) GetUint64(name string) (uint64, error) {
+	prop, err := ds.GetProperty(name)
+	if err != nil {
+		return 0, err
+	}
+	return prop.Uint64()
+}
+
+// Returns an on/off property of the dataset.
+func (ds *Dataset) GetBool(name string) (bool, error) {
+	prop, err := ds.GetProperty(name)
+	if err != nil {
+		return false, err
+	}
+	return prop.Bool()
+}
+
+// Sets a property of the dataset.
+func (ds *Dataset) SetProperty(name, value string) error {
+	return ds.Set(name, value)
+}
+
+// Sets an on/off property of the dataset.
+func (ds *Dataset) SetBool(name string, value bool) error {
+	if value {
+		return ds.Set(name, "on")
+	}
+	return ds.Set(name, "off")
+}
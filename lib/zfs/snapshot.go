@@ -0,0 +1,138 @@
+package zfs
+
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// Options of taking a snapshot
+type SnapshotOptions struct {
+	Recursive  bool              // snapshot descendant datasets too
+	Properties map[string]string // user properties of the snapshot
+}
+
+// A snapshot, as listed by Dataset.Snapshots.
+type SnapshotInfo struct {
+	Name      string // short name, after "@"
+	Created   time.Time
+	CreateTxg uint64   // orders snapshots taken within a second
+	Used      int64    // space used by the snapshot alone
+	Clones    []string // names of datasets cloned from the snapshot
+}
+
+// Returns "-o key=value" arguments, sorted by key.
+func propertyArgs(props map[string]string) []string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, "-o", k+"="+props[k])
+	}
+	return args
+}
+
+// Takes snapshot `ds@name`. Fails with ErrorExists if it's already
+// there.
+func (ds *Dataset) Snapshot(name string, opts *SnapshotOptions) (*Dataset, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	args := propertyArgs(opts.Properties)
+	if opts.Recursive {
+		args = append(args, "-r")
+	}
+	name = ds.SnapshotName(name)
+	if err := Zfs("snapshot", append(args, name)...); err != nil {
+		return nil, err
+	}
+	return GetDataset(name)
+}
+
+// Returns dataset's own snapshots, oldest first.
+func (ds *Dataset) Snapshots() ([]*SnapshotInfo, error) {
+	rows, err := ZfsFields("list", "-p", "-t", "snapshot", "-d", "1", "-s", "createtxg",
+		"-o", "name,creation,createtxg,used,clones", ds.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(ds.Name, rows)
+}
+
+func parseSnapshots(dsName string, rows [][]string) ([]*SnapshotInfo, error) {
+	snaps := make([]*SnapshotInfo, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != 5 || !strings.HasPrefix(row[0], dsName+"@") {
+			return nil, fmt.Errorf("Unexpected snapshot listing: %q", row)
+		}
+		snap := &SnapshotInfo{Name: row[0][len(dsName)+1:]}
+		if created, err := strconv.ParseInt(row[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid creation time of %v: %v", row[0], err)
+		} else {
+			snap.Created = time.Unix(created, 0)
+		}
+		if txg, err := strconv.ParseUint(row[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid createtxg of %v: %v", row[0], err)
+		} else {
+			snap.CreateTxg = txg
+		}
+		if used, err := strconv.ParseInt(row[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid used of %v: %v", row[0], err)
+		} else {
+			snap.Used = used
+		}
+		if row[4] != "" && row[4] != "-" {
+			snap.Clones = strings.Split(row[4], ",")
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// Clones snapshot `ds@snapshot` as target, with properties (e.g.
+// mountpoint) set. If ds is a snapshot itself, snapshot is empty.
+func (ds *Dataset) Clone(snapshot, target string, props map[string]string) (*Dataset, error) {
+	origin := ds.Name
+	if snapshot != "" {
+		origin = ds.SnapshotName(snapshot)
+	} else if ds.Type != "snapshot" {
+		return nil, fmt.Errorf("Not a snapshot: %v", ds)
+	}
+	props, err := mountpointProps(target, props)
+	if err != nil {
+		return nil, err
+	}
+	if err := Zfs("clone", append(propertyArgs(props), origin, target)...); err != nil {
+		return nil, err
+	}
+	return GetDataset(target)
+}
+
+// Rolls ds back to its snapshot. Without force, fails with
+// ErrorHasSnapshots if there are more recent snapshots; with force,
+// destroys them (but not ones that have clones).
+func (ds *Dataset) Rollback(snapshot string, force bool) error {
+	args := []string{}
+	if force {
+		args = append(args, "-r")
+	}
+	return Zfs("rollback", append(args, ds.SnapshotName(snapshot))...)
+}
+
+// Promotes ds, which needs to be a clone, so that it no longer depends
+// on its origin: the origin's snapshots up to the cloned one move to
+// ds, and the origin becomes ds's clone.
+func (ds *Dataset) Promote() error {
+	if err := ds.Zfs("promote"); err != nil {
+		return err
+	}
+	return ds.load()
+}
+
+// Destroys ds's snapshot. Fails with ErrorHasClones if it has clones.
+func (ds *Dataset) DestroySnapshot(name string) error {
+	return Zfs("destroy", ds.SnapshotName(name))
+}
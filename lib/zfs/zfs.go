@@ -1,16 +1,67 @@
 package zfs
 
+import "context"
 import "errors"
 import "fmt"
 import "io"
 import "path"
 import "path/filepath"
 import "strings"
+import "sync/atomic"
+import "time"
 
 import "github.com/3ofcoins/jetpack/lib/run"
 
+// Time that a zfs command can take, in nanoseconds (0 is no limit);
+// set with SetTimeout, which is safe while commands run.
+var timeout int64
+
+// Commands that take as long as the data they process (the stream, or
+// the datasets being freed or rolled back) have no time limit.
+var untimed = map[string]bool{
+	"destroy":  true,
+	"receive":  true,
+	"rollback": true,
+	"send":     true,
+}
+
+// Sets time that zfs commands can take; 0 is no limit.
+func SetTimeout(d time.Duration) {
+	atomic.StoreInt64(&timeout, int64(d))
+}
+
+// Returns time that zfs commands can take; 0 is no limit.
+func Timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&timeout))
+}
+
+// Context of zfs commands (a boxedContext); set with SetContext
+var commandContext atomic.Value
+
+type boxedContext struct{ context.Context }
+
+// Sets context of zfs commands: commands running and started later are
+// killed when it is done.
+func SetContext(ctx context.Context) {
+	commandContext.Store(boxedContext{ctx})
+}
+
+// Returns context of zfs commands; context.Background() if none has
+// been set.
+func Context() context.Context {
+	if boxed, ok := commandContext.Load().(boxedContext); ok && boxed.Context != nil {
+		return boxed.Context
+	}
+	return context.Background()
+}
+
+// Returns command that is run with zfs commands' timeout and context.
+func timedCommand(name string, args ...string) *run.Cmd {
+	return run.Command(name, args...).WithTimeout(Timeout()).WithContext(Context())
+}
+
 func ZPools() ([]string, error) {
-	return run.Command("/sbin/zpool", "list", "-Hp", "-oname").OutputLines()
+	return timedCommand("/sbin/zpool", "list", "-Hp", "-oname").StreamStderr().OutputLines()
 }
 
 func zfs(command string, args []string) *run.Cmd {
@@ -19,23 +70,30 @@ func zfs(command string, args []string) *run.Cmd {
 		quiet = true
 		command = command[1:]
 	}
-	cmd := run.Command("/sbin/zfs", append([]string{command}, args...)...)
+	// Stderr is always captured, errors are classified by it; stdout,
+	// which may be a send stream, is passed through as it is.
+	cmd := run.Command("/sbin/zfs", append([]string{command}, args...)...).StreamStderr().WithContext(Context())
+	if !untimed[command] {
+		cmd.WithTimeout(Timeout())
+	}
 	if quiet {
-		cmd.Cmd.Stderr = nil
+		cmd.Quiet()
 	}
 	return cmd
 }
 
 func Zfs(cmd string, args ...string) error {
-	return zfs(cmd, args).Run()
+	return classify(zfs(cmd, args).Run())
 }
 
 func ZfsOutput(cmd string, args ...string) (string, error) {
-	return zfs(cmd, append([]string{"-H"}, args...)).OutputString()
+	out, err := zfs(cmd, append([]string{"-H"}, args...)).OutputString()
+	return out, classify(err)
 }
 
 func ZfsLines(cmd string, args ...string) ([]string, error) {
-	return zfs(cmd, append([]string{"-H"}, args...)).OutputLines()
+	lines, err := zfs(cmd, append([]string{"-H"}, args...)).OutputLines()
+	return lines, classify(err)
 }
 
 func ZfsFields(cmd string, args ...string) ([][]string, error) {
@@ -51,19 +109,24 @@ func ZfsFields(cmd string, args ...string) ([][]string, error) {
 }
 
 func ZfsReceive(r io.Reader, args ...string) error {
-	return zfs("receive", args).ReadFrom(r).Run()
+	return classify(zfs("receive", args).ReadFrom(r).Run())
 }
 
 func ZfsSend(w io.Writer, args ...string) error {
-	return zfs("send", args).WriteTo(w).Run()
+	return classify(zfs("send", args).WriteTo(w).Run())
 }
 
 type Dataset struct {
 	Name       string
 	Type       string
 	Mounted    bool
-	Mountpoint string
+	Mountpoint string // where it's mounted, with the pool's altroot; see mountpoint.go
+	Legacy     bool   // mountpoint=legacy; mounted by mount(8)
 	Origin     string
+
+	// Extra properties requested from List or Children; unset ones
+	// are missing
+	Properties map[string]string
 }
 
 func (ds *Dataset) String() string {
@@ -74,6 +137,9 @@ func (ds *Dataset) String() string {
 	if ds.Mountpoint != "" {
 		pieces = append(pieces, "at", ds.Mountpoint)
 	}
+	if ds.Legacy {
+		pieces = append(pieces, "(legacy)")
+	}
 	return strings.Join(pieces, " ")
 }
 
@@ -99,38 +165,30 @@ func ListDatasets(typ string) ([]string, error) {
 }
 
 func (ds *Dataset) load() error {
-	if props, err := ds.GetMany("type", "mounted", "mountpoint", "origin"); err != nil {
+	rows, err := ds.ZfsFields("list", append(listArgs(nil), "-t", "all")...)
+	if err != nil {
+		return err
+	}
+	dss, err := parseDatasets(rows, nil)
+	if err != nil {
+		return err
+	}
+	if len(dss) != 1 || dss[0].Name != ds.Name {
+		return fmt.Errorf("Unexpected zfs list output for %v: %q", ds.Name, rows)
+	}
+	if err := resolveLegacy(dss); err != nil {
 		return err
-	} else {
-		ds.Type = props["type"]
-		if props["mountpoint"] != "none" {
-			ds.Mountpoint = props["mountpoint"]
-		}
-		if props["origin"] != "-" {
-			ds.Origin = props["origin"]
-		}
-		ds.Mounted = (props["mounted"] == "yes")
-		return nil
 	}
+	ds.Type, ds.Mounted, ds.Mountpoint, ds.Legacy, ds.Origin = dss[0].Type, dss[0].Mounted, dss[0].Mountpoint, dss[0].Legacy, dss[0].Origin
+	return nil
 }
 
 func GetDataset(name string) (*Dataset, error) {
 	ds := &Dataset{Name: name}
-	if err := ds.load(); err != nil {
-		// Check if dataset exists
-		if dss, err2 := ListDatasets(""); err2 != nil {
-			// Can't list datasets, assume original error was not "not
-			// found" and return it rather than the new one
-			return nil, err
-		} else {
-			for _, ds := range dss {
-				if ds == name {
-					// Dataset exists, the error was legit after all
-					return nil, err
-				}
-			}
-			return nil, ErrNotFound
-		}
+	if err := ds.load(); KindOf(err) == ErrorNoDataset {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
 	}
 	return ds, nil
 }
@@ -149,6 +207,10 @@ func ReceiveDataset(r io.Reader, name string, mounted bool) (*Dataset, error) {
 }
 
 func CreateDataset(name string, args ...string) (*Dataset, error) {
+	args, err := mountpointArgs(name, args)
+	if err != nil {
+		return nil, err
+	}
 	if err := Zfs("create", append(args, name)...); err != nil {
 		return nil, err
 	}
@@ -156,7 +218,7 @@ func CreateDataset(name string, args ...string) (*Dataset, error) {
 }
 
 func (ds *Dataset) Get(name string) (string, error) {
-	return ds.ZfsOutput("get", "-p", "-oproperty", name)
+	return ds.ZfsOutput("get", "-p", "-ovalue", name)
 }
 
 func (ds *Dataset) GetMany(attr ...string) (map[string]string, error) {
@@ -185,6 +247,9 @@ func firstError(err1, err2 error) error {
 
 func (ds *Dataset) Set(name, value string) (err error) {
 	if name == "mountpoint" {
+		if value, err = MountpointProperty(ds.Name, value); err != nil {
+			return err
+		}
 		defer func() {
 			err = firstError(err, ds.load())
 		}()
@@ -194,6 +259,9 @@ func (ds *Dataset) Set(name, value string) (err error) {
 
 func (ds *Dataset) SetMany(attr map[string]string) (err error) {
 	reload := false
+	if attr, err = mountpointProps(ds.Name, attr); err != nil {
+		return err
+	}
 	args := make([]string, 0, len(attr))
 	for k, v := range attr {
 		if k == "mountpoint" {
@@ -213,27 +281,10 @@ func (ds *Dataset) SnapshotName(name string) string {
 	return ds.Name + "@" + name
 }
 
-func (ds *Dataset) Snapshot(name string, args ...string) (*Dataset, error) {
-	name = ds.SnapshotName(name)
-	if err := Zfs("snapshot", append(args, name)...); err != nil {
-		return nil, err
-	} else {
-		return GetDataset(name)
-	}
-}
-
 func (ds *Dataset) GetSnapshot(name string) (*Dataset, error) {
 	return GetDataset(ds.SnapshotName(name))
 }
 
-func (ds *Dataset) RollbackTo(name string, args ...string) error {
-	if snap, err := ds.GetSnapshot(name); err != nil {
-		return err
-	} else {
-		return snap.Rollback(args...)
-	}
-}
-
 func (ds *Dataset) Send(w io.Writer, args ...string) error {
 	if ds.Type != "snapshot" {
 		return fmt.Errorf("Not a snapshot: %v", ds)
@@ -241,28 +292,22 @@ func (ds *Dataset) Send(w io.Writer, args ...string) error {
 	return ZfsSend(w, append(args, ds.Name)...)
 }
 
-func (ds *Dataset) Clone(name string, args ...string) (*Dataset, error) {
-	if ds.Type != "snapshot" {
-		return nil, fmt.Errorf("Not a snapshot: %v", ds)
-	}
-	if err := Zfs("clone", append(args, ds.Name, name)...); err != nil {
-		return nil, err
-	}
-	return GetDataset(name)
+func (ds *Dataset) Mount() (err error) {
+	defer func() {
+		err = firstError(err, ds.load())
+	}()
+	return ds.Zfs("mount")
 }
 
-func (ds *Dataset) Rollback(args ...string) error {
-	if ds.Type != "snapshot" {
-		return fmt.Errorf("Not a snapshot: %v", ds)
+// Mounts a legacy dataset at path.
+func (ds *Dataset) MountLegacy(path string) (err error) {
+	if !ds.Legacy {
+		return fmt.Errorf("Not a legacy dataset: %v", ds)
 	}
-	return ds.Zfs("rollback", args...)
-}
-
-func (ds *Dataset) Mount() (err error) {
 	defer func() {
 		err = firstError(err, ds.load())
 	}()
-	return ds.Zfs("mount")
+	return classify(timedCommand("/sbin/mount", "-t", "zfs", ds.Name, path).StreamStderr().Run())
 }
 
 func (ds *Dataset) Unmount() (err error) {
@@ -296,33 +341,30 @@ func (ds *Dataset) Path(elem ...string) string {
 	return filepath.Join(append([]string{ds.Mountpoint}, elem...)...)
 }
 
+// Returns descendant datasets, with extra properties, listed at once.
 // depth: -1: self and all descendants (unlimited recursion); 0: only
 // all descendants (unlimited recursion); >0: set depth, not include
 // self
-func (ds *Dataset) Children(depth int, args ...string) ([]*Dataset, error) {
-	args = append([]string{"-r", "-oname"}, args...)
+func (ds *Dataset) Children(depth int, properties ...string) ([]*Dataset, error) {
+	recursion := "-r"
 	if depth > 0 {
-		args[0] = fmt.Sprintf("-d%d", depth)
+		recursion = fmt.Sprintf("-d%d", depth)
 	}
-	if lines, err := ds.ZfsFields("list", append([]string{"-p"}, args...)...); err != nil {
+	rows, err := ds.ZfsFields("list", append(listArgs(properties), recursion)...)
+	if err != nil {
 		return nil, err
-	} else {
-		rv := make([]*Dataset, len(lines))
-		for i, ln := range lines {
-			// TODO: use "zfs get" to get data of all children at the same
-			// time and excessive forking
-			if ds, err := GetDataset(ln[0]); err != nil {
-				return nil, err
-			} else {
-				rv[i] = ds
-			}
-		}
-		if depth < 0 {
-			return rv, nil
-		} else {
-			return rv[1:], nil
-		}
 	}
+	rv, err := parseDatasets(rows, properties)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveLegacy(rv); err != nil {
+		return nil, err
+	}
+	if depth < 0 || len(rv) == 0 {
+		return rv, nil
+	}
+	return rv[1:], nil
 }
 
 func (ds *Dataset) Destroy(flags ...string) error {
@@ -0,0 +1,464 @@
+package zfs
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/juju/errors"
+
+import "github.com/3ofcoins/jetpack/lib/run"
+
+func TestClassify(t *testing.T) {
+	for msg, kind := range map[string]ErrorKind{
+		"cannot create snapshot 'p/ds@a': dataset already exists":               ErrorExists,
+		"cannot open 'p/nope': dataset does not exist":                          ErrorNoDataset,
+		"cannot destroy 'p/ds@a': snapshot has dependent clones\nuse '-R'":      ErrorHasClones,
+		"cannot rollback to 'p/ds@a': more recent snapshots or bookmarks exist": ErrorHasSnapshots,
+		"cannot destroy 'p/ds': dataset is busy":                                ErrorBusy,
+		"cannot unmount '/p/ds': Device busy":                                   ErrorBusy,
+		"cannot create 'p/ds': invalid property 'nope'":                         ErrorBadProperty,
+		"cannot create 'p/ds': 'recordsize' must be power of 2 from 512B to 1M": ErrorBadProperty,
+		"internal error: out of memory":                                         ErrorOther,
+	} {
+		err := classify(run.Command("/bin/sh", "-c", "echo \"$0\" >&2; exit 1", msg).Quiet().Run())
+		if actual := KindOf(errors.Annotate(err, "Doing stuff")); actual != kind {
+			t.Errorf("%#v: expected %#v, got %#v (%v)", msg, kind, actual, err)
+		}
+	}
+	if err := classify(nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParseSnapshots(t *testing.T) {
+	snaps, err := parseSnapshots("p/ds", [][]string{
+		{"p/ds@a", "1500000000", "10", "0", "-"},
+		{"p/ds@b", "1500000060", "12", "4096", "p/x,p/y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*SnapshotInfo{
+		{Name: "a", Created: time.Unix(1500000000, 0), CreateTxg: 10},
+		{Name: "b", Created: time.Unix(1500000060, 0), CreateTxg: 12, Used: 4096, Clones: []string{"p/x", "p/y"}},
+	}
+	if !reflect.DeepEqual(snaps, expected) {
+		t.Errorf("Unexpected snapshots %#v", snaps)
+	}
+	if _, err := parseSnapshots("p/ds", [][]string{{"p/other@a", "1", "1", "0", "-"}}); err == nil {
+		t.Error("Expected error for other dataset's snapshot")
+	}
+}
+
+// Creates a pool backed by a temporary file; needs root and ZFS.
+func testPool(t testing.TB) *Dataset {
+	if os.Getuid() != 0 {
+		t.Skip("Needs root")
+	}
+	if _, err := os.Stat("/sbin/zpool"); err != nil {
+		t.Skip("Needs ZFS")
+	}
+	tmp, err := ioutil.TempDir("", "jetpack-zfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdev := filepath.Join(tmp, "vdev")
+	if f, err := os.Create(vdev); err != nil {
+		t.Fatal(err)
+	} else if err := f.Truncate(128 << 20); err != nil {
+		t.Fatal(err)
+	} else {
+		f.Close()
+	}
+	name := fmt.Sprintf("jetpacktest%d", os.Getpid())
+	if err := run.Command("/sbin/zpool", "create", "-O", "mountpoint=none", name, vdev).Run(); err != nil {
+		os.RemoveAll(tmp)
+		t.Skipf("Cannot create test pool: %v", err)
+	}
+	t.Cleanup(func() {
+		run.Command("/sbin/zpool", "destroy", "-f", name).Run()
+		os.RemoveAll(tmp)
+	})
+	ds, err := GetDataset(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func snapshotNames(t *testing.T, ds *Dataset) []string {
+	snaps, err := ds.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(snaps))
+	for i, snap := range snaps {
+		names[i] = snap.Name
+	}
+	return names
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	ds, err := testPool(t).CreateDataset("ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now().Add(-time.Second)
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := ds.Snapshot(name, &SnapshotOptions{Properties: map[string]string{"jetpack:test": name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ds.Snapshot("a", nil); KindOf(err) != ErrorExists {
+		t.Errorf("Expected ErrorExists, got %v", err)
+	}
+	snaps, err := ds.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 3 || snaps[0].Created.Before(started) || snaps[0].CreateTxg > snaps[2].CreateTxg {
+		t.Errorf("Unexpected snapshots %#v", snaps)
+	}
+	if snap, err := ds.GetSnapshot("b"); err != nil {
+		t.Fatal(err)
+	} else if v, err := snap.Get("jetpack:test"); err != nil || v != "b" {
+		t.Errorf("Unexpected property %#v (%v)", v, err)
+	}
+
+	if err := ds.Rollback("a", false); KindOf(err) != ErrorHasSnapshots {
+		t.Errorf("Expected ErrorHasSnapshots, got %v", err)
+	}
+	if names := snapshotNames(t, ds); len(names) != 3 {
+		t.Errorf("Rollback without force destroyed snapshots: %v", names)
+	}
+	if err := ds.Rollback("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if names := snapshotNames(t, ds); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Unexpected snapshots after forced rollback: %v", names)
+	}
+	if err := ds.Rollback("c", false); KindOf(err) != ErrorNoDataset {
+		t.Errorf("Expected ErrorNoDataset, got %v", err)
+	}
+	if err := ds.DestroySnapshot("b"); err != nil {
+		t.Fatal(err)
+	}
+	if names := snapshotNames(t, ds); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("Unexpected snapshots after destroy: %v", names)
+	}
+}
+
+func TestClonePromote(t *testing.T) {
+	pool := testPool(t)
+	ds, err := pool.CreateDataset("ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := ds.Snapshot(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clone, err := ds.Clone("a", pool.ChildName("clone"), map[string]string{"jetpack:test": "clone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Origin != ds.SnapshotName("a") {
+		t.Errorf("Unexpected origin %v", clone.Origin)
+	}
+	if v, err := clone.Get("jetpack:test"); err != nil || v != "clone" {
+		t.Errorf("Unexpected property %#v (%v)", v, err)
+	}
+	if _, err := ds.Clone("a", clone.Name, nil); KindOf(err) != ErrorExists {
+		t.Errorf("Expected ErrorExists, got %v", err)
+	}
+	snap, err := ds.GetSnapshot("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone2, err := snap.Clone("", pool.ChildName("clone2"), nil); err != nil {
+		t.Fatal(err)
+	} else if clone2.Origin != snap.Name {
+		t.Errorf("Unexpected origin %v", clone2.Origin)
+	} else if err := clone2.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	snaps, err := ds.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snaps[0].Clones, []string{clone.Name}) {
+		t.Errorf("Unexpected clones %v", snaps[0].Clones)
+	}
+	if err := ds.DestroySnapshot("a"); KindOf(err) != ErrorHasClones {
+		t.Errorf("Expected ErrorHasClones, got %v", err)
+	}
+
+	// Promoting moves the cloned snapshot and the ones before it
+	if err := clone.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if clone.Origin != "" {
+		t.Errorf("Promoted clone has origin %v", clone.Origin)
+	}
+	if names := snapshotNames(t, clone); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("Unexpected snapshots of promoted clone: %v", names)
+	}
+	if names := snapshotNames(t, ds); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("Unexpected snapshots of origin: %v", names)
+	}
+	if err := ds.Destroy("-r"); err != nil {
+		t.Errorf("Cannot destroy former origin: %v", err)
+	}
+}
+
+func TestProperty(t *testing.T) {
+	quota := &Property{Name: "quota", Value: "1288490188", Source: "inherited from p/ds"}
+	if n, err := quota.Uint64(); err != nil || n != 1288490188 {
+		t.Errorf("Unexpected value %v (%v)", n, err)
+	}
+	if quota.IsLocal() || quota.InheritedFrom() != "p/ds" {
+		t.Errorf("Unexpected source of %#v", quota)
+	}
+	if _, err := (&Property{Name: "origin", Value: "-"}).Uint64(); err == nil {
+		t.Error("Expected error for a non-number")
+	}
+	ro := &Property{Name: "readonly", Value: "on", Source: "local"}
+	if v, err := ro.Bool(); err != nil || !v {
+		t.Errorf("Unexpected value %v (%v)", v, err)
+	}
+	if !ro.IsLocal() || ro.InheritedFrom() != "" {
+		t.Errorf("Unexpected source of %#v", ro)
+	}
+	if v, err := (&Property{Name: "mounted", Value: "no"}).Bool(); err != nil || v {
+		t.Errorf("Unexpected value %v (%v)", v, err)
+	}
+	if _, err := (&Property{Name: "compression", Value: "lz4"}).Bool(); err == nil {
+		t.Error("Expected error for a non-boolean")
+	}
+}
+
+func TestProperties(t *testing.T) {
+	pool := testPool(t)
+	if err := pool.SetProperty("atime", "off"); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := pool.CreateDataset("ds", "-o", "quota=64M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := ds.GetProperties("quota", "atime", "readonly", "used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := props["quota"].Uint64(); err != nil || n != 64<<20 || !props["quota"].IsLocal() {
+		t.Errorf("Unexpected quota %#v (%v)", props["quota"], err)
+	}
+	if props["atime"].InheritedFrom() != pool.Name || props["atime"].Value != "off" {
+		t.Errorf("Unexpected atime %#v", props["atime"])
+	}
+	if _, err := props["used"].Uint64(); err != nil {
+		t.Error(err)
+	}
+	if err := ds.SetBool("readonly", true); err != nil {
+		t.Fatal(err)
+	}
+	if ro, err := ds.GetBool("readonly"); err != nil || !ro {
+		t.Errorf("Unexpected readonly %v (%v)", ro, err)
+	}
+	if err := ds.SetProperty("quota", "lots"); err == nil {
+		t.Error("Expected error for invalid quota")
+	} else if cerr, ok := err.(*run.CmdError); !ok || cerr.Stderr == "" || !strings.Contains(err.Error(), cerr.Stderr) {
+		t.Errorf("Error lacks zfs's message: %v", err)
+	}
+	if _, err := ds.GetProperties("quota", "nonsense"); err == nil {
+		t.Error("Expected error for invalid property")
+	}
+}
+
+func TestParseDatasets(t *testing.T) {
+	dss, err := parseDatasets([][]string{
+		{"p/my data", "filesystem", "yes", "/my data", "-", "1024", "-"},
+		{"p/my data@a b", "snapshot", "-", "-", "-", "0", "-"},
+		{"p/clone", "filesystem", "no", "none", "p/my data@a b", "512", "lz4"},
+		{"p/old", "filesystem", "yes", "legacy", "-", "0", "-"},
+	}, []string{"used", "compression"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Dataset{
+		{Name: "p/my data", Type: "filesystem", Mounted: true, Mountpoint: "/my data", Properties: map[string]string{"used": "1024"}},
+		{Name: "p/my data@a b", Type: "snapshot", Properties: map[string]string{"used": "0"}},
+		{Name: "p/clone", Type: "filesystem", Origin: "p/my data@a b", Properties: map[string]string{"used": "512", "compression": "lz4"}},
+		{Name: "p/old", Type: "filesystem", Mounted: true, Legacy: true, Properties: map[string]string{"used": "0"}},
+	}
+	if !reflect.DeepEqual(dss, expected) {
+		t.Errorf("Unexpected datasets %#v", dss)
+	}
+	if _, err := parseDatasets([][]string{{"p", "filesystem", "yes", "/p", "-"}}, []string{"used"}); err == nil {
+		t.Error("Expected error for missing field")
+	}
+}
+
+func TestChildren(t *testing.T) {
+	pool := testPool(t)
+	for _, name := range []string{"a", "a/one", "a/one/deep", "a/two two"} {
+		if _, err := pool.CreateDataset(name, "-o", "jetpack:test="+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := pool.GetDataset("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := a.Children(1, "jetpack:test", "used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children[0].Name != a.ChildName("one") || children[1].Name != a.ChildName("two two") {
+		t.Fatalf("Unexpected children %v", children)
+	}
+	if children[1].Properties["jetpack:test"] != "a/two two" || children[1].Properties["used"] == "" {
+		t.Errorf("Unexpected properties %v", children[1].Properties)
+	}
+	if all, err := a.Children(-1); err != nil || len(all) != 4 || all[0].Name != a.Name {
+		t.Errorf("Unexpected datasets %v (%v)", all, err)
+	}
+	if all, err := a.Children(0); err != nil || len(all) != 3 {
+		t.Errorf("Unexpected datasets %v (%v)", all, err)
+	}
+	if _, err := pool.GetDataset("nonexistent"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if dss, err := List("filesystem", "jetpack:test"); err != nil {
+		t.Error(err)
+	} else {
+		found := 0
+		for _, ds := range dss {
+			if ds.Name == pool.Name && ds.Properties["jetpack:test"] != "" {
+				t.Errorf("Unset property of %v: %v", ds.Name, ds.Properties)
+			}
+			if strings.HasPrefix(ds.Name, a.Name) {
+				found++
+			}
+		}
+		if found != 4 {
+			t.Errorf("Unexpected datasets %v", dss)
+		}
+	}
+}
+
+func benchmarkRows(n int) [][]string {
+	rows := make([][]string, n)
+	for i := range rows {
+		rows[i] = []string{fmt.Sprintf("pool/jetpack/pods/%d", i), "filesystem", "yes", fmt.Sprintf("/var/jetpack/pods/%d", i), "-", "123456"}
+	}
+	return rows
+}
+
+func BenchmarkParseDatasets(b *testing.B) {
+	rows := benchmarkRows(1000)
+	for i := 0; i < b.N; i++ {
+		if _, err := parseDatasets(rows, []string{"used"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compares a single listing of 1000 datasets with forking zfs for each
+// one of them.
+func BenchmarkChildren(b *testing.B) {
+	pool := testPool(b)
+	for i := 0; i < 10; i++ {
+		parent := fmt.Sprintf("p%d", i)
+		if _, err := pool.CreateDataset(parent); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if _, err := pool.CreateDataset(fmt.Sprintf("%v/c%d", parent, j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("list", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if dss, err := pool.Children(0, "used"); err != nil || len(dss) != 1010 {
+				b.Fatal(len(dss), err)
+			}
+		}
+	})
+	b.Run("each", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			names, err := ZfsLines("list", "-r", "-o", "name", pool.Name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, name := range names[1:] {
+				ds, err := GetDataset(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := ds.Get("used"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestMountpointProperty(t *testing.T) {
+	altrootsMx.Lock()
+	altroots["alt"], altroots["plain"] = "/mnt", ""
+	altrootsMx.Unlock()
+	for _, tc := range []struct{ name, path, prop string }{
+		{"alt/jetpack", "/mnt/var/jetpack", "/var/jetpack"},
+		{"alt/jetpack/pods", "/mnt", "/"},
+		{"alt/jetpack/pods", "/mntx/pods", "/mntx/pods"},
+		{"alt/jetpack@snap", "/mnt/srv", "/srv"},
+		{"alt/jetpack", "legacy", "legacy"},
+		{"alt/jetpack", "none", "none"},
+		{"plain/jetpack", "/mnt/var/jetpack", "/mnt/var/jetpack"},
+	} {
+		if prop, err := MountpointProperty(tc.name, tc.path); err != nil {
+			t.Error(err)
+		} else if prop != tc.prop {
+			t.Errorf("%v at %v: expected mountpoint %v, got %v", tc.name, tc.path, tc.prop, prop)
+		}
+	}
+
+	args, err := mountpointArgs("alt/a", []string{"-p", "-omountpoint=/mnt/a", "-o", "mountpoint=/mnt/b", "-o", "quota=1G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"-p", "-omountpoint=/a", "-o", "mountpoint=/b", "-o", "quota=1G"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+	props := map[string]string{"mountpoint": "/mnt/c", "readonly": "on"}
+	if fixed, err := mountpointProps("alt/c", props); err != nil {
+		t.Fatal(err)
+	} else if fixed["mountpoint"] != "/c" || fixed["readonly"] != "on" || props["mountpoint"] != "/mnt/c" {
+		t.Errorf("Unexpected properties %v (from %v)", fixed, props)
+	}
+}
+
+func TestParseMountTable(t *testing.T) {
+	table := parseMountTable([]string{
+		"zroot/ROOT/default\t/\tzfs\trw\t0 0",
+		"devfs\t\t\t/dev\t\tdevfs\trw\t\t0 0",
+		"zroot/jetpack/my\\040pods /var/jetpack/my\\040pods zfs rw 0 0",
+		"/dev/ada0p2 /boot ufs rw 2 2",
+	})
+	expected := map[string]string{
+		"zroot/ROOT/default":    "/",
+		"zroot/jetpack/my pods": "/var/jetpack/my pods",
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("Expected %v, got %v", expected, table)
+	}
+}
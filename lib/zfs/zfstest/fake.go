@@ -0,0 +1,623 @@
+// Package zfstest provides an in-memory zfs.Interface for tests.
+package zfstest
+
+import "fmt"
+import "path"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/3ofcoins/jetpack/lib/zfs"
+
+// Fake keeps datasets and snapshots in memory, and follows zfs(8)'s
+// rules closely enough for jetpack's code: a snapshot with clones can't
+// be destroyed, rollback past later snapshots needs force, promotion
+// moves snapshots to the clone, and so on. Failures are *zfs.Error of
+// the kind that zfs(8)'s message would be classified as. Datasets
+// marked busy can't be destroyed, renamed or rolled back, like ones
+// that are mounted in a running jail.
+type Fake struct {
+	// Successful changes, as zfs(8) commands without "zfs" (e.g.
+	// "destroy -r pool/x", "set readonly=on pool/x")
+	Ops []string
+
+	mx       sync.Mutex
+	datasets map[string]*dataset
+	busy     map[string]bool
+	txg      uint64
+}
+
+type dataset struct {
+	name    string
+	typ     string // "filesystem" or "snapshot"
+	origin  string
+	props   map[string]string // set locally
+	stats   map[string]string // statistics set with SetStatistic
+	created time.Time
+	txg     uint64
+}
+
+// Properties that are not inherited, and their values if not set
+var ownProperties = map[string]string{
+	"quota":          "0",
+	"refquota":       "0",
+	"reservation":    "0",
+	"refreservation": "0",
+}
+
+// Inherited properties' values if set nowhere
+var defaultProperties = map[string]string{
+	"readonly":    "off",
+	"compression": "off",
+	"atime":       "on",
+	"exec":        "on",
+	"setuid":      "on",
+	"canmount":    "on",
+}
+
+// Statistics, which can't be set; the fake doesn't keep data
+var readonlyProperties = map[string]bool{
+	"used":        true,
+	"referenced":  true,
+	"available":   true,
+	"logicalused": true,
+	"creation":    true,
+	"createtxg":   true,
+	"type":        true,
+	"origin":      true,
+	"name":        true,
+	"mounted":     true,
+}
+
+// Returns a fake with pool datasets (e.g. "zroot") created.
+func NewFake(pools ...string) *Fake {
+	f := &Fake{datasets: make(map[string]*dataset), busy: make(map[string]bool)}
+	for _, pool := range pools {
+		f.datasets[pool] = f.newDataset(pool, "filesystem")
+	}
+	return f
+}
+
+var _ zfs.Interface = (*Fake)(nil)
+
+func (f *Fake) newDataset(name, typ string) *dataset {
+	f.txg++
+	return &dataset{name: name, typ: typ, props: make(map[string]string), created: time.Now(), txg: f.txg}
+}
+
+func fail(kind zfs.ErrorKind, format string, args ...interface{}) error {
+	return &zfs.Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func (f *Fake) op(format string, args ...interface{}) {
+	f.Ops = append(f.Ops, fmt.Sprintf(format, args...))
+}
+
+func (f *Fake) get(name string) (*dataset, error) {
+	if ds := f.datasets[name]; ds != nil {
+		return ds, nil
+	}
+	return nil, fail(zfs.ErrorNoDataset, "cannot open '%v': dataset does not exist", name)
+}
+
+func (f *Fake) checkNew(name string) error {
+	if f.datasets[name] != nil {
+		return fail(zfs.ErrorExists, "cannot create '%v': dataset already exists", name)
+	}
+	if parent := path.Dir(name); parent == "." || f.datasets[parent] == nil {
+		return fail(zfs.ErrorNoDataset, "cannot create '%v': parent does not exist", name)
+	}
+	return nil
+}
+
+// Rejects properties that can't be set, as zfs does.
+func checkSettable(name string, props map[string]string) error {
+	for k := range props {
+		if readonlyProperties[k] {
+			return fail(zfs.ErrorBadProperty, "cannot create '%v': '%v' is readonly", name, k)
+		}
+	}
+	return nil
+}
+
+// Sets a statistic (e.g. "used") of the dataset, which is otherwise 0.
+func (f *Fake) SetStatistic(name, prop, value string) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if ds, ok := f.datasets[name]; ok {
+		if ds.stats == nil {
+			ds.stats = make(map[string]string)
+		}
+		ds.stats[prop] = value
+	}
+}
+
+// Makes the dataset busy (or not), as if it was in use.
+func (f *Fake) SetBusy(name string, busy bool) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if busy {
+		f.busy[name] = true
+	} else {
+		delete(f.busy, name)
+	}
+}
+
+// Returns true if there is a dataset or snapshot of that name.
+func (f *Fake) Exists(name string) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.datasets[name] != nil
+}
+
+// Returns names of all datasets and snapshots, sorted.
+func (f *Fake) Names() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	rv := make([]string, 0, len(f.datasets))
+	for name := range f.datasets {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Returns name's descendant filesystems, and snapshots of it and of
+// them, sorted; name itself is not included.
+func (f *Fake) descendants(name string) []string {
+	var rv []string
+	for other := range f.datasets {
+		if strings.HasPrefix(other, name+"/") || strings.HasPrefix(other, name+"@") {
+			rv = append(rv, other)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Returns snapshots of a filesystem, oldest first.
+func (f *Fake) snapshots(name string) []*dataset {
+	var rv []*dataset
+	for other, ds := range f.datasets {
+		if strings.HasPrefix(other, name+"@") {
+			rv = append(rv, ds)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].txg < rv[j].txg })
+	return rv
+}
+
+// Returns names of clones of a snapshot, sorted.
+func (f *Fake) clones(snapshot string) []string {
+	var rv []string
+	for name, ds := range f.datasets {
+		if ds.origin == snapshot {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func (f *Fake) property(ds *dataset, name string) *zfs.Property {
+	prop := &zfs.Property{Name: name, Value: "-", Source: "-"}
+	switch name {
+	case "name":
+		prop.Value = ds.name
+	case "type":
+		prop.Value = ds.typ
+	case "origin":
+		if ds.origin != "" {
+			prop.Value = ds.origin
+		}
+	case "creation":
+		prop.Value = fmt.Sprint(ds.created.Unix())
+	case "createtxg":
+		prop.Value = fmt.Sprint(ds.txg)
+	case "mounted":
+		if ds.typ != "snapshot" {
+			prop.Value = "no"
+			if mp := f.mountpoint(ds.name).Value; mp != "none" && mp != "legacy" {
+				prop.Value = "yes"
+			}
+		}
+	case "mountpoint":
+		if ds.typ != "snapshot" {
+			prop = f.mountpoint(ds.name)
+		}
+	default:
+		if readonlyProperties[name] {
+			prop.Value = "0"
+			if v, ok := ds.stats[name]; ok {
+				prop.Value = v
+			}
+		} else if v, ok := ds.props[name]; ok {
+			prop.Value, prop.Source = v, "local"
+		} else if v, ok := ownProperties[name]; ok {
+			prop.Value, prop.Source = v, "default"
+		} else {
+			// A snapshot inherits from its dataset
+			parent := path.Dir(ds.name)
+			if ds.typ == "snapshot" {
+				parent = strings.SplitN(ds.name, "@", 2)[0]
+			}
+			for ; parent != "."; parent = path.Dir(parent) {
+				if v, ok := f.datasets[parent].props[name]; ok {
+					prop.Value, prop.Source = v, "inherited from "+parent
+					return prop
+				}
+			}
+			if v, ok := defaultProperties[name]; ok {
+				prop.Value, prop.Source = v, "default"
+			}
+		}
+	}
+	return prop
+}
+
+// Mountpoint is inherited with the path below the dataset it's set on.
+func (f *Fake) mountpoint(name string) *zfs.Property {
+	prop := &zfs.Property{Name: "mountpoint", Value: "/" + name, Source: "default"}
+	for parent := name; parent != "."; parent = path.Dir(parent) {
+		if v, ok := f.datasets[parent].props["mountpoint"]; ok {
+			prop.Value = v
+			if v != "none" && v != "legacy" {
+				prop.Value = path.Join(v, strings.TrimPrefix(name, parent))
+			}
+			if parent == name {
+				prop.Source = "local"
+			} else {
+				prop.Source = "inherited from " + parent
+			}
+			break
+		}
+	}
+	return prop
+}
+
+func (f *Fake) dataset(ds *dataset, props []string) *zfs.Dataset {
+	rv := &zfs.Dataset{Name: ds.name, Type: ds.typ, Origin: ds.origin}
+	if ds.typ != "snapshot" {
+		switch mp := f.mountpoint(ds.name).Value; mp {
+		case "none":
+		case "legacy":
+			// Never mounted by the fake
+			rv.Legacy = true
+		default:
+			rv.Mountpoint, rv.Mounted = mp, true
+		}
+	}
+	if len(props) > 0 {
+		rv.Properties = make(map[string]string, len(props))
+		for _, name := range props {
+			if v := f.property(ds, name).Value; v != "-" {
+				rv.Properties[name] = v
+			}
+		}
+	}
+	return rv
+}
+
+func (f *Fake) GetDataset(name string) (*zfs.Dataset, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds := f.datasets[name]
+	if ds == nil {
+		return nil, zfs.ErrNotFound
+	}
+	return f.dataset(ds, nil), nil
+}
+
+func (f *Fake) CreateDataset(name string, props map[string]string) (*zfs.Dataset, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if err := f.checkNew(name); err != nil {
+		return nil, err
+	}
+	if err := checkSettable(name, props); err != nil {
+		return nil, err
+	}
+	ds := f.newDataset(name, "filesystem")
+	for k, v := range props {
+		ds.props[k] = v
+	}
+	f.datasets[name] = ds
+	f.op("create %v", name)
+	return f.dataset(ds, nil), nil
+}
+
+func (f *Fake) Destroy(name string, recursive bool) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return err
+	}
+	doomed := []string{name}
+	if ds.typ != "snapshot" {
+		descendants := f.descendants(name)
+		if len(descendants) > 0 && !recursive {
+			return fmt.Errorf("cannot destroy '%v': filesystem has children", name)
+		}
+		doomed = append(doomed, descendants...)
+	}
+	isDoomed := make(map[string]bool, len(doomed))
+	for _, name := range doomed {
+		isDoomed[name] = true
+	}
+	for _, name := range doomed {
+		if f.busy[name] {
+			return fail(zfs.ErrorBusy, "cannot unmount '%v': pool or dataset is busy", name)
+		}
+		for _, clone := range f.clones(name) {
+			if !isDoomed[clone] {
+				return fail(zfs.ErrorHasClones, "cannot destroy '%v': snapshot has dependent clones", name)
+			}
+		}
+	}
+	for _, name := range doomed {
+		delete(f.datasets, name)
+	}
+	if recursive {
+		f.op("destroy -r %v", name)
+	} else {
+		f.op("destroy %v", name)
+	}
+	return nil
+}
+
+func (f *Fake) Rename(name, newName string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return err
+	}
+	if f.busy[name] {
+		return fail(zfs.ErrorBusy, "cannot rename '%v': dataset is busy", name)
+	}
+	if ds.typ == "snapshot" {
+		if strings.SplitN(name, "@", 2)[0] != strings.SplitN(newName, "@", 2)[0] {
+			return fmt.Errorf("cannot rename to '%v': snapshots must be part of same dataset", newName)
+		}
+		if f.datasets[newName] != nil {
+			return fail(zfs.ErrorExists, "cannot rename to '%v': dataset already exists", newName)
+		}
+	} else if err := f.checkNew(newName); err != nil {
+		return err
+	}
+	renamed := map[string]string{name: newName}
+	if ds.typ != "snapshot" {
+		for _, other := range f.descendants(name) {
+			renamed[other] = newName + other[len(name):]
+		}
+	}
+	for old, new := range renamed {
+		ds := f.datasets[old]
+		delete(f.datasets, old)
+		ds.name = new
+		f.datasets[new] = ds
+	}
+	for _, ds := range f.datasets {
+		if new, ok := renamed[ds.origin]; ok {
+			ds.origin = new
+		}
+	}
+	f.op("rename %v %v", name, newName)
+	return nil
+}
+
+func (f *Fake) Snapshot(name, snapshot string, opts *zfs.SnapshotOptions) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if opts == nil {
+		opts = &zfs.SnapshotOptions{}
+	}
+	if _, err := f.get(name); err != nil {
+		return err
+	}
+	names := []string{name}
+	if opts.Recursive {
+		for _, other := range f.descendants(name) {
+			if !strings.Contains(other, "@") {
+				names = append(names, other)
+			}
+		}
+	}
+	for _, name := range names {
+		if f.datasets[name+"@"+snapshot] != nil {
+			return fail(zfs.ErrorExists, "cannot create snapshot '%v@%v': dataset already exists", name, snapshot)
+		}
+	}
+	f.txg++
+	for _, name := range names {
+		ds := &dataset{name: name + "@" + snapshot, typ: "snapshot", props: make(map[string]string),
+			created: time.Now(), txg: f.txg}
+		for k, v := range opts.Properties {
+			ds.props[k] = v
+		}
+		f.datasets[ds.name] = ds
+	}
+	if opts.Recursive {
+		f.op("snapshot -r %v@%v", name, snapshot)
+	} else {
+		f.op("snapshot %v@%v", name, snapshot)
+	}
+	return nil
+}
+
+func (f *Fake) Snapshots(name string) ([]*zfs.SnapshotInfo, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if _, err := f.get(name); err != nil {
+		return nil, err
+	}
+	snaps := f.snapshots(name)
+	rv := make([]*zfs.SnapshotInfo, len(snaps))
+	for i, snap := range snaps {
+		rv[i] = &zfs.SnapshotInfo{
+			Name:      snap.name[len(name)+1:],
+			Created:   snap.created,
+			CreateTxg: snap.txg,
+			Clones:    f.clones(snap.name),
+		}
+	}
+	return rv, nil
+}
+
+func (f *Fake) Clone(snapshot, target string, props map[string]string) (*zfs.Dataset, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if snap, err := f.get(snapshot); err != nil {
+		return nil, err
+	} else if snap.typ != "snapshot" {
+		return nil, fmt.Errorf("cannot open '%v': operation only applies to snapshots", snapshot)
+	}
+	if err := f.checkNew(target); err != nil {
+		return nil, err
+	}
+	if err := checkSettable(target, props); err != nil {
+		return nil, err
+	}
+	ds := f.newDataset(target, "filesystem")
+	ds.origin = snapshot
+	for k, v := range props {
+		ds.props[k] = v
+	}
+	f.datasets[target] = ds
+	f.op("clone %v %v", snapshot, target)
+	return f.dataset(ds, nil), nil
+}
+
+func (f *Fake) Rollback(name, snapshot string, force bool) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	snap, err := f.get(name + "@" + snapshot)
+	if err != nil {
+		return err
+	}
+	if f.busy[name] {
+		return fail(zfs.ErrorBusy, "cannot rollback '%v': dataset is busy", name)
+	}
+	var later []*dataset
+	for _, other := range f.snapshots(name) {
+		if other.txg > snap.txg {
+			later = append(later, other)
+		}
+	}
+	if len(later) > 0 {
+		if !force {
+			return fail(zfs.ErrorHasSnapshots, "cannot rollback to '%v': more recent snapshots or bookmarks exist", snap.name)
+		}
+		for _, other := range later {
+			if len(f.clones(other.name)) > 0 {
+				return fail(zfs.ErrorHasClones, "cannot destroy '%v': snapshot has dependent clones", other.name)
+			}
+		}
+		for _, other := range later {
+			delete(f.datasets, other.name)
+		}
+	}
+	if force {
+		f.op("rollback -r %v", snap.name)
+	} else {
+		f.op("rollback %v", snap.name)
+	}
+	return nil
+}
+
+func (f *Fake) Promote(name string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return err
+	}
+	if ds.origin == "" {
+		return fmt.Errorf("cannot promote '%v': not a cloned filesystem", name)
+	}
+	pieces := strings.SplitN(ds.origin, "@", 2)
+	origin, originSnap := f.datasets[pieces[0]], f.datasets[ds.origin]
+	var moved []*dataset
+	for _, snap := range f.snapshots(origin.name) {
+		if snap.txg <= originSnap.txg {
+			if f.datasets[name+snap.name[len(origin.name):]] != nil {
+				return fail(zfs.ErrorExists, "cannot promote '%v': snapshot name conflict %v", name, snap.name)
+			}
+			moved = append(moved, snap)
+		}
+	}
+	renamed := make(map[string]string, len(moved))
+	for _, snap := range moved {
+		delete(f.datasets, snap.name)
+		renamed[snap.name] = name + snap.name[len(origin.name):]
+		snap.name = renamed[snap.name]
+		f.datasets[snap.name] = snap
+	}
+	ds.origin, origin.origin = origin.origin, originSnap.name
+	for _, other := range f.datasets {
+		if other != ds && other != origin {
+			if new, ok := renamed[other.origin]; ok {
+				other.origin = new
+			}
+		}
+	}
+	f.op("promote %v", name)
+	return nil
+}
+
+func (f *Fake) GetProperties(name string, props ...string) (map[string]*zfs.Property, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(props) == 0 {
+		return nil, fmt.Errorf("No properties to get from %v", name)
+	}
+	rv := make(map[string]*zfs.Property, len(props))
+	for _, prop := range props {
+		rv[prop] = f.property(ds, prop)
+	}
+	return rv, nil
+}
+
+func (f *Fake) SetProperty(name, prop, value string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return err
+	}
+	if readonlyProperties[prop] {
+		return fmt.Errorf("cannot set property for '%v': '%v' is readonly", name, prop)
+	}
+	ds.props[prop] = value
+	f.op("set %v=%v %v", prop, value, name)
+	return nil
+}
+
+func (f *Fake) Children(name string, depth int, props ...string) ([]*zfs.Dataset, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	ds, err := f.get(name)
+	if err != nil {
+		return nil, err
+	}
+	var rv []*zfs.Dataset
+	if depth < 0 {
+		rv = append(rv, f.dataset(ds, props))
+	}
+	for _, other := range f.descendants(name) {
+		if strings.Contains(other, "@") {
+			continue
+		}
+		if depth > 0 && strings.Count(other[len(name):], "/") > depth {
+			continue
+		}
+		rv = append(rv, f.dataset(f.datasets[other], props))
+	}
+	return rv, nil
+}
@@ -0,0 +1,140 @@
+package zfstest
+
+import "reflect"
+import "testing"
+
+import "github.com/3ofcoins/jetpack/lib/zfs"
+
+func TestFakeDatasets(t *testing.T) {
+	f := NewFake("tank")
+	if _, err := f.CreateDataset("tank/a", map[string]string{"mountpoint": "/srv", "readonly": "on"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CreateDataset("tank/a", nil); zfs.KindOf(err) != zfs.ErrorExists {
+		t.Errorf("Expected exists error, got %v", err)
+	}
+	if _, err := f.CreateDataset("tank/x/y", nil); zfs.KindOf(err) != zfs.ErrorNoDataset {
+		t.Errorf("Expected no-dataset error, got %v", err)
+	}
+	if _, err := f.CreateDataset("tank/z", map[string]string{"used": "1"}); zfs.KindOf(err) != zfs.ErrorBadProperty {
+		t.Errorf("Expected bad-property error, got %v", err)
+	}
+	if _, err := f.GetDataset("tank/x"); err != zfs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := f.CreateDataset("tank/a/b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CreateDataset("tank/a/b/c", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ds, err := f.GetDataset("tank/a/b"); err != nil {
+		t.Fatal(err)
+	} else if ds.Mountpoint != "/srv/b" {
+		t.Errorf("Unexpected mountpoint %v", ds.Mountpoint)
+	}
+	if props, err := f.GetProperties("tank/a/b", "readonly", "quota"); err != nil {
+		t.Fatal(err)
+	} else if from := props["readonly"].InheritedFrom(); props["readonly"].Value != "on" || from != "tank/a" {
+		t.Errorf("Unexpected readonly %v", props["readonly"])
+	} else if props["quota"].Value != "0" || props["quota"].Source != "default" {
+		t.Errorf("Unexpected quota %v", props["quota"])
+	}
+
+	for depth, expected := range map[int][]string{
+		-1: {"tank/a", "tank/a/b", "tank/a/b/c"},
+		0:  {"tank/a/b", "tank/a/b/c"},
+		1:  {"tank/a/b"},
+	} {
+		dss, err := f.Children("tank/a", depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(dss))
+		for i, ds := range dss {
+			names[i] = ds.Name
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Children(%d): expected %v, got %v", depth, expected, names)
+		}
+	}
+
+	if err := f.Destroy("tank/a", false); err == nil {
+		t.Error("Destroyed dataset with children")
+	}
+	f.SetBusy("tank/a/b/c", true)
+	if err := f.Destroy("tank/a", true); zfs.KindOf(err) != zfs.ErrorBusy {
+		t.Errorf("Expected busy error, got %v", err)
+	}
+	f.SetBusy("tank/a/b/c", false)
+	if err := f.Destroy("tank/a", true); err != nil {
+		t.Fatal(err)
+	}
+	if names := f.Names(); !reflect.DeepEqual(names, []string{"tank"}) {
+		t.Errorf("Unexpected datasets left: %v", names)
+	}
+}
+
+func TestFakeSnapshots(t *testing.T) {
+	f := NewFake("tank")
+	if _, err := f.CreateDataset("tank/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, snap := range []string{"one", "two", "three"} {
+		if err := f.Snapshot("tank/a", snap, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Snapshot("tank/a", "one", nil); zfs.KindOf(err) != zfs.ErrorExists {
+		t.Errorf("Expected exists error, got %v", err)
+	}
+	if _, err := f.Clone("tank/a@two", "tank/b", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Destroy("tank/a@two", false); zfs.KindOf(err) != zfs.ErrorHasClones {
+		t.Errorf("Expected has-clones error, got %v", err)
+	}
+	if err := f.Rollback("tank/a", "one", false); zfs.KindOf(err) != zfs.ErrorHasSnapshots {
+		t.Errorf("Expected has-snapshots error, got %v", err)
+	}
+	if err := f.Rollback("tank/a", "one", true); zfs.KindOf(err) != zfs.ErrorHasClones {
+		t.Errorf("Expected has-clones error, got %v", err)
+	}
+	if err := f.Rollback("tank/a", "two", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Promote("tank/b"); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := f.Snapshots("tank/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].Name != "one" || snaps[1].Name != "two" ||
+		!reflect.DeepEqual(snaps[1].Clones, []string{"tank/a"}) {
+		t.Errorf("Unexpected snapshots after promote: %v", f.Names())
+	}
+	if ds, _ := f.GetDataset("tank/a"); ds.Origin != "tank/b@two" {
+		t.Errorf("Unexpected origin of demoted dataset: %v", ds.Origin)
+	}
+	if err := f.Destroy("tank/a", true); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"create tank/a",
+		"snapshot tank/a@one",
+		"snapshot tank/a@two",
+		"snapshot tank/a@three",
+		"clone tank/a@two tank/b",
+		"rollback -r tank/a@two",
+		"promote tank/b",
+		"destroy -r tank/a",
+	}
+	if !reflect.DeepEqual(f.Ops, expected) {
+		t.Errorf("Expected operations %q, got %q", expected, f.Ops)
+	}
+}
@@ -1,29 +1,147 @@
 #include <sys/param.h>
+#include <sys/ioctl.h>
 #include <sys/jail.h>
+#include <sys/resource.h>
+#include <sys/stat.h>
 
 #include <err.h>
 #include <limits.h>
+#include <login_cap.h>
+#include <pwd.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include <unistd.h>
 
+extern char **environ;
+
 static char *argv0;
 
+static const struct {
+     const char *name;
+     int resource;
+} rlimit_names[] = {
+     { "core", RLIMIT_CORE },
+     { "cpu", RLIMIT_CPU },
+     { "data", RLIMIT_DATA },
+     { "fsize", RLIMIT_FSIZE },
+     { "kqueues", RLIMIT_KQUEUES },
+     { "memlock", RLIMIT_MEMLOCK },
+     { "nofile", RLIMIT_NOFILE },
+     { "nproc", RLIMIT_NPROC },
+     { "npts", RLIMIT_NPTS },
+     { "rss", RLIMIT_RSS },
+     { "sbsize", RLIMIT_SBSIZE },
+     { "stack", RLIMIT_STACK },
+     { "swap", RLIMIT_SWAP },
+     { "vmem", RLIMIT_AS },
+     { NULL, 0 }
+};
+
+#define MAX_RLIMITS 32
+
+static int n_rlimits = 0;
+static struct {
+     int resource;
+     struct rlimit rl;
+} rlimits[MAX_RLIMITS];
+
+static rlim_t parse_rlim(const char *str)
+{
+     char *endp;
+     rlim_t val;
+
+     if ( strcmp(str, "infinity") == 0 ) {
+          return RLIM_INFINITY;
+     }
+     val = strtoull(str, &endp, 10);
+     if ( *endp || !*str ) {
+          errx(1, "invalid rlimit value: %s", str);
+     }
+     return val;
+}
+
+/* NAME=SOFT:HARD */
+static void add_rlimit(char *spec)
+{
+     char *name, *soft;
+     int i;
+
+     if ( n_rlimits == MAX_RLIMITS ) {
+          errx(1, "too many rlimits");
+     }
+     name = strsep(&spec, "=");
+     soft = strsep(&spec, ":");
+     if ( !spec ) {
+          errx(1, "invalid rlimit: %s", name);
+     }
+     for ( i = 0 ; rlimit_names[i].name ; i++ ) {
+          if ( strcmp(rlimit_names[i].name, name) == 0 ) {
+               break;
+          }
+     }
+     if ( !rlimit_names[i].name ) {
+          errx(1, "unknown rlimit: %s", name);
+     }
+     rlimits[n_rlimits].resource = rlimit_names[i].resource;
+     rlimits[n_rlimits].rl.rlim_cur = parse_rlim(soft);
+     rlimits[n_rlimits].rl.rlim_max = parse_rlim(spec);
+     n_rlimits++;
+}
+
 void usage()
 {
-     fprintf(stderr, "Usage: %s JID:UID:GID[,SGID,SGID,...]:APP:CWD [VAR=val...] /PATH/TO/PROG ARG...\n", argv0);
+     fprintf(stderr, "Usage: %s [-e] [-t|-g] [-c CLASS] [-m UMASK] [-r NAME=SOFT:HARD...] JID:UID:GID[,SGID,SGID,...]:APP:CWD [VAR=val...] /PATH/TO/PROG ARG...\n", argv0);
      exit(1);
 }
 
 int main(int argc, char *argv[])
 {
-     int jid, i, ngroups;
+     int jid, i, ngroups, ch, tty = 0, pgrp = 0, n_environ = 0;
+     unsigned int lcflags;
+     long mask = -1;
      uid_t uid;
      gid_t groups[NGROUPS_MAX+1]; /* Is it fine to just preallocate NGROUPS_MAX? */
-     char *cur, *next, *endp, *app, *cwd, *rootdir, **eargv, **eenvp;
+     char *cur, *next, *endp, *app, *cwd, *rootdir, *class = NULL, **eargv, **eenvp;
+     login_cap_t *lc;
 
      argv0 = argv[0];           /* for usage() */
+
+     while ( (ch = getopt(argc, argv, "etc:gm:r:")) != -1 ) {
+          switch ( ch ) {
+          case 'e':
+               /* pass our own environment on, so that it's not in argv */
+               for ( n_environ = 0 ; environ[n_environ] ; n_environ++ );
+               break;
+          case 't':
+               /* stdin is a pty slave, make it the controlling terminal */
+               tty = 1;
+               break;
+          case 'c':
+               /* apply login class from the jail's login.conf */
+               class = optarg;
+               break;
+          case 'g':
+               /* run in a new process group */
+               pgrp = 1;
+               break;
+          case 'm':
+               mask = strtol(optarg, &endp, 8);
+               if ( *endp || !*optarg || mask < 0 || mask > 0777 ) {
+                    errx(1, "invalid umask: %s", optarg);
+               }
+               break;
+          case 'r':
+               add_rlimit(optarg);
+               break;
+          default:
+               usage();
+          }
+     }
+     /* Keep argv[1] pointing at the first non-option argument */
+     argc -= optind - 1;
+     argv += optind - 1;
+
      if ( !(argc>=3) ) {
           usage();
      }
@@ -76,7 +194,7 @@ int main(int argc, char *argv[])
      cwd = next;
 
      /* Biggest possible envp */
-     if ( !(eenvp = calloc(argc-1, sizeof(char*))) ) {
+     if ( !(eenvp = calloc(argc-1+n_environ, sizeof(char*))) ) {
           err(1, "calloc");
      }
 
@@ -89,9 +207,13 @@ int main(int argc, char *argv[])
           err(1, "snprintf");
      }
 
+     for ( i = 0 ; i < n_environ ; i++ ) {
+          eenvp[i+1] = environ[i];
+     }
+
      /* Copy argv to envp until we meet a path or run out of argv */
      for ( i=2 ; i < argc && argv[i] && argv[i][0] != '/' ; i++ ) {
-          eenvp[i-1] = argv[i];
+          eenvp[i-1+n_environ] = argv[i];
      }
 
      /* If we ran out of argv, bomb. */
@@ -106,6 +228,19 @@ int main(int argc, char *argv[])
       * Actual isolation
       */
 
+     if ( tty ) {
+          if ( setsid() < 0 ) {
+               err(1, "setsid");
+          }
+          if ( ioctl(0, TIOCSCTTY, 0) < 0 ) {
+               err(1, "ioctl(TIOCSCTTY)");
+          }
+     } else if ( pgrp ) {
+          if ( setpgid(0, 0) < 0 ) {
+               err(1, "setpgid");
+          }
+     }
+
      if ( jail_attach(jid) < 0 ) {
           err(1, "jail_attach(%d)", jid);
      }
@@ -130,6 +265,37 @@ int main(int argc, char *argv[])
           err(1, "chdir: %s", cwd);
      }
 
+     /* Login class goes first, explicit rlimits and umask override it */
+     if ( class ) {
+          if ( !(lc = login_getclassbyname(class, NULL)) ) {
+               err(1, "login_getclassbyname: %s", class);
+          }
+          if ( strcmp(lc->lc_class, class) != 0 ) {
+               errx(1, "unknown login class: %s", class);
+          }
+          lcflags = LOGIN_SETRESOURCES | LOGIN_SETPRIORITY | LOGIN_SETENV;
+          if ( mask < 0 ) {
+               lcflags |= LOGIN_SETUMASK;
+          }
+          /* Class' environment is set on top of ours */
+          environ = eenvp;
+          if ( setusercontext(lc, getpwuid(uid), uid, lcflags) < 0 ) {
+               err(1, "setusercontext: %s", class);
+          }
+          eenvp = environ;
+          login_close(lc);
+     }
+
+     for ( i = 0 ; i < n_rlimits ; i++ ) {
+          if ( setrlimit(rlimits[i].resource, &rlimits[i].rl) < 0 ) {
+               err(1, "setrlimit(%d)", rlimits[i].resource);
+          }
+     }
+
+     if ( mask >= 0 ) {
+          umask((mode_t)mask);
+     }
+
      if ( setgroups(ngroups, groups) < 0 ) {
           err(1, "setgroups");
      }